@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/client"
+)
+
+// Exit codes, so scripts can tell a missing object from an unreachable server
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitNotFound  = 3
+	exitTransport = 4
+)
+
+// fileConfig is the optional client config file (default ~/.dss-client.json)
+type fileConfig struct {
+	Server  string `json:"server"`
+	APIKey  string `json:"api_key"`
+	Timeout string `json:"timeout"`
+}
+
+type metaFlags map[string]string
+
+func (m metaFlags) String() string { return fmt.Sprint(map[string]string(m)) }
+
+func (m metaFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("metadata must be name=value")
+	}
+	m[strings.ToLower(name)] = val
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	global := flag.NewFlagSet("client", flag.ContinueOnError)
+	var (
+		configPath = global.String("config", defaultConfigPath(), "Client config file")
+		server     = global.String("server", "http://localhost:8080", "Server base URL")
+		apiKey     = global.String("api-key", "", "API key sent with every request")
+		timeout    = global.Duration("timeout", 0, "Request timeout (0 = none)")
+		progress   = global.Bool("progress", false, "Show transfer progress on stderr")
+	)
+	global.Usage = usage(global)
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	// Config file values apply only where the flag wasn't given
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	set := make(map[string]bool)
+	global.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["server"] && cfg.Server != "" {
+		*server = cfg.Server
+	}
+	if !set["api-key"] && cfg.APIKey != "" {
+		*apiKey = cfg.APIKey
+	}
+	if !set["timeout"] && cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid timeout in %s: %v\n", *configPath, err)
+			return exitUsage
+		}
+		*timeout = d
+	}
+
+	if global.NArg() == 0 {
+		global.Usage()
+		return exitUsage
+	}
+
+	c := client.New(*server, *apiKey, *timeout)
+	cmd := &command{client: c, progress: *progress, ctx: context.Background()}
+
+	name, rest := global.Arg(0), global.Args()[1:]
+	switch name {
+	case "put":
+		err = cmd.put(rest)
+	case "get":
+		err = cmd.get(rest)
+	case "head":
+		err = cmd.head(rest)
+	case "stat":
+		err = cmd.stat(rest)
+	case "ls":
+		err = cmd.ls(rest)
+	case "rm":
+		err = cmd.rm(rest)
+	case "tiering":
+		err = cmd.tiering(rest)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		global.Usage()
+		return exitUsage
+	}
+
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	var usageErr usageError
+	var transportErr *client.TransportError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	case errors.Is(err, client.ErrNotFound):
+		fmt.Fprintln(os.Stderr, err)
+		return exitNotFound
+	case errors.As(err, &transportErr):
+		fmt.Fprintln(os.Stderr, err)
+		return exitTransport
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage: client [flags] <command> [args]
+
+Commands:
+  put <key> [file|-]     upload a file (or stdin)
+  get <key>              download to stdout or -o file
+  head <key>             show response headers for an object
+  stat <key>             show object metadata as JSON
+  ls                     list objects
+  rm <key>               delete an object
+  tiering recommendations
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".dss-client.json")
+}
+
+func loadConfig(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+type command struct {
+	client   *client.Client
+	progress bool
+	ctx      context.Context
+}
+
+func (c *command) put(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	contentType := fs.String("content-type", "", "Content-Type (default: guessed from the file name)")
+	checksum := fs.String("checksum", "", "Checksum algorithm: md5, sha256 or crc32c (default: server's choice)")
+	meta := metaFlags{}
+	fs.Var(meta, "meta", "User metadata as name=value (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid put arguments")
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usageError("usage: put [flags] <key> [file|-]")
+	}
+
+	key, source := fs.Arg(0), "-"
+	if fs.NArg() == 2 {
+		source = fs.Arg(1)
+	}
+
+	opts := client.PutOptions{ContentType: *contentType, Metadata: meta, Size: -1, ChecksumAlgorithm: *checksum}
+
+	var body io.Reader = os.Stdin
+	if source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		body, opts.Size = file, info.Size()
+		if opts.ContentType == "" {
+			opts.ContentType = mime.TypeByExtension(filepath.Ext(source))
+		}
+	}
+
+	if c.progress {
+		counter := newProgress("upload", opts.Size)
+		defer counter.finish()
+		body = io.TeeReader(body, counter)
+	}
+
+	obj, err := c.client.Put(c.ctx, key, body, opts)
+	if err != nil {
+		return err
+	}
+	return printJSON(obj)
+}
+
+func (c *command) get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	output := fs.String("o", "-", "Output file (- for stdout)")
+	byteRange := fs.String("range", "", "Byte range START-END (END optional)")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid get arguments")
+	}
+	if fs.NArg() != 1 {
+		return usageError("usage: get [flags] <key>")
+	}
+
+	var opts client.GetOptions
+	if *byteRange != "" {
+		r, err := parseRange(*byteRange)
+		if err != nil {
+			return usageError(err.Error())
+		}
+		opts.Range = r
+	}
+
+	reader, info, err := c.client.Get(c.ctx, fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if c.progress {
+		counter := newProgress("download", info.Size)
+		defer counter.finish()
+		out = io.MultiWriter(out, counter)
+	}
+
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func (c *command) head(args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: head <key>")
+	}
+	info, err := c.client.Head(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Content-Length: %d\n", info.Size)
+	fmt.Printf("Content-Type: %s\n", info.ContentType)
+	fmt.Printf("ETag: %s\n", info.ETag)
+	fmt.Printf("X-Checksum: %s (%s)\n", info.Checksum, info.ChecksumAlgorithm)
+	for name, value := range info.Metadata {
+		fmt.Printf("X-Meta-%s: %s\n", name, value)
+	}
+	return nil
+}
+
+func (c *command) stat(args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: stat <key>")
+	}
+	info, err := c.client.Head(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(info)
+}
+
+func (c *command) ls(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "Only list keys with this prefix")
+	asJSON := fs.Bool("json", false, "Print JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return usageError("invalid ls arguments")
+	}
+
+	objects, err := c.client.List(c.ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(objects)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tTIER\tUPDATED")
+	for _, obj := range objects {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", obj.Key, obj.Size, obj.StorageTier, obj.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (c *command) rm(args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: rm <key>")
+	}
+	return c.client.Delete(c.ctx, args[0])
+}
+
+func (c *command) tiering(args []string) error {
+	if len(args) != 1 || args[0] != "recommendations" {
+		return usageError("usage: tiering recommendations")
+	}
+	recommendations, err := c.client.Recommendations(c.ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(recommendations)
+}
+
+func parseRange(value string) (*client.ByteRange, error) {
+	start, end, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("range must be START-END")
+	}
+	r := &client.ByteRange{End: -1}
+	var err error
+	if r.Start, err = strconv.ParseInt(start, 10, 64); err != nil || r.Start < 0 {
+		return nil, fmt.Errorf("invalid range start %q", start)
+	}
+	if end != "" {
+		if r.End, err = strconv.ParseInt(end, 10, 64); err != nil || r.End < r.Start {
+			return nil, fmt.Errorf("invalid range end %q", end)
+		}
+	}
+	return r, nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// progress counts bytes written through it and reports to stderr twice a second
+type progress struct {
+	label string
+	total int64
+	done  atomic.Int64
+	stop  chan struct{}
+}
+
+func newProgress(label string, total int64) *progress {
+	p := &progress{label: label, total: total, stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progress) report() {
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %d/%d bytes (%.0f%%)", p.label, p.done.Load(), p.total, 100*float64(p.done.Load())/float64(p.total))
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s: %d bytes", p.label, p.done.Load())
+	}
+}
+
+func (p *progress) finish() {
+	close(p.stop)
+	p.report()
+	fmt.Fprintln(os.Stderr)
+}
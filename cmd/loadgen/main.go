@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/client"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+type options struct {
+	server      string
+	apiKey      string
+	duration    time.Duration
+	rampUp      time.Duration
+	concurrency int
+	keys        int
+	keyPrefix   string
+	zipf        float64
+	readPct     int
+	writePct    int
+	deletePct   int
+	sizeDist    string
+	size        int64
+	sizeMax     int64
+	prefill     bool
+	replay      string
+	replaySpeed float64
+	jsonOut     bool
+	seed        int64
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.server, "server", "http://localhost:8080", "Target server base URL")
+	flag.StringVar(&opts.apiKey, "api-key", "", "API key sent with every request")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "How long to generate load")
+	flag.DurationVar(&opts.rampUp, "ramp-up", 0, "Spread worker start-up over this long")
+	flag.IntVar(&opts.concurrency, "concurrency", 8, "Number of concurrent workers")
+	flag.IntVar(&opts.keys, "keys", 1000, "Size of the key space")
+	flag.StringVar(&opts.keyPrefix, "key-prefix", "loadgen-", "Prefix for generated keys")
+	flag.Float64Var(&opts.zipf, "zipf", 0, "Zipf skew s (> 1) for key selection, 0 for uniform")
+	flag.IntVar(&opts.readPct, "read", 80, "Percentage of reads")
+	flag.IntVar(&opts.writePct, "write", 15, "Percentage of writes")
+	flag.IntVar(&opts.deletePct, "delete", 5, "Percentage of deletes")
+	flag.StringVar(&opts.sizeDist, "size-dist", "fixed", "Object size distribution: fixed, uniform or lognormal")
+	flag.Int64Var(&opts.size, "size", 4096, "Object size in bytes (fixed), minimum (uniform) or median (lognormal)")
+	flag.Int64Var(&opts.sizeMax, "size-max", 1024*1024, "Largest object size for uniform and lognormal")
+	flag.BoolVar(&opts.prefill, "prefill", false, "Write every key once before the run")
+	flag.StringVar(&opts.replay, "replay", "", "Replay a recorded access-pattern file (JSON lines) instead of a synthetic mix")
+	flag.Float64Var(&opts.replaySpeed, "replay-speed", 1, "Time compression factor for -replay (2 = twice as fast)")
+	flag.BoolVar(&opts.jsonOut, "json", false, "Print results as JSON")
+	flag.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "Random seed")
+	flag.Parse()
+
+	if opts.readPct+opts.writePct+opts.deletePct != 100 {
+		log.Fatalf("-read, -write and -delete must add up to 100")
+	}
+	if opts.concurrency < 1 || opts.keys < 1 {
+		log.Fatalf("-concurrency and -keys must be positive")
+	}
+	if opts.zipf != 0 && opts.zipf <= 1 {
+		log.Fatalf("-zipf must be greater than 1")
+	}
+
+	c := client.New(opts.server, opts.apiKey, 60*time.Second)
+	gen := newGenerator(opts)
+	stats := newStats()
+
+	if opts.prefill {
+		log.Printf("Prefilling %d keys...", opts.keys)
+		for i := 0; i < opts.keys; i++ {
+			gen.write(context.Background(), c, gen.key(i), rand.New(rand.NewSource(opts.seed+int64(i))))
+		}
+	}
+
+	var elapsed time.Duration
+	if opts.replay != "" {
+		elapsed = runReplay(c, gen, stats, opts)
+	} else {
+		elapsed = runSynthetic(c, gen, stats, opts)
+	}
+
+	report := stats.report(elapsed)
+	if opts.jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+	report.print()
+}
+
+// generator produces keys and payloads
+type generator struct {
+	opts    options
+	payload []byte // shared source for upload bodies, sized to the largest object
+}
+
+func newGenerator(opts options) *generator {
+	max := opts.size
+	if opts.sizeDist != "fixed" && opts.sizeMax > max {
+		max = opts.sizeMax
+	}
+	payload := make([]byte, max)
+	rand.New(rand.NewSource(opts.seed)).Read(payload)
+	return &generator{opts: opts, payload: payload}
+}
+
+func (g *generator) key(i int) string {
+	return g.opts.keyPrefix + strconv.Itoa(i)
+}
+
+func (g *generator) objectSize(rng *rand.Rand) int64 {
+	switch g.opts.sizeDist {
+	case "uniform":
+		if g.opts.sizeMax <= g.opts.size {
+			return g.opts.size
+		}
+		return g.opts.size + rng.Int63n(g.opts.sizeMax-g.opts.size+1)
+	case "lognormal":
+		size := int64(float64(g.opts.size) * math.Exp(rng.NormFloat64()))
+		if size < 1 {
+			size = 1
+		}
+		if size > g.opts.sizeMax {
+			size = g.opts.sizeMax
+		}
+		return size
+	default:
+		return g.opts.size
+	}
+}
+
+func (g *generator) write(ctx context.Context, c *client.Client, key string, rng *rand.Rand) (int64, error) {
+	size := g.objectSize(rng)
+	_, err := c.Put(ctx, key, bytes.NewReader(g.payload[:size]), client.PutOptions{
+		ContentType: "application/octet-stream",
+		Size:        size,
+	})
+	return size, err
+}
+
+func (g *generator) read(ctx context.Context, c *client.Client, key string) (int64, error) {
+	reader, _, err := c.Get(ctx, key, client.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(io.Discard, reader)
+}
+
+func runSynthetic(c *client.Client, gen *generator, stats *stats, opts options) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < opts.concurrency; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			if opts.rampUp > 0 {
+				delay := opts.rampUp * time.Duration(worker) / time.Duration(opts.concurrency)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			rng := rand.New(rand.NewSource(opts.seed + int64(worker)))
+			var zipf *rand.Zipf
+			if opts.zipf > 1 {
+				zipf = rand.NewZipf(rng, opts.zipf, 1, uint64(opts.keys-1))
+			}
+
+			for ctx.Err() == nil {
+				var idx int
+				if zipf != nil {
+					idx = int(zipf.Uint64())
+				} else {
+					idx = rng.Intn(opts.keys)
+				}
+				key := gen.key(idx)
+
+				roll := rng.Intn(100)
+				opStart := time.Now()
+				var op string
+				var n int64
+				var err error
+				switch {
+				case roll < opts.readPct:
+					op = "read"
+					n, err = gen.read(ctx, c, key)
+				case roll < opts.readPct+opts.writePct:
+					op = "write"
+					n, err = gen.write(ctx, c, key, rng)
+				default:
+					op = "delete"
+					err = c.Delete(ctx, key)
+				}
+
+				// Requests cut off by the end of the run aren't real failures
+				if ctx.Err() != nil {
+					return
+				}
+				stats.record(op, time.Since(opStart), n, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+// runReplay issues the operations from a recorded access-pattern file at their original
+// relative times (scaled by -replay-speed), using up to -concurrency requests in flight
+func runReplay(c *client.Client, gen *generator, stats *stats, opts options) time.Duration {
+	patterns, err := loadPatterns(opts.replay)
+	if err != nil {
+		log.Fatalf("Failed to load replay file: %v", err)
+	}
+	if len(patterns) == 0 {
+		log.Fatalf("Replay file %s has no access patterns", opts.replay)
+	}
+
+	sort.Slice(patterns, func(i, j int) bool { return patterns[i].AccessTime.Before(patterns[j].AccessTime) })
+	origin := patterns[0].AccessTime
+
+	ctx := context.Background()
+	slots := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for _, pattern := range patterns {
+		offset := time.Duration(float64(pattern.AccessTime.Sub(origin)) / opts.replaySpeed)
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(p models.AccessPattern) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			key := opts.keyPrefix + p.ObjectID
+			rng := rand.New(rand.NewSource(p.AccessTime.UnixNano()))
+			opStart := time.Now()
+			var n int64
+			var err error
+			switch p.Operation {
+			case "write":
+				size := p.Size
+				if size <= 0 || size > int64(len(gen.payload)) {
+					size = gen.objectSize(rng)
+				}
+				_, err = c.Put(ctx, key, bytes.NewReader(gen.payload[:size]), client.PutOptions{Size: size})
+				n = size
+			case "delete":
+				err = c.Delete(ctx, key)
+			default:
+				n, err = gen.read(ctx, c, key)
+			}
+			stats.record(p.Operation, time.Since(opStart), n, err)
+		}(pattern)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+// loadPatterns reads access patterns as JSON lines, or as a single JSON array
+func loadPatterns(path string) ([]models.AccessPattern, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []models.AccessPattern
+	if err := json.Unmarshal(data, &patterns); err == nil {
+		return patterns, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var p models.AccessPattern
+		if err := json.Unmarshal(line, &p); err != nil {
+			return nil, fmt.Errorf("invalid access pattern line: %v", err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+type stats struct {
+	mutex     sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int // by status code or "transport"
+	bytes     int64
+}
+
+func newStats() *stats {
+	return &stats{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+}
+
+func (s *stats) record(op string, latency time.Duration, n int64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latencies[op] = append(s.latencies[op], latency)
+	s.bytes += n
+	if err != nil {
+		s.errors[errorClass(err)]++
+	}
+}
+
+func errorClass(err error) string {
+	var apiErr *client.APIError
+	var transportErr *client.TransportError
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		return "404"
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode)
+	case errors.As(err, &transportErr):
+		return "transport"
+	default:
+		return "other"
+	}
+}
+
+type opReport struct {
+	Count int     `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+type report struct {
+	DurationSec    float64             `json:"duration_sec"`
+	TotalOps       int                 `json:"total_ops"`
+	OpsPerSec      float64             `json:"ops_per_sec"`
+	BytesPerSec    float64             `json:"bytes_per_sec"`
+	Operations     map[string]opReport `json:"operations"`
+	ErrorsByStatus map[string]int      `json:"errors_by_status"`
+}
+
+func (s *stats) report(elapsed time.Duration) *report {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := &report{
+		DurationSec:    elapsed.Seconds(),
+		Operations:     make(map[string]opReport),
+		ErrorsByStatus: s.errors,
+	}
+	for op, latencies := range s.latencies {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.TotalOps += len(latencies)
+		r.Operations[op] = opReport{
+			Count: len(latencies),
+			P50Ms: percentile(latencies, 0.50),
+			P95Ms: percentile(latencies, 0.95),
+			P99Ms: percentile(latencies, 0.99),
+			MaxMs: percentile(latencies, 1.0),
+		}
+	}
+	if elapsed > 0 {
+		r.OpsPerSec = float64(r.TotalOps) / elapsed.Seconds()
+		r.BytesPerSec = float64(s.bytes) / elapsed.Seconds()
+	}
+	return r
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
+
+func (r *report) print() {
+	fmt.Printf("Duration:    %.1fs\n", r.DurationSec)
+	fmt.Printf("Operations:  %d (%.1f ops/s, %.1f KB/s)\n", r.TotalOps, r.OpsPerSec, r.BytesPerSec/1024)
+	fmt.Println()
+	fmt.Printf("%-8s %8s %10s %10s %10s %10s\n", "op", "count", "p50 ms", "p95 ms", "p99 ms", "max ms")
+	for _, op := range []string{"read", "write", "delete"} {
+		o, ok := r.Operations[op]
+		if !ok {
+			continue
+		}
+		fmt.Printf("%-8s %8d %10.2f %10.2f %10.2f %10.2f\n", op, o.Count, o.P50Ms, o.P95Ms, o.P99Ms, o.MaxMs)
+	}
+	if len(r.ErrorsByStatus) > 0 {
+		fmt.Println()
+		fmt.Println("Errors:")
+		for status, count := range r.ErrorsByStatus {
+			fmt.Printf("  %-10s %d\n", status, count)
+		}
+	}
+}
@@ -1,50 +1,676 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/9ifrashaikh/distributed-system/internal/accesslog"
 	"github.com/9ifrashaikh/distributed-system/internal/api"
+	"github.com/9ifrashaikh/distributed-system/internal/autotier"
+	"github.com/9ifrashaikh/distributed-system/internal/catalog"
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/config"
+	"github.com/9ifrashaikh/distributed-system/internal/lifecycle"
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
 	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/upload"
+	"github.com/9ifrashaikh/distributed-system/internal/usage"
 )
 
+// version is what this node tells the others it runs, set with
+// -ldflags "-X main.version=...". Without it the version Go recorded in the binary is used.
+var version string
+
 func main() {
 	var (
-		port      = flag.String("port", "8080", "Server port")
-		storePath = flag.String("storage", "./data", "Storage directory")
+		configPath  = flag.String("config", "", "Path to a JSON config file")
+		printConfig = flag.Bool("print-config", false, "Print the effective configuration and exit")
+		port        = flag.String("port", "8080", "Server port")
+		storePath   = flag.String("storage", "./data", "Storage directory")
+		quota       = flag.Int64("quota", 0, "Maximum bytes of object data to store (0 = unlimited)")
+		cacheBytes  = flag.Int64("cache-size", 128<<20, "Bytes of memory for caching small objects (0 = no cache)")
+		cacheMax    = flag.Int64("cache-max-object", 256<<10, "Largest object the cache holds, in bytes")
+		encryption  = flag.String("encryption-keys", "", "Comma-separated master keys for encryption at rest (id:base64-key, newest last)")
+		backend     = flag.String("backend", "file", "Object storage backend: file, s3 or tiered (storage.tier_backends)")
+		metaBackend = flag.String("metadata-backend", "json", "Where the file backend keeps object metadata: json or kv")
+		migrateMeta = flag.Bool("migrate-metadata", false, "Import the JSON metadata catalog into the kv metadata backend and exit")
+		hotDir      = flag.String("hot-dir", "", "Directory for hot tier data (default: under the storage directory)")
+		warmDir     = flag.String("warm-dir", "", "Directory for warm tier data (default: under the storage directory)")
+		coldDir     = flag.String("cold-dir", "", "Directory for cold tier data (default: under the storage directory)")
+		s3Endpoint  = flag.String("s3-endpoint", "", "S3 endpoint URL (s3 backend)")
+		s3Bucket    = flag.String("s3-bucket", "", "S3 bucket (s3 backend)")
+		s3Region    = flag.String("s3-region", "", "S3 region (s3 backend, default us-east-1)")
+		s3AccessKey = flag.String("s3-access-key", "", "S3 access key (s3 backend, default $AWS_ACCESS_KEY_ID)")
+		s3SecretKey = flag.String("s3-secret-key", "", "S3 secret key (s3 backend, default $AWS_SECRET_ACCESS_KEY)")
+		nodeID      = flag.String("node-id", "", "Cluster node ID (default: generated and persisted in the storage directory)")
+		forceID     = flag.Bool("force-node-id", false, "Run as -node-id even if the storage directory belongs to another node ID")
+		nodeAddress = flag.String("node-address", "", "Address advertised to cluster peers (host:port)")
+		peers       = flag.String("peers", "", "Comma-separated seed peer addresses to join")
+		zone        = flag.String("zone", "", "Zone this node runs in, for spreading replicas")
+		rack        = flag.String("rack", "", "Rack this node runs in, for spreading replicas within a zone")
+		capacity    = flag.Int64("capacity", 0, "Bytes this node offers the cluster (0 = size of the disk under -storage)")
+		secret      = flag.String("cluster-secret", "", "Comma-separated tokens nodes authenticate to each other with, the first one sent")
+		replicas    = flag.Int("replication-factor", 2, "Number of other nodes each object written here is copied to")
+		consistency = flag.String("write-consistency", "1", "Copies a PUT waits for by default: 1, quorum or all")
+		compression = flag.String("replication-compression", "none", "Encoding replicas are sent to other nodes in: gzip or none")
+		fsckRepair  = flag.Bool("fsck-repair", false, "Apply safe repairs found by --fsck")
+		fsck        fsckMode
 	)
+	flag.Var(&fsck, "fsck", "Check storage consistency before serving (--fsck or --fsck=deep)")
 	flag.Parse()
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Flags given explicitly on the command line take precedence over file and env
+	applyFlags := func(c *config.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				c.Server.Port = *port
+			case "storage":
+				c.Storage.Path = *storePath
+			case "quota":
+				c.Storage.QuotaBytes = *quota
+			case "cache-size":
+				c.Storage.CacheBytes = *cacheBytes
+			case "cache-max-object":
+				c.Storage.CacheMaxObject = *cacheMax
+			case "encryption-keys":
+				c.Storage.EncryptionKeys = splitList(*encryption)
+			case "backend":
+				c.Storage.Backend = *backend
+			case "metadata-backend":
+				c.Storage.MetadataBackend = *metaBackend
+			case "hot-dir":
+				c.Storage.HotDir = *hotDir
+			case "warm-dir":
+				c.Storage.WarmDir = *warmDir
+			case "cold-dir":
+				c.Storage.ColdDir = *coldDir
+			case "s3-endpoint":
+				c.Storage.S3.Endpoint = *s3Endpoint
+			case "s3-bucket":
+				c.Storage.S3.Bucket = *s3Bucket
+			case "s3-region":
+				c.Storage.S3.Region = *s3Region
+			case "s3-access-key":
+				c.Storage.S3.AccessKey = *s3AccessKey
+			case "s3-secret-key":
+				c.Storage.S3.SecretKey = *s3SecretKey
+			case "node-id":
+				c.Cluster.NodeID = *nodeID
+			case "node-address":
+				c.Cluster.Address = *nodeAddress
+			case "peers":
+				c.Cluster.Peers = splitList(*peers)
+			case "zone":
+				c.Cluster.Zone = *zone
+			case "rack":
+				c.Cluster.Rack = *rack
+			case "capacity":
+				c.Cluster.Capacity = *capacity
+			case "cluster-secret":
+				c.Auth.ClusterSecret = *secret
+			case "replication-factor":
+				c.Replication.Factor = *replicas
+			case "write-consistency":
+				c.Replication.WriteConsistency = *consistency
+			case "replication-compression":
+				c.Replication.Compression = *compression
+			}
+		})
+	}
+	applyFlags(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if *printConfig {
+		data, _ := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	if *migrateMeta {
+		n, err := storage.MigrateMetadata(cfg.Storage.Path)
+		if err != nil {
+			log.Fatalf("Failed to migrate metadata: %v", err)
+		}
+		log.Printf("Migrated %d objects to the kv metadata backend; start with --metadata-backend=kv from now on", n)
+		return
+	}
+
 	// Initialize storage
-	store := storage.NewFileStore(*storePath)
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	if fsck != "" {
+		checker, ok := store.(storage.Checker)
+		if !ok {
+			log.Fatalf("The %s backend does not support --fsck", cfg.Storage.Backend)
+		}
+		report := checker.Fsck(storage.FsckOptions{Deep: fsck == "deep", Repair: *fsckRepair})
+		data, _ := json.MarshalIndent(report, "", "  ")
+		os.Stdout.Write(append(data, '\n'))
+		if !report.Clean() {
+			log.Fatalf("fsck found %d unrepaired problems, refusing to start", report.Unrepaired)
+		}
+		log.Printf("fsck passed (%d objects checked, %d problems repaired)", report.ObjectsChecked, len(report.Problems))
+	}
+
+	components := lifecycle.NewManager()
+	components.Register("storage", store, lifecycle.Options{Critical: true})
 
 	// Initialize API server
 	apiServer := api.NewAPIServer(store)
 
+	tracker, err := usage.NewTracker(filepath.Join(cfg.Storage.Path, "usage"), store)
+	if err != nil {
+		log.Fatalf("Failed to start usage tracking: %v", err)
+	}
+	apiServer.SetUsageTracker(tracker)
+	components.Register("usage", tracker, lifecycle.Options{DependsOn: []string{"storage"}})
+
+	accessLog, err := accesslog.Open(filepath.Join(cfg.Storage.Path, "access"), cfg.Tiering.AccessRetention.Duration)
+	if err != nil {
+		log.Fatalf("Failed to open the access log: %v", err)
+	}
+	if err := apiServer.SetAccessLog(accessLog); err != nil {
+		log.Printf("Failed to load the access log: %v", err)
+	}
+	if stats := accessLog.Stats(); stats.Loaded > 0 {
+		log.Printf("Loaded %d accesses from %s to %s", stats.Loaded, stats.Oldest.Format(time.RFC3339), stats.Newest.Format(time.RFC3339))
+	}
+	components.Register("access", accessLog, lifecycle.Options{})
+
+	uploads, err := upload.NewManager(filepath.Join(cfg.Storage.Path, "uploads"), store, cfg.Storage.UploadTTL.Duration)
+	if err != nil {
+		log.Fatalf("Failed to start resumable uploads: %v", err)
+	}
+	apiServer.SetUploadManager(uploads)
+	components.Register("uploads", uploads, lifecycle.Options{DependsOn: []string{"storage"}})
+
+	sweeper := storage.NewExpirySweeper(store, cfg.Storage.ExpirySweep.Duration)
+	components.Register("expiry", sweeper, lifecycle.Options{DependsOn: []string{"storage"}})
+
+	scrubber := storage.NewScrubber(store, cfg.Storage.ScrubInterval.Duration)
+	components.Register("scrub", scrubber, lifecycle.Options{DependsOn: []string{"storage"}})
+
+	gc := storage.NewGarbageCollector(store, cfg.Storage.GCInterval.Duration, cfg.Storage.GCGrace.Duration)
+	apiServer.SetGarbageCollector(gc)
+	components.Register("gc", gc, lifecycle.Options{DependsOn: []string{"storage"}})
+
+	reloader := config.NewReloader(*configPath, cfg, applyFlags)
+	apiServer.SetReloader(reloader)
+
+	// Settings that can change without a restart are applied now and again on every reload
+	live := func(prefixes []string, apply func(*config.Config)) {
+		apply(cfg)
+		reloader.OnChange(prefixes, apply)
+	}
+	live([]string{"server.rate_limit", "server.rate_burst"}, func(c *config.Config) {
+		apiServer.SetRateLimit(c.Server.RateLimit, c.Server.RateBurst)
+	})
+	live([]string{"auth.api_keys"}, func(c *config.Config) {
+		apiServer.SetAdminKeys(c.Auth.APIKeys)
+	})
+	live([]string{"storage.checksum_algorithm"}, func(c *config.Config) {
+		if err := store.SetDefaultChecksum(c.Storage.ChecksumAlgorithm); err != nil {
+			log.Printf("Failed to apply checksum algorithm: %v", err)
+		}
+	})
+	if fileStore, ok := store.(*storage.FileStore); ok {
+		live([]string{"storage.versioning"}, func(c *config.Config) {
+			fileStore.SetVersioning(c.Storage.Versioning)
+		})
+		live([]string{"storage.dedup"}, func(c *config.Config) {
+			if err := fileStore.SetDedup(c.Storage.Dedup); err != nil {
+				log.Printf("Failed to apply dedup setting: %v", err)
+			}
+		})
+		live([]string{"storage.encryption_keys"}, func(c *config.Config) {
+			// Already validated
+			keys, _ := storage.ParseMasterKeys(c.Storage.EncryptionKeys)
+			fileStore.SetEncryption(keys)
+		})
+		live([]string{"storage.verify_reads"}, func(c *config.Config) {
+			fileStore.SetVerifyReads(c.Storage.VerifyReads)
+		})
+		live([]string{"storage.hot_dir", "storage.warm_dir", "storage.cold_dir"}, func(c *config.Config) {
+			err := fileStore.SetTierDirs(map[string]string{
+				storage.TierHot:  c.Storage.HotDir,
+				storage.TierWarm: c.Storage.WarmDir,
+				storage.TierCold: c.Storage.ColdDir,
+			})
+			if err != nil {
+				log.Printf("Failed to apply tier directories: %v", err)
+			}
+		})
+	} else if cfg.Storage.Versioning || cfg.Storage.Dedup || len(cfg.Storage.EncryptionKeys) > 0 || cfg.Storage.VerifyReads ||
+		cfg.Storage.HotDir != "" || cfg.Storage.WarmDir != "" || cfg.Storage.ColdDir != "" {
+		log.Printf("Versioning, dedup, encryption, read verification and tier directories are not supported by the %s backend, ignoring them", cfg.Storage.Backend)
+	}
+	if limiter, ok := store.(storage.Limiter); ok {
+		live([]string{"storage.quota_bytes"}, func(c *config.Config) {
+			limiter.SetQuota(c.Storage.QuotaBytes)
+		})
+		live([]string{"storage.owner_quota_bytes"}, func(c *config.Config) {
+			limiter.SetOwnerQuotas(c.Storage.OwnerQuotaBytes)
+		})
+	} else if cfg.Storage.QuotaBytes > 0 || len(cfg.Storage.OwnerQuotaBytes) > 0 {
+		log.Printf("Quotas are not supported by the %s backend, ignoring storage.quota_bytes and storage.owner_quota_bytes", cfg.Storage.Backend)
+	}
+	// Only an optimization, so backends without a cache just go without
+	if cacher, ok := store.(storage.Cacher); ok {
+		live([]string{"storage.cache_bytes", "storage.cache_max_object"}, func(c *config.Config) {
+			cacher.SetCache(c.Storage.CacheBytes, c.Storage.CacheMaxObject)
+		})
+	}
+	live([]string{"storage.expiry_sweep"}, func(c *config.Config) {
+		sweeper.SetInterval(c.Storage.ExpirySweep.Duration)
+	})
+	live([]string{"storage.scrub_interval"}, func(c *config.Config) {
+		scrubber.SetInterval(c.Storage.ScrubInterval.Duration)
+	})
+	live([]string{"storage.gc_interval", "storage.gc_grace"}, func(c *config.Config) {
+		gc.SetInterval(c.Storage.GCInterval.Duration)
+		gc.SetGrace(c.Storage.GCGrace.Duration)
+	})
+	live([]string{"replication.max_factor"}, func(c *config.Config) {
+		apiServer.SetMaxReplicationFactor(c.Replication.MaxFactor)
+	})
+	// Rules saved through the API outlive restarts and win over the configured ones, until
+	// the configured ones are changed in turn
+	rules, err := ml.OpenRuleStore(filepath.Join(cfg.Storage.Path, "tiering_rules.json"), apiServer.Classifier())
+	if err != nil {
+		log.Fatalf("Failed to load tiering rules: %v", err)
+	}
+	apiServer.SetRuleStore(rules)
+	if rules.Saved() {
+		log.Printf("Using the tiering rules last set through the API over the configured ones")
+	} else if err := apiServer.Classifier().SetRules(cfg.Tiering.Rules); err != nil {
+		log.Printf("Failed to apply tiering rules: %v", err)
+	}
+	reloader.OnChange([]string{"tiering.rules"}, func(c *config.Config) {
+		if _, err := rules.Update(c.Tiering.Rules, "config"); err != nil {
+			log.Printf("Failed to apply tiering rules: %v", err)
+		}
+	})
+	live([]string{"tiering.access_retention"}, func(c *config.Config) {
+		accessLog.SetRetention(c.Tiering.AccessRetention.Duration)
+	})
+	// Read from the reloader when shutdown starts
+	live([]string{"server.shutdown_timeout"}, func(*config.Config) {})
+
+	locks, err := lock.NewManager(filepath.Join(cfg.Storage.Path, "locks", "leases.json"))
+	if err != nil {
+		log.Fatalf("Failed to load object locks: %v", err)
+	}
+	apiServer.SetLockManager(locks)
+	components.Register("locks", locks, lifecycle.Options{})
+
+	shadower, err := shadow.New(cfg.Shadow)
+	if err != nil {
+		log.Fatalf("Invalid shadow settings: %v", err)
+	}
+	apiServer.SetShadower(shadower)
+	components.Register("shadow", shadower, lifecycle.Options{})
+	reloader.OnChange([]string{"shadow"}, func(c *config.Config) {
+		if err := shadower.Configure(c.Shadow); err != nil {
+			log.Printf("Failed to apply shadow settings: %v", err)
+		}
+	})
+
+	tierer := autotier.New(store, apiServer.Classifier())
+	tierer.SetLocks(locks)
+	apiServer.SetAutoTierer(tierer)
+	live([]string{"tiering.auto"}, func(c *config.Config) {
+		tierer.Configure(autotier.Settings{
+			Enabled:       c.Tiering.Auto.Enabled,
+			DryRun:        c.Tiering.Auto.DryRun,
+			Interval:      c.Tiering.Auto.Interval.Duration,
+			MinConfidence: c.Tiering.Auto.MinConfidence,
+			MaxObjects:    c.Tiering.Auto.MaxObjects,
+			MaxBytes:      c.Tiering.Auto.MaxBytes,
+
+			PreloadBytes:    c.Tiering.Auto.PreloadBytes,
+			PrefetchHorizon: c.Tiering.Auto.PrefetchHorizon.Duration,
+		})
+	})
+	components.Register("autotier", tierer, lifecycle.Options{DependsOn: []string{"storage", "access"}})
+
+	serverDeps := []string{"storage", "usage", "access", "uploads", "expiry", "scrub", "gc", "locks", "shadow", "autotier"}
+
+	// Cluster mode is opt-in: without an advertised address or peers we stay standalone
+	var cm *cluster.ClusterManager
+	var rm *replication.ReplicationManager
+	if cfg.Cluster.Address != "" || len(cfg.Cluster.Peers) > 0 {
+		cm, rm = setupCluster(cfg, store, *forceID)
+		apiServer.EnableCluster(cm, rm)
+
+		live([]string{"cluster.event_log_size", "cluster.event_log_max_bytes", "cluster.event_log_files"}, func(c *config.Config) {
+			path := filepath.Join(c.Storage.Path, "cluster_events.jsonl")
+			if err := cm.SetEventLog(path, c.Cluster.EventLogSize, c.Cluster.EventLogMaxBytes, c.Cluster.EventLogFiles); err != nil {
+				log.Printf("Cluster events kept in memory only: %v", err)
+			}
+		})
+		live([]string{"cluster.partition_writes"}, func(c *config.Config) {
+			cm.SetPartitionWrites(c.Cluster.PartitionWrites)
+		})
+		live([]string{"cluster.forwarding"}, func(c *config.Config) {
+			apiServer.SetForwarding(c.Cluster.Forwarding)
+		})
+		live([]string{"auth.cluster_secret"}, func(c *config.Config) {
+			cm.SetClusterSecret(c.Auth.ClusterSecret)
+		})
+		live([]string{"cluster.health_check_interval"}, func(c *config.Config) {
+			cm.SetHealthCheckInterval(c.Cluster.HealthCheckInterval.Duration)
+		})
+		live([]string{"cluster.health_check_timeout", "cluster.stale_after", "cluster.health_check_failures", "cluster.health_check_successes"}, func(c *config.Config) {
+			cm.SetHealthCheck(c.Cluster.HealthCheckTimeout.Duration, c.Cluster.StaleAfter.Duration, c.Cluster.HealthCheckFailures, c.Cluster.HealthCheckSuccesses)
+		})
+		live([]string{"cluster.heartbeat_interval"}, func(c *config.Config) {
+			cm.SetHeartbeatInterval(c.Cluster.HeartbeatInterval.Duration)
+		})
+		live([]string{"cluster.dead_after", "cluster.remove_after"}, func(c *config.Config) {
+			cm.SetEviction(c.Cluster.DeadAfter.Duration, c.Cluster.RemoveAfter.Duration)
+		})
+		live([]string{"cluster.gossip_interval", "cluster.gossip_fanout"}, func(c *config.Config) {
+			cm.SetGossip(c.Cluster.GossipInterval.Duration, c.Cluster.GossipFanout)
+		})
+		live([]string{"replication.throttle"}, func(c *config.Config) {
+			rm.SetThrottle(c.Replication.Throttle)
+		})
+		live([]string{"replication.compression", "replication.compression_min_size", "replication.uncompressed_types"}, func(c *config.Config) {
+			rm.SetCompression(c.Replication.Compression, c.Replication.CompressionMinSize, c.Replication.UncompressedTypes)
+		})
+		live([]string{"replication.max_attempts", "replication.retry_delay", "replication.max_elapsed"}, func(c *config.Config) {
+			rm.SetRetry(c.Replication.MaxAttempts, c.Replication.RetryDelay.Duration, c.Replication.MaxElapsed.Duration)
+		})
+		live([]string{"replication.write_consistency", "replication.write_timeout", "replication.strict_writes"}, func(c *config.Config) {
+			level, _ := replication.ParseConsistency(c.Replication.WriteConsistency) // validated already
+			apiServer.SetWriteConsistency(level, c.Replication.WriteTimeout.Duration, c.Replication.StrictWrites)
+		})
+		live([]string{"replication.min_success"}, func(c *config.Config) {
+			policy, _ := replication.ParseSuccessPolicy(c.Replication.MinSuccess) // validated already
+			rm.SetMinSuccess(policy)
+		})
+		live([]string{"replication.queue_full"}, func(c *config.Config) {
+			rm.SetQueueFull(c.Replication.QueueFull)
+		})
+		live([]string{"replication.repair_interval", "replication.repair_throttle"}, func(c *config.Config) {
+			rm.SetRepair(c.Replication.RepairInterval.Duration, c.Replication.RepairThrottle)
+		})
+		live([]string{"replication.rebalance_rate", "replication.rebalance_throttle", "replication.rebalance_threshold"}, func(c *config.Config) {
+			rm.SetRebalance(c.Replication.RebalanceRate, c.Replication.RebalanceThrottle, c.Replication.RebalanceThreshold)
+		})
+		live([]string{"replication.failover", "replication.failover_grace"}, func(c *config.Config) {
+			rm.SetFailover(c.Replication.Failover, c.Replication.FailoverGrace.Duration)
+		})
+		live([]string{"replication.task_ttl", "replication.failed_task_ttl", "replication.max_tasks"}, func(c *config.Config) {
+			rm.SetTaskRetention(c.Replication.TaskTTL.Duration, c.Replication.FailedTaskTTL.Duration, c.Replication.MaxTasks)
+		})
+
+		tierer.SetCluster(cm)
+
+		clusterCatalog := catalog.New(store, cm, cfg.Cluster.CatalogSyncInterval.Duration)
+		apiServer.SetCatalog(clusterCatalog)
+		live([]string{"cluster.catalog_sync_interval"}, func(c *config.Config) {
+			clusterCatalog.SetSyncInterval(c.Cluster.CatalogSyncInterval.Duration)
+		})
+
+		components.Register("cluster", cm, lifecycle.Options{})
+		components.Register("replication", rm, lifecycle.Options{DependsOn: []string{"cluster", "storage"}})
+		components.Register("catalog", clusterCatalog, lifecycle.Options{DependsOn: []string{"cluster", "storage"}})
+		serverDeps = append(serverDeps, "cluster", "replication", "catalog")
+	}
+
 	// Setup HTTP server
 	server := &http.Server{
-		Addr:    ":" + *port,
+		Addr:    ":" + cfg.Server.Port,
 		Handler: apiServer,
 	}
+	components.Register("http", lifecycle.NewHTTPServer(server, cfg.Server.TLSCert, cfg.Server.TLSKey),
+		lifecycle.Options{DependsOn: serverDeps, Critical: true})
 
-	// Handle graceful shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
+	if err := components.Start(ctx); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+
+	log.Printf("Starting storage server on port %s", cfg.Server.Port)
+	if cfg.Storage.Backend == "s3" {
+		log.Printf("Storage bucket: %s at %s", cfg.Storage.S3.Bucket, cfg.Storage.S3.Endpoint)
+	}
+	log.Printf("Storage directory: %s", cfg.Storage.Path)
+
+	if cm != nil {
+		go func() {
+			// Standalone until a seed answers, however long that takes
+			if err := cm.JoinWithRetry(ctx, cfg.Cluster.Peers); err != nil {
+				return
+			}
+			if cfg.Replication.SyncOnStart {
+				rm.CatchUp()
+			}
+			if cm.Draining() == cluster.DrainDraining {
+				// Stopped part way through a drain, so carry on with it
+				if err := rm.StartDrain(); err != nil {
+					log.Printf("Failed to resume draining: %v", err)
+				}
+			}
+		}()
+	}
+
+	go reloadOnSignal(reloader)
+
+	failure := components.Wait(ctx)
+	if failure != nil {
+		log.Printf("Shutting down: %v", failure)
+	} else {
 		log.Println("Shutting down server...")
-		server.Close()
-	}()
+	}
 
-	log.Printf("Starting storage server on port %s", *port)
-	log.Printf("Storage directory: %s", *storePath)
+	// Components stopped in reverse start order, HTTP first so no new writes arrive
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), reloader.Current().Server.ShutdownTimeout.Duration)
+	defer cancel()
+	if cm != nil {
+		// While still serving, so the others stop sending here before it stops answering
+		cm.Leave(shutdownCtx)
+	}
+	if err := components.Stop(shutdownCtx); err != nil {
+		log.Printf("Unclean shutdown: %v", err)
+	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed to start: %v", err)
+	if failure != nil {
+		os.Exit(1)
+	}
+}
+
+// backend is what main needs from the configured object store
+type backend interface {
+	storage.Store
+	lifecycle.Component
+	SetDefaultChecksum(algorithm string) error
+}
+
+func openStore(cfg *config.Config) (backend, error) {
+	switch cfg.Storage.Backend {
+	case "s3":
+		// Local state (usage, uploads, locks, node ID) still lives under the storage path
+		if err := os.MkdirAll(cfg.Storage.Path, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %v", err)
+		}
+		return storage.NewS3Store(cfg.Storage.S3)
+	case "tiered":
+		return openTieredStore(cfg)
+	}
+	return storage.OpenFileStore(cfg.Storage.Path, cfg.Storage.MetadataBackend)
+}
+
+// openTieredStore opens the backends storage.tier_backends names, each once however many
+// tiers share it
+func openTieredStore(cfg *config.Config) (backend, error) {
+	opened := make(map[string]storage.Store)
+	tiers := make(map[string]storage.Store)
+	for tier, name := range cfg.Storage.TierBackends {
+		if opened[name] == nil {
+			var store storage.Store
+			var err error
+			switch name {
+			case "s3":
+				if err := os.MkdirAll(cfg.Storage.Path, 0755); err != nil {
+					return nil, fmt.Errorf("failed to create storage directory: %v", err)
+				}
+				store, err = storage.NewS3Store(cfg.Storage.S3)
+			default:
+				store, err = storage.OpenFileStore(cfg.Storage.Path, cfg.Storage.MetadataBackend)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the %s backend: %v", name, err)
+			}
+			opened[name] = store
+		}
+		tiers[tier] = opened[name]
+	}
+	return storage.NewTieredStore(tiers)
+}
+
+func setupCluster(cfg *config.Config, store storage.Store, forceID bool) (*cluster.ClusterManager, *replication.ReplicationManager) {
+	id, err := cluster.ClaimNodeID(cfg.Storage.Path, cfg.Cluster.NodeID, forceID)
+	if errors.Is(err, cluster.ErrNodeIDMismatch) {
+		log.Fatalf("Refusing to start: %v (use -force-node-id to rename the node)", err)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load node ID: %v", err)
+	}
+	if named, ok := store.(storage.NodeNamer); ok {
+		named.SetNodeID(id)
+	}
+
+	address := cfg.Cluster.Address
+	if address == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		address = host + ":" + cfg.Server.Port
+	}
+
+	log.Printf("Cluster node %s advertising %s", id, address)
+
+	cm := cluster.NewClusterManager(id, address)
+	cm.SetLocation(cfg.Cluster.Zone, cfg.Cluster.Rack)
+	build := version
+	if build == "" {
+		build = cluster.BuildVersion()
+	}
+	cm.SetBuild(build, replication.Capabilities())
+	if drain, err := cm.RestoreDrain(cfg.Storage.Path); err != nil {
+		log.Fatalf("Failed to load drain state: %v", err)
+	} else if drain != "" {
+		log.Printf("Node is %s, taking no writes until DELETE /admin/drain", drain)
+	}
+	cm.SetUsageSource(func() cluster.Usage { return nodeUsage(store, cfg.Storage.Path, cfg.Cluster.Capacity) })
+	rm := replication.NewReplicationManager(cm, store, cfg.Replication.Factor)
+	rm.SetWorkers(cfg.Replication.Concurrency, cfg.Replication.QueueSize)
+	return cm, rm
+}
+
+// nodeUsage is what this node reports to the others: the bytes and objects the store holds
+// and capacity if set, otherwise the size of the disk its files are on or its quota if that
+// is smaller
+func nodeUsage(store storage.Store, path string, capacity int64) cluster.Usage {
+	usage := cluster.Usage{Load: cluster.SystemLoad(), Capacity: capacity}
+	if reporter, ok := store.(storage.TierReporter); ok {
+		for _, tier := range reporter.Usage() {
+			usage.Used += tier.StoredBytes
+			usage.Objects += tier.Objects
+		}
+	}
+	if capacity > 0 {
+		return usage
+	}
+	if _, ok := store.(*storage.FileStore); ok {
+		if total, _, err := storage.DiskSpace(path); err == nil {
+			usage.Capacity = total
+		}
+	}
+	if limiter, ok := store.(storage.Limiter); ok {
+		if _, quota := limiter.QuotaUsage(); quota > 0 && (usage.Capacity == 0 || quota < usage.Capacity) {
+			usage.Capacity = quota
+		}
+	}
+	return usage
+}
+
+// reloadOnSignal re-reads the configuration every time the process gets SIGHUP
+func reloadOnSignal(reloader *config.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		result, err := reloader.Reload()
+		if err != nil {
+			log.Printf("Config reload failed, keeping the running configuration: %v", err)
+			continue
+		}
+		log.Printf("Config reloaded: applied %v", result.Applied)
+		if len(result.RestartRequired) > 0 {
+			log.Printf("Config changes that need a restart to take effect: %v", result.RestartRequired)
+		}
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
+
+// fsckMode is a flag that works both bare (--fsck) and with a value (--fsck=deep)
+type fsckMode string
+
+func (m *fsckMode) String() string { return string(*m) }
+
+func (m *fsckMode) Set(value string) error {
+	switch value {
+	case "true", "shallow":
+		*m = "shallow"
+	case "deep":
+		*m = "deep"
+	case "false":
+		*m = ""
+	default:
+		return fmt.Errorf("must be shallow or deep")
+	}
+	return nil
+}
+
+func (m *fsckMode) IsBoolFlag() bool { return true }
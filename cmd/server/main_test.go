@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/api"
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/config"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// testNode is a server as main sets it up with -node-address, on a port of this host
+type testNode struct {
+	id      string
+	address string
+	cm      *cluster.ClusterManager
+}
+
+func startNode(t *testing.T, dir, nodeID string) *testNode {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Storage.Path = dir
+	cfg.Cluster.NodeID = nodeID
+
+	server := httptest.NewUnstartedServer(nil)
+	cfg.Cluster.Address = server.Listener.Addr().String()
+
+	store, err := storage.OpenFileStore(dir, cfg.Storage.MetadataBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, rm := setupCluster(cfg, store, false)
+	apiServer := api.NewAPIServer(store)
+	apiServer.EnableCluster(cm, rm)
+	server.Config.Handler = apiServer
+	server.Start()
+	if err := cm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cm.Stop(ctx)
+		server.Close()
+		store.Stop(ctx)
+	})
+	return &testNode{id: cm.GetCurrentNode().ID, address: cfg.Cluster.Address, cm: cm}
+}
+
+// clusterStatus fetches GET /cluster/status from node
+func clusterStatus(t *testing.T, node *testNode) cluster.ClusterStats {
+	t.Helper()
+	resp, err := http.Get("http://" + node.address + "/cluster/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats cluster.ClusterStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("/cluster/status on %s = %d (%v)", node.id, resp.StatusCode, err)
+	}
+	return stats
+}
+
+func TestThreeNodesSeeEachOther(t *testing.T) {
+	nodes := []*testNode{
+		startNode(t, t.TempDir(), ""),
+		startNode(t, t.TempDir(), ""),
+		startNode(t, t.TempDir(), ""),
+	}
+	// Each joins through the one before; the third learns of the first from the second
+	if err := nodes[1].cm.Join([]string{nodes[0].address}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[2].cm.Join([]string{nodes[1].address}); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, node := range nodes {
+		want = append(want, node.id)
+	}
+	sort.Strings(want)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for {
+			stats := clusterStatus(t, node)
+			var seen []string
+			for _, status := range stats.Nodes {
+				seen = append(seen, status.ID)
+			}
+			sort.Strings(seen)
+			if stats.TotalNodes == 3 && stats.HealthyNodes == 3 && strings.Join(seen, ",") == strings.Join(want, ",") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s sees %v (%d healthy), want %v all healthy", node.id, seen, stats.HealthyNodes, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestNodeIDPersistedInDataDir(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.Path = t.TempDir()
+	cfg.Cluster.Address = "127.0.0.1:1"
+	store, err := storage.OpenFileStore(cfg.Storage.Path, cfg.Storage.MetadataBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+
+	// Generated on first start and kept under the storage directory
+	cm, _ := setupCluster(cfg, store, false)
+	generated := cm.GetCurrentNode().ID
+	if generated == "" {
+		t.Fatal("no node ID generated")
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.Storage.Path, "node_id"))
+	if err != nil || strings.TrimSpace(string(data)) != generated {
+		t.Errorf("node_id file = %q (%v), want %s", data, err, generated)
+	}
+
+	// The same after a restart
+	if cm, _ := setupCluster(cfg, store, false); cm.GetCurrentNode().ID != generated {
+		t.Errorf("restarted as %s, want %s", cm.GetCurrentNode().ID, generated)
+	}
+
+	// -node-id names a node in a fresh directory
+	cfg.Storage.Path = t.TempDir()
+	cfg.Cluster.NodeID = "node-a"
+	if cm, _ := setupCluster(cfg, store, false); cm.GetCurrentNode().ID != "node-a" || cm.GetCurrentNode().Address != "127.0.0.1:1" {
+		t.Errorf("started as %s at %s, want node-a at 127.0.0.1:1", cm.GetCurrentNode().ID, cm.GetCurrentNode().Address)
+	}
+}
+
+func TestOpenStoreBackend(t *testing.T) {
+	// An empty bucket, as far as listing it goes
+	var listed atomic.Bool
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/test-bucket" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		listed.Store(true)
+		w.Write([]byte("<ListBucketResult></ListBucketResult>"))
+	}))
+	t.Cleanup(bucket.Close)
+
+	cfg := config.Default()
+	cfg.Storage.Path = t.TempDir()
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Stop(context.Background())
+	if _, ok := store.(*storage.FileStore); !ok {
+		t.Errorf("the default backend is %T, want a FileStore", store)
+	}
+
+	// Local state still goes under the storage path, which is made if need be
+	cfg.Storage.Backend = "s3"
+	cfg.Storage.Path = filepath.Join(t.TempDir(), "state")
+	cfg.Storage.S3 = storage.S3Config{Endpoint: bucket.URL, Bucket: "test-bucket", AccessKey: "test", SecretKey: "secret"}
+	store, err = openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Stop(context.Background())
+	if _, ok := store.(*storage.S3Store); !ok || !listed.Load() {
+		t.Errorf("-backend=s3 opened %T (bucket listed: %v), want an S3Store on the bucket", store, listed.Load())
+	}
+	if info, err := os.Stat(cfg.Storage.Path); err != nil || !info.IsDir() {
+		t.Errorf("storage path not made for the s3 backend: %v", err)
+	}
+
+	cfg.Storage.S3.Bucket = "other-bucket"
+	if _, err := openStore(cfg); err == nil {
+		t.Error("opened a bucket S3 refused access to")
+	}
+}
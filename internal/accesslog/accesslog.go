@@ -0,0 +1,327 @@
+// Package accesslog keeps the accesses to objects on disk, so what the tiering classifier
+// has learned about them outlives restarts.
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+const (
+	filePrefix = "access-"
+	fileSuffix = ".jsonl"
+	dateLayout = "2006-01-02"
+
+	// Accesses are written out every flushInterval, or sooner once flushBatch are waiting
+	flushInterval = 5 * time.Second
+	flushBatch    = 1000
+
+	DefaultRetention = 90 * 24 * time.Hour
+)
+
+// Log appends accesses to one file per UTC day in its directory, and deletes the files
+// that have fallen out of the retention window
+type Log struct {
+	dir string
+
+	mutex     sync.Mutex
+	retention time.Duration
+	pending   []models.AccessPattern
+	loaded    int
+	recorded  int64
+	oldest    time.Time
+	newest    time.Time
+	onPrune   func(cutoff time.Time)
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Stats is how much access history the log holds
+type Stats struct {
+	Loaded   int        `json:"loaded"`   // read back at startup
+	Recorded int64      `json:"recorded"` // since startup
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Newest   *time.Time `json:"newest,omitempty"`
+	// Retention is how long accesses are kept, in hours
+	Retention float64 `json:"retention_hours"`
+}
+
+// Open opens the log in dir, creating it if need be
+func Open(dir string, retention time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %v", err)
+	}
+	return &Log{dir: dir, retention: retention, kick: make(chan struct{}, 1)}, nil
+}
+
+// SetRetention sets how long accesses are kept, applied from the next prune
+func (l *Log) SetRetention(retention time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.retention = retention
+}
+
+// OnPrune has fn called with the start of the retention window each time the log prunes,
+// for whoever keeps accesses in memory to let go of the same ones
+func (l *Log) OnPrune(fn func(cutoff time.Time)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onPrune = fn
+}
+
+// Load hands fn every access in the retention window, oldest first. Lines cut short by a
+// crash are skipped.
+func (l *Log) Load(fn func(models.AccessPattern)) error {
+	l.mutex.Lock()
+	cutoff := time.Now().Add(-l.retention)
+	l.mutex.Unlock()
+
+	files, err := l.files()
+	if err != nil {
+		return err
+	}
+	var loaded int
+	var oldest, newest time.Time
+	for _, path := range files {
+		err := readFile(path, func(pattern models.AccessPattern) {
+			if pattern.AccessTime.Before(cutoff) {
+				return
+			}
+			if oldest.IsZero() || pattern.AccessTime.Before(oldest) {
+				oldest = pattern.AccessTime
+			}
+			if pattern.AccessTime.After(newest) {
+				newest = pattern.AccessTime
+			}
+			loaded++
+			fn(pattern)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", filepath.Base(path), err)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.loaded += loaded
+	l.extend(oldest)
+	l.extend(newest)
+	return nil
+}
+
+// Record queues an access to be written with the next batch
+func (l *Log) Record(pattern models.AccessPattern) {
+	l.mutex.Lock()
+	l.pending = append(l.pending, pattern)
+	l.recorded++
+	l.extend(pattern.AccessTime)
+	full := len(l.pending) >= flushBatch
+	l.mutex.Unlock()
+
+	if full {
+		select {
+		case l.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// extend widens the covered time range to t; the caller holds the lock
+func (l *Log) extend(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if l.oldest.IsZero() || t.Before(l.oldest) {
+		l.oldest = t
+	}
+	if t.After(l.newest) {
+		l.newest = t
+	}
+}
+
+// Stats reports how much access history the log holds
+func (l *Log) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := Stats{Loaded: l.loaded, Recorded: l.recorded, Retention: l.retention.Hours()}
+	if !l.oldest.IsZero() {
+		oldest, newest := l.oldest, l.newest
+		stats.Oldest, stats.Newest = &oldest, &newest
+	}
+	return stats
+}
+
+// Start writes out queued accesses in the background and prunes old files
+func (l *Log) Start(ctx context.Context) error {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	if err := l.prune(time.Now()); err != nil {
+		log.Printf("Failed to prune the access log: %v", err)
+	}
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		day := time.Now().UTC().Format(dateLayout)
+
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-l.kick:
+			case <-ticker.C:
+			}
+			if err := l.flush(); err != nil {
+				log.Printf("Failed to write the access log: %v", err)
+			}
+			if today := time.Now().UTC().Format(dateLayout); today != day {
+				day = today
+				if err := l.prune(time.Now()); err != nil {
+					log.Printf("Failed to prune the access log: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the background loop and writes out what is still queued
+func (l *Log) Stop(ctx context.Context) error {
+	if l.stop != nil {
+		close(l.stop)
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return l.flush()
+}
+
+// flush appends the queued accesses to the files of their days, syncing once per file.
+// The days that fail to be written stay queued for the next flush.
+func (l *Log) flush() error {
+	l.mutex.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	byDay := make(map[string][]models.AccessPattern)
+	days := []string{}
+	for _, pattern := range pending {
+		day := pattern.AccessTime.UTC().Format(dateLayout)
+		if _, ok := byDay[day]; !ok {
+			days = append(days, day)
+		}
+		byDay[day] = append(byDay[day], pattern)
+	}
+	var failed []models.AccessPattern
+	var firstErr error
+	for _, day := range days {
+		if err := l.appendFile(filepath.Join(l.dir, filePrefix+day+fileSuffix), byDay[day]); err != nil {
+			failed = append(failed, byDay[day]...)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		l.mutex.Lock()
+		l.pending = append(failed, l.pending...)
+		l.mutex.Unlock()
+	}
+	return firstErr
+}
+
+func (l *Log) appendFile(path string, patterns []models.AccessPattern) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, pattern := range patterns {
+		if err := encoder.Encode(pattern); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// prune deletes the files of days wholly before the retention window
+func (l *Log) prune(now time.Time) error {
+	l.mutex.Lock()
+	start := now.Add(-l.retention)
+	onPrune := l.onPrune
+	l.mutex.Unlock()
+	if onPrune != nil {
+		onPrune(start)
+	}
+	cutoff := start.UTC().Format(dateLayout)
+
+	files, err := l.files()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), filePrefix), fileSuffix)
+		if day >= cutoff {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		log.Printf("Pruned access log for %s", day)
+	}
+	return nil
+}
+
+// files lists the log's files, oldest day first
+func (l *Log) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readFile(path string, fn func(models.AccessPattern)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var pattern models.AccessPattern
+		if json.Unmarshal(scanner.Bytes(), &pattern) != nil {
+			continue
+		}
+		fn(pattern)
+	}
+	return scanner.Err()
+}
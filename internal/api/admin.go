@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/9ifrashaikh/distributed-system/internal/config"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+func (api *APIServer) setObjectOwner(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Owner == "" {
+		http.Error(w, "Request body must be {\"owner\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+
+	obj, err := api.store.SetOwner(key, req.Owner, callerID(r))
+	if err != nil {
+		if errors.Is(err, storage.ErrReadOnly) {
+			writeReadOnlyError(w, err)
+			return
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// backfillOwners assigns an owner to every object under a prefix whose owner is unknown
+func (api *APIServer) backfillOwners(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		Owner  string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Owner == "" {
+		http.Error(w, "Request body must be {\"prefix\": \"...\", \"owner\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+
+	relabeled, err := api.store.BackfillOwner(req.Prefix, req.Owner, callerID(r))
+	if errors.Is(err, storage.ErrReadOnly) {
+		writeReadOnlyError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"prefix":    req.Prefix,
+		"owner":     req.Owner,
+		"relabeled": relabeled,
+	})
+}
+
+// getJournal returns journal records after ?since_seq= (default 0), at most ?limit= (default 1000)
+func (api *APIServer) getJournal(w http.ResponseWriter, r *http.Request) {
+	j := api.store.Journal()
+	if j == nil {
+		http.Error(w, "Journal is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var since uint64
+	if value := r.URL.Query().Get("since_seq"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since_seq", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	limit := 1000
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, err := j.ReadSince(since, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"last_seq": j.LastSeq(),
+		"records":  records,
+	})
+}
+
+// runFsck checks the store online; ?deep=true re-hashes blobs, ?repair=true applies safe fixes
+func (api *APIServer) runFsck(w http.ResponseWriter, r *http.Request) {
+	checker, ok := api.store.(storage.Checker)
+	if !ok {
+		http.Error(w, "Store does not support consistency checks", http.StatusNotImplemented)
+		return
+	}
+	report := checker.Fsck(storage.FsckOptions{
+		Deep:   r.URL.Query().Get("deep") == "true",
+		Repair: r.URL.Query().Get("repair") == "true",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SetGarbageCollector enables /admin/gc
+func (api *APIServer) SetGarbageCollector(gc *storage.GarbageCollector) {
+	api.gc = gc
+}
+
+// runGC removes unreferenced data files now; ?dry_run=true only reports what would go
+func (api *APIServer) runGC(w http.ResponseWriter, r *http.Request) {
+	var report *storage.GCReport
+	if api.gc != nil {
+		report = api.gc.Collect(r.URL.Query().Get("dry_run") == "true")
+	}
+	if report == nil {
+		http.Error(w, "Store does not support garbage collection", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// rotateKeys rewraps every data key with the newest master key, after which older master
+// keys can be removed from the configuration
+func (api *APIServer) rotateKeys(w http.ResponseWriter, r *http.Request) {
+	encrypter, ok := api.store.(storage.Encrypter)
+	if !ok {
+		http.Error(w, "Store does not support encryption", http.StatusNotImplemented)
+		return
+	}
+	rotated, err := encrypter.RotateKeys(callerID(r))
+	if err != nil {
+		if errors.Is(err, storage.ErrReadOnly) {
+			writeReadOnlyError(w, err)
+			return
+		}
+		if errors.Is(err, storage.ErrKeyUnavailable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rewrapped": rotated,
+	})
+}
+
+// SetReloader enables /admin/reload and lets /admin/config report the live configuration
+func (api *APIServer) SetReloader(r *config.Reloader) {
+	api.reloader = r
+}
+
+// getConfig returns the effective configuration with secrets masked
+func (api *APIServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	if api.reloader == nil {
+		http.Error(w, "Configuration is not available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.reloader.Current().Redacted())
+}
+
+// reloadConfig re-reads the config file, the same as sending the process SIGHUP
+func (api *APIServer) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if api.reloader == nil {
+		http.Error(w, "Configuration reload is not available", http.StatusNotFound)
+		return
+	}
+
+	result, err := api.reloader.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/config"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// allowed counts how many of n requests in quick succession get through
+func allowed(api *APIServer, n int) int {
+	ok := 0
+	for i := 0; i < n; i++ {
+		if serve(api, http.MethodGet, "/stats", "").Code != http.StatusTooManyRequests {
+			ok++
+		}
+	}
+	return ok
+}
+
+func TestReloadRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"server": {"rate_limit": 0.001, "rate_burst": 3}}`)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	api := NewAPIServer(store)
+	reloader := config.NewReloader(path, cfg, nil)
+	api.SetReloader(reloader)
+	// As the server wires it up
+	apply := func(c *config.Config) { api.SetRateLimit(c.Server.RateLimit, c.Server.RateBurst) }
+	apply(cfg)
+	reloader.OnChange([]string{"server.rate_limit", "server.rate_burst"}, apply)
+
+	if n := allowed(api, 10); n != 3 {
+		t.Fatalf("%d of 10 requests allowed, want the burst of 3", n)
+	}
+
+	// Lifted by a reload, with the limiter exhausted
+	write(`{"server": {"rate_limit": 0, "rate_burst": 3}}`)
+	w := serve(api, http.MethodPost, "/admin/reload", "")
+	var result config.ReloadResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("reload = %d (%v)", w.Code, err)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "server.rate_limit" {
+		t.Errorf("reload applied %v, want server.rate_limit", result.Applied)
+	}
+	if n := allowed(api, 10); n != 10 {
+		t.Errorf("%d of 10 requests allowed with the limit lifted", n)
+	}
+
+	// And the live configuration says so straight away
+	var live config.Config
+	if err := json.NewDecoder(serve(api, http.MethodGet, "/admin/config", "").Body).Decode(&live); err != nil {
+		t.Fatal(err)
+	}
+	if live.Server.RateLimit != 0 {
+		t.Errorf("/admin/config has rate_limit %v, want 0", live.Server.RateLimit)
+	}
+
+	// Put back with a smaller burst
+	write(`{"server": {"rate_limit": 0.001, "rate_burst": 1}}`)
+	if w := serve(api, http.MethodPost, "/admin/reload", ""); w.Code != http.StatusOK {
+		t.Fatalf("reload = %d: %s", w.Code, w.Body)
+	}
+	if n := allowed(api, 10); n != 1 {
+		t.Errorf("%d of 10 requests allowed, want the new burst of 1", n)
+	}
+
+	// A bad file is refused, leaving the limit as it was
+	write(`{"server": {"rate_limit": "fast"}}`)
+	if w := serve(api, http.MethodPost, "/admin/reload", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("reloading a bad file = %d, want 400", w.Code)
+	}
+	if n := allowed(api, 10); n != 0 {
+		t.Errorf("%d requests allowed after a bad reload, want the limit kept", n)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// Variables rather than constants so tests needn't wait on them
+var (
+	// aggregateNodeTimeout is how long each node gets to answer for the aggregate stats
+	aggregateNodeTimeout = 2 * time.Second
+	// aggregateTTL is how long the aggregate stats are served again before the nodes are
+	// asked afresh, so dashboards polling often don't each set off a round of requests
+	aggregateTTL = 5 * time.Second
+)
+
+// NodeStats is one node's part of the aggregate stats, or why it is missing from them
+type NodeStats struct {
+	Status           string         `json:"status"` // ok or failed
+	Error            string         `json:"error,omitempty"`
+	Latency          float64        `json:"latency_ms"`
+	TotalObjects     int            `json:"total_objects"`
+	TotalSize        int64          `json:"total_size"`
+	TierDistribution map[string]int `json:"tier_distribution,omitempty"`
+	Quota            *QuotaStats    `json:"quota,omitempty"`
+}
+
+// QuotaStats is the storage quota of a node, or the sum of them
+type QuotaStats struct {
+	Used  int64 `json:"used_bytes"`
+	Quota int64 `json:"quota_bytes"`
+}
+
+// AggregateStats adds up the stats of every healthy node. Each node counts the copies it
+// holds, so objects with replicas are counted once per copy.
+type AggregateStats struct {
+	GeneratedAt      time.Time             `json:"generated_at"`
+	Queried          int                   `json:"nodes_queried"`
+	Responded        int                   `json:"nodes_responded"`
+	Failed           []string              `json:"nodes_failed"`
+	TotalObjects     int                   `json:"total_objects"`
+	TotalSize        int64                 `json:"total_size"`
+	TierDistribution map[string]int        `json:"tier_distribution"`
+	Quota            QuotaStats            `json:"quota"` // of the nodes that have one
+	Nodes            map[string]*NodeStats `json:"nodes"`
+}
+
+// statsCache holds the last AggregateStats for aggregateTTL
+type statsCache struct {
+	mutex sync.Mutex
+	stats *AggregateStats
+}
+
+// getAggregateStats answers with the stats of the whole cluster, see AggregateStats. Nodes
+// that don't answer in time are listed as failed rather than failing the request.
+func (api *APIServer) getAggregateStats(w http.ResponseWriter, r *http.Request) {
+	// Held while the nodes are asked, so requests meanwhile wait for the same answer
+	api.aggregate.mutex.Lock()
+	stats := api.aggregate.stats
+	if stats == nil || time.Since(stats.GeneratedAt) > aggregateTTL {
+		stats = api.aggregateStats()
+		api.aggregate.stats = stats
+	}
+	api.aggregate.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// aggregateStats asks every healthy node for its stats at once and adds them up
+func (api *APIServer) aggregateStats() *AggregateStats {
+	self := api.cluster.GetCurrentNode().ID
+	nodes := api.cluster.GetHealthyNodes()
+	client := api.cluster.NewClient(aggregateNodeTimeout)
+
+	results := make([]*NodeStats, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node.ID == self {
+			results[i] = api.ownStats()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, node *cluster.Node) {
+			defer wg.Done()
+			results[i] = fetchNodeStats(client, node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	stats := &AggregateStats{
+		GeneratedAt:      time.Now(),
+		Queried:          len(nodes),
+		Failed:           []string{},
+		TierDistribution: make(map[string]int),
+		Nodes:            make(map[string]*NodeStats, len(nodes)),
+	}
+	for i, result := range results {
+		stats.Nodes[nodes[i].ID] = result
+		if result.Status != "ok" {
+			stats.Failed = append(stats.Failed, nodes[i].ID)
+			continue
+		}
+		stats.Responded++
+		stats.TotalObjects += result.TotalObjects
+		stats.TotalSize += result.TotalSize
+		for tier, count := range result.TierDistribution {
+			stats.TierDistribution[tier] += count
+		}
+		if result.Quota != nil {
+			stats.Quota.Used += result.Quota.Used
+			stats.Quota.Quota += result.Quota.Quota
+		}
+	}
+	sort.Strings(stats.Failed)
+	return stats
+}
+
+// ownStats is this node's part of the aggregate stats
+func (api *APIServer) ownStats() *NodeStats {
+	objects := api.store.List()
+	stats := &NodeStats{
+		Status:           "ok",
+		TotalObjects:     len(objects),
+		TotalSize:        calculateTotalSize(objects),
+		TierDistribution: calculateTierDistribution(objects),
+	}
+	if limiter, ok := api.store.(storage.Limiter); ok {
+		used, quota := limiter.QuotaUsage()
+		stats.Quota = &QuotaStats{Used: used, Quota: quota}
+	}
+	return stats
+}
+
+// fetchNodeStats asks node for its /stats
+func fetchNodeStats(client *http.Client, node *cluster.Node) *NodeStats {
+	started := time.Now()
+	failed := func(err error) *NodeStats {
+		return &NodeStats{Status: "failed", Error: err.Error(), Latency: milliseconds(time.Since(started))}
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/stats?top=0", node.Address))
+	if err != nil {
+		return failed(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return failed(fmt.Errorf("stats answered %s", resp.Status))
+	}
+	var stats NodeStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return failed(fmt.Errorf("failed to decode stats: %v", err))
+	}
+	stats.Status = "ok"
+	stats.Latency = milliseconds(time.Since(started))
+	return &stats
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
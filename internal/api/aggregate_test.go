@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// newStatsServer is an APIServer on a FileStore holding objects, keyed by name and given
+// as their data
+func newStatsServer(t *testing.T, objects ...string) *APIServer {
+	t.Helper()
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	api := NewAPIServer(store)
+	for _, data := range objects {
+		if w := serve(api, http.MethodPut, "/objects/"+data, data); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s = %d: %s", data, w.Code, w.Body)
+		}
+	}
+	return api
+}
+
+func address(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func getAggregate(t *testing.T, api *APIServer) AggregateStats {
+	t.Helper()
+	w := serve(api, http.MethodGet, "/cluster/stats/aggregate", "")
+	var stats AggregateStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("aggregate stats = %d (%v)", w.Code, err)
+	}
+	return stats
+}
+
+func TestAggregateStats(t *testing.T) {
+	timeout, ttl := aggregateNodeTimeout, aggregateTTL
+	aggregateNodeTimeout, aggregateTTL = 100*time.Millisecond, time.Hour
+	t.Cleanup(func() { aggregateNodeTimeout, aggregateTTL = timeout, ttl })
+
+	// node-2 answers, node-3 and node-4 take too long, node-5 is gone and node-6 is known
+	// to be down
+	var asked atomic.Int32
+	peer := newStatsServer(t, "a", "bb", "ccc")
+	responsive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		peer.ServeHTTP(w, r)
+	}))
+	t.Cleanup(responsive.Close)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Minute):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	api := newStatsServer(t, "dddd")
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	for _, node := range []*cluster.Node{
+		{ID: "node-2", Address: address(responsive), Status: "healthy"},
+		{ID: "node-3", Address: address(slow), Status: "healthy"},
+		{ID: "node-4", Address: address(slow), Status: "healthy"},
+		{ID: "node-5", Address: address(dead), Status: "healthy"},
+		{ID: "node-6", Address: address(responsive), Status: "unhealthy"},
+	} {
+		if err := cm.RegisterNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api.EnableCluster(cm, nil)
+
+	started := time.Now()
+	stats := getAggregate(t, api)
+	if elapsed := time.Since(started); elapsed > 3*aggregateNodeTimeout/2 {
+		t.Errorf("took %v with two slow nodes, want them asked at once and cut off", elapsed)
+	}
+	if stats.Queried != 5 || stats.Responded != 2 {
+		t.Errorf("%d nodes queried and %d responded, want 5 and 2", stats.Queried, stats.Responded)
+	}
+	if strings.Join(stats.Failed, ",") != "node-3,node-4,node-5" {
+		t.Errorf("failed nodes %v, want node-3, node-4 and node-5", stats.Failed)
+	}
+	for _, id := range stats.Failed {
+		if node := stats.Nodes[id]; node == nil || node.Status != "failed" || node.Error == "" {
+			t.Errorf("%s = %+v, want failed and why", id, node)
+		}
+	}
+	if _, asked := stats.Nodes["node-6"]; asked {
+		t.Error("node-6 was asked while unhealthy")
+	}
+	// a, bb and ccc on node-2 and dddd here
+	if stats.TotalObjects != 4 || stats.TotalSize != 10 || stats.TierDistribution["hot"] != 4 {
+		t.Errorf("%d objects of %d bytes, tiers %v; want 4 hot ones of 10", stats.TotalObjects, stats.TotalSize, stats.TierDistribution)
+	}
+	if node := stats.Nodes["node-2"]; node == nil || node.Status != "ok" || node.TotalObjects != 3 {
+		t.Errorf("node-2 = %+v, want its 3 objects", node)
+	}
+
+	// Asked again within the TTL, the nodes aren't
+	if again := getAggregate(t, api); !again.GeneratedAt.Equal(stats.GeneratedAt) || asked.Load() != 1 {
+		t.Errorf("node-2 was asked %d times for two requests within the TTL", asked.Load())
+	}
+	aggregateTTL = 0
+	if again := getAggregate(t, api); !again.GeneratedAt.After(stats.GeneratedAt) || asked.Load() != 2 {
+		t.Errorf("node-2 was asked %d times once the aggregate had expired, want again", asked.Load())
+	}
+}
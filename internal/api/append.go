@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// appendObject answers POST ?append=true: the body is added to the end of the object,
+// which is created if it doesn't exist. If-Version-Match makes it conditional.
+func (api *APIServer) appendObject(w http.ResponseWriter, r *http.Request) {
+	key, ok := api.objectKey(w, r)
+	if !ok || !checkKey(w, mux.Vars(r)["key"]) {
+		return
+	}
+	if r.URL.Query().Get("append") != "true" {
+		http.Error(w, "POST to an object needs ?append=true", http.StatusBadRequest)
+		return
+	}
+	appender, ok := api.store.(storage.Appender)
+	if !ok {
+		http.Error(w, "This store can't append to objects", http.StatusNotImplemented)
+		return
+	}
+
+	expectedVersion, err := parseVersionMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.checkWriteLock(w, r, key) {
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	owner := callerID(r)
+	if owner == "" {
+		owner = "anonymous"
+	}
+
+	obj, err := appender.AppendWithOptions(key, r.Body, storage.AppendOptions{
+		ContentType: contentType,
+		Owner:       owner,
+		IfVersion:   expectedVersion,
+		// Chunked uploads report -1 and are exempt
+		ExpectedSize: r.ContentLength,
+		Actor:        callerID(r),
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrReadOnly):
+			writeReadOnlyError(w, err)
+		case errors.Is(err, storage.ErrCorrupt):
+			writeCorruptionError(w, err)
+		case errors.Is(err, storage.ErrPreconditionFailed):
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		case errors.Is(err, storage.ErrIncompleteUpload), errors.Is(err, io.ErrUnexpectedEOF):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, storage.ErrQuotaExceeded):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	api.trackAccess(obj.ID, "write", r.Header.Get("User-ID"), obj.Size)
+	if api.usage != nil && r.ContentLength > 0 {
+		api.usage.RecordUpload(principal(r), r.ContentLength)
+	}
+
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setVersionIDHeader(w, obj)
+	setChecksumHeaders(w, obj)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// SetAdminKeys enables API-key protection of the admin endpoints and the dashboard.
+// With no keys configured they stay open.
+func (api *APIServer) SetAdminKeys(keys []string) {
+	api.authMutex.Lock()
+	defer api.authMutex.Unlock()
+	api.adminKeys = keys
+}
+
+// requireAdmin rejects requests that don't present a configured key in X-API-Key
+// (or ?api_key= for browsers loading the dashboard)
+func (api *APIServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !api.isAdmin(r) {
+			http.Error(w, "Admin API key required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether the request carries a configured admin key. With no keys
+// configured everyone is an admin.
+func (api *APIServer) isAdmin(r *http.Request) bool {
+	api.authMutex.RLock()
+	keys := api.adminKeys
+	api.authMutex.RUnlock()
+
+	if len(keys) == 0 {
+		return true
+	}
+
+	presented := r.Header.Get("X-API-Key")
+	if presented == "" {
+		presented = r.URL.Query().Get("api_key")
+	}
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
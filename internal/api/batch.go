@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+const maxBatchDelete = 1000
+
+// batchResult is the outcome for one key of a batch delete
+type batchResult struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+	Status  int    `json:"status,omitempty"` // what a single DELETE would have answered
+}
+
+// batchDelete deletes the keys in a JSON array body, up to maxBatchDelete of them. Keys
+// that can't be deleted, because they don't exist or are locked, are reported one by one
+// and don't stop the rest.
+func (api *APIServer) batchDelete(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := api.requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "Request body must be a JSON array of keys", http.StatusBadRequest)
+		return
+	}
+	if len(keys) == 0 || len(keys) > maxBatchDelete {
+		http.Error(w, fmt.Sprintf("A batch holds 1 to %d keys", maxBatchDelete), http.StatusBadRequest)
+		return
+	}
+	if api.store.ReadOnly() {
+		writeReadOnlyError(w, storage.ErrReadOnly)
+		return
+	}
+
+	failed := make(map[string]error)
+	var names []string
+	for _, key := range keys {
+		name := storage.ObjectName(bucket, key)
+		if api.locks != nil {
+			if err := api.locks.CheckWrite(name, r.Header.Get("X-Lock-Token")); err != nil {
+				failed[name] = err
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+
+	actor := callerID(r)
+	if batcher, ok := api.store.(storage.BatchDeleter); ok {
+		for name, err := range batcher.DeleteBatch(names, actor) {
+			failed[name] = err
+		}
+	} else {
+		for _, name := range names {
+			if err := api.store.DeleteWithOptions(name, storage.DeleteOptions{Actor: actor}); err != nil {
+				failed[name] = err
+			}
+		}
+	}
+
+	results := make([]batchResult, 0, len(keys))
+	deleted := 0
+	for _, key := range keys {
+		err, isFailed := failed[storage.ObjectName(bucket, key)]
+		if !isFailed {
+			results = append(results, batchResult{Key: key, Deleted: true})
+			deleted++
+			continue
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			status = http.StatusNotFound
+		} else if isLockError(err) {
+			status = http.StatusLocked
+		} else if errors.Is(err, storage.ErrReadOnly) {
+			status = http.StatusServiceUnavailable
+		}
+		results = append(results, batchResult{Key: key, Error: err.Error(), Status: status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"deleted": deleted,
+		"failed":  len(results) - deleted,
+	})
+}
+
+func isLockError(err error) bool {
+	var locked *lock.LockedError
+	return errors.As(err, &locked) || errors.Is(err, lock.ErrNotLocked) || errors.Is(err, lock.ErrTokenMismatch)
+}
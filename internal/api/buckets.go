@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// requestBucket returns the bucket a request addresses, the default one for the legacy
+// /objects routes. Unknown buckets are answered with a 404 here.
+func (api *APIServer) requestBucket(w http.ResponseWriter, r *http.Request) (string, bool) {
+	bucket := mux.Vars(r)["bucket"]
+	if bucket == "" {
+		return storage.DefaultBucket, true
+	}
+	if !api.bucketExists(bucket) {
+		http.Error(w, fmt.Sprintf("%v: %s", storage.ErrBucketNotFound, bucket), http.StatusNotFound)
+		return "", false
+	}
+	return bucket, true
+}
+
+// objectKey returns the store-wide name of the object a request addresses
+func (api *APIServer) objectKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	bucket, ok := api.requestBucket(w, r)
+	if !ok {
+		return "", false
+	}
+	return storage.ObjectName(bucket, mux.Vars(r)["key"]), true
+}
+
+// subresources end the paths of what belongs to an object, like /objects/{key}/lock, so a
+// key ending in one would be routed there instead of to the object itself
+var subresources = []string{"/versions", "/rename", "/tier", "/lock"}
+
+// checkKey answers 400 for a key that can't be written, see storage.ValidateKey, or that
+// couldn't be read back because its path is taken by one of subresources
+func checkKey(w http.ResponseWriter, key string) bool {
+	err := storage.ValidateKey(key)
+	for _, suffix := range subresources {
+		if err == nil && strings.HasSuffix(key, suffix) {
+			err = fmt.Errorf("%w: key can't end in %q, that path addresses the object's %s", storage.ErrInvalidKey, suffix, suffix[1:])
+		}
+	}
+	if err == nil {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+		"key":   key,
+	})
+	return false
+}
+
+func (api *APIServer) bucketExists(name string) bool {
+	if name == storage.DefaultBucket {
+		return true
+	}
+	buckets, ok := api.store.(storage.Bucketer)
+	return ok && buckets.BucketExists(name)
+}
+
+func (api *APIServer) listBuckets(w http.ResponseWriter, r *http.Request) {
+	var list []storage.BucketInfo
+	if buckets, ok := api.store.(storage.Bucketer); ok {
+		list = buckets.ListBuckets()
+	} else {
+		info := storage.BucketInfo{Name: storage.DefaultBucket}
+		for _, obj := range api.store.List() {
+			info.Objects++
+			info.Bytes += obj.Size
+		}
+		list = []storage.BucketInfo{info}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"buckets": list})
+}
+
+func (api *APIServer) createBucket(w http.ResponseWriter, r *http.Request) {
+	buckets, ok := api.store.(storage.Bucketer)
+	if !ok {
+		http.Error(w, "Store does not support buckets", http.StatusNotImplemented)
+		return
+	}
+
+	name := mux.Vars(r)["bucket"]
+	if err := buckets.CreateBucket(name); err != nil {
+		writeBucketError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"bucket": name})
+}
+
+// deleteBucket removes an empty bucket; ?force=true deletes its objects too
+func (api *APIServer) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	buckets, ok := api.store.(storage.Bucketer)
+	if !ok {
+		http.Error(w, "Store does not support buckets", http.StatusNotImplemented)
+		return
+	}
+
+	name := mux.Vars(r)["bucket"]
+	force := r.URL.Query().Get("force") == "true"
+	deleted, err := buckets.DeleteBucket(name, force, callerID(r))
+	if err != nil {
+		writeBucketError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bucket":          name,
+		"deleted_objects": deleted,
+	})
+}
+
+func writeBucketError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrReadOnly) {
+		writeReadOnlyError(w, err)
+		return
+	}
+	http.Error(w, err.Error(), bucketErrorStatus(err))
+}
+
+func bucketErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrBucketExists), errors.Is(err, storage.ErrBucketNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrInvalidBucketName):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+var keySeeds = []string{
+	"report.pdf",
+	"docs/2024/q1 summary.txt",
+	"docs/a//b",
+	"docs/100% done",
+	"docs/encoded%2Fslash",
+	"docs/what?#fragment",
+	"docs/日本語のキー",
+	"docs/emoji 🚀",
+	"",
+	"/leading",
+	"../etc/passwd",
+	"docs/../../escape",
+	"tab\there",
+	"null\x00byte",
+	"bad\xffutf8",
+	"docs/photo/versions",
+	strings.Repeat("k", storage.MaxKeyLength),
+	strings.Repeat("k", storage.MaxKeyLength+1),
+}
+
+// FuzzCheckKey holds checkKey to the rules the store relies on: whatever it lets through
+// can't escape the data directory or confuse the router, and whatever it refuses gets a
+// 400 saying why
+func FuzzCheckKey(f *testing.F) {
+	for _, key := range keySeeds {
+		f.Add(key)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		w := httptest.NewRecorder()
+		if !checkKey(w, key) {
+			var body struct {
+				Error string `json:"error"`
+				Key   string `json:"key"`
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("refused %q with status %d, want 400", key, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error == "" {
+				t.Fatalf("refused %q without a JSON error (%v)", key, err)
+			}
+			return
+		}
+
+		switch {
+		case key == "" || len(key) > storage.MaxKeyLength:
+			t.Fatalf("accepted a key of %d bytes", len(key))
+		case !utf8.ValidString(key):
+			t.Fatalf("accepted invalid UTF-8 %q", key)
+		case strings.HasPrefix(key, "/") || strings.Contains(key, ".."):
+			t.Fatalf("accepted %q, which could leave its directory", key)
+		case strings.ContainsFunc(key, unicode.IsControl):
+			t.Fatalf("accepted %q, which has a control character", key)
+		}
+		for _, suffix := range subresources {
+			if strings.HasSuffix(key, suffix) {
+				t.Fatalf("accepted %q, which would be routed to %s", key, suffix)
+			}
+		}
+	})
+}
+
+// FuzzKeyRoundTrip writes each key checkKey accepts through the router into a FileStore,
+// both in the default bucket and in another, and reads it back before and after the store
+// is reopened
+func FuzzKeyRoundTrip(f *testing.F) {
+	for _, key := range keySeeds {
+		f.Add(key)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		if !checkKey(httptest.NewRecorder(), key) {
+			return
+		}
+
+		dir := t.TempDir()
+		store, err := storage.OpenFileStore(dir, storage.MetadataJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreateBucket("docs"); err != nil {
+			t.Fatal(err)
+		}
+		paths := map[string]string{
+			"/objects/" + url.PathEscape(key):              storage.ObjectName(storage.DefaultBucket, key),
+			"/buckets/docs/objects/" + url.PathEscape(key): storage.ObjectName("docs", key),
+		}
+
+		api := NewAPIServer(store)
+		for path, name := range paths {
+			data := "stored as " + name
+			if w := serve(api, http.MethodPut, path, data); w.Code != http.StatusCreated && w.Code != http.StatusOK {
+				t.Fatalf("PUT %s = %d: %s", path, w.Code, w.Body)
+			}
+			if w := serve(api, http.MethodGet, path, ""); w.Code != http.StatusOK || w.Body.String() != data {
+				t.Fatalf("GET %s = %d %q, want %q", path, w.Code, w.Body, data)
+			}
+			if _, exists := store.List()[name]; !exists {
+				t.Fatalf("%q isn't listed as %q", key, name)
+			}
+		}
+
+		if err := store.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := storage.OpenFileStore(dir, storage.MetadataJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Stop(context.Background())
+		api = NewAPIServer(reopened)
+		for path, name := range paths {
+			if w := serve(api, http.MethodGet, path, ""); w.Code != http.StatusOK || w.Body.String() != "stored as "+name {
+				t.Fatalf("after reopening, GET %s = %d %q, want the data", path, w.Code, w.Body)
+			}
+		}
+	})
+}
+
+func serve(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, reader))
+	return w
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/internal/catalog"
+)
+
+// SetCatalog makes listings and lookups cluster-wide and serves this node's catalog
+// changes to its peers. The cluster has to be enabled first.
+func (api *APIServer) SetCatalog(c *catalog.Catalog) {
+	api.catalog = c
+	api.router.HandleFunc("/internal/catalog", api.cluster.RequireToken(api.getCatalogChanges)).Methods("GET")
+}
+
+func (api *APIServer) getCatalogChanges(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if value := r.URL.Query().Get("since_seq"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since_seq", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	delta, err := api.catalog.Changes(since, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delta)
+}
+
+// setLocationHeader tells the client which nodes hold the object's bytes
+func setLocationHeader(w http.ResponseWriter, entry catalog.Entry) {
+	w.Header().Set("X-Object-Location", strings.Join(entry.Nodes, ","))
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/catalog"
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+)
+
+// catalogNode is one of two nodes syncing their catalogs with each other
+type catalogNode struct {
+	api     *APIServer
+	catalog *catalog.Catalog
+}
+
+func newCatalogNodes(t *testing.T) (*catalogNode, *catalogNode) {
+	t.Helper()
+	nodes := []*catalogNode{{}, {}}
+	servers := make([]*httptest.Server, len(nodes))
+	for i := range nodes {
+		node := nodes[i]
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.api.ServeHTTP(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+	}
+	ids := []string{"node-1", "node-2"}
+	for i, node := range nodes {
+		cm := cluster.NewClusterManager(ids[i], address(servers[i]))
+		other := 1 - i
+		if err := cm.RegisterNode(&cluster.Node{ID: ids[other], Address: address(servers[other]), Status: "healthy"}); err != nil {
+			t.Fatal(err)
+		}
+		node.api = newStatsServer(t)
+		node.api.EnableCluster(cm, nil)
+		// Synced by hand rather than on an interval
+		node.catalog = catalog.New(node.api.store, cm, time.Hour)
+		node.api.SetCatalog(node.catalog)
+	}
+	return nodes[0], nodes[1]
+}
+
+func syncAll(nodes ...*catalogNode) {
+	for _, node := range nodes {
+		node.catalog.Sync()
+	}
+}
+
+type listing struct {
+	Objects map[string]struct {
+		Checksum string   `json:"checksum"`
+		Version  int64    `json:"version"`
+		Location []string `json:"location"`
+	} `json:"objects"`
+}
+
+func list(t *testing.T, node *catalogNode) listing {
+	t.Helper()
+	w := serve(node.api, http.MethodGet, "/objects", "")
+	var l listing
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /objects = %d (%v)", w.Code, err)
+	}
+	return l
+}
+
+func TestCatalogSyncedAcrossNodes(t *testing.T) {
+	one, two := newCatalogNodes(t)
+	if w := serve(one.api, http.MethodPut, "/objects/report", "written to node-1"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(two.api, http.MethodPut, "/objects/notes", "written to node-2"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+	syncAll(one, two)
+
+	// Either node lists both, saying where each lives
+	first, second := list(t, one), list(t, two)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("node-1 lists %+v, node-2 %+v", first, second)
+	}
+	if len(first.Objects) != 2 {
+		t.Fatalf("listed %+v, want report and notes", first.Objects)
+	}
+	if got := first.Objects["report"].Location; !reflect.DeepEqual(got, []string{"node-1"}) {
+		t.Errorf("report located on %v, want node-1", got)
+	}
+	if got := first.Objects["notes"].Location; !reflect.DeepEqual(got, []string{"node-2"}) {
+		t.Errorf("notes located on %v, want node-2", got)
+	}
+	if held, err := one.api.store.Stat("report"); err != nil || first.Objects["report"].Checksum != held.Checksum {
+		t.Errorf("report listed with checksum %s, want node-1's (%v)", first.Objects["report"].Checksum, err)
+	}
+
+	// node-2 can describe report without holding it, and says where to get it
+	w := serve(two.api, http.MethodHead, "/objects/report", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Object-Location") != "node-1" {
+		t.Errorf("HEAD on node-2 = %d at %q, want 200 at node-1", w.Code, w.Header().Get("X-Object-Location"))
+	}
+	if w := serve(two.api, http.MethodGet, "/objects/report", ""); w.Code != http.StatusNotFound || w.Header().Get("X-Object-Location") != "node-1" {
+		t.Errorf("GET on node-2 = %d at %q, want pointed at node-1", w.Code, w.Header().Get("X-Object-Location"))
+	}
+
+	// Later changes arrive as deltas: a deletion, and a newer version of notes written
+	// to node-1 wins over node-2's older one
+	if w := serve(one.api, http.MethodDelete, "/objects/report", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d: %s", w.Code, w.Body)
+	}
+	for _, data := range []string{"first on node-1", "second on node-1"} {
+		if w := serve(one.api, http.MethodPut, "/objects/notes", data); w.Code != http.StatusOK {
+			t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+		}
+	}
+	syncAll(one, two)
+
+	first, second = list(t, one), list(t, two)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("node-1 lists %+v, node-2 %+v", first, second)
+	}
+	notes, listed := first.Objects["notes"]
+	if len(first.Objects) != 1 || !listed {
+		t.Fatalf("listed %+v, want only notes", first.Objects)
+	}
+	held, err := one.api.store.Stat("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes.Checksum != held.Checksum || notes.Version != 2 || strings.Join(notes.Location, ",") != "node-1" {
+		t.Errorf("notes = %+v, want node-1's version 2", notes)
+	}
+}
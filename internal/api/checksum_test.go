@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// putWithAlgorithm serves a PUT asking for the named checksum algorithm
+func putWithAlgorithm(api *APIServer, path, body, algorithm string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+	r.Header.Set("X-Checksum-Algorithm", algorithm)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestChecksumAlgorithmChosenPerPut(t *testing.T) {
+	api := newStatsServer(t)
+	const data = "quarterly figures, final"
+
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		want, err := storage.Checksum(algorithm, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := "/objects/report-" + algorithm
+		w := putWithAlgorithm(api, path, data, strings.ToUpper(algorithm))
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT with %s = %d: %s", algorithm, w.Code, w.Body)
+		}
+		// Answered the same on the write, on reads and on HEAD
+		for _, w := range []*httptest.ResponseRecorder{w, serve(api, http.MethodGet, path, ""), serve(api, http.MethodHead, path, "")} {
+			if got := w.Header().Get("X-Checksum"); got != want {
+				t.Errorf("%s: X-Checksum %s, want %s", algorithm, got, want)
+			}
+			if got := w.Header().Get("X-Checksum-Algorithm"); got != algorithm {
+				t.Errorf("%s: X-Checksum-Algorithm %s", algorithm, got)
+			}
+			if got := w.Header().Get("ETag"); got != algorithm+":"+want {
+				t.Errorf("%s: ETag %s, want %s:%s", algorithm, got, algorithm, want)
+			}
+		}
+	}
+
+	// Without the header the store's default applies
+	if w := serve(api, http.MethodPut, "/objects/plain", data); w.Header().Get("X-Checksum-Algorithm") != storage.ChecksumSHA256 {
+		t.Errorf("PUT without an algorithm used %q, want sha256", w.Header().Get("X-Checksum-Algorithm"))
+	}
+
+	w := putWithAlgorithm(api, "/objects/unknown", data, "crc7")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with crc7 = %d, want 400", w.Code)
+	}
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		if !strings.Contains(w.Body.String(), algorithm) {
+			t.Errorf("error %q doesn't list %s", strings.TrimSpace(w.Body.String()), algorithm)
+		}
+	}
+	if _, err := api.store.Stat("unknown"); err == nil {
+		t.Error("the object with an unknown algorithm was kept")
+	}
+}
+
+func TestReplicationVerifiesEachAlgorithm(t *testing.T) {
+	target := newReplicaTarget(t)
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	if err := cm.RegisterNode(&cluster.Node{ID: "node-2", Address: target.address, Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	rm := replication.NewReplicationManager(cm, store, 1)
+	rm.SetRetry(1, time.Millisecond, time.Minute)
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rm.Stop(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("quarterly "), 1<<14)
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		key := "report-" + algorithm
+		obj, err := store.PutWithOptions(key, bytes.NewReader(data), storage.PutOptions{ChecksumAlgorithm: algorithm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.ReplicateObject(ctx, obj, 1); err != nil {
+			t.Errorf("replicating the %s object: %v", algorithm, err)
+			continue
+		}
+		// Verified and recorded on node-2 in the algorithm it was written with
+		replica, err := target.store.Stat(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if replica.ChecksumAlgorithm != algorithm || replica.Checksum != obj.Checksum {
+			t.Errorf("%s replica recorded %s:%s, want %s:%s", key, replica.ChecksumAlgorithm, replica.Checksum, algorithm, obj.Checksum)
+		}
+	}
+
+	// A copy damaged on the way fails whichever algorithm checks it
+	target.damage.Store(true)
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		key := "damaged-" + algorithm
+		obj, err := store.PutWithOptions(key, bytes.NewReader(data), storage.PutOptions{ChecksumAlgorithm: algorithm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.ReplicateObject(ctx, obj, 1); err == nil {
+			t.Errorf("the damaged %s copy was accepted", algorithm)
+		}
+		if _, err := target.store.Stat(key); err == nil {
+			t.Errorf("the damaged %s copy was kept", algorithm)
+		}
+	}
+}
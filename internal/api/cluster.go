@@ -0,0 +1,378 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// EnableCluster attaches cluster membership and replication to the server and mounts
+// the cluster endpoints, those only other nodes call requiring the cluster token. Servers
+// without it run as a standalone node.
+func (api *APIServer) EnableCluster(cm *cluster.ClusterManager, rm *replication.ReplicationManager) {
+	api.cluster = cm
+	api.replication = rm
+	api.forwarding.transport = cm.NewClient(0).Transport
+
+	api.router.HandleFunc("/cluster/register", cm.RequireToken(cm.HandleNodeRegistration)).Methods("POST")
+	api.router.HandleFunc("/cluster/status", cm.HandleClusterStatus).Methods("GET")
+	api.router.HandleFunc("/cluster/events", cm.HandleEvents).Methods("GET")
+	api.router.HandleFunc("/cluster/stats/aggregate", api.getAggregateStats).Methods("GET")
+	api.router.HandleFunc("/cluster/events/watch", cm.HandleWatchEvents).Methods("GET")
+	api.router.HandleFunc("/internal/gossip", cm.RequireToken(cm.HandleGossip)).Methods("POST")
+	api.router.HandleFunc("/internal/heartbeat", cm.RequireToken(cm.HandleHeartbeat)).Methods("POST")
+	api.router.HandleFunc("/internal/nodes/{id}", cm.RequireToken(api.nodeLeaving)).Methods("DELETE")
+	api.router.HandleFunc("/replication/tasks", api.getReplicationTasks).Methods("GET")
+	api.router.HandleFunc("/replication/tasks/{id}", api.getReplicationTask).Methods("GET")
+	api.router.HandleFunc("/admin/replication/tasks/{id}", api.requireAdmin(api.acknowledgeReplicationTask)).Methods("DELETE")
+	api.router.HandleFunc("/replication/stats", api.getReplicationStats).Methods("GET")
+	api.router.HandleFunc("/replication/queue", api.getReplicationQueue).Methods("GET")
+	api.router.HandleFunc("/replication/repair/status", api.getRepairStatus).Methods("GET")
+	api.router.HandleFunc("/internal/replicate/{key:.+}", cm.RequireToken(api.receiveReplica)).Methods("PUT")
+	api.router.HandleFunc("/internal/replicate/{key:.+}", cm.RequireToken(api.serveReplica)).Methods("GET")
+	api.router.HandleFunc("/internal/replicate/{key:.+}", cm.RequireToken(api.dropReplica)).Methods("DELETE")
+	api.router.HandleFunc("/internal/inventory", cm.RequireToken(api.getInventory)).Methods("GET")
+	api.router.HandleFunc("/internal/rebalance", cm.RequireToken(api.rebalanceHere)).Methods("POST", "DELETE")
+	api.router.HandleFunc("/replication/rebalance/status", api.getRebalanceStatus).Methods("GET")
+	api.router.HandleFunc("/admin/rebalance", api.requireAdmin(api.startRebalance)).Methods("POST")
+	api.router.HandleFunc("/admin/rebalance", api.requireAdmin(api.cancelRebalance)).Methods("DELETE")
+	api.router.HandleFunc("/admin/drain", api.requireAdmin(api.getDrainStatus)).Methods("GET")
+	api.router.HandleFunc("/admin/drain", api.requireAdmin(api.startDrain)).Methods("POST")
+	api.router.HandleFunc("/admin/drain", api.requireAdmin(api.cancelDrain)).Methods("DELETE")
+	api.router.HandleFunc("/internal/tiering/run", cm.RequireToken(api.autoTierHere)).Methods("POST")
+	api.router.HandleFunc("/replication/sync/status", api.getSyncStatus).Methods("GET")
+	api.router.HandleFunc("/admin/sync", api.requireAdmin(api.startSync)).Methods("POST")
+}
+
+// nodeLeaving takes a node's word that it is leaving the cluster, see ClusterManager.Leave.
+// Only the node itself can say so.
+func (api *APIServer) nodeLeaving(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := api.cluster.GetNode(id); !exists {
+		http.Error(w, "Unknown node", http.StatusNotFound)
+		return
+	}
+	if !api.cluster.IsPeer(id, r.RemoteAddr) {
+		http.Error(w, "Only a node itself can leave the cluster", http.StatusForbidden)
+		return
+	}
+	if !api.cluster.MarkLeft(id) {
+		http.Error(w, "Unknown node", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *APIServer) getReplicationTasks(w http.ResponseWriter, r *http.Request) {
+	tasks := api.replication.GetAllReplicationTasks()
+	if tasks == nil {
+		tasks = []*replication.ReplicationTask{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// getReplicationTask reports on the task for one object, by its ID as X-Replication-Task
+// names it. A task that has been pruned is 410 Gone, which says nothing about whether the
+// copies were made.
+func (api *APIServer) getReplicationTask(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	task, err := api.replication.GetReplicationStatus(id)
+	if err != nil {
+		status, state := http.StatusNotFound, "unknown"
+		if errors.Is(err, replication.ErrTaskExpired) {
+			status, state = http.StatusGone, "expired"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     err.Error(),
+			"object_id": id,
+			"status":    state,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// acknowledgeReplicationTask forgets a finished task, typically a failed one that has been
+// dealt with
+func (api *APIServer) acknowledgeReplicationTask(w http.ResponseWriter, r *http.Request) {
+	err := api.replication.AcknowledgeTask(mux.Vars(r)["id"])
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, replication.ErrTaskInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, replication.ErrTaskExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func (api *APIServer) getReplicationStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.Stats())
+}
+
+func (api *APIServer) getReplicationQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.GetQueueStats())
+}
+
+func (api *APIServer) getRepairStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.GetRepairStatus())
+}
+
+// startSync pulls from another node what this one is missing, see SyncFrom. The body names
+// the node and, optionally, how far back to look; progress is at /replication/sync/status.
+func (api *APIServer) startSync(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		NodeID string     `json:"node_id"`
+		Since  *time.Time `json:"since"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+		http.Error(w, "Request body must be {\"node_id\": \"...\", \"since\": \"<RFC 3339 time, optional>\"}", http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if req.Since != nil {
+		since = *req.Since
+	}
+
+	if err := api.replication.StartSync(req.NodeID, since); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, replication.ErrSyncRunning) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(api.replication.GetSyncStatus())
+}
+
+// startRebalance has every node move copies off the nodes fuller than average, see
+// ReplicationManager.StartRebalance. Only the leader takes it; ?resume=true carries on
+// where the last run stopped. Progress is at /replication/rebalance/status on each node.
+func (api *APIServer) startRebalance(w http.ResponseWriter, r *http.Request) {
+	resume := r.URL.Query().Get("resume") == "true"
+	if err := api.replication.StartClusterRebalance(resume); err != nil {
+		api.rebalanceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(api.replication.GetRebalanceStatus())
+}
+
+// cancelRebalance stops the rebalance on every node; only the leader takes it
+func (api *APIServer) cancelRebalance(w http.ResponseWriter, r *http.Request) {
+	if err := api.replication.CancelClusterRebalance(); err != nil {
+		api.rebalanceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rebalanceHere starts (POST) or cancels (DELETE) this node's part of a rebalance at the
+// leader's word
+func (api *APIServer) rebalanceHere(w http.ResponseWriter, r *http.Request) {
+	if !api.cluster.IsPeer(r.Header.Get("X-Replication-Source"), r.RemoteAddr) {
+		http.Error(w, "Rebalancing is only started by other cluster nodes", http.StatusForbidden)
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		err = api.replication.StartRebalance(r.URL.Query().Get("resume") == "true")
+	} else {
+		err = api.replication.CancelRebalance()
+	}
+	if err != nil {
+		api.rebalanceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *APIServer) rebalanceError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, replication.ErrRebalanceRunning), errors.Is(err, replication.ErrNoRebalance),
+		errors.Is(err, replication.ErrNotLeader):
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// startDrain has this node hand its objects over to the others ahead of being taken out,
+// see ReplicationManager.StartDrain. Progress is at GET /admin/drain.
+func (api *APIServer) startDrain(w http.ResponseWriter, r *http.Request) {
+	if err := api.replication.StartDrain(); errors.Is(err, replication.ErrDrainRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(api.replication.GetDrainStatus())
+}
+
+// cancelDrain stops a drain, or undoes a finished one, so this node takes writes again
+func (api *APIServer) cancelDrain(w http.ResponseWriter, r *http.Request) {
+	if err := api.replication.CancelDrain(); errors.Is(err, replication.ErrNotDraining) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	api.getDrainStatus(w, r)
+}
+
+func (api *APIServer) getDrainStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.GetDrainStatus())
+}
+
+func (api *APIServer) getRebalanceStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.GetRebalanceStatus())
+}
+
+func (api *APIServer) getSyncStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.replication.GetSyncStatus())
+}
+
+// writePolicy is how many copies a PUT waits for, see SetWriteConsistency
+type writePolicy struct {
+	mutex     sync.RWMutex
+	level     replication.Consistency
+	timeout   time.Duration
+	strict    bool
+	maxFactor int // the most copies a PUT can ask for with X-Replication-Factor
+}
+
+// SetWriteConsistency makes PUTs wait for level copies unless they ask for another with
+// X-Write-Consistency, for up to timeout. A PUT that doesn't get them fails with 503 when
+// strict; otherwise it is answered with 202 and the replication carries on. Either way the
+// object is stored here and its replication task is flagged under-replicated. Strict PUTs
+// also wait for the replication manager's MinSuccess copies when that is more.
+func (api *APIServer) SetWriteConsistency(level replication.Consistency, timeout time.Duration, strict bool) {
+	api.writes.mutex.Lock()
+	defer api.writes.mutex.Unlock()
+	api.writes.level, api.writes.timeout, api.writes.strict = level, timeout, strict
+}
+
+// SetMaxReplicationFactor caps the number of other nodes a PUT can ask for its object to
+// be kept on with X-Replication-Factor
+func (api *APIServer) SetMaxReplicationFactor(max int) {
+	api.writes.mutex.Lock()
+	defer api.writes.mutex.Unlock()
+	api.writes.maxFactor = max
+}
+
+// parseReplicationFactor reads X-Replication-Factor, nil if the request doesn't set it
+func (api *APIServer) parseReplicationFactor(r *http.Request) (*int, error) {
+	value := r.Header.Get("X-Replication-Factor")
+	if value == "" {
+		return nil, nil
+	}
+	api.writes.mutex.RLock()
+	max := api.writes.maxFactor
+	api.writes.mutex.RUnlock()
+
+	factor, err := strconv.Atoi(value)
+	if err != nil || factor < 0 {
+		return nil, fmt.Errorf("X-Replication-Factor must be a number of nodes, not %q", value)
+	}
+	if factor > max {
+		return nil, fmt.Errorf("X-Replication-Factor can be at most %d", max)
+	}
+	return &factor, nil
+}
+
+// parseWriteConsistency reads X-Write-Consistency, empty if the request doesn't set it
+func parseWriteConsistency(r *http.Request) (replication.Consistency, error) {
+	value := r.Header.Get("X-Write-Consistency")
+	if value == "" {
+		return "", nil
+	}
+	return replication.ParseConsistency(value)
+}
+
+// replicate copies an object just written here to other nodes. The request body has been
+// used up by then, so each node is sent the data from the local store.
+//
+// It waits for as many copies as level asks for (the server default if empty) and returns
+// the status to answer with, or false once it has answered with 503 itself.
+func (api *APIServer) replicate(w http.ResponseWriter, r *http.Request, obj *models.StorageObject, level replication.Consistency) (int, bool) {
+	if api.replication == nil {
+		return http.StatusOK, true
+	}
+	api.writes.mutex.RLock()
+	timeout, strict := api.writes.timeout, api.writes.strict
+	if level == "" {
+		level = api.writes.level
+	}
+	api.writes.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	acks := api.replication.RequiredAcks(level, obj)
+	if min := api.replication.MinSuccess(obj); strict && min > acks {
+		acks = min
+	}
+	err := api.replication.ReplicateObject(ctx, obj, acks)
+	if err == nil {
+		return http.StatusOK, true
+	}
+	if errors.Is(err, replication.ErrQueueFull) {
+		// The copies will still be made, just without anyone waiting for them
+		log.Printf("Replication of %s queued in the background: %v", obj.Key, err)
+		w.Header().Set("Warning", `199 - "replication queue is full, replicating asynchronously"`)
+		w.Header().Set("X-Replication-Task", obj.ID)
+		return http.StatusAccepted, true
+	}
+	if !errors.Is(err, replication.ErrUnderReplicated) {
+		// Nobody is waiting for the copies, they'll be made when they can
+		log.Printf("Failed to replicate %s: %v", obj.Key, err)
+		return http.StatusOK, true
+	}
+
+	log.Printf("Write of %s is under-replicated: %v", obj.Key, err)
+	w.Header().Set("X-Replication-Task", obj.ID)
+	if !strict {
+		return http.StatusAccepted, true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   err.Error(),
+		"key":     obj.Key,
+		"task_id": obj.ID,
+		"version": obj.Version,
+	})
+	return 0, false
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// copyObject answers a PUT carrying X-Copy-Source: the source object is copied on the
+// server, so its data never passes through the client. Sources are object names, key or
+// bucket/key.
+func (api *APIServer) copyObject(w http.ResponseWriter, r *http.Request, key, source string) {
+	copier, ok := api.store.(storage.Copier)
+	if !ok {
+		http.Error(w, "This store can't copy objects", http.StatusNotImplemented)
+		return
+	}
+	overwrite, err := parseOverwrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.checkWriteLock(w, r, key) {
+		return
+	}
+
+	owner := callerID(r)
+	if owner == "" {
+		owner = "anonymous"
+	}
+	obj, err := copier.Copy(strings.TrimPrefix(source, "/"), key, storage.CopyOptions{
+		Overwrite: overwrite,
+		Owner:     owner,
+		Actor:     callerID(r),
+	})
+	if err != nil {
+		writeCopyError(w, err)
+		return
+	}
+
+	api.trackAccess(obj.ID, "write", r.Header.Get("User-ID"), obj.Size)
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setVersionIDHeader(w, obj)
+	setChecksumHeaders(w, obj)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// renameObject moves an object to the name in {"destination": "..."}
+func (api *APIServer) renameObject(w http.ResponseWriter, r *http.Request) {
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+	copier, ok := api.store.(storage.Copier)
+	if !ok {
+		http.Error(w, "This store can't rename objects", http.StatusNotImplemented)
+		return
+	}
+
+	var req struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Destination == "" {
+		http.Error(w, "Request body must be {\"destination\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	destination := strings.TrimPrefix(req.Destination, "/")
+	if !checkKey(w, destination) {
+		return
+	}
+	overwrite, err := parseOverwrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.checkWriteLock(w, r, key) || !api.checkWriteLock(w, r, destination) {
+		return
+	}
+
+	obj, err := copier.Rename(key, destination, storage.CopyOptions{Overwrite: overwrite, Actor: callerID(r)})
+	if err != nil {
+		writeCopyError(w, err)
+		return
+	}
+
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setVersionIDHeader(w, obj)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// parseOverwrite reads ?overwrite=, which a copy or rename needs to replace an object
+func parseOverwrite(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("overwrite")
+	if value == "" {
+		return false, nil
+	}
+	overwrite, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid overwrite: want true or false")
+	}
+	return overwrite, nil
+}
+
+func writeCopyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrReadOnly):
+		writeReadOnlyError(w, err)
+	case errors.Is(err, storage.ErrCorrupt):
+		writeCorruptionError(w, err)
+	case errors.Is(err, storage.ErrObjectNotFound), errors.Is(err, storage.ErrBucketNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrDestinationExists):
+		http.Error(w, err.Error()+" (set overwrite=true to replace it)", http.StatusConflict)
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
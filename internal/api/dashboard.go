@@ -0,0 +1,17 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed static/dashboard.html
+var dashboardHTML []byte
+
+// serveDashboard serves the single-page status dashboard. The page pulls everything it
+// shows from the JSON endpoints and marks subsystems that aren't mounted as not configured.
+func (api *APIServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardHTML)
+}
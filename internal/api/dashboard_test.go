@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+)
+
+// dashboardCalls lists the endpoints the dashboard page fetches
+func dashboardCalls(t *testing.T, page string) []string {
+	t.Helper()
+	var paths []string
+	for _, match := range regexp.MustCompile(`fetchJSON\("([^"]+)"\)`).FindAllStringSubmatch(page, -1) {
+		paths = append(paths, match[1])
+	}
+	if len(paths) == 0 {
+		t.Fatal("the dashboard fetches nothing")
+	}
+	return paths
+}
+
+func TestDashboard(t *testing.T) {
+	api := newStatsServer(t, "a", "bb")
+	w := serve(api, http.MethodGet, "/dashboard", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("/dashboard = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	page := w.Body.String()
+	// Everything it needs is in the page or on this node
+	if strings.Contains(page, "http://") || strings.Contains(page, "https://") || strings.Contains(page, "src=") {
+		t.Error("the dashboard loads something from elsewhere")
+	}
+	calls := dashboardCalls(t, page)
+	for _, want := range []string{"/stats", "/cluster/status", "/replication/tasks", "/tiering/recommendations"} {
+		found := false
+		for _, path := range calls {
+			found = found || path == want
+		}
+		if !found {
+			t.Errorf("the dashboard doesn't fetch %s, only %v", want, calls)
+		}
+	}
+
+	// Standalone, the cluster's endpoints aren't there and the page says so on a 404
+	for _, path := range calls {
+		w := serve(api, http.MethodGet, path, "")
+		switch path {
+		case "/cluster/status", "/replication/tasks":
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s standalone = %d, want 404 for not configured", path, w.Code)
+			}
+		default:
+			if w.Code != http.StatusOK {
+				t.Errorf("%s standalone = %d", path, w.Code)
+			}
+		}
+	}
+
+	// In a cluster every one answers, in the shape the page reads
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	rm := replication.NewReplicationManager(cm, api.store, 1)
+	api.EnableCluster(cm, rm)
+	for _, path := range calls {
+		w := serve(api, http.MethodGet, path, "")
+		var body interface{}
+		if err := json.NewDecoder(w.Body).Decode(&body); w.Code != http.StatusOK || err != nil {
+			t.Errorf("%s in a cluster = %d (%v)", path, w.Code, err)
+			continue
+		}
+		switch path {
+		case "/stats":
+			if stats, ok := body.(map[string]interface{}); !ok || stats["total_objects"] != 2.0 || stats["tier_distribution"] == nil {
+				t.Errorf("/stats = %v, want total_objects and tier_distribution", body)
+			}
+		case "/cluster/status":
+			if status, ok := body.(map[string]interface{}); !ok || status["nodes"] == nil || status["healthy_nodes"] == nil || status["total_nodes"] == nil {
+				t.Errorf("/cluster/status = %v, want nodes and their counts", body)
+			}
+		case "/replication/tasks", "/tiering/recommendations":
+			if _, ok := body.([]interface{}); !ok {
+				t.Errorf("%s = %v, want a list", path, body)
+			}
+		}
+	}
+}
+
+func TestDashboardRequiresAdmin(t *testing.T) {
+	api := newStatsServer(t)
+	api.SetAdminKeys([]string{"secret"})
+
+	if w := serve(api, http.MethodGet, "/dashboard", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("/dashboard without a key = %d, want 401", w.Code)
+	}
+	// The page passes ?api_key= on to its own calls as X-API-Key
+	if w := serve(api, http.MethodGet, "/dashboard?api_key=secret", ""); w.Code != http.StatusOK {
+		t.Errorf("/dashboard?api_key= = %d, want 200", w.Code)
+	}
+	for key, want := range map[string]int{"wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("/dashboard with key %q = %d, want %d", key, w.Code, want)
+		}
+	}
+}
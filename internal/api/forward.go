@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// HopsHeader counts the times a client request has been forwarded between nodes. A node
+// serves one that has come maxForwardHops hops itself, so requests never go round in
+// circles while tables disagree about who owns a key.
+const (
+	HopsHeader     = "X-Forwarded-Hops"
+	maxForwardHops = 1
+)
+
+// ForwardedToHeader names the node that answered a forwarded request
+const ForwardedToHeader = "X-Forwarded-To"
+
+// forwarding is the sending of object requests to the nodes that own their keys, see
+// SetForwarding
+type forwarding struct {
+	enabled   atomic.Bool
+	transport http.RoundTripper
+	forwarded atomic.Int64
+	failed    atomic.Int64
+	latency   atomic.Int64 // nanoseconds, summed over the forwarded requests
+}
+
+// ForwardStats counts the object requests sent on to other nodes
+type ForwardStats struct {
+	Forwarded int64 `json:"forwarded"`
+	Failed    int64 `json:"failed"` // no owner could be reached
+	// AverageLatency is how long, in milliseconds, forwarded requests took on average to
+	// be answered, head and body, as this node saw it
+	AverageLatency float64 `json:"average_latency_ms"`
+}
+
+// SetForwarding has object requests for keys this node doesn't own passed on to the nodes
+// that do, see ClusterManager.GetNodesForKey. PUTs go to the first healthy owner unless
+// this node is one. GETs, HEADs and DELETEs of objects held here are served here, and
+// others go to the nodes the catalog says hold them, or else the owners, in turn until
+// one answers. The answer is streamed back as it is; ?local_only=true skips forwarding.
+func (api *APIServer) SetForwarding(enabled bool) {
+	api.forwarding.enabled.Store(enabled)
+}
+
+// GetForwardStats reports how forwarding has gone since the server started
+func (api *APIServer) GetForwardStats() ForwardStats {
+	stats := ForwardStats{Forwarded: api.forwarding.forwarded.Load(), Failed: api.forwarding.failed.Load()}
+	if stats.Forwarded > 0 {
+		stats.AverageLatency = float64(api.forwarding.latency.Load()) / float64(stats.Forwarded) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// forwarded serves a request for an object through next, unless it is to be forwarded
+func (api *APIServer) forwarded(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hops, _ := strconv.Atoi(r.Header.Get(HopsHeader))
+		if api.cluster == nil || !api.forwarding.enabled.Load() || hops >= maxForwardHops || r.URL.Query().Get("local_only") == "true" {
+			next(w, r)
+			return
+		}
+		bucket := mux.Vars(r)["bucket"]
+		if bucket == "" {
+			bucket = storage.DefaultBucket
+		}
+		targets := api.forwardTargets(r, storage.ObjectName(bucket, mux.Vars(r)["key"]))
+		if len(targets) == 0 || !api.forward(w, r, targets, hops) {
+			next(w, r)
+		}
+	}
+}
+
+// forwardTargets returns the healthy nodes to try for a request for key, in turn, none if
+// it is to be served here
+func (api *APIServer) forwardTargets(r *http.Request, key string) []*cluster.Node {
+	self := api.cluster.GetCurrentNode().ID
+	owners := api.cluster.GetNodesForKey(key, api.replication.Factor(&models.StorageObject{})+1)
+
+	var candidates []*cluster.Node
+	if r.Method == http.MethodPut {
+		for _, node := range owners {
+			if node.ID == self {
+				return nil
+			}
+		}
+		candidates = owners
+	} else {
+		if _, err := api.store.Stat(key); !errors.Is(err, storage.ErrObjectNotFound) {
+			return nil // here, or for this node to say what is wrong with it
+		}
+		if api.catalog != nil {
+			if entry, exists := api.catalog.Lookup(key); exists {
+				for _, nodeID := range entry.Nodes {
+					if node, ok := api.cluster.GetNode(nodeID); ok {
+						candidates = append(candidates, node)
+					}
+				}
+			}
+		}
+		candidates = append(candidates, owners...)
+	}
+
+	var targets []*cluster.Node
+	seen := map[string]bool{self: true}
+	for _, node := range candidates {
+		if !seen[node.ID] && node.Status == "healthy" {
+			seen[node.ID] = true
+			targets = append(targets, node)
+		}
+	}
+	return targets
+}
+
+// forward proxies r to the first of targets that answers, streaming both ways, and reports
+// whether one did or the client has been answered anyway. Requests with a body go to the
+// first target only, as it can't be sent twice; one that can't be reached is a 502, or a
+// 504 if it timed out. Bodiless requests no target answers are left to this node.
+func (api *APIServer) forward(w http.ResponseWriter, r *http.Request, targets []*cluster.Node, hops int) bool {
+	hasBody := r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+	for i, node := range targets {
+		var failure error
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(&url.URL{Scheme: "http", Host: node.Address})
+				pr.Out.Host = r.Host
+				pr.Out.Header.Set(HopsHeader, strconv.Itoa(hops+1))
+				pr.SetXForwarded()
+			},
+			Transport: api.forwarding.transport,
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Set(ForwardedToHeader, node.ID)
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				failure = err
+			},
+		}
+
+		started := time.Now()
+		proxy.ServeHTTP(w, r)
+		if failure == nil {
+			api.forwarding.forwarded.Add(1)
+			api.forwarding.latency.Add(int64(time.Since(started)))
+			return true
+		}
+		if r.Context().Err() != nil {
+			return true // the client has gone
+		}
+		log.Printf("Failed to forward %s %s to node %s: %v", r.Method, r.URL.Path, node.ID, failure)
+		if hasBody || i == len(targets)-1 {
+			api.forwarding.failed.Add(1)
+			if !hasBody {
+				return false
+			}
+			status := http.StatusBadGateway
+			if errors.Is(failure, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(w, "owner of the key unreachable: "+failure.Error(), status)
+			return true
+		}
+	}
+	return false
+}
@@ -2,117 +2,757 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/9ifrashaikh/distributed-system/internal/accesslog"
+	"github.com/9ifrashaikh/distributed-system/internal/autotier"
+	"github.com/9ifrashaikh/distributed-system/internal/catalog"
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/config"
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
 	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/upload"
+	"github.com/9ifrashaikh/distributed-system/internal/usage"
 	"github.com/9ifrashaikh/distributed-system/pkg/models"
 	"github.com/gorilla/mux"
 )
 
 type APIServer struct {
-	store   *storage.FileStore
-	router  *mux.Router
-	tracker *AccessTracker
+	store       storage.Store
+	router      *mux.Router
+	tracker     *AccessTracker
+	classifier  *ml.DataClassifier
+	cluster     *cluster.ClusterManager         // nil when running standalone
+	replication *replication.ReplicationManager // nil when running standalone
+	authMutex   sync.RWMutex
+	adminKeys   []string
+	limiter     rateLimiter
+	gc          *storage.GarbageCollector
+	reloader    *config.Reloader // nil when reload isn't wired up
+	usage       *usage.Tracker   // nil when usage tracking is off
+	uploads     *upload.Manager  // nil when resumable uploads are off
+	locks       *lock.Manager    // nil when object locks are off
+	shadow      *shadow.Shadower // nil when shadowing isn't set up
+	catalog     *catalog.Catalog // nil unless the cluster catalog is synced
+	writes      writePolicy      // copies PUTs wait for in a cluster
+	forwarding  forwarding       // see SetForwarding
+	aggregate   statsCache       // see getAggregateStats
+	accessLog   *accesslog.Log   // nil when accesses aren't kept on disk
+	autotier    *autotier.Tierer // nil when auto-tiering isn't set up
+	rules       *ml.RuleStore    // nil when the tiering rules can't be changed at runtime
+	handler     http.Handler     // router, possibly wrapped by the shadower
 }
 
 type AccessTracker struct {
+	mutex    sync.Mutex
 	patterns []models.AccessPattern
 }
 
-func NewAPIServer(store *storage.FileStore) *APIServer {
+func (t *AccessTracker) add(pattern models.AccessPattern) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.patterns = append(t.patterns, pattern)
+}
+
+// accessSummary is how many accesses the tracker holds, and over what time
+type accessSummary struct {
+	Count  int        `json:"count"`
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Newest *time.Time `json:"newest,omitempty"`
+}
+
+func (t *AccessTracker) summary() accessSummary {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	summary := accessSummary{Count: len(t.patterns)}
+	for i := range t.patterns {
+		at := &t.patterns[i].AccessTime
+		if summary.Oldest == nil || at.Before(*summary.Oldest) {
+			oldest := *at
+			summary.Oldest = &oldest
+		}
+		if summary.Newest == nil || at.After(*summary.Newest) {
+			newest := *at
+			summary.Newest = &newest
+		}
+	}
+	return summary
+}
+
+// trim forgets the accesses from before cutoff
+func (t *AccessTracker) trim(cutoff time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.patterns = ml.TrimPatterns(t.patterns, cutoff)
+}
+
+func NewAPIServer(store storage.Store) *APIServer {
 	api := &APIServer{
-		store:   store,
-		router:  mux.NewRouter(),
-		tracker: &AccessTracker{},
+		store:      store,
+		router:     mux.NewRouter(),
+		tracker:    &AccessTracker{},
+		classifier: ml.NewDataClassifier(),
 	}
 
+	api.handler = api.router
 	api.setupRoutes()
 	return api
 }
 
 func (api *APIServer) setupRoutes() {
+	// Keys may contain slashes, so {key} matches them and the routes that end in a fixed
+	// name come first; keys ending in one of those names are refused, see checkKey. The
+	// path isn't cleaned, which would change keys like "a//b".
+	api.router.SkipClean(true)
 	api.router.HandleFunc("/objects", api.listObjects).Methods("GET")
-	api.router.HandleFunc("/objects/{key}", api.getObject).Methods("GET")
-	api.router.HandleFunc("/objects/{key}", api.putObject).Methods("PUT")
-	api.router.HandleFunc("/objects/{key}", api.deleteObject).Methods("DELETE")
+	api.router.HandleFunc("/objects/batch-delete", api.quorumGuard(api.batchDelete)).Methods("POST")
+	api.router.HandleFunc("/objects/{key:.+}/versions", api.listVersions).Methods("GET")
+	api.router.HandleFunc("/objects/{key:.+}/rename", api.quorumGuard(api.renameObject)).Methods("POST")
+	api.router.HandleFunc("/objects/{key:.+}/tier", api.quorumGuard(api.setObjectTier)).Methods("POST")
+	api.router.HandleFunc("/objects/{key:.+}/lock", api.quorumGuard(api.acquireLock)).Methods("POST")
+	api.router.HandleFunc("/objects/{key:.+}/lock", api.quorumGuard(api.releaseLock)).Methods("DELETE")
+	api.router.HandleFunc("/objects/{key:.+}/lock", api.getLock).Methods("GET")
+	api.router.HandleFunc("/objects/{key:.+}", api.forwarded(api.getObject)).Methods("GET", "HEAD")
+	api.router.HandleFunc("/objects/{key:.+}", api.forwarded(api.quorumGuard(api.putObject))).Methods("PUT")
+	api.router.HandleFunc("/objects/{key:.+}", api.quorumGuard(api.appendObject)).Methods("POST")
+	api.router.HandleFunc("/objects/{key:.+}", api.forwarded(api.quorumGuard(api.deleteObject))).Methods("DELETE")
+	api.router.HandleFunc("/buckets", api.listBuckets).Methods("GET")
+	api.router.HandleFunc("/buckets/{bucket}", api.quorumGuard(api.createBucket)).Methods("PUT")
+	api.router.HandleFunc("/buckets/{bucket}", api.quorumGuard(api.deleteBucket)).Methods("DELETE")
+	api.router.HandleFunc("/buckets/{bucket}/objects", api.listObjects).Methods("GET")
+	api.router.HandleFunc("/buckets/{bucket}/objects/batch-delete", api.quorumGuard(api.batchDelete)).Methods("POST")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}/versions", api.listVersions).Methods("GET")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}/rename", api.quorumGuard(api.renameObject)).Methods("POST")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}/tier", api.quorumGuard(api.setObjectTier)).Methods("POST")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}", api.forwarded(api.getObject)).Methods("GET", "HEAD")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}", api.forwarded(api.quorumGuard(api.putObject))).Methods("PUT")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}", api.quorumGuard(api.appendObject)).Methods("POST")
+	api.router.HandleFunc("/buckets/{bucket}/objects/{key:.+}", api.forwarded(api.quorumGuard(api.deleteObject))).Methods("DELETE")
+	api.router.HandleFunc("/uploads", api.quorumGuard(api.createUpload)).Methods("POST")
+	api.router.HandleFunc("/uploads/{id}", api.uploadOffset).Methods("HEAD")
+	api.router.HandleFunc("/uploads/{id}", api.quorumGuard(api.appendUpload)).Methods("PATCH")
+	api.router.HandleFunc("/uploads/{id}", api.terminateUpload).Methods("DELETE")
 	api.router.HandleFunc("/stats", api.getStats).Methods("GET")
 	api.router.HandleFunc("/health", api.healthCheck).Methods("GET")
+	api.router.HandleFunc("/admin/objects/{key:.+}/owner", api.requireAdmin(api.setObjectOwner)).Methods("POST")
+	api.router.HandleFunc("/admin/owners/backfill", api.requireAdmin(api.backfillOwners)).Methods("POST")
+	api.router.HandleFunc("/admin/journal", api.requireAdmin(api.getJournal)).Methods("GET")
+	api.router.HandleFunc("/admin/fsck", api.requireAdmin(api.runFsck)).Methods("POST")
+	api.router.HandleFunc("/admin/gc", api.requireAdmin(api.runGC)).Methods("POST")
+	api.router.HandleFunc("/admin/rotate-keys", api.requireAdmin(api.rotateKeys)).Methods("POST")
+	api.router.HandleFunc("/admin/config", api.requireAdmin(api.getConfig)).Methods("GET")
+	api.router.HandleFunc("/admin/reload", api.requireAdmin(api.reloadConfig)).Methods("POST")
+	api.router.HandleFunc("/admin/readonly", api.requireAdmin(api.setReadOnly)).Methods("POST")
+	api.router.HandleFunc("/admin/shadow", api.requireAdmin(api.getShadow)).Methods("GET")
+	api.router.HandleFunc("/admin/shadow", api.requireAdmin(api.updateShadow)).Methods("PUT")
+	api.router.HandleFunc("/admin/usage", api.requireAdmin(api.getUsageSummary)).Methods("GET")
+	api.router.HandleFunc("/usage/{user}", api.getUserUsage).Methods("GET")
+	api.router.HandleFunc("/dashboard", api.requireAdmin(api.serveDashboard)).Methods("GET")
+	api.router.HandleFunc("/tiering/simulate", api.simulateTiering).Methods("POST")
+	api.router.HandleFunc("/tiering/prefetch", api.getPrefetch).Methods("GET")
+	api.router.HandleFunc("/tiering/recommendations", api.getRecommendations).Methods("GET")
+	api.router.HandleFunc("/tiering/feature-importance", api.getFeatureImportance).Methods("GET")
+	api.router.HandleFunc("/tiering/auto", api.getAutoTiering).Methods("GET")
+	api.router.HandleFunc("/tiering/history", api.getTieringHistory).Methods("GET")
+	api.router.HandleFunc("/admin/tiering/run", api.requireAdmin(api.runAutoTiering)).Methods("POST")
+	api.router.HandleFunc("/admin/tiering/rules", api.requireAdmin(api.getTieringRules)).Methods("GET")
+	api.router.HandleFunc("/admin/tiering/rules", api.requireAdmin(api.updateTieringRules)).Methods("PUT")
+}
+
+// Classifier returns the tiering classifier so its settings can be changed live
+func (api *APIServer) Classifier() *ml.DataClassifier {
+	return api.classifier
 }
 
 func (api *APIServer) putObject(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, ok := api.objectKey(w, r)
+	if !ok || !checkKey(w, mux.Vars(r)["key"]) {
+		return
+	}
+	if source := r.Header.Get("X-Copy-Source"); source != "" {
+		api.copyObject(w, r, key, source)
+		return
+	}
 
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 
-	obj, err := api.store.Put(key, r.Body, contentType)
+	expectedVersion, err := parseVersionMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseExpiry(r, time.Now())
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tier := strings.ToLower(r.Header.Get("X-Storage-Tier"))
+	if tier != "" {
+		if err := storage.ValidateTier(tier); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	metadata, err := parseUserMetadata(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	consistency, err := parseWriteConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	factor, err := api.parseReplicationFactor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !api.checkWriteLock(w, r, key) {
+		return
+	}
+
+	owner := callerID(r)
+	if owner == "" {
+		owner = "anonymous"
+	}
+
+	algorithm := strings.ToLower(r.Header.Get("X-Checksum-Algorithm"))
+	if algorithm != "" {
+		if err := storage.ValidateChecksumAlgorithm(algorithm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A writer that knows the digest (replicating nodes always do) gets it verified
+	var expectedChecksum string
+	if value := r.Header.Get("X-Checksum"); value != "" {
+		declared, checksum, err := storage.ParseChecksum(value, algorithm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if algorithm != "" && declared != algorithm {
+			http.Error(w, "X-Checksum and X-Checksum-Algorithm name different algorithms", http.StatusBadRequest)
+			return
+		}
+		algorithm, expectedChecksum = declared, checksum
+	}
+
+	// Ordered against writes of the key made through other nodes
+	var stamp *models.WriteStamp
+	if api.replication != nil {
+		stamp = api.replication.NextStamp()
+	}
+
+	obj, err := api.store.PutWithOptions(key, r.Body, storage.PutOptions{
+		ContentType:       contentType,
+		ChecksumAlgorithm: algorithm,
+		ExpectedChecksum:  expectedChecksum,
+		Owner:             owner,
+		IfVersion:         expectedVersion,
+		IfMatch:           parseETags(r.Header.Get("If-Match")),
+		IfNoneMatch:       parseETags(r.Header.Get("If-None-Match")),
+		// Chunked uploads report -1 and are exempt
+		ExpectedSize: r.ContentLength,
+		Actor:        callerID(r),
+		ExpiresAt:    expiresAt,
+		StorageTier:  tier,
+		Metadata:     metadata,
+		// Only for cluster mode, but kept either way
+		ReplicationFactor: factor,
+		Stamp:             stamp,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrReadOnly) {
+			writeReadOnlyError(w, err)
+			return
+		}
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if errors.Is(err, storage.ErrStaleWrite) {
+			// A newer write of the key got here first
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrIncompleteUpload) || errors.Is(err, storage.ErrChecksumMismatch) || errors.Is(err, io.ErrUnexpectedEOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Track access pattern
 	api.trackAccess(obj.ID, "write", r.Header.Get("User-ID"), obj.Size)
+	if api.usage != nil {
+		api.usage.RecordUpload(principal(r), obj.Size)
+	}
+	status, ok := api.replicate(w, r, obj, consistency)
+	if !ok {
+		return
+	}
 
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setVersionIDHeader(w, obj)
+	setChecksumHeaders(w, obj)
+	setExpiryHeader(w, obj)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(obj)
 }
 
 func (api *APIServer) getObject(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
 
-	reader, obj, err := api.store.Get(key)
+	offset, length, ranged, rangeErr := parseRange(r.Header.Get("Range"))
+	versionID := r.URL.Query().Get("versionId")
+
+	var reader io.ReadCloser
+	var obj *models.StorageObject
+	var err error
+	if r.Method == http.MethodHead && versionID == "" {
+		// Only the headers are needed, so the data isn't opened and no read is counted
+		obj, err = api.store.Stat(key)
+		if err == nil && ranged && rangeErr == nil {
+			_, _, err = storage.ResolveRange(obj.Size, offset, length)
+		}
+	} else {
+		reader, obj, err = api.store.GetWithOptions(key, storage.GetOptions{
+			VersionID: versionID,
+			Ranged:    ranged && rangeErr == nil,
+			Offset:    offset,
+			Length:    length,
+		})
+	}
 	if err != nil {
+		if localCopyLost(err) && versionID == "" && rangeErr == nil && api.readFromReplica(w, r, key, ranged) {
+			return
+		}
+		var rangeError *storage.RangeError
+		if errors.As(err, &rangeError) {
+			rangeNotSatisfiable(w, err, rangeError.Size)
+			return
+		}
+		if errors.Is(err, storage.ErrDeleteMarker) {
+			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, storage.ErrCorrupt) {
+			writeCorruptionError(w, err)
+			return
+		}
+		if !errors.Is(err, storage.ErrObjectNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if api.catalog != nil && versionID == "" {
+			if entry, exists := api.catalog.Lookup(key); exists {
+				api.remoteObject(w, r, entry)
+				return
+			}
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	defer reader.Close()
+	if reader != nil {
+		defer reader.Close()
+	}
+
+	if rangeErr != nil {
+		rangeNotSatisfiable(w, rangeErr, obj.Size)
+		return
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setVersionIDHeader(w, obj)
+	setChecksumHeaders(w, obj)
+	setExpiryHeader(w, obj)
+	setMetadataHeaders(w, obj)
+	if api.catalog != nil {
+		if entry, exists := api.catalog.Lookup(key); exists {
+			setLocationHeader(w, entry)
+		}
+	}
+
+	status := http.StatusOK
+	if ranged {
+		start, n, _ := storage.ResolveRange(obj.Size, offset, length)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, obj.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		status = http.StatusPartialContent
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		api.trackAccess(obj.ID, "read", r.Header.Get("User-ID"), 0)
+		return
+	}
+	w.WriteHeader(status)
+	n, err := io.Copy(w, reader)
+	if errors.Is(err, storage.ErrCorrupt) {
+		// Too late for an error status; cutting the connection short is what tells the
+		// client the body is bad
+		panic(http.ErrAbortHandler)
+	}
 
 	// Track access pattern
-	api.trackAccess(obj.ID, "read", r.Header.Get("User-ID"), obj.Size)
+	api.trackAccess(obj.ID, "read", r.Header.Get("User-ID"), n)
+	if api.usage != nil {
+		api.usage.RecordDownload(principal(r), n)
+	}
+}
+
+// parseRange reads a single-range "bytes=" header into the offset and length GetRange
+// takes. ranged is false when the whole object should be sent: no header, another unit,
+// or several ranges, which we're allowed to ignore.
+func parseRange(header string) (offset, length int64, ranged bool, err error) {
+	if header == "" {
+		return 0, 0, false, nil
+	}
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	invalid := fmt.Errorf("%w: invalid range %q", storage.ErrInvalidRange, header)
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, true, invalid
+	}
+
+	if first == "" {
+		// Suffix range: the last N bytes
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, true, invalid
+		}
+		return -suffix, -1, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, true, invalid
+	}
+	if last == "" {
+		return start, -1, true, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, true, invalid
+	}
+	return start, end - start + 1, true, nil
+}
+
+// writeCorruptionError answers for an object whose stored data failed its checksum
+func writeCorruptionError(w http.ResponseWriter, err error) {
+	var corrupt *storage.CorruptionError
+	if !errors.As(err, &corrupt) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             err.Error(),
+		"key":               corrupt.Key,
+		"expected_checksum": corrupt.Expected,
+		"actual_checksum":   corrupt.Actual,
+	})
+}
 
+func rangeNotSatisfiable(w http.ResponseWriter, err error, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+}
+
+// remoteObject answers for an object only other nodes hold: HEAD is served from the
+// catalog, GET points the client at the nodes that have the bytes
+func (api *APIServer) remoteObject(w http.ResponseWriter, r *http.Request, entry catalog.Entry) {
+	setLocationHeader(w, entry)
+	if r.Method != http.MethodHead {
+		http.Error(w, "object is stored on other nodes", http.StatusNotFound)
+		return
+	}
+
+	obj := entry.Object()
 	w.Header().Set("Content-Type", obj.ContentType)
 	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
-	w.Header().Set("ETag", obj.Checksum)
-
-	io.Copy(w, reader)
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	setChecksumHeaders(w, obj)
+	setMetadataHeaders(w, obj)
 }
 
 func (api *APIServer) deleteObject(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
 
-	err := api.store.Delete(key)
+	expectedVersion, err := parseVersionMatch(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !api.checkWriteLock(w, r, key) {
+		return
+	}
+
+	err = api.store.DeleteWithOptions(key, storage.DeleteOptions{
+		IfVersion: expectedVersion,
+		VersionID: r.URL.Query().Get("versionId"),
+		Actor:     callerID(r),
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrReadOnly) {
+			writeReadOnlyError(w, err)
+			return
+		}
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// listedObject is a listing entry; Location names the nodes holding the object in cluster mode
+type listedObject struct {
+	*models.StorageObject
+	Location []string `json:"location,omitempty"`
+}
+
+func (api *APIServer) listVersions(w http.ResponseWriter, r *http.Request) {
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+	versions, err := api.store.ListVersions(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	list := make([]map[string]interface{}, 0, len(versions))
+	for i, obj := range versions {
+		list = append(list, map[string]interface{}{
+			"version_id":    obj.VersionID,
+			"is_latest":     i == 0,
+			"delete_marker": obj.DeleteMarker,
+			"size":          obj.Size,
+			"checksum":      obj.Checksum,
+			"version":       obj.Version,
+			"updated_at":    obj.UpdatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":      key,
+		"versions": list,
+	})
+}
+
+// maxListLimit caps one page of a listing, and is the page size when no limit is given
+const maxListLimit = 1000
+
+// listObjects lists one bucket, keyed by the key within it, a page at a time in key order.
+// ?prefix= narrows it to keys starting with prefix, ?meta.name=value to objects whose user
+// metadata has that value, and ?token= picks up where the next_token of the previous page
+// left off.
 func (api *APIServer) listObjects(w http.ResponseWriter, r *http.Request) {
-	objects := api.store.List()
+	bucket, ok := api.requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	owner := r.URL.Query().Get("owner")
+	if r.URL.Query().Get("mine") == "true" {
+		owner = callerID(r)
+		if owner == "" {
+			http.Error(w, "mine=true requires a User-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	metaFilter := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if name, ok := strings.CutPrefix(name, "meta."); ok && name != "" {
+			metaFilter[strings.ToLower(name)] = values[0]
+		}
+	}
+	// Expired objects read as gone even before the sweeper deletes them
+	now := time.Now()
+	opts := storage.ListOptions{
+		Bucket: bucket,
+		Prefix: r.URL.Query().Get("prefix"),
+		Limit:  maxListLimit,
+		Token:  r.URL.Query().Get("token"),
+		Filter: func(obj *models.StorageObject) bool {
+			return !storage.Expired(obj, now) && (owner == "" || obj.Owner == owner) && matchesMetadata(obj, metaFilter)
+		},
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = min(parsed, maxListLimit)
+	}
+
+	// The store pages its own objects; in cluster mode the catalog's are paged the same way
+	var page *storage.ListResult
+	var err error
+	var locations map[*models.StorageObject][]string
+	if api.catalog != nil {
+		local := api.store.List()
+		objects := make(map[string]*models.StorageObject)
+		locations = make(map[*models.StorageObject][]string)
+		for key, entry := range api.catalog.Entries() {
+			obj, exists := local[key]
+			if !exists || obj.Checksum != entry.Checksum {
+				obj = entry.Object()
+			}
+			objects[key] = obj
+			locations[obj] = entry.Nodes
+		}
+		page, err = storage.ListPage(objects, opts)
+	} else {
+		page, err = api.store.ListWithOptions(opts)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listed := make(map[string]listedObject, len(page.Objects))
+	for i, obj := range page.Objects {
+		listed[page.Keys[i]] = listedObject{StorageObject: obj, Location: locations[obj]}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(objects)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"objects":      listed,
+		"is_truncated": page.IsTruncated,
+		"next_token":   page.NextToken,
+	})
 }
 
+// defaultStatsTop is how many of the largest objects of each tier /stats lists, unless
+// ?top= asks for another number, up to maxStatsTop
+const (
+	defaultStatsTop = 10
+	maxStatsTop     = 100
+)
+
 func (api *APIServer) getStats(w http.ResponseWriter, r *http.Request) {
+	top := defaultStatsTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = min(parsed, maxStatsTop)
+	}
+
 	objects := api.store.List()
 
 	stats := map[string]interface{}{
 		"total_objects":     len(objects),
 		"total_size":        calculateTotalSize(objects),
 		"tier_distribution": calculateTierDistribution(objects),
-		"access_patterns":   api.tracker.patterns,
+		"access_patterns":   api.tracker.summary(),
+		"owner_usage":       api.store.UsageByOwner(),
+		"read_only":         api.store.ReadOnly(),
+	}
+	if reporter, ok := api.store.(storage.TierReadReporter); ok {
+		stats["tier_reads"] = reporter.TierReads()
+	}
+	if limiter, ok := api.store.(storage.Limiter); ok {
+		used, quota := limiter.QuotaUsage()
+		stats["quota"] = map[string]interface{}{
+			"used_bytes":        used,
+			"quota_bytes":       quota,
+			"owner_quota_bytes": limiter.OwnerQuotas(),
+		}
+	}
+	if verifier, ok := api.store.(storage.Verifier); ok {
+		stats["corruptions_detected"] = verifier.Corruptions()
+	}
+	if cacher, ok := api.store.(storage.Cacher); ok {
+		stats["cache"] = cacher.CacheStats()
+	}
+	if api.accessLog != nil {
+		stats["access_history"] = api.accessLog.Stats()
+	}
+	if api.replication != nil {
+		stats["replica_reads"] = api.replication.GetReadStats()
+		stats["forwarding"] = api.GetForwardStats()
+	}
+	if reporter, ok := api.store.(storage.TierReporter); ok {
+		largest := reporter.LargestObjects(top)
+		tierUsage := make(map[string]interface{})
+		for tier, usage := range reporter.Usage() {
+			list := make([]map[string]interface{}, 0, len(largest[tier]))
+			for _, obj := range largest[tier] {
+				list = append(list, map[string]interface{}{
+					"key":         obj.Key,
+					"size":        obj.Size,
+					"last_access": obj.LastAccess,
+				})
+			}
+			tierUsage[tier] = map[string]interface{}{
+				"objects":         usage.Objects,
+				"bytes":           usage.Bytes,
+				"stored_bytes":    usage.StoredBytes,
+				"largest_objects": list,
+			}
+		}
+		stats["tier_usage"] = tierUsage
+	}
+	if dedup, ok := api.store.(storage.Deduplicator); ok {
+		if blobs, references := dedup.DedupStats(); blobs > 0 {
+			stats["dedup"] = map[string]interface{}{
+				"blobs":      blobs,
+				"references": references,
+			}
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -120,8 +760,29 @@ func (api *APIServer) getStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *APIServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	status := "healthy"
+	if api.store.ReadOnly() {
+		// Still up and serving reads, so still a 200
+		status = "read-only"
+	}
+	response := map[string]interface{}{
+		"status":    status,
+		"read_only": api.store.ReadOnly(),
+	}
+	if api.cluster != nil {
+		if drain := api.cluster.Draining(); drain != "" {
+			// Up, but a load balancer should send writes elsewhere
+			response["status"], response["drain"] = drain, drain
+		}
+		quorum := api.cluster.GetQuorumStatus()
+		if quorum.Degraded {
+			// Reads carry on, so a 200 still
+			response["status"] = "degraded"
+		}
+		response["quorum"] = quorum
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (api *APIServer) trackAccess(objectID, operation, userID string, size int64) {
@@ -132,11 +793,139 @@ func (api *APIServer) trackAccess(objectID, operation, userID string, size int64
 		UserID:     userID,
 		Size:       size,
 	}
-	api.tracker.patterns = append(api.tracker.patterns, pattern)
+	api.tracker.add(pattern)
+	api.classifier.AddAccessPattern(pattern)
+	if api.accessLog != nil {
+		api.accessLog.Record(pattern)
+	}
+}
+
+// parseVersionMatch reads the If-Version-Match precondition; 0 means the object must not exist
+func parseVersionMatch(r *http.Request) (*int64, error) {
+	value := r.Header.Get("If-Version-Match")
+	if value == "" {
+		return nil, nil
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 0 {
+		return nil, fmt.Errorf("invalid If-Version-Match header: %q", value)
+	}
+	return &version, nil
+}
+
+// parseETags reads an If-Match or If-None-Match header: "*" or a list of ETags, quoted or
+// not. Weak ETags compare like strong ones, they're checksums either way.
+func parseETags(value string) []string {
+	var etags []string
+	for _, part := range strings.Split(value, ",") {
+		etag := strings.Trim(strings.TrimPrefix(strings.TrimSpace(part), "W/"), `"`)
+		if etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// setChecksumHeaders reports the object's digest. The ETag carries the algorithm so an MD5
+// from a legacy object can't be mistaken for another digest.
+func setChecksumHeaders(w http.ResponseWriter, obj *models.StorageObject) {
+	w.Header().Set("X-Checksum", obj.Checksum)
+	w.Header().Set("X-Checksum-Algorithm", obj.ChecksumAlgorithm)
+	w.Header().Set("ETag", storage.FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum))
+}
+
+// setVersionIDHeader reports which version was written or read, when versioning assigned one
+func setVersionIDHeader(w http.ResponseWriter, obj *models.StorageObject) {
+	if obj.VersionID != "" {
+		w.Header().Set("X-Version-Id", obj.VersionID)
+	}
+}
+
+// metadataHeaderPrefix marks the request and response headers carrying user metadata
+const metadataHeaderPrefix = "X-Meta-"
+
+// parseUserMetadata collects the user metadata in X-Meta-* headers, with lowercased names.
+// It returns nil if there is none.
+func parseUserMetadata(header http.Header) (map[string]string, error) {
+	var metadata map[string]string
+	for name, values := range header {
+		name, ok := strings.CutPrefix(http.CanonicalHeaderKey(name), metadataHeaderPrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.ToLower(name)] = values[0]
+	}
+	if err := storage.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// setMetadataHeaders echoes the object's user metadata as X-Meta-* headers
+func setMetadataHeaders(w http.ResponseWriter, obj *models.StorageObject) {
+	for name, value := range obj.Metadata {
+		w.Header().Set(metadataHeaderPrefix+name, value)
+	}
+}
+
+// matchesMetadata reports whether obj's user metadata has every value in filter
+func matchesMetadata(obj *models.StorageObject, filter map[string]string) bool {
+	for name, value := range filter {
+		if actual, exists := obj.Metadata[name]; !exists || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// setExpiryHeader reports when an object with an expiry stops being readable
+func setExpiryHeader(w http.ResponseWriter, obj *models.StorageObject) {
+	if obj.ExpiresAt != nil {
+		w.Header().Set("X-Expires-At", obj.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+}
+
+// parseExpiry reads X-Expires-After (seconds from now) or X-Expires-At (RFC 3339). It
+// returns nil if neither is set.
+func parseExpiry(r *http.Request, now time.Time) (*time.Time, error) {
+	after := r.Header.Get("X-Expires-After")
+	at := r.Header.Get("X-Expires-At")
+	switch {
+	case after != "" && at != "":
+		return nil, fmt.Errorf("X-Expires-After and X-Expires-At can't be combined")
+	case after != "":
+		seconds, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("X-Expires-After must be a positive number of seconds")
+		}
+		expiresAt := now.Add(time.Duration(seconds) * time.Second)
+		return &expiresAt, nil
+	case at != "":
+		expiresAt, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return nil, fmt.Errorf("X-Expires-At must be an RFC 3339 time: %v", err)
+		}
+		if !expiresAt.After(now) {
+			return nil, fmt.Errorf("X-Expires-At is in the past")
+		}
+		return &expiresAt, nil
+	}
+	return nil, nil
+}
+
+// callerID identifies who is making the request
+func callerID(r *http.Request) string {
+	return r.Header.Get("User-ID")
 }
 
 func (api *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	api.router.ServeHTTP(w, r)
+	if api.rateLimited(w, r) {
+		return
+	}
+	api.handler.ServeHTTP(w, r)
 }
 
 func calculateTotalSize(objects map[string]*models.StorageObject) int64 {
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+)
+
+// SetLockManager enables the object lock endpoints and the X-Lock-Token write guard
+func (api *APIServer) SetLockManager(m *lock.Manager) {
+	api.locks = m
+}
+
+// acquireLock takes a lease on the key, or refreshes it when X-Lock-Token is sent.
+// Body (optional): {"owner": "...", "ttl_seconds": 30, "guard_writes": false}
+func (api *APIServer) acquireLock(w http.ResponseWriter, r *http.Request) {
+	if api.locks == nil {
+		http.Error(w, "Object locks are not enabled", http.StatusNotFound)
+		return
+	}
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Owner       string  `json:"owner"`
+		TTLSeconds  float64 `json:"ttl_seconds"`
+		GuardWrites bool    `json:"guard_writes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid lock request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.TTLSeconds < 0 {
+		http.Error(w, "ttl_seconds must be non-negative", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds * float64(time.Second))
+
+	var lease lock.Lease
+	var err error
+	if token := r.Header.Get("X-Lock-Token"); token != "" {
+		lease, err = api.locks.Refresh(key, token, ttl)
+	} else {
+		owner := req.Owner
+		if owner == "" {
+			owner = principal(r)
+		}
+		lease, err = api.locks.Acquire(key, owner, ttl, req.GuardWrites)
+	}
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lease)
+}
+
+func (api *APIServer) releaseLock(w http.ResponseWriter, r *http.Request) {
+	if api.locks == nil {
+		http.Error(w, "Object locks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	token := r.Header.Get("X-Lock-Token")
+	if token == "" {
+		http.Error(w, "X-Lock-Token header required", http.StatusBadRequest)
+		return
+	}
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+	if err := api.locks.Release(key, token); err != nil {
+		writeLockError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getLock shows who holds the lock, without the token
+func (api *APIServer) getLock(w http.ResponseWriter, r *http.Request) {
+	if api.locks == nil {
+		http.Error(w, "Object locks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+	lease, held := api.locks.Get(key)
+	if !held {
+		http.Error(w, lock.ErrNotLocked.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease":                 lease.Public(),
+		"remaining_ttl_seconds": lease.Remaining(time.Now()).Seconds(),
+	})
+}
+
+// checkWriteLock rejects a write to key that the lock holder hasn't allowed, returning
+// false if it wrote the rejection
+func (api *APIServer) checkWriteLock(w http.ResponseWriter, r *http.Request, key string) bool {
+	if api.locks == nil {
+		return true
+	}
+	if err := api.locks.CheckWrite(key, r.Header.Get("X-Lock-Token")); err != nil {
+		writeLockError(w, err)
+		return false
+	}
+	return true
+}
+
+func writeLockError(w http.ResponseWriter, err error) {
+	var locked *lock.LockedError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusLocked)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":                 err.Error(),
+			"holder":                locked.Lease.Owner,
+			"expires_at":            locked.Lease.ExpiresAt,
+			"remaining_ttl_seconds": locked.Lease.Remaining(time.Now()).Seconds(),
+		})
+	case errors.Is(err, lock.ErrNotLocked), errors.Is(err, lock.ErrTokenMismatch):
+		// The caller thought it held a lock it doesn't (any more)
+		http.Error(w, err.Error(), http.StatusLocked)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+func newLockServer(t *testing.T) *APIServer {
+	t.Helper()
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	locks, err := lock.NewManager(filepath.Join(t.TempDir(), "locks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPIServer(store)
+	api.SetLockManager(locks)
+	return api
+}
+
+// withToken serves a request carrying X-Lock-Token if token isn't empty
+func withToken(api *APIServer, method, path, body, token string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	if token != "" {
+		r.Header.Set("X-Lock-Token", token)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestLockContention(t *testing.T) {
+	api := newLockServer(t)
+
+	w := serve(api, http.MethodPost, "/objects/reports/q1/lock", `{"owner": "pipeline-a", "ttl_seconds": 60}`)
+	var lease lock.Lease
+	if err := json.NewDecoder(w.Body).Decode(&lease); err != nil || w.Code != http.StatusOK || lease.Token == "" {
+		t.Fatalf("acquiring = %d %+v (%v)", w.Code, lease, err)
+	}
+
+	w = serve(api, http.MethodPost, "/objects/reports/q1/lock", `{"owner": "pipeline-b"}`)
+	var refused struct {
+		Holder    string  `json:"holder"`
+		Remaining float64 `json:"remaining_ttl_seconds"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&refused); err != nil || w.Code != http.StatusLocked {
+		t.Fatalf("acquiring a held lock = %d (%v), want 423", w.Code, err)
+	}
+	if refused.Holder != "pipeline-a" || refused.Remaining <= 0 || refused.Remaining > 60 {
+		t.Errorf("refused with %+v, want pipeline-a's holder and time left", refused)
+	}
+
+	// Refreshed with the token, by its holder
+	if w := withToken(api, http.MethodPost, "/objects/reports/q1/lock", `{"ttl_seconds": 120}`, lease.Token); w.Code != http.StatusOK {
+		t.Errorf("refreshing = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodGet, "/objects/reports/q1/lock", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), lease.Token) {
+		t.Errorf("GET lock = %d, want it shown without the token", w.Code)
+	}
+
+	if w := withToken(api, http.MethodDelete, "/objects/reports/q1/lock", "", "not-the-token"); w.Code != http.StatusLocked {
+		t.Errorf("releasing with the wrong token = %d, want 423", w.Code)
+	}
+	if w := withToken(api, http.MethodDelete, "/objects/reports/q1/lock", "", lease.Token); w.Code != http.StatusNoContent {
+		t.Errorf("releasing = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodGet, "/objects/reports/q1/lock", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET a released lock = %d, want 404", w.Code)
+	}
+}
+
+func TestLockGuardsWrites(t *testing.T) {
+	api := newLockServer(t)
+	w := serve(api, http.MethodPost, "/objects/report/lock", `{"owner": "pipeline-a", "guard_writes": true}`)
+	var lease lock.Lease
+	if err := json.NewDecoder(w.Body).Decode(&lease); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("acquiring = %d (%v)", w.Code, err)
+	}
+
+	for _, write := range []struct{ method, token string }{
+		{http.MethodPut, ""},
+		{http.MethodPut, "not-the-token"},
+		{http.MethodDelete, ""},
+	} {
+		if w := withToken(api, write.method, "/objects/report", "from pipeline-b", write.token); w.Code != http.StatusLocked {
+			t.Errorf("%s with token %q = %d, want 423", write.method, write.token, w.Code)
+		}
+	}
+	if w := withToken(api, http.MethodPut, "/objects/report", "from pipeline-a", lease.Token); w.Code != http.StatusOK {
+		t.Fatalf("PUT by the holder = %d: %s", w.Code, w.Body)
+	}
+
+	// Released, anyone can write again, but not with the old token
+	withToken(api, http.MethodDelete, "/objects/report/lock", "", lease.Token)
+	if w := withToken(api, http.MethodPut, "/objects/report", "from pipeline-a", lease.Token); w.Code != http.StatusLocked {
+		t.Errorf("PUT with a released token = %d, want 423", w.Code)
+	}
+	if w := serve(api, http.MethodPut, "/objects/report", "from pipeline-b"); w.Code != http.StatusOK {
+		t.Errorf("PUT once released = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Body.String() != "from pipeline-b" {
+		t.Errorf("report = %q", w.Body)
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// droppedConnection reads as n bytes of data and then fails, as a body does when the
+// client goes away mid-upload
+type droppedConnection struct {
+	r io.Reader
+}
+
+func newDroppedConnection(data []byte, n int) *droppedConnection {
+	return &droppedConnection{r: bytes.NewReader(data[:n])}
+}
+
+func (d *droppedConnection) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestTruncatedUploadsAreDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.OpenFileStore(dir, storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	api := NewAPIServer(store)
+	if w := serve(api, http.MethodPut, "/objects/kept", "the first version"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+
+	data := bytes.Repeat([]byte("megabyte"), 1<<17)
+	for _, test := range []struct {
+		name string
+		key  string
+		body io.Reader
+	}{
+		{"a connection dropped after 300 KB", "dropped", newDroppedConnection(data, 300<<10)},
+		{"a body ending early", "short", bytes.NewReader(data[:300<<10])},
+		{"a connection dropped overwriting an object", "kept", newDroppedConnection(data, 300<<10)},
+		{"a body ending early overwriting an object", "kept", bytes.NewReader(data[:1])},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/objects/"+test.key, test.body)
+		r.ContentLength = int64(len(data))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s, want 400", test.name, w.Code, w.Body)
+		}
+	}
+
+	// Nothing of them is kept, and what they would have overwritten is untouched
+	for _, key := range []string{"dropped", "short"} {
+		if obj, err := store.Stat(key); err == nil {
+			t.Errorf("%s kept as %d bytes", key, obj.Size)
+		}
+	}
+	if w := serve(api, http.MethodGet, "/objects/kept", ""); w.Body.String() != "the first version" {
+		t.Errorf("kept = %q, want the first version", w.Body)
+	}
+	if n := len(store.List()); n != 1 {
+		t.Errorf("%d objects listed, want only kept", n)
+	}
+	if n := dataFiles(t, dir); n != 1 {
+		t.Errorf("%d data files, want only kept's", n)
+	}
+
+	// Without a declared length there is nothing to hold the body to
+	r := httptest.NewRequest(http.MethodPut, "/objects/chunked", bytes.NewReader(data[:300<<10]))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if obj, err := store.Stat("chunked"); w.Code != http.StatusOK || err != nil || obj.Size != 300<<10 {
+		t.Errorf("chunked upload = %d, kept %+v (%v), want all 300 KB kept", w.Code, obj, err)
+	}
+}
+
+func TestTruncatedReplicaIsDiscarded(t *testing.T) {
+	target := newReplicaTarget(t)
+	data := bytes.Repeat([]byte("replica "), 1<<14)
+	r := replicaRequest("dropped", nil, md5Of(data))
+	r.Body = io.NopCloser(newDroppedConnection(data, len(data)/3))
+	r.ContentLength = int64(len(data))
+
+	w := httptest.NewRecorder()
+	target.api.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("replica cut off = %d %s, want 400", w.Code, w.Body)
+	}
+	if _, err := target.store.Stat("dropped"); err == nil {
+		t.Error("the partial replica was kept")
+	}
+	if n := dataFiles(t, target.dir); n != 0 {
+		t.Errorf("%d data files left of the partial replica", n)
+	}
+}
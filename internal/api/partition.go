@@ -0,0 +1,38 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+)
+
+// DegradedHeader is set on the answers to writes taken while this node is degraded, see
+// cluster.PartitionAccept
+const DegradedHeader = "X-Partition-Degraded"
+
+// quorumGuard turns writes away with 503 while this node sees too little of the cluster to
+// take them, see ClusterManager.Degraded, or flags them when it is to take them anyway
+func (api *APIServer) quorumGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.cluster == nil {
+			next(w, r)
+			return
+		}
+		degraded, policy := api.cluster.Degraded()
+		if !degraded {
+			next(w, r)
+			return
+		}
+		if policy != cluster.PartitionAccept {
+			w.Header().Set("Retry-After", strconv.Itoa(readOnlyRetryAfter))
+			http.Error(w, "node is cut off from most of the cluster, writes are refused until it rejoins", http.StatusServiceUnavailable)
+			return
+		}
+		api.cluster.FlagWrite()
+		log.Printf("Write to %s taken while degraded", r.URL.Path)
+		w.Header().Set(DegradedHeader, "true")
+		next(w, r)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// newDegradedServer is node-1 holding "report", having lost sight of the other two of three
+// nodes
+func newDegradedServer(t *testing.T, policy string) (*APIServer, *cluster.ClusterManager) {
+	t.Helper()
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	api := NewAPIServer(store)
+	if w := serve(api, http.MethodPut, "/objects/report", "written before"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	cm.SetPartitionWrites(policy)
+	for _, id := range []string{"node-2", "node-3"} {
+		if err := cm.RegisterNode(&cluster.Node{ID: id, Address: "127.0.0.1:2", Status: "unhealthy"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api.EnableCluster(cm, nil)
+	if degraded, _ := cm.Degraded(); !degraded {
+		t.Fatalf("not degraded seeing %+v", cm.GetQuorumStatus())
+	}
+	return api, cm
+}
+
+func TestDegradedRejectsWrites(t *testing.T) {
+	api, cm := newDegradedServer(t, cluster.PartitionReject)
+
+	for _, write := range []struct{ method, path string }{
+		{http.MethodPut, "/objects/report"},
+		{http.MethodPut, "/objects/new"},
+		{http.MethodDelete, "/objects/report"},
+		{http.MethodPut, "/buckets/docs"},
+	} {
+		w := serve(api, write.method, write.path, "written while cut off")
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s = %d, want 503 with Retry-After", write.method, write.path, w.Code)
+		}
+	}
+	// Reads carry on
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Code != http.StatusOK || w.Body.String() != "written before" {
+		t.Errorf("GET = %d %q, want what was there", w.Code, w.Body)
+	}
+	if flagged := cm.GetQuorumStatus().FlaggedWrites; flagged != 0 {
+		t.Errorf("%d writes flagged, want none taken", flagged)
+	}
+
+	var health struct {
+		Status string               `json:"status"`
+		Quorum cluster.QuorumStatus `json:"quorum"`
+	}
+	w := serve(api, http.MethodGet, "/health", "")
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || health.Status != "degraded" || !health.Quorum.Degraded || health.Quorum.Visible != 1 {
+		t.Errorf("/health = %d %+v, want 200 and degraded seeing only this node", w.Code, health)
+	}
+
+	// Back in sight of the others, it takes writes again
+	if err := cm.RegisterNode(&cluster.Node{ID: "node-2", Address: "127.0.0.1:2", Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(api, http.MethodPut, "/objects/report", "written after"); w.Code != http.StatusOK {
+		t.Errorf("PUT after rejoining = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDegradedAcceptsAndFlagsWrites(t *testing.T) {
+	api, cm := newDegradedServer(t, cluster.PartitionAccept)
+
+	w := serve(api, http.MethodPut, "/objects/report", "written while cut off")
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get(DegradedHeader) != "true" {
+		t.Errorf("PUT answered without %s", DegradedHeader)
+	}
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Body.String() != "written while cut off" {
+		t.Errorf("GET = %q, want the write taken", w.Body)
+	}
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Header().Get(DegradedHeader) != "" {
+		t.Error("a read was flagged")
+	}
+	if flagged := cm.GetQuorumStatus().FlaggedWrites; flagged != 1 {
+		t.Errorf("%d writes flagged, want 1", flagged)
+	}
+}
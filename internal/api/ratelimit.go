@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all clients
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens per second, 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// SetRateLimit caps the server at rate requests per second with bursts of up to burst
+// requests. A rate of 0 removes the limit. The bucket starts full.
+func (api *APIServer) SetRateLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	api.limiter.mutex.Lock()
+	defer api.limiter.mutex.Unlock()
+
+	api.limiter.rate = rate
+	api.limiter.burst = float64(burst)
+	api.limiter.tokens = float64(burst)
+	api.limiter.last = time.Now()
+}
+
+// rateLimited answers 429 when the limiter is out of tokens. Health checks are exempt so
+// a busy node isn't marked dead by its peers, and admin calls so an operator can always
+// reach /admin/reload to lift a limit.
+func (api *APIServer) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/admin/") || api.limiter.allow() {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	return true
+}
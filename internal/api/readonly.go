@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// readOnlyRetryAfter is how long, in seconds, clients are told to wait before retrying a
+// write turned away while the store is read-only
+const readOnlyRetryAfter = 30
+
+// writeReadOnlyError turns away a write while the store is read-only
+func writeReadOnlyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(readOnlyRetryAfter))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// setReadOnly puts the store in or out of read-only mode with {"read_only": true|false},
+// for maintenance such as disk migrations. Reads carry on either way.
+func (api *APIServer) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReadOnly == nil {
+		http.Error(w, "Request body must be {\"read_only\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	api.store.SetReadOnly(*req.ReadOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"read_only": api.store.ReadOnly(),
+	})
+}
@@ -0,0 +1,404 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// receiveReplica stores a copy of an object another node has sent here. It keeps the ID
+// the object has on its source and is only written once its checksum and length check
+// out; a copy that doesn't hash to X-Checksum is refused with 422. A copy stamped older in
+// X-Object-Version than the object here is refused with 409, describing the newer one so
+// the source can take it. A copy may come compressed, in a Content-Encoding listed in the
+// Accept-Encoding every answer carries, and is checked once decoded; other encodings are
+// refused with 415. An encrypted copy comes as it is stored on the source, described by
+// the X-Stored-* headers, and is kept that way without the master key; only its length is
+// checked. The key is the source's store-wide name, bucket included.
+// Replicas aren't replicated any further.
+func (api *APIServer) receiveReplica(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Encoding", replication.AcceptedEncodings)
+	source := r.Header.Get("X-Replication-Source")
+	if !api.cluster.IsPeer(source, r.RemoteAddr) {
+		http.Error(w, "Replicas are only accepted from other cluster nodes", http.StatusForbidden)
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if !checkKey(w, key) {
+		return
+	}
+
+	objectID := r.Header.Get("X-Object-ID")
+	if objectID == "" {
+		http.Error(w, "X-Object-ID header required", http.StatusBadRequest)
+		return
+	}
+	value := r.Header.Get("X-Checksum")
+	if value == "" {
+		http.Error(w, "X-Checksum header required", http.StatusBadRequest)
+		return
+	}
+	algorithm, checksum, err := storage.ParseChecksum(value, strings.ToLower(r.Header.Get("X-Checksum-Algorithm")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseExpiry(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseUserMetadata(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	factor, err := api.parseReplicationFactor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stamp, err := replication.ParseStamp(r.Header.Get("X-Object-Version"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.replication.ObserveStamp(stamp)
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	opts := storage.PutOptions{
+		ContentType:       contentType,
+		ChecksumAlgorithm: algorithm,
+		ExpectedChecksum:  checksum,
+		Owner:             r.Header.Get("X-Object-Owner"),
+		Actor:             "node:" + source,
+		ExpiresAt:         expiresAt,
+		Metadata:          metadata,
+		ObjectID:          objectID,
+		ReplicationFactor: factor,
+		Stamp:             stamp,
+	}
+
+	// An encrypted copy is kept as it came, without the master key
+	form, size, stored, err := replication.ParseStoredForm(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	var obj *models.StorageObject
+	if stored {
+		copier, ok := api.store.(storage.StoredCopier)
+		if !ok {
+			http.Error(w, "This node can't keep copies as they are stored", http.StatusUnsupportedMediaType)
+			return
+		}
+		opts.ExpectedSize = size
+		obj, err = copier.PutStored(key, r.Body, form, opts)
+	} else {
+		// Compressed on the way, the declared length is that of the data once decoded
+		opts.ExpectedSize = r.ContentLength
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			opts.ExpectedSize, err = strconv.ParseInt(r.Header.Get("X-Decoded-Content-Length"), 10, 64)
+			if err != nil || opts.ExpectedSize < 0 {
+				http.Error(w, "X-Decoded-Content-Length header required with Content-Encoding", http.StatusBadRequest)
+				return
+			}
+		}
+		var body io.ReadCloser
+		body, err = replication.DecodeReplica(r.Body, r.Header.Get("Content-Encoding"))
+		if errors.Is(err, replication.ErrUnsupportedEncoding) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			// Damaged on the way
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		defer body.Close()
+		obj, err = api.store.PutWithOptions(key, body, opts)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrStaleWrite):
+			api.rejectStaleReplica(w, key, source, stamp, err)
+		case errors.Is(err, storage.ErrReadOnly):
+			writeReadOnlyError(w, err)
+		case errors.Is(err, storage.ErrBucketNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, storage.ErrChecksumMismatch), errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader):
+			// Damaged on the way, nothing of it has been kept
+			log.Printf("Rejected replica of %s from node %s: %v", key, source, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, storage.ErrInvalidObjectID), errors.Is(err, storage.ErrIncompleteUpload),
+			errors.Is(err, io.ErrUnexpectedEOF):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, storage.ErrQuotaExceeded):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		case errors.Is(err, storage.ErrInvalidStoredForm):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// The source has a copy too, which the repair loop here counts should the source go away
+	if recorder, ok := api.store.(storage.ReplicaRecorder); ok {
+		var zone string
+		if node, exists := api.cluster.GetNode(source); exists {
+			zone = node.Zone
+		}
+		if err := recorder.AddReplica(key, obj.ID, obj.Version, source, zone); err != nil && !errors.Is(err, storage.ErrPreconditionFailed) {
+			log.Printf("Failed to record replica of %s on node %s: %v", key, source, err)
+		}
+	}
+
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// rejectStaleReplica answers a copy of key stamped older than the object here with 409 and
+// a description of that object, and records the conflict
+func (api *APIServer) rejectStaleReplica(w http.ResponseWriter, key, source string, stamp *models.WriteStamp, err error) {
+	held, statErr := api.store.Stat(key)
+	if statErr != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Rejected stale replica of %s from node %s: %v", key, source, err)
+	api.replication.RecordConflict(held, source, stamp, "rejected_replica")
+
+	current := replication.NewInventoryEntry(held)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   err.Error(),
+		"current": current,
+	})
+}
+
+// serveReplica sends another node this node's copy of an object, the part in Range if it
+// asks for one. It only ever reads the local copy: if that is lost too the read fails
+// rather than being passed on, so nodes can't keep handing it to each other.
+func (api *APIServer) serveReplica(w http.ResponseWriter, r *http.Request) {
+	source := r.Header.Get("X-Replication-Source")
+	if !api.cluster.IsPeer(source, r.RemoteAddr) {
+		http.Error(w, "Replicas are only served to other cluster nodes", http.StatusForbidden)
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if !checkKey(w, key) {
+		return
+	}
+
+	offset, length, ranged, err := parseRange(r.Header.Get("Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	reader, obj, err := api.store.GetWithOptions(key, storage.GetOptions{Ranged: ranged, Offset: offset, Length: length})
+	if err != nil {
+		var rangeError *storage.RangeError
+		switch {
+		case errors.As(err, &rangeError):
+			rangeNotSatisfiable(w, err, rangeError.Size)
+		case errors.Is(err, storage.ErrObjectNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, storage.ErrCorrupt):
+			writeCorruptionError(w, err)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("X-Object-ID", obj.ID)
+	setChecksumHeaders(w, obj)
+	status := http.StatusOK
+	if ranged {
+		start, n, _ := storage.ResolveRange(obj.Size, offset, length)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, obj.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		status = http.StatusPartialContent
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, reader); err != nil {
+		// Cut short, so the reader can tell
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// localCopyLost reports whether a read failed because this node's copy of the data is
+// missing or corrupt, rather than the object itself being a problem
+func localCopyLost(err error) bool {
+	return errors.Is(err, storage.ErrCorrupt) || errors.Is(err, os.ErrNotExist)
+}
+
+// readFromReplica answers a GET for key from another node's copy, for when the local one
+// is lost, and has the local one restored from it in the background. It returns false,
+// having written nothing, if no other node could send it.
+func (api *APIServer) readFromReplica(w http.ResponseWriter, r *http.Request, key string, ranged bool) bool {
+	if api.replication == nil {
+		return false
+	}
+	obj, err := api.store.Stat(key)
+	if err != nil {
+		return false
+	}
+	rangeHeader := ""
+	if ranged {
+		rangeHeader = r.Header.Get("Range")
+	}
+	resp, nodeID, err := api.replication.OpenReplica(r.Context(), obj, rangeHeader)
+	if err != nil {
+		log.Printf("Local copy of %s is lost and no replica could be read: %v", key, err)
+		return false
+	}
+	defer resp.Body.Close()
+	log.Printf("Local copy of %s is lost, reading it from node %s", key, nodeID)
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	w.Header().Set("X-Served-By", nodeID)
+	setVersionIDHeader(w, obj)
+	setChecksumHeaders(w, obj)
+	setExpiryHeader(w, obj)
+	setMetadataHeaders(w, obj)
+	w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	api.trackAccess(obj.ID, "read", r.Header.Get("User-ID"), n)
+	if api.usage != nil {
+		api.usage.RecordDownload(principal(r), n)
+	}
+	api.replication.RestoreLocal(obj, nodeID)
+	return true
+}
+
+// dropReplica deletes this node's copy of an object at the word of another node, which has
+// moved it elsewhere. Only a copy still of the object with X-Object-ID is deleted; one
+// written over since is kept with 409.
+func (api *APIServer) dropReplica(w http.ResponseWriter, r *http.Request) {
+	source := r.Header.Get("X-Replication-Source")
+	if !api.cluster.IsPeer(source, r.RemoteAddr) {
+		http.Error(w, "Replicas are only dropped by other cluster nodes", http.StatusForbidden)
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if !checkKey(w, key) {
+		return
+	}
+	objectID := r.Header.Get("X-Object-ID")
+	if objectID == "" {
+		http.Error(w, "X-Object-ID header required", http.StatusBadRequest)
+		return
+	}
+
+	held, err := api.store.Stat(key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if held.ID != objectID {
+		http.Error(w, fmt.Sprintf("%s is another object here now", key), http.StatusConflict)
+		return
+	}
+	err = api.store.DeleteWithOptions(key, storage.DeleteOptions{IfVersion: &held.Version, Actor: "node:" + source})
+	switch {
+	case err == nil:
+		log.Printf("Dropped the copy of %s, moved elsewhere by node %s", key, source)
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, storage.ErrObjectNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrReadOnly):
+		writeReadOnlyError(w, err)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getInventory lists this node's objects with their checksums for a peer diffing against
+// it, no bodies: those under ?prefix= (of the store-wide name, bucket included) updated at
+// or after ?since= (RFC 3339) if given, in key order after ?after=, at most ?limit=
+// (default 1000) at a time. With ?format=ndjson the entries come one per line as they are
+// written, with the key to carry on after in X-Inventory-Next.
+func (api *APIServer) getInventory(w http.ResponseWriter, r *http.Request) {
+	if !api.cluster.IsPeer(r.Header.Get("X-Replication-Source"), r.RemoteAddr) {
+		http.Error(w, "The inventory is only served to other cluster nodes", http.StatusForbidden)
+		return
+	}
+
+	opts := replication.InventoryOptions{
+		Prefix: r.URL.Query().Get("prefix"),
+		After:  r.URL.Query().Get("after"),
+		Limit:  1000,
+	}
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		opts.Since = since
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = n
+	}
+	inventory := replication.BuildInventory(api.store, opts)
+
+	if r.URL.Query().Get("format") == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if inventory.Next != "" {
+			w.Header().Set("X-Inventory-Next", inventory.Next)
+		}
+		encoder := json.NewEncoder(w)
+		for _, entry := range inventory.Entries {
+			if err := encoder.Encode(entry); err != nil {
+				return // the peer has gone
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inventory)
+}
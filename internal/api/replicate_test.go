@@ -0,0 +1,328 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// flipByte passes a body on with the byte at offset flipped, as if damaged on the way
+type flipByte struct {
+	r      io.Reader
+	offset int64
+	read   int64
+}
+
+func (f *flipByte) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if i := f.offset - f.read; i >= 0 && i < int64(n) {
+		p[i] ^= 0xff
+	}
+	f.read += int64(n)
+	return n, err
+}
+
+// replicaTarget is node-2, taking copies from node-1 on this host
+type replicaTarget struct {
+	dir     string
+	store   *storage.FileStore
+	api     *APIServer
+	damage  atomic.Bool // flip a byte halfway through each copy
+	address string
+}
+
+func newReplicaTarget(t *testing.T) *replicaTarget {
+	t.Helper()
+	target := &replicaTarget{dir: t.TempDir()}
+	store, err := storage.OpenFileStore(target.dir, storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	target.store = store
+	cm := cluster.NewClusterManager("node-2", "127.0.0.1:2")
+	if err := cm.RegisterNode(&cluster.Node{ID: "node-1", Address: "127.0.0.1:1", Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	target.api = NewAPIServer(store)
+	target.api.EnableCluster(cm, replication.NewReplicationManager(cm, store, 1))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target.damage.Load() {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{&flipByte{r: r.Body, offset: r.ContentLength / 2}, r.Body}
+		}
+		target.api.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	target.address = strings.TrimPrefix(server.URL, "http://")
+	return target
+}
+
+// dataFiles counts the files in the data directory of the store in dir, kept or partial
+func dataFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files := 0
+	err := filepath.WalkDir(filepath.Join(dir, "data"), func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// replicaRequest is a copy of data as node-1 sends it
+func replicaRequest(key string, data []byte, checksum string) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "/internal/replicate/"+key, bytes.NewReader(data))
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set("X-Replication-Source", "node-1")
+	r.Header.Set("X-Object-ID", "0123456789abcdef0123456789abcdef")
+	r.Header.Set("X-Checksum", checksum)
+	return r
+}
+
+func md5Of(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReceiveReplicaChecks(t *testing.T) {
+	target := newReplicaTarget(t)
+	data := bytes.Repeat([]byte("replica "), 1<<14)
+	damaged := append([]byte(nil), data...)
+	damaged[len(damaged)/2] ^= 0xff
+	sum := sha256.Sum256(data)
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    int
+	}{
+		{"a flipped byte", replicaRequest("flipped", damaged, md5Of(data)), http.StatusUnprocessableEntity},
+		{"the checksum of another algorithm", replicaRequest("mislabelled", data, "sha256:"+md5Of(data)), http.StatusUnprocessableEntity},
+		{"an unknown algorithm", replicaRequest("unknown", data, "crc7:00"), http.StatusBadRequest},
+		{"shorter than its Content-Length", func() *http.Request {
+			r := replicaRequest("short", data, md5Of(data))
+			r.ContentLength = int64(len(data)) + 1
+			return r
+		}(), http.StatusBadRequest},
+		{"longer than its Content-Length", func() *http.Request {
+			r := replicaRequest("long", data, md5Of(data))
+			r.ContentLength = int64(len(data)) - 1
+			return r
+		}(), http.StatusBadRequest},
+		{"md5 by default", replicaRequest("md5", data, md5Of(data)), http.StatusOK},
+		{"the algorithm from the prefix", replicaRequest("sha256", data, "sha256:"+hex.EncodeToString(sum[:])), http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		target.api.ServeHTTP(w, test.request)
+		if w.Code != test.want {
+			t.Errorf("%s: %d %s, want %d", test.name, w.Code, strings.TrimSpace(w.Body.String()), test.want)
+		}
+	}
+
+	// Only the two good copies are kept, each with node-1 recorded as holding one too
+	objects := target.store.List()
+	if len(objects) != 2 || dataFiles(t, target.dir) != 2 {
+		t.Errorf("%d objects and %d data files kept, want the 2 good copies", len(objects), dataFiles(t, target.dir))
+	}
+	for _, key := range []string{"md5", "sha256"} {
+		obj, err := target.store.Stat(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if obj.ChecksumAlgorithm != key {
+			t.Errorf("%s copy checked with %s", key, obj.ChecksumAlgorithm)
+		}
+		if len(obj.Replicas) != 2 {
+			t.Errorf("%s replicas %+v, want this node and node-1", key, obj.Replicas)
+		}
+	}
+}
+
+func TestReplicaDamagedInTransit(t *testing.T) {
+	target := newReplicaTarget(t)
+	target.damage.Store(true)
+
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	obj, err := store.Put("report", bytes.NewReader(bytes.Repeat([]byte("quarterly "), 1<<16)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	if err := cm.RegisterNode(&cluster.Node{ID: "node-2", Address: target.address, Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	rm := replication.NewReplicationManager(cm, store, 1)
+	rm.SetRetry(5, time.Millisecond, time.Minute)
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rm.ReplicateObject(ctx, obj, 1); !errors.Is(err, replication.ErrUnderReplicated) {
+		t.Fatalf("replicating over a link that damages every copy = %v, want ErrUnderReplicated", err)
+	}
+
+	// Whatever the repair loop makes of it meanwhile is done with once it stops
+	if err := rm.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sent again once, then given up on with the reason
+	var task *replication.ReplicationTask
+	for _, candidate := range rm.GetAllReplicationTasks() {
+		if !candidate.Repair {
+			task = candidate
+		}
+	}
+	if task == nil || len(task.Targets) != 1 {
+		t.Fatalf("task = %+v, want the one to node-2", task)
+	}
+	if status := task.Targets[0]; status.Status != "failed" || status.Attempts != 2 || !strings.Contains(status.LastError, "422") {
+		t.Errorf("node-2 = %+v, want failed after 2 attempts with the 422 recorded", status)
+	}
+
+	// Nothing of the damaged copies is kept, nor recorded as a replica
+	if _, err := target.store.Stat("report"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("node-2 holds report (%v)", err)
+	}
+	if n := dataFiles(t, target.dir); n != 0 {
+		t.Errorf("%d data files left on node-2", n)
+	}
+	if held, err := store.Stat("report"); err != nil || len(held.Replicas) != 1 {
+		t.Errorf("report replicas %+v (%v), want only this node's", held.Replicas, err)
+	}
+}
+
+func TestReplicationShipsCiphertext(t *testing.T) {
+	target := newReplicaTarget(t)
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	keys := []storage.MasterKey{{ID: "k1", Key: bytes.Repeat([]byte{7}, 32)}}
+	store.SetEncryption(keys)
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	if err := cm.RegisterNode(&cluster.Node{ID: "node-2", Address: target.address, Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	rm := replication.NewReplicationManager(cm, store, 1)
+	rm.SetRetry(1, time.Millisecond, time.Minute)
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rm.Stop(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// node-2 has no master key, and gets the same ciphertext and wrapped key, cold and
+	// compressed before encrypting included
+	data := strings.Repeat("quarterly figures, confidential. ", 1<<10)
+	for _, tier := range []string{storage.TierHot, storage.TierCold} {
+		key := "report-" + tier
+		obj, err := store.PutWithOptions(key, strings.NewReader(data), storage.PutOptions{StorageTier: tier})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.ReplicateObject(ctx, obj, 1); err != nil {
+			t.Fatalf("replicating %s: %v", key, err)
+		}
+
+		replica, err := target.store.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replica.ID != obj.ID || replica.KeyID != "k1" || replica.WrappedKey != obj.WrappedKey ||
+			replica.Size != obj.Size || replica.Checksum != obj.Checksum || replica.ContentEncoding != obj.ContentEncoding {
+			t.Errorf("%s replica = %+v, want the source's key, size, checksum and encoding", key, replica)
+		}
+		sent, err := os.ReadFile(obj.Replicas[0].FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept, err := os.ReadFile(replica.Replicas[0].FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(kept, sent) || bytes.Contains(kept, []byte("confidential")) {
+			t.Errorf("%s replica holds %d bytes, not the source's %d of ciphertext", key, len(kept), len(sent))
+		}
+
+		// Unreadable there until it has the master key
+		if _, _, err := target.store.Get(key); !errors.Is(err, storage.ErrKeyUnavailable) {
+			t.Errorf("reading %s on node-2 without the key: %v, want ErrKeyUnavailable", key, err)
+		}
+	}
+	target.store.SetEncryption(keys)
+	for _, tier := range []string{storage.TierHot, storage.TierCold} {
+		reader, _, err := target.store.Get("report-" + tier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(got) != data {
+			t.Errorf("report-%s on node-2 with the key reads %d bytes (%v), want the original %d", tier, len(got), err, len(data))
+		}
+	}
+
+	// A node that can only keep copies decoded isn't sent one, rather than given plaintext
+	stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("sent an encrypted copy to a node that can't keep it as it is")
+	}))
+	t.Cleanup(stale.Close)
+	oldCluster := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	err = oldCluster.RegisterNode(&cluster.Node{ID: "node-3", Address: strings.TrimPrefix(stale.URL, "http://"), Status: "healthy",
+		Capabilities: []string{replication.CapabilityGzip}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	toOld := replication.NewReplicationManager(oldCluster, store, 1)
+	toOld.SetRetry(1, time.Millisecond, time.Minute)
+	if err := toOld.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer toOld.Stop(ctx)
+	obj, err := store.Put("report-late", strings.NewReader(data), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := toOld.ReplicateObject(ctx, obj, 1); err == nil {
+		t.Error("replicated an encrypted copy to a node without " + replication.CapabilityStored)
+	}
+}
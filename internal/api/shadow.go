@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
+)
+
+// SetShadower mirrors sampled object traffic through s
+func (api *APIServer) SetShadower(s *shadow.Shadower) {
+	api.shadow = s
+	api.handler = s.Wrap(api.router)
+}
+
+// getShadow reports the shadowing settings and how the shadow's answers have compared
+func (api *APIServer) getShadow(w http.ResponseWriter, r *http.Request) {
+	if api.shadow == nil {
+		http.Error(w, "Traffic shadowing is not available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"settings": api.shadow.Settings(),
+		"stats":    api.shadow.Stats(),
+	})
+}
+
+// updateShadow changes the shadowing settings at runtime, e.g. {"enabled": false}.
+// Fields left out keep their current value.
+func (api *APIServer) updateShadow(w http.ResponseWriter, r *http.Request) {
+	if api.shadow == nil {
+		http.Error(w, "Traffic shadowing is not available", http.StatusNotFound)
+		return
+	}
+
+	settings := api.shadow.Settings()
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid shadow settings", http.StatusBadRequest)
+		return
+	}
+	if err := api.shadow.Configure(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"settings": api.shadow.Settings(),
+		"stats":    api.shadow.Stats(),
+	})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
+)
+
+type shadowStatus struct {
+	Settings shadow.Settings `json:"settings"`
+	Stats    shadow.Stats    `json:"stats"`
+}
+
+func TestShadowToggledAtRuntime(t *testing.T) {
+	// The shadow cluster is another node of this version, counting what it's sent
+	var mirrored atomic.Int32
+	secondary := newStatsServer(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(shadow.Header) == "true" {
+			mirrored.Add(1)
+		}
+		secondary.ServeHTTP(w, r)
+	}))
+	t.Cleanup(target.Close)
+
+	api := newStatsServer(t)
+	shadower, err := shadow.New(shadow.Settings{Target: target.URL, SamplePercent: 100, MaxConcurrency: 4, MaxBodyBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetShadower(shadower)
+	settle := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shadower.Stop(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w := serve(api, http.MethodPut, "/objects/before", "not mirrored"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+
+	// Turned on, leaving the rest of the settings as they were
+	w := serve(api, http.MethodPut, "/admin/shadow", `{"enabled": true}`)
+	var status shadowStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("enabling = %d (%v)", w.Code, err)
+	}
+	if !status.Settings.Enabled || status.Settings.Target != target.URL || status.Settings.SamplePercent != 100 {
+		t.Errorf("settings %+v, want enabled and the rest kept", status.Settings)
+	}
+	if w := serve(api, http.MethodPut, "/objects/during", "mirrored"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+	settle()
+	if w := serve(api, http.MethodGet, "/objects/during", ""); w.Body.String() != "mirrored" {
+		t.Errorf("GET = %q", w.Body)
+	}
+	settle()
+
+	// The shadow holds what was written while mirroring, and only that
+	if _, err := secondary.store.Stat("during"); err != nil {
+		t.Errorf("the shadow doesn't hold the mirrored upload: %v", err)
+	}
+	if _, err := secondary.store.Stat("before"); err == nil {
+		t.Error("the shadow holds an upload from before mirroring was enabled")
+	}
+
+	if w := serve(api, http.MethodPut, "/admin/shadow", `{"sample_percent": 101}`); w.Code != http.StatusBadRequest {
+		t.Errorf("sample_percent 101 = %d, want 400", w.Code)
+	}
+	if w := serve(api, http.MethodPut, "/admin/shadow", `{"enabled": false}`); w.Code != http.StatusOK {
+		t.Fatalf("disabling = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodPut, "/objects/after", "not mirrored"); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", w.Code, w.Body)
+	}
+	settle()
+
+	if n := mirrored.Load(); n != 2 {
+		t.Errorf("shadow was sent %d marked requests, want the PUT and GET while enabled", n)
+	}
+	status = shadowStatus{}
+	if err := json.NewDecoder(serve(api, http.MethodGet, "/admin/shadow", "").Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if stats := status.Stats; stats.Sent != 2 || stats.Compared != 2 || stats.StatusMismatches != 0 || stats.ChecksumMismatches != 0 {
+		t.Errorf("stats %+v, want 2 mirrored and agreed on", stats)
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/accesslog"
+	"github.com/9ifrashaikh/distributed-system/internal/autotier"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// SetAccessLog keeps the accesses the server tracks in l too, and gives the tracker and
+// the classifier back the ones l holds from before, so tiering doesn't start from nothing
+// after a restart. Whenever l prunes, they forget what it no longer keeps.
+func (api *APIServer) SetAccessLog(l *accesslog.Log) error {
+	err := l.Load(func(pattern models.AccessPattern) {
+		api.tracker.add(pattern)
+		api.classifier.AddAccessPattern(pattern)
+	})
+	l.OnPrune(func(cutoff time.Time) {
+		api.tracker.trim(cutoff)
+		api.classifier.TrimAccessPatterns(cutoff)
+	})
+	api.accessLog = l
+	return err
+}
+
+// setObjectTier moves an object to the tier in {"tier": "..."}, and its data into that
+// tier's directory. Reads are served from the old data until the move is committed.
+func (api *APIServer) setObjectTier(w http.ResponseWriter, r *http.Request) {
+	key, ok := api.objectKey(w, r)
+	if !ok {
+		return
+	}
+	migrator, ok := api.store.(storage.TierMigrator)
+	if !ok {
+		http.Error(w, "This store can't move objects between tiers", http.StatusNotImplemented)
+		return
+	}
+
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Tier == "" {
+		http.Error(w, "Request body must be {\"tier\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	if err := storage.ValidateTier(req.Tier); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.checkWriteLock(w, r, key) {
+		return
+	}
+
+	obj, err := migrator.SetTier(key, req.Tier, callerID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrReadOnly):
+			writeReadOnlyError(w, err)
+		case errors.Is(err, storage.ErrCorrupt):
+			writeCorruptionError(w, err)
+		case errors.Is(err, storage.ErrObjectNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, storage.ErrPreconditionFailed):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// simulateTiering runs the classifier with candidate rules and reports what would move.
+// Pass ?from=<tier>&to=<tier> to list the objects changing between that pair.
+func (api *APIServer) simulateTiering(w http.ResponseWriter, r *http.Request) {
+	var req ml.SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid simulation request", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var drill *ml.TierPair
+	query := r.URL.Query()
+	if from, to := query.Get("from"), query.Get("to"); from != "" || to != "" {
+		if from == "" || to == "" {
+			http.Error(w, "from and to must be given together", http.StatusBadRequest)
+			return
+		}
+		drill = &ml.TierPair{From: from, To: to, Limit: 1000}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			drill.Limit = n
+		}
+	}
+
+	result, err := api.classifier.Simulate(api.store.List(), req, drill)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// getPrefetch lists objects predicted to be read within ?horizon= (default 1h)
+func (api *APIServer) getPrefetch(w http.ResponseWriter, r *http.Request) {
+	horizon := time.Hour
+	if h := r.URL.Query().Get("horizon"); h != "" {
+		d, err := time.ParseDuration(h)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid horizon", http.StatusBadRequest)
+			return
+		}
+		horizon = d
+	}
+
+	opts := ml.PrefetchOptions{Horizon: horizon, IsCached: storage.CacheCheck(api.store)}
+	entries := api.classifier.GetPrefetchRecommendations(api.store.List(), opts, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"horizon": horizon.String(),
+		"entries": entries,
+	})
+}
+
+func (api *APIServer) getRecommendations(w http.ResponseWriter, r *http.Request) {
+	recommendations, err := api.classifier.GetRecommendations(api.store.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recommendations)
+}
+
+// getFeatureImportance reports the importance summary of the last classification run,
+// classifying the current catalog first if nothing has run yet
+func (api *APIServer) getFeatureImportance(w http.ResponseWriter, r *http.Request) {
+	importance := api.classifier.FeatureImportance()
+	if importance == nil {
+		if _, err := api.classifier.ClassifyObjects(api.store.List()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		importance = api.classifier.FeatureImportance()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(importance)
+}
+
+// SetAutoTierer enables the auto-tiering endpoints
+func (api *APIServer) SetAutoTierer(t *autotier.Tierer) {
+	api.autotier = t
+}
+
+// getAutoTiering reports the auto-tiering settings and how the last run went
+func (api *APIServer) getAutoTiering(w http.ResponseWriter, r *http.Request) {
+	if api.autotier == nil {
+		http.Error(w, "Auto-tiering is not set up", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.autotier.Status())
+}
+
+// getTieringHistory lists the latest objects auto-tiering moved, or would have in a dry
+// run, newest first, at most ?limit= (default 100)
+func (api *APIServer) getTieringHistory(w http.ResponseWriter, r *http.Request) {
+	if api.autotier == nil {
+		http.Error(w, "Auto-tiering is not set up", http.StatusNotFound)
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"migrations": api.autotier.History(limit),
+	})
+}
+
+// runAutoTiering runs auto-tiering on this node now, enabled or not, and answers with how
+// it went. ?dry_run=true only reports what would be moved.
+func (api *APIServer) runAutoTiering(w http.ResponseWriter, r *http.Request) {
+	if api.autotier == nil {
+		http.Error(w, "Auto-tiering is not set up", http.StatusNotFound)
+		return
+	}
+	summary, err := api.autotier.Run(r.URL.Query().Get("dry_run") == "true")
+	if errors.Is(err, autotier.ErrRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// autoTierHere starts an auto-tiering run on this node at the leader's word
+func (api *APIServer) autoTierHere(w http.ResponseWriter, r *http.Request) {
+	if !api.cluster.IsPeer(r.Header.Get("X-Replication-Source"), r.RemoteAddr) {
+		http.Error(w, "Auto-tiering runs are only started by other cluster nodes", http.StatusForbidden)
+		return
+	}
+	if api.autotier == nil {
+		http.Error(w, "Auto-tiering is not set up", http.StatusNotFound)
+		return
+	}
+	if err := api.autotier.Trigger(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SetRuleStore enables changing the tiering rules through the API
+func (api *APIServer) SetRuleStore(rules *ml.RuleStore) {
+	api.rules = rules
+}
+
+// getTieringRules answers with the live tiering rules and who changed them when
+func (api *APIServer) getTieringRules(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"rules": api.classifier.Rules()}
+	if api.rules != nil {
+		response["history"] = api.rules.History()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// updateTieringRules replaces the tiering rules from the next classification on, e.g.
+// {"hot_tier_days": 3}. Fields left out keep their current value. The rules are saved, so
+// they are kept over the configured ones after a restart.
+func (api *APIServer) updateTieringRules(w http.ResponseWriter, r *http.Request) {
+	if api.rules == nil {
+		http.Error(w, "Tiering rules can't be changed on this node", http.StatusNotFound)
+		return
+	}
+
+	rules := api.classifier.Rules()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tiering rules: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := rules.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := callerID(r)
+	if actor == "" {
+		actor = "admin"
+	}
+	change, err := api.rules.Update(rules, actor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Tiering rules changed by %s: %+v", change.Actor, change.Rules)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules":   change.Rules,
+		"change":  change,
+		"history": api.rules.History(),
+	})
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/upload"
+	"github.com/gorilla/mux"
+)
+
+const (
+	tusVersion = "1.0.0"
+
+	// tus uses 460 for a finished upload whose checksum doesn't match
+	statusChecksumMismatch = 460
+)
+
+// SetUploadManager enables the resumable upload endpoints
+func (api *APIServer) SetUploadManager(m *upload.Manager) {
+	api.uploads = m
+}
+
+// createUpload starts a resumable upload. The total size goes in Upload-Length and the
+// target key in Upload-Metadata ("key <base64>", as in tus) or ?key=. An expected digest
+// can be given with X-Checksum and X-Checksum-Algorithm and is verified on completion.
+func (api *APIServer) createUpload(w http.ResponseWriter, r *http.Request) {
+	if api.uploads == nil {
+		http.Error(w, "Resumable uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := metadata["key"]
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	if key == "" {
+		http.Error(w, "Upload-Metadata must include a key", http.StatusBadRequest)
+		return
+	}
+	if !checkKey(w, key) {
+		return
+	}
+
+	contentType := metadata["content_type"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	checksum := r.Header.Get("X-Checksum")
+	algorithm := strings.ToLower(r.Header.Get("X-Checksum-Algorithm"))
+	if checksum != "" && algorithm == "" {
+		algorithm = storage.ChecksumMD5
+	}
+
+	owner := callerID(r)
+	if owner == "" {
+		owner = "anonymous"
+	}
+
+	// Into the default bucket, as a PUT to /objects/{key} would be
+	u, err := api.uploads.Create(storage.ObjectName(storage.DefaultBucket, key), length, contentType, owner, checksum, algorithm)
+	if err != nil {
+		if errors.Is(err, storage.ErrUnsupportedChecksum) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+u.ID)
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// uploadOffset lets a client find out where to resume
+func (api *APIServer) uploadOffset(w http.ResponseWriter, r *http.Request) {
+	if api.uploads == nil {
+		http.Error(w, "Resumable uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	u, err := api.uploads.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendUpload writes the body at Upload-Offset. The last PATCH also stores the object.
+func (api *APIServer) appendUpload(w http.ResponseWriter, r *http.Request) {
+	if api.uploads == nil {
+		http.Error(w, "Resumable uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	u, obj, err := api.uploads.Append(mux.Vars(r)["id"], offset, r.Body, callerID(r))
+	if api.usage != nil && u.Offset > offset {
+		api.usage.RecordUpload(principal(r), u.Offset-offset)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, upload.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, upload.ErrOffsetMismatch), errors.Is(err, upload.ErrBusy):
+			setUploadHeaders(w, u)
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, upload.ErrTooLarge):
+			setUploadHeaders(w, u)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, upload.ErrChecksum):
+			http.Error(w, err.Error(), statusChecksumMismatch)
+		case errors.Is(err, storage.ErrReadOnly):
+			// Kept too, for when the store takes writes again
+			setUploadHeaders(w, u)
+			writeReadOnlyError(w, err)
+		case errors.Is(err, storage.ErrQuotaExceeded):
+			// The upload is kept, so it can be completed once space is freed
+			setUploadHeaders(w, u)
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			// Most likely the client went away mid-body; what arrived is kept
+			setUploadHeaders(w, u)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	setUploadHeaders(w, u)
+	if obj != nil {
+		api.trackAccess(obj.ID, "write", r.Header.Get("User-ID"), obj.Size)
+		_, key := storage.SplitObjectName(obj.Key)
+		w.Header().Set("X-Object-Key", key)
+		w.Header().Set("X-Object-Version", strconv.FormatInt(obj.Version, 10))
+		setChecksumHeaders(w, obj)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *APIServer) terminateUpload(w http.ResponseWriter, r *http.Request) {
+	if api.uploads == nil {
+		http.Error(w, "Resumable uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if err := api.uploads.Terminate(mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, upload.ErrBusy) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setUploadHeaders(w http.ResponseWriter, u upload.Upload) {
+	if u.ID == "" {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(time.RFC1123))
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header: comma-separated
+// "name base64value" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, errors.New("invalid base64 in Upload-Metadata for " + parts[0])
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
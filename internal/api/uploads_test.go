@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/upload"
+)
+
+// dropped gives up n bytes of data, then breaks off as a client losing its connection would
+type dropped struct {
+	data []byte
+	n    int
+}
+
+func (d *dropped) Read(p []byte) (int, error) {
+	if d.n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, d.data[:min(len(p), d.n)])
+	d.data, d.n = d.data[n:], d.n-n
+	return n, nil
+}
+
+type uploadServer struct {
+	api   *APIServer
+	store *storage.FileStore
+	dir   string // where uploads in progress are kept
+}
+
+func newUploadServer(t *testing.T) *uploadServer {
+	t.Helper()
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	s := &uploadServer{api: NewAPIServer(store), store: store, dir: t.TempDir()}
+	s.restart(t)
+	return s
+}
+
+// restart picks up the uploads in progress with a new manager, as after a restart
+func (s *uploadServer) restart(t *testing.T) *upload.Manager {
+	t.Helper()
+	m, err := upload.NewManager(s.dir, s.store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.api.SetUploadManager(m)
+	return m
+}
+
+func (s *uploadServer) create(t *testing.T, key string, length int, checksum string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte(key)))
+	if checksum != "" {
+		r.Header.Set("X-Checksum", checksum)
+		r.Header.Set("X-Checksum-Algorithm", storage.ChecksumMD5)
+	}
+	w := httptest.NewRecorder()
+	s.api.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") == "" {
+		t.Fatalf("creating the upload = %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func (s *uploadServer) patch(location string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, location, body)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	s.api.ServeHTTP(w, r)
+	return w
+}
+
+// offset is where the server says to resume, -1 if it doesn't know the upload
+func (s *uploadServer) offset(location string) int {
+	w := serve(s.api, http.MethodHead, location, "")
+	if w.Code != http.StatusOK {
+		return -1
+	}
+	offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	return offset
+}
+
+func TestUploadResumesAfterDisconnect(t *testing.T) {
+	s := newUploadServer(t)
+	data := bytes.Repeat([]byte("0123456789"), 100_000)
+	location := s.create(t, "videos/holiday.mp4", len(data), md5Of(data))
+
+	// The connection drops 300 000 bytes into the first PATCH
+	if w := s.patch(location, 0, &dropped{data: data, n: 300_000}); w.Code == http.StatusNoContent {
+		t.Fatal("a PATCH that broke off was taken as complete")
+	}
+	if offset := s.offset(location); offset != 300_000 {
+		t.Fatalf("after the disconnect the upload is at %d, want 300000", offset)
+	}
+	if _, err := s.store.Stat("videos/holiday.mp4"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("the object exists half uploaded (%v)", err)
+	}
+
+	// Resuming from anywhere else is refused, saying where to resume from
+	w := s.patch(location, 0, bytes.NewReader(data))
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "300000" {
+		t.Errorf("PATCH at the wrong offset = %d at %s, want 409 at 300000", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// Nor does a restart lose what arrived
+	s.restart(t)
+	if offset := s.offset(location); offset != 300_000 {
+		t.Fatalf("after a restart the upload is at %d, want 300000", offset)
+	}
+	if w := s.patch(location, 300_000, bytes.NewReader(data[300_000:600_000])); w.Code != http.StatusNoContent || w.Header().Get("X-Object-Key") != "" {
+		t.Fatalf("resuming = %d, key %q, want 204 and not finished yet", w.Code, w.Header().Get("X-Object-Key"))
+	}
+	w = s.patch(location, 600_000, bytes.NewReader(data[600_000:]))
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Object-Key") != "videos/holiday.mp4" {
+		t.Fatalf("finishing = %d, key %q, want 204 with the object stored: %s", w.Code, w.Header().Get("X-Object-Key"), w.Body)
+	}
+
+	if got := serve(s.api, http.MethodGet, "/objects/videos/holiday.mp4", ""); !bytes.Equal(got.Body.Bytes(), data) {
+		t.Errorf("stored %d bytes, want the %d uploaded", got.Body.Len(), len(data))
+	}
+	if offset := s.offset(location); offset != -1 {
+		t.Errorf("the finished upload is still there at %d", offset)
+	}
+	if entries, _ := os.ReadDir(s.dir); len(entries) != 0 {
+		t.Errorf("%d files left behind by the finished upload", len(entries))
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	s := newUploadServer(t)
+	data := []byte("the data the client meant to send")
+	location := s.create(t, "report", len(data), md5Of(data))
+
+	damaged := bytes.ToUpper(data)
+	if w := s.patch(location, 0, bytes.NewReader(damaged)); w.Code != statusChecksumMismatch {
+		t.Errorf("finishing with the wrong data = %d, want %d", w.Code, statusChecksumMismatch)
+	}
+	if _, err := s.store.Stat("report"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("the object was stored (%v)", err)
+	}
+	if offset := s.offset(location); offset != -1 {
+		t.Errorf("an upload that can't be fixed by resuming is still there at %d", offset)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s := newUploadServer(t)
+	location := s.create(t, "small", 10, "")
+	w := s.patch(location, 0, bytes.NewReader([]byte("more than ten bytes")))
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("PATCH past the length = %d at %s, want 413 with the 10 that fit", w.Code, w.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestIncompleteUploadsAreReaped(t *testing.T) {
+	s := newUploadServer(t)
+	m := s.restart(t)
+	stale := s.create(t, "stale", 100, "")
+	s.patch(stale, 0, bytes.NewReader(make([]byte, 40)))
+
+	if n := m.Reap(time.Now()); n != 0 {
+		t.Errorf("reaped %d uploads before they expired", n)
+	}
+	if n := m.Reap(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Errorf("reaped %d uploads an hour after they expired, want 1", n)
+	}
+	if offset := s.offset(stale); offset != -1 {
+		t.Errorf("the reaped upload is still at %d", offset)
+	}
+	if w := s.patch(stale, 40, bytes.NewReader(make([]byte, 60))); w.Code != http.StatusNotFound {
+		t.Errorf("resuming a reaped upload = %d, want 404", w.Code)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(s.dir, "*")); len(entries) != 0 {
+		t.Errorf("the reaped upload left %v", entries)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/usage"
+	"github.com/gorilla/mux"
+)
+
+// SetUsageTracker enables usage accounting and the /usage reports
+func (api *APIServer) SetUsageTracker(t *usage.Tracker) {
+	api.usage = t
+}
+
+// principal is who transfer is billed to
+func principal(r *http.Request) string {
+	if id := callerID(r); id != "" {
+		return id
+	}
+	return "anonymous"
+}
+
+// getUserUsage returns a user's daily rollups for ?from=..&to= (YYYY-MM-DD, default the
+// last 30 days) and their current totals. Users may read their own usage, admins anyone's.
+// ?format=csv returns the series as CSV.
+func (api *APIServer) getUserUsage(w http.ResponseWriter, r *http.Request) {
+	if api.usage == nil {
+		http.Error(w, "Usage tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	user := mux.Vars(r)["user"]
+	if callerID(r) != user && !api.isAdmin(r) {
+		http.Error(w, "Not allowed to read another user's usage", http.StatusForbidden)
+		return
+	}
+
+	from, to, err := usageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := api.usage.Series(user, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		rows := make([][]string, 0, len(series))
+		for _, rollup := range series {
+			rows = append(rows, usageRow(rollup.Date, rollup.Principal, rollup.Totals))
+		}
+		writeUsageCSV(w, fmt.Sprintf("usage-%s-%s-%s.csv", user, from, to), "date", rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":    user,
+		"from":    from,
+		"to":      to,
+		"current": api.usage.Current(user),
+		"series":  series,
+	})
+}
+
+// getUsageSummary lists every principal's usage over the range, largest consumers first
+func (api *APIServer) getUsageSummary(w http.ResponseWriter, r *http.Request) {
+	if api.usage == nil {
+		http.Error(w, "Usage tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	from, to, err := usageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := api.usage.Summarize(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		rows := make([][]string, 0, len(summaries))
+		for _, s := range summaries {
+			rows = append(rows, usageRow(from+".."+to, s.Principal, s.Totals))
+		}
+		writeUsageCSV(w, fmt.Sprintf("usage-summary-%s-%s.csv", from, to), "period", rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":       from,
+		"to":         to,
+		"principals": summaries,
+	})
+}
+
+func usageRange(r *http.Request) (string, string, error) {
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, -30).Format("2006-01-02")
+	to := now.Format("2006-01-02")
+
+	for name, target := range map[string]*string{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return "", "", fmt.Errorf("invalid %s date %q, expected YYYY-MM-DD", name, value)
+		}
+		*target = value
+	}
+	if from > to {
+		return "", "", fmt.Errorf("from must not be after to")
+	}
+	return from, to, nil
+}
+
+func usageRow(period, principal string, t usage.Totals) []string {
+	return []string{
+		period,
+		principal,
+		strconv.FormatInt(t.StoredBytes, 10),
+		strconv.FormatInt(t.Objects, 10),
+		strconv.FormatInt(t.BytesUploaded, 10),
+		strconv.FormatInt(t.BytesDownloaded, 10),
+	}
+}
+
+func writeUsageCSV(w http.ResponseWriter, filename, periodColumn string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{periodColumn, "principal", "stored_bytes", "objects", "bytes_uploaded", "bytes_downloaded"})
+	writer.WriteAll(rows)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ifVersion serves a request with an If-Version-Match precondition
+func ifVersion(api *APIServer, method, path, body, version string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("If-Version-Match", version)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestObjectVersionHeader(t *testing.T) {
+	api := newStatsServer(t)
+
+	for i, step := range []struct {
+		method, path, body string
+	}{
+		{http.MethodPut, "/objects/report", "first draft"},
+		{http.MethodPut, "/objects/report", "first draft"},
+		{http.MethodPost, "/objects/report?append=true", ", revised"},
+		{http.MethodPost, "/objects/report/tier", `{"tier": "warm"}`},
+	} {
+		w := serve(api, step.method, step.path, step.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s = %d: %s", step.method, step.path, w.Code, w.Body)
+		}
+		if got, want := w.Header().Get("X-Object-Version"), strconv.Itoa(i+1); got != want {
+			t.Errorf("%s %s: X-Object-Version %q, want %s", step.method, step.path, got, want)
+		}
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if got := serve(api, method, "/objects/report", "").Header().Get("X-Object-Version"); got != "4" {
+			t.Errorf("%s: X-Object-Version %q, want 4", method, got)
+		}
+	}
+}
+
+func TestIfVersionMatch(t *testing.T) {
+	api := newStatsServer(t)
+
+	// 0 creates only
+	if w := ifVersion(api, http.MethodPut, "/objects/report", "first draft", "0"); w.Code != http.StatusOK {
+		t.Fatalf("create-only PUT = %d: %s", w.Code, w.Body)
+	}
+	if w := ifVersion(api, http.MethodPut, "/objects/report", "again", "0"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("create-only PUT over an object = %d, want 412", w.Code)
+	}
+
+	// A stale version is refused and leaves the object as it was
+	for _, path := range []string{"PUT /objects/report", "POST /objects/report?append=true", "DELETE /objects/report"} {
+		method, target, _ := strings.Cut(path, " ")
+		if w := ifVersion(api, method, target, "lost update", "7"); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s at a stale version = %d, want 412", path, w.Code)
+		}
+	}
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Body.String() != "first draft" || w.Header().Get("X-Object-Version") != "1" {
+		t.Errorf("report = %q at version %s, want the first draft at 1", w.Body, w.Header().Get("X-Object-Version"))
+	}
+
+	// The current version goes through
+	if w := ifVersion(api, http.MethodPut, "/objects/report", "second draft", "1"); w.Code != http.StatusOK || w.Header().Get("X-Object-Version") != "2" {
+		t.Errorf("PUT at the current version = %d, version %s", w.Code, w.Header().Get("X-Object-Version"))
+	}
+	if w := ifVersion(api, http.MethodPut, "/objects/report", "x", "two"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with If-Version-Match: two = %d, want 400", w.Code)
+	}
+	if w := ifVersion(api, http.MethodDelete, "/objects/report", "", "2"); w.Code >= 300 {
+		t.Errorf("DELETE at the current version = %d", w.Code)
+	}
+	if w := serve(api, http.MethodGet, "/objects/report", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after the delete = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,433 @@
+// Package autotier moves objects between tiers on the classifier's recommendations, a
+// batch at a time within a budget, so nothing has to be moved by hand.
+package autotier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+var (
+	ErrRunning  = errors.New("an auto-tiering run is already in progress")
+	ErrDisabled = errors.New("auto-tiering is off on this node")
+)
+
+const (
+	// Actor is who tier changes made by a run are recorded as made by
+	Actor = "autotier"
+
+	maxHistory  = 1000 // migrations kept for History
+	peerTimeout = 10 * time.Second
+)
+
+// Settings are when runs happen and how much one may move
+type Settings struct {
+	Enabled       bool
+	DryRun        bool // runs only record what they would move
+	Interval      time.Duration
+	MinConfidence float64 // recommendations less sure than this are left alone
+	MaxObjects    int     // moved per run
+	MaxBytes      int64   // moved per run
+
+	// PreloadBytes is how much of the objects expected to be read within PrefetchHorizon
+	// a run may read into the store's cache ahead of time, 0 for none
+	PreloadBytes    int64
+	PrefetchHorizon time.Duration
+}
+
+// Migration is one object a run moved, or would have in a dry run, or failed to
+type Migration struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	ObjectID   string    `json:"object_id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Size       int64     `json:"size"`
+	Confidence float64   `json:"confidence"`
+	Reason     string    `json:"reason"`
+	DryRun     bool      `json:"dry_run,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// RunSummary is how one run went
+type RunSummary struct {
+	StartedAt   time.Time   `json:"started_at"`
+	FinishedAt  time.Time   `json:"finished_at"`
+	DryRun      bool        `json:"dry_run"`
+	Recommended int         `json:"recommended"` // objects the classifier would move
+	Eligible    int         `json:"eligible"`    // of those, sure enough to
+	Migrated    int         `json:"migrated"`    // or would have been, in a dry run
+	Bytes       int64       `json:"bytes"`
+	Failed      int         `json:"failed"`
+	Skipped     int         `json:"skipped"`  // locked, or changed since they were classified
+	Deferred    int         `json:"deferred"` // left for a later run by the budget
+	Migrations  []Migration `json:"migrations"`
+	// Preloaded objects were read into the cache ahead of their expected reads, or would
+	// have been, in a dry run
+	Preloaded      int   `json:"preloaded"`
+	PreloadedBytes int64 `json:"preloaded_bytes"`
+}
+
+// Status is the settings and how the last run went
+type Status struct {
+	Enabled       bool        `json:"enabled"`
+	DryRun        bool        `json:"dry_run"`
+	Interval      string      `json:"interval"`
+	MinConfidence float64     `json:"min_confidence"`
+	MaxObjects    int         `json:"max_objects"`
+	MaxBytes      int64       `json:"max_bytes"`
+	PreloadBytes  int64       `json:"preload_bytes"`
+	Running       bool        `json:"running"`
+	LastRun       *RunSummary `json:"last_run,omitempty"`
+}
+
+// Tierer runs the classifier over a store every so often and applies what it recommends.
+// In a cluster each node tiers its own objects, but only the leader keeps the time: it
+// runs, then tells the other nodes to.
+type Tierer struct {
+	store      storage.Store
+	classifier *ml.DataClassifier
+	cluster    *cluster.ClusterManager // nil when standalone
+	locks      *lock.Manager           // nil when object locks are off
+
+	mutex    sync.Mutex
+	settings Settings
+	running  bool
+	last     *RunSummary
+	history  []Migration // oldest first
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(store storage.Store, classifier *ml.DataClassifier) *Tierer {
+	return &Tierer{store: store, classifier: classifier, wake: make(chan struct{}, 1)}
+}
+
+// SetCluster has only the leader schedule runs, telling the other nodes when to run theirs
+func (t *Tierer) SetCluster(cm *cluster.ClusterManager) {
+	t.cluster = cm
+}
+
+// SetLocks has runs leave alone objects whose lock holders guard them against writes
+func (t *Tierer) SetLocks(locks *lock.Manager) {
+	t.locks = locks
+}
+
+// Configure replaces the settings, taking effect from the next run
+func (t *Tierer) Configure(settings Settings) {
+	t.mutex.Lock()
+	t.settings = settings
+	t.mutex.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Tierer) Status() Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return Status{
+		Enabled:       t.settings.Enabled,
+		DryRun:        t.settings.DryRun,
+		Interval:      t.settings.Interval.String(),
+		MinConfidence: t.settings.MinConfidence,
+		MaxObjects:    t.settings.MaxObjects,
+		MaxBytes:      t.settings.MaxBytes,
+		PreloadBytes:  t.settings.PreloadBytes,
+		Running:       t.running,
+		LastRun:       t.last,
+	}
+}
+
+// History returns up to limit of the latest migrations, newest first
+func (t *Tierer) History(limit int) []Migration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	history := make([]Migration, 0, min(limit, len(t.history)))
+	for i := len(t.history) - 1; i >= 0 && len(history) < limit; i-- {
+		history = append(history, t.history[i])
+	}
+	return history
+}
+
+// Run classifies the store and moves the objects it recommends moving, the surest first,
+// until the budget runs out. With dryRun, or the settings' DryRun, nothing is moved and
+// the summary lists what would have been.
+func (t *Tierer) Run(dryRun bool) (*RunSummary, error) {
+	t.mutex.Lock()
+	if t.running {
+		t.mutex.Unlock()
+		return nil, ErrRunning
+	}
+	t.running = true
+	settings := t.settings
+	t.mutex.Unlock()
+
+	summary := t.run(settings, dryRun || settings.DryRun)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.running = false
+	t.last = summary
+	t.history = append(t.history, summary.Migrations...)
+	if len(t.history) > maxHistory {
+		t.history = append([]Migration(nil), t.history[len(t.history)-maxHistory:]...)
+	}
+	return summary, nil
+}
+
+// Trigger starts a run in the background, for the leader's word
+func (t *Tierer) Trigger() error {
+	t.mutex.Lock()
+	enabled, running := t.settings.Enabled, t.running
+	t.mutex.Unlock()
+	switch {
+	case !enabled:
+		return ErrDisabled
+	case running:
+		return ErrRunning
+	}
+	go func() {
+		if _, err := t.Run(false); err != nil {
+			log.Printf("Auto-tiering run failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (t *Tierer) run(settings Settings, dryRun bool) *RunSummary {
+	summary := &RunSummary{StartedAt: time.Now(), DryRun: dryRun, Migrations: []Migration{}}
+	defer func() { summary.FinishedAt = time.Now() }()
+
+	migrator, ok := t.store.(storage.TierMigrator)
+	if !ok {
+		log.Printf("Auto-tiering skipped: this store can't move objects between tiers")
+		return summary
+	}
+	objects := t.store.List()
+	recommendations, err := t.classifier.GetRecommendations(objects)
+	if err != nil {
+		log.Printf("Auto-tiering skipped: %v", err)
+		return summary
+	}
+	summary.Recommended = len(recommendations)
+
+	var eligible []ml.TieringRecommendation
+	for _, rec := range recommendations {
+		if rec.Confidence >= settings.MinConfidence {
+			eligible = append(eligible, rec)
+		}
+	}
+	sort.SliceStable(eligible, func(i, j int) bool { return eligible[i].Confidence > eligible[j].Confidence })
+	summary.Eligible = len(eligible)
+
+	for _, rec := range eligible {
+		obj, exists := objects[rec.ObjectKey]
+		if !exists || obj.ID != rec.ObjectID {
+			summary.Skipped++
+			continue
+		}
+		if summary.Migrated >= settings.MaxObjects || summary.Bytes+obj.Size > settings.MaxBytes {
+			summary.Deferred++
+			continue
+		}
+		if t.locks != nil && t.locks.CheckWrite(rec.ObjectKey, "") != nil {
+			summary.Skipped++
+			continue
+		}
+
+		migration := Migration{
+			Time:       time.Now(),
+			Key:        rec.ObjectKey,
+			ObjectID:   rec.ObjectID,
+			From:       rec.CurrentTier,
+			To:         rec.RecommendedTier,
+			Size:       obj.Size,
+			Confidence: rec.Confidence,
+			Reason:     rec.Reason,
+			DryRun:     dryRun,
+		}
+		if !dryRun {
+			if _, err := migrator.SetTier(rec.ObjectKey, rec.RecommendedTier, Actor); err != nil {
+				migration.Error = err.Error()
+			}
+		}
+		summary.Migrations = append(summary.Migrations, migration)
+		switch {
+		case migration.Error != "":
+			summary.Failed++
+			log.Printf("Auto-tiering failed to move %s from %s to %s: %s", migration.Key, migration.From, migration.To, migration.Error)
+		case dryRun:
+			summary.Migrated++
+			summary.Bytes += obj.Size
+			log.Printf("Auto-tiering would move %s from %s to %s: %s", migration.Key, migration.From, migration.To, migration.Reason)
+		default:
+			summary.Migrated++
+			summary.Bytes += obj.Size
+			log.Printf("Auto-tiering moved %s from %s to %s: %s", migration.Key, migration.From, migration.To, migration.Reason)
+		}
+	}
+	t.preload(settings, dryRun, summary)
+	if summary.Eligible > 0 {
+		moved := "moved"
+		if dryRun {
+			moved = "would be moved"
+		}
+		log.Printf("Auto-tiering run done: %d of %d eligible objects %s (%d bytes), %d failed, %d skipped, %d left for later",
+			summary.Migrated, summary.Eligible, moved, summary.Bytes, summary.Failed, summary.Skipped, summary.Deferred)
+	}
+	return summary
+}
+
+// preload reads the objects the classifier expects to be read within the horizon, and
+// that aren't cached, into the store's cache, the soonest expected first, until the
+// preload budget runs out
+func (t *Tierer) preload(settings Settings, dryRun bool, summary *RunSummary) {
+	isCached := storage.CacheCheck(t.store)
+	if settings.PreloadBytes <= 0 || isCached == nil {
+		return
+	}
+	cacher := t.store.(storage.Cacher)
+	opts := ml.PrefetchOptions{Horizon: settings.PrefetchHorizon, IsCached: isCached}
+	for _, entry := range t.classifier.GetPrefetchRecommendations(t.store.List(), opts, time.Now()) {
+		if entry.Action != "preload_cache" || summary.PreloadedBytes+entry.Size > settings.PreloadBytes {
+			continue
+		}
+		size := entry.Size
+		if !dryRun {
+			var err error
+			if size, err = cacher.Preload(entry.ObjectKey); err != nil {
+				log.Printf("Auto-tiering failed to preload %s: %v", entry.ObjectKey, err)
+				continue
+			}
+			if size == 0 {
+				continue // too large for the cache after all, or read in since
+			}
+		}
+		summary.Preloaded++
+		summary.PreloadedBytes += size
+	}
+	if summary.Preloaded > 0 {
+		preloaded := "preloaded"
+		if dryRun {
+			preloaded = "would preload"
+		}
+		log.Printf("Auto-tiering %s %d objects (%d bytes) expected to be read within %s",
+			preloaded, summary.Preloaded, summary.PreloadedBytes, settings.PrefetchHorizon)
+	}
+}
+
+// Start runs every Interval while enabled; in a cluster only on the leader, which then
+// has the others run
+func (t *Tierer) Start(ctx context.Context) error {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+		last := time.Now()
+		for {
+			t.mutex.Lock()
+			settings := t.settings
+			t.mutex.Unlock()
+
+			var due <-chan time.Time
+			var timer *time.Timer
+			if settings.Enabled && settings.Interval > 0 {
+				timer = time.NewTimer(time.Until(last.Add(settings.Interval)))
+				due = timer.C
+			}
+			woken := false
+			select {
+			case <-t.stop:
+			case <-t.wake:
+				woken = true
+			case <-due:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			select {
+			case <-t.stop:
+				return
+			default:
+			}
+			if woken {
+				continue // settings changed, work out when the next run is due again
+			}
+			last = time.Now()
+
+			if t.cluster != nil {
+				leader := t.cluster.Leader()
+				if leader == nil || leader.ID != t.cluster.GetCurrentNode().ID {
+					continue
+				}
+			}
+			if _, err := t.Run(false); err != nil {
+				log.Printf("Auto-tiering run failed: %v", err)
+			}
+			if t.cluster != nil {
+				t.tellOthers()
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *Tierer) Stop(ctx context.Context) error {
+	if t.stop == nil {
+		return nil
+	}
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tellOthers has every other healthy node run, see Trigger
+func (t *Tierer) tellOthers() {
+	self := t.cluster.GetCurrentNode().ID
+	client := t.cluster.NewClient(peerTimeout)
+	var wg sync.WaitGroup
+	for _, node := range t.cluster.GetHealthyNodes() {
+		if node.ID == self {
+			continue
+		}
+		wg.Add(1)
+		go func(node *cluster.Node) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/internal/tiering/run", node.Address), nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("X-Replication-Source", self)
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Failed to have node %s run auto-tiering: %v", node.ID, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+				log.Printf("Failed to have node %s run auto-tiering: %s", node.ID, resp.Status)
+			}
+		}(node)
+	}
+	wg.Wait()
+}
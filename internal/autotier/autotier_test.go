@@ -0,0 +1,88 @@
+package autotier_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/autotier"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+func TestRunPreloadsWithinBudget(t *testing.T) {
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	store.SetCache(4<<20, 1<<20)
+
+	// Three inputs of 400 KB, each read daily at a time coming up within the hour, the
+	// soonest first
+	dc := ml.NewDataClassifier()
+	now := time.Now()
+	keys := []string{"input-a", "input-b", "input-c"}
+	for i, key := range keys {
+		obj, err := store.Put(key, bytes.NewReader(make([]byte, 400<<10)), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := now.Add(time.Duration(i+1) * 10 * time.Minute)
+		for day := 1; day <= 7; day++ {
+			dc.AddAccessPattern(models.AccessPattern{ObjectID: obj.ID, AccessTime: next.AddDate(0, 0, -day), Operation: "read"})
+		}
+	}
+
+	tierer := autotier.New(store, dc)
+	settings := autotier.Settings{
+		MinConfidence:   2, // moves nothing, only preloads
+		PreloadBytes:    1 << 20,
+		PrefetchHorizon: time.Hour,
+	}
+	tierer.Configure(settings)
+
+	// A dry run only says what it would read in
+	summary, err := tierer.Run(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Preloaded != 2 || summary.PreloadedBytes != 800<<10 {
+		t.Errorf("dry run would preload %d objects of %d bytes, want 2 of 800 KB", summary.Preloaded, summary.PreloadedBytes)
+	}
+	for _, key := range keys {
+		if store.Cached(key) {
+			t.Errorf("%s cached by a dry run", key)
+		}
+	}
+
+	// Two fit in the budget, the two expected soonest
+	summary, err = tierer.Run(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Preloaded != 2 || summary.PreloadedBytes != 800<<10 || summary.Migrated != 0 {
+		t.Errorf("run preloaded %d objects of %d bytes and moved %d, want 2 of 800 KB and none moved",
+			summary.Preloaded, summary.PreloadedBytes, summary.Migrated)
+	}
+	for key, want := range map[string]bool{"input-a": true, "input-b": true, "input-c": false} {
+		if store.Cached(key) != want {
+			t.Errorf("%s cached = %v, want %v", key, !want, want)
+		}
+	}
+
+	// Those already cached aren't counted against the budget again
+	if summary, err = tierer.Run(false); err != nil || summary.Preloaded != 1 || !store.Cached("input-c") {
+		t.Errorf("second run preloaded %d (%v), want input-c", summary.Preloaded, err)
+	}
+
+	// Nothing is preloaded without a budget
+	store.SetCache(8<<20, 1<<20)
+	settings.PreloadBytes = 0
+	tierer.Configure(settings)
+	if summary, err = tierer.Run(false); err != nil || summary.Preloaded != 0 {
+		t.Errorf("run without a budget preloaded %d (%v)", summary.Preloaded, err)
+	}
+}
@@ -0,0 +1,337 @@
+// Package catalog keeps a cluster-wide view of object metadata. Each node pulls compact
+// entries (never data) from its peers, keyed on the peer's journal sequence number, and
+// merges them with its own store so any node can list everything and say where it lives.
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// pageSize bounds how many entries one pull request asks for
+const pageSize = 1000
+
+// Entry is the metadata a node advertises for one object
+type Entry struct {
+	Key               string            `json:"key"`
+	Bucket            string            `json:"bucket,omitempty"`
+	ObjectID          string            `json:"object_id"`
+	Size              int64             `json:"size"`
+	ContentType       string            `json:"content_type"`
+	Checksum          string            `json:"checksum"`
+	ChecksumAlgorithm string            `json:"checksum_algorithm"`
+	Tier              string            `json:"tier"`
+	Version           int64             `json:"version"`
+	Owner             string            `json:"owner"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	Metadata          map[string]string `json:"metadata,omitempty"` // user metadata
+	Nodes             []string          `json:"nodes,omitempty"`    // nodes holding these bytes, in merged entries
+	Deleted           bool              `json:"deleted,omitempty"`  // only in deltas
+}
+
+// Delta is one page of a node's catalog changes. A full delta replaces everything the
+// puller knew about the node; otherwise entries are applied on top.
+type Delta struct {
+	NodeID  string  `json:"node_id"`
+	LastSeq uint64  `json:"last_seq"`
+	Full    bool    `json:"full"`
+	More    bool    `json:"more"`
+	Entries []Entry `json:"entries"`
+}
+
+func entryFor(obj *models.StorageObject) Entry {
+	return Entry{
+		Key:               obj.Key,
+		Bucket:            obj.Bucket,
+		ObjectID:          obj.ID,
+		Size:              obj.Size,
+		ContentType:       obj.ContentType,
+		Checksum:          obj.Checksum,
+		ChecksumAlgorithm: obj.ChecksumAlgorithm,
+		Tier:              obj.StorageTier,
+		Version:           obj.Version,
+		Owner:             obj.Owner,
+		UpdatedAt:         obj.UpdatedAt,
+		Metadata:          obj.Metadata,
+	}
+}
+
+// Object converts the entry into the metadata shape used by listings
+func (e Entry) Object() *models.StorageObject {
+	return &models.StorageObject{
+		ID:                e.ObjectID,
+		Key:               e.Key,
+		Bucket:            e.Bucket,
+		Size:              e.Size,
+		ContentType:       e.ContentType,
+		Checksum:          e.Checksum,
+		ChecksumAlgorithm: e.ChecksumAlgorithm,
+		UpdatedAt:         e.UpdatedAt,
+		StorageTier:       e.Tier,
+		Version:           e.Version,
+		Owner:             e.Owner,
+		Metadata:          e.Metadata,
+	}
+}
+
+// newer reports whether a should win over b. Versions are counted per node, so equal
+// versions fall back to the most recent update.
+func newer(a, b Entry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.UpdatedAt.After(b.UpdatedAt)
+}
+
+type peer struct {
+	seq     uint64
+	entries map[string]Entry
+}
+
+type Catalog struct {
+	store   storage.Store
+	cluster *cluster.ClusterManager
+	client  *http.Client
+
+	mutex sync.RWMutex
+	peers map[string]*peer
+
+	tickerMutex sync.Mutex
+	ticker      *time.Ticker
+	interval    time.Duration
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func New(store storage.Store, cm *cluster.ClusterManager, interval time.Duration) *Catalog {
+	return &Catalog{
+		store:    store,
+		cluster:  cm,
+		client:   cm.NewClient(10 * time.Second),
+		peers:    make(map[string]*peer),
+		interval: interval,
+	}
+}
+
+// Changes returns this node's catalog changes after journal sequence since. Pullers that
+// are new, or ahead of a journal that was reset, get the whole catalog instead.
+func (c *Catalog) Changes(since uint64, limit int) (*Delta, error) {
+	delta := &Delta{NodeID: c.cluster.GetCurrentNode().ID, Entries: make([]Entry, 0)}
+
+	j := c.store.Journal()
+	if j == nil || since == 0 || since > j.LastSeq() {
+		// Read the sequence first: a write racing the listing is then sent again next
+		// time, which is harmless
+		if j != nil {
+			delta.LastSeq = j.LastSeq()
+		}
+		delta.Full = true
+		for _, obj := range c.store.List() {
+			delta.Entries = append(delta.Entries, entryFor(obj))
+		}
+		return delta, nil
+	}
+
+	records, err := j.ReadSince(since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %v", err)
+	}
+	delta.LastSeq = since
+	for _, rec := range records {
+		delta.LastSeq = rec.Seq
+		if rec.Op == journal.OpDelete {
+			delta.Entries = append(delta.Entries, Entry{Key: rec.Key, ObjectID: rec.ObjectID, Deleted: true})
+		} else if rec.Object != nil {
+			delta.Entries = append(delta.Entries, entryFor(rec.Object))
+		}
+	}
+	delta.More = limit > 0 && len(records) == limit
+	return delta, nil
+}
+
+// Sync pulls changes from every healthy peer once
+func (c *Catalog) Sync() {
+	self := c.cluster.GetCurrentNode().ID
+	for _, node := range c.cluster.GetHealthyNodes() {
+		if node.ID == self {
+			continue
+		}
+		if err := c.pull(node); err != nil {
+			log.Printf("Catalog sync with %s failed: %v", node.ID, err)
+		}
+	}
+}
+
+func (c *Catalog) pull(node *cluster.Node) error {
+	c.mutex.RLock()
+	var since uint64
+	if p, exists := c.peers[node.ID]; exists {
+		since = p.seq
+	}
+	c.mutex.RUnlock()
+
+	for {
+		query := url.Values{}
+		query.Set("since_seq", strconv.FormatUint(since, 10))
+		query.Set("limit", strconv.Itoa(pageSize))
+
+		resp, err := c.client.Get(fmt.Sprintf("http://%s/internal/catalog?%s", node.Address, query.Encode()))
+		if err != nil {
+			return err
+		}
+		var delta Delta
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("peer returned status %d", resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&delta)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode catalog delta: %v", err)
+		}
+
+		c.apply(node.ID, &delta)
+		if !delta.More {
+			return nil
+		}
+		since = delta.LastSeq
+	}
+}
+
+func (c *Catalog) apply(nodeID string, delta *Delta) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	p, exists := c.peers[nodeID]
+	if !exists || delta.Full {
+		p = &peer{entries: make(map[string]Entry)}
+		c.peers[nodeID] = p
+	}
+	for _, entry := range delta.Entries {
+		if entry.Deleted {
+			if current, ok := p.entries[entry.Key]; ok && current.ObjectID == entry.ObjectID {
+				delete(p.entries, entry.Key)
+			}
+			continue
+		}
+		p.entries[entry.Key] = entry
+	}
+	p.seq = delta.LastSeq
+}
+
+// Entries returns the merged catalog: for each key the newest version any healthy node
+// has, with every node that holds the same bytes
+func (c *Catalog) Entries() map[string]Entry {
+	self := c.cluster.GetCurrentNode().ID
+	merged := make(map[string]Entry)
+
+	for _, obj := range c.store.List() {
+		merge(merged, entryFor(obj), self)
+	}
+
+	c.mutex.RLock()
+	for _, node := range c.cluster.GetHealthyNodes() {
+		p, exists := c.peers[node.ID]
+		if !exists || node.ID == self {
+			continue
+		}
+		for _, entry := range p.entries {
+			merge(merged, entry, node.ID)
+		}
+	}
+	c.mutex.RUnlock()
+
+	for key, entry := range merged {
+		sort.Strings(entry.Nodes)
+		merged[key] = entry
+	}
+	return merged
+}
+
+// Lookup returns the merged entry for key
+func (c *Catalog) Lookup(key string) (Entry, bool) {
+	entry, exists := c.Entries()[key]
+	return entry, exists
+}
+
+func merge(merged map[string]Entry, entry Entry, node string) {
+	current, exists := merged[entry.Key]
+	switch {
+	case !exists:
+		entry.Nodes = []string{node}
+	case entry.Checksum == current.Checksum && entry.ChecksumAlgorithm == current.ChecksumAlgorithm:
+		// Same bytes, so either node can serve them; keep the newer metadata
+		nodes := append(current.Nodes, node)
+		if !newer(entry, current) {
+			entry = current
+		}
+		entry.Nodes = nodes
+	case newer(entry, current):
+		entry.Nodes = []string{node}
+	default:
+		return
+	}
+	merged[entry.Key] = entry
+}
+
+// Start syncs once straight away and then on every interval
+func (c *Catalog) Start(ctx context.Context) error {
+	c.tickerMutex.Lock()
+	c.ticker = time.NewTicker(c.interval)
+	c.tickerMutex.Unlock()
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		c.Sync()
+		for {
+			select {
+			case <-c.ticker.C:
+				c.Sync()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// SetSyncInterval changes how often peers are pulled from
+func (c *Catalog) SetSyncInterval(interval time.Duration) {
+	c.tickerMutex.Lock()
+	defer c.tickerMutex.Unlock()
+
+	c.interval = interval
+	if c.ticker != nil {
+		c.ticker.Reset(interval)
+	}
+}
+
+func (c *Catalog) Stop(ctx context.Context) error {
+	if c.ticker == nil {
+		return nil
+	}
+	c.ticker.Stop()
+	close(c.stop)
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TokenHeader carries the cluster secret on every request one node makes to another
+const TokenHeader = "X-Cluster-Token"
+
+// clusterAuth is the secret nodes prove they belong to the cluster with, see
+// SetClusterSecret
+type clusterAuth struct {
+	tokens   atomic.Value // []string, the first one sent
+	rejected atomic.Int64
+}
+
+// SetClusterSecret has the node-to-node endpoints only take requests carrying one of the
+// comma-separated tokens in secret, and has this node send the first one. Rotating it is
+// putting the new token first everywhere, then dropping the old one once every node
+// sends the new. An empty secret leaves the endpoints open.
+func (cm *ClusterManager) SetClusterSecret(secret string) {
+	var tokens []string
+	for _, token := range strings.Split(secret, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	cm.auth.tokens.Store(tokens)
+}
+
+func (cm *ClusterManager) clusterTokens() []string {
+	tokens, _ := cm.auth.tokens.Load().([]string)
+	return tokens
+}
+
+// Authenticate reports whether r carries one of the cluster's tokens, or there are none.
+// Requests that don't are counted, see ClusterStats.RejectedRequests.
+func (cm *ClusterManager) Authenticate(r *http.Request) bool {
+	tokens := cm.clusterTokens()
+	if len(tokens) == 0 {
+		return true
+	}
+	presented := []byte(r.Header.Get(TokenHeader))
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			return true
+		}
+	}
+	cm.auth.rejected.Add(1)
+	log.Printf("Rejected %s %s from %s: missing or wrong cluster token", r.Method, r.URL.Path, r.RemoteAddr)
+	return false
+}
+
+// RequireToken answers requests that Authenticate turns down with 401
+func (cm *ClusterManager) RequireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cm.Authenticate(r) {
+			http.Error(w, "Cluster token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// NewClient returns a client for requests to other nodes, which sends the cluster token
+// with each. A timeout of 0 is none.
+func (cm *ClusterManager) NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: &tokenTransport{cm: cm, base: http.DefaultTransport}}
+}
+
+// tokenTransport adds the cluster token to the requests sent through it
+type tokenTransport struct {
+	cm   *ClusterManager
+	base http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tokens := t.cm.clusterTokens(); len(tokens) > 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set(TokenHeader, tokens[0])
+	}
+	return t.base.RoundTrip(req)
+}
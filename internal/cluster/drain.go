@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Drain states a node advertises in Node.Drain. A draining node is up and serving reads,
+// but isn't picked for new writes or copies while it hands its objects over to the others;
+// once it has, it is drained and can be shut down. It stays drained across restarts until
+// told otherwise.
+const (
+	DrainDraining = "draining"
+	DrainDrained  = "drained"
+)
+
+const drainStateFile = "drain_state"
+
+// RestoreDrain has this node keep its drain state in dir from now on, and advertise the one
+// kept there already, which it returns. Call it before joining the cluster.
+func (cm *ClusterManager) RestoreDrain(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, drainStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read drain state: %v", err)
+	}
+	state := strings.TrimSpace(string(data))
+	if state != "" && state != DrainDraining && state != DrainDrained {
+		return "", fmt.Errorf("unknown drain state %q in %s", state, drainStateFile)
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.drainDir = dir
+	cm.currentNode.Drain = state
+	return state, nil
+}
+
+// SetDrain changes the drain state this node advertises, "" for taking writes again, and
+// tells the others straight away rather than at the next heartbeat
+func (cm *ClusterManager) SetDrain(state string) error {
+	cm.mutex.Lock()
+	if cm.drainDir != "" {
+		path := filepath.Join(cm.drainDir, drainStateFile)
+		var err error
+		if state == "" {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.WriteFile(path, []byte(state+"\n"), 0644)
+		}
+		if err != nil {
+			cm.mutex.Unlock()
+			return fmt.Errorf("failed to persist drain state: %v", err)
+		}
+	}
+	changed := cm.currentNode.Drain != state
+	cm.currentNode.Drain = state
+	cm.currentNode.LastSeen = time.Now()
+	cm.mutex.Unlock()
+
+	if changed {
+		log.Printf("Drain state of this node now %q", state)
+		go cm.sendHeartbeats()
+	}
+	return nil
+}
+
+// Draining returns this node's drain state, empty while it takes writes
+func (cm *ClusterManager) Draining() string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.currentNode.Drain
+}
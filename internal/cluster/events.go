@@ -0,0 +1,348 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of Event
+const (
+	EventRegistered    = "registered"
+	EventStatusChanged = "status_changed"
+	EventDead          = "dead"
+	EventRemoved       = "removed"
+	EventLeft          = "left"
+)
+
+// Defaults for the event log, see SetEventLog
+const (
+	DefaultEventLogSize     = 1000
+	DefaultEventLogMaxBytes = 10 << 20
+	DefaultEventLogFiles    = 3
+)
+
+// Event is something that happened to the cluster's membership, as this node saw it
+type Event struct {
+	Seq    uint64    `json:"seq"` // counts up from 1 on each node, across restarts while its log is kept
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	NodeID string    `json:"node_id"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// eventLog keeps the latest events in memory, appends them all to a file, and passes them
+// on to whoever is watching
+type eventLog struct {
+	mutex       sync.Mutex
+	seq         uint64
+	ring        []Event // oldest first
+	size        int
+	path        string
+	file        *os.File
+	written     int64
+	maxBytes    int64
+	keep        int
+	subscribers map[chan Event]struct{}
+}
+
+// SetEventLog keeps the latest size events in memory and appends every event to the file
+// at path, which is rotated once it grows past maxBytes with keep older files kept
+// (path.1 the newest). The events already in the file are loaded when it is first opened,
+// so the history outlives restarts. An empty path keeps events in memory only.
+func (cm *ClusterManager) SetEventLog(path string, size int, maxBytes int64, keep int) error {
+	events := &cm.events
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	events.size, events.maxBytes, events.keep = max(size, 1), maxBytes, keep
+	events.trim()
+	if path == events.path {
+		return nil
+	}
+	if events.file != nil {
+		events.file.Close()
+		events.file = nil
+	}
+	events.path = path
+	if path == "" {
+		return nil
+	}
+	if len(events.ring) == 0 {
+		if err := events.load(); err != nil {
+			log.Printf("Failed to load the cluster event log: %v", err)
+		}
+	}
+	return events.open()
+}
+
+// load fills the ring from the file, for its history before a restart
+func (l *eventLog) load() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue // a line cut short by a crash
+		}
+		l.ring = append(l.ring, event)
+		l.seq = max(l.seq, event.Seq)
+		l.trim()
+	}
+	return scanner.Err()
+}
+
+func (l *eventLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open cluster event log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open cluster event log: %v", err)
+	}
+	l.file, l.written = file, info.Size()
+	return nil
+}
+
+// rotate moves the file to path.1, the one there to path.2 and so on, dropping the oldest
+func (l *eventLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if l.keep < 1 {
+		os.Remove(l.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+		for i := l.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// trim drops the oldest events past the ring's size. The caller holds the mutex.
+func (l *eventLog) trim() {
+	if extra := len(l.ring) - l.size; extra > 0 {
+		l.ring = append([]Event(nil), l.ring[extra:]...)
+	}
+}
+
+// record numbers event, keeps it and hands it to the watchers. Watchers too slow to keep
+// up are dropped rather than waited for.
+func (l *eventLog) record(event Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.seq++
+	event.Seq = l.seq
+	l.ring = append(l.ring, event)
+	l.trim()
+
+	if l.file != nil {
+		line, _ := json.Marshal(event)
+		line = append(line, '\n')
+		if l.maxBytes > 0 && l.written > 0 && l.written+int64(len(line)) > l.maxBytes {
+			if err := l.rotate(); err != nil {
+				log.Printf("Failed to rotate the cluster event log: %v", err)
+			}
+		}
+		if l.file != nil {
+			n, err := l.file.Write(line)
+			l.written += int64(n)
+			if err != nil {
+				log.Printf("Failed to write the cluster event log: %v", err)
+			}
+		}
+	}
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// recordChanges logs a status change each
+func (cm *ClusterManager) recordChanges(changes []statusChange) {
+	for _, change := range changes {
+		kind := EventStatusChanged
+		switch change.new {
+		case StatusDead:
+			kind = EventDead
+		case StatusRemoved:
+			kind = EventRemoved
+		case StatusLeft:
+			kind = EventLeft
+		}
+		cm.events.record(Event{
+			Time:   time.Now(),
+			Type:   kind,
+			NodeID: change.node.ID,
+			Old:    change.old,
+			New:    change.new,
+			Reason: change.reason,
+		})
+	}
+}
+
+// Events returns up to limit of the events kept in memory that happened after since,
+// oldest first. A limit of 0 is all of them.
+func (cm *ClusterManager) Events(since time.Time, limit int) []Event {
+	cm.events.mutex.Lock()
+	defer cm.events.mutex.Unlock()
+
+	events := make([]Event, 0)
+	for _, event := range cm.events.ring {
+		if !event.Time.After(since) {
+			continue
+		}
+		events = append(events, event)
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+	return events
+}
+
+// WatchEvents returns a channel of the events from now on, closed if its reader falls more
+// than buffer events behind, and a function to stop watching
+func (cm *ClusterManager) WatchEvents(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	cm.events.mutex.Lock()
+	if cm.events.subscribers == nil {
+		cm.events.subscribers = make(map[chan Event]struct{})
+	}
+	cm.events.subscribers[ch] = struct{}{}
+	cm.events.mutex.Unlock()
+
+	return ch, func() {
+		cm.events.mutex.Lock()
+		defer cm.events.mutex.Unlock()
+		if _, watching := cm.events.subscribers[ch]; watching {
+			delete(cm.events.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventsAfter returns the events kept in memory numbered after seq
+func (cm *ClusterManager) eventsAfter(seq uint64) []Event {
+	cm.events.mutex.Lock()
+	defer cm.events.mutex.Unlock()
+
+	var events []Event
+	for _, event := range cm.events.ring {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// HandleEvents answers with the events kept in memory, after ?since= (RFC 3339) and up to
+// ?limit= of them
+func (cm *ClusterManager) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm.Events(since, limit))
+}
+
+// eventKeepAlive is how often a watch with nothing to send sends a comment, so proxies
+// don't take it for dead
+const eventKeepAlive = 15 * time.Second
+
+// HandleWatchEvents streams events as they happen, as Server-Sent Events. A client that
+// reconnects with Last-Event-ID first gets the ones it missed that are still in memory.
+func (cm *ClusterManager) HandleWatchEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	ch, stop := cm.WatchEvents(64)
+	defer stop()
+
+	var last uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		last, _ = strconv.ParseUint(value, 10, 64)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event Event) bool {
+		if event.Seq <= last {
+			return true // replayed already
+		}
+		last = event.Seq
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if last > 0 {
+		for _, event := range cm.eventsAfter(last) {
+			if !send(event) {
+				return
+			}
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok || !send(event) {
+				return // fell behind; it can reconnect with Last-Event-ID
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
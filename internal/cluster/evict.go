@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// StatusDead is the status of a node that has been unhealthy for so long it is taken for
+// gone: its copies are re-made elsewhere, and it has to register again to come back, as a
+// node holding nothing. Once it has been gone for longer still it is forgotten altogether.
+const StatusDead = "dead"
+
+// StatusRemoved is never a node's status, only what OnNodeStatusChange listeners are told a
+// dead node's becomes when it is dropped from the node table
+const StatusRemoved = "removed"
+
+// Nodes not heard from for defaultDeadAfter are dead, and for defaultRemoveAfter removed
+const (
+	defaultDeadAfter   = 30 * time.Minute
+	defaultRemoveAfter = 24 * time.Hour
+)
+
+// eviction is when unhealthy nodes are given up on, see SetEviction
+type eviction struct {
+	mutex       sync.Mutex
+	deadAfter   time.Duration
+	removeAfter time.Duration
+}
+
+// SetEviction has nodes not heard from for deadAfter taken for dead, and ones not heard
+// from for removeAfter dropped from the node table. Health checks pick it up from the next.
+func (cm *ClusterManager) SetEviction(deadAfter, removeAfter time.Duration) {
+	cm.eviction.mutex.Lock()
+	defer cm.eviction.mutex.Unlock()
+	cm.eviction.deadAfter, cm.eviction.removeAfter = deadAfter, removeAfter
+}
+
+// SetClock has the health checks tell the time with now instead of the system clock, for
+// tests
+func (cm *ClusterManager) SetClock(now func() time.Time) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.now = now
+}
+
+// evict moves node on to dead, or out of the table, once it has been silent long enough.
+// It returns true for nodes there's nothing more to check about: those it moved on, and
+// dead and left ones waiting to be removed. The caller holds cm.mutex.
+func (cm *ClusterManager) evict(node *Node, now time.Time, changes *[]statusChange) bool {
+	cm.eviction.mutex.Lock()
+	deadAfter, removeAfter := cm.eviction.deadAfter, cm.eviction.removeAfter
+	cm.eviction.mutex.Unlock()
+
+	silent := now.Sub(node.LastSeen)
+	switch {
+	case silent > removeAfter:
+		delete(cm.nodes, node.ID)
+		delete(cm.heartbeats.received, node.ID)
+		delete(cm.probes, node.ID)
+		reason := fmt.Sprintf("silent for %v", silent.Round(time.Second))
+		*changes = append(*changes, statusChange{*node, node.Status, StatusRemoved, reason})
+		log.Printf("Node removed, %s: %s", reason, node.ID)
+		return true
+	case node.Status == StatusDead, node.Status == StatusLeft:
+		return true
+	case silent > deadAfter:
+		reason := fmt.Sprintf("silent for %v", silent.Round(time.Second))
+		*changes = append(*changes, statusChange{*node, node.Status, StatusDead, reason})
+		node.Status = StatusDead
+		delete(cm.heartbeats.received, node.ID)
+		delete(cm.probes, node.ID)
+		log.Printf("Node dead, %s: %s", reason, node.ID)
+		return true
+	}
+	return false
+}
+
+// rejoined tells the OnNodeStatusChange listeners this node has found out the others took
+// it for dead, so it can catch up on what it missed
+func (cm *ClusterManager) rejoined() {
+	cm.mutex.RLock()
+	self := *cm.currentNode
+	cm.mutex.RUnlock()
+	log.Printf("This node had been taken for dead, rejoining as an empty one")
+	cm.notify([]statusChange{{self, StatusDead, self.Status, "rejoined after being taken for dead"}})
+}
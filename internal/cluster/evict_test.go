@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when it's told to
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// transitions records the status changes OnNodeStatusChange reports, as "old>new"
+type transitions struct {
+	mutex sync.Mutex
+	seen  map[string][]string // by node ID
+}
+
+func watch(cm *ClusterManager) *transitions {
+	tr := &transitions{seen: make(map[string][]string)}
+	cm.OnNodeStatusChange(func(node *Node, old, new string) {
+		tr.mutex.Lock()
+		defer tr.mutex.Unlock()
+		tr.seen[node.ID] = append(tr.seen[node.ID], old+">"+new)
+	})
+	return tr
+}
+
+func (tr *transitions) of(nodeID string) []string {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return append([]string(nil), tr.seen[nodeID]...)
+}
+
+func TestEvictionStateMachine(t *testing.T) {
+	p := newPeer(t)
+	p.up.Store(false)
+	clock := &fakeClock{now: time.Now()}
+	cm := NewClusterManager("node-1", "127.0.0.1:1")
+	cm.SetClock(clock.Now)
+	cm.SetHealthCheck(time.Second, 2*time.Minute, 3, 1)
+	cm.SetEviction(10*time.Minute, time.Hour)
+	changes := watch(cm)
+	if err := cm.RegisterNode(&Node{ID: "node-2", Address: p.address(), Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		after time.Duration
+		want  string
+	}{
+		{time.Minute, "healthy"}, // within the staleness window, and one failed ping isn't enough
+		{2 * time.Minute, "unhealthy"},
+		{5 * time.Minute, "unhealthy"},
+		{3 * time.Minute, StatusDead},
+		{30 * time.Minute, StatusDead},
+	}
+	for _, step := range steps {
+		clock.Advance(step.after)
+		cm.performHealthCheck()
+		node, exists := cm.GetNode("node-2")
+		if !exists || node.Status != step.want {
+			t.Fatalf("%v after it was last seen node-2 is %+v, want %s", clock.Now().Sub(node.LastSeen), node, step.want)
+		}
+	}
+	if targets := cm.SelectNodesForReplication(3, 1); len(targets) != 0 {
+		t.Errorf("selected %v for replicas with node-2 dead, want none", ids(targets))
+	}
+	if stats := cm.GetClusterStats(); stats.DeadNodes != 1 || stats.Quorum.Members != 1 {
+		t.Errorf("stats count %d dead nodes and %d quorum members, want 1 and just this node", stats.DeadNodes, stats.Quorum.Members)
+	}
+
+	clock.Advance(30 * time.Minute)
+	cm.performHealthCheck()
+	if _, exists := cm.GetNode("node-2"); exists {
+		t.Error("node-2 is still in the table an hour after it went silent")
+	}
+	want := []string{"healthy>unhealthy", "unhealthy>" + StatusDead, StatusDead + ">" + StatusRemoved}
+	if got := changes.of("node-2"); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("node-2 went %v, want %v", got, want)
+	}
+}
+
+func TestDeadNodeReregisters(t *testing.T) {
+	p := newPeer(t)
+	clock := &fakeClock{now: time.Now()}
+	cm := NewClusterManager("node-1", "127.0.0.1:1")
+	cm.SetClock(clock.Now)
+	cm.SetHealthCheck(time.Second, time.Minute, 1, 1)
+	cm.SetEviction(10*time.Minute, time.Hour)
+	changes := watch(cm)
+	node := Node{ID: "node-2", Address: p.address(), Status: "healthy"}
+	registered := node
+	if err := cm.RegisterNode(&registered); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Minute)
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != StatusDead {
+		t.Fatalf("node-2 is %s, want dead", s)
+	}
+
+	// A dead node's heartbeats aren't taken; it has to register again
+	if err := cm.recordHeartbeat(&Heartbeat{NodeID: "node-2"}); !errors.Is(err, errNotRegistered) {
+		t.Errorf("heartbeat from a dead node = %v, want errNotRegistered", err)
+	}
+	body, _ := json.Marshal(node)
+	w := httptest.NewRecorder()
+	cm.HandleNodeRegistration(w, httptest.NewRequest(http.MethodPost, "/cluster/register", bytes.NewReader(body)))
+	var answer struct {
+		WasDead bool `json:"was_dead"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&answer); err != nil || !answer.WasDead {
+		t.Errorf("registration answered %d (%v), want was_dead so the node catches up", w.Code, err)
+	}
+
+	// Registered again, it is seen now and isn't taken straight back for dead
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != "healthy" {
+		t.Errorf("after registering again node-2 is %s, want healthy", s)
+	}
+	if got := changes.of("node-2"); len(got) != 2 || got[1] != StatusDead+">healthy" {
+		t.Errorf("node-2 went %v, want back to healthy from dead", got)
+	}
+}
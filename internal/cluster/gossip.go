@@ -0,0 +1,223 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Nodes swap their node tables with a few others every round, so one registration with a
+// seed is enough for the whole cluster to learn about a node
+const (
+	defaultGossipInterval = 10 * time.Second
+	defaultGossipFanout   = 3
+)
+
+// gossip is the state of the periodic node table exchanges, see SetGossip
+type gossip struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	fanout   int
+	ticker   *time.Ticker
+	stop     chan struct{}
+	done     chan struct{}
+	client   *http.Client
+}
+
+// GossipMessage is a node table as one node sends it to another, and gets the other's back
+type GossipMessage struct {
+	From  string  `json:"from"`
+	Nodes []*Node `json:"nodes"`
+}
+
+// SetGossip has this node swap node tables with fanout random others every interval. A
+// running loop picks up the interval from its next tick.
+func (cm *ClusterManager) SetGossip(interval time.Duration, fanout int) {
+	cm.gossip.mutex.Lock()
+	defer cm.gossip.mutex.Unlock()
+
+	cm.gossip.interval = interval
+	cm.gossip.fanout = fanout
+	if cm.gossip.ticker != nil {
+		cm.gossip.ticker.Reset(interval)
+	}
+}
+
+// startGossip begins the gossip rounds, see Start
+func (cm *ClusterManager) startGossip() {
+	cm.gossip.mutex.Lock()
+	ticker := time.NewTicker(cm.gossip.interval)
+	cm.gossip.ticker = ticker
+	cm.gossip.mutex.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	cm.gossip.stop, cm.gossip.done = stop, done
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				cm.gossipRound()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopGossip ends the gossip rounds, returning a channel closed once one in progress is done
+func (cm *ClusterManager) stopGossip() <-chan struct{} {
+	cm.gossip.ticker.Stop()
+	close(cm.gossip.stop)
+	return cm.gossip.done
+}
+
+// gossipRound swaps node tables with up to fanout other nodes picked at random
+func (cm *ClusterManager) gossipRound() {
+	if cm.leaving() {
+		return
+	}
+	cm.gossip.mutex.Lock()
+	fanout := cm.gossip.fanout
+	cm.gossip.mutex.Unlock()
+
+	for _, node := range cm.gossipTargets(fanout) {
+		if err := cm.gossipWith(node.Address); err != nil {
+			log.Printf("Gossip with node %s failed: %v", node.ID, err)
+		}
+	}
+}
+
+// gossipTargets picks up to count other nodes at random, healthy or not, so nodes that
+// are back are found out about. Nodes that have left or died aren't, they come back by
+// registering.
+func (cm *ClusterManager) gossipTargets(count int) []*Node {
+	cm.mutex.RLock()
+	var others []*Node
+	for _, node := range cm.nodes {
+		if node.ID != cm.currentNode.ID && node.Status != StatusLeft && node.Status != StatusDead {
+			others = append(others, node)
+		}
+	}
+	cm.mutex.RUnlock()
+
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if len(others) > count {
+		others = others[:count]
+	}
+	return others
+}
+
+// gossipWith sends this node's table to the node at address and merges the one it answers
+// with
+func (cm *ClusterManager) gossipWith(address string) error {
+	body, err := json.Marshal(cm.gossipMessage())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(cm.requestContext(), http.MethodPost, fmt.Sprintf("http://%s/internal/gossip", address), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cm.gossip.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gossip rejected with status %d", resp.StatusCode)
+	}
+	var reply GossipMessage
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("invalid gossip reply: %v", err)
+	}
+	cm.mergeNodes(reply.Nodes)
+	return nil
+}
+
+// gossipMessage is this node's table as it is now, its own entry just seen
+func (cm *ClusterManager) gossipMessage() *GossipMessage {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	cm.currentNode.LastSeen = time.Now()
+	message := &GossipMessage{From: cm.currentNode.ID, Nodes: make([]*Node, 0, len(cm.nodes))}
+	for _, node := range cm.nodes {
+		copied := *node
+		message.Nodes = append(message.Nodes, &copied)
+	}
+	return message
+}
+
+// mergeNodes takes the entries of another node's table that are fresher, by LastSeen, than
+// the ones here, and the nodes not known here at all. This node's own entry is never
+// taken from elsewhere, and nodes dead here only come back by registering with it.
+func (cm *ClusterManager) mergeNodes(nodes []*Node) {
+	cm.mutex.Lock()
+	var changes []statusChange
+	for _, node := range nodes {
+		if node == nil || node.ID == "" || node.ID == cm.currentNode.ID {
+			continue
+		}
+		current, exists := cm.nodes[node.ID]
+		if !exists && node.Status == StatusDead {
+			continue
+		}
+		if !exists {
+			copied := *node
+			cm.nodes[node.ID] = &copied
+			log.Printf("Node learned through gossip: %s (%s)", node.ID, node.Address)
+			continue
+		}
+		if !node.LastSeen.After(current.LastSeen) || current.Status == StatusDead && node.Status != StatusDead {
+			continue
+		}
+		if current.Status != node.Status {
+			changes = append(changes, statusChange{*node, current.Status, node.Status, "gossip"})
+		}
+		*current = *node
+	}
+	cm.mutex.Unlock()
+
+	cm.notify(changes)
+}
+
+// HandleGossip merges the node table another node sends and answers with this node's. The
+// sender has to be a known node or, when it has only just joined, list itself at the
+// address the request comes from.
+func (cm *ClusterManager) HandleGossip(w http.ResponseWriter, r *http.Request) {
+	var message GossipMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, "Invalid gossip message", http.StatusBadRequest)
+		return
+	}
+	if !cm.IsPeer(message.From, r.RemoteAddr) && !cm.introduces(&message, r.RemoteAddr) {
+		http.Error(w, "Gossip is only accepted from other cluster nodes", http.StatusForbidden)
+		return
+	}
+
+	cm.mergeNodes(message.Nodes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm.gossipMessage())
+}
+
+// introduces reports whether message lists its sender at an address remoteAddr is from
+func (cm *ClusterManager) introduces(message *GossipMessage, remoteAddr string) bool {
+	if message.From == cm.GetCurrentNode().ID {
+		return false
+	}
+	for _, node := range message.Nodes {
+		if node != nil && node.ID == message.From {
+			return addressMatches(node.Address, remoteAddr)
+		}
+	}
+	return false
+}
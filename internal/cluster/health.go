@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for the health checks, see SetHealthCheck. A node is only taken for unhealthy
+// after a few failed pings in a row, which at the default interval takes longer than the
+// old one-minute cutoff, so nodes are only stale after two.
+const (
+	defaultPingTimeout      = 5 * time.Second
+	defaultStaleAfter       = 2 * time.Minute
+	defaultFailureThreshold = 3
+	defaultSuccessThreshold = 2
+)
+
+// healthPolicy is how other nodes are checked on, under healthMutex
+type healthPolicy struct {
+	timeout    time.Duration
+	staleAfter time.Duration
+	failures   int
+	successes  int
+}
+
+// probes is the run of ping results a node is on: only one of the two is ever non-zero
+type probes struct {
+	failures  int
+	successes int
+}
+
+// SetHealthCheck has pings time out after timeout, nodes not heard from for staleAfter
+// taken for unhealthy without one, and otherwise failures failed pings in a row needed to
+// take a node for unhealthy and successes good ones to take it back. Checks pick it up
+// from the next.
+func (cm *ClusterManager) SetHealthCheck(timeout, staleAfter time.Duration, failures, successes int) {
+	cm.healthMutex.Lock()
+	defer cm.healthMutex.Unlock()
+	cm.health = healthPolicy{timeout: timeout, staleAfter: staleAfter, failures: max(failures, 1), successes: max(successes, 1)}
+}
+
+func (cm *ClusterManager) healthPolicy() healthPolicy {
+	cm.healthMutex.Lock()
+	defer cm.healthMutex.Unlock()
+	return cm.health
+}
+
+func (cm *ClusterManager) performHealthCheck() {
+	cm.notify(cm.checkNodes())
+}
+
+// checkNodes updates every other node's status, returning the ones that changed. Nodes
+// silent for long enough are taken for dead, then removed, see SetEviction. The nodes that
+// need pinging are pinged all at once, without holding the lock.
+func (cm *ClusterManager) checkNodes() []statusChange {
+	ctx := cm.requestContext()
+	policy := cm.healthPolicy()
+
+	cm.mutex.Lock()
+	now := cm.now()
+	var changes []statusChange
+	var toPing []Node
+	for nodeID, node := range cm.nodes {
+		if nodeID == cm.currentNode.ID {
+			continue // Skip self
+		}
+		if cm.evict(node, now, &changes) {
+			continue // Dead or left, until it registers again or is removed
+		}
+
+		// Check if node is stale
+		if silent := now.Sub(node.LastSeen); silent > policy.staleAfter {
+			cm.setStatus(node, "unhealthy", fmt.Sprintf("silent for %v", silent.Round(time.Second)), &changes)
+			log.Printf("Node marked unhealthy: %s", nodeID)
+			continue
+		}
+
+		// Nodes that keep sending heartbeats needn't be asked
+		if cm.reportedRecently(nodeID, now) {
+			cm.setStatus(node, "healthy", "heartbeat", &changes)
+			delete(cm.probes, nodeID)
+			continue
+		}
+		toPing = append(toPing, *node)
+	}
+	cm.mutex.Unlock()
+
+	alive := cm.pingNodes(ctx, toPing, policy.timeout)
+	if ctx.Err() != nil {
+		return changes // Stopping, which says nothing about the nodes pinged
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	for _, pinged := range toPing {
+		node, exists := cm.nodes[pinged.ID]
+		if !exists || node.Status != pinged.Status {
+			continue // Changed meanwhile, by a heartbeat, gossip or registration
+		}
+		run := cm.probes[node.ID]
+		if run == nil {
+			run = &probes{}
+			cm.probes[node.ID] = run
+		}
+		if alive[node.ID] {
+			node.LastSeen = now
+			run.failures = 0
+			run.successes++
+			if node.Status != "healthy" && run.successes >= policy.successes {
+				reason := fmt.Sprintf("%d good pings", run.successes)
+				cm.setStatus(node, "healthy", reason, &changes)
+				log.Printf("Node healthy again after %s: %s", reason, node.ID)
+			}
+		} else {
+			run.successes = 0
+			run.failures++
+			if node.Status != "unhealthy" && run.failures >= policy.failures {
+				reason := fmt.Sprintf("%d failed pings", run.failures)
+				cm.setStatus(node, "unhealthy", reason, &changes)
+				log.Printf("Node marked unhealthy after %s: %s", reason, node.ID)
+			}
+		}
+	}
+	return changes
+}
+
+// setStatus sets node's status, noting the change and why in changes if it is one. The
+// caller holds cm.mutex.
+func (cm *ClusterManager) setStatus(node *Node, status, reason string, changes *[]statusChange) {
+	old := node.Status
+	node.Status = status
+	if old != status {
+		*changes = append(*changes, statusChange{*node, old, status, reason})
+	}
+}
+
+// pingNodes pings nodes all at once, returning which answered by ID
+func (cm *ClusterManager) pingNodes(ctx context.Context, nodes []Node, timeout time.Duration) map[string]bool {
+	client := cm.NewClient(timeout)
+	var mutex sync.Mutex
+	alive := make(map[string]bool, len(nodes))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node Node) {
+			defer wg.Done()
+			ok := cm.pingNode(ctx, client, &node)
+			mutex.Lock()
+			alive[node.ID] = ok
+			mutex.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	return alive
+}
+
+func (cm *ClusterManager) pingNode(ctx context.Context, client *http.Client, node *Node) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/health", node.Address), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
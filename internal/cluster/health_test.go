@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// peer is another node's /health, answering 200 while up and 503 otherwise, after delay
+type peer struct {
+	server *httptest.Server
+	up     atomic.Bool
+	delay  atomic.Int64 // nanoseconds
+	pings  atomic.Int32
+}
+
+func newPeer(t *testing.T) *peer {
+	t.Helper()
+	p := &peer{}
+	p.up.Store(true)
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.pings.Add(1)
+		select {
+		case <-time.After(time.Duration(p.delay.Load())):
+		case <-r.Context().Done():
+			return
+		}
+		if !p.up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "healthy"}`))
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *peer) address() string {
+	return strings.TrimPrefix(p.server.URL, "http://")
+}
+
+func status(t *testing.T, cm *ClusterManager, nodeID string) string {
+	t.Helper()
+	node, exists := cm.GetNode(nodeID)
+	if !exists {
+		t.Fatalf("%s isn't in the table", nodeID)
+	}
+	return node.Status
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	p := newPeer(t)
+	cm := newTestCluster(t, &Node{ID: "node-2", Address: p.address()})
+	cm.SetHealthCheck(time.Second, time.Hour, 3, 2)
+
+	// One dropped ping, or two, isn't enough
+	p.up.Store(false)
+	for i := 1; i <= 2; i++ {
+		cm.performHealthCheck()
+		if s := status(t, cm, "node-2"); s != "healthy" {
+			t.Fatalf("after %d failed pings node-2 is %s, want still healthy", i, s)
+		}
+	}
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != "unhealthy" {
+		t.Fatalf("after 3 failed pings node-2 is %s, want unhealthy", s)
+	}
+
+	// Nor is one good ping enough to take it back
+	p.up.Store(true)
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != "unhealthy" {
+		t.Fatalf("after 1 good ping node-2 is %s, want still unhealthy", s)
+	}
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != "healthy" {
+		t.Fatalf("after 2 good pings node-2 is %s, want healthy", s)
+	}
+}
+
+func TestHealthCheckIntermittentFailures(t *testing.T) {
+	p := newPeer(t)
+	cm := newTestCluster(t, &Node{ID: "node-2", Address: p.address()})
+	cm.SetHealthCheck(time.Second, time.Hour, 2, 2)
+
+	var changes atomic.Int32
+	cm.OnNodeStatusChange(func(node *Node, old, new string) { changes.Add(1) })
+
+	// Every other ping dropped never makes a run long enough to flip it
+	for i := 0; i < 10; i++ {
+		p.up.Store(i%2 == 0)
+		cm.performHealthCheck()
+	}
+	if n := changes.Load(); n != 0 || status(t, cm, "node-2") != "healthy" {
+		t.Errorf("node-2 is %s after %d status changes, want healthy after none", status(t, cm, "node-2"), n)
+	}
+	if n := p.pings.Load(); n != 10 {
+		t.Errorf("node-2 was pinged %d times, want 10", n)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	p := newPeer(t)
+	p.delay.Store(int64(time.Second))
+	cm := newTestCluster(t, &Node{ID: "node-2", Address: p.address()})
+	cm.SetHealthCheck(20*time.Millisecond, time.Hour, 1, 1)
+
+	started := time.Now()
+	cm.performHealthCheck()
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("the check took %v, want it cut off by the timeout", elapsed)
+	}
+	if s := status(t, cm, "node-2"); s != "unhealthy" {
+		t.Errorf("a node that doesn't answer in time is %s, want unhealthy", s)
+	}
+}
+
+func TestHealthCheckStale(t *testing.T) {
+	p := newPeer(t)
+	cm := newTestCluster(t, &Node{ID: "node-2", Address: p.address()})
+	cm.SetHealthCheck(time.Second, time.Minute, 3, 2)
+	now := time.Now()
+	cm.SetClock(func() time.Time { return now.Add(2 * time.Minute) })
+
+	cm.performHealthCheck()
+	if s := status(t, cm, "node-2"); s != "unhealthy" {
+		t.Errorf("a node silent for longer than the staleness window is %s, want unhealthy", s)
+	}
+	if n := p.pings.Load(); n != 0 {
+		t.Errorf("a stale node was pinged %d times, want none", n)
+	}
+}
+
+// Slow peers are pinged all at once, and without the table locked meanwhile
+func TestHealthCheckPingsInParallel(t *testing.T) {
+	var nodes []*Node
+	var peers []*peer
+	for _, id := range []string{"node-2", "node-3", "node-4", "node-5", "node-6"} {
+		p := newPeer(t)
+		p.delay.Store(int64(200 * time.Millisecond))
+		peers = append(peers, p)
+		nodes = append(nodes, &Node{ID: id, Address: p.address()})
+	}
+	cm := newTestCluster(t, nodes...)
+	cm.SetHealthCheck(5*time.Second, time.Hour, 1, 1)
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cm.performHealthCheck()
+	}()
+
+	// Once the pings are out, the table can be read while they're answered
+	for peers[0].pings.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	read := time.Now()
+	if n := len(cm.GetHealthyNodes()); n != 6 {
+		t.Errorf("%d healthy nodes during the check, want 6", n)
+	}
+	if waited := time.Since(read); waited > 100*time.Millisecond {
+		t.Errorf("reading the table during the check took %v", waited)
+	}
+
+	wg.Wait()
+	if elapsed := time.Since(started); elapsed > 800*time.Millisecond {
+		t.Errorf("pinging 5 nodes that take 200ms each took %v, want them pinged at once", elapsed)
+	}
+	for i, p := range peers {
+		if n := p.pings.Load(); n != 1 {
+			t.Errorf("%s was pinged %d times, want once", nodes[i].ID, n)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHeartbeatInterval is how often nodes push their usage to each other. One that has
+// within two of them isn't pinged by the health checks.
+const defaultHeartbeatInterval = 10 * time.Second
+
+// Usage is what a node reports about itself in its heartbeats
+type Usage struct {
+	Used     int64   `json:"used"`     // bytes
+	Capacity int64   `json:"capacity"` // bytes, 0 if unknown
+	Objects  int64   `json:"objects"`
+	Load     float64 `json:"load"` // 0.0 to 1.0
+}
+
+// Heartbeat is a node telling the others it is up, where, and how full and busy it is
+type Heartbeat struct {
+	NodeID string `json:"node_id"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Drain  string `json:"drain,omitempty"`
+	// Version and Capabilities as in Node, so a node restarted on a new build says so
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Usage
+}
+
+// errNotRegistered is recordHeartbeat's answer to a node that has to register (again)
+var errNotRegistered = errors.New("unknown node, register first")
+
+// heartbeats is the state of the heartbeat loop, see SetHeartbeatInterval
+type heartbeats struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	ticker   *time.Ticker
+	stop     chan struct{}
+	done     chan struct{}
+	client   *http.Client
+	usage    func() Usage
+	received map[string]time.Time // node ID -> last heartbeat from it, under cm.mutex
+}
+
+// SetUsageSource has this node report what fn returns in its heartbeats, and show it as its
+// own usage. Without one it reports nothing but being up.
+func (cm *ClusterManager) SetUsageSource(fn func() Usage) {
+	cm.heartbeats.mutex.Lock()
+	defer cm.heartbeats.mutex.Unlock()
+	cm.heartbeats.usage = fn
+}
+
+// SetHeartbeatInterval changes how often this node pushes its usage to the others; a
+// running loop picks it up from its next tick
+func (cm *ClusterManager) SetHeartbeatInterval(interval time.Duration) {
+	cm.heartbeats.mutex.Lock()
+	defer cm.heartbeats.mutex.Unlock()
+
+	cm.heartbeats.interval = interval
+	if cm.heartbeats.ticker != nil {
+		cm.heartbeats.ticker.Reset(interval)
+	}
+}
+
+// startHeartbeats begins sending heartbeats, see Start
+func (cm *ClusterManager) startHeartbeats() {
+	cm.refreshUsage()
+
+	cm.heartbeats.mutex.Lock()
+	ticker := time.NewTicker(cm.heartbeats.interval)
+	cm.heartbeats.ticker = ticker
+	cm.heartbeats.mutex.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	cm.heartbeats.stop, cm.heartbeats.done = stop, done
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				cm.sendHeartbeats()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopHeartbeats stops sending heartbeats, returning a channel closed once a round in
+// progress is done
+func (cm *ClusterManager) stopHeartbeats() <-chan struct{} {
+	cm.heartbeats.ticker.Stop()
+	close(cm.heartbeats.stop)
+	return cm.heartbeats.done
+}
+
+// refreshUsage updates this node's own entry from the usage source and returns it
+func (cm *ClusterManager) refreshUsage() Usage {
+	cm.heartbeats.mutex.Lock()
+	source := cm.heartbeats.usage
+	cm.heartbeats.mutex.Unlock()
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	self := cm.currentNode
+	if source != nil {
+		usage := source()
+		self.Used, self.Objects, self.Load = usage.Used, usage.Objects, usage.Load
+		if usage.Capacity > 0 {
+			self.Capacity = usage.Capacity
+		}
+	}
+	self.LastSeen = time.Now()
+	return Usage{Used: self.Used, Capacity: self.Capacity, Objects: self.Objects, Load: self.Load}
+}
+
+// sendHeartbeats sends this node's usage to every other node at once. One that doesn't
+// know this node yet is registered with instead.
+func (cm *ClusterManager) sendHeartbeats() {
+	if cm.leaving() {
+		return
+	}
+	usage := cm.refreshUsage()
+	cm.mutex.RLock()
+	self := cm.currentNode
+	heartbeat := Heartbeat{
+		NodeID:       self.ID,
+		Zone:         self.Zone,
+		Rack:         self.Rack,
+		Drain:        self.Drain,
+		Version:      self.Version,
+		Capabilities: self.Capabilities,
+		Usage:        usage,
+	}
+	cm.mutex.RUnlock()
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return
+	}
+
+	cm.mutex.RLock()
+	var others []*Node
+	for _, node := range cm.nodes {
+		if node.ID != cm.currentNode.ID && node.Status != StatusLeft && node.Status != StatusDead {
+			others = append(others, node)
+		}
+	}
+	cm.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, node := range others {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			if err := cm.sendHeartbeat(node.Address, body); err != nil {
+				log.Printf("Heartbeat to node %s failed: %v", node.ID, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (cm *ClusterManager) sendHeartbeat(address string, body []byte) error {
+	client := cm.heartbeats.client
+	req, err := http.NewRequestWithContext(cm.requestContext(), http.MethodPost, fmt.Sprintf("http://%s/internal/heartbeat", address), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		// It has forgotten us, or never heard of us
+		_, err := cm.registerWith(client, address)
+		return err
+	}
+	return fmt.Errorf("heartbeat rejected with status %d", resp.StatusCode)
+}
+
+// recordHeartbeat takes a heartbeat from another node, which is seen now and healthy. It
+// fails with errNotRegistered if the node isn't known here, or has left or died and has to
+// register again, and with ErrZoneChanged if it says it is in another zone than it
+// registered in. Racks and drain states it may change.
+func (cm *ClusterManager) recordHeartbeat(heartbeat *Heartbeat) error {
+	cm.mutex.Lock()
+	node, exists := cm.nodes[heartbeat.NodeID]
+	if !exists || node.ID == cm.currentNode.ID || node.Status == StatusLeft || node.Status == StatusDead {
+		cm.mutex.Unlock()
+		return errNotRegistered
+	}
+	if heartbeat.Zone != node.Zone {
+		cm.mutex.Unlock()
+		return fmt.Errorf("%w: %s is in zone %q, not %q", ErrZoneChanged, node.ID, node.Zone, heartbeat.Zone)
+	}
+	now := cm.now()
+	node.Rack = heartbeat.Rack
+	if heartbeat.Version != "" {
+		// Older nodes don't send these, and then what they registered with stands
+		node.Version, node.Capabilities = heartbeat.Version, heartbeat.Capabilities
+	}
+	if node.Drain != heartbeat.Drain {
+		log.Printf("Node %s drain state now %q", node.ID, heartbeat.Drain)
+		node.Drain = heartbeat.Drain
+	}
+	node.Used, node.Objects, node.Load = heartbeat.Used, heartbeat.Objects, heartbeat.Load
+	if heartbeat.Capacity > 0 {
+		node.Capacity = heartbeat.Capacity
+	}
+	node.LastSeen = now
+	cm.heartbeats.received[node.ID] = now
+	delete(cm.probes, node.ID) // it has spoken for itself
+	var changes []statusChange
+	if node.Status != "healthy" {
+		changes = append(changes, statusChange{*node, node.Status, "healthy", "heartbeat"})
+		node.Status = "healthy"
+		log.Printf("Node healthy again after a heartbeat: %s", node.ID)
+	}
+	cm.mutex.Unlock()
+
+	cm.notify(changes)
+	return nil
+}
+
+// reportedRecently reports whether nodeID has sent a heartbeat within two intervals, so
+// doesn't need pinging. The caller holds cm.mutex.
+func (cm *ClusterManager) reportedRecently(nodeID string, now time.Time) bool {
+	cm.heartbeats.mutex.Lock()
+	interval := cm.heartbeats.interval
+	cm.heartbeats.mutex.Unlock()
+
+	received, ok := cm.heartbeats.received[nodeID]
+	return ok && now.Sub(received) < 2*interval
+}
+
+// HandleHeartbeat takes another node's heartbeat. A node not known here gets 404, and
+// registers itself.
+func (cm *ClusterManager) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var heartbeat Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+	if _, exists := cm.GetNode(heartbeat.NodeID); !exists {
+		http.Error(w, "Unknown node, register first", http.StatusNotFound)
+		return
+	}
+	if !cm.IsPeer(heartbeat.NodeID, r.RemoteAddr) {
+		http.Error(w, "Heartbeats are only accepted from other cluster nodes", http.StatusForbidden)
+		return
+	}
+	if err := cm.recordHeartbeat(&heartbeat); errors.Is(err, errNotRegistered) {
+		http.Error(w, "Unknown node, register first", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
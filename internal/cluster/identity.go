@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const nodeIDFile = "node_id"
+
+// ErrNodeIDMismatch is returned by ClaimNodeID for an ID other than the one persisted
+var ErrNodeIDMismatch = errors.New("node ID differs from the one this storage directory belongs to")
+
+// ClaimNodeID returns the ID the node with its data in dir is to run as: requested if set,
+// otherwise the one persisted there, generating and saving one on first start so the node
+// keeps its identity across restarts. requested is persisted
+// in turn, but one other than the ID already persisted is refused with ErrNodeIDMismatch,
+// as the cluster would take the node for a new one and its replicas recorded elsewhere
+// under the old ID would be orphaned; unless force is set, when the node is renamed.
+func ClaimNodeID(dir, requested string, force bool) (string, error) {
+	path := filepath.Join(dir, nodeIDFile)
+
+	var persisted string
+	data, err := os.ReadFile(path)
+	if err == nil {
+		persisted = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read node ID: %v", err)
+	}
+
+	id := requested
+	switch {
+	case id == "" && persisted != "":
+		return persisted, nil
+	case id == "":
+		if id, err = newNodeID(); err != nil {
+			return "", err
+		}
+	case id == persisted:
+		return id, nil
+	case persisted != "" && !force:
+		return "", fmt.Errorf("%w: %s was %s", ErrNodeIDMismatch, dir, persisted)
+	case persisted != "":
+		log.Printf("WARNING: renaming node %s to %s; the cluster will take it for a new node", persisted, id)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to persist node ID: %v", err)
+	}
+
+	return id, nil
+}
+
+// newNodeID generates a random (version 4) UUID
+func newNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate node ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// replaceAt has the nodes other than nodeID known at address taken as having left, as one
+// address is only ever one node: nodeID is the node there now, under a new identity, so the
+// old one doesn't linger as unhealthy. This node is never replaced.
+func (cm *ClusterManager) replaceAt(address, nodeID string) {
+	cm.mutex.Lock()
+	var changes []statusChange
+	for id, node := range cm.nodes {
+		if id == nodeID || id == cm.currentNode.ID || node.Address != address || node.Status == StatusLeft {
+			continue
+		}
+		changes = append(changes, statusChange{*node, node.Status, StatusLeft, "replaced by " + nodeID + " at " + address})
+		node.Status = StatusLeft
+		node.LastSeen = time.Now() // so gossip carries it over older entries
+		delete(cm.heartbeats.received, id)
+		delete(cm.probes, id)
+	}
+	cm.mutex.Unlock()
+
+	for _, change := range changes {
+		log.Printf("Node %s replaced by %s at %s", change.node.ID, nodeID, address)
+	}
+	cm.notify(changes)
+}
@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Join registers this node with each seed, then learns the seeds' view of the cluster and
+// registers with every node found there too, so existing members learn about us as well.
+// It returns an error only if no seed could be reached.
+func (cm *ClusterManager) Join(seeds []string) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	client := cm.NewClient(5 * time.Second)
+	self := cm.GetCurrentNode()
+
+	contacted := map[string]bool{self.Address: true}
+	joined := false
+
+	for _, seed := range seeds {
+		if contacted[seed] {
+			continue
+		}
+		contacted[seed] = true
+
+		nodes, err := cm.registerWith(client, seed)
+		if err != nil {
+			log.Printf("Failed to join via seed %s: %v", seed, err)
+			continue
+		}
+		joined = true
+
+		// Seeds from before registration answered with the node table have to be asked
+		if nodes == nil {
+			if nodes, err = cm.fetchClusterNodes(client, seed); err != nil {
+				log.Printf("Failed to fetch cluster view from %s: %v", seed, err)
+				continue
+			}
+		}
+
+		for _, node := range nodes {
+			if node.ID == self.ID || node.Status == StatusDead {
+				continue // dead nodes come back by registering themselves
+			}
+			if node.Address == self.Address {
+				continue // this node under an old ID, which registering replaced
+			}
+			if err := cm.RegisterNode(node); err != nil {
+				log.Printf("Not taking node %s from %s: %v", node.ID, seed, err)
+				continue
+			}
+
+			if contacted[node.Address] {
+				continue
+			}
+			contacted[node.Address] = true
+			if _, err := cm.registerWith(client, node.Address); err != nil {
+				log.Printf("Failed to register with %s: %v", node.Address, err)
+			}
+		}
+	}
+
+	if !joined {
+		return fmt.Errorf("no seed peers reachable")
+	}
+	return nil
+}
+
+// Seeds that can't be reached are tried again after joinRetryDelay, doubling each time up
+// to maxJoinRetryDelay
+const (
+	joinRetryDelay    = time.Second
+	maxJoinRetryDelay = time.Minute
+)
+
+// JoinWithRetry joins the cluster through seeds like Join, trying again with backoff until
+// one of them answers or ctx ends. The node serves standalone in the meantime.
+func (cm *ClusterManager) JoinWithRetry(ctx context.Context, seeds []string) error {
+	delay := joinRetryDelay
+	for {
+		err := cm.Join(seeds)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to join cluster, retrying in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, maxJoinRetryDelay)
+	}
+}
+
+// registerWith registers this node with the node at address, returning the node table it
+// answers with, nil if it doesn't. If it had taken this node for dead the listeners are
+// told, see rejoined.
+func (cm *ClusterManager) registerWith(client *http.Client, address string) ([]*Node, error) {
+	body, err := json.Marshal(cm.GetCurrentNode())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(fmt.Sprintf("http://%s/cluster/register", address), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registration rejected with status %d", resp.StatusCode)
+	}
+
+	var registered struct {
+		Nodes   map[string]*Node `json:"nodes"`
+		WasDead bool             `json:"was_dead"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		return nil, nil
+	}
+	if registered.WasDead {
+		cm.rejoined()
+	}
+	if registered.Nodes == nil {
+		return nil, nil
+	}
+	nodes := make([]*Node, 0, len(registered.Nodes))
+	for _, node := range registered.Nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (cm *ClusterManager) fetchClusterNodes(client *http.Client, address string) ([]*Node, error) {
+	resp, err := client.Get(fmt.Sprintf("http://%s/cluster/status", address))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status request failed with status %d", resp.StatusCode)
+	}
+
+	// A list of nodes, or a map of them by ID from nodes that predate ClusterStats
+	var status struct {
+		Nodes json.RawMessage `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid cluster status: %v", err)
+	}
+	var nodes []*Node
+	if err := json.Unmarshal(status.Nodes, &nodes); err == nil {
+		return nodes, nil
+	}
+	var byID map[string]*Node
+	if err := json.Unmarshal(status.Nodes, &byID); err != nil {
+		return nil, fmt.Errorf("invalid cluster status: %v", err)
+	}
+	for _, node := range byID {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// StatusLeft is the status of a node that has left the cluster on purpose. It is never
+// written to or copied to, isn't checked on, and comes back by registering again.
+const StatusLeft = "left"
+
+// Leave tells every other node this one is leaving, so they stop sending it writes and
+// copies without taking it for failed. It stops gossiping and sending heartbeats too.
+// Nodes that can't be told find out through gossip, or take it for failed.
+func (cm *ClusterManager) Leave(ctx context.Context) {
+	cm.mutex.Lock()
+	self := cm.currentNode
+	self.Status = StatusLeft
+	self.LastSeen = time.Now()
+	var others []*Node
+	for _, node := range cm.nodes {
+		if node.ID != self.ID && node.Status != StatusLeft {
+			others = append(others, node)
+		}
+	}
+	cm.mutex.Unlock()
+
+	client := cm.NewClient(5 * time.Second)
+	var wg sync.WaitGroup
+	for _, node := range others {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			if err := cm.sendLeave(ctx, client, node.Address, self.ID); err != nil {
+				log.Printf("Failed to tell node %s this one is leaving: %v", node.ID, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+	log.Printf("Left the cluster, told %d nodes", len(others))
+}
+
+func (cm *ClusterManager) sendLeave(ctx context.Context, client *http.Client, address, nodeID string) error {
+	endpoint := fmt.Sprintf("http://%s/internal/nodes/%s", address, url.PathEscape(nodeID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("leave rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// MarkLeft records that nodeID has left the cluster, returning false if it isn't known
+func (cm *ClusterManager) MarkLeft(nodeID string) bool {
+	cm.mutex.Lock()
+	node, exists := cm.nodes[nodeID]
+	if !exists || node.ID == cm.currentNode.ID {
+		cm.mutex.Unlock()
+		return false
+	}
+	var changes []statusChange
+	if node.Status != StatusLeft {
+		changes = append(changes, statusChange{*node, node.Status, StatusLeft, "left"})
+	}
+	node.Status = StatusLeft
+	node.LastSeen = time.Now() // so gossip carries it over older entries
+	delete(cm.heartbeats.received, nodeID)
+	delete(cm.probes, nodeID)
+	cm.mutex.Unlock()
+
+	log.Printf("Node left: %s", nodeID)
+	cm.notify(changes)
+	return true
+}
+
+// leaving reports whether this node has left the cluster
+func (cm *ClusterManager) leaving() bool {
+	return cm.GetCurrentNode().Status == StatusLeft
+}
@@ -0,0 +1,25 @@
+package cluster
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// SystemLoad is the one-minute load average per CPU, capped at 1, or 0 if it can't be read
+func SystemLoad() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return min(load/float64(runtime.NumCPU()), 1)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package cluster
+
+// SystemLoad can't read the load average here, so every node looks idle
+func SystemLoad() float64 {
+	return 0
+}
@@ -1,10 +1,15 @@
 package cluster
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -12,11 +17,22 @@ import (
 type Node struct {
 	ID       string    `json:"id"`
 	Address  string    `json:"address"`
-	Status   string    `json:"status"` // healthy, unhealthy, unknown
+	Status   string    `json:"status"` // healthy, unhealthy, unknown, dead or left (see StatusDead, StatusLeft)
 	LastSeen time.Time `json:"last_seen"`
 	Load     float64   `json:"load"`     // Current load (0.0 to 1.0)
 	Capacity int64     `json:"capacity"` // Storage capacity in bytes
 	Used     int64     `json:"used"`     // Used storage in bytes
+	Objects  int64     `json:"objects"`
+	// Zone and Rack are where the node runs, failure domains replicas are spread over;
+	// empty is a zone (or rack) of its own like any other
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	// Drain is empty, or draining or drained for a node on its way out, see DrainDraining
+	Drain string `json:"drain,omitempty"`
+	// Version is the build the node runs, and Capabilities the optional features it
+	// understands; both empty for nodes from before they were advertised
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 type ClusterManager struct {
@@ -24,6 +40,39 @@ type ClusterManager struct {
 	currentNode  *Node
 	mutex        sync.RWMutex
 	healthTicker *time.Ticker
+	healthMutex  sync.Mutex
+	interval     time.Duration
+	health       healthPolicy // see SetHealthCheck
+	stopHealth   chan struct{}
+	healthDone   chan struct{}
+	gossip       gossip
+	heartbeats   heartbeats
+	eviction     eviction
+	auth         clusterAuth
+	probes       map[string]*probes // node ID -> its run of ping results, under mutex
+	events       eventLog
+	now          func() time.Time // see SetClock, under mutex
+	drainDir     string           // see RestoreDrain, under mutex
+	quorum       quorum
+
+	// running is cancelled by Stop, abandoning the requests to other nodes in flight
+	running context.Context
+	cancel  context.CancelFunc
+
+	// rand picks between equally good replica targets, see SetSelectionSeed
+	randMutex sync.Mutex
+	rand      *rand.Rand
+
+	listenersMutex sync.Mutex
+	listeners      []func(node *Node, old, new string)
+}
+
+// statusChange is a node's status changing, for OnNodeStatusChange listeners and the
+// event log
+type statusChange struct {
+	node     Node
+	old, new string
+	reason   string
 }
 
 func NewClusterManager(nodeID, nodeAddress string) *ClusterManager {
@@ -35,25 +84,106 @@ func NewClusterManager(nodeID, nodeAddress string) *ClusterManager {
 			Status:   "healthy",
 			LastSeen: time.Now(),
 			Load:     0.0,
-			Capacity: 10 * 1024 * 1024 * 1024, // 10GB default
+			Capacity: 0, // unknown until the usage source says, see SetUsageSource
 			Used:     0,
 		},
+		interval: 30 * time.Second,
+		health: healthPolicy{
+			timeout:    defaultPingTimeout,
+			staleAfter: defaultStaleAfter,
+			failures:   defaultFailureThreshold,
+			successes:  defaultSuccessThreshold,
+		},
+		probes:  make(map[string]*probes),
+		running: context.Background(),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		gossip: gossip{
+			interval: defaultGossipInterval,
+			fanout:   defaultGossipFanout,
+		},
+		heartbeats: heartbeats{
+			interval: defaultHeartbeatInterval,
+			received: make(map[string]time.Time),
+		},
+		eviction: eviction{
+			deadAfter:   defaultDeadAfter,
+			removeAfter: defaultRemoveAfter,
+		},
+		now:    time.Now,
+		events: eventLog{size: DefaultEventLogSize},
+		quorum: quorum{policy: PartitionReject},
 	}
 
+	cm.gossip.client = cm.NewClient(5 * time.Second)
+	cm.heartbeats.client = cm.NewClient(5 * time.Second)
 	cm.nodes[nodeID] = cm.currentNode
-	cm.startHealthCheck()
+	cm.checkQuorum()
 
 	return cm
 }
 
-func (cm *ClusterManager) RegisterNode(node *Node) {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
+// ErrZoneChanged is returned for a node registering in another zone than the one it is up
+// in here, which is more likely two nodes with the same ID than a node that has moved. A
+// node moves by leaving the cluster and registering again.
+var ErrZoneChanged = errors.New("node is up in another zone")
 
-	node.LastSeen = time.Now()
+// RegisterNode adds node to the table, or replaces what is known about it. A node that is
+// up here can't change zones, see ErrZoneChanged.
+func (cm *ClusterManager) RegisterNode(node *Node) error {
+	cm.mutex.Lock()
+	previous, exists := cm.nodes[node.ID]
+	if exists && previous.Status == "healthy" && previous.Zone != node.Zone && node.ID != cm.currentNode.ID {
+		cm.mutex.Unlock()
+		return fmt.Errorf("%w: %s is in zone %q, not %q", ErrZoneChanged, node.ID, previous.Zone, node.Zone)
+	}
+	node.LastSeen = cm.now()
+	var changes []statusChange
+	if exists && previous.Status != node.Status {
+		changes = append(changes, statusChange{*node, previous.Status, node.Status, "registered"})
+	}
 	cm.nodes[node.ID] = node
+	delete(cm.probes, node.ID)
+	cm.mutex.Unlock()
+
+	log.Printf("Node registered: %s (%s, zone %q, rack %q)", node.ID, node.Address, node.Zone, node.Rack)
+	cm.events.record(Event{Time: time.Now(), Type: EventRegistered, NodeID: node.ID, New: node.Status, Reason: "at " + node.Address})
+	cm.notify(changes)
+	return nil
+}
+
+// OnNodeStatusChange calls fn whenever a known node's status changes, from healthy to
+// unhealthy, dead and removed or back, with a copy of the node as it is now. This node
+// going from dead to healthy means it found out the others had taken it for dead. Listeners
+// are called one after the other, outside of the manager's lock.
+func (cm *ClusterManager) OnNodeStatusChange(fn func(node *Node, old, new string)) {
+	cm.listenersMutex.Lock()
+	defer cm.listenersMutex.Unlock()
+	cm.listeners = append(cm.listeners, fn)
+}
 
-	log.Printf("Node registered: %s (%s)", node.ID, node.Address)
+func (cm *ClusterManager) notify(changes []statusChange) {
+	cm.checkQuorum()
+	if len(changes) == 0 {
+		return
+	}
+	cm.recordChanges(changes)
+	cm.listenersMutex.Lock()
+	listeners := cm.listeners // only ever appended to
+	cm.listenersMutex.Unlock()
+	for _, change := range changes {
+		for _, fn := range listeners {
+			node := change.node
+			fn(&node, change.old, change.new)
+		}
+	}
+}
+
+// GetNode returns the node with nodeID, healthy or not
+func (cm *ClusterManager) GetNode(nodeID string) (*Node, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	node, exists := cm.nodes[nodeID]
+	return node, exists
 }
 
 func (cm *ClusterManager) GetHealthyNodes() []*Node {
@@ -70,6 +200,19 @@ func (cm *ClusterManager) GetHealthyNodes() []*Node {
 	return healthy
 }
 
+// Leader returns the healthy node with the lowest ID, this one included, which starts the
+// operations run across the whole cluster such as rebalancing. Each node works it out from
+// its own table, so while tables disagree two nodes may each take themselves for it.
+func (cm *ClusterManager) Leader() *Node {
+	var leader *Node
+	for _, node := range cm.GetHealthyNodes() {
+		if leader == nil || node.ID < leader.ID {
+			leader = node
+		}
+	}
+	return leader
+}
+
 func (cm *ClusterManager) SelectNodeForWrite() *Node {
 	nodes := cm.GetHealthyNodes()
 	if len(nodes) == 0 {
@@ -81,9 +224,11 @@ func (cm *ClusterManager) SelectNodeForWrite() *Node {
 	lowestLoad := 1.0
 
 	for _, node := range nodes {
-		utilization := float64(node.Used) / float64(node.Capacity)
-		if utilization < lowestLoad {
-			lowestLoad = utilization
+		if node.Drain != "" {
+			continue
+		}
+		if used := utilization(node.Used, node.Capacity); used < lowestLoad {
+			lowestLoad = used
 			bestNode = node
 		}
 	}
@@ -91,104 +236,400 @@ func (cm *ClusterManager) SelectNodeForWrite() *Node {
 	return bestNode
 }
 
-func (cm *ClusterManager) SelectNodesForReplication(count int) []*Node {
-	nodes := cm.GetHealthyNodes()
-	if len(nodes) <= count {
-		return nodes
+// SetLocation sets the zone and rack this node advertises, before it joins the cluster
+func (cm *ClusterManager) SetLocation(zone, rack string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.currentNode.Zone = zone
+	cm.currentNode.Rack = rack
+}
+
+// SelectNodesForReplication picks up to count healthy nodes other than this one to hold
+// copies of an object of size bytes written here, spread over as many zones as it can.
+// Nodes being drained aren't picked, here or by SelectReplicaTargets.
+func (cm *ClusterManager) SelectNodesForReplication(count int, size int64) []*Node {
+	return cm.SelectReplicaTargets(count, nil, size)
+}
+
+// SelectReplicaTargets picks up to count more healthy nodes for an object of size bytes
+// this node and the nodes in holders already have copies of. The zones and racks of those
+// are taken into account, and none of them are picked again. Nodes without room for the
+// object aren't picked, and among equally good ones those with more room are likelier to be.
+func (cm *ClusterManager) SelectReplicaTargets(count int, holders []*Node, size int64) []*Node {
+	self := cm.GetCurrentNode()
+	held := map[string]bool{self.ID: true}
+	for _, node := range holders {
+		held[node.ID] = true
+	}
+	var candidates []*Node
+	for _, node := range cm.GetHealthyNodes() {
+		if free, known := freeSpace(node); !held[node.ID] && node.Drain == "" && (!known || free >= size) {
+			candidates = append(candidates, node)
+		}
 	}
 
-	// Simple selection - could be improved with rack awareness, etc.
-	selected := make([]*Node, 0, count)
-	for i := 0; i < count && i < len(nodes); i++ {
-		selected = append(selected, nodes[i])
+	cm.randMutex.Lock()
+	defer cm.randMutex.Unlock()
+	return spreadNodes(candidates, append([]*Node{self}, holders...), count, cm.rand)
+}
+
+// SetSelectionSeed makes the choice between equally good replica targets repeatable, for
+// tests
+func (cm *ClusterManager) SetSelectionSeed(seed int64) {
+	cm.randMutex.Lock()
+	defer cm.randMutex.Unlock()
+	cm.rand = rand.New(rand.NewSource(seed))
+}
+
+// freeSpace is how many bytes node has room for, known false if it hasn't said how big it is
+func freeSpace(node *Node) (free int64, known bool) {
+	if node.Capacity <= 0 {
+		return 0, false
 	}
+	return max(node.Capacity-node.Used, 0), true
+}
 
+// spreadNodes picks count of candidates one at a time, each from the zone with the fewest
+// of taken and those picked so far, then the rack with the fewest. Distinct zones come
+// first, and once there are more copies than zones, distinct racks and nodes. Between
+// nodes as good as each other it picks at random, weighted by their free space.
+func spreadNodes(candidates, taken []*Node, count int, rng *rand.Rand) []*Node {
+	if count <= 0 {
+		return nil
+	}
+	zones := make(map[string]int)
+	racks := make(map[[2]string]int)
+	for _, node := range taken {
+		zones[node.Zone]++
+		racks[[2]string{node.Zone, node.Rack}]++
+	}
+
+	remaining := append([]*Node(nil), candidates...)
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].ID < remaining[j].ID })
+	var selected []*Node
+	for len(selected) < count && len(remaining) > 0 {
+		var best []int
+		for i, node := range remaining {
+			if len(best) == 0 {
+				best = []int{i}
+				continue
+			}
+			b := remaining[best[0]]
+			switch {
+			case zones[node.Zone] < zones[b.Zone],
+				zones[node.Zone] == zones[b.Zone] && racks[[2]string{node.Zone, node.Rack}] < racks[[2]string{b.Zone, b.Rack}]:
+				best = []int{i}
+			case zones[node.Zone] == zones[b.Zone] && racks[[2]string{node.Zone, node.Rack}] == racks[[2]string{b.Zone, b.Rack}]:
+				best = append(best, i)
+			}
+		}
+		pick := best[weightedPick(remaining, best, rng)]
+		node := remaining[pick]
+		selected = append(selected, node)
+		zones[node.Zone]++
+		racks[[2]string{node.Zone, node.Rack}]++
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
 	return selected
 }
 
-func (cm *ClusterManager) startHealthCheck() {
-	cm.healthTicker = time.NewTicker(30 * time.Second)
+// weightedPick picks one of the nodes at indexes, returning its position in indexes, with
+// odds in proportion to its free space. Nodes that haven't said how big they are count as
+// having the average of those that have.
+func weightedPick(nodes []*Node, indexes []int, rng *rand.Rand) int {
+	weights := make([]float64, len(indexes))
+	var sum float64
+	var known int
+	for i, index := range indexes {
+		if free, ok := freeSpace(nodes[index]); ok {
+			weights[i] = float64(free) + 1 // full nodes still get a look in when it's them or nothing
+			sum += weights[i]
+			known++
+		}
+	}
+	average := 1.0
+	if known > 0 {
+		average = sum / float64(known)
+	}
+	sum = 0
+	for i, index := range indexes {
+		if _, ok := freeSpace(nodes[index]); !ok {
+			weights[i] = average
+		}
+		sum += weights[i]
+	}
 
-	go func() {
-		for range cm.healthTicker.C {
-			cm.performHealthCheck()
+	target := rng.Float64() * sum
+	for i, weight := range weights {
+		if target < weight {
+			return i
 		}
-	}()
+		target -= weight
+	}
+	return len(weights) - 1
 }
 
-func (cm *ClusterManager) performHealthCheck() {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
+// Start begins the periodic health checks of the other nodes, the gossip with them and
+// the heartbeats sent to them. Starting a running manager does nothing.
+func (cm *ClusterManager) Start(ctx context.Context) error {
+	cm.healthMutex.Lock()
+	defer cm.healthMutex.Unlock()
+	if cm.healthTicker != nil {
+		return nil
+	}
+	cm.running, cm.cancel = context.WithCancel(context.Background())
 
-	now := time.Now()
+	cm.startGossip()
+	cm.startHeartbeats()
 
-	for nodeID, node := range cm.nodes {
-		if nodeID == cm.currentNode.ID {
-			continue // Skip self
-		}
+	ticker := time.NewTicker(cm.interval)
+	stop, done := make(chan struct{}), make(chan struct{})
+	cm.healthTicker, cm.stopHealth, cm.healthDone = ticker, stop, done
 
-		// Check if node is stale
-		if now.Sub(node.LastSeen) > 60*time.Second {
-			node.Status = "unhealthy"
-			log.Printf("Node marked unhealthy: %s", nodeID)
-			continue
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				cm.performHealthCheck()
+			case <-stop:
+				return
+			}
 		}
+	}()
+	return nil
+}
+
+// SetHealthCheckInterval changes how often other nodes are checked; a running loop picks
+// it up from its next tick
+func (cm *ClusterManager) SetHealthCheckInterval(interval time.Duration) {
+	cm.healthMutex.Lock()
+	defer cm.healthMutex.Unlock()
 
-		// Ping node
-		if cm.pingNode(node) {
-			node.Status = "healthy"
-			node.LastSeen = now
-		} else {
-			node.Status = "unhealthy"
+	cm.interval = interval
+	if cm.healthTicker != nil {
+		cm.healthTicker.Reset(interval)
+	}
+}
+
+// Stop ends the health checks, gossip and heartbeats, abandoning the requests they have in
+// flight, and waits for them to finish. A stopped manager can be started again.
+func (cm *ClusterManager) Stop(ctx context.Context) error {
+	cm.healthMutex.Lock()
+	if cm.healthTicker == nil {
+		cm.healthMutex.Unlock()
+		return nil
+	}
+	cm.healthTicker.Stop()
+	cm.healthTicker = nil
+	close(cm.stopHealth)
+	cm.cancel()
+	waits := []<-chan struct{}{cm.healthDone, cm.stopGossip(), cm.stopHeartbeats()}
+	cm.healthMutex.Unlock()
+
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+	return nil
 }
 
-func (cm *ClusterManager) pingNode(node *Node) bool {
-	client := &http.Client{Timeout: 5 * time.Second}
+// requestContext is what requests to other nodes are made under, cancelled by Stop
+func (cm *ClusterManager) requestContext() context.Context {
+	cm.healthMutex.Lock()
+	defer cm.healthMutex.Unlock()
+	return cm.running
+}
 
-	resp, err := client.Get(fmt.Sprintf("http://%s/health", node.Address))
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
+// ClusterStats is the cluster as this node sees it
+type ClusterStats struct {
+	TotalNodes     int   `json:"total_nodes"`
+	HealthyNodes   int   `json:"healthy_nodes"`
+	UnhealthyNodes int   `json:"unhealthy_nodes"`
+	DeadNodes      int   `json:"dead_nodes"`
+	LeftNodes      int   `json:"left_nodes"`
+	TotalCapacity  int64 `json:"total_capacity"`
+	TotalUsed      int64 `json:"total_used"`
+	// RejectedRequests counts the requests from other nodes turned down for not carrying
+	// the cluster token, see SetClusterSecret; a growing count is someone probing
+	RejectedRequests int64 `json:"rejected_requests"`
+	// Utilization is TotalUsed of TotalCapacity, 0 while no node has said how big it is
+	Utilization float64      `json:"utilization"`
+	Nodes       []NodeStatus `json:"nodes"` // by ID
+	Zones       []ZoneStats  `json:"zones"` // by name, the nodes without one under ""
+	Quorum      QuorumStatus `json:"quorum"`
+	// Versions is how many nodes run each build, most first, so a rollout that has
+	// stalled shows. Nodes that are dead or have left aren't counted.
+	Versions []VersionStats `json:"versions"`
+}
+
+// VersionStats is the nodes running one build in ClusterStats
+type VersionStats struct {
+	Version string   `json:"version"` // UnknownVersion for nodes that don't say
+	Nodes   []string `json:"nodes"`   // by ID
+}
+
+// ZoneStats is the nodes in one zone in ClusterStats. Nodes that are dead or have left
+// aren't counted.
+type ZoneStats struct {
+	Zone         string  `json:"zone"`
+	TotalNodes   int     `json:"total_nodes"`
+	HealthyNodes int     `json:"healthy_nodes"`
+	Capacity     int64   `json:"capacity"`
+	Used         int64   `json:"used"`
+	Utilization  float64 `json:"utilization"`
+	// Degraded is true when some of the zone's nodes aren't healthy
+	Degraded bool `json:"degraded"`
+}
 
-	return resp.StatusCode == http.StatusOK
+// NodeStatus is one node in ClusterStats
+type NodeStatus struct {
+	Node
+	Utilization float64 `json:"utilization"`
+	// SinceSeen is how long ago the node was last heard from, in seconds
+	SinceSeen float64 `json:"seconds_since_seen"`
 }
 
-func (cm *ClusterManager) GetClusterStats() map[string]interface{} {
+// GetClusterStats returns the nodes known here and their totals. The nodes are copies, safe
+// to use once the lock is released.
+func (cm *ClusterManager) GetClusterStats() ClusterStats {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
 
-	totalNodes := len(cm.nodes)
-	healthyNodes := 0
-	totalCapacity := int64(0)
-	totalUsed := int64(0)
-
+	now := cm.now()
+	stats := ClusterStats{
+		TotalNodes:       len(cm.nodes),
+		RejectedRequests: cm.auth.rejected.Load(),
+		Quorum:           cm.GetQuorumStatus(),
+		Nodes:            make([]NodeStatus, 0, len(cm.nodes)),
+	}
+	zones := make(map[string]*ZoneStats)
+	versions := make(map[string][]string)
 	for _, node := range cm.nodes {
-		if node.Status == "healthy" {
-			healthyNodes++
+		if node.Status != StatusDead && node.Status != StatusLeft {
+			version := node.Version
+			if version == "" {
+				version = UnknownVersion
+			}
+			versions[version] = append(versions[version], node.ID)
+
+			zone, ok := zones[node.Zone]
+			if !ok {
+				zone = &ZoneStats{Zone: node.Zone}
+				zones[node.Zone] = zone
+			}
+			zone.TotalNodes++
+			if node.Status == "healthy" {
+				zone.HealthyNodes++
+			}
+			zone.Capacity += node.Capacity
+			zone.Used += node.Used
 		}
-		totalCapacity += node.Capacity
-		totalUsed += node.Used
+
+		switch node.Status {
+		case "healthy":
+			stats.HealthyNodes++
+		case "unhealthy":
+			stats.UnhealthyNodes++
+		case StatusDead:
+			stats.DeadNodes++
+		case StatusLeft:
+			stats.LeftNodes++
+		}
+		stats.TotalCapacity += node.Capacity
+		stats.TotalUsed += node.Used
+		stats.Nodes = append(stats.Nodes, NodeStatus{
+			Node:        *node,
+			Utilization: utilization(node.Used, node.Capacity),
+			SinceSeen:   now.Sub(node.LastSeen).Seconds(),
+		})
+	}
+	stats.Utilization = utilization(stats.TotalUsed, stats.TotalCapacity)
+	sort.Slice(stats.Nodes, func(i, j int) bool { return stats.Nodes[i].ID < stats.Nodes[j].ID })
+	stats.Zones = make([]ZoneStats, 0, len(zones))
+	for _, zone := range zones {
+		zone.Utilization = utilization(zone.Used, zone.Capacity)
+		zone.Degraded = zone.HealthyNodes < zone.TotalNodes
+		stats.Zones = append(stats.Zones, *zone)
+	}
+	sort.Slice(stats.Zones, func(i, j int) bool { return stats.Zones[i].Zone < stats.Zones[j].Zone })
+	stats.Versions = make([]VersionStats, 0, len(versions))
+	for version, nodes := range versions {
+		sort.Strings(nodes)
+		stats.Versions = append(stats.Versions, VersionStats{Version: version, Nodes: nodes})
 	}
+	sort.Slice(stats.Versions, func(i, j int) bool {
+		a, b := stats.Versions[i], stats.Versions[j]
+		if len(a.Nodes) != len(b.Nodes) {
+			return len(a.Nodes) > len(b.Nodes)
+		}
+		return a.Version < b.Version
+	})
+	return stats
+}
 
-	return map[string]interface{}{
-		"total_nodes":    totalNodes,
-		"healthy_nodes":  healthyNodes,
-		"total_capacity": totalCapacity,
-		"total_used":     totalUsed,
-		"utilization":    float64(totalUsed) / float64(totalCapacity),
-		"nodes":          cm.nodes,
+// utilization is used of capacity, 0 when the capacity isn't known
+func utilization(used, capacity int64) float64 {
+	if capacity <= 0 {
+		return 0
 	}
+	return float64(used) / float64(capacity)
 }
+
 func (cm *ClusterManager) GetCurrentNode() *Node {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
 	return cm.currentNode
 }
 
+// IsPeer reports whether a request from remoteAddr claiming to come from nodeID does: the
+// node has to be another registered one, and the request has to come from the host it
+// advertises, or an address that host resolves to
+func (cm *ClusterManager) IsPeer(nodeID, remoteAddr string) bool {
+	cm.mutex.RLock()
+	node, exists := cm.nodes[nodeID]
+	cm.mutex.RUnlock()
+	if !exists || node.ID == cm.currentNode.ID {
+		return false
+	}
+	return addressMatches(node.Address, remoteAddr)
+}
+
+// addressMatches reports whether a request from remoteAddr comes from the host of address,
+// or an address that host resolves to
+func addressMatches(address, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	if host == remote {
+		return true
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.Equal(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
 // HTTP handlers for cluster management
+
+// HandleNodeRegistration registers the node posted and answers with this node's table, so
+// a joining node learns the whole cluster from one seed. A node taken for dead here is told
+// so, and has to catch up on what it missed.
 func (cm *ClusterManager) HandleNodeRegistration(w http.ResponseWriter, r *http.Request) {
 	var node Node
 	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
@@ -196,10 +637,29 @@ func (cm *ClusterManager) HandleNodeRegistration(w http.ResponseWriter, r *http.
 		return
 	}
 
-	cm.RegisterNode(&node)
+	cm.mutex.RLock()
+	previous, known := cm.nodes[node.ID]
+	wasDead := known && previous.Status == StatusDead
+	cm.mutex.RUnlock()
+	if err := cm.RegisterNode(&node); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	cm.replaceAt(node.Address, node.ID)
+
+	cm.mutex.RLock()
+	nodes := make(map[string]Node, len(cm.nodes))
+	for id, known := range cm.nodes {
+		nodes[id] = *known
+	}
+	cm.mutex.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "registered",
+		"nodes":    nodes,
+		"was_dead": wasDead,
+	})
 }
 
 func (cm *ClusterManager) HandleClusterStatus(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,357 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const gb = int64(1) << 30
+
+// newTestCluster is node-1 with nodes registered as given, and a fixed selection seed
+func newTestCluster(t *testing.T, nodes ...*Node) *ClusterManager {
+	t.Helper()
+	cm := NewClusterManager("node-1", "127.0.0.1:1")
+	cm.SetSelectionSeed(1)
+	for _, node := range nodes {
+		if node.Status == "" {
+			node.Status = "healthy"
+		}
+		if err := cm.RegisterNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cm
+}
+
+func ids(nodes []*Node) []string {
+	var ids []string
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	return ids
+}
+
+func TestSelectNodesForReplication(t *testing.T) {
+	cm := newTestCluster(t,
+		&Node{ID: "node-2", Capacity: 10 * gb},
+		&Node{ID: "node-3", Capacity: 10 * gb},
+		&Node{ID: "node-4", Capacity: 10 * gb, Used: 10*gb - 100}, // no room for the object
+		&Node{ID: "node-5", Status: "unhealthy"},
+		&Node{ID: "node-6", Drain: DrainDraining},
+	)
+
+	selected := cm.SelectNodesForReplication(5, 1000)
+	if len(selected) != 2 {
+		t.Fatalf("selected %v, want node-2 and node-3, the only ones that can take it", ids(selected))
+	}
+	for _, node := range selected {
+		if node.ID != "node-2" && node.ID != "node-3" {
+			t.Errorf("selected %s, want node-2 and node-3 only", node.ID)
+		}
+	}
+	if small := cm.SelectNodesForReplication(5, 10); len(small) != 3 {
+		t.Errorf("for a small object selected %v, want node-4 as well", ids(small))
+	}
+	if none := cm.SelectNodesForReplication(0, 10); len(none) != 0 {
+		t.Errorf("asked for none, selected %v", ids(none))
+	}
+}
+
+func TestSelectNodesForReplicationSpread(t *testing.T) {
+	cm := newTestCluster(t,
+		&Node{ID: "node-2", Capacity: 10 * gb},
+		&Node{ID: "node-3", Capacity: 10 * gb},
+		&Node{ID: "node-4", Capacity: 10 * gb},
+		&Node{ID: "node-5", Capacity: 40 * gb},
+	)
+
+	const trials = 6000
+	picked := make(map[string]int)
+	for i := 0; i < trials; i++ {
+		for _, node := range cm.SelectNodesForReplication(1, 1) {
+			picked[node.ID]++
+		}
+	}
+	if picked["node-1"] > 0 {
+		t.Fatalf("this node was picked %d times", picked["node-1"])
+	}
+	// In proportion to their room: 40 of the 70 GB free for node-5, 10 for each of the others
+	for id, want := range map[string]float64{"node-2": 1.0 / 7, "node-3": 1.0 / 7, "node-4": 1.0 / 7, "node-5": 4.0 / 7} {
+		if share := float64(picked[id]) / trials; math.Abs(share-want) > 0.05 {
+			t.Errorf("%s picked %.2f of the time, want about %.2f", id, share, want)
+		}
+	}
+}
+
+func TestSelectNodesForReplicationSeed(t *testing.T) {
+	nodes := func() []*Node {
+		return []*Node{{ID: "node-2"}, {ID: "node-3"}, {ID: "node-4"}, {ID: "node-5"}}
+	}
+	a, b := newTestCluster(t, nodes()...), newTestCluster(t, nodes()...)
+	for i := 0; i < 20; i++ {
+		x, y := ids(a.SelectNodesForReplication(2, 1)), ids(b.SelectNodesForReplication(2, 1))
+		if len(x) != 2 || x[0] != y[0] || x[1] != y[1] {
+			t.Fatalf("pick %d: %v and %v with the same seed", i, x, y)
+		}
+	}
+}
+
+func TestSelectReplicaTargetsZones(t *testing.T) {
+	spread := func(layout ...string) []*Node {
+		var nodes []*Node
+		for i, location := range layout {
+			zone, rack, _ := strings.Cut(location, "/")
+			nodes = append(nodes, &Node{ID: fmt.Sprintf("node-%d", i+2), Zone: zone, Rack: rack})
+		}
+		return nodes
+	}
+	tests := []struct {
+		name    string
+		self    string   // this node's zone/rack
+		nodes   []*Node  // the others, node-2 on
+		holders []string // nodes already holding a copy
+		count   int
+		want    map[string]int // picked by zone/rack
+	}{
+		{
+			name:  "three zones",
+			self:  "a/",
+			nodes: spread("a/", "a/", "b/", "b/", "c/", "c/"),
+			count: 2,
+			want:  map[string]int{"b/": 1, "c/": 1},
+		},
+		{
+			name:  "one zone",
+			self:  "a/",
+			nodes: spread("a/", "a/", "a/", "a/"),
+			count: 3,
+			want:  map[string]int{"a/": 3},
+		},
+		{
+			name:  "more copies than zones",
+			self:  "a/",
+			nodes: spread("a/", "a/", "b/", "b/", "b/", "c/", "c/", "c/"),
+			count: 5,
+			want:  map[string]int{"a/": 1, "b/": 2, "c/": 2},
+		},
+		{
+			name:  "racks within a zone",
+			self:  "a/1",
+			nodes: spread("a/1", "a/1", "a/2", "a/2"),
+			count: 3,
+			want:  map[string]int{"a/1": 1, "a/2": 2},
+		},
+		{
+			name:    "a copy already in another zone",
+			self:    "a/",
+			nodes:   spread("a/", "b/", "b/", "c/"),
+			holders: []string{"node-3"},
+			count:   1,
+			want:    map[string]int{"c/": 1},
+		},
+		{
+			name:  "fewer nodes than copies",
+			self:  "a/",
+			nodes: spread("b/", "c/"),
+			count: 4,
+			want:  map[string]int{"b/": 1, "c/": 1},
+		},
+		{
+			name:  "no zones given",
+			self:  "",
+			nodes: spread("", "", ""),
+			count: 2,
+			want:  map[string]int{"/": 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cm := newTestCluster(t, test.nodes...)
+			zone, rack, _ := strings.Cut(test.self, "/")
+			cm.SetLocation(zone, rack)
+			var holders []*Node
+			for _, id := range test.holders {
+				node, _ := cm.GetNode(id)
+				holders = append(holders, node)
+			}
+
+			// Whichever of the equally good nodes it picks, the spread is the same
+			for i := 0; i < 20; i++ {
+				selected := cm.SelectReplicaTargets(test.count, holders, 1)
+				got := make(map[string]int)
+				for _, node := range selected {
+					got[node.Zone+"/"+node.Rack]++
+					for _, id := range test.holders {
+						if node.ID == id {
+							t.Fatalf("picked %s, which already holds a copy", id)
+						}
+					}
+				}
+				if !maps.Equal(got, test.want) {
+					t.Fatalf("picked %v in %v, want %v", ids(selected), got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetClusterStats(t *testing.T) {
+	t.Run("just this node", func(t *testing.T) {
+		stats := newTestCluster(t).GetClusterStats()
+		if stats.TotalNodes != 1 || stats.HealthyNodes != 1 || stats.Utilization != 0 || len(stats.Nodes) != 1 {
+			t.Errorf("stats = %+v, want this healthy node and utilization 0", stats)
+		}
+	})
+
+	t.Run("zero capacity", func(t *testing.T) {
+		cm := newTestCluster(t, &Node{ID: "node-2", Used: 100}, &Node{ID: "node-3"})
+		stats := cm.GetClusterStats()
+		if stats.Utilization != 0 || stats.TotalUsed != 100 {
+			t.Errorf("utilization %v of %d used, want 0 with no capacity known", stats.Utilization, stats.TotalUsed)
+		}
+		for _, node := range stats.Nodes {
+			if node.Utilization != 0 {
+				t.Errorf("%s utilization = %v, want 0", node.ID, node.Utilization)
+			}
+		}
+		if _, err := json.Marshal(stats); err != nil {
+			t.Errorf("encoding the stats: %v", err)
+		}
+	})
+
+	t.Run("mixed health", func(t *testing.T) {
+		cm := newTestCluster(t,
+			&Node{ID: "node-2", Capacity: 100, Used: 25, Zone: "a"},
+			&Node{ID: "node-3", Capacity: 100, Used: 75, Zone: "a", Status: "unhealthy"},
+			&Node{ID: "node-4", Status: StatusDead},
+		)
+		stats := cm.GetClusterStats()
+		if stats.TotalNodes != 4 || stats.HealthyNodes != 2 || stats.UnhealthyNodes != 1 || stats.DeadNodes != 1 {
+			t.Errorf("nodes: %d total, %d healthy, %d unhealthy, %d dead; want 4, 2, 1, 1",
+				stats.TotalNodes, stats.HealthyNodes, stats.UnhealthyNodes, stats.DeadNodes)
+		}
+		if stats.Utilization != 0.5 {
+			t.Errorf("utilization = %v, want 0.5", stats.Utilization)
+		}
+		var order []string
+		for _, node := range stats.Nodes {
+			order = append(order, node.ID)
+		}
+		if len(order) != 4 || order[0] != "node-1" || order[3] != "node-4" {
+			t.Errorf("nodes in order %v, want by ID", order)
+		}
+		if zone := stats.Zones[len(stats.Zones)-1]; zone.Zone != "a" || !zone.Degraded || zone.Utilization != 0.5 {
+			t.Errorf("zone a = %+v, want degraded at 0.5", zone)
+		}
+
+		// The nodes are copies: changing them doesn't change the table
+		stats.Nodes[1].Status = "tampered"
+		if node, _ := cm.GetNode("node-2"); node.Status != "healthy" {
+			t.Errorf("node-2 is %s after changing the stats' copy", node.Status)
+		}
+	})
+}
+
+func TestHandleClusterStatus(t *testing.T) {
+	cm := newTestCluster(t, &Node{ID: "node-2"})
+	w := httptest.NewRecorder()
+	cm.HandleClusterStatus(w, httptest.NewRequest(http.MethodGet, "/cluster/status", nil))
+
+	var stats ClusterStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding the response: %v", err)
+	}
+	if w.Code != http.StatusOK || stats.TotalNodes != 2 || len(stats.Nodes) != 2 {
+		t.Errorf("status %d with %d nodes, want 200 with 2", w.Code, stats.TotalNodes)
+	}
+}
+
+// startChecking starts a manager checking a peer that never answers, and waits for a ping
+// to be in flight
+func startChecking(t *testing.T, p *peer) *ClusterManager {
+	t.Helper()
+	cm := newTestCluster(t, &Node{ID: "node-2", Address: p.address()})
+	cm.SetHealthCheck(time.Hour, time.Hour, 3, 2)
+	cm.SetHealthCheckInterval(time.Millisecond)
+	pinged := p.pings.Load()
+	if err := cm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); p.pings.Load() == pinged; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("node-2 never pinged")
+		}
+	}
+	return cm
+}
+
+// settle waits for the goroutine count to come back down to at most want, as the
+// goroutines told to exit get round to it
+func settle(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, want at most %d:\n%s", runtime.NumGoroutine(), want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartStopLeaksNoGoroutines(t *testing.T) {
+	p := newPeer(t)
+	p.delay.Store(int64(time.Hour))
+	before := runtime.NumGoroutine()
+
+	// Each Stop abandons the ping in flight and waits for every loop to finish
+	for i := 0; i < 20; i++ {
+		cm := startChecking(t, p)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := cm.Stop(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("stop %d: %v", i, err)
+		}
+		// Twice is fine, and waits for nothing
+		if err := cm.Stop(context.Background()); err != nil {
+			t.Fatalf("second stop %d: %v", i, err)
+		}
+	}
+	settle(t, before)
+}
+
+func TestStopWithExpiredContext(t *testing.T) {
+	p := newPeer(t)
+	p.delay.Store(int64(time.Hour))
+	before := runtime.NumGoroutine()
+
+	cm := startChecking(t, p)
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	// It may or may not find the loops already done, but they're told to stop either way
+	if err := cm.Stop(expired); err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("stop with an expired context: %v, want nil or context.Canceled", err)
+	}
+	if err := cm.Stop(context.Background()); err != nil {
+		t.Errorf("stop after that: %v", err)
+	}
+	settle(t, before)
+
+	// And it can be started again afterwards
+	cm.Start(context.Background())
+	if err := cm.Stop(context.Background()); err != nil {
+		t.Errorf("stop after a restart: %v", err)
+	}
+	settle(t, before)
+}
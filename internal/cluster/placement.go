@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// GetNodesForKey returns up to count nodes that own key, the primary first, by rendezvous
+// hashing: every node scores the key and the highest scores own it, so a node joining or
+// going only moves the keys it wins or held. Unhealthy nodes keep their keys, and it is up
+// to the caller to skip them, so a node that flaps doesn't shuffle ownership. Nodes that
+// are dead, have left or are being drained own nothing.
+func (cm *ClusterManager) GetNodesForKey(key string, count int) []*Node {
+	cm.mutex.RLock()
+	var candidates []*Node
+	for _, node := range cm.nodes {
+		if node.Status != StatusDead && node.Status != StatusLeft && node.Drain == "" {
+			candidates = append(candidates, node)
+		}
+	}
+	cm.mutex.RUnlock()
+
+	scores := make(map[string]uint64, len(candidates))
+	for _, node := range candidates {
+		scores[node.ID] = keyScore(node.ID, key)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if scores[a.ID] != scores[b.ID] {
+			return scores[a.ID] > scores[b.ID]
+		}
+		return a.ID < b.ID
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// keyScore is nodeID's score for key in GetNodesForKey
+func keyScore(nodeID, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(nodeID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// FNV mixes the last bytes poorly, so finish it off with a 64-bit mixer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
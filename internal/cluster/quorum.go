@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// What a node cut off from most of the cluster does with writes, see SetPartitionWrites
+const (
+	PartitionReject = "reject" // turned away with 503
+	PartitionAccept = "accept" // taken, and flagged as written while degraded
+)
+
+// Kinds of Event for this node losing and regaining sight of enough of the cluster
+const (
+	EventQuorumLost     = "quorum_lost"
+	EventQuorumRegained = "quorum_regained"
+)
+
+// ValidatePartitionWrites checks a policy as SetPartitionWrites takes it
+func ValidatePartitionWrites(policy string) error {
+	switch policy {
+	case PartitionReject, PartitionAccept:
+		return nil
+	}
+	return fmt.Errorf("unknown partition write policy %q (want %s or %s)", policy, PartitionReject, PartitionAccept)
+}
+
+// quorum is whether this node sees enough of the cluster to take writes, see Degraded
+type quorum struct {
+	mutex    sync.Mutex
+	policy   string
+	degraded bool
+	since    time.Time
+	visible  int
+	members  int
+	flagged  int64 // writes taken while degraded
+}
+
+// QuorumStatus is what this node sees of the cluster, for ClusterStats and /health
+type QuorumStatus struct {
+	Degraded bool       `json:"degraded"`
+	Since    *time.Time `json:"since,omitempty"` // when it was last degraded or recovered
+	Visible  int        `json:"visible"`         // healthy nodes, this one included
+	Members  int        `json:"members"`         // nodes that haven't left or died
+	Needed   int        `json:"needed"`
+	Policy   string     `json:"policy"`
+	// FlaggedWrites counts the writes taken while degraded under PartitionAccept, which
+	// may have to be reconciled with the rest of the cluster
+	FlaggedWrites int64 `json:"flagged_writes"`
+}
+
+// SetPartitionWrites sets what this node does with writes while it is degraded, see
+// PartitionReject and PartitionAccept
+func (cm *ClusterManager) SetPartitionWrites(policy string) {
+	cm.quorum.mutex.Lock()
+	defer cm.quorum.mutex.Unlock()
+	cm.quorum.policy = policy
+}
+
+// quorumNeeded is how many of members a node has to see to take writes: half of them,
+// rounded up
+func quorumNeeded(members int) int {
+	return (members + 1) / 2
+}
+
+// checkQuorum works out again whether this node sees enough of the cluster, recording an
+// event when that changes. Nodes that have left or died don't count, as they went on
+// purpose or were given up on; unhealthy ones do, as the last known membership.
+func (cm *ClusterManager) checkQuorum() {
+	cm.mutex.RLock()
+	members, visible := 0, 0
+	for _, node := range cm.nodes {
+		if node.Status == StatusLeft || node.Status == StatusDead {
+			continue
+		}
+		members++
+		if node.Status == "healthy" || node.ID == cm.currentNode.ID {
+			visible++
+		}
+	}
+	self := cm.currentNode.ID
+	cm.mutex.RUnlock()
+
+	needed := quorumNeeded(members)
+	degraded := visible < needed
+
+	cm.quorum.mutex.Lock()
+	cm.quorum.visible, cm.quorum.members = visible, members
+	changed := degraded != cm.quorum.degraded
+	if changed {
+		cm.quorum.degraded = degraded
+		cm.quorum.since = time.Now()
+	}
+	cm.quorum.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	reason := fmt.Sprintf("sees %d of %d nodes, %d needed", visible, members, needed)
+	event := Event{Time: time.Now(), Type: EventQuorumRegained, NodeID: self, Reason: reason}
+	if degraded {
+		event.Type = EventQuorumLost
+		log.Printf("Degraded, likely cut off from the rest of the cluster: %s", reason)
+	} else {
+		log.Printf("No longer degraded: %s", reason)
+	}
+	cm.events.record(event)
+}
+
+// Degraded reports whether this node sees too little of the cluster to be sure it isn't
+// on the minority side of a partition, and what it is to do with writes meanwhile
+func (cm *ClusterManager) Degraded() (degraded bool, policy string) {
+	cm.quorum.mutex.Lock()
+	defer cm.quorum.mutex.Unlock()
+	return cm.quorum.degraded, cm.quorum.policy
+}
+
+// FlagWrite counts a write taken while degraded
+func (cm *ClusterManager) FlagWrite() {
+	cm.quorum.mutex.Lock()
+	defer cm.quorum.mutex.Unlock()
+	cm.quorum.flagged++
+}
+
+// GetQuorumStatus reports what this node sees of the cluster
+func (cm *ClusterManager) GetQuorumStatus() QuorumStatus {
+	cm.quorum.mutex.Lock()
+	defer cm.quorum.mutex.Unlock()
+	status := QuorumStatus{
+		Degraded:      cm.quorum.degraded,
+		Visible:       cm.quorum.visible,
+		Members:       cm.quorum.members,
+		Needed:        quorumNeeded(cm.quorum.members),
+		Policy:        cm.quorum.policy,
+		FlaggedWrites: cm.quorum.flagged,
+	}
+	if !cm.quorum.since.IsZero() {
+		since := cm.quorum.since
+		status.Since = &since
+	}
+	return status
+}
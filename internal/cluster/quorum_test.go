@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+// partitionedCluster is node-1 with a peer for each of ids, healthy to begin with, pinged
+// with a short timeout and given up on after one failed ping
+func partitionedCluster(t *testing.T, ids ...string) (*ClusterManager, map[string]*peer) {
+	t.Helper()
+	peers := make(map[string]*peer)
+	var nodes []*Node
+	for _, id := range ids {
+		peers[id] = newPeer(t)
+		nodes = append(nodes, &Node{ID: id, Address: peers[id].address()})
+	}
+	cm := newTestCluster(t, nodes...)
+	cm.SetHealthCheck(50*time.Millisecond, time.Hour, 1, 1)
+	return cm, peers
+}
+
+// cut has peers stop answering, as if on the other side of a partition, or answer again
+func cut(peers map[string]*peer, cut bool, ids ...string) {
+	for _, id := range ids {
+		if cut {
+			peers[id].delay.Store(int64(time.Minute))
+		} else {
+			peers[id].delay.Store(0)
+		}
+	}
+}
+
+func quorumEvents(cm *ClusterManager) []string {
+	var types []string
+	for _, event := range cm.Events(time.Time{}, 0) {
+		if event.Type == EventQuorumLost || event.Type == EventQuorumRegained {
+			types = append(types, event.Type)
+		}
+	}
+	return types
+}
+
+func TestQuorumLostOnTheMinoritySide(t *testing.T) {
+	cm, peers := partitionedCluster(t, "node-2", "node-3", "node-4", "node-5")
+
+	// Cut off from two of the other four, it still sees three of five
+	cut(peers, true, "node-4", "node-5")
+	cm.performHealthCheck()
+	if degraded, _ := cm.Degraded(); degraded {
+		t.Fatalf("degraded seeing %+v", cm.GetQuorumStatus())
+	}
+
+	// From three, it is in the minority
+	cut(peers, true, "node-3")
+	cm.performHealthCheck()
+	status := cm.GetQuorumStatus()
+	if !status.Degraded || status.Visible != 2 || status.Members != 5 || status.Needed != 3 || status.Since == nil {
+		t.Fatalf("quorum = %+v, want degraded seeing 2 of 5 with 3 needed", status)
+	}
+	if stats := cm.GetClusterStats(); !stats.Quorum.Degraded {
+		t.Errorf("stats quorum = %+v, want degraded", stats.Quorum)
+	}
+
+	// Still cut off, it doesn't say so again
+	cm.performHealthCheck()
+	if events := quorumEvents(cm); len(events) != 1 || events[0] != EventQuorumLost {
+		t.Errorf("events %v, want %s once", events, EventQuorumLost)
+	}
+
+	// Once the partition heals it takes writes again
+	cut(peers, false, "node-3", "node-4", "node-5")
+	cm.performHealthCheck()
+	if status := cm.GetQuorumStatus(); status.Degraded || status.Visible != 5 {
+		t.Errorf("after the partition healed quorum = %+v, want all 5 seen", status)
+	}
+	if events := quorumEvents(cm); len(events) != 2 || events[1] != EventQuorumRegained {
+		t.Errorf("events %v, want %s after %s", events, EventQuorumRegained, EventQuorumLost)
+	}
+}
+
+func TestQuorumIgnoresNodesThatLeftOrDied(t *testing.T) {
+	cm, peers := partitionedCluster(t, "node-2", "node-3")
+	for _, node := range []*Node{
+		{ID: "node-4", Address: "127.0.0.1:2", Status: StatusDead},
+		{ID: "node-5", Address: "127.0.0.1:2", Status: StatusDead},
+		{ID: "node-6", Address: "127.0.0.1:2", Status: StatusLeft},
+	} {
+		if err := cm.RegisterNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two of the three members is enough, however many nodes went away on purpose
+	cut(peers, true, "node-3")
+	cm.performHealthCheck()
+	status := cm.GetQuorumStatus()
+	if status.Degraded || status.Members != 3 || status.Needed != 2 {
+		t.Fatalf("quorum = %+v, want 2 of 3 seen and not degraded", status)
+	}
+
+	// Alone it isn't
+	cut(peers, true, "node-2")
+	cm.performHealthCheck()
+	if status := cm.GetQuorumStatus(); !status.Degraded || status.Visible != 1 {
+		t.Errorf("quorum = %+v, want degraded seeing only itself", status)
+	}
+}
+
+func TestPartitionWrites(t *testing.T) {
+	cm, _ := partitionedCluster(t)
+	if _, policy := cm.Degraded(); policy != PartitionReject {
+		t.Errorf("default policy %q, want %q", policy, PartitionReject)
+	}
+	cm.SetPartitionWrites(PartitionAccept)
+	cm.FlagWrite()
+	if status := cm.GetQuorumStatus(); status.Policy != PartitionAccept || status.FlaggedWrites != 1 {
+		t.Errorf("quorum = %+v, want accept with 1 flagged write", status)
+	}
+	if err := ValidatePartitionWrites("ignore"); err == nil {
+		t.Error("took an unknown policy")
+	}
+}
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"runtime/debug"
+	"slices"
+)
+
+// UnknownVersion is what nodes that don't say which version they run are counted under
+const UnknownVersion = "unknown"
+
+// BuildVersion is the version of this binary as the Go toolchain recorded it: the module
+// version, or failing that the commit it was built from
+func BuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return UnknownVersion
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// SetBuild sets the version this node runs and the optional features it understands, for
+// the others to see in its registration, gossip and heartbeats. Call it before joining.
+func (cm *ClusterManager) SetBuild(version string, capabilities []string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.currentNode.Version = version
+	cm.currentNode.Capabilities = append([]string(nil), capabilities...)
+}
+
+// HasCapability reports whether the node has said it understands capability. Nodes from
+// before capabilities were advertised say nothing, see AdvertisesCapabilities.
+func (n *Node) HasCapability(capability string) bool {
+	return slices.Contains(n.Capabilities, capability)
+}
+
+// AdvertisesCapabilities reports whether the node says what it understands at all, which
+// nodes older than that don't
+func (n *Node) AdvertisesCapabilities() bool {
+	return len(n.Capabilities) > 0
+}
@@ -0,0 +1,365 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/accesslog"
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/ml"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// Config is the full server configuration. Values are resolved in order of increasing
+// precedence: built-in defaults, the config file, DSS_* environment variables, then flags.
+type Config struct {
+	Server      ServerConfig      `json:"server"`
+	Storage     StorageConfig     `json:"storage"`
+	Cluster     ClusterConfig     `json:"cluster"`
+	Replication ReplicationConfig `json:"replication"`
+	Auth        AuthConfig        `json:"auth"`
+	Tiering     TieringConfig     `json:"tiering"`
+	Shadow      shadow.Settings   `json:"shadow"`
+}
+
+type ServerConfig struct {
+	Port            string   `json:"port"`
+	TLSCert         string   `json:"tls_cert"`
+	TLSKey          string   `json:"tls_key"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"` // how long components get to stop cleanly
+	RateLimit       float64  `json:"rate_limit"`       // requests per second across all clients, 0 = unlimited
+	RateBurst       int      `json:"rate_burst"`
+}
+
+type StorageConfig struct {
+	Path              string   `json:"path"`
+	QuotaBytes        int64    `json:"quota_bytes"`        // 0 = unlimited
+	Fsync             bool     `json:"fsync"`              // fsync data files before acknowledging writes
+	ChecksumAlgorithm string   `json:"checksum_algorithm"` // default for PUTs without X-Checksum-Algorithm
+	UploadTTL         Duration `json:"upload_ttl"`         // incomplete resumable uploads are reaped after this long idle
+	Versioning        bool     `json:"versioning"`         // keep previous versions on overwrite and delete
+	Dedup             bool     `json:"dedup"`              // store identical content once, shared between keys
+	ExpirySweep       Duration `json:"expiry_sweep"`       // how often expired objects are deleted
+	VerifyReads       bool     `json:"verify_reads"`       // hash whole-object reads, failing them on a checksum mismatch
+	ScrubInterval     Duration `json:"scrub_interval"`     // how often every object is rehashed in the background
+	GCInterval        Duration `json:"gc_interval"`        // how often unreferenced data files are cleaned up
+	GCGrace           Duration `json:"gc_grace"`           // how old an unreferenced data file must be before it goes
+	CacheBytes        int64    `json:"cache_bytes"`        // memory for caching small objects' data, 0 = no cache
+	CacheMaxObject    int64    `json:"cache_max_object"`   // largest object the cache takes, in bytes
+
+	// OwnerQuotaBytes caps the bytes each owner listed may hold, within QuotaBytes; owners
+	// not listed, or given 0, are limited by QuotaBytes alone
+	OwnerQuotaBytes map[string]int64 `json:"owner_quota_bytes"`
+
+	// Backend is where objects live: file (under Path), s3, or tiered, where each tier's
+	// objects go to the backend TierBackends names for it. Path holds local state like
+	// usage and uploads either way.
+	Backend      string            `json:"backend"`
+	S3           storage.S3Config  `json:"s3"`
+	TierBackends map[string]string `json:"tier_backends"` // by tier, file or s3
+
+	// Tiers can keep their data files in directories of their own, such as fast disks for
+	// hot and cheap ones for cold; empty means under Path. GC treats everything in them as
+	// the store's, so they mustn't be shared.
+	HotDir  string `json:"hot_dir"`
+	WarmDir string `json:"warm_dir"`
+	ColdDir string `json:"cold_dir"`
+
+	// MetadataBackend keeps the file backend's catalog in JSON files (json) or in an
+	// embedded database (kv). Switching an existing store needs --migrate-metadata.
+	MetadataBackend string `json:"metadata_backend"`
+
+	// EncryptionKeys are master keys for encryption at rest, id:base64-key, oldest first;
+	// the last one encrypts new writes. Without any, data is stored in plaintext.
+	EncryptionKeys []string `json:"encryption_keys" secret:"true"`
+}
+
+type ClusterConfig struct {
+	NodeID              string   `json:"node_id"`
+	Address             string   `json:"address"`
+	Peers               []string `json:"peers"`
+	HealthCheckInterval Duration `json:"health_check_interval"`
+	CatalogSyncInterval Duration `json:"catalog_sync_interval"` // how often peers' catalogs are pulled
+	// Pings time out after HealthCheckTimeout. A node takes HealthCheckFailures failed ones
+	// in a row to be taken for unhealthy, or not being heard from for StaleAfter, and
+	// HealthCheckSuccesses good ones to be taken back.
+	HealthCheckTimeout   Duration `json:"health_check_timeout"`
+	StaleAfter           Duration `json:"stale_after"`
+	HealthCheckFailures  int      `json:"health_check_failures"`
+	HealthCheckSuccesses int      `json:"health_check_successes"`
+	// Every GossipInterval the node swaps its node table with GossipFanout others
+	GossipInterval Duration `json:"gossip_interval"`
+	GossipFanout   int      `json:"gossip_fanout"`
+	// HeartbeatInterval is how often the node pushes its usage to the others
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	// Nodes not heard from for DeadAfter are taken for dead and their copies re-made
+	// elsewhere; ones not heard from for RemoveAfter are forgotten
+	DeadAfter   Duration `json:"dead_after"`
+	RemoveAfter Duration `json:"remove_after"`
+	// The latest EventLogSize membership events are kept in memory for /cluster/events, and
+	// all of them in a file under the storage path, rotated at EventLogMaxBytes with
+	// EventLogFiles older ones kept
+	EventLogSize     int   `json:"event_log_size"`
+	EventLogMaxBytes int64 `json:"event_log_max_bytes"`
+	EventLogFiles    int   `json:"event_log_files"`
+	// Zone and Rack are where this node runs; copies of an object are spread over as many
+	// zones as there are, then racks
+	Zone string `json:"zone"`
+	Rack string `json:"rack"`
+	// Capacity is the bytes this node tells the others it has room for, instead of the size
+	// of the disk under the storage path; for disks shared with other things. 0 detects it.
+	Capacity int64 `json:"capacity"`
+	// With Forwarding, requests for objects this node doesn't own or hold are passed on to
+	// the nodes that do instead of being answered here
+	Forwarding bool `json:"forwarding"`
+	// PartitionWrites is what the node does with writes while it sees fewer than half of
+	// the cluster, likely cut off from the rest: reject them with 503, or accept them
+	// flagged as written while degraded
+	PartitionWrites string `json:"partition_writes"`
+}
+
+type ReplicationConfig struct {
+	Factor int `json:"factor"`
+	// MaxFactor caps the factor a PUT can ask for its object with X-Replication-Factor
+	MaxFactor int `json:"max_factor"`
+	// Copies are made by Concurrency workers from a queue of QueueSize. When it is full a
+	// write waits for room, or with QueueFull "async" leaves its copies to be queued later.
+	Concurrency int    `json:"concurrency"`
+	QueueSize   int    `json:"queue_size"`
+	QueueFull   string `json:"queue_full"`
+	Throttle    int64  `json:"throttle"` // bytes per second, 0 = unlimited
+	// Copies of at least CompressionMinSize bytes are sent in Compression (gzip or none)
+	// to nodes that take it, unless their content type is one of UncompressedTypes
+	Compression        string   `json:"compression"`
+	CompressionMinSize int64    `json:"compression_min_size"`
+	UncompressedTypes  []string `json:"uncompressed_types"`
+	// A target that fails for a reason worth retrying is tried up to MaxAttempts times,
+	// RetryDelay apart and doubling each time, for no longer than MaxElapsed
+	MaxAttempts int      `json:"max_attempts"`
+	RetryDelay  Duration `json:"retry_delay"`
+	MaxElapsed  Duration `json:"max_elapsed"`
+	// WriteConsistency is how many copies a PUT waits for (1, quorum or all) unless it
+	// asks otherwise, for up to WriteTimeout. Short of them it fails with 503 when
+	// StrictWrites is set and is accepted with 202 when not.
+	WriteConsistency string   `json:"write_consistency"`
+	WriteTimeout     Duration `json:"write_timeout"`
+	StrictWrites     bool     `json:"strict_writes"`
+	// A replication task that reaches fewer than MinSuccess targets (a number, quorum or
+	// all) is partial and left to the repair loop; with StrictWrites the PUT fails as well
+	MinSuccess string `json:"min_success"`
+	// Objects short of Factor copies are found every RepairInterval and copied again,
+	// at no more than RepairThrottle bytes per second (0 = unlimited)
+	RepairInterval Duration `json:"repair_interval"`
+	RepairThrottle int64    `json:"repair_throttle"`
+	// A rebalance, started at /admin/rebalance, moves copies off nodes more than
+	// RebalanceThreshold (a fraction of capacity) fuller than average, at no more than
+	// RebalanceRate objects and RebalanceThrottle bytes per second (0 = unlimited)
+	RebalanceRate      float64 `json:"rebalance_rate"`
+	RebalanceThrottle  int64   `json:"rebalance_throttle"`
+	RebalanceThreshold float64 `json:"rebalance_threshold"`
+	// With Failover, the copies a node held are made again elsewhere once it has been
+	// unhealthy for FailoverGrace
+	Failover      bool     `json:"failover"`
+	FailoverGrace Duration `json:"failover_grace"`
+	// SyncOnStart pulls from the other nodes, once joined, the objects written while this
+	// one was away
+	SyncOnStart bool `json:"sync_on_start"`
+	// Finished tasks are kept for TaskTTL, failed ones for FailedTaskTTL unless acknowledged,
+	// and no more than MaxTasks of them
+	TaskTTL       Duration `json:"task_ttl"`
+	FailedTaskTTL Duration `json:"failed_task_ttl"`
+	MaxTasks      int      `json:"max_tasks"`
+}
+
+type AuthConfig struct {
+	APIKeys []string `json:"api_keys" secret:"true"`
+	// ClusterSecret is the comma-separated tokens nodes have to send each other, the first
+	// one sent; empty leaves the node-to-node endpoints open
+	ClusterSecret string `json:"cluster_secret" secret:"true"`
+}
+
+type TieringConfig struct {
+	Rules ml.TieringRules `json:"rules"`
+	// AccessRetention is how long the accesses the classifier learns from are kept on disk
+	AccessRetention Duration          `json:"access_retention"`
+	Auto            AutoTieringConfig `json:"auto"`
+}
+
+// AutoTieringConfig is the background job moving objects to the tiers the classifier
+// recommends. It starts out in dry run, only recording what it would move.
+type AutoTieringConfig struct {
+	Enabled       bool     `json:"enabled"`
+	DryRun        bool     `json:"dry_run"`
+	Interval      Duration `json:"interval"`
+	MinConfidence float64  `json:"min_confidence"` // recommendations less sure are left alone
+	MaxObjects    int      `json:"max_objects"`    // moved per run
+	MaxBytes      int64    `json:"max_bytes"`      // moved per run
+	// PreloadBytes is how much of the objects expected to be read within PrefetchHorizon
+	// a run may read into the cache ahead of time, 0 for none
+	PreloadBytes    int64    `json:"preload_bytes"`
+	PrefetchHorizon Duration `json:"prefetch_horizon"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Plain numbers are taken as seconds
+		var seconds float64
+		if err := json.Unmarshal(data, &seconds); err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		d.Duration = time.Duration(seconds * float64(time.Second))
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d *Duration) Set(s string) error {
+	if parsed, err := time.ParseDuration(s); err == nil {
+		d.Duration = parsed
+		return nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration = time.Duration(seconds * float64(time.Second))
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            "8080",
+			ShutdownTimeout: Duration{30 * time.Second},
+			RateBurst:       100,
+		},
+		Storage: StorageConfig{
+			Backend:           "file",
+			MetadataBackend:   storage.MetadataJSON,
+			Path:              "./data",
+			ChecksumAlgorithm: "sha256",
+			UploadTTL:         Duration{24 * time.Hour},
+			ExpirySweep:       Duration{time.Minute},
+			ScrubInterval:     Duration{24 * time.Hour},
+			GCInterval:        Duration{time.Hour},
+			GCGrace:           Duration{time.Hour},
+			CacheBytes:        128 << 20,
+			CacheMaxObject:    256 << 10,
+
+			TierBackends: map[string]string{
+				storage.TierHot:  "file",
+				storage.TierWarm: "file",
+				storage.TierCold: "s3",
+			},
+		},
+		Cluster: ClusterConfig{
+			HealthCheckInterval:  Duration{30 * time.Second},
+			HealthCheckTimeout:   Duration{5 * time.Second},
+			StaleAfter:           Duration{2 * time.Minute},
+			HealthCheckFailures:  3,
+			HealthCheckSuccesses: 2,
+			CatalogSyncInterval:  Duration{10 * time.Second},
+			GossipInterval:       Duration{10 * time.Second},
+			GossipFanout:         3,
+			HeartbeatInterval:    Duration{10 * time.Second},
+			DeadAfter:            Duration{30 * time.Minute},
+			RemoveAfter:          Duration{24 * time.Hour},
+			EventLogSize:         1000,
+			EventLogMaxBytes:     10 << 20,
+			EventLogFiles:        3,
+			PartitionWrites:      cluster.PartitionReject,
+		},
+		Replication: ReplicationConfig{
+			Factor:      2,
+			MaxFactor:   5,
+			Concurrency: 8,
+			QueueSize:   1024,
+			QueueFull:   "wait",
+			MaxAttempts: 5,
+			RetryDelay:  Duration{500 * time.Millisecond},
+			MaxElapsed:  Duration{2 * time.Minute},
+
+			WriteConsistency: "1",
+			WriteTimeout:     Duration{10 * time.Second},
+			MinSuccess:       "1",
+
+			Compression:        replication.CompressionNone,
+			CompressionMinSize: replication.DefaultCompressionMinSize,
+			UncompressedTypes:  append([]string(nil), replication.DefaultUncompressedTypes...),
+
+			RepairInterval: Duration{10 * time.Minute},
+			RepairThrottle: 8 * 1024 * 1024,
+			Failover:       true,
+			FailoverGrace:  Duration{5 * time.Minute},
+			TaskTTL:        Duration{time.Hour},
+			FailedTaskTTL:  Duration{24 * time.Hour},
+			MaxTasks:       10000,
+
+			RebalanceRate:      10,
+			RebalanceThrottle:  8 * 1024 * 1024,
+			RebalanceThreshold: 0.1,
+		},
+		Tiering: TieringConfig{
+			Rules:           ml.NewDataClassifier().Rules(),
+			AccessRetention: Duration{accesslog.DefaultRetention},
+			Auto: AutoTieringConfig{
+				DryRun:        true,
+				Interval:      Duration{time.Hour},
+				MinConfidence: 0.8,
+				MaxObjects:    100,
+				MaxBytes:      1024 * 1024 * 1024,
+
+				PrefetchHorizon: Duration{time.Hour},
+			},
+		},
+		Shadow: shadow.Settings{
+			MaxConcurrency: 16,
+			MaxBodyBytes:   16 * 1024 * 1024,
+		},
+	}
+}
+
+// Load reads the config file at path on top of the defaults and applies environment
+// overrides. An empty path skips the file.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields() // a typo'd key should fail, not silently fall back to a default
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "DSS"
+
+// FieldError reports a configuration value that failed to parse or validate
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// applyEnv overrides config fields from environment variables named after their JSON path,
+// e.g. server.port -> DSS_SERVER_PORT. List values are comma-separated.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	return walkFields(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.Value, _ reflect.StructField) error {
+		name := envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+		value, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		if err := setField(field, value); err != nil {
+			return &FieldError{Field: path, Reason: fmt.Sprintf("invalid value in %s: %v", name, err)}
+		}
+		return nil
+	})
+}
+
+// walkFields calls fn for every leaf field, passing its dotted JSON path
+func walkFields(v reflect.Value, prefix string, fn func(path string, field reflect.Value, info reflect.StructField) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		info := t.Field(i)
+		if !info.IsExported() {
+			continue
+		}
+
+		name := strings.Split(info.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			if err := walkFields(field, path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(path, field, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		return field.Addr().Interface().(*Duration).Set(value)
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with every field tagged secret masked
+func (c *Config) Redacted() *Config {
+	clone := *c
+	walkFields(reflect.ValueOf(&clone).Elem(), "", func(_ string, field reflect.Value, info reflect.StructField) error {
+		if info.Tag.Get("secret") != "true" {
+			return nil
+		}
+		switch field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				field.SetString("REDACTED")
+			}
+		case reflect.Slice:
+			masked := make([]string, field.Len())
+			for i := range masked {
+				masked[i] = "REDACTED"
+			}
+			field.Set(reflect.ValueOf(masked))
+		}
+		return nil
+	})
+	return &clone
+}
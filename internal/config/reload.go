@@ -0,0 +1,150 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Reloader re-reads the config file and hands changed settings to the subsystems that can
+// take them without a restart. Settings nobody has registered for keep their running
+// value and are reported as needing a restart.
+type Reloader struct {
+	path     string
+	override func(*Config) // re-applies command-line flags, which outrank the file
+
+	mutex    sync.Mutex // one reload at a time
+	current  *Config
+	handlers []reloadHandler
+}
+
+type reloadHandler struct {
+	prefixes []string
+	apply    func(*Config)
+}
+
+// ReloadResult lists the dotted paths of the settings that changed
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+func NewReloader(path string, running *Config, override func(*Config)) *Reloader {
+	return &Reloader{path: path, override: override, current: running}
+}
+
+// OnChange registers apply to be called with the new config whenever a setting under one
+// of prefixes (e.g. "tiering" or "server.rate_limit") changes. apply receives the whole
+// config and should swap its subsystem's settings in one step.
+func (r *Reloader) OnChange(prefixes []string, apply func(*Config)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers = append(r.handlers, reloadHandler{prefixes: prefixes, apply: apply})
+}
+
+// Current returns the effective running configuration. Callers must not modify it.
+func (r *Reloader) Current() *Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// Reload loads and validates the config file; if it is invalid nothing is applied
+func (r *Reloader) Reload() (*ReloadResult, error) {
+	next, err := Load(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.override != nil {
+		r.override(next)
+	}
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	var triggered []reloadHandler
+
+	for _, path := range diff(r.current, next) {
+		live := false
+		for _, h := range r.handlers {
+			if h.matches(path) {
+				live = true
+			}
+		}
+		if live {
+			result.Applied = append(result.Applied, path)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, path)
+		}
+	}
+
+	// What's running is the new config minus the settings only a restart can change
+	for _, path := range result.RestartRequired {
+		copyField(next, r.current, path)
+	}
+
+	for _, h := range r.handlers {
+		for _, path := range result.Applied {
+			if h.matches(path) {
+				triggered = append(triggered, h)
+				break
+			}
+		}
+	}
+	for _, h := range triggered {
+		h.apply(next)
+	}
+
+	r.current = next
+	return result, nil
+}
+
+func (h reloadHandler) matches(path string) bool {
+	for _, prefix := range h.prefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diff returns the dotted paths of the leaf settings that differ between a and b
+func diff(a, b *Config) []string {
+	values := make(map[string]reflect.Value)
+	walkFields(reflect.ValueOf(a).Elem(), "", func(path string, field reflect.Value, _ reflect.StructField) error {
+		values[path] = field
+		return nil
+	})
+
+	var changed []string
+	walkFields(reflect.ValueOf(b).Elem(), "", func(path string, field reflect.Value, _ reflect.StructField) error {
+		if !reflect.DeepEqual(values[path].Interface(), field.Interface()) {
+			changed = append(changed, path)
+		}
+		return nil
+	})
+	sort.Strings(changed)
+	return changed
+}
+
+// copyField sets the setting at path in dst to its value in src
+func copyField(dst, src *Config, path string) {
+	var value reflect.Value
+	walkFields(reflect.ValueOf(src).Elem(), "", func(p string, field reflect.Value, _ reflect.StructField) error {
+		if p == path {
+			value = field
+		}
+		return nil
+	})
+	walkFields(reflect.ValueOf(dst).Elem(), "", func(p string, field reflect.Value, _ reflect.StructField) error {
+		if p == path {
+			field.Set(value)
+		}
+		return nil
+	})
+}
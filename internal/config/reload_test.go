@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"server": {"port": "8080", "rate_limit": 10, "rate_burst": 5}}`)
+	running, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := NewReloader(path, running, nil)
+
+	var limits []float64
+	reloader.OnChange([]string{"server.rate_limit", "server.rate_burst"}, func(c *Config) {
+		limits = append(limits, c.Server.RateLimit)
+	})
+	var checksums int
+	reloader.OnChange([]string{"storage.checksum_algorithm"}, func(c *Config) { checksums++ })
+
+	// Unchanged, nothing is applied
+	result, err := reloader.Reload()
+	if err != nil || len(result.Applied) != 0 || len(result.RestartRequired) != 0 || len(limits) != 0 {
+		t.Fatalf("reloading the same file = %+v (%v), applied %v", result, err, limits)
+	}
+
+	writeConfig(t, path, `{"server": {"port": "9090", "rate_limit": 2, "rate_burst": 1}}`)
+	result, err = reloader.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(result.Applied, ","); got != "server.rate_burst,server.rate_limit" {
+		t.Errorf("applied %s, want the rate limit and burst", got)
+	}
+	if got := strings.Join(result.RestartRequired, ","); got != "server.port" {
+		t.Errorf("restart required for %s, want server.port", got)
+	}
+	// Both settings reach the limiter in one call
+	if len(limits) != 1 || limits[0] != 2 || checksums != 0 {
+		t.Errorf("rate limits applied %v and checksums %d times, want [2] and none", limits, checksums)
+	}
+	current := reloader.Current()
+	if current.Server.RateLimit != 2 || current.Server.RateBurst != 1 || current.Server.Port != "8080" {
+		t.Errorf("running config %+v, want the new limits on the old port", current.Server)
+	}
+
+	// A file that doesn't parse or validate changes nothing
+	for _, bad := range []string{
+		`{"server": {"rate_limit": 100`,
+		`{"server": {"rate_limit": 100, "rate_limt": 1}}`,
+		`{"server": {"rate_limit": -1}}`,
+	} {
+		writeConfig(t, path, bad)
+		if _, err := reloader.Reload(); err == nil {
+			t.Errorf("reloaded %s", bad)
+		}
+	}
+	if len(limits) != 1 || reloader.Current().Server.RateLimit != 2 {
+		t.Errorf("a bad file applied rate limits %v", limits)
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"strconv"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/replication"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// Validate checks every section and returns a *FieldError naming the first bad field
+func (c *Config) Validate() error {
+	port, err := strconv.Atoi(c.Server.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return &FieldError{Field: "server.port", Reason: "must be a number between 1 and 65535"}
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return &FieldError{Field: "server.tls_cert", Reason: "tls_cert and tls_key must be set together"}
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		return &FieldError{Field: "server.shutdown_timeout", Reason: "must be positive"}
+	}
+	if c.Server.RateLimit < 0 {
+		return &FieldError{Field: "server.rate_limit", Reason: "must be non-negative"}
+	}
+	if c.Server.RateBurst < 1 {
+		return &FieldError{Field: "server.rate_burst", Reason: "must be at least 1"}
+	}
+
+	usesS3 := false
+	switch c.Storage.Backend {
+	case "file":
+	case "s3":
+		usesS3 = true
+	case "tiered":
+		for _, tier := range []string{storage.TierHot, storage.TierWarm, storage.TierCold} {
+			switch c.Storage.TierBackends[tier] {
+			case "file":
+			case "s3":
+				usesS3 = true
+			default:
+				return &FieldError{Field: "storage.tier_backends." + tier, Reason: "must be file or s3 with the tiered backend"}
+			}
+		}
+	default:
+		return &FieldError{Field: "storage.backend", Reason: "must be file, s3 or tiered"}
+	}
+	if usesS3 && c.Storage.S3.Endpoint == "" {
+		return &FieldError{Field: "storage.s3.endpoint", Reason: "is required with the s3 backend"}
+	}
+	if usesS3 && c.Storage.S3.Bucket == "" {
+		return &FieldError{Field: "storage.s3.bucket", Reason: "is required with the s3 backend"}
+	}
+	if c.Storage.MetadataBackend != storage.MetadataJSON && c.Storage.MetadataBackend != storage.MetadataKV {
+		return &FieldError{Field: "storage.metadata_backend", Reason: "must be json or kv"}
+	}
+	if c.Storage.Path == "" {
+		return &FieldError{Field: "storage.path", Reason: "must not be empty"}
+	}
+	if c.Storage.QuotaBytes < 0 {
+		return &FieldError{Field: "storage.quota_bytes", Reason: "must be non-negative"}
+	}
+	for owner, quota := range c.Storage.OwnerQuotaBytes {
+		if quota < 0 {
+			return &FieldError{Field: "storage.owner_quota_bytes." + owner, Reason: "must be non-negative"}
+		}
+	}
+	if c.Storage.CacheBytes < 0 {
+		return &FieldError{Field: "storage.cache_bytes", Reason: "must be non-negative"}
+	}
+	if c.Storage.CacheMaxObject < 0 {
+		return &FieldError{Field: "storage.cache_max_object", Reason: "must be non-negative"}
+	}
+	if err := storage.ValidateChecksumAlgorithm(c.Storage.ChecksumAlgorithm); err != nil {
+		return &FieldError{Field: "storage.checksum_algorithm", Reason: err.Error()}
+	}
+	if c.Storage.UploadTTL.Duration <= 0 {
+		return &FieldError{Field: "storage.upload_ttl", Reason: "must be positive"}
+	}
+	if c.Storage.ExpirySweep.Duration <= 0 {
+		return &FieldError{Field: "storage.expiry_sweep", Reason: "must be positive"}
+	}
+	if c.Storage.ScrubInterval.Duration <= 0 {
+		return &FieldError{Field: "storage.scrub_interval", Reason: "must be positive"}
+	}
+	if c.Storage.GCInterval.Duration <= 0 {
+		return &FieldError{Field: "storage.gc_interval", Reason: "must be positive"}
+	}
+	if c.Storage.GCGrace.Duration <= 0 {
+		return &FieldError{Field: "storage.gc_grace", Reason: "must be positive"}
+	}
+	if _, err := storage.ParseMasterKeys(c.Storage.EncryptionKeys); err != nil {
+		return &FieldError{Field: "storage.encryption_keys", Reason: err.Error()}
+	}
+
+	if c.Cluster.HealthCheckInterval.Duration <= 0 {
+		return &FieldError{Field: "cluster.health_check_interval", Reason: "must be positive"}
+	}
+	if c.Cluster.HealthCheckTimeout.Duration <= 0 {
+		return &FieldError{Field: "cluster.health_check_timeout", Reason: "must be positive"}
+	}
+	if c.Cluster.StaleAfter.Duration <= c.Cluster.HealthCheckInterval.Duration {
+		return &FieldError{Field: "cluster.stale_after", Reason: "must be longer than cluster.health_check_interval"}
+	}
+	if c.Cluster.HealthCheckFailures < 1 {
+		return &FieldError{Field: "cluster.health_check_failures", Reason: "must be at least 1"}
+	}
+	if c.Cluster.HealthCheckSuccesses < 1 {
+		return &FieldError{Field: "cluster.health_check_successes", Reason: "must be at least 1"}
+	}
+	if c.Cluster.CatalogSyncInterval.Duration <= 0 {
+		return &FieldError{Field: "cluster.catalog_sync_interval", Reason: "must be positive"}
+	}
+	if c.Cluster.GossipInterval.Duration <= 0 {
+		return &FieldError{Field: "cluster.gossip_interval", Reason: "must be positive"}
+	}
+	if c.Cluster.GossipFanout < 1 {
+		return &FieldError{Field: "cluster.gossip_fanout", Reason: "must be at least 1"}
+	}
+	if c.Cluster.Capacity < 0 {
+		return &FieldError{Field: "cluster.capacity", Reason: "must be non-negative"}
+	}
+	if c.Cluster.HeartbeatInterval.Duration <= 0 {
+		return &FieldError{Field: "cluster.heartbeat_interval", Reason: "must be positive"}
+	}
+	if c.Cluster.DeadAfter.Duration <= 0 {
+		return &FieldError{Field: "cluster.dead_after", Reason: "must be positive"}
+	}
+	if c.Cluster.RemoveAfter.Duration <= c.Cluster.DeadAfter.Duration {
+		return &FieldError{Field: "cluster.remove_after", Reason: "must be longer than cluster.dead_after"}
+	}
+	if c.Cluster.EventLogSize < 1 {
+		return &FieldError{Field: "cluster.event_log_size", Reason: "must be at least 1"}
+	}
+	if c.Cluster.EventLogMaxBytes < 0 {
+		return &FieldError{Field: "cluster.event_log_max_bytes", Reason: "must be non-negative"}
+	}
+	if err := cluster.ValidatePartitionWrites(c.Cluster.PartitionWrites); err != nil {
+		return &FieldError{Field: "cluster.partition_writes", Reason: "must be reject or accept"}
+	}
+	if c.Cluster.EventLogFiles < 0 {
+		return &FieldError{Field: "cluster.event_log_files", Reason: "must be non-negative"}
+	}
+	for _, peer := range c.Cluster.Peers {
+		if peer == "" {
+			return &FieldError{Field: "cluster.peers", Reason: "must not contain empty addresses"}
+		}
+	}
+
+	if c.Replication.Factor < 0 {
+		return &FieldError{Field: "replication.factor", Reason: "must be non-negative"}
+	}
+	if c.Replication.MaxFactor < c.Replication.Factor {
+		return &FieldError{Field: "replication.max_factor", Reason: "must be at least replication.factor"}
+	}
+	if c.Replication.Concurrency < 1 {
+		return &FieldError{Field: "replication.concurrency", Reason: "must be at least 1"}
+	}
+	if c.Replication.QueueSize < 1 {
+		return &FieldError{Field: "replication.queue_size", Reason: "must be at least 1"}
+	}
+	if c.Replication.QueueFull != replication.QueueFullWait && c.Replication.QueueFull != replication.QueueFullAsync {
+		return &FieldError{Field: "replication.queue_full", Reason: "must be wait or async"}
+	}
+	if c.Replication.Throttle < 0 {
+		return &FieldError{Field: "replication.throttle", Reason: "must be non-negative"}
+	}
+	if err := replication.ValidateCompression(c.Replication.Compression); err != nil {
+		return &FieldError{Field: "replication.compression", Reason: "must be gzip or none"}
+	}
+	if c.Replication.CompressionMinSize < 0 {
+		return &FieldError{Field: "replication.compression_min_size", Reason: "must be non-negative"}
+	}
+	if c.Replication.MaxAttempts < 1 {
+		return &FieldError{Field: "replication.max_attempts", Reason: "must be at least 1"}
+	}
+	if c.Replication.RetryDelay.Duration <= 0 {
+		return &FieldError{Field: "replication.retry_delay", Reason: "must be positive"}
+	}
+	if c.Replication.MaxElapsed.Duration <= 0 {
+		return &FieldError{Field: "replication.max_elapsed", Reason: "must be positive"}
+	}
+	if _, err := replication.ParseConsistency(c.Replication.WriteConsistency); err != nil {
+		return &FieldError{Field: "replication.write_consistency", Reason: "must be 1, quorum or all"}
+	}
+	if _, err := replication.ParseSuccessPolicy(c.Replication.MinSuccess); err != nil {
+		return &FieldError{Field: "replication.min_success", Reason: "must be a positive number, quorum or all"}
+	}
+	if c.Replication.WriteTimeout.Duration <= 0 {
+		return &FieldError{Field: "replication.write_timeout", Reason: "must be positive"}
+	}
+	if c.Replication.RepairInterval.Duration <= 0 {
+		return &FieldError{Field: "replication.repair_interval", Reason: "must be positive"}
+	}
+	if c.Replication.RepairThrottle < 0 {
+		return &FieldError{Field: "replication.repair_throttle", Reason: "must be non-negative"}
+	}
+	if c.Replication.RebalanceRate < 0 {
+		return &FieldError{Field: "replication.rebalance_rate", Reason: "must be non-negative"}
+	}
+	if c.Replication.RebalanceThrottle < 0 {
+		return &FieldError{Field: "replication.rebalance_throttle", Reason: "must be non-negative"}
+	}
+	if c.Replication.RebalanceThreshold <= 0 || c.Replication.RebalanceThreshold >= 1 {
+		return &FieldError{Field: "replication.rebalance_threshold", Reason: "must be between 0 and 1"}
+	}
+	if c.Replication.FailoverGrace.Duration <= 0 {
+		return &FieldError{Field: "replication.failover_grace", Reason: "must be positive"}
+	}
+	if c.Replication.TaskTTL.Duration <= 0 {
+		return &FieldError{Field: "replication.task_ttl", Reason: "must be positive"}
+	}
+	if c.Replication.FailedTaskTTL.Duration <= 0 {
+		return &FieldError{Field: "replication.failed_task_ttl", Reason: "must be positive"}
+	}
+	if c.Replication.MaxTasks < 1 {
+		return &FieldError{Field: "replication.max_tasks", Reason: "must be at least 1"}
+	}
+
+	if err := c.Tiering.Rules.Validate(); err != nil {
+		return &FieldError{Field: "tiering.rules", Reason: err.Error()}
+	}
+	if c.Tiering.AccessRetention.Duration <= 0 {
+		return &FieldError{Field: "tiering.access_retention", Reason: "must be positive"}
+	}
+	if c.Tiering.Auto.Interval.Duration <= 0 {
+		return &FieldError{Field: "tiering.auto.interval", Reason: "must be positive"}
+	}
+	if c.Tiering.Auto.MinConfidence < 0 || c.Tiering.Auto.MinConfidence > 1 {
+		return &FieldError{Field: "tiering.auto.min_confidence", Reason: "must be between 0 and 1"}
+	}
+	if c.Tiering.Auto.MaxObjects < 1 {
+		return &FieldError{Field: "tiering.auto.max_objects", Reason: "must be at least 1"}
+	}
+	if c.Tiering.Auto.MaxBytes < 1 {
+		return &FieldError{Field: "tiering.auto.max_bytes", Reason: "must be positive"}
+	}
+	if c.Tiering.Auto.PreloadBytes < 0 {
+		return &FieldError{Field: "tiering.auto.preload_bytes", Reason: "must not be negative"}
+	}
+	if c.Tiering.Auto.PrefetchHorizon.Duration <= 0 {
+		return &FieldError{Field: "tiering.auto.prefetch_horizon", Reason: "must be positive"}
+	}
+
+	if err := c.Shadow.Validate(); err != nil {
+		return &FieldError{Field: "shadow", Reason: err.Error()}
+	}
+
+	return nil
+}
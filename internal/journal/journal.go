@@ -0,0 +1,245 @@
+// Package journal keeps an append-only, ordered record of every mutation on a node.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// FormatVersion is written into every record so readers can tell how to decode it
+const FormatVersion = 1
+
+const (
+	OpPut      = "put"
+	OpDelete   = "delete"
+	OpMetadata = "metadata"
+	OpTier     = "tier"
+)
+
+const (
+	filePrefix     = "journal-"
+	fileSuffix     = ".jsonl"
+	defaultMaxSize = 64 * 1024 * 1024
+)
+
+// Record is one committed mutation. Object holds the full metadata after the change
+// (nil for deletes) so the catalog can be rebuilt from the journal alone.
+type Record struct {
+	FormatVersion int                   `json:"v"`
+	Seq           uint64                `json:"seq"`
+	Timestamp     time.Time             `json:"ts"`
+	Op            string                `json:"op"`
+	Key           string                `json:"key"`
+	ObjectID      string                `json:"object_id"`
+	Checksum      string                `json:"checksum,omitempty"`
+	Actor         string                `json:"actor,omitempty"`
+	SizeDelta     int64                 `json:"size_delta"`
+	Object        *models.StorageObject `json:"object,omitempty"`
+}
+
+type Journal struct {
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	index   int
+	lastSeq uint64
+}
+
+// Open opens (or creates) the journal in dir and continues numbering after its last record
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	j := &Journal{dir: dir, maxSize: defaultMaxSize}
+
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		fmt.Sscanf(filepath.Base(last), filePrefix+"%06d"+fileSuffix, &j.index)
+
+		err := readFile(last, func(rec Record) bool {
+			j.lastSeq = rec.Seq
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := j.openSegment(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// SetMaxSize changes the size at which the journal rolls over to a new file
+func (j *Journal) SetMaxSize(bytes int64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.maxSize = bytes
+}
+
+// Append assigns the next sequence number to rec and writes it
+func (j *Journal) Append(rec Record) (uint64, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	rec.FormatVersion = FormatVersion
+	rec.Seq = j.lastSeq + 1
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode journal record: %v", err)
+	}
+	line = append(line, '\n')
+
+	if j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		j.file.Close()
+		j.index++
+		if err := j.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write journal record: %v", err)
+	}
+
+	j.lastSeq = rec.Seq
+	return rec.Seq, nil
+}
+
+func (j *Journal) LastSeq() uint64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.lastSeq
+}
+
+// ReadSince returns up to limit records with a sequence number greater than since
+// (limit <= 0 means no limit)
+func (j *Journal) ReadSince(since uint64, limit int) ([]Record, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return readDir(j.dir, since, limit)
+}
+
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+func (j *Journal) openSegment() error {
+	if j.index == 0 {
+		j.index = 1
+	}
+	path := filepath.Join(j.dir, fmt.Sprintf("%s%06d%s", filePrefix, j.index, fileSuffix))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat journal file: %v", err)
+	}
+
+	j.file = file
+	j.size = info.Size()
+	return nil
+}
+
+func listFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list journal: %v", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files) // zero-padded names sort in sequence order
+	return files, nil
+}
+
+func readDir(dir string, since uint64, limit int) ([]Record, error) {
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0)
+	for _, path := range files {
+		err := readFile(path, func(rec Record) bool {
+			if rec.Seq <= since {
+				return true
+			}
+			records = append(records, rec)
+			return limit <= 0 || len(records) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// readFile calls fn for each record in the file until fn returns false. A torn final
+// line (crash mid-append) is ignored.
+func readFile(path string, fn func(Record) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.FormatVersion > FormatVersion {
+			return fmt.Errorf("journal record %d has unsupported format version %d", rec.Seq, rec.FormatVersion)
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
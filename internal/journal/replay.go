@@ -0,0 +1,30 @@
+package journal
+
+import (
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Replay rebuilds the metadata catalog by applying every record in dir in order.
+// It returns the catalog and the sequence number of the last record applied.
+func Replay(dir string) (map[string]*models.StorageObject, uint64, error) {
+	records, err := readDir(dir, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	objects := make(map[string]*models.StorageObject)
+	var lastSeq uint64
+	for _, rec := range records {
+		switch rec.Op {
+		case OpDelete:
+			delete(objects, rec.Key)
+		default:
+			if rec.Object != nil {
+				objects[rec.Key] = rec.Object
+			}
+		}
+		lastSeq = rec.Seq
+	}
+
+	return objects, lastSeq, nil
+}
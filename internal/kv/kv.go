@@ -0,0 +1,427 @@
+// Package kv is a small embedded key-value store: named buckets of string keys, held in
+// memory and persisted as an append-only log of transactions in a single file.
+//
+// Every transaction is written as one checksummed record and synced before Update
+// returns, so after a crash a transaction is either there in full or not at all; a torn
+// record at the end of the file is cut off when it is next opened. The log is rewritten
+// as a snapshot once most of it is overwritten history.
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrTxNotWritable = errors.New("transaction is read-only")
+	ErrClosed        = errors.New("database is closed")
+)
+
+const (
+	opPut    = 1
+	opDelete = 2
+
+	headerSize = 8 // length and CRC of the payload
+
+	// Compact once the log is at least this big and over twice the size of the live data
+	compactMinSize = 4 * 1024 * 1024
+	// Snapshots are split into records of about this size
+	snapshotRecordSize = 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type DB struct {
+	path string
+
+	mutex   sync.RWMutex
+	file    *os.File // nil once closed
+	size    int64    // bytes of log
+	live    int64    // bytes the live data would take in a snapshot
+	buckets map[string]map[string][]byte
+}
+
+// Open opens the database at path, creating it if it doesn't exist
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	db := &DB{path: path, file: file, buckets: make(map[string]map[string][]byte)}
+	if err := db.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// replay loads every complete record and cuts off whatever follows the last one
+func (db *DB) replay() error {
+	reader := bufio.NewReader(db.file)
+	var offset int64
+	for {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Discarding the end of %s after %d bytes: %v", db.path, offset, err)
+			if err := db.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate database: %v", err)
+			}
+			break
+		}
+		if err := db.apply(payload); err != nil {
+			return fmt.Errorf("failed to load database at byte %d: %v", offset, err)
+		}
+		offset += headerSize + int64(len(payload))
+	}
+	if _, err := db.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	db.size = offset
+	return nil
+}
+
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("torn record header")
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	sum := binary.LittleEndian.Uint32(header[4:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("torn record")
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// apply replays the operations in one record
+func (db *DB) apply(payload []byte) error {
+	for len(payload) > 0 {
+		op := payload[0]
+		payload = payload[1:]
+		bucket, rest, err := readBytes(payload)
+		if err != nil {
+			return err
+		}
+		key, rest, err := readBytes(rest)
+		if err != nil {
+			return err
+		}
+		payload = rest
+		switch op {
+		case opPut:
+			var value []byte
+			if value, payload, err = readBytes(payload); err != nil {
+				return err
+			}
+			db.set(string(bucket), string(key), value)
+		case opDelete:
+			db.set(string(bucket), string(key), nil)
+		default:
+			return fmt.Errorf("unknown operation %d", op)
+		}
+	}
+	return nil
+}
+
+// set stores value under key, or removes key if value is nil
+func (db *DB) set(bucket, key string, value []byte) {
+	b := db.buckets[bucket]
+	if old, exists := b[key]; exists {
+		db.live -= entrySize(bucket, key, old)
+	}
+	if value == nil {
+		delete(b, key)
+		if len(b) == 0 {
+			delete(db.buckets, bucket)
+		}
+		return
+	}
+	if b == nil {
+		b = make(map[string][]byte)
+		db.buckets[bucket] = b
+	}
+	b[key] = value
+	db.live += entrySize(bucket, key, value)
+}
+
+func entrySize(bucket, key string, value []byte) int64 {
+	return int64(1 + 3*binary.MaxVarintLen32 + len(bucket) + len(key) + len(value))
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	n, used := binary.Uvarint(buf)
+	if used <= 0 || uint64(len(buf)-used) < n {
+		return nil, nil, fmt.Errorf("malformed record")
+	}
+	return buf[used : used+int(n)], buf[used+int(n):], nil
+}
+
+func appendOp(buf []byte, op byte, bucket, key string, value []byte) []byte {
+	buf = append(buf, op)
+	buf = binary.AppendUvarint(buf, uint64(len(bucket)))
+	buf = append(buf, bucket...)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	if op == opPut {
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func appendRecord(buf, payload []byte) []byte {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	return append(append(buf, header[:]...), payload...)
+}
+
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+	return fn(&Tx{db: db})
+}
+
+// Update runs fn in a read-write transaction. Its writes are committed together if fn
+// returns nil and discarded otherwise.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	tx := &Tx{db: db, writable: true, writes: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Close closes the database file. Transactions fail with ErrClosed afterwards.
+func (db *DB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return nil
+	}
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
+
+// compact replaces the log with a snapshot of the live data. The caller holds the lock.
+func (db *DB) compact() error {
+	tmp := db.path + ".compact"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	var buf, payload []byte
+	for _, bucket := range sortedKeys(db.buckets) {
+		b := db.buckets[bucket]
+		for _, key := range sortedKeys(b) {
+			payload = appendOp(payload, opPut, bucket, key, b[key])
+			if len(payload) >= snapshotRecordSize {
+				buf = appendRecord(buf, payload)
+				payload = payload[:0]
+			}
+		}
+	}
+	if len(payload) > 0 {
+		buf = appendRecord(buf, payload)
+	}
+	if _, err := out.Write(buf); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(db.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	file, err := os.OpenFile(db.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	db.file.Close()
+	db.file = file
+	db.size = int64(len(buf))
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Tx is a transaction. It sees its own writes; they reach the database, and other
+// transactions, when Update commits them.
+type Tx struct {
+	db       *DB
+	writable bool
+	writes   map[string]map[string][]byte // nil value = deleted
+	ops      []byte
+}
+
+// Get returns the value of key in bucket, or nil if there is none. The value must not be
+// modified.
+func (tx *Tx) Get(bucket, key string) []byte {
+	if value, written := tx.writes[bucket][key]; written {
+		return value
+	}
+	return tx.db.buckets[bucket][key]
+}
+
+// Put sets key in bucket to value, creating the bucket if needed
+func (tx *Tx) Put(bucket, key string, value []byte) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	tx.write(bucket, key, stored)
+	tx.ops = appendOp(tx.ops, opPut, bucket, key, value)
+	return nil
+}
+
+// Delete removes key from bucket. Deleting a missing key is not an error.
+func (tx *Tx) Delete(bucket, key string) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if tx.Get(bucket, key) == nil {
+		return nil
+	}
+	tx.write(bucket, key, nil)
+	tx.ops = appendOp(tx.ops, opDelete, bucket, key, nil)
+	return nil
+}
+
+func (tx *Tx) write(bucket, key string, value []byte) {
+	b := tx.writes[bucket]
+	if b == nil {
+		b = make(map[string][]byte)
+		tx.writes[bucket] = b
+	}
+	b[key] = value
+}
+
+// ForEach calls fn for every key in bucket in order, stopping at the first error
+func (tx *Tx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	keys := sortedKeys(tx.db.buckets[bucket])
+	if written := tx.writes[bucket]; len(written) > 0 {
+		for key := range written {
+			if _, exists := tx.db.buckets[bucket][key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		if value := tx.Get(bucket, key); value != nil {
+			if err := fn(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns how many keys bucket holds
+func (tx *Tx) Len(bucket string) int {
+	n := len(tx.db.buckets[bucket])
+	for key, value := range tx.writes[bucket] {
+		_, exists := tx.db.buckets[bucket][key]
+		switch {
+		case value != nil && !exists:
+			n++
+		case value == nil && exists:
+			n--
+		}
+	}
+	return n
+}
+
+// commit writes the transaction as one record and applies it. The caller holds the lock.
+func (tx *Tx) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	db := tx.db
+	record := appendRecord(nil, tx.ops)
+	n, err := db.file.Write(record)
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		// Cut off whatever part made it, so the next commit doesn't follow a torn record
+		if n > 0 {
+			db.file.Truncate(db.size)
+			db.file.Seek(db.size, io.SeekStart)
+		}
+		return fmt.Errorf("failed to write database: %v", err)
+	}
+	db.size += int64(n)
+
+	for bucket, writes := range tx.writes {
+		for key, value := range writes {
+			db.set(bucket, key, value)
+		}
+	}
+
+	if db.size >= compactMinSize && db.size > 2*db.live {
+		if err := db.compact(); err != nil {
+			// The log is still whole, just longer than it needs to be
+			log.Printf("Failed to compact %s: %v", db.path, err)
+		}
+	}
+	return nil
+}
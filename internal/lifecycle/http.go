@@ -0,0 +1,57 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// HTTPServer runs an http.Server as a critical component. Start binds the listener
+// synchronously so a taken port fails startup instead of surfacing later.
+type HTTPServer struct {
+	Server   *http.Server
+	CertFile string // TLS is used when both are set
+	KeyFile  string
+
+	failed chan error
+}
+
+func NewHTTPServer(server *http.Server, certFile, keyFile string) *HTTPServer {
+	return &HTTPServer{
+		Server:   server,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		failed:   make(chan error, 1),
+	}
+}
+
+func (s *HTTPServer) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		var err error
+		if s.CertFile != "" {
+			err = s.Server.ServeTLS(listener, s.CertFile, s.KeyFile)
+		} else {
+			err = s.Server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.failed <- err
+		}
+		close(s.failed)
+	}()
+	return nil
+}
+
+// Stop stops accepting connections and waits for in-flight requests to finish
+func (s *HTTPServer) Stop(ctx context.Context) error {
+	return s.Server.Shutdown(ctx)
+}
+
+func (s *HTTPServer) Failed() <-chan error {
+	return s.failed
+}
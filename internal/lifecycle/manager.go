@@ -0,0 +1,217 @@
+// Package lifecycle starts and stops the server's long-running components in order.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Component is anything with background work that has to be started and stopped cleanly.
+// Start should return once the component is running; Stop should return once it has
+// finished, or when ctx expires.
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Failer is implemented by components that can fail after Start has returned, e.g. an
+// HTTP server whose listener dies. The channel yields at most one error.
+type Failer interface {
+	Failed() <-chan error
+}
+
+// Options describes how a component relates to the others
+type Options struct {
+	DependsOn []string // started before this component, stopped after it
+	Critical  bool     // a runtime failure shuts everything down
+}
+
+type entry struct {
+	name      string
+	component Component
+	opts      Options
+}
+
+type Manager struct {
+	mutex    sync.Mutex
+	entries  map[string]*entry
+	order    []string // registration order, used to break ties
+	started  []*entry // in start order
+	failures chan error
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		entries:  make(map[string]*entry),
+		failures: make(chan error, 1),
+	}
+}
+
+// Register adds a component under a unique name. Dependencies may be registered later,
+// they are resolved by Start.
+func (m *Manager) Register(name string, c Component, opts Options) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.entries[name]; exists {
+		panic(fmt.Sprintf("lifecycle: component %q registered twice", name))
+	}
+	m.entries[name] = &entry{name: name, component: c, opts: opts}
+	m.order = append(m.order, name)
+}
+
+// Start starts every component after its dependencies. If one fails to start, the ones
+// already running are stopped again (in reverse order) and the error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	order, err := m.startOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range order {
+		log.Printf("Starting %s", e.name)
+		if err := e.component.Start(ctx); err != nil {
+			startErr := fmt.Errorf("failed to start %s: %v", e.name, err)
+			m.Stop(ctx)
+			return startErr
+		}
+
+		m.mutex.Lock()
+		m.started = append(m.started, e)
+		m.mutex.Unlock()
+
+		if f, ok := e.component.(Failer); ok {
+			go m.watch(e, f)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) watch(e *entry, f Failer) {
+	err, ok := <-f.Failed()
+	if !ok || err == nil {
+		return
+	}
+	if !e.opts.Critical {
+		log.Printf("Component %s failed: %v", e.name, err)
+		return
+	}
+	select {
+	case m.failures <- fmt.Errorf("critical component %s failed: %v", e.name, err):
+	default: // already shutting down because of another failure
+	}
+}
+
+// Wait blocks until ctx is done (a clean shutdown request, returns nil) or a critical
+// component fails (returns its error). Either way the caller should then call Stop.
+func (m *Manager) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-m.failures:
+		return err
+	}
+}
+
+// abandonGrace is how long the components still to stop once the deadline has passed get
+// between them. They are stopped with the expired context, which most take as the cue to
+// return at once.
+const abandonGrace = time.Second
+
+// Stop stops the started components in reverse start order. Each Stop shares ctx's
+// deadline; a component that hasn't returned by then is abandoned so it can't wedge
+// shutdown, and the rest are still stopped, see abandonGrace.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mutex.Lock()
+	started := m.started
+	m.started = nil
+	m.mutex.Unlock()
+
+	var late context.Context // once ctx is done
+	var firstErr error
+	for i := len(started) - 1; i >= 0; i-- {
+		e := started[i]
+		log.Printf("Stopping %s", e.name)
+
+		wait := ctx
+		if ctx.Err() != nil {
+			if late == nil {
+				var cancel context.CancelFunc
+				late, cancel = context.WithTimeout(context.Background(), abandonGrace)
+				defer cancel()
+			}
+			wait = late
+		}
+		if err := stopWithDeadline(ctx, wait, e.component); err != nil {
+			log.Printf("Failed to stop %s: %v", e.name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to stop %s: %v", e.name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// stopWithDeadline stops c with ctx, giving up on it once wait is done
+func stopWithDeadline(ctx, wait context.Context, c Component) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-wait.Done():
+		return fmt.Errorf("abandoned after shutdown deadline: %v", ctx.Err())
+	}
+}
+
+// startOrder sorts the components so each comes after its dependencies, keeping
+// registration order otherwise
+func (m *Manager) startOrder() ([]*entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var order []*entry
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		e, exists := m.entries[name]
+		if !exists {
+			return fmt.Errorf("component %s depends on unregistered component %s", path[len(path)-1], name)
+		}
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		}
+
+		state[name] = visiting
+		for _, dep := range e.opts.DependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, e)
+		return nil
+	}
+
+	for _, name := range m.order {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
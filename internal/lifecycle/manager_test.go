@@ -0,0 +1,170 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/lifecycle"
+)
+
+// calls records the order components were started and stopped in, as "start x"/"stop x"
+type calls struct {
+	mutex sync.Mutex
+	seen  []string
+}
+
+func (c *calls) add(call string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seen = append(c.seen, call)
+}
+
+func (c *calls) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return strings.Join(c.seen, ", ")
+}
+
+type component struct {
+	name     string
+	calls    *calls
+	startErr error
+	hang     bool // Stop never returns
+	failed   chan error
+}
+
+func (c *component) Start(ctx context.Context) error {
+	c.calls.add("start " + c.name)
+	return c.startErr
+}
+
+func (c *component) Stop(ctx context.Context) error {
+	c.calls.add("stop " + c.name)
+	if c.hang {
+		select {}
+	}
+	return nil
+}
+
+// failing is a component that can fail once running
+type failing struct {
+	*component
+}
+
+func (c failing) Failed() <-chan error {
+	return c.failed
+}
+
+func TestStartAndStopOrder(t *testing.T) {
+	seen := &calls{}
+	m := lifecycle.NewManager()
+	// Registered out of order: the HTTP server needs replication, which needs the cluster
+	// and the store
+	m.Register("http", &component{name: "http", calls: seen}, lifecycle.Options{DependsOn: []string{"replication"}})
+	m.Register("replication", &component{name: "replication", calls: seen}, lifecycle.Options{DependsOn: []string{"cluster", "store"}})
+	m.Register("store", &component{name: "store", calls: seen}, lifecycle.Options{})
+	m.Register("cluster", &component{name: "cluster", calls: seen}, lifecycle.Options{})
+	m.Register("sweeper", &component{name: "sweeper", calls: seen}, lifecycle.Options{DependsOn: []string{"store"}})
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "start cluster, start store, start replication, start http, start sweeper, " +
+		"stop sweeper, stop http, stop replication, stop store, stop cluster"
+	if got := seen.String(); got != want {
+		t.Errorf("calls were\n\t%s\nwant\n\t%s", got, want)
+	}
+}
+
+func TestStartFailureStopsTheRest(t *testing.T) {
+	seen := &calls{}
+	m := lifecycle.NewManager()
+	m.Register("store", &component{name: "store", calls: seen}, lifecycle.Options{})
+	m.Register("cluster", &component{name: "cluster", calls: seen}, lifecycle.Options{})
+	m.Register("http", &component{name: "http", calls: seen, startErr: errors.New("address in use")}, lifecycle.Options{DependsOn: []string{"store"}})
+	m.Register("sweeper", &component{name: "sweeper", calls: seen}, lifecycle.Options{})
+
+	err := m.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "http") || !strings.Contains(err.Error(), "address in use") {
+		t.Fatalf("Start = %v, want http's failure", err)
+	}
+	if got, want := seen.String(), "start store, start cluster, start http, stop cluster, stop store"; got != want {
+		t.Errorf("calls were %s, want %s", got, want)
+	}
+}
+
+func TestStopAbandonsHangingComponent(t *testing.T) {
+	seen := &calls{}
+	m := lifecycle.NewManager()
+	m.Register("store", &component{name: "store", calls: seen}, lifecycle.Options{})
+	m.Register("replication", &component{name: "replication", calls: seen, hang: true}, lifecycle.Options{DependsOn: []string{"store"}})
+	m.Register("http", &component{name: "http", calls: seen}, lifecycle.Options{DependsOn: []string{"replication"}})
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err := m.Stop(ctx)
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("Stop took %v with a deadline of 50ms", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "replication") {
+		t.Errorf("Stop = %v, want replication reported as abandoned", err)
+	}
+	// The store is still stopped after the component that hung, with what time is left
+	if got, want := seen.String(), "start store, start replication, start http, stop http, stop replication, stop store"; got != want {
+		t.Errorf("calls were %s, want %s", got, want)
+	}
+}
+
+func TestCriticalFailure(t *testing.T) {
+	seen := &calls{}
+	critical := failing{&component{name: "http", calls: seen, failed: make(chan error, 1)}}
+	optional := failing{&component{name: "tiering", calls: seen, failed: make(chan error, 1)}}
+	m := lifecycle.NewManager()
+	m.Register("http", critical, lifecycle.Options{Critical: true})
+	m.Register("tiering", optional, lifecycle.Options{})
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A component that isn't critical failing doesn't bring the rest down
+	optional.failed <- errors.New("rules unreadable")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err != nil {
+		t.Fatalf("Wait = %v after tiering failed, want nil when asked to stop", err)
+	}
+
+	critical.failed <- errors.New("listener closed")
+	if err := m.Wait(context.Background()); err == nil || !strings.Contains(err.Error(), "listener closed") {
+		t.Errorf("Wait = %v, want http's failure", err)
+	}
+}
+
+func TestStartOrderErrors(t *testing.T) {
+	for name, register := range map[string]func(m *lifecycle.Manager){
+		"dependency cycle": func(m *lifecycle.Manager) {
+			m.Register("a", &component{name: "a", calls: &calls{}}, lifecycle.Options{DependsOn: []string{"b"}})
+			m.Register("b", &component{name: "b", calls: &calls{}}, lifecycle.Options{DependsOn: []string{"a"}})
+		},
+		"unregistered dependency": func(m *lifecycle.Manager) {
+			m.Register("a", &component{name: "a", calls: &calls{}}, lifecycle.Options{DependsOn: []string{"missing"}})
+		},
+	} {
+		m := lifecycle.NewManager()
+		register(m)
+		if err := m.Start(context.Background()); err == nil {
+			t.Errorf("%s: Start succeeded", name)
+		}
+	}
+}
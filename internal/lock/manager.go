@@ -0,0 +1,296 @@
+// Package lock provides advisory, lease-based locks on object keys. Locks are local to
+// this node but survive restarts.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL = 30 * time.Second
+	MaxTTL     = 24 * time.Hour
+)
+
+var (
+	ErrLocked        = errors.New("object is locked")
+	ErrNotLocked     = errors.New("object is not locked")
+	ErrTokenMismatch = errors.New("lock token does not match")
+)
+
+// Lease is a held lock. Token is the secret proving ownership and is only handed to the
+// holder.
+type Lease struct {
+	Key         string    `json:"key"`
+	Owner       string    `json:"owner"`
+	Token       string    `json:"token,omitempty"`
+	GuardWrites bool      `json:"guard_writes"` // writes without the token are rejected while held
+	AcquiredAt  time.Time `json:"acquired_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Public returns the lease without its token, for showing to anyone else
+func (l Lease) Public() Lease {
+	l.Token = ""
+	return l
+}
+
+// Remaining is how long the lease has left at now
+func (l Lease) Remaining(now time.Time) time.Duration {
+	if now.After(l.ExpiresAt) {
+		return 0
+	}
+	return l.ExpiresAt.Sub(now)
+}
+
+// LockedError carries the current holder when an acquisition or write is refused
+type LockedError struct {
+	Lease Lease
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v: held by %s for another %s", ErrLocked, e.Lease.Owner, e.Lease.Remaining(time.Now()).Round(time.Second))
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+type Manager struct {
+	path string
+	now  func() time.Time
+
+	mutex  sync.Mutex
+	leases map[string]Lease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewManager loads the leases saved at path, dropping any that expired while we were down
+func NewManager(path string) (*Manager, error) {
+	m := &Manager{path: path, now: time.Now, leases: make(map[string]Lease)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read locks: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &m.leases); err != nil {
+			return nil, fmt.Errorf("failed to parse locks: %v", err)
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expireLocked(m.now())
+	return m, nil
+}
+
+// SetClock replaces the clock leases are timed by, for tests
+func (m *Manager) SetClock(now func() time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = now
+}
+
+// Acquire takes the lock on key for ttl. If someone else holds it, a *LockedError
+// describing their lease is returned.
+func (m *Manager) Acquire(key, owner string, ttl time.Duration, guardWrites bool) (Lease, error) {
+	ttl = clampTTL(ttl)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	if current, held := m.leases[key]; held && now.Before(current.ExpiresAt) {
+		return Lease{}, &LockedError{Lease: current.Public()}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return Lease{}, err
+	}
+	lease := Lease{
+		Key:         key,
+		Owner:       owner,
+		Token:       token,
+		GuardWrites: guardWrites,
+		AcquiredAt:  now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	m.leases[key] = lease
+	return lease, m.saveLocked()
+}
+
+// Refresh extends the holder's lease to ttl from now
+func (m *Manager) Refresh(key, token string, ttl time.Duration) (Lease, error) {
+	ttl = clampTTL(ttl)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lease, err := m.heldLocked(key, token)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.ExpiresAt = m.now().Add(ttl)
+	m.leases[key] = lease
+	return lease, m.saveLocked()
+}
+
+func (m *Manager) Release(key, token string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, err := m.heldLocked(key, token); err != nil {
+		return err
+	}
+	delete(m.leases, key)
+	return m.saveLocked()
+}
+
+// Get returns the current lease on key, if any
+func (m *Manager) Get(key string) (Lease, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lease, held := m.leases[key]
+	if !held || m.now().After(lease.ExpiresAt) {
+		return Lease{}, false
+	}
+	return lease, true
+}
+
+// CheckWrite decides whether a write to key may go ahead. A token that is presented must
+// be the current holder's; without one, the write is refused only if the holder asked
+// for writes to be guarded.
+func (m *Manager) CheckWrite(key, token string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lease, held := m.leases[key]
+	if !held || m.now().After(lease.ExpiresAt) {
+		if token != "" {
+			return ErrNotLocked
+		}
+		return nil
+	}
+	if token == "" {
+		if lease.GuardWrites {
+			return &LockedError{Lease: lease.Public()}
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(lease.Token)) != 1 {
+		return &LockedError{Lease: lease.Public()}
+	}
+	return nil
+}
+
+func (m *Manager) heldLocked(key, token string) (Lease, error) {
+	lease, held := m.leases[key]
+	if !held || m.now().After(lease.ExpiresAt) {
+		return Lease{}, ErrNotLocked
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(lease.Token)) != 1 {
+		return Lease{}, ErrTokenMismatch
+	}
+	return lease, nil
+}
+
+// expireLocked drops leases past their expiry, returning how many
+func (m *Manager) expireLocked(now time.Time) int {
+	expired := 0
+	for key, lease := range m.leases {
+		if now.After(lease.ExpiresAt) {
+			delete(m.leases, key)
+			expired++
+		}
+	}
+	if expired > 0 {
+		m.saveLocked()
+	}
+	return expired
+}
+
+func (m *Manager) saveLocked() error {
+	data, err := json.MarshalIndent(m.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("failed to save locks: %v", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save locks: %v", err)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (m *Manager) Start(ctx context.Context) error {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.mutex.Lock()
+				if n := m.expireLocked(m.now()); n > 0 {
+					log.Printf("Expired %d object locks", n)
+				}
+				m.mutex.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) Stop(ctx context.Context) error {
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultTTL
+	}
+	if ttl > MaxTTL {
+		return MaxTTL
+	}
+	return ttl
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lock token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
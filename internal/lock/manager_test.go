@@ -0,0 +1,165 @@
+package lock_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/lock"
+)
+
+// fakeClock only moves when it's told to
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newManager(t *testing.T, path string, clock *fakeClock) *lock.Manager {
+	t.Helper()
+	m, err := lock.NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetClock(clock.Now)
+	return m
+}
+
+func TestContention(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	m := newManager(t, filepath.Join(t.TempDir(), "locks.json"), clock)
+
+	held, err := m.Acquire("reports/q1", "pipeline-a", time.Minute, false)
+	if err != nil || held.Token == "" {
+		t.Fatalf("Acquire = %+v, %v", held, err)
+	}
+	_, err = m.Acquire("reports/q1", "pipeline-b", time.Minute, false)
+	var locked *lock.LockedError
+	if !errors.As(err, &locked) || locked.Lease.Owner != "pipeline-a" || locked.Lease.Token != "" {
+		t.Fatalf("second Acquire = %v, want held by pipeline-a without its token", err)
+	}
+	if _, err := m.Acquire("reports/q2", "pipeline-b", time.Minute, false); err != nil {
+		t.Errorf("another key: %v", err)
+	}
+
+	// Only the holder can let it go
+	if err := m.Release("reports/q1", "not-the-token"); !errors.Is(err, lock.ErrTokenMismatch) {
+		t.Errorf("Release with the wrong token = %v, want ErrTokenMismatch", err)
+	}
+	if err := m.Release("reports/q1", held.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Release("reports/q1", held.Token); !errors.Is(err, lock.ErrNotLocked) {
+		t.Errorf("releasing twice = %v, want ErrNotLocked", err)
+	}
+	if _, err := m.Acquire("reports/q1", "pipeline-b", time.Minute, false); err != nil {
+		t.Errorf("Acquire once released: %v", err)
+	}
+}
+
+func TestExpiryAndRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	m := newManager(t, filepath.Join(t.TempDir(), "locks.json"), clock)
+	held, err := m.Acquire("batch", "pipeline-a", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshed before it runs out, it runs for the new TTL from then
+	clock.Advance(50 * time.Second)
+	refreshed, err := m.Refresh("batch", held.Token, time.Minute)
+	if err != nil || !refreshed.ExpiresAt.Equal(clock.Now().Add(time.Minute)) || refreshed.Token != held.Token {
+		t.Fatalf("Refresh = %+v, %v; want the same token held a minute from now", refreshed, err)
+	}
+	clock.Advance(50 * time.Second)
+	if _, held := m.Get("batch"); !held {
+		t.Fatal("lost the lease 50s after refreshing it for a minute")
+	}
+
+	clock.Advance(11 * time.Second)
+	if _, held := m.Get("batch"); held {
+		t.Error("the lease outlived its TTL")
+	}
+	if _, err := m.Refresh("batch", held.Token, time.Minute); !errors.Is(err, lock.ErrNotLocked) {
+		t.Errorf("refreshing an expired lease = %v, want ErrNotLocked", err)
+	}
+	if _, err := m.Acquire("batch", "pipeline-b", time.Minute, false); err != nil {
+		t.Errorf("Acquire once expired: %v", err)
+	}
+}
+
+func TestCheckWrite(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	m := newManager(t, filepath.Join(t.TempDir(), "locks.json"), clock)
+	guarded, _ := m.Acquire("guarded", "pipeline-a", time.Minute, true)
+	advisory, _ := m.Acquire("advisory", "pipeline-a", time.Minute, false)
+
+	var locked *lock.LockedError
+	for _, check := range []struct {
+		key, token string
+		ok         bool
+	}{
+		{"guarded", guarded.Token, true},
+		{"guarded", "", false},
+		{"guarded", advisory.Token, false},
+		{"advisory", "", true},
+		{"advisory", advisory.Token, true},
+		{"advisory", guarded.Token, false},
+		{"free", "", true},
+	} {
+		err := m.CheckWrite(check.key, check.token)
+		if check.ok && err != nil || !check.ok && !errors.As(err, &locked) {
+			t.Errorf("write to %s with token %q = %v", check.key, check.token, err)
+		}
+	}
+	// A token for a lock that isn't held any more is a writer that lost its lease
+	if err := m.CheckWrite("free", "stale-token"); !errors.Is(err, lock.ErrNotLocked) {
+		t.Errorf("write with a token for a free key = %v, want ErrNotLocked", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if err := m.CheckWrite("guarded", ""); err != nil {
+		t.Errorf("write once the guard expired = %v", err)
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	// An hour ago, so the short lease ran out while the node was down
+	clock := &fakeClock{now: time.Now().Add(-time.Hour)}
+	m := newManager(t, path, clock)
+	long, err := m.Acquire("long", "pipeline-a", 2*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acquire("short", "pipeline-b", time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := lock.NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, held := restarted.Get("long")
+	if !held || lease.Token != long.Token || !lease.GuardWrites {
+		t.Errorf("after a restart long = %+v (held %v), want the same lease", lease, held)
+	}
+	if _, held := restarted.Get("short"); held {
+		t.Error("a lease that expired while the node was down came back")
+	}
+	if err := restarted.Release("long", long.Token); err != nil {
+		t.Errorf("releasing with the token from before the restart: %v", err)
+	}
+}
@@ -4,14 +4,22 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/9ifrashaikh/distributed-system/pkg/models"
 )
 
 type DataClassifier struct {
+	patternsMutex  sync.RWMutex
 	accessPatterns []models.AccessPattern
+	rulesMutex     sync.RWMutex
 	tieringRules   TieringRules
+	costModel      CostModel
+
+	importanceMutex sync.RWMutex
+	importance      *FeatureImportance // from the last ClassifyObjects run
 }
 
 type TieringRules struct {
@@ -21,12 +29,62 @@ type TieringRules struct {
 	SizeThreshold   int64 `json:"size_threshold"`
 }
 
+// CostModel maps a storage tier to its price in dollars per GB per month
+type CostModel map[string]float64
+
+func DefaultCostModel() CostModel {
+	return CostModel{
+		"hot":  0.023, // High-performance storage
+		"warm": 0.012, // Standard storage
+		"cold": 0.004, // Archive storage
+	}
+}
+
+// Validate checks that the rules are internally consistent
+func (r TieringRules) Validate() error {
+	if r.HotTierDays < 0 {
+		return fmt.Errorf("hot_tier_days must be non-negative, got %d", r.HotTierDays)
+	}
+	if r.WarmTierDays < 0 {
+		return fmt.Errorf("warm_tier_days must be non-negative, got %d", r.WarmTierDays)
+	}
+	if r.HotTierDays >= r.WarmTierDays {
+		return fmt.Errorf("hot_tier_days (%d) must be less than warm_tier_days (%d)", r.HotTierDays, r.WarmTierDays)
+	}
+	if r.AccessThreshold < 0 {
+		return fmt.Errorf("access_threshold must be non-negative, got %d", r.AccessThreshold)
+	}
+	if r.SizeThreshold < 0 {
+		return fmt.Errorf("size_threshold must be non-negative, got %d", r.SizeThreshold)
+	}
+	return nil
+}
+
+// Validate checks that every tier has a non-negative price
+func (c CostModel) Validate() error {
+	for _, tier := range []string{"hot", "warm", "cold"} {
+		cost, ok := c[tier]
+		if !ok {
+			return fmt.Errorf("cost model is missing tier %q", tier)
+		}
+		if cost < 0 {
+			return fmt.Errorf("cost for tier %q must be non-negative, got %g", tier, cost)
+		}
+	}
+	return nil
+}
+
 type ObjectScore struct {
-	ObjectID   string             `json:"object_id"`
-	Score      float64            `json:"score"`
-	Prediction string             `json:"prediction"`
-	Confidence float64            `json:"confidence"`
-	Features   map[string]float64 `json:"features"`
+	ObjectID    string                `json:"object_id"`
+	Score       float64               `json:"score"`
+	Prediction  string                `json:"prediction"`
+	Confidence  float64               `json:"confidence"`
+	Features    map[string]float64    `json:"features"`
+	Explanation []FeatureContribution `json:"explanation"` // top contributors to Score
+
+	contributions []FeatureContribution // every term, sums to Score
+	key           string                // the object's name in the map it was classified from
+	object        *models.StorageObject
 }
 
 func NewDataClassifier() *DataClassifier {
@@ -38,20 +96,77 @@ func NewDataClassifier() *DataClassifier {
 			AccessThreshold: 10,          // Minimum access count for hot tier
 			SizeThreshold:   1024 * 1024, // 1MB threshold for size-based decisions
 		},
+		costModel: DefaultCostModel(),
+	}
+}
+
+func (dc *DataClassifier) Rules() TieringRules {
+	dc.rulesMutex.RLock()
+	defer dc.rulesMutex.RUnlock()
+	return dc.tieringRules
+}
+
+// SetRules replaces the active tiering rules; invalid rules are rejected and the old ones kept
+func (dc *DataClassifier) SetRules(rules TieringRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	dc.rulesMutex.Lock()
+	defer dc.rulesMutex.Unlock()
+	dc.tieringRules = rules
+	return nil
+}
+
+func (dc *DataClassifier) CostModel() CostModel {
+	costs := make(CostModel, len(dc.costModel))
+	for tier, cost := range dc.costModel {
+		costs[tier] = cost
 	}
+	return costs
 }
 
+// AddAccessPattern records one access to an object, for scoring it by how it is used
 func (dc *DataClassifier) AddAccessPattern(pattern models.AccessPattern) {
+	dc.patternsMutex.Lock()
+	defer dc.patternsMutex.Unlock()
 	dc.accessPatterns = append(dc.accessPatterns, pattern)
 }
 
+// TrimAccessPatterns forgets the accesses recorded from before cutoff
+func (dc *DataClassifier) TrimAccessPatterns(cutoff time.Time) {
+	dc.patternsMutex.Lock()
+	defer dc.patternsMutex.Unlock()
+	dc.accessPatterns = TrimPatterns(dc.accessPatterns, cutoff)
+}
+
+// TrimPatterns drops the accesses from before cutoff from patterns, reusing its array
+func TrimPatterns(patterns []models.AccessPattern, cutoff time.Time) []models.AccessPattern {
+	kept := patterns[:0]
+	for _, pattern := range patterns {
+		if !pattern.AccessTime.Before(cutoff) {
+			kept = append(kept, pattern)
+		}
+	}
+	clear(patterns[len(kept):])
+	return kept
+}
+
+// ClassifyObjects scores objects by their metadata and recorded accesses. Accesses to
+// objects not among them, such as deleted ones, are ignored.
 func (dc *DataClassifier) ClassifyObjects(objects map[string]*models.StorageObject) ([]ObjectScore, error) {
 	scores := make([]ObjectScore, 0, len(objects))
 
-	for _, obj := range objects {
-		score := dc.calculateObjectScore(obj)
+	now := time.Now()
+	history := dc.patternsByObject()
+
+	importance := newImportanceAccumulator()
+	for key, obj := range objects {
+		score := dc.calculateObjectScore(obj, history[obj.ID], now)
+		score.key, score.object = key, obj
+		importance.add(score.contributions)
 		scores = append(scores, score)
 	}
+	dc.setFeatureImportance(importance.summary())
 
 	// Sort by score (highest first)
 	sort.Slice(scores, func(i, j int) bool {
@@ -61,9 +176,18 @@ func (dc *DataClassifier) ClassifyObjects(objects map[string]*models.StorageObje
 	return scores, nil
 }
 
-func (dc *DataClassifier) calculateObjectScore(obj *models.StorageObject) ObjectScore {
-	now := time.Now()
+// patternsByObject groups the recorded access patterns by object ID
+func (dc *DataClassifier) patternsByObject() map[string][]models.AccessPattern {
+	dc.patternsMutex.RLock()
+	defer dc.patternsMutex.RUnlock()
+	grouped := make(map[string][]models.AccessPattern)
+	for _, pattern := range dc.accessPatterns {
+		grouped[pattern.ObjectID] = append(grouped[pattern.ObjectID], pattern)
+	}
+	return grouped
+}
 
+func (dc *DataClassifier) calculateObjectScore(obj *models.StorageObject, history []models.AccessPattern, now time.Time) ObjectScore {
 	// Feature extraction
 	features := make(map[string]float64)
 
@@ -88,57 +212,113 @@ func (dc *DataClassifier) calculateObjectScore(obj *models.StorageObject) Object
 		features["access_frequency"] = features["access_count"]
 	}
 
+	// Seasonality features from the access pattern history
+	accessTimes := make([]time.Time, 0, len(history))
+	for _, pattern := range history {
+		accessTimes = append(accessTimes, pattern.AccessTime)
+	}
+	addSeasonalFeatures(features, accessTimes, now)
+	addCalendarFeatures(features, accessTimes, obj.LastAccess, now)
+	addPatternFeatures(features, history, now)
+
 	// Calculate composite score
-	score := dc.calculateCompositeScore(features)
+	score, contributions := dc.calculateCompositeScore(features)
 
 	// Determine tier prediction
 	prediction, confidence := dc.predictTier(features, score)
 
 	return ObjectScore{
-		ObjectID:   obj.ID,
-		Score:      score,
-		Prediction: prediction,
-		Confidence: confidence,
-		Features:   features,
+		ObjectID:      obj.ID,
+		Score:         score,
+		Prediction:    prediction,
+		Confidence:    confidence,
+		Features:      features,
+		Explanation:   topContributions(contributions, explanationSize),
+		contributions: contributions,
 	}
 }
 
-func (dc *DataClassifier) calculateCompositeScore(features map[string]float64) float64 {
+func (dc *DataClassifier) calculateCompositeScore(features map[string]float64) (float64, []FeatureContribution) {
 	// Weights for different features (can be tuned)
 	weights := map[string]float64{
-		"recency_weight":   0.4, // How recently accessed
-		"frequency_weight": 0.3, // How often accessed
-		"size_weight":      0.2, // Size considerations
-		"age_weight":       0.1, // Age of the object
+		"recency_weight":    0.25, // How recently accessed
+		"frequency_weight":  0.1,  // How often accessed
+		"activity_weight":   0.15, // How often accessed lately
+		"expected_weight":   0.1,  // How often accessed at this time in past weeks
+		"sharing_weight":    0.1,  // How many users read it
+		"read_weight":       0.05, // How much of its use is reading
+		"regularity_weight": 0.05, // How steady the gaps between accesses are
+		"size_weight":       0.15, // Size considerations
+		"age_weight":        0.05, // Age of the object
 	}
 
+	// Recency is measured against the nearest actual or seasonally expected access
+	recencyFeature, recencyDays := effectiveRecency(features)
+
 	// Normalize and score each feature
-	recencyScore := math.Max(0, 1.0-features["days_since_access"]/30.0) // Decay over 30 days
-	frequencyScore := math.Min(1.0, features["access_frequency"]*10)    // Cap at reasonable frequency
-	sizeScore := 1.0 / (1.0 + features["size_mb"]/100)                  // Smaller files scored higher
-	ageScore := math.Max(0, 1.0-features["days_since_creation"]/365.0)  // Newer files scored higher
+	recencyScore := math.Max(0, 1.0-recencyDays/30.0)                  // Decay over 30 days
+	frequencyScore := math.Min(1.0, features["access_frequency"]*10)   // Cap at reasonable frequency
+	sizeScore := 1.0 / (1.0 + features["size_mb"]/100)                 // Smaller files scored higher
+	ageScore := math.Max(0, 1.0-features["days_since_creation"]/365.0) // Newer files scored higher
+	activityScore := recentActivityScore(features)                     // Bursts of late scored higher
+	expectedScore := expectedActivityScore(features)                   // Due to be busy scored higher
+	sharedScore := sharingScore(features)                              // Read by more users scored higher
+	readsScore := readScore(features)                                  // Mostly read scored higher
+	steadyScore := regularityScore(features)                           // Steadily used scored higher
+
+	// Weighted combination, kept per feature so the score can be explained
+	contributions := []FeatureContribution{
+		{Feature: recencyFeature, Value: recencyDays, Contribution: weights["recency_weight"] * recencyScore},
+		{Feature: "access_frequency", Value: features["access_frequency"], Contribution: weights["frequency_weight"] * frequencyScore},
+		{Feature: "accesses_7d", Value: features["accesses_7d"], Contribution: weights["activity_weight"] * activityScore},
+		{Feature: "expected_accesses_24h", Value: features["expected_accesses_24h"], Contribution: weights["expected_weight"] * expectedScore},
+		{Feature: "distinct_users", Value: features["distinct_users"], Contribution: weights["sharing_weight"] * sharedScore},
+		{Feature: "read_write_ratio", Value: features["read_write_ratio"], Contribution: weights["read_weight"] * readsScore},
+		{Feature: "access_interval_variance", Value: features["access_interval_variance"], Contribution: weights["regularity_weight"] * steadyScore},
+		{Feature: "size_mb", Value: features["size_mb"], Contribution: weights["size_weight"] * sizeScore},
+		{Feature: "days_since_creation", Value: features["days_since_creation"], Contribution: weights["age_weight"] * ageScore},
+	}
 
-	// Weighted combination
-	score := weights["recency_weight"]*recencyScore +
-		weights["frequency_weight"]*frequencyScore +
-		weights["size_weight"]*sizeScore +
-		weights["age_weight"]*ageScore
+	score := 0.0
+	for _, c := range contributions {
+		score += c.Contribution
+	}
 
-	return score
+	return score, contributions
 }
 
 func (dc *DataClassifier) predictTier(features map[string]float64, score float64) (string, float64) {
-	daysSinceAccess := features["days_since_access"]
+	_, daysSinceAccess := effectiveRecency(features)
 	accessCount := features["access_count"]
+	rules := dc.Rules()
+
+	// Rule-based classification with confidence. Objects used at this time in past weeks
+	// stay hot through their quiet spells, the surer the more their accesses keep to a few
+	// hours of the day.
+	if features["expected_accesses_24h"] >= 1 && accessCount >= float64(rules.AccessThreshold) {
+		return "hot", 0.8 + 0.1*(1.0-features["hour_entropy"])
+	}
 
-	// Rule-based classification with confidence
-	if daysSinceAccess <= float64(dc.tieringRules.HotTierDays) &&
-		accessCount >= float64(dc.tieringRules.AccessThreshold) {
+	if daysSinceAccess <= float64(rules.HotTierDays) &&
+		accessCount >= float64(rules.AccessThreshold) {
 		return "hot", 0.9
 	}
 
-	if daysSinceAccess <= float64(dc.tieringRules.WarmTierDays) {
-		confidence := 0.7 + (0.2 * (1.0 - daysSinceAccess/float64(dc.tieringRules.WarmTierDays)))
+	// Objects read by several users lately are hot short of the threshold, a cold read
+	// slowing each of them down
+	if daysSinceAccess <= float64(rules.HotTierDays) &&
+		features["distinct_users"] >= sharedUsers && features["read_write_ratio"] >= 1 {
+		return "hot", 0.7 + 0.2*sharingScore(features)
+	}
+
+	if daysSinceAccess <= float64(rules.WarmTierDays) {
+		confidence := 0.7 + (0.2 * (1.0 - daysSinceAccess/float64(rules.WarmTierDays)))
+		return "warm", confidence
+	}
+
+	// Objects read on a steady cycle longer than the warm window stay warm until their
+	// next read is overdue
+	if due, confidence := dueOnCycle(features, daysSinceAccess); due {
 		return "warm", confidence
 	}
 
@@ -147,6 +327,8 @@ func (dc *DataClassifier) predictTier(features map[string]float64, score float64
 	return "cold", confidence
 }
 
+// GetRecommendations lists the objects whose predicted tier differs from their current one,
+// keyed by their names in objects
 func (dc *DataClassifier) GetRecommendations(objects map[string]*models.StorageObject) ([]TieringRecommendation, error) {
 	scores, err := dc.ClassifyObjects(objects)
 	if err != nil {
@@ -156,15 +338,15 @@ func (dc *DataClassifier) GetRecommendations(objects map[string]*models.StorageO
 	recommendations := make([]TieringRecommendation, 0)
 
 	for _, score := range scores {
-		obj := objects[findObjectByID(objects, score.ObjectID)]
-		if obj != nil && obj.StorageTier != score.Prediction {
+		obj := score.object
+		if obj.StorageTier != score.Prediction {
 			rec := TieringRecommendation{
 				ObjectID:         score.ObjectID,
-				ObjectKey:        obj.Key,
+				ObjectKey:        score.key,
 				CurrentTier:      obj.StorageTier,
 				RecommendedTier:  score.Prediction,
 				Confidence:       score.Confidence,
-				Reason:           dc.generateReason(score.Features, score.Prediction),
+				Reason:           dc.generateReason(score),
 				EstimatedSavings: dc.calculateSavings(obj, score.Prediction),
 			}
 			recommendations = append(recommendations, rec)
@@ -184,29 +366,22 @@ type TieringRecommendation struct {
 	EstimatedSavings float64 `json:"estimated_savings"`
 }
 
-func (dc *DataClassifier) generateReason(features map[string]float64, prediction string) string {
-	switch prediction {
-	case "hot":
-		return fmt.Sprintf("Recently accessed (%.1f days ago) with high frequency (%.1f accesses)",
-			features["days_since_access"], features["access_count"])
-	case "warm":
-		return fmt.Sprintf("Moderate access pattern (%.1f days since last access)",
-			features["days_since_access"])
-	case "cold":
-		return fmt.Sprintf("Infrequently accessed (%.1f days ago) - suitable for archival",
-			features["days_since_access"])
-	default:
+func (dc *DataClassifier) generateReason(score ObjectScore) string {
+	if len(score.Explanation) == 0 {
 		return "Unknown classification reason"
 	}
+
+	parts := make([]string, 0, len(score.Explanation))
+	for _, c := range score.Explanation {
+		parts = append(parts, fmt.Sprintf("%s (%+.3f)", describeFeature(c.Feature, c.Value), c.Contribution))
+	}
+
+	return fmt.Sprintf("Predicted %s with score %.3f: %s", score.Prediction, score.Score, strings.Join(parts, ", "))
 }
 
 func (dc *DataClassifier) calculateSavings(obj *models.StorageObject, recommendedTier string) float64 {
 	// Simple cost model (dollars per GB per month)
-	costs := map[string]float64{
-		"hot":  0.023, // High-performance storage
-		"warm": 0.012, // Standard storage
-		"cold": 0.004, // Archive storage
-	}
+	costs := dc.costModel
 
 	currentCost := costs[obj.StorageTier]
 	newCost := costs[recommendedTier]
@@ -216,12 +391,3 @@ func (dc *DataClassifier) calculateSavings(obj *models.StorageObject, recommende
 
 	return monthlySavings
 }
-
-func findObjectByID(objects map[string]*models.StorageObject, id string) string {
-	for key, obj := range objects {
-		if obj.ID == id {
-			return key
-		}
-	}
-	return ""
-}
@@ -0,0 +1,267 @@
+package ml
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// accessedObject is an object created at created and read at each of times, with its
+// access count and last access to match
+func accessedObject(id string, created time.Time, times []time.Time) (*models.StorageObject, []models.AccessPattern) {
+	obj := &models.StorageObject{
+		ID:          id,
+		Key:         id,
+		Size:        1024 * 1024,
+		StorageTier: "hot",
+		CreatedAt:   created,
+		LastAccess:  created,
+	}
+	history := make([]models.AccessPattern, 0, len(times))
+	for _, at := range times {
+		history = append(history, models.AccessPattern{ObjectID: id, AccessTime: at, Operation: "read", UserID: "analyst"})
+		obj.AccessCount++
+		if at.After(obj.LastAccess) {
+			obj.LastAccess = at
+		}
+	}
+	return obj, history
+}
+
+// spread returns n times evenly spaced from start to end
+func spread(start, end time.Time, n int) []time.Time {
+	times := make([]time.Time, n)
+	step := end.Sub(start) / time.Duration(n-1)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * step)
+	}
+	return times
+}
+
+// burst returns n times a minute apart from start
+func burst(start time.Time, n int) []time.Time {
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * time.Minute)
+	}
+	return times
+}
+
+func TestRecentBurstScoresHotterThanSpreadOverAYear(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+	created := now.AddDate(-1, 0, 0)
+
+	bursty, burstHistory := accessedObject("bursty", created, burst(now.Add(-3*time.Hour), 50))
+	steady, steadyHistory := accessedObject("steady", created, spread(created, now.AddDate(0, 0, -20), 50))
+
+	burstScore := dc.calculateObjectScore(bursty, burstHistory, now)
+	steadyScore := dc.calculateObjectScore(steady, steadyHistory, now)
+	if burstScore.Score <= steadyScore.Score {
+		t.Errorf("recent burst scored %.3f, not above %.3f for the same reads spread over a year", burstScore.Score, steadyScore.Score)
+	}
+}
+
+func TestOneOffBurstScoresLowerThanSpreadOverTime(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+	created := now.AddDate(0, -3, 0)
+
+	// The same 60 reads: all within an hour two months ago, or every day and a half since
+	oneOff, oneOffHistory := accessedObject("one-off", created, burst(created.AddDate(0, 0, 30), 60))
+	steady, steadyHistory := accessedObject("steady", created, spread(created, now.Add(-time.Hour), 60))
+
+	oneOffScore := dc.calculateObjectScore(oneOff, oneOffHistory, now)
+	steadyScore := dc.calculateObjectScore(steady, steadyHistory, now)
+	if oneOffScore.Score >= steadyScore.Score {
+		t.Errorf("one-off burst scored %.3f, not below %.3f for the same reads spread over time", oneOffScore.Score, steadyScore.Score)
+	}
+	if oneOffScore.Prediction == "hot" {
+		t.Errorf("one-off burst two months ago predicted hot")
+	}
+}
+
+// shareAmong hands the accesses in history out to users in turn, as operation
+func shareAmong(history []models.AccessPattern, operation string, users ...string) []models.AccessPattern {
+	shared := make([]models.AccessPattern, len(history))
+	for i, pattern := range history {
+		pattern.UserID = users[i%len(users)]
+		pattern.Operation = operation
+		shared[i] = pattern
+	}
+	return shared
+}
+
+func TestObjectReadByManyUsersIsHot(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+
+	// Six reads over the last three days, short of the access threshold of ten
+	obj, history := accessedObject("dashboard", now.AddDate(0, 0, -60), spread(now.AddDate(0, 0, -3), now.Add(-time.Hour), 6))
+	alone := dc.calculateObjectScore(obj, history, now)
+	shared := dc.calculateObjectScore(obj, shareAmong(history, "read", "ana", "ben", "cho", "dev"), now)
+	written := dc.calculateObjectScore(obj, shareAmong(history, "write", "ana", "ben", "cho", "dev"), now)
+
+	if alone.Prediction != "warm" {
+		t.Errorf("read by one user: predicted %s, want warm", alone.Prediction)
+	}
+	if shared.Prediction != "hot" {
+		t.Errorf("read by four users: predicted %s (features %v), want hot", shared.Prediction, shared.Features)
+	}
+	if written.Prediction != "warm" {
+		t.Errorf("written by four users: predicted %s, want warm", written.Prediction)
+	}
+	if shared.Score <= alone.Score || shared.Score <= written.Score {
+		t.Errorf("read by four users scored %.3f, not above %.3f by one or %.3f written by four", shared.Score, alone.Score, written.Score)
+	}
+}
+
+func TestObjectReadOnASteadyCycleStaysWarm(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+	created := now.AddDate(-1, 0, 0)
+	daysAgo := func(days ...int) []time.Time {
+		var times []time.Time
+		for _, d := range days {
+			times = append(times, now.AddDate(0, 0, -d))
+		}
+		return times
+	}
+
+	// Read every 45 days, last 40 days ago: due again in five
+	cycle, cycleHistory := accessedObject("quarterly-ish", created, daysAgo(355, 310, 265, 220, 175, 130, 85, 40))
+	// As many reads, last just as long ago, at no steady interval
+	erratic, erraticHistory := accessedObject("erratic", created, daysAgo(355, 350, 300, 180, 170, 60, 42, 40))
+
+	cycleScore := dc.calculateObjectScore(cycle, cycleHistory, now)
+	erraticScore := dc.calculateObjectScore(erratic, erraticHistory, now)
+	if cycleScore.Prediction != "warm" {
+		t.Errorf("read every 45 days, 40 days on: predicted %s (features %v), want warm", cycleScore.Prediction, cycleScore.Features)
+	}
+	if erraticScore.Prediction != "cold" {
+		t.Errorf("read erratically, 40 days on: predicted %s, want cold", erraticScore.Prediction)
+	}
+	if cycleScore.Score <= erraticScore.Score {
+		t.Errorf("steady cycle scored %.3f, not above %.3f for erratic reads", cycleScore.Score, erraticScore.Score)
+	}
+
+	// Overdue, it goes cold after all
+	if late := dc.calculateObjectScore(cycle, cycleHistory, now.AddDate(0, 0, 10)); late.Prediction != "cold" {
+		t.Errorf("read every 45 days, 50 days on: predicted %s, want cold", late.Prediction)
+	}
+}
+
+func TestObjectWithoutHistory(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+	obj, _ := accessedObject("untouched", now.AddDate(0, 0, -200), nil)
+
+	score := dc.calculateObjectScore(obj, nil, now)
+	if score.Prediction != "cold" {
+		t.Errorf("object never read in 200 days predicted %s, want cold", score.Prediction)
+	}
+}
+
+// weekdayHours returns an access every business hour, Monday to Friday, for weeks weeks
+// up to now
+func weekdayHours(now time.Time, weeks int) []time.Time {
+	var times []time.Time
+	for day := now.AddDate(0, 0, -7*weeks); day.Before(now); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+		for hour := 9; hour < 17; hour++ {
+			if at := midnight.Add(time.Duration(hour) * time.Hour); at.Before(now) {
+				times = append(times, at)
+			}
+		}
+	}
+	return times
+}
+
+func TestWeekdayObjectStaysHotOnSunday(t *testing.T) {
+	dc := NewDataClassifier()
+	sunday := time.Date(2024, 6, 16, 10, 0, 0, 0, time.UTC)
+	if sunday.Weekday() != time.Sunday {
+		t.Fatalf("%s is a %s", sunday, sunday.Weekday())
+	}
+
+	obj, history := accessedObject("analytics", sunday.AddDate(0, 0, -60), weekdayHours(sunday, 4))
+	score := dc.calculateObjectScore(obj, history, sunday)
+	if score.Prediction != "hot" {
+		t.Errorf("weekday object on a Sunday predicted %s (features %v), want hot", score.Prediction, score.Features)
+	}
+	if score.Features["expected_accesses_24h"] < 1 {
+		t.Errorf("expected_accesses_24h = %.2f, want Monday morning's reads expected", score.Features["expected_accesses_24h"])
+	}
+
+	// The same reads ending two weeks earlier aren't a rhythm that's still going
+	var earlier []time.Time
+	for _, access := range history {
+		earlier = append(earlier, access.AccessTime.AddDate(0, 0, -14))
+	}
+	stale, staleHistory := accessedObject("stale", sunday.AddDate(0, 0, -60), earlier)
+	if staleScore := dc.calculateObjectScore(stale, staleHistory, sunday); staleScore.Score >= score.Score {
+		t.Errorf("object last read two weeks ago scored %.3f, not below %.3f for the weekday object", staleScore.Score, score.Score)
+	}
+}
+
+func TestRecommendationsKeyedByMapName(t *testing.T) {
+	dc := NewDataClassifier()
+	now := time.Now()
+
+	// Renamed into a bucket: the catalog's name differs from the Key recorded at upload
+	renamed, _ := accessedObject("id-renamed", now.AddDate(0, 0, -400), nil)
+	renamed.Key = "old-name"
+	other, _ := accessedObject("id-other", now.AddDate(0, 0, -400), nil)
+	other.Key = "old-name" // a stale Key shared with another object must not confuse them
+
+	objects := map[string]*models.StorageObject{
+		"reports/2023-q4": renamed,
+		"archive/dump":    other,
+	}
+	recommendations, err := dc.GetRecommendations(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recommendations) != 2 {
+		t.Fatalf("got %d recommendations, want one per idle object", len(recommendations))
+	}
+	for _, rec := range recommendations {
+		obj, exists := objects[rec.ObjectKey]
+		if !exists {
+			t.Errorf("recommendation for %s keyed %q, which isn't in the catalog", rec.ObjectID, rec.ObjectKey)
+			continue
+		}
+		if obj.ID != rec.ObjectID {
+			t.Errorf("recommendation keyed %q has object ID %s, want %s", rec.ObjectKey, rec.ObjectID, obj.ID)
+		}
+		if rec.RecommendedTier != "cold" {
+			t.Errorf("%s recommended %s, want cold", rec.ObjectKey, rec.RecommendedTier)
+		}
+	}
+}
+
+func BenchmarkGetRecommendations(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			dc := NewDataClassifier()
+			now := time.Now()
+			objects := make(map[string]*models.StorageObject, n)
+			for i := 0; i < n; i++ {
+				obj, _ := accessedObject(fmt.Sprintf("id-%d", i), now.AddDate(0, 0, -i%400), nil)
+				obj.LastAccess = now.AddDate(0, 0, -i%100)
+				objects[fmt.Sprintf("bucket/object-%d", i)] = obj
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dc.GetRecommendations(objects); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
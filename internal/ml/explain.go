@@ -0,0 +1,108 @@
+package ml
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const explanationSize = 3 // contributors kept in ObjectScore.Explanation
+
+// FeatureContribution is one feature's signed, weighted share of the composite score
+type FeatureContribution struct {
+	Feature      string  `json:"feature"`
+	Value        float64 `json:"value"`
+	Contribution float64 `json:"contribution"`
+}
+
+// FeatureImportance summarizes a classification run as the mean absolute contribution per feature
+type FeatureImportance struct {
+	Objects    int                `json:"objects"`
+	Features   map[string]float64 `json:"features"`
+	ComputedAt time.Time          `json:"computed_at"`
+}
+
+func topContributions(contributions []FeatureContribution, n int) []FeatureContribution {
+	sorted := make([]FeatureContribution, len(contributions))
+	copy(sorted, contributions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return math.Abs(sorted[i].Contribution) > math.Abs(sorted[j].Contribution)
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+func describeFeature(feature string, value float64) string {
+	switch feature {
+	case "days_since_access":
+		return fmt.Sprintf("last accessed %.1f days ago", value)
+	case "weekdays_since_access":
+		return fmt.Sprintf("last accessed %.1f weekdays ago", value)
+	case "expected_accesses_24h":
+		return fmt.Sprintf("%.1f accesses expected in the next 24h", value)
+	case "seasonal_days_until_access":
+		return fmt.Sprintf("seasonal access expected in %.1f days", value)
+	case "access_frequency":
+		return fmt.Sprintf("%.2f accesses per day", value)
+	case "accesses_7d":
+		return fmt.Sprintf("%.0f accesses in the last 7 days", value)
+	case "distinct_users":
+		return fmt.Sprintf("read by %.0f users", value)
+	case "read_write_ratio":
+		return fmt.Sprintf("%.1f reads per write", value)
+	case "access_interval_variance":
+		return fmt.Sprintf("gaps between accesses vary by %.1f hours", math.Sqrt(value))
+	case "size_mb":
+		return fmt.Sprintf("%.1f MB in size", value)
+	case "days_since_creation":
+		return fmt.Sprintf("created %.1f days ago", value)
+	default:
+		return fmt.Sprintf("%s = %.2f", feature, value)
+	}
+}
+
+type importanceAccumulator struct {
+	objects int
+	totals  map[string]float64
+}
+
+func newImportanceAccumulator() *importanceAccumulator {
+	return &importanceAccumulator{totals: make(map[string]float64)}
+}
+
+func (a *importanceAccumulator) add(contributions []FeatureContribution) {
+	a.objects++
+	for _, c := range contributions {
+		a.totals[c.Feature] += math.Abs(c.Contribution)
+	}
+}
+
+func (a *importanceAccumulator) summary() *FeatureImportance {
+	features := make(map[string]float64, len(a.totals))
+	for feature, total := range a.totals {
+		features[feature] = total / float64(a.objects)
+	}
+
+	return &FeatureImportance{
+		Objects:    a.objects,
+		Features:   features,
+		ComputedAt: time.Now(),
+	}
+}
+
+func (dc *DataClassifier) setFeatureImportance(importance *FeatureImportance) {
+	dc.importanceMutex.Lock()
+	defer dc.importanceMutex.Unlock()
+	dc.importance = importance
+}
+
+// FeatureImportance returns the summary of the last classification run, or nil if none has run
+func (dc *DataClassifier) FeatureImportance() *FeatureImportance {
+	dc.importanceMutex.RLock()
+	defer dc.importanceMutex.RUnlock()
+	return dc.importance
+}
@@ -0,0 +1,132 @@
+package ml
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// explainedObjects is a mix of objects scored for different reasons, with their histories
+func explainedObjects(now time.Time) (map[string]*models.StorageObject, []models.AccessPattern) {
+	objects := make(map[string]*models.StorageObject)
+	var patterns []models.AccessPattern
+	add := func(key string, obj *models.StorageObject, history []models.AccessPattern) {
+		objects[key] = obj
+		patterns = append(patterns, history...)
+	}
+
+	created := now.AddDate(-1, 0, 0)
+	bursty, history := accessedObject("bursty", created, burst(now.Add(-3*time.Hour), 50))
+	add("bursty", bursty, history)
+	steady, history := accessedObject("steady", created, spread(created, now.AddDate(0, 0, -20), 50))
+	add("steady", steady, history)
+	idle, history := accessedObject("idle", created, nil)
+	idle.Size = 2 << 30
+	add("datasets/director", idle, history)
+	fresh, history := accessedObject("fresh", now.Add(-time.Hour), nil)
+	add("fresh", fresh, history)
+	weekly, history := accessedObject("weekly", created, weekdayHours(now, 4))
+	add("weekly", weekly, history)
+	return objects, patterns
+}
+
+func TestContributionsSumToScore(t *testing.T) {
+	now := time.Date(2024, 6, 12, 12, 0, 0, 0, time.UTC)
+	objects, patterns := explainedObjects(now)
+	dc := NewDataClassifier()
+	history := make(map[string][]models.AccessPattern)
+	for _, pattern := range patterns {
+		history[pattern.ObjectID] = append(history[pattern.ObjectID], pattern)
+	}
+
+	for key, obj := range objects {
+		score := dc.calculateObjectScore(obj, history[obj.ID], now)
+
+		sum := 0.0
+		for _, c := range score.contributions {
+			sum += c.Contribution
+		}
+		if math.Abs(sum-score.Score) > 1e-9 {
+			t.Errorf("%s: contributions sum to %v, score is %v", key, sum, score.Score)
+		}
+
+		// The explanation is the largest of them, largest first
+		if len(score.Explanation) != explanationSize {
+			t.Fatalf("%s: explained by %d features, want %d", key, len(score.Explanation), explanationSize)
+		}
+		smallest := math.Abs(score.Explanation[len(score.Explanation)-1].Contribution)
+		for i, c := range score.Explanation {
+			if i > 0 && math.Abs(c.Contribution) > math.Abs(score.Explanation[i-1].Contribution) {
+				t.Errorf("%s: explanation %+v isn't largest first", key, score.Explanation)
+			}
+		}
+		left := 0
+		for _, c := range score.contributions {
+			if math.Abs(c.Contribution) > smallest {
+				left++
+			}
+		}
+		if left >= explanationSize {
+			t.Errorf("%s: explanation %+v leaves out larger contributions among %+v", key, score.Explanation, score.contributions)
+		}
+	}
+}
+
+func TestReasonNamesTopContributors(t *testing.T) {
+	now := time.Now()
+	objects, patterns := explainedObjects(now)
+	dc := NewDataClassifier()
+	for _, pattern := range patterns {
+		dc.AddAccessPattern(pattern)
+	}
+
+	recommendations, err := dc.GetRecommendations(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var demotion *TieringRecommendation
+	for i, rec := range recommendations {
+		if rec.ObjectKey == "datasets/director" {
+			demotion = &recommendations[i]
+		}
+	}
+	if demotion == nil || demotion.RecommendedTier != "cold" {
+		t.Fatalf("recommendations %+v, want the idle dataset sent cold", recommendations)
+	}
+	// Says what the score came from, not a template
+	if !strings.HasPrefix(demotion.Reason, "Predicted cold") {
+		t.Errorf("reason %q doesn't give the prediction", demotion.Reason)
+	}
+	for _, c := range dc.calculateObjectScore(objects["datasets/director"], nil, now).Explanation {
+		if want := describeFeature(c.Feature, c.Value); !strings.Contains(demotion.Reason, want) {
+			t.Errorf("reason %q doesn't mention %q", demotion.Reason, want)
+		}
+	}
+
+	// The run's importance is the mean absolute contribution of each feature
+	scores, err := dc.ClassifyObjects(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importance := dc.FeatureImportance()
+	if importance == nil || importance.Objects != len(objects) {
+		t.Fatalf("importance %+v, want one for %d objects", importance, len(objects))
+	}
+	totals := make(map[string]float64)
+	for _, score := range scores {
+		for _, c := range score.contributions {
+			totals[c.Feature] += math.Abs(c.Contribution)
+		}
+	}
+	if len(importance.Features) != len(totals) {
+		t.Errorf("importance of %v, want of the features in %v", importance.Features, totals)
+	}
+	for feature, total := range totals {
+		if mean := total / float64(len(objects)); math.Abs(importance.Features[feature]-mean) > 1e-9 {
+			t.Errorf("%s importance %v, want %v", feature, importance.Features[feature], mean)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package ml
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// busyRate is the accesses per day at which recent activity scores full marks; it is
+// scored on a log scale so a few accesses a day already count for something
+const busyRate = 100.0
+
+// sharedUsers is how many users reading an object in the hot window make it hot short of
+// the access threshold, and widelyShared how many give it full marks for sharing
+const (
+	sharedUsers  = 3
+	widelyShared = 10
+)
+
+// addPatternFeatures records what an object's recorded accesses say beyond its counters:
+// reads per write, how many users it has, how many accesses came in the last day and week,
+// and the mean and variance of the gaps between them. An object with no recorded accesses
+// gets zero counts and no ratio or gaps.
+func addPatternFeatures(features map[string]float64, history []models.AccessPattern, now time.Time) {
+	var reads, writes, lastDay, lastWeek int
+	users := make(map[string]bool)
+	times := make([]time.Time, 0, len(history))
+	for _, pattern := range history {
+		switch pattern.Operation {
+		case "read":
+			reads++
+		case "write":
+			writes++
+		}
+		users[pattern.UserID] = true
+		age := now.Sub(pattern.AccessTime)
+		if age <= 24*time.Hour {
+			lastDay++
+		}
+		if age <= 7*24*time.Hour {
+			lastWeek++
+		}
+		times = append(times, pattern.AccessTime)
+	}
+
+	features["distinct_users"] = float64(len(users))
+	features["accesses_24h"] = float64(lastDay)
+	features["accesses_7d"] = float64(lastWeek)
+	if len(history) == 0 {
+		return
+	}
+	features["read_write_ratio"] = float64(reads) / float64(max(writes, 1))
+
+	// Mean of the gaps between accesses in hours, and their variance in hours squared; it
+	// takes two gaps
+	if len(times) < 3 {
+		return
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	gaps := make([]float64, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]).Hours())
+	}
+	mean, stddev := meanStddev(gaps)
+	features["access_interval_hours"] = mean
+	features["access_interval_variance"] = stddev * stddev
+}
+
+// recentActivityScore scores the busier of the last day and the last week's average day
+func recentActivityScore(features map[string]float64) float64 {
+	rate := math.Max(features["accesses_24h"], features["accesses_7d"]/7)
+	return math.Min(1.0, math.Log1p(rate)/math.Log1p(busyRate))
+}
+
+// expectedActivityScore scores the accesses the coming day had on average in past weeks,
+// on the same scale as recentActivityScore
+func expectedActivityScore(features map[string]float64) float64 {
+	return math.Min(1.0, math.Log1p(features["expected_accesses_24h"])/math.Log1p(busyRate))
+}
+
+// sharingScore scores how many users read an object, on a log scale up to widelyShared
+func sharingScore(features map[string]float64) float64 {
+	return math.Min(1.0, math.Log1p(features["distinct_users"])/math.Log1p(widelyShared))
+}
+
+// readScore scores the share of an object's accesses that are reads; writes alone, or no
+// recorded accesses, score nothing
+func readScore(features map[string]float64) float64 {
+	ratio := features["read_write_ratio"]
+	return ratio / (1 + ratio)
+}
+
+// regularityScore scores how steadily an object is accessed, by how far its gaps stray
+// from their mean, in days; it takes two gaps to tell
+func regularityScore(features map[string]float64) float64 {
+	variance, ok := features["access_interval_variance"]
+	if !ok {
+		return 0
+	}
+	return 1.0 / (1.0 + math.Sqrt(variance)/24)
+}
+
+// dueOnCycle reports whether an object read on a steady cycle, its gaps straying from
+// their mean by no more than a quarter of it, isn't overdue for its next read after
+// daysSinceAccess, and how sure that is
+func dueOnCycle(features map[string]float64, daysSinceAccess float64) (bool, float64) {
+	interval, ok := features["access_interval_hours"]
+	if !ok || interval <= 0 {
+		return false, 0
+	}
+	spread := math.Sqrt(features["access_interval_variance"])
+	if spread > interval/4 || daysSinceAccess*24 > interval+2*spread {
+		return false, 0
+	}
+	return true, 0.9 - spread/interval
+}
@@ -0,0 +1,179 @@
+package ml
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+const (
+	minPeriodicIntervals = 3    // need at least this many gaps before trusting a period
+	maxPeriodVariation   = 0.25 // coefficient of variation allowed between gaps
+)
+
+// AccessPrediction describes the periodicity found in an object's read history
+type AccessPrediction struct {
+	Periodic   bool          `json:"periodic"`
+	Period     time.Duration `json:"period"`
+	NextAccess time.Time     `json:"next_access"`
+	Regularity float64       `json:"regularity"` // 1.0 = perfectly regular gaps
+}
+
+type PrefetchOptions struct {
+	Horizon  time.Duration
+	IsCached func(key string) bool // nil when no read cache is configured
+}
+
+type PrefetchEntry struct {
+	ObjectID        string        `json:"object_id"`
+	ObjectKey       string        `json:"object_key"`
+	CurrentTier     string        `json:"current_tier"`
+	Size            int64         `json:"size"`
+	Action          string        `json:"action"` // promote_tier, preload_cache
+	TargetTier      string        `json:"target_tier,omitempty"`
+	PredictedAccess time.Time     `json:"predicted_access"`
+	Period          time.Duration `json:"period"`
+}
+
+// predictNextAccess looks for a regular gap between accesses and projects it forward past now
+func predictNextAccess(times []time.Time, now time.Time) AccessPrediction {
+	if len(times) < minPeriodicIntervals+1 {
+		return AccessPrediction{}
+	}
+
+	sorted := make([]time.Time, len(times))
+	copy(sorted, times)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	intervals := make([]float64, 0, len(sorted)-1)
+	for i := 1; i < len(sorted); i++ {
+		intervals = append(intervals, sorted[i].Sub(sorted[i-1]).Seconds())
+	}
+
+	mean, stddev := meanStddev(intervals)
+	if mean <= 0 {
+		return AccessPrediction{}
+	}
+
+	variation := stddev / mean
+	if variation > maxPeriodVariation {
+		return AccessPrediction{Regularity: math.Max(0, 1-variation)}
+	}
+
+	period := time.Duration(mean * float64(time.Second))
+	next := sorted[len(sorted)-1].Add(period)
+	if next.Before(now) {
+		// Roll forward over the cycles we've missed
+		missed := now.Sub(next)/period + 1
+		next = next.Add(missed * period)
+	}
+
+	return AccessPrediction{
+		Periodic:   true,
+		Period:     period,
+		NextAccess: next,
+		Regularity: 1 - variation,
+	}
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(values))
+
+	return mean, math.Sqrt(variance)
+}
+
+// readTimesByObject groups the recorded read times by object ID
+func (dc *DataClassifier) readTimesByObject() map[string][]time.Time {
+	dc.patternsMutex.RLock()
+	defer dc.patternsMutex.RUnlock()
+	times := make(map[string][]time.Time)
+	for _, pattern := range dc.accessPatterns {
+		if pattern.Operation != "read" {
+			continue
+		}
+		times[pattern.ObjectID] = append(times[pattern.ObjectID], pattern.AccessTime)
+	}
+	return times
+}
+
+// PredictAccess returns the periodicity prediction for every object with enough history.
+// Objects whose gaps are irregular but whose reads follow a weekly or monthly cycle are
+// predicted from that cycle instead.
+func (dc *DataClassifier) PredictAccess(now time.Time) map[string]AccessPrediction {
+	predictions := make(map[string]AccessPrediction)
+	for objectID, times := range dc.readTimesByObject() {
+		if prediction := predictNextAccess(times, now); prediction.Periodic {
+			predictions[objectID] = prediction
+			continue
+		}
+		if season, ok := strongestSeason(times, now); ok {
+			predictions[objectID] = AccessPrediction{
+				Periodic:   true,
+				Period:     season.Period,
+				NextAccess: season.NextExpected,
+				Regularity: season.Strength,
+			}
+		}
+	}
+	return predictions
+}
+
+// GetPrefetchRecommendations lists objects expected to be read within the horizon that
+// would be served faster after a tier promotion or a cache preload. Entries are keyed, and
+// the cache asked about them, by their names in objects.
+func (dc *DataClassifier) GetPrefetchRecommendations(objects map[string]*models.StorageObject, opts PrefetchOptions, now time.Time) []PrefetchEntry {
+	predictions := dc.PredictAccess(now)
+	deadline := now.Add(opts.Horizon)
+
+	entries := make([]PrefetchEntry, 0)
+	for key, obj := range objects {
+		prediction, ok := predictions[obj.ID]
+		if !ok || prediction.NextAccess.After(deadline) {
+			continue
+		}
+
+		entry := PrefetchEntry{
+			ObjectID:        obj.ID,
+			ObjectKey:       key,
+			CurrentTier:     obj.StorageTier,
+			Size:            obj.Size,
+			PredictedAccess: prediction.NextAccess,
+			Period:          prediction.Period,
+		}
+
+		switch {
+		case obj.StorageTier == "warm" || obj.StorageTier == "cold":
+			entry.Action = "promote_tier"
+			entry.TargetTier = "hot"
+		case opts.IsCached != nil && !opts.IsCached(key):
+			entry.Action = "preload_cache"
+		default:
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// Soonest first so a budgeted consumer handles the most urgent objects
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PredictedAccess.Before(entries[j].PredictedAccess)
+	})
+
+	return entries
+}
@@ -0,0 +1,90 @@
+package ml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// daily returns a read at the same time of day on each of the days before now
+func daily(now time.Time, hour, days int) []time.Time {
+	first := time.Date(now.Year(), now.Month(), now.Day()-days, hour, 0, 0, 0, now.Location())
+	times := make([]time.Time, days)
+	for i := range times {
+		times[i] = first.AddDate(0, 0, i)
+	}
+	return times
+}
+
+// prefetchClassifier knows of each object in reads being read at the times given
+func prefetchClassifier(reads map[*models.StorageObject][]time.Time) *DataClassifier {
+	dc := NewDataClassifier()
+	for obj, times := range reads {
+		_, history := accessedObject(obj.ID, obj.CreatedAt, times)
+		for _, pattern := range history {
+			dc.AddAccessPattern(pattern)
+		}
+	}
+	return dc
+}
+
+func TestPrefetchNightlyReads(t *testing.T) {
+	// 01:00, an hour before the nightly batch job reads its inputs
+	now := time.Date(2024, 6, 12, 1, 0, 0, 0, time.UTC)
+	created := now.AddDate(0, -1, 0)
+	warm, _ := accessedObject("warm-input", created, nil)
+	warm.StorageTier = "warm"
+	uncached, _ := accessedObject("uncached-input", created, nil)
+	cached, _ := accessedObject("cached-input", created, nil)
+	adhoc, _ := accessedObject("adhoc", created, nil)
+	adhoc.StorageTier = "cold"
+
+	start := now.AddDate(0, 0, -5)
+	dc := prefetchClassifier(map[*models.StorageObject][]time.Time{
+		warm:     daily(now, 2, 7),
+		uncached: daily(now, 2, 7),
+		cached:   daily(now, 2, 7),
+		// Read now and then, with nothing regular about it
+		adhoc: {start, start.Add(time.Hour), start.Add(30 * time.Hour), start.Add(31 * time.Hour), start.Add(70 * time.Hour), start.Add(100 * time.Hour)},
+	})
+	objects := map[string]*models.StorageObject{
+		"batch/warm":     warm,
+		"batch/uncached": uncached,
+		"batch/cached":   cached,
+		"adhoc":          adhoc,
+	}
+	isCached := func(key string) bool { return key == "batch/cached" }
+
+	entries := dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 2 * time.Hour, IsCached: isCached}, now)
+	if len(entries) != 2 {
+		t.Fatalf("got %+v, want the warm and the uncached input", entries)
+	}
+	want := map[string]string{"batch/warm": "promote_tier", "batch/uncached": "preload_cache"}
+	nightly := time.Date(2024, 6, 12, 2, 0, 0, 0, time.UTC)
+	for _, entry := range entries {
+		if want[entry.ObjectKey] != entry.Action {
+			t.Errorf("%s: %s, want %s", entry.ObjectKey, entry.Action, want[entry.ObjectKey])
+		}
+		if entry.Action == "promote_tier" && entry.TargetTier != "hot" {
+			t.Errorf("%s promoted to %s, want hot", entry.ObjectKey, entry.TargetTier)
+		}
+		if !entry.PredictedAccess.Equal(nightly) || entry.Period != 24*time.Hour {
+			t.Errorf("%s expected at %v every %v, want 02:00 every day", entry.ObjectKey, entry.PredictedAccess, entry.Period)
+		}
+	}
+
+	// Outside the window: too far ahead, or just missed and a day away again
+	if entries := dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 30 * time.Minute, IsCached: isCached}, now); len(entries) != 0 {
+		t.Errorf("got %+v with an hour to go and a 30 minute horizon", entries)
+	}
+	if entries := dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 2 * time.Hour, IsCached: isCached}, nightly.Add(time.Minute)); len(entries) != 0 {
+		t.Errorf("got %+v just after the nightly reads", entries)
+	}
+
+	// Without a read cache there is nothing to preload
+	entries = dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 2 * time.Hour}, now)
+	if len(entries) != 1 || entries[0].ObjectKey != "batch/warm" {
+		t.Errorf("got %+v without a cache, want only the warm input promoted", entries)
+	}
+}
@@ -0,0 +1,122 @@
+package ml
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxRulesHistory is how many rule changes a RuleStore remembers
+const maxRulesHistory = 100
+
+// RulesChange is one replacement of the tiering rules
+type RulesChange struct {
+	Time     time.Time    `json:"time"`
+	Actor    string       `json:"actor"`
+	Previous TieringRules `json:"previous"`
+	Rules    TieringRules `json:"rules"`
+}
+
+// RuleStore keeps the rules a classifier was last given at runtime in a file, so they
+// outlive restarts, along with who changed them and when
+type RuleStore struct {
+	path       string
+	classifier *DataClassifier
+
+	mutex   sync.Mutex
+	saved   bool
+	history []RulesChange // oldest first
+}
+
+type rulesFile struct {
+	Rules   TieringRules  `json:"rules"`
+	History []RulesChange `json:"history"`
+}
+
+// OpenRuleStore reads the rules saved at path, if any, and gives them to classifier
+func OpenRuleStore(path string, classifier *DataClassifier) (*RuleStore, error) {
+	s := &RuleStore{path: path, classifier: classifier}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tiering rules: %v", err)
+	}
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tiering rules: %v", err)
+	}
+	if err := classifier.SetRules(file.Rules); err != nil {
+		return nil, fmt.Errorf("saved tiering rules are invalid: %v", err)
+	}
+	s.saved = true
+	s.history = file.History
+	return s, nil
+}
+
+// Saved reports whether rules have been saved, which then take precedence over the
+// configured ones at startup
+func (s *RuleStore) Saved() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saved
+}
+
+// Update validates rules, hands them to the classifier for its next run and saves them.
+// Invalid rules are rejected and the old ones kept.
+func (s *RuleStore) Update(rules TieringRules, actor string) (RulesChange, error) {
+	if err := rules.Validate(); err != nil {
+		return RulesChange{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change := RulesChange{Time: time.Now(), Actor: actor, Previous: s.classifier.Rules(), Rules: rules}
+	history := append(s.history, change)
+	if len(history) > maxRulesHistory {
+		history = history[len(history)-maxRulesHistory:]
+	}
+	if err := s.save(rulesFile{Rules: rules, History: history}); err != nil {
+		return RulesChange{}, err
+	}
+	if err := s.classifier.SetRules(rules); err != nil {
+		return RulesChange{}, err
+	}
+	s.saved = true
+	s.history = history
+	return change, nil
+}
+
+// History returns the rule changes, newest first
+func (s *RuleStore) History() []RulesChange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := make([]RulesChange, 0, len(s.history))
+	for i := len(s.history) - 1; i >= 0; i-- {
+		history = append(history, s.history[i])
+	}
+	return history
+}
+
+func (s *RuleStore) save(file rulesFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to save tiering rules: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save tiering rules: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save tiering rules: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package ml
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	weeklyPeriod  = 7 * 24 * time.Hour
+	monthlyPeriod = 30 * 24 * time.Hour
+
+	minSeasonalStrength = 0.6 // below this a cycle is treated as noise
+	minSeasonalCycles   = 2   // history must touch at least this many distinct cycles
+)
+
+// SeasonalEstimate describes how strongly accesses cluster at one point of a cycle.
+// Phase is the position of that point within the period, from 0 to 1.
+type SeasonalEstimate struct {
+	Period       time.Duration `json:"period"`
+	Strength     float64       `json:"strength"`
+	Phase        float64       `json:"phase"`
+	NextExpected time.Time     `json:"next_expected"`
+}
+
+func (s SeasonalEstimate) Strong() bool {
+	return s.Strength >= minSeasonalStrength
+}
+
+// estimateSeasonality treats each access as an angle around the cycle and measures the
+// length of their mean vector: 1.0 when every access lands at the same phase, near 0 when
+// accesses are spread evenly.
+func estimateSeasonality(times []time.Time, period time.Duration, now time.Time) SeasonalEstimate {
+	estimate := SeasonalEstimate{Period: period}
+	if len(times) == 0 {
+		return estimate
+	}
+
+	cycles := make(map[int64]bool)
+	var sumSin, sumCos float64
+	for _, t := range times {
+		offset := t.UnixNano() % int64(period)
+		angle := 2 * math.Pi * float64(offset) / float64(period)
+		sumSin += math.Sin(angle)
+		sumCos += math.Cos(angle)
+		cycles[t.UnixNano()/int64(period)] = true
+	}
+
+	if len(cycles) < minSeasonalCycles {
+		return estimate
+	}
+
+	n := float64(len(times))
+	estimate.Strength = math.Sqrt(sumSin*sumSin+sumCos*sumCos) / n
+
+	meanAngle := math.Atan2(sumSin/n, sumCos/n)
+	if meanAngle < 0 {
+		meanAngle += 2 * math.Pi
+	}
+	estimate.Phase = meanAngle / (2 * math.Pi)
+
+	// Next time the cycle reaches its peak phase; a peak that passed moments ago
+	// still counts as the current window
+	cycleStart := time.Unix(0, now.UnixNano()-now.UnixNano()%int64(period))
+	next := cycleStart.Add(time.Duration(estimate.Phase * float64(period)))
+	if now.Sub(next) > period/10 {
+		next = next.Add(period)
+	}
+	if next.Before(now) {
+		next = now
+	}
+	estimate.NextExpected = next
+
+	return estimate
+}
+
+// addSeasonalFeatures records weekly and monthly seasonality and, when a strong cycle
+// exists, the days until its next expected access
+func addSeasonalFeatures(features map[string]float64, times []time.Time, now time.Time) {
+	weekly := estimateSeasonality(times, weeklyPeriod, now)
+	monthly := estimateSeasonality(times, monthlyPeriod, now)
+
+	features["weekly_seasonality"] = weekly.Strength
+	features["weekly_phase"] = weekly.Phase
+	features["monthly_seasonality"] = monthly.Strength
+	features["monthly_phase"] = monthly.Phase
+
+	for _, season := range []SeasonalEstimate{weekly, monthly} {
+		if !season.Strong() {
+			continue
+		}
+		days := season.NextExpected.Sub(now).Hours() / 24
+		if current, ok := features["seasonal_days_until_access"]; !ok || days < current {
+			features["seasonal_days_until_access"] = days
+		}
+	}
+}
+
+// effectiveRecency is the days figure used for recency scoring: the time since the last
+// access, or the weekdays since it or the time until a seasonally expected access if
+// either is less
+func effectiveRecency(features map[string]float64) (string, float64) {
+	feature, days := "days_since_access", features["days_since_access"]
+	for _, candidate := range []string{"weekdays_since_access", "seasonal_days_until_access"} {
+		if value, ok := features[candidate]; ok && value < days {
+			feature, days = candidate, value
+		}
+	}
+	return feature, days
+}
+
+// strongestSeason returns the strongest seasonal cycle in the history, if any is strong enough
+func strongestSeason(times []time.Time, now time.Time) (SeasonalEstimate, bool) {
+	weekly := estimateSeasonality(times, weeklyPeriod, now)
+	monthly := estimateSeasonality(times, monthlyPeriod, now)
+
+	best := weekly
+	if monthly.Strength > weekly.Strength {
+		best = monthly
+	}
+	return best, best.Strong()
+}
+
+const (
+	calendarWeeks = 4 // past weeks looked back on for expected_accesses_24h
+
+	// weekdayBias is the weekday_weekend_ratio from which an object's quiet weekends are
+	// expected, so its recency only counts weekdays
+	weekdayBias = 3.0
+)
+
+// addCalendarFeatures records how accesses fall on the clock and the calendar, in now's
+// location: how spread they are over the hours of the day (hour_entropy, 0 when all in one
+// hour, 1 when even), how much busier a weekday is than a weekend day, and how many
+// accesses the next 24 hours had on average in the past weeks. Objects busy mostly on
+// weekdays also get their recency counted in weekdays.
+func addCalendarFeatures(features map[string]float64, times []time.Time, lastAccess, now time.Time) {
+	if len(times) == 0 {
+		return
+	}
+
+	var hours [24]int
+	var weekdays, weekends int
+	oldest := times[0]
+	for _, t := range times {
+		local := t.In(now.Location())
+		hours[local.Hour()]++
+		if isWeekend(local) {
+			weekends++
+		} else {
+			weekdays++
+		}
+		if t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	if len(times) > 1 {
+		var entropy float64
+		for _, count := range hours {
+			if count > 0 {
+				p := float64(count) / float64(len(times))
+				entropy -= p * math.Log(p)
+			}
+		}
+		features["hour_entropy"] = entropy / math.Log(24)
+	}
+
+	// Per day of each kind; a weekend without accesses counts as one, to keep it finite
+	ratio := (float64(weekdays) / 5) / (math.Max(float64(weekends), 1) / 2)
+	features["weekday_weekend_ratio"] = ratio
+	if ratio >= weekdayBias {
+		features["weekdays_since_access"] = weekdayDuration(lastAccess.In(now.Location()), now).Hours() / 24
+	}
+
+	// Only weeks the history reaches back to count, or a new object would look idle
+	var expected, weeks int
+	for k := 1; k <= calendarWeeks; k++ {
+		start := now.Add(-time.Duration(k) * weeklyPeriod)
+		if start.Before(oldest) {
+			break
+		}
+		end := start.Add(24 * time.Hour)
+		for _, t := range times {
+			if !t.Before(start) && t.Before(end) {
+				expected++
+			}
+		}
+		weeks++
+	}
+	if weeks > 0 {
+		features["expected_accesses_24h"] = float64(expected) / float64(weeks)
+	}
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
+
+// weekdayDuration is how much of the time from from to to falls on weekdays
+func weekdayDuration(from, to time.Time) time.Duration {
+	if !from.Before(to) {
+		return 0
+	}
+	// Whole weeks hold five weekdays each; the rest is walked a day at a time
+	weeks := to.Sub(from) / weeklyPeriod
+	total := weeks * 5 * 24 * time.Hour
+	from = from.Add(weeks * weeklyPeriod)
+	for from.Before(to) {
+		midnight := time.Date(from.Year(), from.Month(), from.Day()+1, 0, 0, 0, 0, from.Location())
+		if midnight.After(to) {
+			midnight = to
+		}
+		if !isWeekend(from) {
+			total += midnight.Sub(from)
+		}
+		from = midnight
+	}
+	return total
+}
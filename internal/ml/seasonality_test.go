@@ -0,0 +1,122 @@
+package ml
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// monthEnd returns reads every six hours through the last three days of each of the
+// cycles months before now's, as a month-end report is read
+func monthEnd(now time.Time, cycles int) []time.Time {
+	current := now.UnixNano() - now.UnixNano()%int64(monthlyPeriod)
+	var times []time.Time
+	for k := cycles; k >= 1; k-- {
+		start := time.Unix(0, current-int64(k)*int64(monthlyPeriod)).UTC().Add(27 * 24 * time.Hour)
+		for i := 0; i < 12; i++ {
+			times = append(times, start.Add(time.Duration(i)*6*time.Hour))
+		}
+	}
+	return times
+}
+
+func TestEstimateSeasonality(t *testing.T) {
+	// 25 days into a cycle, 25 days since the last month-end reads
+	cycle := time.Unix(0, 20*int64(monthlyPeriod)).UTC()
+	now := cycle.Add(25 * 24 * time.Hour)
+	reads := monthEnd(now, 4)
+
+	monthly := estimateSeasonality(reads, monthlyPeriod, now)
+	if !monthly.Strong() || monthly.Strength < 0.95 {
+		t.Errorf("monthly strength %.3f for reads three days a month, want near 1", monthly.Strength)
+	}
+	// Peaks midway through the last three days of the cycle
+	peak := 28.375 / 30
+	if math.Abs(monthly.Phase-peak) > 0.01 {
+		t.Errorf("monthly phase %.3f, want %.3f", monthly.Phase, peak)
+	}
+	expected := cycle.Add(time.Duration(peak * float64(monthlyPeriod)))
+	if d := monthly.NextExpected.Sub(expected); d < -time.Hour || d > time.Hour {
+		t.Errorf("next expected %v, want about %v", monthly.NextExpected, expected)
+	}
+	if weekly := estimateSeasonality(reads, weeklyPeriod, now); weekly.Strong() {
+		t.Errorf("weekly strength %.3f for a monthly cycle", weekly.Strength)
+	}
+
+	// The same number of reads evenly over the same months has no cycle
+	even := spread(reads[0], reads[len(reads)-1], len(reads))
+	for _, period := range []time.Duration{weeklyPeriod, monthlyPeriod} {
+		if season := estimateSeasonality(even, period, now); season.Strong() {
+			t.Errorf("strength %.3f over %v for evenly spread reads", season.Strength, period)
+		}
+	}
+
+	// One month-end is not a cycle yet
+	if season := estimateSeasonality(monthEnd(now, 1), monthlyPeriod, now); season.Strength != 0 {
+		t.Errorf("strength %.3f from a single cycle", season.Strength)
+	}
+}
+
+func TestMonthlyObjectIsNotColdBetweenCycles(t *testing.T) {
+	cycle := time.Unix(0, 20*int64(monthlyPeriod)).UTC()
+	now := cycle.Add(25 * 24 * time.Hour)
+	reads := monthEnd(now, 4)
+	created := reads[0].AddDate(0, 0, -1)
+	dc := NewDataClassifier()
+
+	report, reportHistory := accessedObject("report", created, reads)
+	even, evenHistory := accessedObject("even", created, spread(reads[0], reads[len(reads)-1], len(reads)))
+
+	reportScore := dc.calculateObjectScore(report, reportHistory, now)
+	evenScore := dc.calculateObjectScore(even, evenHistory, now)
+
+	for _, feature := range []string{"monthly_seasonality", "monthly_phase", "weekly_seasonality", "weekly_phase"} {
+		if _, ok := reportScore.Features[feature]; !ok {
+			t.Errorf("no %s in %v", feature, reportScore.Features)
+		}
+	}
+	if days := reportScore.Features["seasonal_days_until_access"]; days < 3 || days > 4 {
+		t.Errorf("next month-end expected in %.1f days, want about 3.4", days)
+	}
+	if _, ok := evenScore.Features["seasonal_days_until_access"]; ok {
+		t.Errorf("a seasonal access expected of evenly spread reads: %v", evenScore.Features)
+	}
+
+	// Both were last read 25 days ago; only the report is due again
+	if reportScore.Prediction != "hot" {
+		t.Errorf("report predicted %s, want hot with its month-end coming", reportScore.Prediction)
+	}
+	if evenScore.Prediction == "hot" {
+		t.Errorf("evenly read object predicted hot after 25 idle days")
+	}
+	if reportScore.Score <= evenScore.Score {
+		t.Errorf("report scored %.3f, not above %.3f for the same reads without a cycle", reportScore.Score, evenScore.Score)
+	}
+}
+
+func TestPrefetchMonthlyCycle(t *testing.T) {
+	cycle := time.Unix(0, 20*int64(monthlyPeriod)).UTC()
+	now := cycle.Add(25 * 24 * time.Hour)
+	report, _ := accessedObject("report", cycle.AddDate(0, -5, 0), nil)
+	report.StorageTier = "cold"
+	dc := prefetchClassifier(map[*models.StorageObject][]time.Time{report: monthEnd(now, 4)})
+	objects := map[string]*models.StorageObject{"reports/monthly": report}
+
+	entries := dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 4 * 24 * time.Hour}, now)
+	if len(entries) != 1 {
+		t.Fatalf("got %+v, want the report promoted ahead of month-end", entries)
+	}
+	entry := entries[0]
+	if entry.Action != "promote_tier" || entry.TargetTier != "hot" || entry.Period != monthlyPeriod {
+		t.Errorf("got %+v, want a promotion to hot on a monthly cycle", entry)
+	}
+	if until := entry.PredictedAccess.Sub(now); until < 3*24*time.Hour || until > 4*24*time.Hour {
+		t.Errorf("expected in %v, want about 3.4 days", until)
+	}
+
+	if entries := dc.GetPrefetchRecommendations(objects, PrefetchOptions{Horizon: 2 * 24 * time.Hour}, now); len(entries) != 0 {
+		t.Errorf("got %+v with month-end still 3 days off", entries)
+	}
+}
@@ -0,0 +1,137 @@
+package ml
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// SimulationRequest is a candidate configuration to compare against the active one.
+// CostModel is optional, the active cost model is used when it's empty.
+type SimulationRequest struct {
+	Rules     TieringRules `json:"rules"`
+	CostModel CostModel    `json:"cost_model,omitempty"`
+}
+
+type SimulationResult struct {
+	TotalObjects          int               `json:"total_objects"`
+	ChangedObjects        int               `json:"changed_objects"`
+	Transitions           map[string]int    `json:"transitions"` // "warm->cold": count
+	ActiveDistribution    map[string]int    `json:"active_distribution"`
+	CandidateDistribution map[string]int    `json:"candidate_distribution"`
+	DistributionDelta     map[string]int    `json:"distribution_delta"`
+	ActiveSavings         float64           `json:"active_savings"`
+	CandidateSavings      float64           `json:"candidate_savings"`
+	SavingsDelta          float64           `json:"savings_delta"`
+	Changes               []SimulatedChange `json:"changes,omitempty"`
+}
+
+// SimulatedChange is one object whose recommendation differs between the active and candidate rules
+type SimulatedChange struct {
+	ObjectID            string  `json:"object_id"`
+	ObjectKey           string  `json:"object_key"`
+	CurrentTier         string  `json:"current_tier"`
+	ActivePrediction    string  `json:"active_prediction"`
+	CandidatePrediction string  `json:"candidate_prediction"`
+	CandidateConfidence float64 `json:"candidate_confidence"`
+}
+
+// TierPair selects which changed objects to list in a simulation result
+type TierPair struct {
+	From  string
+	To    string
+	Limit int
+}
+
+func (req SimulationRequest) Validate() error {
+	if err := req.Rules.Validate(); err != nil {
+		return err
+	}
+	if len(req.CostModel) > 0 {
+		if err := req.CostModel.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Simulate classifies objects under both the active and the candidate configuration and
+// aggregates the differences. Nothing on the classifier is modified. When drill is set,
+// the changed objects moving between drill.From and drill.To are listed in the result.
+func (dc *DataClassifier) Simulate(objects map[string]*models.StorageObject, req SimulationRequest, drill *TierPair) (*SimulationResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	costs := req.CostModel
+	if len(costs) == 0 {
+		costs = dc.costModel
+	}
+
+	// The candidate is handed the pattern history below, so needs none of its own
+	candidate := &DataClassifier{
+		tieringRules: req.Rules,
+		costModel:    costs,
+	}
+
+	result := &SimulationResult{
+		Transitions:           make(map[string]int),
+		ActiveDistribution:    make(map[string]int),
+		CandidateDistribution: make(map[string]int),
+		DistributionDelta:     make(map[string]int),
+	}
+
+	now := time.Now()
+	history := dc.patternsByObject()
+
+	for _, obj := range objects {
+		active := dc.calculateObjectScore(obj, history[obj.ID], now)
+		proposed := candidate.calculateObjectScore(obj, history[obj.ID], now)
+
+		result.TotalObjects++
+		result.ActiveDistribution[active.Prediction]++
+		result.CandidateDistribution[proposed.Prediction]++
+
+		if obj.StorageTier != active.Prediction {
+			result.ActiveSavings += dc.calculateSavings(obj, active.Prediction)
+		}
+		if obj.StorageTier != proposed.Prediction {
+			result.CandidateSavings += candidate.calculateSavings(obj, proposed.Prediction)
+		}
+
+		if active.Prediction == proposed.Prediction {
+			continue
+		}
+
+		result.ChangedObjects++
+		result.Transitions[fmt.Sprintf("%s->%s", active.Prediction, proposed.Prediction)]++
+
+		if drill != nil && drill.From == active.Prediction && drill.To == proposed.Prediction {
+			if drill.Limit > 0 && len(result.Changes) >= drill.Limit {
+				continue
+			}
+			result.Changes = append(result.Changes, SimulatedChange{
+				ObjectID:            obj.ID,
+				ObjectKey:           obj.Key,
+				CurrentTier:         obj.StorageTier,
+				ActivePrediction:    active.Prediction,
+				CandidatePrediction: proposed.Prediction,
+				CandidateConfidence: proposed.Confidence,
+			})
+		}
+	}
+
+	for tier, count := range result.CandidateDistribution {
+		result.DistributionDelta[tier] = count - result.ActiveDistribution[tier]
+	}
+	for tier, count := range result.ActiveDistribution {
+		if _, ok := result.CandidateDistribution[tier]; !ok {
+			result.DistributionDelta[tier] = -count
+		}
+	}
+
+	result.SavingsDelta = result.CandidateSavings - result.ActiveSavings
+
+	return result, nil
+}
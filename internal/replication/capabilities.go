@@ -0,0 +1,51 @@
+package replication
+
+import (
+	"fmt"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Capabilities other nodes check for before sending this one copies that use optional
+// features. A node's list may hold names a sender doesn't know, which it ignores.
+const (
+	// CapabilityGzip is taking copies sent with Content-Encoding gzip
+	CapabilityGzip = "repl-" + CompressionGzip
+	// capabilityChecksum, followed by an algorithm, is verifying copies against a checksum
+	// of that kind, e.g. checksum-sha256
+	capabilityChecksum = "checksum-"
+)
+
+// Capabilities lists what this build understands of the optional replication features,
+// for cluster.ClusterManager.SetBuild
+func Capabilities() []string {
+	capabilities := []string{CapabilityGzip, CapabilityStored}
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		capabilities = append(capabilities, capabilityChecksum+algorithm)
+	}
+	return capabilities
+}
+
+// checksumFor returns the checksum to send a copy of obj to node with: obj's own, unless
+// node says what it understands and doesn't list its algorithm, in which case the data is
+// hashed again in one it does list
+func (rm *ReplicationManager) checksumFor(node *cluster.Node, obj *models.StorageObject) (algorithm, checksum string, err error) {
+	if !node.AdvertisesCapabilities() || node.HasCapability(capabilityChecksum+obj.ChecksumAlgorithm) {
+		return obj.ChecksumAlgorithm, obj.Checksum, nil
+	}
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		if !node.HasCapability(capabilityChecksum + algorithm) {
+			continue
+		}
+		data, _, err := rm.opener(obj)()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read object: %v", err)
+		}
+		defer data.Close()
+		checksum, err := storage.Checksum(algorithm, data)
+		return algorithm, checksum, err
+	}
+	return "", "", fmt.Errorf("node %s can't verify any checksum this node knows", node.ID)
+}
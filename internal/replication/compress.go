@@ -0,0 +1,189 @@
+package replication
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Encodings a replica can be sent in. Only gzip is understood so far; none sends every
+// copy as it is stored.
+const (
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// DefaultCompressionMinSize is the smallest object worth compressing on its way to another
+// node, below it the gzip header eats most of the saving
+const DefaultCompressionMinSize = 4096
+
+// DefaultUncompressedTypes are content types sent as they are, their data being compressed
+// already. Entries ending in a slash match every subtype.
+var DefaultUncompressedTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-xz", "application/x-bzip2", "application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// ValidateCompression checks an encoding name as SetCompression takes it
+func ValidateCompression(encoding string) error {
+	switch encoding {
+	case CompressionGzip, CompressionNone:
+		return nil
+	}
+	return fmt.Errorf("unknown replication compression %q (want %s or %s)", encoding, CompressionGzip, CompressionNone)
+}
+
+// compression is how copies are encoded on their way to other nodes, and which encodings
+// each of them has said it takes
+type compression struct {
+	settings atomic.Value // compressionSettings
+	accepted sync.Map     // node ID -> accept-encoding list, from its last answer
+}
+
+type compressionSettings struct {
+	encoding  string
+	minSize   int64
+	skipTypes []string
+}
+
+// SetCompression has copies of objects of at least minSize bytes sent to other nodes in
+// encoding, unless their content type is in skipTypes (see DefaultUncompressedTypes). A
+// node is only sent compressed copies once it has answered with an Accept-Encoding that
+// lists the encoding, so ones that don't know it get their copies as they are.
+func (rm *ReplicationManager) SetCompression(encoding string, minSize int64, skipTypes []string) {
+	if encoding == "" {
+		encoding = CompressionNone
+	}
+	rm.compression.settings.Store(compressionSettings{
+		encoding:  encoding,
+		minSize:   minSize,
+		skipTypes: append([]string(nil), skipTypes...),
+	})
+}
+
+// encodingFor returns the encoding to send contentType data of size bytes to nodeID in,
+// empty for none. Nodes that advertise their capabilities are taken at their word; others
+// have to have answered with an Accept-Encoding naming it.
+func (rm *ReplicationManager) encodingFor(nodeID, contentType string, size int64) string {
+	settings := rm.compression.settings.Load().(compressionSettings)
+	if settings.encoding == CompressionNone || size < settings.minSize || !compressible(contentType, settings.skipTypes) {
+		return ""
+	}
+	if node, exists := rm.clusterManager.GetNode(nodeID); exists && node.AdvertisesCapabilities() {
+		if !node.HasCapability("repl-" + settings.encoding) {
+			return ""
+		}
+		return settings.encoding
+	}
+	accepted, ok := rm.compression.accepted.Load(nodeID)
+	if !ok || !acceptsEncoding(accepted.(string), settings.encoding) {
+		return ""
+	}
+	return settings.encoding
+}
+
+// noteAccepted remembers which encodings nodeID said it takes in resp, a node that doesn't
+// say taking none
+func (rm *ReplicationManager) noteAccepted(nodeID string, resp *http.Response) {
+	rm.compression.accepted.Store(nodeID, resp.Header.Get("Accept-Encoding"))
+}
+
+// compressible reports whether contentType is worth compressing, that is it matches none
+// of skipTypes
+func compressible(contentType string, skipTypes []string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, skip := range skipTypes {
+		skip = strings.ToLower(skip)
+		if mediaType == skip || strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsEncoding reports whether an Accept-Encoding list names encoding without turning
+// it down with q=0
+func acceptsEncoding(list, encoding string) bool {
+	for _, item := range strings.Split(list, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		value, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		q, err := strconv.ParseFloat(value, 64)
+		return err == nil && q > 0
+	}
+	return false
+}
+
+// AcceptedEncodings is what the internal replica endpoint answers with in Accept-Encoding,
+// the encodings it can decode
+const AcceptedEncodings = CompressionGzip
+
+// ErrUnsupportedEncoding is returned for a replica sent in an encoding this node can't decode
+var ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// DecodeReplica wraps a replica body sent with contentEncoding in a reader of the data as
+// it was before, failing for encodings it doesn't know
+func DecodeReplica(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case CompressionGzip:
+		return gzip.NewReader(body)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, contentEncoding)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// compressedStream is data gzipped as it is read
+type compressedStream struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// compressStream gzips data as it is read from the returned stream. Closing the stream
+// stops the compression and waits until data is no longer being read.
+func compressStream(data io.Reader) *compressedStream {
+	pr, pw := io.Pipe()
+	stream := &compressedStream{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(stream.done)
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, data)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return stream
+}
+
+func (s *compressedStream) Close() error {
+	s.PipeReader.Close()
+	<-s.done
+	return nil
+}
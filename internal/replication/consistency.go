@@ -0,0 +1,98 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrUnderReplicated is returned when a write didn't get the copies its consistency level
+// asks for in time. Replication carries on in the background regardless.
+var ErrUnderReplicated = errors.New("not enough replicas acknowledged")
+
+// Consistency is how many copies of an object, the local one included, have to exist
+// before a write succeeds
+type Consistency string
+
+const (
+	ConsistencyOne    Consistency = "1"      // just the local one, replicas follow in the background
+	ConsistencyQuorum Consistency = "quorum" // a majority of the replication factor + 1 copies
+	ConsistencyAll    Consistency = "all"
+)
+
+func ParseConsistency(value string) (Consistency, error) {
+	switch level := Consistency(strings.ToLower(value)); level {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return level, nil
+	}
+	return "", fmt.Errorf("write consistency must be 1, quorum or all, not %q", value)
+}
+
+// RequiredAcks is how many other nodes have to acknowledge a copy of obj for level to be met
+func (rm *ReplicationManager) RequiredAcks(level Consistency, obj *models.StorageObject) int {
+	factor := rm.Factor(obj)
+	switch level {
+	case ConsistencyQuorum:
+		return (factor + 1) / 2
+	case ConsistencyAll:
+		return factor
+	}
+	return 0
+}
+
+// Factor is how many other nodes obj is to be kept on: what its writer asked for, or the
+// cluster's replication factor
+func (rm *ReplicationManager) Factor(obj *models.StorageObject) int {
+	if obj.ReplicationFactor != nil {
+		return *obj.ReplicationFactor
+	}
+	return rm.replicationFactor
+}
+
+// SuccessPolicy is how many targets a replication task has to get copies to for it to
+// count as completed: a number of them, or a quorum or all of the object's replication
+// factor. A task short of it is partial, or failed with none at all.
+type SuccessPolicy struct {
+	count int
+	level Consistency
+}
+
+func ParseSuccessPolicy(value string) (SuccessPolicy, error) {
+	switch level := Consistency(strings.ToLower(value)); level {
+	case ConsistencyQuorum, ConsistencyAll:
+		return SuccessPolicy{level: level}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return SuccessPolicy{}, fmt.Errorf("minimum success must be a number of nodes, quorum or all, not %q", value)
+	}
+	return SuccessPolicy{count: count}, nil
+}
+
+// SetMinSuccess changes the policy tasks are judged by, from the next one started
+func (rm *ReplicationManager) SetMinSuccess(policy SuccessPolicy) {
+	rm.minSuccess.Store(policy)
+}
+
+// MinSuccess is how many targets a task replicating obj has to reach, never more than its
+// replication factor
+func (rm *ReplicationManager) MinSuccess(obj *models.StorageObject) int {
+	policy := rm.minSuccess.Load().(SuccessPolicy)
+	factor := rm.Factor(obj)
+	var min int
+	switch policy.level {
+	case ConsistencyQuorum:
+		min = (factor + 1) / 2
+	case ConsistencyAll:
+		min = factor
+	default:
+		min = policy.count
+	}
+	if min > factor {
+		min = factor
+	}
+	return min
+}
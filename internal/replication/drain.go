@@ -0,0 +1,227 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+var (
+	ErrDrainRunning = errors.New("this node is draining already")
+	ErrNotDraining  = errors.New("this node isn't draining")
+)
+
+// drainRetryDelay is how long a drain waits before another pass over the objects it
+// couldn't hand over
+const drainRetryDelay = 30 * time.Second
+
+// drainer hands every object here over to the other nodes before this one is taken out:
+// each gets as many copies on healthy nodes that aren't draining as it is meant to have
+// counting the one here, which can then go with the node. Copies are paced like repairs.
+type drainer struct {
+	mutex  sync.Mutex
+	status DrainStatus
+	cancel context.CancelFunc
+}
+
+// DrainStatus is how the drain of this node is going. Once nothing remains it is drained.
+type DrainStatus struct {
+	State      string     `json:"state"` // empty, draining or drained, see cluster.DrainDraining
+	Running    bool       `json:"running"`
+	Passes     int        `json:"passes"`
+	Objects    int        `json:"objects_remaining"`
+	Bytes      int64      `json:"bytes_remaining"`
+	Copied     int        `json:"copies_made"`
+	Failed     int        `json:"failed"` // objects not handed over in the last pass
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// GetDrainStatus reports how the drain of this node is going, or went
+func (rm *ReplicationManager) GetDrainStatus() DrainStatus {
+	rm.drain.mutex.Lock()
+	status := rm.drain.status
+	rm.drain.mutex.Unlock()
+	status.State = rm.clusterManager.Draining()
+	return status
+}
+
+func (rm *ReplicationManager) updateDrain(fn func(status *DrainStatus)) {
+	rm.drain.mutex.Lock()
+	defer rm.drain.mutex.Unlock()
+	fn(&rm.drain.status)
+}
+
+// StartDrain marks this node draining, so the others stop picking it for writes and
+// copies, and hands its objects over to them in the background. Objects that can't be
+// handed over yet are tried again every drainRetryDelay until none remain, when the node
+// is marked drained. The state is kept across restarts; a node restarted while draining is
+// started draining again by main.
+func (rm *ReplicationManager) StartDrain() error {
+	if _, ok := rm.store.(storage.ReplicaRecorder); !ok {
+		return errors.New("the store doesn't keep track of replicas")
+	}
+	rm.drain.mutex.Lock()
+	if rm.drain.status.Running {
+		rm.drain.mutex.Unlock()
+		return ErrDrainRunning
+	}
+	if err := rm.clusterManager.SetDrain(cluster.DrainDraining); err != nil {
+		rm.drain.mutex.Unlock()
+		return err
+	}
+	ctx, cancel := rm.untilStopping()
+	started := time.Now()
+	rm.drain.status = DrainStatus{Running: true, StartedAt: &started}
+	rm.drain.cancel = cancel
+	rm.drain.mutex.Unlock()
+
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		defer cancel()
+		err := rm.runDrain(ctx)
+		if err == nil && ctx.Err() == nil {
+			if err = rm.clusterManager.SetDrain(cluster.DrainDrained); err == nil {
+				log.Printf("Drained: every object here has its copies elsewhere, the node can be shut down")
+			}
+		}
+		finished := time.Now()
+		rm.updateDrain(func(status *DrainStatus) {
+			status.Running = false
+			status.FinishedAt = &finished
+			if err != nil && !errors.Is(err, context.Canceled) {
+				status.LastError = err.Error()
+			}
+		})
+	}()
+	return nil
+}
+
+// CancelDrain stops a drain under way, or undoes one that has finished, so this node is
+// picked for writes and copies again. The copies already made stay.
+func (rm *ReplicationManager) CancelDrain() error {
+	rm.drain.mutex.Lock()
+	defer rm.drain.mutex.Unlock()
+	if !rm.drain.status.Running && rm.clusterManager.Draining() == "" {
+		return ErrNotDraining
+	}
+	if rm.drain.status.Running {
+		rm.drain.cancel()
+	}
+	return rm.clusterManager.SetDrain("")
+}
+
+// runDrain makes passes over the objects here until every one has been handed over, or
+// ctx ends
+func (rm *ReplicationManager) runDrain(ctx context.Context) error {
+	for {
+		var objects []*models.StorageObject
+		var bytes int64
+		now := time.Now()
+		for _, obj := range rm.store.List() {
+			if !storage.Expired(obj, now) {
+				objects = append(objects, obj)
+				bytes += obj.Size
+			}
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+		rm.updateDrain(func(status *DrainStatus) {
+			status.Passes++
+			status.Objects, status.Bytes, status.Failed = len(objects), bytes, 0
+		})
+		log.Printf("Draining %d objects (%d bytes)", len(objects), bytes)
+
+		for _, obj := range objects {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			made, err := rm.drainObject(obj)
+			rm.updateDrain(func(status *DrainStatus) {
+				status.Copied += made
+				if err != nil {
+					status.Failed++
+					status.LastError = fmt.Sprintf("%s: %v", obj.Key, err)
+					return
+				}
+				status.Objects--
+				status.Bytes -= obj.Size
+			})
+		}
+
+		status := rm.GetDrainStatus()
+		if status.Objects == 0 {
+			return nil
+		}
+		log.Printf("Drain pass left %d objects, trying again in %v: %s", status.Objects, drainRetryDelay, status.LastError)
+		select {
+		case <-time.After(drainRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drainObject makes copies of obj on healthy nodes that aren't draining until there are as
+// many of them as obj is meant to have counting the one here, or as many as there are such
+// nodes, returning how many it made
+func (rm *ReplicationManager) drainObject(obj *models.StorageObject) (int, error) {
+	self := rm.clusterManager.GetCurrentNode().ID
+	available := make(map[string]*cluster.Node)
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		if node.ID != self && node.Drain == "" {
+			available[node.ID] = node
+		}
+	}
+	var holders []*cluster.Node
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		if node, ok := available[nodeID]; ok {
+			holders = append(holders, node)
+		}
+	}
+	want := min(rm.Factor(obj)+1, len(available))
+	if want == 0 {
+		return 0, errors.New("no healthy node that isn't draining to hand it to")
+	}
+	need := want - len(holders)
+	if need <= 0 {
+		return 0, nil
+	}
+	if len(obj.Replicas) == 0 || obj.Replicas[0].Status != "active" {
+		return 0, errors.New("the copy here is corrupt")
+	}
+	targets := rm.clusterManager.SelectReplicaTargets(need, holders, obj.Size)
+	if len(targets) == 0 {
+		return 0, errors.New("no node has room for it")
+	}
+
+	open := rm.opener(obj)
+	throttled := func() (io.ReadCloser, *models.StorageObject, error) {
+		data, current, err := open()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &throttledReadCloser{throttledReader{r: data, t: &rm.repair.throttle}, data}, current, nil
+	}
+	_, results, _ := rm.startTask(obj, targets, 0, throttled, true, true)
+	made := 0
+	for range targets {
+		if <-results {
+			made++
+		}
+	}
+	if len(holders)+made < want {
+		return made, fmt.Errorf("%d of %d copies made", made, need)
+	}
+	return made, nil
+}
@@ -0,0 +1,143 @@
+package replication
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+const defaultFailoverGrace = 5 * time.Minute
+
+// failover re-replicates the copies a node held once it has been unhealthy for longer than
+// a grace period, so a node that's only restarting doesn't get all its objects copied
+// elsewhere. Nodes that come back in time cancel it.
+type failover struct {
+	mutex   sync.Mutex
+	enabled bool
+	grace   time.Duration
+	pending map[string]graceTimer // by node ID
+	// afterFunc starts a grace period, time.AfterFunc unless a test has its own clock
+	afterFunc func(time.Duration, func()) graceTimer
+}
+
+// graceTimer is what a grace period needs of a *time.Timer
+type graceTimer interface {
+	Stop() bool
+}
+
+func afterFunc(d time.Duration, f func()) graceTimer {
+	return time.AfterFunc(d, f)
+}
+
+// SetFailover turns re-replicating the copies of nodes that have been unhealthy for longer
+// than grace on or off. Turning it off cancels what is waiting for its grace period to end.
+func (rm *ReplicationManager) SetFailover(enabled bool, grace time.Duration) {
+	rm.failover.mutex.Lock()
+	defer rm.failover.mutex.Unlock()
+	rm.failover.enabled, rm.failover.grace = enabled, grace
+	if !enabled {
+		rm.cancelFailovers()
+	}
+}
+
+// nodeStatusChanged is the ReplicationManager's OnNodeStatusChange listener
+func (rm *ReplicationManager) nodeStatusChanged(node *cluster.Node, old, new string) {
+	rm.failover.mutex.Lock()
+	defer rm.failover.mutex.Unlock()
+
+	timer, pending := rm.failover.pending[node.ID]
+	switch {
+	case node.ID == rm.clusterManager.GetCurrentNode().ID:
+		if old == cluster.StatusDead {
+			// The others have given up on what this node holds, and it missed what they
+			// wrote meanwhile
+			rm.CatchUp()
+		}
+	case new == cluster.StatusDead:
+		if pending {
+			timer.Stop()
+			delete(rm.failover.pending, node.ID)
+		}
+		select {
+		case <-rm.stopping:
+			return
+		default:
+		}
+		rm.inflight.Add(1)
+		go rm.nodeDead(node.ID)
+	case new == "healthy" && pending:
+		timer.Stop()
+		delete(rm.failover.pending, node.ID)
+		log.Printf("Node %s is back, its copies aren't re-replicated", node.ID)
+	case old == "healthy" && new == "unhealthy" && rm.failover.enabled && !pending:
+		nodeID := node.ID
+		rm.failover.pending[nodeID] = rm.failover.afterFunc(rm.failover.grace, func() { rm.nodeLost(nodeID) })
+		log.Printf("Node %s is unhealthy, re-replicating its copies unless it is back within %v", nodeID, rm.failover.grace)
+	}
+}
+
+// nodeLost repairs every object here with a copy on nodeID, now its grace period is over
+func (rm *ReplicationManager) nodeLost(nodeID string) {
+	rm.failover.mutex.Lock()
+	if _, pending := rm.failover.pending[nodeID]; !pending {
+		// Cancelled just as it went off
+		rm.failover.mutex.Unlock()
+		return
+	}
+	delete(rm.failover.pending, nodeID)
+	rm.failover.mutex.Unlock()
+
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		if node.ID == nodeID {
+			return
+		}
+	}
+	select {
+	case <-rm.stopping:
+		return
+	default:
+	}
+
+	rm.inflight.Add(1)
+	defer rm.inflight.Done()
+	log.Printf("Node %s has been unhealthy too long, re-replicating its copies", nodeID)
+	rm.repairScan(func(obj *models.StorageObject) bool {
+		for _, holder := range storage.RemoteReplicas(obj) {
+			if holder == nodeID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// nodeDead forgets the copies nodeID was recorded as holding, it having been taken for
+// dead, and makes new ones on the nodes still there straight away
+func (rm *ReplicationManager) nodeDead(nodeID string) {
+	defer rm.inflight.Done()
+	recorder, ok := rm.store.(storage.ReplicaRecorder)
+	if !ok {
+		return
+	}
+	forgotten, err := recorder.ForgetNode(nodeID)
+	if err != nil {
+		log.Printf("Failed to forget the copies on dead node %s: %v", nodeID, err)
+		return
+	}
+	log.Printf("Node %s is dead, re-replicating the %d objects it had copies of", nodeID, forgotten)
+	if forgotten > 0 {
+		rm.repairScan(nil)
+	}
+}
+
+// cancelFailovers stops every grace period running. The caller holds the failover lock.
+func (rm *ReplicationManager) cancelFailovers() {
+	for nodeID, timer := range rm.failover.pending {
+		timer.Stop()
+		delete(rm.failover.pending, nodeID)
+	}
+}
@@ -0,0 +1,157 @@
+package replication
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// fakeClock runs grace periods when it is moved on, not as time passes
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	fn     func()
+	active bool
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, fn func()) graceTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), fn: fn, active: true}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+// Advance moves the clock on by d, running the timers that go off meanwhile
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	for _, timer := range c.timers {
+		if timer.active && !timer.at.After(c.now) {
+			timer.active = false
+			due = append(due, timer.fn)
+		}
+	}
+	c.mutex.Unlock()
+	for _, fn := range due {
+		fn()
+	}
+}
+
+// newFailoverTest has node-1 with two objects, one with a copy on node-2 and one with a
+// copy on node-3, and grace periods of a minute on clock
+func newFailoverTest(t *testing.T) (*ReplicationManager, *cluster.ClusterManager, *fakeClock) {
+	t.Helper()
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	for key, holder := range map[string]string{"held-by-2": "node-2", "held-by-3": "node-3"} {
+		obj, err := store.Put(key, strings.NewReader(key), "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddReplica(key, obj.ID, obj.Version, holder, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	setStatus(t, cm, "node-2", "healthy")
+	rm := NewReplicationManager(cm, store, 1)
+	clock := &fakeClock{now: time.Now()}
+	rm.failover.afterFunc = clock.AfterFunc
+	rm.SetFailover(true, time.Minute)
+	t.Cleanup(func() { rm.Stop(context.Background()) })
+	return rm, cm, clock
+}
+
+func setStatus(t *testing.T, cm *cluster.ClusterManager, nodeID, status string) {
+	t.Helper()
+	if err := cm.RegisterNode(&cluster.Node{ID: nodeID, Address: "127.0.0.1:2", Status: status}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverAfterGracePeriod(t *testing.T) {
+	rm, cm, clock := newFailoverTest(t)
+	setStatus(t, cm, "node-2", "unhealthy")
+
+	clock.Advance(59 * time.Second)
+	if scans := rm.GetRepairStatus().Scans; scans != 0 {
+		t.Fatalf("%d repair scans within the grace period, want none", scans)
+	}
+
+	clock.Advance(time.Second)
+	status := rm.GetRepairStatus()
+	if status.Scans != 1 {
+		t.Fatalf("%d repair scans once the grace period was over, want 1", status.Scans)
+	}
+	// Only the object with a copy on node-2 is looked at
+	if status.ObjectsScanned != 1 {
+		t.Errorf("the scan looked at %d objects, want 1", status.ObjectsScanned)
+	}
+	rm.failover.mutex.Lock()
+	defer rm.failover.mutex.Unlock()
+	if n := len(rm.failover.pending); n != 0 {
+		t.Errorf("%d grace periods still pending", n)
+	}
+}
+
+func TestFailoverCancelledWhenNodeIsBack(t *testing.T) {
+	rm, cm, clock := newFailoverTest(t)
+	setStatus(t, cm, "node-2", "unhealthy")
+	clock.Advance(30 * time.Second)
+	setStatus(t, cm, "node-2", "healthy")
+
+	clock.Advance(time.Hour)
+	if scans := rm.GetRepairStatus().Scans; scans != 0 {
+		t.Errorf("%d repair scans for a node that came back in time, want none", scans)
+	}
+
+	// Unhealthy again, it gets a grace period of its own
+	setStatus(t, cm, "node-2", "unhealthy")
+	clock.Advance(time.Minute)
+	if scans := rm.GetRepairStatus().Scans; scans != 1 {
+		t.Errorf("%d repair scans after the second grace period, want 1", scans)
+	}
+}
+
+func TestFailoverDisabled(t *testing.T) {
+	rm, cm, clock := newFailoverTest(t)
+	setStatus(t, cm, "node-2", "unhealthy")
+	rm.SetFailover(false, time.Minute)
+
+	clock.Advance(time.Hour)
+	if scans := rm.GetRepairStatus().Scans; scans != 0 {
+		t.Errorf("%d repair scans with failover turned off while waiting, want none", scans)
+	}
+
+	setStatus(t, cm, "node-2", "healthy")
+	setStatus(t, cm, "node-2", "unhealthy")
+	clock.Advance(time.Hour)
+	if scans := rm.GetRepairStatus().Scans; scans != 0 {
+		t.Errorf("%d repair scans with failover off, want none", scans)
+	}
+}
@@ -1,23 +1,55 @@
 package replication
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
 	"github.com/9ifrashaikh/distributed-system/pkg/models"
 )
 
 type ReplicationManager struct {
 	clusterManager      *cluster.ClusterManager
+	store               storage.Store // where the objects sent to other nodes are read from
 	replicationFactor   int
 	client              *http.Client
 	pendingReplications sync.Map
+	tasksMutex          sync.Mutex     // guards the fields of the tasks in pendingReplications
+	inflight            sync.WaitGroup // copies not finished yet, and the repair loop
+	pool                pool
+	throttle            throttle
+	retryMutex          sync.Mutex
+	retry               retryPolicy
+	stopping            chan struct{} // closed by Stop, cutting retries short
+	stopOnce            sync.Once
+	repair              repairer
+	failover            failover
+	reads               replicaReads
+	counters            counters
+	pruned              prunedTasks
+	minSuccess          atomic.Value // SuccessPolicy
+	syncing             syncer
+	rebalance           rebalancer
+	drain               drainer
+	clock               clock
+	compression         compression
+}
+
+// replicaReads is the state of reading from other nodes' copies, see OpenReplica
+type replicaReads struct {
+	ReadStats
+	client    *http.Client // without a timeout, a proxied read takes as long as its reader
+	restoring sync.Map     // keys being restored
 }
 
 type ReplicationTask struct {
@@ -25,99 +57,256 @@ type ReplicationTask struct {
 	ObjectKey   string     `json:"object_key"`
 	SourceNode  string     `json:"source_node"`
 	TargetNodes []string   `json:"target_nodes"`
-	Status      string     `json:"status"` // pending, in_progress, completed, failed
+	Status      string     `json:"status"` // pending, in_progress, completed, partial, failed
 	CreatedAt   time.Time  `json:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty"`
 	Error       string     `json:"error,omitempty"`
+	Attempts    int        `json:"attempts"` // across all targets
+	// RequiredAcks is how many targets the write waited for, see ReplicateObject. The
+	// task is UnderReplicated while it is short of them after the write gave up waiting.
+	RequiredAcks    int  `json:"required_acks"`
+	UnderReplicated bool `json:"under_replicated"`
+	// MinSuccess is how many targets had to get a copy for the task to be completed
+	// rather than partial, Succeeded how many have
+	MinSuccess int  `json:"min_success"`
+	Succeeded  int  `json:"succeeded"`
+	Repair     bool `json:"repair,omitempty"` // made by the repair loop, see taskID
+	// Targets has how replication to each of TargetNodes is going, in the same order
+	Targets []TargetStatus `json:"targets"`
+
+	remaining int // targets
+}
+
+// TargetStatus is how replication of a task to one node is going
+type TargetStatus struct {
+	NodeID string `json:"node_id"`
+	// pending (queued), in_progress, retrying, completed, failed, or stale when the node
+	// holds a newer write of the object, which is taken from it instead
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"` // while retrying
 }
 
-func NewReplicationManager(cm *cluster.ClusterManager, replicationFactor int) *ReplicationManager {
-	return &ReplicationManager{
+func NewReplicationManager(cm *cluster.ClusterManager, store storage.Store, replicationFactor int) *ReplicationManager {
+	rm := &ReplicationManager{
 		clusterManager:    cm,
+		store:             store,
 		replicationFactor: replicationFactor,
-		client:            &http.Client{Timeout: 30 * time.Second},
+		client:            cm.NewClient(30 * time.Second),
+		retry:             defaultRetryPolicy,
+		stopping:          make(chan struct{}),
+		repair:            repairer{interval: defaultRepairInterval, queued: make(map[string]bool), kick: make(chan struct{}, 1)},
+		failover:          failover{enabled: true, grace: defaultFailoverGrace, pending: make(map[string]graceTimer), afterFunc: afterFunc},
+		rebalance:         rebalancer{rate: defaultRebalanceRate, threshold: defaultRebalanceThreshold},
+		reads:             replicaReads{client: cm.NewClient(0)},
+		counters:          counters{Stats: Stats{Nodes: make(map[string]*NodeStats)}},
+		pruned:            prunedTasks{retention: defaultTaskRetention, ids: make(map[string]bool)},
 	}
+	cm.OnNodeStatusChange(rm.nodeStatusChanged)
+	rm.SetWorkers(defaultWorkers, defaultQueueSize)
+	rm.SetQueueFull(QueueFullWait)
+	rm.SetMinSuccess(SuccessPolicy{count: 1})
+	rm.SetCompression(CompressionNone, DefaultCompressionMinSize, DefaultUncompressedTypes)
+	rm.loadClock()
+	return rm
 }
 
-func (rm *ReplicationManager) ReplicateObject(obj *models.StorageObject, data io.Reader) error {
-	// Select target nodes for replication
-	targetNodes := rm.clusterManager.SelectNodesForReplication(rm.replicationFactor)
+// ReplicateObject copies obj to other nodes in the background. Each target reads it afresh
+// from the local store, so the data streams from where it is stored and is never held in
+// memory as a whole. With acks above 0 it waits until that many targets have stored a
+// verified copy, and fails with ErrUnderReplicated, flagging the task, if too few of them
+// can or ctx ends first. If the queue is full and writes don't wait for room, it fails
+// with ErrQueueFull straight away instead. Objects whose factor is 0 are left alone.
+func (rm *ReplicationManager) ReplicateObject(ctx context.Context, obj *models.StorageObject, acks int) error {
+	factor := rm.Factor(obj)
+	if factor == 0 {
+		return nil
+	}
+
+	// Select target nodes for replication, as many as are healthy if that's fewer
+	targetNodes := rm.clusterManager.SelectNodesForReplication(factor, obj.Size)
 	if len(targetNodes) == 0 {
+		if acks > 0 {
+			return fmt.Errorf("%w: no healthy nodes available for replication", ErrUnderReplicated)
+		}
 		return fmt.Errorf("no healthy nodes available for replication")
 	}
 
-	// Create replication task
-	task := &ReplicationTask{
-		ObjectID:    obj.ID,
-		ObjectKey:   obj.Key,
-		SourceNode:  rm.clusterManager.GetCurrentNode().ID,
-		TargetNodes: make([]string, len(targetNodes)),
-		Status:      "pending",
-		CreatedAt:   time.Now(),
+	block := rm.pool.whenFull.Load().(string) == QueueFullWait
+	task, results, queued := rm.startTask(obj, targetNodes, acks, rm.opener(obj), block, false)
+	if !queued {
+		if acks > 0 {
+			rm.updateTask(task, func() { task.UnderReplicated = true })
+		}
+		return ErrQueueFull
+	}
+
+	acked, failed := 0, 0
+	for acked < acks {
+		if len(targetNodes)-failed < acks {
+			rm.updateTask(task, func() { task.UnderReplicated = true })
+			return fmt.Errorf("%w: %d of %d, and only %d more nodes to try", ErrUnderReplicated, acked, acks, len(targetNodes)-failed-acked)
+		}
+		select {
+		case ok := <-results:
+			if ok {
+				acked++
+			} else {
+				failed++
+			}
+		case <-ctx.Done():
+			rm.updateTask(task, func() { task.UnderReplicated = true })
+			return fmt.Errorf("%w: %d of %d before %v", ErrUnderReplicated, acked, acks, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// startTask records a task copying obj to targetNodes and queues a job per target.
+// results gets whether each target got there as it finishes. If the queue is full and
+// block isn't set, the jobs that don't fit are queued in the background and queued is false.
+// repair marks tasks made by the repair loop, whose shortfalls aren't handed back to it.
+func (rm *ReplicationManager) startTask(obj *models.StorageObject, targetNodes []*cluster.Node, acks int, open func() (io.ReadCloser, *models.StorageObject, error), block, repair bool) (task *ReplicationTask, results <-chan bool, queued bool) {
+	task = &ReplicationTask{
+		ObjectID:     obj.ID,
+		ObjectKey:    obj.Key,
+		SourceNode:   rm.clusterManager.GetCurrentNode().ID,
+		TargetNodes:  make([]string, len(targetNodes)),
+		Status:       "pending",
+		CreatedAt:    time.Now(),
+		RequiredAcks: acks,
+		MinSuccess:   rm.MinSuccess(obj),
+		Repair:       repair,
+		Targets:      make([]TargetStatus, len(targetNodes)),
+		remaining:    len(targetNodes),
 	}
 
 	for i, node := range targetNodes {
 		task.TargetNodes[i] = node.ID
+		task.Targets[i] = TargetStatus{NodeID: node.ID, Status: "pending"}
 	}
 
-	rm.pendingReplications.Store(obj.ID, task)
+	rm.pendingReplications.Store(taskID(obj.ID, repair), task)
+	rm.count(func(stats *Stats) { stats.TasksCreated++ })
 
-	// Start replication in background
-	go rm.executeReplication(task, obj, data)
+	sent := make(chan bool, len(targetNodes))
+	policy := rm.retryPolicy()
+	queued = true
+	for i := range targetNodes {
+		rm.inflight.Add(1)
+		j := &job{task: task, target: i, obj: obj, open: open, results: sent, policy: policy, attempt: 1, started: time.Now()}
+		if !rm.enqueue(j, block) {
+			queued = false
+			go rm.enqueue(j, true)
+		}
+	}
+	return task, sent, queued
+}
 
-	return nil
+// taskID is what a task is kept and looked up under: its object's ID, with a prefix for
+// repairs so they don't hide how the write's own replication went
+func taskID(objectID string, repair bool) string {
+	if repair {
+		return "repair-" + objectID
+	}
+	return objectID
 }
 
-func (rm *ReplicationManager) executeReplication(task *ReplicationTask, obj *models.StorageObject, data io.Reader) {
-	task.Status = "in_progress"
-	rm.pendingReplications.Store(task.ObjectID, task)
+// opener reads obj's data from the local store, exactly the version given, returning it
+// with obj as it is now. Once it has been replaced there is nothing left to send, the
+// replacement gets replicated in its own right. Copies aren't reads of the object, so they
+// don't count towards its access stats. Encrypted objects are read as they are stored, see
+// sendsStored.
+func (rm *ReplicationManager) opener(obj *models.StorageObject) func() (io.ReadCloser, *models.StorageObject, error) {
+	return func() (io.ReadCloser, *models.StorageObject, error) {
+		read := rm.store.ReadData
+		if rm.sendsStored(obj) {
+			read = rm.store.(storage.StoredCopier).GetStored
+		}
+		data, current, err := read(obj.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if current.ID != obj.ID || current.Version != obj.Version {
+			data.Close()
+			return nil, nil, fmt.Errorf("%s has been replaced since it was written", obj.Key)
+		}
+		return data, current, nil
+	}
+}
 
-	// Read data into buffer for multiple replications
-	buffer := &bytes.Buffer{}
-	_, err := io.Copy(buffer, data)
-	if err != nil {
-		rm.markTaskFailed(task, fmt.Sprintf("Failed to buffer data: %v", err))
+// recordReplica notes in obj's metadata that nodeID now holds a copy, and in which zone,
+// so the repair loop can tell how many there are and how spread out
+func (rm *ReplicationManager) recordReplica(obj *models.StorageObject, nodeID string) {
+	recorder, ok := rm.store.(storage.ReplicaRecorder)
+	if !ok {
 		return
 	}
+	var zone string
+	if node, exists := rm.clusterManager.GetNode(nodeID); exists {
+		zone = node.Zone
+	}
+	err := recorder.AddReplica(obj.Key, obj.ID, obj.Version, nodeID, zone)
+	if err != nil && !errors.Is(err, storage.ErrPreconditionFailed) {
+		log.Printf("Failed to record replica of %s on node %s: %v", obj.Key, nodeID, err)
+	}
+}
 
-	var wg sync.WaitGroup
-	successCount := 0
-	var mutex sync.Mutex
+// SetThrottle limits outgoing replication traffic to bytesPerSecond across all transfers,
+// 0 removes the limit. Transfers in progress pick up the new rate immediately.
+func (rm *ReplicationManager) SetThrottle(bytesPerSecond int64) {
+	rm.throttle.setRate(bytesPerSecond)
+}
 
-	// Replicate to each target node
-	for _, nodeID := range task.TargetNodes {
-		wg.Add(1)
-		go func(nID string) {
-			defer wg.Done()
+// Start starts the workers, the repair loop and the pruning of finished tasks. Replications
+// are started on demand by ReplicateObject.
+func (rm *ReplicationManager) Start(ctx context.Context) error {
+	rm.startWorkers()
+	rm.startRepair()
+	rm.startPruning()
+	return nil
+}
 
-			if rm.replicateToNode(nID, obj, bytes.NewReader(buffer.Bytes())) {
-				mutex.Lock()
-				successCount++
-				mutex.Unlock()
-				log.Printf("Successfully replicated object %s to node %s", obj.Key, nID)
-			} else {
-				log.Printf("Failed to replicate object %s to node %s", obj.Key, nID)
-			}
-		}(nodeID)
-	}
+// Stop works through the copies already queued and waits for them to finish. Targets
+// waiting to be retried, objects still waiting for repair and unhealthy nodes' grace
+// periods are given up on. Whatever
+// is left when ctx ends is dropped: the objects aren't recorded as having those copies, so
+// the repair loop makes them after a restart.
+func (rm *ReplicationManager) Stop(ctx context.Context) error {
+	rm.stopOnce.Do(func() { close(rm.stopping) })
+	rm.failover.mutex.Lock()
+	rm.cancelFailovers()
+	rm.failover.mutex.Unlock()
 
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		rm.inflight.Wait()
+		close(done)
+	}()
 
-	// Update task status
-	if successCount > 0 {
-		task.Status = "completed"
-		now := time.Now()
-		task.CompletedAt = &now
-		log.Printf("Replication completed for object %s (%d/%d nodes successful)",
-			obj.Key, successCount, len(task.TargetNodes))
-	} else {
-		rm.markTaskFailed(task, "Failed to replicate to any target node")
+	select {
+	case <-done:
+		close(rm.pool.quit)
+		rm.pool.done.Wait()
+		return nil
+	case <-ctx.Done():
+		dropped := rm.drainQueue()
+		return fmt.Errorf("replications still in flight, %d queued ones dropped: %v", dropped, ctx.Err())
 	}
+}
 
-	rm.pendingReplications.Store(task.ObjectID, task)
+// attemptReplica makes one attempt at sending obj to a node, reading it afresh
+func (rm *ReplicationManager) attemptReplica(nodeID string, obj *models.StorageObject, open func() (io.ReadCloser, *models.StorageObject, error)) error {
+	data, current, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to read object: %v", err)
+	}
+	defer data.Close()
+	return rm.replicateToNode(nodeID, current, data)
 }
 
-func (rm *ReplicationManager) replicateToNode(nodeID string, obj *models.StorageObject, data io.Reader) bool {
+func (rm *ReplicationManager) replicateToNode(nodeID string, obj *models.StorageObject, data io.Reader) error {
 	// Get node information
 	nodes := rm.clusterManager.GetHealthyNodes()
 	var targetNode *cluster.Node
@@ -129,50 +318,117 @@ func (rm *ReplicationManager) replicateToNode(nodeID string, obj *models.Storage
 	}
 
 	if targetNode == nil {
-		return false
+		// It may well be back by the next attempt
+		return &replicaError{err: fmt.Errorf("node %s isn't healthy", nodeID), retryable: true}
 	}
 
 	// Create replication request
-	url := fmt.Sprintf("http://%s/internal/replicate/%s", targetNode.Address, obj.Key)
+	// Escaped, slashes and all, so the key comes back out of the path as it went in
+	endpoint := fmt.Sprintf("http://%s/internal/replicate/%s", targetNode.Address, url.PathEscape(obj.Key))
 
-	req, err := http.NewRequest("PUT", url, data)
+	// Encrypted data goes as it is, to a node that can keep it that way. It doesn't
+	// compress, so isn't tried.
+	stored := rm.sendsStored(obj)
+	if stored && targetNode.AdvertisesCapabilities() && !targetNode.HasCapability(CapabilityStored) {
+		return fmt.Errorf("node %s can't keep encrypted copies as they are", nodeID)
+	}
+
+	// Compressed when the node takes it, the throttle then counting what goes on the wire
+	encoding := ""
+	if !stored {
+		encoding = rm.encodingFor(nodeID, obj.ContentType, obj.Size)
+	}
+	var sent *countingReader
+	if encoding != "" {
+		compressed := compressStream(data)
+		defer compressed.Close()
+		sent = &countingReader{r: compressed}
+		data = sent
+	}
+
+	req, err := http.NewRequest("PUT", endpoint, &throttledReader{r: data, t: &rm.throttle})
 	if err != nil {
-		return false
+		return err
+	}
+	req.ContentLength = obj.Size
+	if stored {
+		req.ContentLength = obj.StoredSize
+		setStoredHeaders(req, obj)
+	}
+	if encoding != "" {
+		req.ContentLength = -1 // not known until it has all been sent
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("X-Decoded-Content-Length", strconv.FormatInt(obj.Size, 10))
 	}
 
 	req.Header.Set("Content-Type", obj.ContentType)
 	req.Header.Set("X-Object-ID", obj.ID)
-	req.Header.Set("X-Checksum", obj.Checksum)
+	// The checksum of a copy sent as it is stored is only recorded, so it goes as it is
+	algorithm, checksum := obj.ChecksumAlgorithm, obj.Checksum
+	if !stored {
+		if algorithm, checksum, err = rm.checksumFor(targetNode, obj); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("X-Checksum", storage.FormatChecksum(algorithm, checksum))
+	req.Header.Set("X-Checksum-Algorithm", algorithm)
+	if obj.Stamp != nil {
+		req.Header.Set("X-Object-Version", FormatStamp(obj.Stamp))
+	}
 	req.Header.Set("X-Replication-Source", rm.clusterManager.GetCurrentNode().ID)
+	req.Header.Set("X-Object-Owner", obj.Owner)
+	if obj.ReplicationFactor != nil {
+		req.Header.Set("X-Replication-Factor", strconv.Itoa(*obj.ReplicationFactor))
+	}
+	if obj.ExpiresAt != nil {
+		req.Header.Set("X-Expires-At", obj.ExpiresAt.Format(time.RFC3339))
+	}
+	for name, value := range obj.Metadata {
+		req.Header.Set("X-Meta-"+name, value)
+	}
 
+	// Timeouts, refused and dropped connections are all worth another go
 	resp, err := rm.client.Do(req)
 	if err != nil {
-		return false
+		return &replicaError{err: err, retryable: true}
 	}
 	defer resp.Body.Close()
+	rm.noteAccepted(nodeID, resp)
 
-	return resp.StatusCode == http.StatusOK
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if encoding != "" {
+		rm.count(func(stats *Stats) {
+			stats.CompressedCopies++
+			stats.CompressedRawBytes += obj.Size
+			stats.CompressedBytes += sent.n.Load()
+		})
+	}
+	return nil
 }
 
-func (rm *ReplicationManager) markTaskFailed(task *ReplicationTask, errorMsg string) {
-	task.Status = "failed"
-	task.Error = errorMsg
-	now := time.Now()
-	task.CompletedAt = &now
+// updateTask changes task's fields through fn, keeping readers from seeing it half done
+func (rm *ReplicationManager) updateTask(task *ReplicationTask, fn func()) {
+	rm.tasksMutex.Lock()
+	defer rm.tasksMutex.Unlock()
+	fn()
 }
 
-func (rm *ReplicationManager) GetReplicationStatus(objectID string) (*ReplicationTask, bool) {
-	task, exists := rm.pendingReplications.Load(objectID)
-	if !exists {
-		return nil, false
-	}
-	return task.(*ReplicationTask), true
+// copyTask returns a copy of task safe to hand out while it carries on
+func (rm *ReplicationManager) copyTask(task *ReplicationTask) *ReplicationTask {
+	rm.tasksMutex.Lock()
+	defer rm.tasksMutex.Unlock()
+	copied := *task
+	copied.TargetNodes = append([]string(nil), task.TargetNodes...)
+	copied.Targets = append([]TargetStatus(nil), task.Targets...)
+	return &copied
 }
 
 func (rm *ReplicationManager) GetAllReplicationTasks() []*ReplicationTask {
 	var tasks []*ReplicationTask
 	rm.pendingReplications.Range(func(key, value interface{}) bool {
-		tasks = append(tasks, value.(*ReplicationTask))
+		tasks = append(tasks, rm.copyTask(value.(*ReplicationTask)))
 		return true
 	})
 	return tasks
@@ -0,0 +1,169 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// zeros reads as an endless run of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// sparseStore holds one object of zeros, as big as it says, without keeping any of it
+type sparseStore struct {
+	storage.Store
+	obj *models.StorageObject
+}
+
+func (s *sparseStore) ReadData(key string) (io.ReadCloser, *models.StorageObject, error) {
+	if key != s.obj.Key {
+		return nil, nil, storage.ErrObjectNotFound
+	}
+	return io.NopCloser(io.LimitReader(zeros{}, s.obj.Size)), s.obj, nil
+}
+
+func (s *sparseStore) List() map[string]*models.StorageObject {
+	return map[string]*models.StorageObject{s.obj.Key: s.obj}
+}
+
+// heapPeak tracks the most heap in use, sampled as copies come in
+type heapPeak struct {
+	mutex sync.Mutex
+	peak  uint64
+}
+
+func (h *heapPeak) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.peak = max(h.peak, stats.HeapInuse)
+}
+
+// sink is a node taking copies and throwing them away, answering status once it has read
+// all of one, and sampling the heap every 64 MB meanwhile
+func sink(t *testing.T, status int, heap *heapPeak) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			n, err := io.CopyN(io.Discard, r.Body, 64<<20)
+			heap.sample()
+			if err != nil || n == 0 {
+				break
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestReplicationStreamsLargeObjects(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends 2 GB over loopback")
+	}
+	obj := &models.StorageObject{
+		ID:                "0123456789abcdef0123456789abcdef",
+		Key:               "disk.img",
+		Size:              1 << 30,
+		ContentType:       "application/octet-stream",
+		Checksum:          "cd573cfaace07e7949bc0c46028904ff",
+		ChecksumAlgorithm: storage.ChecksumMD5,
+	}
+	heap := &heapPeak{}
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	for id, status := range map[string]int{"node-2": http.StatusOK, "node-3": http.StatusBadRequest} {
+		if err := cm.RegisterNode(&cluster.Node{ID: id, Address: sink(t, status, heap), Status: "healthy"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm := NewReplicationManager(cm, &sparseStore{obj: obj}, 2)
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	heap.sample()
+	before := heap.peak
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := rm.ReplicateObject(ctx, obj, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two copies of 1 GB at once, in a fixed buffer each
+	if grown := heap.peak - before; grown > 64<<20 {
+		t.Errorf("the heap grew by %d MB sending two copies of 1 GB", grown>>20)
+	}
+
+	// Each target is accounted for as it went
+	stats := rm.Stats()
+	if n := stats.Nodes["node-2"]; n == nil || n.Succeeded != 1 {
+		t.Errorf("node-2 = %+v, want 1 copy", n)
+	}
+	if n := stats.Nodes["node-3"]; n == nil || n.Failed != 1 || n.Succeeded != 0 {
+		t.Errorf("node-3 = %+v, want 1 failed copy", n)
+	}
+	if stats.BytesReplicated != obj.Size || stats.TasksCompleted != 1 {
+		t.Errorf("%d bytes replicated in %d completed tasks, want 1 GB in 1", stats.BytesReplicated, stats.TasksCompleted)
+	}
+}
+
+func TestReplicationDoesNotCountAsAccess(t *testing.T) {
+	store, err := storage.OpenFileStore(t.TempDir(), storage.MetadataJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Stop(context.Background()) })
+	cm := cluster.NewClusterManager("node-1", "127.0.0.1:1")
+	for _, id := range []string{"node-2", "node-3"} {
+		if err := cm.RegisterNode(&cluster.Node{ID: id, Address: sink(t, http.StatusOK, &heapPeak{}), Status: "healthy"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm := NewReplicationManager(cm, store, 2)
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	obj, err := store.Put("report", strings.NewReader("quarterly figures"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.ReplicateObject(ctx, obj, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two copies sent, and the first client read is still the first access
+	reader, read, err := store.Get("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if read.AccessCount != 1 {
+		t.Errorf("first read after replicating to 2 nodes counted as access %d, want 1", read.AccessCount)
+	}
+}
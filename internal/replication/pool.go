@@ -0,0 +1,271 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrQueueFull is returned when a write didn't wait for its copies because the replication
+// queue was full. They are made once there is room.
+var ErrQueueFull = errors.New("replication queue is full")
+
+// What a write does when the replication queue is full, see SetQueueFull
+const (
+	QueueFullWait  = "wait"  // until there is room, holding up the write
+	QueueFullAsync = "async" // not, the copies are queued in the background
+)
+
+const (
+	defaultWorkers   = 8
+	defaultQueueSize = 1024
+)
+
+// job is the next attempt at copying a task's object to one of its targets. Retries are
+// queued again rather than holding on to a worker while they wait.
+type job struct {
+	task    *ReplicationTask
+	target  int // into task.Targets
+	obj     *models.StorageObject
+	open    func() (io.ReadCloser, *models.StorageObject, error)
+	results chan<- bool
+	policy  retryPolicy
+	attempt int       // the one about to be made, from 1
+	started time.Time // the first attempt
+}
+
+// pool is the fixed number of workers all copies to other nodes are made by, so a burst
+// of writes can't open an outgoing connection per object and target
+type pool struct {
+	workers  int
+	queue    chan *job
+	quit     chan struct{} // closed once the queue is done with
+	whenFull atomic.Value  // QueueFullWait or QueueFullAsync
+	busy     int64
+	done     sync.WaitGroup
+}
+
+// QueueStats is how busy the replication workers are
+type QueueStats struct {
+	Workers     int     `json:"workers"`
+	Busy        int     `json:"busy"`
+	Utilization float64 `json:"utilization"` // busy / workers
+	Queued      int     `json:"queued"`
+	QueueSize   int     `json:"queue_size"`
+	WhenFull    string  `json:"when_full"`
+}
+
+// SetWorkers sizes the pool of workers copies are made by and the queue of copies waiting
+// for one. It has to be called before Start.
+func (rm *ReplicationManager) SetWorkers(workers, queueSize int) {
+	rm.pool.workers = workers
+	rm.pool.queue = make(chan *job, queueSize)
+	rm.pool.quit = make(chan struct{})
+}
+
+// SetQueueFull says what a write does when the queue is full, QueueFullWait or
+// QueueFullAsync. Copies made by the repair loop always wait.
+func (rm *ReplicationManager) SetQueueFull(policy string) {
+	rm.pool.whenFull.Store(policy)
+}
+
+func (rm *ReplicationManager) GetQueueStats() QueueStats {
+	busy := int(atomic.LoadInt64(&rm.pool.busy))
+	return QueueStats{
+		Workers:     rm.pool.workers,
+		Busy:        busy,
+		Utilization: float64(busy) / float64(rm.pool.workers),
+		Queued:      len(rm.pool.queue),
+		QueueSize:   cap(rm.pool.queue),
+		WhenFull:    rm.pool.whenFull.Load().(string),
+	}
+}
+
+func (rm *ReplicationManager) startWorkers() {
+	for i := 0; i < rm.pool.workers; i++ {
+		rm.pool.done.Add(1)
+		go func() {
+			defer rm.pool.done.Done()
+			for {
+				select {
+				case j := <-rm.pool.queue:
+					atomic.AddInt64(&rm.pool.busy, 1)
+					rm.runJob(j)
+					atomic.AddInt64(&rm.pool.busy, -1)
+				case <-rm.pool.quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// enqueue queues j for a worker. If the queue is full it waits for room when block is set
+// and returns false when it isn't. Once stopping nothing is queued any more, j fails.
+func (rm *ReplicationManager) enqueue(j *job, block bool) bool {
+	select {
+	case <-rm.stopping:
+		rm.failJob(j, "not sent, shutting down")
+		return true
+	default:
+	}
+	select {
+	case rm.pool.queue <- j:
+		return true
+	default:
+	}
+	if !block {
+		return false
+	}
+	select {
+	case rm.pool.queue <- j:
+	case <-rm.stopping:
+		rm.failJob(j, "not sent, shutting down")
+	}
+	return true
+}
+
+// runJob makes j's attempt, queueing the next one after a backoff if it fails for a reason
+// worth retrying and the retry policy allows
+func (rm *ReplicationManager) runJob(j *job) {
+	task := j.task
+	target := &task.Targets[j.target]
+	nodeID := target.NodeID
+	rm.updateTask(task, func() {
+		task.Status = "in_progress"
+		task.Attempts++
+		target.Status, target.Attempts, target.NextAttempt = "in_progress", j.attempt, nil
+	})
+
+	err := rm.attemptReplica(nodeID, j.obj, j.open)
+	if err == nil {
+		rm.countAttempt(nodeID, j.obj.Size, nil, true)
+		rm.recordReplica(j.obj, nodeID)
+		rm.updateTask(task, func() { target.Status, target.LastError = "completed", "" })
+		log.Printf("Successfully replicated object %s to node %s", j.obj.Key, nodeID)
+		rm.finishJob(j, true)
+		return
+	}
+
+	var replicaErr *replicaError
+	if errors.As(err, &replicaErr) && replicaErr.newer != nil {
+		// Not worth retrying, this copy is out of date
+		log.Printf("Node %s holds a newer write of %s: %v", nodeID, j.obj.Key, err)
+		rm.countAttempt(nodeID, j.obj.Size, err, true)
+		rm.updateTask(task, func() { target.Status, target.LastError = "stale", err.Error() })
+		rm.takeNewer(nodeID, j.obj, replicaErr.newer)
+		rm.finishJob(j, false)
+		return
+	}
+
+	wait := j.policy.backoff(j.attempt)
+	if !retryable(err, j.attempt) || j.attempt >= j.policy.maxAttempts || time.Since(j.started)+wait > j.policy.maxElapsed {
+		rm.countAttempt(nodeID, j.obj.Size, err, true)
+		log.Printf("Failed to replicate object %s to node %s after %d attempts: %v", j.obj.Key, nodeID, j.attempt, err)
+		rm.failJob(j, err.Error())
+		return
+	}
+	rm.countAttempt(nodeID, j.obj.Size, err, false)
+	next := time.Now().Add(wait)
+	rm.updateTask(task, func() {
+		target.Status, target.LastError, target.NextAttempt = "retrying", err.Error(), &next
+	})
+	log.Printf("Failed to replicate object %s to node %s, retrying in %v: %v", j.obj.Key, nodeID, wait.Round(time.Millisecond), err)
+
+	j.attempt++
+	go func() {
+		select {
+		case <-time.After(wait):
+			rm.enqueue(j, true)
+		case <-rm.stopping:
+			rm.failJob(j, "gave up retrying on shutdown: "+err.Error())
+		}
+	}()
+}
+
+func (rm *ReplicationManager) failJob(j *job, reason string) {
+	target := &j.task.Targets[j.target]
+	rm.updateTask(j.task, func() {
+		target.Status, target.LastError, target.NextAttempt = "failed", reason, nil
+	})
+	rm.finishJob(j, false)
+}
+
+// finishJob reports how j's target went and completes its task after the last one. A
+// task short of its MinSuccess is partial, or failed with no copies at all, and its object
+// is handed to the repair loop unless it came from there.
+func (rm *ReplicationManager) finishJob(j *job, ok bool) {
+	defer rm.inflight.Done()
+	j.results <- ok
+
+	task := j.task
+	var finished, repair bool
+	var status string
+	var successCount int
+	rm.updateTask(task, func() {
+		if ok {
+			task.Succeeded++
+		}
+		task.remaining--
+		if task.remaining > 0 {
+			return
+		}
+		finished, successCount, repair = true, task.Succeeded, task.Repair
+		now := time.Now()
+		task.CompletedAt = &now
+		if successCount >= task.RequiredAcks {
+			task.UnderReplicated = false
+		}
+		switch {
+		case successCount >= task.MinSuccess:
+			task.Status = "completed"
+		case successCount > 0:
+			task.Status = "partial"
+			task.Error = fmt.Sprintf("Replicated to %d target nodes, %d required", successCount, task.MinSuccess)
+		default:
+			task.Status = "failed"
+			task.Error = "Failed to replicate to any target node"
+		}
+		status = task.Status
+	})
+	if !finished {
+		return
+	}
+	rm.count(func(stats *Stats) {
+		switch status {
+		case "completed":
+			stats.TasksCompleted++
+		case "partial":
+			stats.TasksPartial++
+		default:
+			stats.TasksFailed++
+		}
+	})
+	if successCount > 0 {
+		log.Printf("Replication %s for object %s (%d/%d nodes successful)",
+			status, j.obj.Key, successCount, len(task.TargetNodes))
+	}
+	if status != "completed" && !repair {
+		rm.queueRepair(j.obj.Key)
+	}
+}
+
+// drainQueue fails every job still queued, returning how many there were
+func (rm *ReplicationManager) drainQueue() int {
+	dropped := 0
+	for {
+		select {
+		case j := <-rm.pool.queue:
+			rm.failJob(j, "not sent before shutdown")
+			dropped++
+		default:
+			return dropped
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ReadStats counts reads served from other nodes' copies because the local one was lost
+// or corrupt, and the local copies rewritten from them afterwards
+type ReadStats struct {
+	ProxiedReads   int64 `json:"proxied_reads"`
+	Restores       int64 `json:"restores"`
+	RestoresFailed int64 `json:"restores_failed"`
+}
+
+func (rm *ReplicationManager) GetReadStats() ReadStats {
+	return ReadStats{
+		ProxiedReads:   atomic.LoadInt64(&rm.reads.ProxiedReads),
+		Restores:       atomic.LoadInt64(&rm.reads.Restores),
+		RestoresFailed: atomic.LoadInt64(&rm.reads.RestoresFailed),
+	}
+}
+
+// OpenReplica reads obj from the first healthy node recorded as holding a copy that
+// answers with it, the part in rangeHeader if it isn't empty. The caller closes the
+// response; nodeID is who sent it. ctx bounds the whole read, body included.
+func (rm *ReplicationManager) OpenReplica(ctx context.Context, obj *models.StorageObject, rangeHeader string) (resp *http.Response, nodeID string, err error) {
+	healthy := make(map[string]string)
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		healthy[node.ID] = node.Address
+	}
+
+	err = fmt.Errorf("no healthy node holds a copy of %s", obj.Key)
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		address, ok := healthy[nodeID]
+		if !ok {
+			continue
+		}
+		resp, err = rm.fetchReplica(ctx, address, obj, rangeHeader)
+		if err != nil {
+			log.Printf("Failed to read %s from node %s: %v", obj.Key, nodeID, err)
+			continue
+		}
+		atomic.AddInt64(&rm.reads.ProxiedReads, 1)
+		return resp, nodeID, nil
+	}
+	return nil, "", err
+}
+
+// fetchReplica asks the node at address for its copy of obj, which it only ever reads
+// locally, so a node whose copy is gone too never passes the request on
+func (rm *ReplicationManager) fetchReplica(ctx context.Context, address string, obj *models.StorageObject, rangeHeader string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("http://%s/internal/replicate/%s", address, url.PathEscape(obj.Key))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Replication-Source", rm.clusterManager.GetCurrentNode().ID)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	resp, err := rm.reads.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	// It has to be the same object, not just one under the same key
+	id, checksum := resp.Header.Get("X-Object-ID"), resp.Header.Get("X-Checksum")
+	if id != obj.ID || !strings.EqualFold(checksum, obj.Checksum) || resp.Header.Get("X-Checksum-Algorithm") != obj.ChecksumAlgorithm {
+		resp.Body.Close()
+		return nil, fmt.Errorf("node's copy of %s is object %s with checksum %s, not %s with %s",
+			obj.Key, id, checksum, obj.ID, obj.Checksum)
+	}
+	return resp, nil
+}
+
+// RestoreLocal rewrites the local copy of obj in the background from nodeID's, through the
+// repair throttle. Reads of obj carry on from other nodes until it's done.
+func (rm *ReplicationManager) RestoreLocal(obj *models.StorageObject, nodeID string) {
+	restorer, ok := rm.store.(storage.DataRestorer)
+	if !ok {
+		return
+	}
+	select {
+	case <-rm.stopping:
+		return
+	default:
+	}
+	if _, busy := rm.reads.restoring.LoadOrStore(obj.Key, true); busy {
+		return
+	}
+
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		defer rm.reads.restoring.Delete(obj.Key)
+
+		ctx, cancel := rm.untilStopping()
+		defer cancel()
+
+		err := rm.restoreFrom(ctx, restorer, obj, nodeID)
+		if err != nil {
+			atomic.AddInt64(&rm.reads.RestoresFailed, 1)
+			log.Printf("Failed to restore local copy of %s from node %s: %v", obj.Key, nodeID, err)
+			return
+		}
+		atomic.AddInt64(&rm.reads.Restores, 1)
+		log.Printf("Restored local copy of %s from node %s", obj.Key, nodeID)
+	}()
+}
+
+func (rm *ReplicationManager) restoreFrom(ctx context.Context, restorer storage.DataRestorer, obj *models.StorageObject, nodeID string) error {
+	var address string
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		if node.ID == nodeID {
+			address = node.Address
+			break
+		}
+	}
+	if address == "" {
+		return fmt.Errorf("node %s isn't healthy", nodeID)
+	}
+	resp, err := rm.fetchReplica(ctx, address, obj, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return restorer.RestoreData(obj.Key, obj.ID, obj.Version, &throttledReader{r: resp.Body, t: &rm.repair.throttle})
+}
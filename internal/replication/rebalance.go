@@ -0,0 +1,403 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+var (
+	ErrRebalanceRunning = errors.New("a rebalance is already running")
+	ErrNoRebalance      = errors.New("no rebalance is running")
+)
+
+// Defaults for rebalancing, see SetRebalance
+const (
+	defaultRebalanceRate      = 10 // objects per second
+	defaultRebalanceThreshold = 0.1
+)
+
+// rebalancer moves copies off nodes fuller than the cluster's average onto emptier ones,
+// so a node added to the cluster takes its share. Each node moves the copies of the
+// objects it would repair, see needsRepair: the copy here stays, and a copy on a node
+// more than the threshold fuller than average is made on the emptiest node below average
+// that can take it before the full node is asked to drop its own. Nothing is dropped
+// before the new copy has been verified.
+type rebalancer struct {
+	mutex     sync.Mutex
+	rate      float64 // objects per second, 0 = unlimited
+	threshold float64
+	throttle  throttle
+	status    RebalanceStatus
+	cancel    context.CancelFunc
+}
+
+// RebalanceStatus is how the current or last rebalance went. One that was cancelled or
+// failed can be resumed from ResumeAfter.
+type RebalanceStatus struct {
+	Running     bool       `json:"running"`
+	Cancelled   bool       `json:"cancelled,omitempty"`
+	Average     float64    `json:"average_utilization"` // of the healthy nodes, when it started
+	Scanned     int        `json:"scanned"`
+	Moved       int        `json:"moved"`
+	Failed      int        `json:"failed"`
+	Remaining   int        `json:"remaining"` // objects not looked at yet
+	Bytes       int64      `json:"bytes"`
+	ResumeAfter string     `json:"resume_after,omitempty"` // the last key looked at
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// SetRebalance paces rebalancing to objectsPerSecond objects moved and bytesPerSecond bytes
+// copied, 0 for no limit, and has it move copies off nodes whose utilization is more than
+// threshold above the average. The copies count against the overall throttle as well.
+func (rm *ReplicationManager) SetRebalance(objectsPerSecond float64, bytesPerSecond int64, threshold float64) {
+	rm.rebalance.throttle.setRate(bytesPerSecond)
+
+	rm.rebalance.mutex.Lock()
+	defer rm.rebalance.mutex.Unlock()
+	rm.rebalance.rate, rm.rebalance.threshold = objectsPerSecond, threshold
+}
+
+// GetRebalanceStatus reports how the running or last rebalance on this node went
+func (rm *ReplicationManager) GetRebalanceStatus() RebalanceStatus {
+	rm.rebalance.mutex.Lock()
+	defer rm.rebalance.mutex.Unlock()
+	return rm.rebalance.status
+}
+
+func (rm *ReplicationManager) updateRebalance(fn func(status *RebalanceStatus)) {
+	rm.rebalance.mutex.Lock()
+	defer rm.rebalance.mutex.Unlock()
+	fn(&rm.rebalance.status)
+}
+
+// StartRebalance moves copies in the background until every object here has been looked
+// at, it is cancelled or the manager stops. With resume it carries on after the last key
+// the previous run looked at.
+func (rm *ReplicationManager) StartRebalance(resume bool) error {
+	if _, ok := rm.store.(storage.ReplicaRecorder); !ok {
+		return errors.New("the store doesn't keep track of replicas")
+	}
+	rm.rebalance.mutex.Lock()
+	if rm.rebalance.status.Running {
+		rm.rebalance.mutex.Unlock()
+		return ErrRebalanceRunning
+	}
+	after := ""
+	if resume {
+		after = rm.rebalance.status.ResumeAfter
+	}
+	ctx, cancel := rm.untilStopping()
+	started := time.Now()
+	rm.rebalance.status = RebalanceStatus{Running: true, ResumeAfter: after, StartedAt: &started}
+	rm.rebalance.cancel = cancel
+	rm.rebalance.mutex.Unlock()
+
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		defer cancel()
+		err := rm.runRebalance(ctx, after)
+		finished := time.Now()
+		rm.updateRebalance(func(status *RebalanceStatus) {
+			status.Running = false
+			status.FinishedAt = &finished
+			if err != nil && !errors.Is(err, context.Canceled) {
+				status.LastError = err.Error()
+			}
+		})
+	}()
+	return nil
+}
+
+// CancelRebalance stops the running rebalance after the object it is moving
+func (rm *ReplicationManager) CancelRebalance() error {
+	rm.rebalance.mutex.Lock()
+	defer rm.rebalance.mutex.Unlock()
+	if !rm.rebalance.status.Running {
+		return ErrNoRebalance
+	}
+	rm.rebalance.status.Cancelled = true
+	rm.rebalance.cancel()
+	return nil
+}
+
+// nodeLoad is a node's utilization as rebalancing expects it to be once the moves planned
+// so far are done
+type nodeLoad struct {
+	node     *cluster.Node
+	used     int64
+	capacity int64
+}
+
+func (l *nodeLoad) utilization() float64 {
+	return float64(l.used) / float64(l.capacity)
+}
+
+func (rm *ReplicationManager) runRebalance(ctx context.Context, after string) error {
+	self := rm.clusterManager.GetCurrentNode()
+	healthy := make(map[string]*cluster.Node)
+	loads := make(map[string]*nodeLoad)
+	var used, capacity int64
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		healthy[node.ID] = node
+		if node.Capacity > 0 {
+			loads[node.ID] = &nodeLoad{node: node, used: node.Used, capacity: node.Capacity}
+			used += node.Used
+			capacity += node.Capacity
+		}
+	}
+	if capacity == 0 {
+		return errors.New("no healthy node has said how big it is")
+	}
+	average := float64(used) / float64(capacity)
+
+	var objects []*models.StorageObject
+	for _, obj := range rm.store.List() {
+		if obj.Key > after {
+			objects = append(objects, obj)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	rm.rebalance.mutex.Lock()
+	rate, threshold := rm.rebalance.rate, rm.rebalance.threshold
+	rm.rebalance.mutex.Unlock()
+	rm.updateRebalance(func(status *RebalanceStatus) {
+		status.Average = average
+		status.Remaining = len(objects)
+	})
+	log.Printf("Rebalancing %d objects, cluster %.0f%% full", len(objects), average*100)
+
+	for _, obj := range objects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		moved, err := rm.rebalanceObject(ctx, obj, self, healthy, loads, average+threshold, average)
+		rm.updateRebalance(func(status *RebalanceStatus) {
+			status.Scanned++
+			status.Remaining--
+			status.ResumeAfter = obj.Key
+			switch {
+			case err != nil:
+				status.Failed++
+				status.LastError = err.Error()
+			case moved:
+				status.Moved++
+				status.Bytes += obj.Size
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to move a copy of %s: %v", obj.Key, err)
+		}
+		if (moved || err != nil) && rate > 0 {
+			select {
+			case <-time.After(time.Duration(float64(time.Second) / rate)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// rebalanceObject moves obj's copy on a node fuller than high to the emptiest node below
+// average that has room for it, reporting whether it did. Objects this node isn't the one
+// to repair are left to the node that is.
+func (rm *ReplicationManager) rebalanceObject(ctx context.Context, obj *models.StorageObject, self *cluster.Node, healthy map[string]*cluster.Node, loads map[string]*nodeLoad, high, average float64) (bool, error) {
+	if !rm.coordinates(obj, self.ID, healthy) {
+		return false, nil
+	}
+	holders := make(map[string]bool)
+	var from *nodeLoad
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		holders[nodeID] = true
+		if load, ok := loads[nodeID]; ok && load.utilization() > high && (from == nil || load.utilization() > from.utilization()) {
+			from = load
+		}
+	}
+	if from == nil {
+		return false, nil
+	}
+
+	// Only to the zone of the copy leaving or one without a copy, so the copies stay as
+	// spread out as they are, and to its zone first
+	zones := map[string]bool{self.Zone: true}
+	for nodeID := range holders {
+		if node, ok := healthy[nodeID]; ok && nodeID != from.node.ID {
+			zones[node.Zone] = true
+		}
+	}
+	better := func(a, b *nodeLoad) bool {
+		if sameA, sameB := a.node.Zone == from.node.Zone, b.node.Zone == from.node.Zone; sameA != sameB {
+			return sameA
+		}
+		return a.utilization() < b.utilization()
+	}
+	var to *nodeLoad
+	for _, load := range loads {
+		if load.node.ID == self.ID || holders[load.node.ID] || load.node.Drain != "" || load.capacity-load.used < obj.Size {
+			continue
+		}
+		if float64(load.used+obj.Size)/float64(load.capacity) > average {
+			continue // it would only be the next node to move copies off
+		}
+		if load.node.Zone != from.node.Zone && zones[load.node.Zone] {
+			continue
+		}
+		if to == nil || better(load, to) {
+			to = load
+		}
+	}
+	if to == nil {
+		return false, nil
+	}
+
+	open := rm.opener(obj)
+	err := rm.attemptReplica(to.node.ID, obj, func() (io.ReadCloser, *models.StorageObject, error) {
+		data, current, err := open()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &throttledReadCloser{throttledReader{r: data, t: &rm.rebalance.throttle}, data}, current, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("copy to node %s failed: %v", to.node.ID, err)
+	}
+	rm.recordReplica(obj, to.node.ID)
+	to.used += obj.Size
+
+	// The new copy is verified, so the one on the full node can go
+	if err := rm.dropReplica(ctx, from.node, obj); err != nil {
+		return false, fmt.Errorf("copied to node %s, but node %s kept its copy: %v", to.node.ID, from.node.ID, err)
+	}
+	from.used -= obj.Size
+	if recorder, ok := rm.store.(storage.ReplicaRecorder); ok {
+		if err := recorder.RemoveReplica(obj.Key, obj.ID, obj.Version, from.node.ID); err != nil && !errors.Is(err, storage.ErrPreconditionFailed) {
+			log.Printf("Failed to forget the copy of %s on node %s: %v", obj.Key, from.node.ID, err)
+		}
+	}
+	return true, nil
+}
+
+// coordinates reports whether this node is the one to move obj's copies: its own copy is
+// intact and no healthy node holding one has a lower ID, as for needsRepair
+func (rm *ReplicationManager) coordinates(obj *models.StorageObject, self string, healthy map[string]*cluster.Node) bool {
+	if storage.Expired(obj, time.Now()) || len(obj.Replicas) == 0 || obj.Replicas[0].Status != "active" {
+		return false
+	}
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		if _, ok := healthy[nodeID]; ok && nodeID < self {
+			return false
+		}
+	}
+	return true
+}
+
+// dropReplica asks node to delete its copy of obj, which is only done if the copy is
+// still of the same object
+func (rm *ReplicationManager) dropReplica(ctx context.Context, node *cluster.Node, obj *models.StorageObject) error {
+	endpoint := fmt.Sprintf("http://%s/internal/replicate/%s", node.Address, url.PathEscape(obj.Key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Object-ID", obj.ID)
+	req.Header.Set("X-Replication-Source", rm.clusterManager.GetCurrentNode().ID)
+
+	resp, err := rm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// ErrNotLeader is returned for cluster-wide operations started on a node that isn't the
+// leader, see ClusterManager.Leader
+var ErrNotLeader = errors.New("only the cluster leader can do that")
+
+// StartClusterRebalance has this node and every other healthy one rebalance, see
+// StartRebalance. Only the leader can start one. Nodes that can't be told are logged and
+// left out; the run here goes ahead regardless.
+func (rm *ReplicationManager) StartClusterRebalance(resume bool) error {
+	if err := rm.checkLeader(); err != nil {
+		return err
+	}
+	if err := rm.StartRebalance(resume); err != nil {
+		return err
+	}
+	query := ""
+	if resume {
+		query = "?resume=true"
+	}
+	rm.tellOthers(http.MethodPost, "/internal/rebalance"+query)
+	return nil
+}
+
+// CancelClusterRebalance cancels the rebalance here and on every other healthy node
+func (rm *ReplicationManager) CancelClusterRebalance() error {
+	if err := rm.checkLeader(); err != nil {
+		return err
+	}
+	rm.tellOthers(http.MethodDelete, "/internal/rebalance")
+	return rm.CancelRebalance()
+}
+
+func (rm *ReplicationManager) checkLeader() error {
+	leader := rm.clusterManager.Leader()
+	if leader == nil || leader.ID != rm.clusterManager.GetCurrentNode().ID {
+		if leader != nil {
+			return fmt.Errorf("%w, which is node %s at %s", ErrNotLeader, leader.ID, leader.Address)
+		}
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// tellOthers sends an empty request to path on every other healthy node at once
+func (rm *ReplicationManager) tellOthers(method, path string) {
+	self := rm.clusterManager.GetCurrentNode().ID
+	var wg sync.WaitGroup
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		if node.ID == self {
+			continue
+		}
+		wg.Add(1)
+		go func(node *cluster.Node) {
+			defer wg.Done()
+			req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", node.Address, path), nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("X-Replication-Source", self)
+			resp, err := rm.client.Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+					err = responseError(resp)
+				}
+			}
+			if err != nil {
+				log.Printf("Failed to pass %s %s on to node %s: %v", method, path, node.ID, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,261 @@
+package replication
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/cluster"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+const defaultRepairInterval = 10 * time.Minute
+
+// repairer brings objects written here back up to the replication factor when copies
+// failed to be made or the nodes holding them went away. Every scan walks the local store
+// and counts the copies recorded in each object's Replicas on nodes that are healthy now.
+// Objects short of the factor are sent to more nodes, one at a time and through their own
+// throttle, so repairs never crowd out new writes.
+type repairer struct {
+	scanning sync.Mutex // one scan at a time
+	mutex    sync.Mutex
+	interval time.Duration
+	ticker   *time.Ticker
+	status   RepairStatus
+	throttle throttle
+	queued   map[string]bool // keys to look at before the next scan, see queueRepair
+	kick     chan struct{}
+}
+
+// RepairStatus is what the repair loop has been up to
+type RepairStatus struct {
+	Enabled         bool       `json:"enabled"` // false if the store doesn't record replicas
+	Interval        string     `json:"interval"`
+	Scans           int64      `json:"scans"`
+	ObjectsScanned  int64      `json:"objects_scanned"`  // across all scans
+	ObjectsRepaired int64      `json:"objects_repaired"` // across all scans
+	RepairsFailed   int64      `json:"repairs_failed"`
+	Backlog         int        `json:"backlog"` // under-replicated objects the current or last scan hasn't repaired
+	LastScanStarted *time.Time `json:"last_scan_started,omitempty"`
+	LastScanEnded   *time.Time `json:"last_scan_ended,omitempty"`
+}
+
+// SetRepair changes how often the repair loop scans and how many bytes per second its
+// copies may use, 0 for no limit. The copies count against the overall throttle as well.
+func (rm *ReplicationManager) SetRepair(interval time.Duration, bytesPerSecond int64) {
+	rm.repair.throttle.setRate(bytesPerSecond)
+
+	rm.repair.mutex.Lock()
+	defer rm.repair.mutex.Unlock()
+	rm.repair.interval = interval
+	if rm.repair.ticker != nil {
+		rm.repair.ticker.Reset(interval)
+	}
+}
+
+func (rm *ReplicationManager) GetRepairStatus() RepairStatus {
+	rm.repair.mutex.Lock()
+	defer rm.repair.mutex.Unlock()
+	status := rm.repair.status
+	status.Interval = rm.repair.interval.String()
+	return status
+}
+
+// startRepair starts scanning every interval, if the store keeps track of replicas at all
+func (rm *ReplicationManager) startRepair() {
+	if _, ok := rm.store.(storage.ReplicaRecorder); !ok {
+		return
+	}
+	rm.repair.mutex.Lock()
+	rm.repair.ticker = time.NewTicker(rm.repair.interval)
+	rm.repair.status.Enabled = true
+	ticker := rm.repair.ticker
+	rm.repair.mutex.Unlock()
+
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rm.stopping:
+				return
+			case <-ticker.C:
+				rm.repairScan(nil)
+			case <-rm.repair.kick:
+				rm.repair.mutex.Lock()
+				keys := rm.repair.queued
+				rm.repair.queued = make(map[string]bool)
+				rm.repair.mutex.Unlock()
+				rm.repairScan(func(obj *models.StorageObject) bool { return keys[obj.Key] })
+			}
+		}
+	}()
+}
+
+// queueRepair has the repair loop look at key straight away instead of at its next scan
+func (rm *ReplicationManager) queueRepair(key string) {
+	rm.repair.mutex.Lock()
+	if !rm.repair.status.Enabled {
+		rm.repair.mutex.Unlock()
+		return
+	}
+	rm.repair.queued[key] = true
+	rm.repair.mutex.Unlock()
+
+	select {
+	case rm.repair.kick <- struct{}{}:
+	default: // one is due already
+	}
+}
+
+// repairScan checks every object here once, or those filter picks if it isn't nil, then
+// repairs those short of copies
+func (rm *ReplicationManager) repairScan(filter func(obj *models.StorageObject) bool) {
+	rm.repair.scanning.Lock()
+	defer rm.repair.scanning.Unlock()
+
+	started := time.Now()
+	rm.updateRepair(func(status *RepairStatus) {
+		status.Scans++
+		status.LastScanStarted = &started
+	})
+
+	healthy := make(map[string]*cluster.Node)
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		healthy[node.ID] = node
+	}
+
+	var short []*models.StorageObject
+	for _, obj := range rm.store.List() {
+		if filter != nil && !filter(obj) {
+			continue
+		}
+		if rm.needsRepair(obj, healthy, started) {
+			short = append(short, obj)
+		}
+		rm.updateRepair(func(status *RepairStatus) { status.ObjectsScanned++ })
+	}
+	rm.updateRepair(func(status *RepairStatus) { status.Backlog = len(short) })
+	if len(short) > 0 {
+		log.Printf("Repair scan found %d under-replicated objects", len(short))
+	}
+
+	for _, obj := range short {
+		select {
+		case <-rm.stopping:
+			return
+		default:
+		}
+		repaired := rm.repairObject(obj, healthy)
+		rm.updateRepair(func(status *RepairStatus) {
+			if repaired {
+				status.ObjectsRepaired++
+				status.Backlog--
+			} else {
+				status.RepairsFailed++
+			}
+		})
+	}
+
+	ended := time.Now()
+	rm.updateRepair(func(status *RepairStatus) { status.LastScanEnded = &ended })
+}
+
+// needsRepair reports whether obj has fewer than the replication factor of copies on
+// healthy nodes, or has them in fewer zones than it could, and this node is the one to do
+// something about it. Every node holding a copy may scan it, so only the one with the
+// lowest ID among them repairs it.
+func (rm *ReplicationManager) needsRepair(obj *models.StorageObject, healthy map[string]*cluster.Node, now time.Time) bool {
+	if storage.Expired(obj, now) || len(obj.Replicas) == 0 || obj.Replicas[0].Status != "active" {
+		// A corrupt local copy is no source to repair others from
+		return false
+	}
+	self := rm.clusterManager.GetCurrentNode().ID
+	copies := 0
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		if _, ok := healthy[nodeID]; !ok {
+			continue
+		}
+		if nodeID < self {
+			return false
+		}
+		copies++
+	}
+	return copies < rm.Factor(obj) || rm.zonesShort(obj, healthy)
+}
+
+// zonesShort reports whether the copies of obj here and on healthy nodes are in fewer
+// zones than there are copies meant to be, while healthy nodes in other zones could take
+// one. Nodes are counted in the zone they are in now, which after a node moves may not be
+// the one recorded with its copy.
+func (rm *ReplicationManager) zonesShort(obj *models.StorageObject, healthy map[string]*cluster.Node) bool {
+	self := rm.clusterManager.GetCurrentNode()
+	available := map[string]bool{self.Zone: true}
+	for _, node := range healthy {
+		available[node.Zone] = true
+	}
+	held := map[string]bool{self.Zone: true}
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		if node, ok := healthy[nodeID]; ok {
+			held[node.Zone] = true
+		}
+	}
+	want := rm.Factor(obj) + 1
+	if len(available) < want {
+		want = len(available)
+	}
+	return len(held) < want
+}
+
+// repairObject sends obj to enough healthy nodes without a copy to make up the replication
+// factor, or when it has that many already, to one in a zone without a copy, and reports
+// whether it got there
+func (rm *ReplicationManager) repairObject(obj *models.StorageObject, healthy map[string]*cluster.Node) bool {
+	var holders []*cluster.Node
+	for _, nodeID := range storage.RemoteReplicas(obj) {
+		if node, ok := healthy[nodeID]; ok {
+			holders = append(holders, node)
+		}
+	}
+	factor := rm.Factor(obj)
+	need := factor - len(holders)
+	spreading := need <= 0
+	if spreading {
+		// One more copy, which goes to the zone with the fewest of them
+		need = 1
+	}
+	targets := rm.clusterManager.SelectReplicaTargets(need, holders, obj.Size)
+	if len(targets) == 0 {
+		return false
+	}
+
+	open := rm.opener(obj)
+	throttled := func() (io.ReadCloser, *models.StorageObject, error) {
+		data, current, err := open()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &throttledReadCloser{throttledReader{r: data, t: &rm.repair.throttle}, data}, current, nil
+	}
+
+	_, results, _ := rm.startTask(obj, targets, 0, throttled, true, true)
+	made := 0
+	for range targets {
+		if <-results {
+			made++
+		}
+	}
+	if spreading {
+		return made > 0
+	}
+	return len(holders)+made >= factor
+}
+
+func (rm *ReplicationManager) updateRepair(fn func(status *RepairStatus)) {
+	rm.repair.mutex.Lock()
+	defer rm.repair.mutex.Unlock()
+	fn(&rm.repair.status)
+}
@@ -0,0 +1,107 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCorruptAttempts limits sending a copy the target found corrupt. Once more might get
+// it there undamaged, more than that and it's likely the data here that's corrupt.
+const maxCorruptAttempts = 2
+
+// maxRetryDelay caps the wait between two attempts, however many there have been
+const maxRetryDelay = 30 * time.Second
+
+// retryPolicy says how often and for how long a failing target is retried
+type retryPolicy struct {
+	maxAttempts int           // including the first
+	delay       time.Duration // before the first retry, doubling after each
+	maxElapsed  time.Duration // since the first attempt
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts: 5,
+	delay:       500 * time.Millisecond,
+	maxElapsed:  2 * time.Minute,
+}
+
+// SetRetry changes how failed replications are retried: each target is tried up to
+// maxAttempts times, delay apart and doubling each time, for at most maxElapsed. Retries
+// already waiting keep the policy they started with.
+func (rm *ReplicationManager) SetRetry(maxAttempts int, delay, maxElapsed time.Duration) {
+	rm.retryMutex.Lock()
+	defer rm.retryMutex.Unlock()
+	rm.retry = retryPolicy{maxAttempts: maxAttempts, delay: delay, maxElapsed: maxElapsed}
+}
+
+func (rm *ReplicationManager) retryPolicy() retryPolicy {
+	rm.retryMutex.Lock()
+	defer rm.retryMutex.Unlock()
+	return rm.retry
+}
+
+// backoff is how long to wait after the given attempt (1 for the first) failed: the delay
+// doubled for each attempt before, jittered to between half and all of that so targets
+// failing together don't retry together
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	wait := p.delay
+	for i := 1; i < attempt && wait < maxRetryDelay; i++ {
+		wait *= 2
+	}
+	wait = min(wait, maxRetryDelay)
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// replicaError is a failed attempt to send a replica, saying whether trying again might
+// work. Network errors and 5xx answers might, and so might a copy that arrived corrupt;
+// other 4xx answers, like for an invalid key, won't.
+type replicaError struct {
+	err       error
+	retryable bool
+	corrupt   bool            // the target got different data than was sent
+	newer     *InventoryEntry // what the target holds instead, when it is a newer write
+}
+
+func (e *replicaError) Error() string { return e.err.Error() }
+func (e *replicaError) Unwrap() error { return e.err }
+
+// retryable reports whether the attempt that failed with err is worth following with another
+func retryable(err error, attempt int) bool {
+	var replicaErr *replicaError
+	if !errors.As(err, &replicaErr) || !replicaErr.retryable {
+		return false
+	}
+	return !replicaErr.corrupt || attempt < maxCorruptAttempts
+}
+
+// responseError turns a target's answer other than 200 into a replicaError. A 422 means
+// the copy arrived corrupt, which is retried, but only once, see maxCorruptAttempts.
+// A 409 means the target holds a newer write of the object, which it describes. A 415
+// means it can't decode the encoding the copy was sent in; its Accept-Encoding has been
+// noted by then, so the retry goes as it is stored.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusConflict {
+		// The target holds a newer write, and says which
+		var conflict struct {
+			Error   string          `json:"error"`
+			Current *InventoryEntry `json:"current"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&conflict); err == nil && conflict.Current != nil {
+			return &replicaError{err: fmt.Errorf("node answered %s: %s", resp.Status, conflict.Error), newer: conflict.Current}
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	corrupt := resp.StatusCode == http.StatusUnprocessableEntity
+	return &replicaError{
+		err: fmt.Errorf("node answered %s: %s", resp.Status, strings.TrimSpace(string(body))),
+		retryable: corrupt || resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusUnsupportedMediaType,
+		corrupt: corrupt,
+	}
+}
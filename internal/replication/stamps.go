@@ -0,0 +1,123 @@
+package replication
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// clock is this node's Lamport clock. Every write made here is stamped with its next tick,
+// and every stamp seen from another node moves it on past that one, so a write made after
+// another has been seen is always stamped newer than it.
+type clock struct {
+	mutex   sync.Mutex
+	counter int64
+}
+
+// loadClock starts the clock past every stamp in the store
+func (rm *ReplicationManager) loadClock() {
+	for _, obj := range rm.store.List() {
+		rm.ObserveStamp(obj.Stamp)
+	}
+}
+
+// NextStamp stamps a write made through this node
+func (rm *ReplicationManager) NextStamp() *models.WriteStamp {
+	rm.clock.mutex.Lock()
+	defer rm.clock.mutex.Unlock()
+	rm.clock.counter++
+	return &models.WriteStamp{Counter: rm.clock.counter, NodeID: rm.clusterManager.GetCurrentNode().ID}
+}
+
+// ObserveStamp moves the clock on past stamp, one a write was made with elsewhere
+func (rm *ReplicationManager) ObserveStamp(stamp *models.WriteStamp) {
+	if stamp == nil {
+		return
+	}
+	rm.clock.mutex.Lock()
+	defer rm.clock.mutex.Unlock()
+	if stamp.Counter > rm.clock.counter {
+		rm.clock.counter = stamp.Counter
+	}
+}
+
+// FormatStamp writes stamp as X-Object-Version carries it between nodes, counter@node
+func FormatStamp(stamp *models.WriteStamp) string {
+	return fmt.Sprintf("%d@%s", stamp.Counter, stamp.NodeID)
+}
+
+// ParseStamp reads X-Object-Version as another node sent it. Empty, or a plain version
+// number from a node that doesn't stamp its writes, is no stamp at all.
+func ParseStamp(value string) (*models.WriteStamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	counter, nodeID, found := strings.Cut(value, "@")
+	if !found {
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return nil, nil
+		}
+	}
+	n, err := strconv.ParseInt(counter, 10, 64)
+	if err != nil || n < 1 || nodeID == "" {
+		return nil, fmt.Errorf("X-Object-Version must be counter@node, not %q", value)
+	}
+	return &models.WriteStamp{Counter: n, NodeID: nodeID}, nil
+}
+
+// RecordConflict notes that held, the object under its key here, won out over a write
+// stamped dropped that came from or went to nodeID, in the stats and the object's
+// conflict history. action says what became of the loser, see models.ConflictRecord.
+func (rm *ReplicationManager) RecordConflict(held *models.StorageObject, nodeID string, dropped *models.WriteStamp, action string) {
+	rm.count(func(stats *Stats) {
+		stats.Conflicts++
+		node := stats.Nodes[nodeID]
+		if node == nil {
+			node = &NodeStats{}
+			stats.Nodes[nodeID] = node
+		}
+		node.Conflicts++
+	})
+
+	recorder, ok := rm.store.(storage.ConflictRecorder)
+	if !ok {
+		return
+	}
+	err := recorder.RecordConflict(held.Key, held.ID, models.ConflictRecord{
+		NodeID:  nodeID,
+		Kept:    held.Stamp,
+		Dropped: dropped,
+		Action:  action,
+	})
+	if err != nil {
+		log.Printf("Failed to record conflict on %s with node %s: %v", held.Key, nodeID, err)
+	}
+}
+
+// takeNewer replaces obj, which nodeID turned down for holding newer, with newer in the
+// background. A write made here meanwhile is left alone, it will be sent on in its turn.
+func (rm *ReplicationManager) takeNewer(nodeID string, obj *models.StorageObject, newer *InventoryEntry) {
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		ctx, cancel := rm.untilStopping()
+		defer cancel()
+
+		node, exists := rm.clusterManager.GetNode(nodeID)
+		if !exists {
+			return
+		}
+		held, err := rm.pullObject(ctx, nodeID, node.Address, newer)
+		if err != nil {
+			log.Printf("Failed to take newer %s from node %s: %v", obj.Key, nodeID, err)
+			return
+		}
+		log.Printf("Replaced stale %s with the newer write from node %s", obj.Key, nodeID)
+		rm.RecordConflict(held, nodeID, obj.Stamp, "replaced")
+	}()
+}
@@ -0,0 +1,100 @@
+package replication
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats is how replication from this node has been going since it started. The counters
+// are kept as tasks go, so they outlive the tasks themselves.
+type Stats struct {
+	TasksCreated    int64 `json:"tasks_created"`
+	TasksCompleted  int64 `json:"tasks_completed"` // enough targets got a copy, see SetMinSuccess
+	TasksPartial    int64 `json:"tasks_partial"`
+	TasksFailed     int64 `json:"tasks_failed"`
+	BytesReplicated int64 `json:"bytes_replicated"`
+	Conflicts       int64 `json:"conflicts"` // writes of the same key through different nodes that raced
+	// CompressedCopies were sent compressed, CompressedRawBytes of data in CompressedBytes
+	CompressedCopies   int64 `json:"compressed_copies"`
+	CompressedRawBytes int64 `json:"compressed_raw_bytes"`
+	CompressedBytes    int64 `json:"compressed_bytes"`
+	QueueDepth         int   `json:"queue_depth"`
+	// OldestPending is how long the oldest unfinished task has been going, in seconds
+	OldestPending float64               `json:"oldest_pending_seconds"`
+	Nodes         map[string]*NodeStats `json:"nodes"`
+}
+
+// NodeStats is how copies to one target node have been going
+type NodeStats struct {
+	Succeeded      int64      `json:"succeeded"`
+	Failed         int64      `json:"failed"`          // targets given up on
+	FailedAttempts int64      `json:"failed_attempts"` // retried ones included
+	Conflicts      int64      `json:"conflicts"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	LastFailure    *time.Time `json:"last_failure,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// counters is what Stats is made from
+type counters struct {
+	mutex sync.Mutex
+	Stats
+}
+
+func (rm *ReplicationManager) Stats() Stats {
+	rm.counters.mutex.Lock()
+	stats := rm.counters.Stats
+	stats.Nodes = make(map[string]*NodeStats, len(rm.counters.Nodes))
+	for nodeID, node := range rm.counters.Nodes {
+		copied := *node
+		stats.Nodes[nodeID] = &copied
+	}
+	rm.counters.mutex.Unlock()
+
+	stats.QueueDepth = len(rm.pool.queue)
+	var oldest time.Time
+	rm.pendingReplications.Range(func(key, value interface{}) bool {
+		task := value.(*ReplicationTask)
+		rm.tasksMutex.Lock()
+		if task.CompletedAt == nil && (oldest.IsZero() || task.CreatedAt.Before(oldest)) {
+			oldest = task.CreatedAt
+		}
+		rm.tasksMutex.Unlock()
+		return true
+	})
+	if !oldest.IsZero() {
+		stats.OldestPending = time.Since(oldest).Seconds()
+	}
+	return stats
+}
+
+// count changes the counters through fn
+func (rm *ReplicationManager) count(fn func(stats *Stats)) {
+	rm.counters.mutex.Lock()
+	defer rm.counters.mutex.Unlock()
+	fn(&rm.counters.Stats)
+}
+
+// countAttempt counts an attempt at copying size bytes to nodeID, final if it won't be
+// retried
+func (rm *ReplicationManager) countAttempt(nodeID string, size int64, err error, final bool) {
+	rm.count(func(stats *Stats) {
+		node := stats.Nodes[nodeID]
+		if node == nil {
+			node = &NodeStats{}
+			stats.Nodes[nodeID] = node
+		}
+		now := time.Now()
+		if err == nil {
+			node.Succeeded++
+			node.LastSuccess = &now
+			stats.BytesReplicated += size
+			return
+		}
+		node.FailedAttempts++
+		node.LastFailure, node.LastError = &now, err.Error()
+		if final {
+			node.Failed++
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package replication
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// CapabilityStored is taking encrypted copies as they are stored, see sendsStored
+const CapabilityStored = "repl-stored"
+
+// sendsStored reports whether copies of obj go out exactly as they are stored here rather
+// than decoded. Encrypted ones do, ciphertext and wrapped data key, so nodes keeping them
+// never need the master key unless they serve reads of them.
+func (rm *ReplicationManager) sendsStored(obj *models.StorageObject) bool {
+	_, ok := rm.store.(storage.StoredCopier)
+	return ok && obj.KeyID != ""
+}
+
+// setStoredHeaders describes obj's stored form on a copy sent as it is stored, see
+// ParseStoredForm
+func setStoredHeaders(req *http.Request, obj *models.StorageObject) {
+	req.Header.Set("X-Stored-Encryption", storage.EncryptionAlgorithm)
+	req.Header.Set("X-Stored-Key-ID", obj.KeyID)
+	req.Header.Set("X-Stored-Wrapped-Key", obj.WrappedKey)
+	req.Header.Set("X-Stored-Size", strconv.FormatInt(obj.StoredSize, 10))
+	req.Header.Set("X-Object-Size", strconv.FormatInt(obj.Size, 10))
+	if obj.ContentEncoding != "" {
+		req.Header.Set("X-Stored-Encoding", obj.ContentEncoding)
+	}
+}
+
+// ParseStoredForm reads the stored form of a copy sent as it is stored, along with the size
+// of its original data. ok is false for copies sent decoded.
+func ParseStoredForm(header http.Header) (form storage.StoredForm, size int64, ok bool, err error) {
+	algorithm := header.Get("X-Stored-Encryption")
+	if algorithm == "" {
+		return storage.StoredForm{}, 0, false, nil
+	}
+	if algorithm != storage.EncryptionAlgorithm {
+		return storage.StoredForm{}, 0, true, fmt.Errorf("%w: encryption %q", storage.ErrInvalidStoredForm, algorithm)
+	}
+	form = storage.StoredForm{
+		ContentEncoding: header.Get("X-Stored-Encoding"),
+		KeyID:           header.Get("X-Stored-Key-ID"),
+		WrappedKey:      header.Get("X-Stored-Wrapped-Key"),
+	}
+	form.StoredSize, err = strconv.ParseInt(header.Get("X-Stored-Size"), 10, 64)
+	if err != nil || form.StoredSize < 0 {
+		return storage.StoredForm{}, 0, true, fmt.Errorf("%w: X-Stored-Size required", storage.ErrInvalidStoredForm)
+	}
+	size, err = strconv.ParseInt(header.Get("X-Object-Size"), 10, 64)
+	if err != nil || size < 0 {
+		return storage.StoredForm{}, 0, true, fmt.Errorf("%w: X-Object-Size required", storage.ErrInvalidStoredForm)
+	}
+	return form, size, true, nil
+}
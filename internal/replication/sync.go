@@ -0,0 +1,445 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+var (
+	ErrSyncRunning     = errors.New("a sync is already running")
+	ErrNodeUnavailable = errors.New("node isn't a healthy peer")
+)
+
+const (
+	inventoryPageSize = 1000
+	// catchUpMargin is how far before the newest object here a startup sync starts
+	// looking, for writes this node missed just before it went away
+	catchUpMargin = time.Hour
+)
+
+// InventoryEntry is one object in a node's inventory, enough for another node to tell
+// whether its own copy is missing or stale and to store the object as it is here
+type InventoryEntry struct {
+	Key               string             `json:"key"`
+	ObjectID          string             `json:"object_id"`
+	Size              int64              `json:"size"`
+	ContentType       string             `json:"content_type"`
+	Checksum          string             `json:"checksum"`
+	ChecksumAlgorithm string             `json:"checksum_algorithm"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+	Owner             string             `json:"owner,omitempty"`
+	Metadata          map[string]string  `json:"metadata,omitempty"`
+	ExpiresAt         *time.Time         `json:"expires_at,omitempty"`
+	ReplicationFactor *int               `json:"replication_factor,omitempty"`
+	Stamp             *models.WriteStamp `json:"stamp,omitempty"`
+	Tier              string             `json:"tier,omitempty"`
+}
+
+// Inventory is a page of a node's inventory. Next is the key to carry on after, empty on
+// the last page.
+type Inventory struct {
+	Entries []InventoryEntry `json:"entries"`
+	Next    string           `json:"next,omitempty"`
+}
+
+// InventoryOptions selects one page of a node's inventory
+type InventoryOptions struct {
+	Prefix string
+	Since  time.Time // only objects updated at or after it, all of them if zero
+	After  string    // Next from the previous page, empty for the first
+	Limit  int       // 0 means no limit
+}
+
+// BuildInventory lists the objects in store opts asks for, in key order. Expired objects
+// are left out.
+func BuildInventory(store storage.Store, opts InventoryOptions) Inventory {
+	now := time.Now()
+	var objects []*models.StorageObject
+	for _, obj := range store.List() {
+		if obj.Key <= opts.After || !strings.HasPrefix(obj.Key, opts.Prefix) || obj.UpdatedAt.Before(opts.Since) {
+			continue
+		}
+		if obj.ExpiresAt != nil && !obj.ExpiresAt.After(now) {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	inventory := Inventory{Entries: []InventoryEntry{}}
+	for i, obj := range objects {
+		if i == opts.Limit {
+			inventory.Next = objects[i-1].Key
+			break
+		}
+		inventory.Entries = append(inventory.Entries, NewInventoryEntry(obj))
+	}
+	return inventory
+}
+
+// NewInventoryEntry describes obj as another node's inventory would list it
+func NewInventoryEntry(obj *models.StorageObject) InventoryEntry {
+	return InventoryEntry{
+		Key:               obj.Key,
+		ObjectID:          obj.ID,
+		Size:              obj.Size,
+		ContentType:       obj.ContentType,
+		Checksum:          obj.Checksum,
+		ChecksumAlgorithm: obj.ChecksumAlgorithm,
+		UpdatedAt:         obj.UpdatedAt,
+		Owner:             obj.Owner,
+		Metadata:          obj.Metadata,
+		ExpiresAt:         obj.ExpiresAt,
+		ReplicationFactor: obj.ReplicationFactor,
+		Stamp:             obj.Stamp,
+		Tier:              obj.StorageTier,
+	}
+}
+
+// object is the entry as far as fetchReplica needs it
+func (e *InventoryEntry) object() *models.StorageObject {
+	return &models.StorageObject{
+		ID:                e.ObjectID,
+		Key:               e.Key,
+		Checksum:          e.Checksum,
+		ChecksumAlgorithm: e.ChecksumAlgorithm,
+	}
+}
+
+// SyncStatus is how the current or last sync went, see SyncFrom
+type SyncStatus struct {
+	Running    bool       `json:"running"`
+	Node       string     `json:"node,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	Listed     int        `json:"listed"`  // objects in the node's inventory
+	Missing    int        `json:"missing"` // of those, missing or stale here
+	Fetched    int        `json:"fetched"`
+	Bytes      int64      `json:"bytes"`
+	Skipped    int        `json:"skipped"` // written here while being fetched, so left alone
+	Failed     int        `json:"failed"`
+	Remaining  int        `json:"remaining"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+type syncer struct {
+	mutex  sync.Mutex
+	status SyncStatus
+}
+
+func (rm *ReplicationManager) GetSyncStatus() SyncStatus {
+	rm.syncing.mutex.Lock()
+	defer rm.syncing.mutex.Unlock()
+	return rm.syncing.status
+}
+
+func (rm *ReplicationManager) updateSync(fn func(status *SyncStatus)) {
+	rm.syncing.mutex.Lock()
+	defer rm.syncing.mutex.Unlock()
+	fn(&rm.syncing.status)
+}
+
+// SyncFrom pulls from nodeID the objects updated there since since (all of them if it is
+// zero) that are missing here, or older here with other content. Copies are checked
+// against the checksums the node lists and come through the same throttles as repairs.
+// Objects written here while being fetched are left as they are. One sync runs at a time.
+func (rm *ReplicationManager) SyncFrom(ctx context.Context, nodeID string, since time.Time) error {
+	address, err := rm.claimSync(nodeID, since)
+	if err != nil {
+		return err
+	}
+	return rm.runSync(ctx, nodeID, address, since)
+}
+
+// StartSync runs SyncFrom in the background, until it is done or the manager stops
+func (rm *ReplicationManager) StartSync(nodeID string, since time.Time) error {
+	address, err := rm.claimSync(nodeID, since)
+	if err != nil {
+		return err
+	}
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		ctx, cancel := rm.untilStopping()
+		defer cancel()
+		if err := rm.runSync(ctx, nodeID, address, since); err != nil {
+			log.Printf("Sync from node %s failed: %v", nodeID, err)
+		}
+	}()
+	return nil
+}
+
+// CatchUp syncs from every healthy peer in turn in the background, for a node that has
+// been away. Only objects updated since a while before the newest one here are looked at.
+func (rm *ReplicationManager) CatchUp() {
+	var since time.Time
+	for _, obj := range rm.store.List() {
+		if obj.UpdatedAt.After(since) {
+			since = obj.UpdatedAt
+		}
+	}
+	if !since.IsZero() {
+		since = since.Add(-catchUpMargin)
+	}
+
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		ctx, cancel := rm.untilStopping()
+		defer cancel()
+		self := rm.clusterManager.GetCurrentNode().ID
+		for _, node := range rm.clusterManager.GetHealthyNodes() {
+			if node.ID == self {
+				continue
+			}
+			if err := rm.SyncFrom(ctx, node.ID, since); err != nil {
+				log.Printf("Sync from node %s failed: %v", node.ID, err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+}
+
+// untilStopping is a context that ends when the manager stops
+func (rm *ReplicationManager) untilStopping() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-rm.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// claimSync marks a sync from nodeID as running, returning the node's address
+func (rm *ReplicationManager) claimSync(nodeID string, since time.Time) (string, error) {
+	address, err := rm.peerAddress(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	rm.syncing.mutex.Lock()
+	defer rm.syncing.mutex.Unlock()
+	if rm.syncing.status.Running {
+		return "", ErrSyncRunning
+	}
+	started := time.Now()
+	rm.syncing.status = SyncStatus{Running: true, Node: nodeID, StartedAt: &started}
+	if !since.IsZero() {
+		rm.syncing.status.Since = &since
+	}
+	return address, nil
+}
+
+// peerAddress returns the address of nodeID if it is a healthy node other than this one
+func (rm *ReplicationManager) peerAddress(nodeID string) (string, error) {
+	self := rm.clusterManager.GetCurrentNode().ID
+	for _, node := range rm.clusterManager.GetHealthyNodes() {
+		if node.ID == nodeID && node.ID != self {
+			return node.Address, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNodeUnavailable, nodeID)
+}
+
+func (rm *ReplicationManager) runSync(ctx context.Context, nodeID, address string, since time.Time) (err error) {
+	defer func() {
+		finished := time.Now()
+		rm.updateSync(func(status *SyncStatus) {
+			status.Running = false
+			status.FinishedAt = &finished
+			if err != nil {
+				status.LastError = err.Error()
+			}
+		})
+	}()
+
+	var entries []InventoryEntry
+	err = rm.listInventory(ctx, address, InventoryOptions{Since: since}, func(entry InventoryEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list node %s: %v", nodeID, err)
+	}
+
+	var wanted []InventoryEntry
+	for _, entry := range entries {
+		if rm.isMissing(&entry) {
+			wanted = append(wanted, entry)
+		}
+	}
+	rm.updateSync(func(status *SyncStatus) {
+		status.Listed = len(entries)
+		status.Missing = len(wanted)
+		status.Remaining = len(wanted)
+	})
+	if len(wanted) > 0 {
+		log.Printf("Syncing %d objects from node %s", len(wanted), nodeID)
+	}
+
+	for i := range wanted {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entry := &wanted[i]
+		_, err := rm.pullObject(ctx, nodeID, address, entry)
+		rm.updateSync(func(status *SyncStatus) {
+			status.Remaining--
+			switch {
+			case err == nil:
+				status.Fetched++
+				status.Bytes += entry.Size
+			case errors.Is(err, storage.ErrPreconditionFailed), errors.Is(err, storage.ErrStaleWrite):
+				status.Skipped++
+			default:
+				status.Failed++
+				status.LastError = err.Error()
+			}
+		})
+		if err != nil && !errors.Is(err, storage.ErrPreconditionFailed) && !errors.Is(err, storage.ErrStaleWrite) {
+			log.Printf("Failed to sync %s from node %s: %v", entry.Key, nodeID, err)
+		}
+	}
+	return nil
+}
+
+// FetchInventory lists what nodeID holds of what opts asks for, by key, page by page so
+// no one answer gets too big. opts.After and opts.Limit are left to the paging. Only the
+// listing is sent, no bodies, for comparing with what this or another node holds.
+func (rm *ReplicationManager) FetchInventory(ctx context.Context, nodeID string, opts InventoryOptions) (map[string]InventoryEntry, error) {
+	address, err := rm.peerAddress(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]InventoryEntry)
+	err = rm.listInventory(ctx, address, opts, func(entry InventoryEntry) {
+		entries[entry.Key] = entry
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node %s: %v", nodeID, err)
+	}
+	return entries, nil
+}
+
+// listInventory pages through the inventory of the node at address, handing fn every entry
+func (rm *ReplicationManager) listInventory(ctx context.Context, address string, opts InventoryOptions, fn func(InventoryEntry)) error {
+	opts.After, opts.Limit = "", inventoryPageSize
+	for {
+		page, err := rm.fetchInventory(ctx, address, opts)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries {
+			fn(entry)
+		}
+		if page.Next == "" {
+			return nil
+		}
+		opts.After = page.Next
+	}
+}
+
+func (rm *ReplicationManager) fetchInventory(ctx context.Context, address string, opts InventoryOptions) (*Inventory, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(opts.Limit))
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if opts.After != "" {
+		query.Set("after", opts.After)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/internal/inventory?%s", address, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Replication-Source", rm.clusterManager.GetCurrentNode().ID)
+
+	resp, err := rm.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	var inventory Inventory
+	if err := json.NewDecoder(resp.Body).Decode(&inventory); err != nil {
+		return nil, fmt.Errorf("failed to decode inventory: %v", err)
+	}
+	return &inventory, nil
+}
+
+// isMissing reports whether entry should be pulled: there's no object under its key here,
+// or an older one with other content. Newer ones here win; when both are stamped, newer is
+// by their stamps, otherwise by when they were written.
+func (rm *ReplicationManager) isMissing(entry *InventoryEntry) bool {
+	local, err := rm.store.Stat(entry.Key)
+	if err != nil {
+		return errors.Is(err, storage.ErrObjectNotFound)
+	}
+	if local.ID == entry.ObjectID && strings.EqualFold(local.Checksum, entry.Checksum) {
+		return false
+	}
+	if local.Stamp != nil && entry.Stamp != nil {
+		return storage.StampBefore(local.Stamp, entry.Stamp)
+	}
+	return local.UpdatedAt.Before(entry.UpdatedAt)
+}
+
+// pullObject fetches entry from the node at address and stores it here, unless the key has
+// been written here in the meantime or holds a newer write
+func (rm *ReplicationManager) pullObject(ctx context.Context, nodeID, address string, entry *InventoryEntry) (*models.StorageObject, error) {
+	var version int64 // the key mustn't exist
+	if local, err := rm.store.Stat(entry.Key); err == nil {
+		version = local.Version
+	}
+
+	resp, err := rm.fetchReplica(ctx, address, entry.object(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rm.ObserveStamp(entry.Stamp)
+	data := &throttledReader{r: &throttledReader{r: resp.Body, t: &rm.repair.throttle}, t: &rm.throttle}
+	obj, err := rm.store.PutWithOptions(entry.Key, data, storage.PutOptions{
+		ContentType:       entry.ContentType,
+		ChecksumAlgorithm: entry.ChecksumAlgorithm,
+		ExpectedChecksum:  entry.Checksum,
+		Owner:             entry.Owner,
+		IfVersion:         &version,
+		ExpectedSize:      entry.Size,
+		Actor:             "node:" + nodeID,
+		ExpiresAt:         entry.ExpiresAt,
+		Metadata:          entry.Metadata,
+		ObjectID:          entry.ObjectID,
+		ReplicationFactor: entry.ReplicationFactor,
+		Stamp:             entry.Stamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rm.recordReplica(obj, nodeID)
+	return obj, nil
+}
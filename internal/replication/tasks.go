@@ -0,0 +1,171 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTaskNotFound is returned for an object no replication task is known for
+	ErrTaskNotFound = errors.New("no replication task known")
+	// ErrTaskExpired is returned for an object whose task has been pruned, see SetTaskRetention
+	ErrTaskExpired = errors.New("replication task has expired")
+	// ErrTaskInProgress is returned when acknowledging a task that hasn't finished
+	ErrTaskInProgress = errors.New("replication task is still in progress")
+)
+
+// taskPruneInterval is how often finished tasks are checked against the retention policy
+const taskPruneInterval = time.Minute
+
+var defaultTaskRetention = taskRetention{
+	completedTTL: time.Hour,
+	failedTTL:    24 * time.Hour,
+	maxTasks:     10000,
+}
+
+// taskRetention is how long finished tasks are kept. Tasks still going are always kept.
+type taskRetention struct {
+	completedTTL time.Duration
+	failedTTL    time.Duration // unless acknowledged before, see AcknowledgeTask
+	maxTasks     int           // the oldest finished tasks go first once there are more
+}
+
+// prunedTasks remembers the IDs of the latest pruned tasks, so asking after one gets
+// ErrTaskExpired rather than ErrTaskNotFound
+type prunedTasks struct {
+	mutex     sync.Mutex
+	retention taskRetention
+	ids       map[string]bool
+	order     []string // oldest first, at most retention.maxTasks
+}
+
+// SetTaskRetention keeps completed tasks for completedTTL after they finish, failed and
+// partial ones for failedTTL, and no more than maxTasks finished tasks in all
+func (rm *ReplicationManager) SetTaskRetention(completedTTL, failedTTL time.Duration, maxTasks int) {
+	rm.pruned.mutex.Lock()
+	defer rm.pruned.mutex.Unlock()
+	rm.pruned.retention = taskRetention{completedTTL: completedTTL, failedTTL: failedTTL, maxTasks: maxTasks}
+}
+
+func (rm *ReplicationManager) GetReplicationStatus(objectID string) (*ReplicationTask, error) {
+	task, exists := rm.pendingReplications.Load(objectID)
+	if exists {
+		return rm.copyTask(task.(*ReplicationTask)), nil
+	}
+	rm.pruned.mutex.Lock()
+	defer rm.pruned.mutex.Unlock()
+	if rm.pruned.ids[objectID] {
+		return nil, fmt.Errorf("%w: %s", ErrTaskExpired, objectID)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, objectID)
+}
+
+// AcknowledgeTask forgets a finished task, most usefully a failed one someone has looked
+// into, which would be kept for a long time otherwise
+func (rm *ReplicationManager) AcknowledgeTask(objectID string) error {
+	value, exists := rm.pendingReplications.Load(objectID)
+	if !exists {
+		_, err := rm.GetReplicationStatus(objectID)
+		return err
+	}
+	task := value.(*ReplicationTask)
+	rm.tasksMutex.Lock()
+	finished := task.CompletedAt != nil
+	rm.tasksMutex.Unlock()
+	if !finished {
+		return fmt.Errorf("%w: %s", ErrTaskInProgress, objectID)
+	}
+	rm.pruneTask(objectID, task)
+	return nil
+}
+
+// startPruning prunes finished tasks every taskPruneInterval until Stop
+func (rm *ReplicationManager) startPruning() {
+	ticker := time.NewTicker(taskPruneInterval)
+	rm.inflight.Add(1)
+	go func() {
+		defer rm.inflight.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rm.stopping:
+				return
+			case now := <-ticker.C:
+				if pruned := rm.pruneTasks(now); pruned > 0 {
+					log.Printf("Pruned %d finished replication tasks", pruned)
+				}
+			}
+		}
+	}()
+}
+
+// pruneTasks drops the finished tasks the retention policy has no room for, returning how
+// many there were
+func (rm *ReplicationManager) pruneTasks(now time.Time) int {
+	rm.pruned.mutex.Lock()
+	retention := rm.pruned.retention
+	rm.pruned.mutex.Unlock()
+
+	type finished struct {
+		id   string
+		task *ReplicationTask
+		at   time.Time
+	}
+	var kept []finished
+	pruned := 0
+	rm.pendingReplications.Range(func(key, value interface{}) bool {
+		task := value.(*ReplicationTask)
+		rm.tasksMutex.Lock()
+		completedAt, status := task.CompletedAt, task.Status
+		rm.tasksMutex.Unlock()
+		if completedAt == nil {
+			return true
+		}
+		ttl := retention.completedTTL
+		if status == "failed" || status == "partial" {
+			ttl = retention.failedTTL
+		}
+		if now.Sub(*completedAt) > ttl {
+			rm.pruneTask(key.(string), task)
+			pruned++
+		} else {
+			kept = append(kept, finished{key.(string), task, *completedAt})
+		}
+		return true
+	})
+
+	if excess := len(kept) - retention.maxTasks; excess > 0 {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].at.Before(kept[j].at) })
+		for _, task := range kept[:excess] {
+			rm.pruneTask(task.id, task.task)
+		}
+		pruned += excess
+	}
+	return pruned
+}
+
+// pruneTask forgets task, the one for objectID, remembering that it did. A newer task for
+// the same object is left alone.
+func (rm *ReplicationManager) pruneTask(objectID string, task *ReplicationTask) {
+	if !rm.pendingReplications.CompareAndDelete(objectID, task) {
+		return
+	}
+
+	rm.pruned.mutex.Lock()
+	defer rm.pruned.mutex.Unlock()
+	if rm.pruned.ids[objectID] {
+		return
+	}
+	rm.pruned.ids[objectID] = true
+	rm.pruned.order = append(rm.pruned.order, objectID)
+	if excess := len(rm.pruned.order) - rm.pruned.retention.maxTasks; excess > 0 {
+		for _, id := range rm.pruned.order[:excess] {
+			delete(rm.pruned.ids, id)
+		}
+		rm.pruned.order = append([]string(nil), rm.pruned.order[excess:]...)
+	}
+}
@@ -0,0 +1,63 @@
+package replication
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttle paces all replication traffic to a shared bytes-per-second budget
+type throttle struct {
+	mutex sync.Mutex
+	rate  int64     // bytes per second, 0 = unlimited
+	next  time.Time // when the budget is next free
+}
+
+func (t *throttle) setRate(rate int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rate = rate
+}
+
+// wait blocks long enough for n more bytes to fit in the budget
+func (t *throttle) wait(n int) {
+	t.mutex.Lock()
+	if t.rate <= 0 {
+		t.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	t.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the pacing smooth
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
+
+// throttledReadCloser is a throttledReader that closes what it reads from
+type throttledReadCloser struct {
+	throttledReader
+	closer io.Closer
+}
+
+func (t *throttledReadCloser) Close() error { return t.closer.Close() }
@@ -0,0 +1,421 @@
+// Package shadow mirrors a sample of object traffic to a secondary cluster and compares
+// its answers with ours, without the client ever seeing the shadow's side.
+package shadow
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Header marks mirrored requests. Requests that already carry it are never mirrored again.
+const Header = "X-Shadow-Request"
+
+const (
+	// Upload bodies are handed to the shadow through a queue of at most this many chunks;
+	// if the shadow can't keep up the mirrored request is abandoned rather than slowing
+	// the client down
+	streamChunks = 64
+
+	shadowTimeout = 30 * time.Second
+)
+
+var errDropped = errors.New("shadow fell behind, request abandoned")
+
+type Settings struct {
+	Enabled        bool    `json:"enabled"`
+	Target         string  `json:"target"`         // base URL of the shadow cluster
+	SamplePercent  float64 `json:"sample_percent"` // 0-100
+	MaxConcurrency int     `json:"max_concurrency"`
+	MaxBodyBytes   int64   `json:"max_body_bytes"` // larger uploads aren't mirrored
+}
+
+func (s Settings) Validate() error {
+	if s.SamplePercent < 0 || s.SamplePercent > 100 {
+		return fmt.Errorf("sample_percent must be between 0 and 100, got %g", s.SamplePercent)
+	}
+	if s.MaxConcurrency < 1 {
+		return fmt.Errorf("max_concurrency must be at least 1")
+	}
+	if s.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must be non-negative")
+	}
+	if s.Enabled {
+		u, err := url.Parse(s.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("target must be an http(s) URL when enabled, got %q", s.Target)
+		}
+	}
+	return nil
+}
+
+// Stats counts what the shadow has been sent and how its answers compared
+type Stats struct {
+	Sampled            int64   `json:"sampled"`
+	Sent               int64   `json:"sent"`
+	SkippedBusy        int64   `json:"skipped_busy"`  // no free concurrency slot
+	SkippedLarge       int64   `json:"skipped_large"` // body over max_body_bytes or of unknown length
+	Dropped            int64   `json:"dropped"`       // abandoned because the shadow fell behind
+	Errors             int64   `json:"errors"`        // shadow unreachable or failed mid-request
+	Compared           int64   `json:"compared"`
+	StatusMismatches   int64   `json:"status_mismatches"`
+	ChecksumMismatches int64   `json:"checksum_mismatches"`
+	AvgLatencyDeltaMs  float64 `json:"avg_latency_delta_ms"` // shadow minus primary
+}
+
+type counters struct {
+	sampled, sent, skippedBusy, skippedLarge, dropped, errors atomic.Int64
+	compared, statusMismatches, checksumMismatches            atomic.Int64
+	latencyDelta                                              atomic.Int64 // summed nanoseconds
+}
+
+type Shadower struct {
+	mutex    sync.RWMutex
+	settings Settings
+	slots    chan struct{} // one per in-flight mirrored request
+
+	client   *http.Client
+	counters counters
+	inflight sync.WaitGroup
+}
+
+func New(settings Settings) (*Shadower, error) {
+	s := &Shadower{client: &http.Client{Timeout: shadowTimeout}}
+	if err := s.Configure(settings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Configure swaps in new settings. Requests already mirrored finish under the old ones.
+func (s *Shadower) Configure(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	settings.Target = strings.TrimRight(settings.Target, "/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.settings = settings
+	s.slots = make(chan struct{}, settings.MaxConcurrency)
+	return nil
+}
+
+func (s *Shadower) Settings() Settings {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.settings
+}
+
+func (s *Shadower) Stats() Stats {
+	c := &s.counters
+	stats := Stats{
+		Sampled:            c.sampled.Load(),
+		Sent:               c.sent.Load(),
+		SkippedBusy:        c.skippedBusy.Load(),
+		SkippedLarge:       c.skippedLarge.Load(),
+		Dropped:            c.dropped.Load(),
+		Errors:             c.errors.Load(),
+		Compared:           c.compared.Load(),
+		StatusMismatches:   c.statusMismatches.Load(),
+		ChecksumMismatches: c.checksumMismatches.Load(),
+	}
+	if stats.Compared > 0 {
+		stats.AvgLatencyDeltaMs = float64(c.latencyDelta.Load()) / float64(stats.Compared) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// outcome is what one side answered
+type outcome struct {
+	status   int
+	checksum string // md5 of a GET body
+	latency  time.Duration
+	err      error
+}
+
+// Wrap mirrors sampled object requests handled by next
+func (s *Shadower) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.RLock()
+		settings, slots := s.settings, s.slots
+		s.mutex.RUnlock()
+
+		if !settings.Enabled || r.Header.Get(Header) != "" || !isObjectRequest(r) ||
+			rand.Float64()*100 >= settings.SamplePercent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.counters.sampled.Add(1)
+
+		if r.Method == http.MethodPut && (r.ContentLength < 0 || r.ContentLength > settings.MaxBodyBytes) {
+			s.counters.skippedLarge.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			s.counters.skippedBusy.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		release := func() { <-slots }
+
+		recorder := &recorder{ResponseWriter: w, status: http.StatusOK}
+		if r.Method == http.MethodGet {
+			recorder.hasher = md5.New()
+		}
+
+		if r.Method == http.MethodPut {
+			s.mirrorUpload(settings.Target, w, r, recorder, next, release)
+			return
+		}
+
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		primary := recorder.outcome(time.Since(start))
+
+		// Reads and deletes are mirrored after ours so the shadow sees the same order
+		req, err := s.shadowRequest(settings.Target, r, nil)
+		if err != nil {
+			release()
+			return
+		}
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			defer release()
+			s.compare(primary, s.send(req))
+		}()
+	})
+}
+
+// mirrorUpload sends the PUT body to the shadow as our handler reads it
+func (s *Shadower) mirrorUpload(target string, w http.ResponseWriter, r *http.Request, recorder *recorder, next http.Handler, release func()) {
+	stream := newStream()
+	req, err := s.shadowRequest(target, r, stream.reader())
+	if err != nil {
+		release()
+		next.ServeHTTP(w, r)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	r.Body = &teeBody{ReadCloser: r.Body, stream: stream}
+
+	primaryDone := make(chan outcome, 1)
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		defer release()
+		shadowOutcome := s.send(req)
+		if stream.wasDropped() {
+			s.counters.dropped.Add(1)
+			return
+		}
+		s.compare(<-primaryDone, shadowOutcome)
+	}()
+
+	start := time.Now()
+	next.ServeHTTP(recorder, r)
+	stream.close()
+	primaryDone <- recorder.outcome(time.Since(start))
+}
+
+func (s *Shadower) shadowRequest(target string, r *http.Request, body io.Reader) (*http.Request, error) {
+	// Not tied to the client's request, which is over long before the shadow answers
+	req, err := http.NewRequest(r.Method, target+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(Header, "true")
+	req.Header.Del("Connection")
+	return req, nil
+}
+
+func (s *Shadower) send(req *http.Request) outcome {
+	s.counters.sent.Add(1)
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return outcome{err: err, latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	result := outcome{status: resp.StatusCode}
+	if req.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		hasher := md5.New()
+		if _, err := io.Copy(hasher, resp.Body); err != nil {
+			return outcome{err: err, latency: time.Since(start)}
+		}
+		result.checksum = fmt.Sprintf("%x", hasher.Sum(nil))
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	result.latency = time.Since(start)
+	return result
+}
+
+func (s *Shadower) compare(primary, shadow outcome) {
+	if shadow.err != nil {
+		s.counters.errors.Add(1)
+		return
+	}
+	s.counters.compared.Add(1)
+	s.counters.latencyDelta.Add(int64(shadow.latency - primary.latency))
+
+	if primary.status != shadow.status {
+		s.counters.statusMismatches.Add(1)
+		return
+	}
+	if primary.checksum != shadow.checksum {
+		s.counters.checksumMismatches.Add(1)
+	}
+}
+
+// Start has nothing to do, mirroring happens inline with requests
+func (s *Shadower) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop waits for mirrored requests still in flight
+func (s *Shadower) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isObjectRequest matches GET, HEAD, PUT and DELETE on /objects/{key}
+func isObjectRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	return key != r.URL.Path && key != "" && !strings.Contains(key, "/")
+}
+
+// recorder notes our status and, for GETs, hashes the body on its way to the client
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hasher      hash.Hash
+	err         error
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(p)
+	if rec.hasher != nil {
+		rec.hasher.Write(p[:n])
+	}
+	if err != nil {
+		rec.err = err
+	}
+	return n, err
+}
+
+func (rec *recorder) outcome(latency time.Duration) outcome {
+	result := outcome{status: rec.status, latency: latency, err: rec.err}
+	if rec.hasher != nil && rec.status == http.StatusOK {
+		result.checksum = fmt.Sprintf("%x", rec.hasher.Sum(nil))
+	}
+	return result
+}
+
+// stream carries upload bytes from our handler to the shadow request without ever
+// blocking the handler
+type stream struct {
+	chunks  chan []byte
+	pr      *io.PipeReader
+	pw      *io.PipeWriter
+	dropped atomic.Bool
+}
+
+func newStream() *stream {
+	pr, pw := io.Pipe()
+	st := &stream{chunks: make(chan []byte, streamChunks), pr: pr, pw: pw}
+
+	go func() {
+		for chunk := range st.chunks {
+			if st.dropped.Load() {
+				continue
+			}
+			if _, err := pw.Write(chunk); err != nil {
+				st.dropped.Store(true)
+			}
+		}
+		if st.dropped.Load() {
+			pw.CloseWithError(errDropped)
+		} else {
+			pw.Close()
+		}
+	}()
+	return st
+}
+
+func (st *stream) reader() io.Reader { return st.pr }
+
+func (st *stream) write(p []byte) {
+	if st.dropped.Load() {
+		return
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case st.chunks <- chunk:
+	default:
+		st.dropped.Store(true)
+		st.pr.CloseWithError(errDropped) // unblock the pump so it can drain
+	}
+}
+
+func (st *stream) close() {
+	close(st.chunks)
+}
+
+func (st *stream) wasDropped() bool {
+	return st.dropped.Load()
+}
+
+type teeBody struct {
+	io.ReadCloser
+	stream *stream
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.stream.write(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,334 @@
+package shadow_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/shadow"
+)
+
+// objects is a minimal object store over HTTP, standing in for either cluster
+type objects struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func newObjects() *objects {
+	return &objects{data: make(map[string][]byte)}
+}
+
+func (o *objects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	switch r.Method {
+	case http.MethodPut:
+		// In small reads, as a store copying to disk would
+		var data []byte
+		chunk := make([]byte, 32<<10)
+		for {
+			n, err := r.Body.Read(chunk)
+			data = append(data, chunk[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		o.mutex.Lock()
+		o.data[key] = data
+		o.mutex.Unlock()
+	case http.MethodDelete:
+		o.mutex.Lock()
+		delete(o.data, key)
+		o.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		o.mutex.Lock()
+		data, ok := o.data[key]
+		o.mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+// mirrored is one request as the shadow saw it
+type mirrored struct {
+	method, path, marker string
+	body                 []byte
+}
+
+// fakeShadow records what it is sent before handing it to handler
+type fakeShadow struct {
+	mutex    sync.Mutex
+	requests []mirrored
+	server   *httptest.Server
+}
+
+func newFakeShadow(t *testing.T, handler http.Handler) *fakeShadow {
+	t.Helper()
+	fake := &fakeShadow{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, mirrored{r.Method, r.URL.Path, r.Header.Get(shadow.Header), body})
+		fake.mutex.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (fake *fakeShadow) seen() []mirrored {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]mirrored(nil), fake.requests...)
+}
+
+func newShadower(t *testing.T, settings shadow.Settings) *shadow.Shadower {
+	t.Helper()
+	s, err := shadow.New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// settle waits for mirrored requests still in flight
+func settle(t *testing.T, s *shadow.Shadower) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func do(handler http.Handler, method, path string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestShadowMirrorsMarkedRequests(t *testing.T) {
+	fake := newFakeShadow(t, newObjects())
+	s := newShadower(t, shadow.Settings{Enabled: true, Target: fake.server.URL, SamplePercent: 100, MaxConcurrency: 4, MaxBodyBytes: 1 << 20})
+	handler := s.Wrap(newObjects())
+
+	data := bytes.Repeat([]byte("mirrored "), 4096)
+	if w := do(handler, http.MethodPut, "/objects/report", data); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d", w.Code)
+	}
+	settle(t, s)
+	if w := do(handler, http.MethodGet, "/objects/report", nil); !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("GET = %d with %d bytes, want what was written", w.Code, w.Body.Len())
+	}
+	settle(t, s)
+	if w := do(handler, http.MethodDelete, "/objects/report", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", w.Code)
+	}
+	// Not object requests, or already mirrored once, so not mirrored
+	do(handler, http.MethodGet, "/health", nil)
+	do(handler, http.MethodGet, "/objects/videos/intro.mp4", nil)
+	r := httptest.NewRequest(http.MethodGet, "/objects/report", nil)
+	r.Header.Set(shadow.Header, "true")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	settle(t, s)
+
+	seen := fake.seen()
+	if len(seen) != 3 {
+		t.Fatalf("shadow was sent %+v, want the PUT, GET and DELETE", seen)
+	}
+	for i, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+		if seen[i].method != method || seen[i].path != "/objects/report" || seen[i].marker != "true" {
+			t.Errorf("request %d was %s %s marked %q, want %s /objects/report marked", i, seen[i].method, seen[i].path, seen[i].marker, method)
+		}
+	}
+	if !bytes.Equal(seen[0].body, data) {
+		t.Errorf("shadow was sent %d bytes of the upload, want all %d", len(seen[0].body), len(data))
+	}
+
+	stats := s.Stats()
+	if stats.Sampled != 3 || stats.Sent != 3 || stats.Compared != 3 {
+		t.Errorf("stats %+v, want 3 sampled, sent and compared", stats)
+	}
+	if stats.StatusMismatches != 0 || stats.ChecksumMismatches != 0 || stats.Errors != 0 {
+		t.Errorf("stats %+v, want the shadow to have agreed throughout", stats)
+	}
+}
+
+func TestShadowSampling(t *testing.T) {
+	fake := newFakeShadow(t, newObjects())
+	settings := shadow.Settings{Enabled: true, Target: fake.server.URL, SamplePercent: 0, MaxConcurrency: 1, MaxBodyBytes: 1 << 20}
+	s := newShadower(t, settings)
+	handler := s.Wrap(newObjects())
+
+	for i := 0; i < 100; i++ {
+		do(handler, http.MethodHead, "/objects/report", nil)
+	}
+	settle(t, s)
+	if stats := s.Stats(); stats.Sampled != 0 || len(fake.seen()) != 0 {
+		t.Errorf("%d of 100 requests sampled at 0%%", stats.Sampled)
+	}
+
+	// Half, give or take; those that find the one slot taken still count as sampled
+	settings.SamplePercent = 50
+	if err := s.Configure(settings); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		do(handler, http.MethodHead, "/objects/report", nil)
+	}
+	settle(t, s)
+	if sampled := s.Stats().Sampled; sampled < 350 || sampled > 650 {
+		t.Errorf("%d of 1000 requests sampled at 50%%", sampled)
+	}
+
+	// Turned off, nothing more is sampled at all
+	before := s.Stats().Sampled
+	settings.Enabled, settings.SamplePercent = false, 100
+	if err := s.Configure(settings); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		do(handler, http.MethodHead, "/objects/report", nil)
+	}
+	settle(t, s)
+	if sampled := s.Stats().Sampled; sampled != before {
+		t.Errorf("%d requests sampled while disabled", sampled-before)
+	}
+}
+
+func TestShadowComparesAnswers(t *testing.T) {
+	// The shadow has its own idea of report and knows nothing of draft
+	shadowObjects := newObjects()
+	shadowObjects.data["report"] = []byte("the shadow's version")
+	fake := newFakeShadow(t, shadowObjects)
+	s := newShadower(t, shadow.Settings{Enabled: true, Target: fake.server.URL, SamplePercent: 100, MaxConcurrency: 4, MaxBodyBytes: 1 << 20})
+	primary := newObjects()
+	primary.data["report"] = []byte("our version")
+	primary.data["draft"] = []byte("ours alone")
+	handler := s.Wrap(primary)
+
+	// What the client gets is ours alone
+	if w := do(handler, http.MethodGet, "/objects/report", nil); w.Code != http.StatusOK || w.Body.String() != "our version" {
+		t.Errorf("GET report = %d %q, want ours", w.Code, w.Body)
+	}
+	if w := do(handler, http.MethodGet, "/objects/draft", nil); w.Code != http.StatusOK || w.Body.String() != "ours alone" {
+		t.Errorf("GET draft = %d %q, want ours", w.Code, w.Body)
+	}
+	settle(t, s)
+
+	stats := s.Stats()
+	if stats.Compared != 2 || stats.ChecksumMismatches != 1 || stats.StatusMismatches != 1 {
+		t.Errorf("stats %+v, want a checksum and a status mismatch out of 2", stats)
+	}
+}
+
+func TestShadowDoesNotHoldUpThePrimary(t *testing.T) {
+	// A shadow that doesn't answer until released
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(stuck.Close)
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	settings := shadow.Settings{Enabled: true, Target: stuck.URL, SamplePercent: 100, MaxConcurrency: 1, MaxBodyBytes: 64 << 20}
+	s := newShadower(t, settings)
+	primary := newObjects()
+	primary.data["report"] = []byte("our version")
+	handler := s.Wrap(primary)
+
+	started := time.Now()
+	if w := do(handler, http.MethodGet, "/objects/report", nil); w.Code != http.StatusOK || w.Body.String() != "our version" {
+		t.Errorf("GET = %d %q, want ours", w.Code, w.Body)
+	}
+	// With the one slot held by the first GET, the rest go unmirrored
+	for i := 0; i < 10; i++ {
+		do(handler, http.MethodGet, "/objects/report", nil)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("11 GETs took %v with the shadow stuck", elapsed)
+	}
+	if stats := s.Stats(); stats.Sampled != 11 || stats.SkippedBusy != 10 {
+		t.Errorf("stats %+v, want 10 of 11 skipped with one slot", stats)
+	}
+	releaseOnce.Do(func() { close(release) })
+	settle(t, s)
+
+	// A shadow that never reads what it is sent: the upload to it is abandoned rather
+	// than left to back up into ours. Not reading, it can't notice the client is gone, so
+	// it is let go once done with.
+	done := make(chan struct{})
+	deaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(deaf.Close)
+	t.Cleanup(func() { close(done) })
+	settings.Target = deaf.URL
+	if err := s.Configure(settings); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{'x'}, 32<<20)
+	started = time.Now()
+	if w := do(handler, http.MethodPut, "/objects/disk.img", data); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d", w.Code)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("PUT of 32 MB took %v with the shadow not reading", elapsed)
+	}
+	if got := primary.data["disk.img"]; !bytes.Equal(got, data) {
+		t.Errorf("primary stored %d bytes of %d", len(got), len(data))
+	}
+	settle(t, s)
+	if stats := s.Stats(); stats.Dropped != 1 {
+		t.Errorf("stats %+v, want the upload dropped", stats)
+	}
+}
+
+func TestShadowSkipsLargeUploads(t *testing.T) {
+	fake := newFakeShadow(t, newObjects())
+	s := newShadower(t, shadow.Settings{Enabled: true, Target: fake.server.URL, SamplePercent: 100, MaxConcurrency: 4, MaxBodyBytes: 1024})
+	primary := newObjects()
+	handler := s.Wrap(primary)
+
+	if w := do(handler, http.MethodPut, "/objects/big", make([]byte, 1025)); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d", w.Code)
+	}
+	// Of unknown length, it might be any size
+	r := httptest.NewRequest(http.MethodPut, "/objects/streamed", io.NopCloser(strings.NewReader("streamed")))
+	r.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if w := do(handler, http.MethodPut, "/objects/small", make([]byte, 1024)); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d", w.Code)
+	}
+	settle(t, s)
+
+	if len(primary.data["big"]) != 1025 || string(primary.data["streamed"]) != "streamed" {
+		t.Error("the primary didn't get the uploads too large to mirror")
+	}
+	seen := fake.seen()
+	if len(seen) != 1 || seen[0].path != "/objects/small" {
+		t.Errorf("shadow was sent %d requests, want only the small upload", len(seen))
+	}
+	if stats := s.Stats(); stats.SkippedLarge != 2 || stats.Sent != 1 {
+		t.Errorf("stats %+v, want 2 skipped as too large and 1 sent", stats)
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Reads don't write metadata. Their access stats are kept aside and written out in a batch
+// every accessFlushInterval, or sooner once accessFlushBatch reads have piled up, so
+// LastAccess on disk and in listings trails the truth by at most about that long.
+const (
+	accessFlushInterval = 10 * time.Second
+	accessFlushBatch    = 1000
+)
+
+// accessStats are the reads of one object since its stats were last flushed
+type accessStats struct {
+	key   string
+	count int64
+	last  time.Time
+}
+
+// accessLog collects access stats without the store lock, so reads can share it. Stats
+// are kept by accessID, which stays the same when only an object's metadata changes.
+type accessLog struct {
+	mutex   sync.Mutex
+	pending map[string]*accessStats
+	reads   int
+	full    chan struct{} // nudges the flusher once a batch has piled up
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{pending: make(map[string]*accessStats), full: make(chan struct{}, 1)}
+}
+
+// record counts a read of obj and returns obj as it looks with every read not flushed yet
+func (a *accessLog) record(obj *models.StorageObject) *models.StorageObject {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	id := accessID(obj)
+	stats, exists := a.pending[id]
+	if !exists {
+		stats = &accessStats{key: obj.Key}
+		a.pending[id] = stats
+	}
+	stats.count++
+	stats.last = time.Now()
+	a.reads++
+	if a.reads == accessFlushBatch {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+	return stats.apply(obj)
+}
+
+// take hands over everything pending and starts afresh
+func (a *accessLog) take() map[string]*accessStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pending := a.pending
+	a.pending = make(map[string]*accessStats)
+	a.reads = 0
+	return pending
+}
+
+// accessID tells apart the objects reads are counted for. Versions of a key share its
+// object ID, see inherit.
+func accessID(obj *models.StorageObject) string {
+	return obj.ID + "/" + obj.VersionID
+}
+
+func (s *accessStats) apply(obj *models.StorageObject) *models.StorageObject {
+	updated := *obj
+	updated.AccessCount += s.count
+	updated.LastAccess = s.last
+	return &updated
+}
+
+// flushAccess writes out the access stats gathered since the last flush. An overwrite keeps
+// them, see inherit, but stats of objects deleted since they were read are dropped, as are
+// those of noncurrent versions, which only keep the stats they had when they were archived.
+func (fs *FileStore) flushAccess() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.readOnly {
+		// Kept until the store is writable again
+		return
+	}
+	pending := fs.access.take()
+
+	for id, stats := range pending {
+		obj, exists := fs.objects[stats.key]
+		if !exists || accessID(obj) != id {
+			continue
+		}
+		updated := stats.apply(obj)
+		if err := fs.saveObject(updated); err != nil {
+			log.Printf("Failed to save access stats of %s: %v", stats.key, err)
+			continue
+		}
+		fs.objects[stats.key] = updated
+	}
+}
+
+// flushAccessLoop flushes access stats until stop is closed, and once more then
+func (fs *FileStore) flushAccessLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			fs.flushAccess()
+			return
+		case <-ticker.C:
+		case <-fs.access.full:
+		}
+		fs.flushAccess()
+	}
+}
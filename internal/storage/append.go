@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// AppendOptions carries the optional parts of an append
+type AppendOptions struct {
+	ContentType string // of a new object; an existing one keeps its own
+	Owner       string // of a new object
+	IfVersion   *int64 // current version must match; 0 means the key must not exist
+	// ExpectedSize is the declared length of the appended data; when positive, any other
+	// byte count aborts the append
+	ExpectedSize int64
+	Actor        string // who is making the change, for the journal
+}
+
+// Append adds data to the end of key's object, creating it if it doesn't exist
+func (fs *FileStore) Append(key string, data io.Reader) (*models.StorageObject, error) {
+	return fs.AppendWithOptions(key, data, AppendOptions{})
+}
+
+// AppendWithOptions is Append with ownership and a precondition. Appends to one key are
+// serialized, so their bytes never interleave.
+//
+// When the object's data file is plain and its alone, the new bytes are spooled to a
+// temporary file without holding the lock, added to the end of the data file, and the
+// checksum carried on from where the last append left it. Reads stop at the committed
+// size, so they never see bytes that aren't part of the object yet. Anything else, like
+// shared, encrypted or compressed data, or a store keeping versions, is rewritten with the
+// data added, as a Put would.
+func (fs *FileStore) AppendWithOptions(key string, data io.Reader, opts AppendOptions) (*models.StorageObject, error) {
+	unlock := fs.appends.lock(key)
+	defer unlock()
+
+	fs.mutex.RLock()
+	obj := fs.objects[key]
+	err := fs.checkWritable()
+	if err == nil {
+		err = checkVersion(obj, opts.IfVersion)
+	}
+	live := err == nil && obj != nil && !fs.expired(obj)
+	if live && obj.Replicas[0].Status == replicaFailed {
+		err = &CorruptionError{Key: key, Path: obj.Replicas[0].FilePath,
+			Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum)}
+	}
+	inPlace := err == nil && live && fs.appendable(obj)
+	room := fs.quotaRoom(obj, opts.Owner)
+	var old io.ReadCloser
+	if err == nil && live && !inPlace {
+		old, err = fs.openObjectData(obj, 0, -1)
+	}
+	fs.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if inPlace {
+		return fs.appendInPlace(obj, data, room, opts)
+	}
+
+	// Rewritten whole, pinned to the version the old data was read from
+	var version int64
+	if obj != nil {
+		version = obj.Version
+	}
+	putOpts := PutOptions{
+		ContentType:  opts.ContentType,
+		Owner:        opts.Owner,
+		IfVersion:    &version,
+		ExpectedSize: opts.ExpectedSize,
+		Actor:        opts.Actor,
+	}
+	if old != nil {
+		defer old.Close()
+		data = io.MultiReader(old, data)
+		putOpts.ContentType = obj.ContentType
+		putOpts.ChecksumAlgorithm = obj.ChecksumAlgorithm
+		putOpts.StorageTier = obj.StorageTier
+		putOpts.ExpiresAt = obj.ExpiresAt
+		putOpts.Metadata = obj.Metadata
+		if opts.ExpectedSize > 0 {
+			putOpts.ExpectedSize += obj.Size
+		}
+	}
+	return fs.PutWithOptions(key, data, putOpts)
+}
+
+// appendable reports whether data can be added to the end of obj's data file in place:
+// it must be stored plain, and no other object, kept version or blob reference may share
+// it. The caller holds the lock.
+func (fs *FileStore) appendable(obj *models.StorageObject) bool {
+	path := obj.Replicas[0].FilePath
+	if obj.ContentEncoding == encodingGzip || obj.KeyID != "" || fs.isBlob(path) || fs.versioning {
+		return false
+	}
+	for _, version := range fs.versions[obj.Key] {
+		if len(version.Replicas) > 0 && version.Replicas[0].FilePath == path {
+			return false
+		}
+	}
+	// Copies hard link the data file
+	info, err := os.Stat(path)
+	return err == nil && linkCount(info) == 1
+}
+
+func (fs *FileStore) appendInPlace(obj *models.StorageObject, data io.Reader, room int64, opts AppendOptions) (*models.StorageObject, error) {
+	path := obj.Replicas[0].FilePath
+	hasher, err := fs.appends.resume(obj)
+	if err != nil {
+		return nil, err
+	}
+	if hasher == nil {
+		// Nothing to carry on from, so the data so far is hashed again, and checked on the way
+		if hasher, err = NewHasher(obj.ChecksumAlgorithm); err != nil {
+			return nil, err
+		}
+		reader, err := openStored(path, false, nil, 0, obj.Size)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(hasher, reader)
+		reader.Close()
+		if err := fs.checkIntegrity(obj, fmt.Sprintf("%x", hasher.Sum(nil)), err); err != nil {
+			return nil, err
+		}
+	}
+
+	// The new bytes are spooled first, so a slow writer doesn't hold the lock
+	spool, err := createTemp(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if room >= 0 {
+		data = io.LimitReader(data, room-obj.Size+1)
+	}
+	n, err := io.Copy(io.MultiWriter(spool, hasher), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	if room >= 0 && obj.Size+n > room {
+		return nil, fmt.Errorf("%w: only %d bytes left", ErrQuotaExceeded, room-obj.Size)
+	}
+	if opts.ExpectedSize > 0 && n != opts.ExpectedSize {
+		return nil, fmt.Errorf("%w: declared %d bytes, received %d", ErrIncompleteUpload, opts.ExpectedSize, n)
+	}
+	if n == 0 {
+		return obj, nil
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	// Reads carry on while the data file grows, but nothing commits or checks it meanwhile.
+	// The file stays open so it can be cut back even if it has been renamed or linked since.
+	fs.mutex.RLock()
+	var file *os.File
+	if !unchanged(fs.objects[obj.Key], obj) {
+		err = fmt.Errorf("%w: %s changed while it was being appended to", ErrPreconditionFailed, obj.Key)
+	} else if err = fs.checkWritable(); err == nil {
+		file, err = extendFile(path, obj.Size, spool)
+	}
+	fs.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	current := fs.objects[obj.Key]
+	if !unchanged(current, obj) {
+		file.Truncate(obj.Size)
+		return nil, fmt.Errorf("%w: %s changed while it was being appended to", ErrPreconditionFailed, obj.Key)
+	}
+	if room := fs.quotaRoom(current, current.Owner); room >= 0 && obj.Size+n > room {
+		file.Truncate(obj.Size)
+		return nil, fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, obj.Size+n, room)
+	}
+	if err := fs.checkWritable(); err != nil {
+		file.Truncate(obj.Size)
+		return nil, err
+	}
+
+	updated := *current
+	updated.Size += n
+	updated.Checksum = checksum
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+	updated.Replicas = localReplicas(current)
+	if err := fs.saveObject(&updated); err != nil {
+		file.Truncate(obj.Size)
+		return nil, err
+	}
+	fs.objects[obj.Key] = &updated
+	fs.uncache(obj.Key)
+	fs.tally(current, &updated)
+	fs.record(journal.OpPut, &updated, opts.Actor, n)
+	fs.adjustUsage(updated.Owner, 0, n)
+	fs.appends.save(&updated, hasher)
+	return &updated, nil
+}
+
+// extendFile adds the contents of spool to the data file at path after its first size
+// bytes, cutting off anything past them first, left by an append that didn't finish. It
+// returns the file, still open.
+func extendFile(path string, size int64, spool *os.File) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	fail := func(err error) (*os.File, error) {
+		file.Truncate(size)
+		file.Close()
+		return nil, fmt.Errorf("failed to write data: %v", err)
+	}
+	if err := file.Truncate(size); err != nil {
+		return fail(err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	if _, err := io.Copy(file, spool); err != nil {
+		return fail(err)
+	}
+	return file, nil
+}
+
+// maxHashStates bounds how many objects' checksum states are kept between appends
+const maxHashStates = 1024
+
+// appendLocks serializes appends per key, and keeps the checksum state of objects after
+// their last append so the next one doesn't have to hash the data again
+type appendLocks struct {
+	mutex  sync.Mutex
+	keys   map[string]*keyLock
+	hashes map[string]hashState // by data file
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+type hashState struct {
+	size  int64
+	state []byte
+}
+
+func newAppendLocks() *appendLocks {
+	return &appendLocks{keys: make(map[string]*keyLock), hashes: make(map[string]hashState)}
+}
+
+// lock takes key's lock, returning the function that releases it
+func (a *appendLocks) lock(key string) func() {
+	a.mutex.Lock()
+	l, exists := a.keys[key]
+	if !exists {
+		l = &keyLock{}
+		a.keys[key] = l
+	}
+	l.waiters++
+	a.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		if l.waiters--; l.waiters == 0 {
+			delete(a.keys, key)
+		}
+	}
+}
+
+// resume returns a hasher holding the checksum state of obj's data as it is now, or nil
+// if that isn't known
+func (a *appendLocks) resume(obj *models.StorageObject) (hash.Hash, error) {
+	a.mutex.Lock()
+	saved, exists := a.hashes[obj.Replicas[0].FilePath]
+	a.mutex.Unlock()
+	if !exists || saved.size != obj.Size {
+		return nil, nil
+	}
+	hasher, err := NewHasher(obj.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := hasher.(encoding.BinaryUnmarshaler); !ok || u.UnmarshalBinary(saved.state) != nil {
+		return nil, nil
+	}
+	return hasher, nil
+}
+
+// save keeps hasher's state as that of obj's data
+func (a *appendLocks) save(obj *models.StorageObject, hasher hash.Hash) {
+	m, ok := hasher.(encoding.BinaryMarshaler)
+	if !ok {
+		return
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	path := obj.Replicas[0].FilePath
+	if _, exists := a.hashes[path]; !exists && len(a.hashes) >= maxHashStates {
+		// Mostly objects replaced or deleted since; the rest hash their data again once
+		a.hashes = make(map[string]hashState)
+	}
+	a.hashes[path] = hashState{size: obj.Size, state: state}
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// DefaultBucket holds objects written without a bucket, including everything from before
+// buckets existed. Its files stay where they always were: data in the store root and
+// metadata in metadata/. Other buckets live under buckets/<name>/.
+const DefaultBucket = "default"
+
+const bucketsDir = "buckets"
+
+var (
+	ErrBucketNotFound    = errors.New("bucket not found")
+	ErrBucketExists      = errors.New("bucket already exists")
+	ErrBucketNotEmpty    = errors.New("bucket is not empty")
+	ErrInvalidBucketName = errors.New("invalid bucket name")
+)
+
+// BucketInfo describes one bucket and what is currently stored in it
+type BucketInfo struct {
+	Name    string `json:"name"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// ObjectName is the store-wide name of key in bucket: the key itself in the default
+// bucket, bucket/key in any other. Bucket names can't contain a slash, so names split
+// back unambiguously; a default bucket key with a slash in it is named default/key so it
+// isn't taken for one in another bucket.
+func ObjectName(bucket, key string) string {
+	if (bucket == "" || bucket == DefaultBucket) && !strings.Contains(key, "/") {
+		return key
+	}
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	return bucket + "/" + key
+}
+
+// SplitObjectName is the reverse of ObjectName
+func SplitObjectName(name string) (string, string) {
+	if i := strings.IndexByte(name, '/'); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return DefaultBucket, name
+}
+
+// BucketOf returns the bucket obj belongs to; objects from before buckets have none set
+func BucketOf(obj *models.StorageObject) string {
+	if obj.Bucket == "" {
+		return DefaultBucket
+	}
+	return obj.Bucket
+}
+
+// ValidateBucketName accepts 3 to 63 lowercase letters, digits, dots and hyphens,
+// starting and ending with a letter or digit
+func ValidateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("%w: %q must be 3 to 63 characters", ErrInvalidBucketName, name)
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		alnum := (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9')
+		if !alnum && ((ch != '.' && ch != '-') || i == 0 || i == len(name)-1) {
+			return fmt.Errorf("%w: %q may only use lowercase letters, digits, dots and hyphens, starting and ending with a letter or digit", ErrInvalidBucketName, name)
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) bucketPath(bucket string) string {
+	if bucket == DefaultBucket {
+		return fs.basePath
+	}
+	return filepath.Join(fs.basePath, bucketsDir, bucket)
+}
+
+func (fs *FileStore) bucketMetadataPath(bucket string) string {
+	if bucket == DefaultBucket {
+		return fs.metadataPath
+	}
+	return filepath.Join(fs.bucketPath(bucket), "metadata")
+}
+
+// metadataDirs lists the metadata directory of every bucket, the default one first
+func (fs *FileStore) metadataDirs() []string {
+	dirs := []string{fs.metadataPath}
+	for _, bucket := range fs.bucketNames() {
+		dirs = append(dirs, fs.bucketMetadataPath(bucket))
+	}
+	return dirs
+}
+
+// bucketNames returns the buckets other than the default one, sorted
+func (fs *FileStore) bucketNames() []string {
+	names := make([]string, 0, len(fs.buckets))
+	for name := range fs.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadBuckets finds the buckets created earlier, one directory each
+func (fs *FileStore) loadBuckets() {
+	entries, err := os.ReadDir(filepath.Join(fs.basePath, bucketsDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateBucketName(entry.Name()) == nil {
+			fs.buckets[entry.Name()] = true
+		}
+	}
+}
+
+// checkBucket makes sure the bucket an object name points into exists
+func (fs *FileStore) checkBucket(bucket string) error {
+	if bucket != DefaultBucket && !fs.buckets[bucket] {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, bucket)
+	}
+	return nil
+}
+
+func (fs *FileStore) BucketExists(name string) bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return name == DefaultBucket || fs.buckets[name]
+}
+
+// CreateBucket adds an empty bucket
+func (fs *FileStore) CreateBucket(name string) error {
+	if err := ValidateBucketName(name); err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	if name == DefaultBucket || fs.buckets[name] {
+		return fmt.Errorf("%w: %s", ErrBucketExists, name)
+	}
+	if err := os.MkdirAll(fs.bucketMetadataPath(name), 0755); err != nil {
+		return fmt.Errorf("failed to create bucket: %v", err)
+	}
+	fs.buckets[name] = true
+	return nil
+}
+
+// DeleteBucket removes a bucket. A bucket that still holds objects (or old versions of
+// them) is only removed with force, which permanently deletes all of them first. It
+// returns how many objects were deleted.
+func (fs *FileStore) DeleteBucket(name string, force bool, actor string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return 0, err
+	}
+	if name == DefaultBucket {
+		return 0, fmt.Errorf("%w: the %s bucket can't be deleted", ErrInvalidBucketName, DefaultBucket)
+	}
+	if !fs.buckets[name] {
+		return 0, fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+
+	var objects []*models.StorageObject
+	for _, obj := range fs.objects {
+		if BucketOf(obj) == name {
+			objects = append(objects, obj)
+		}
+	}
+	var versioned []string
+	for key := range fs.versions {
+		if bucket, _ := SplitObjectName(key); bucket == name {
+			versioned = append(versioned, key)
+		}
+	}
+	if (len(objects) > 0 || len(versioned) > 0) && !force {
+		return 0, fmt.Errorf("%w: %s holds %d objects", ErrBucketNotEmpty, name, len(objects))
+	}
+
+	deleted := 0
+	for _, obj := range objects {
+		if err := fs.removeObject(obj, actor); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if len(versioned) > 0 {
+		removed := make(map[string][]*models.StorageObject)
+		for _, key := range versioned {
+			removed[key] = fs.versions[key]
+			delete(fs.versions, key)
+		}
+		if err := fs.saveVersions(); err != nil {
+			for key, versions := range removed {
+				fs.versions[key] = versions
+			}
+			return deleted, err
+		}
+		for _, versions := range removed {
+			for _, obj := range versions {
+				for _, replica := range obj.Replicas {
+					fs.releaseData(replica.FilePath)
+				}
+			}
+		}
+	}
+
+	if err := os.RemoveAll(fs.bucketPath(name)); err != nil {
+		return deleted, fmt.Errorf("failed to remove bucket directory: %v", err)
+	}
+	delete(fs.buckets, name)
+	return deleted, nil
+}
+
+// ListBuckets returns every bucket, the default one first
+func (fs *FileStore) ListBuckets() []BucketInfo {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	infos := map[string]*BucketInfo{DefaultBucket: {Name: DefaultBucket}}
+	order := []string{DefaultBucket}
+	for _, name := range fs.bucketNames() {
+		infos[name] = &BucketInfo{Name: name}
+		order = append(order, name)
+	}
+	for _, obj := range fs.objects {
+		if info, exists := infos[BucketOf(obj)]; exists {
+			info.Objects++
+			info.Bytes += obj.Size
+		}
+	}
+
+	buckets := make([]BucketInfo, 0, len(order))
+	for _, name := range order {
+		buckets = append(buckets, *infos[name])
+	}
+	return buckets
+}
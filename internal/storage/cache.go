@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// CacheStats reports how the object cache is doing
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+// objectCache keeps the data of small objects in memory, least recently read first out
+// once it holds more than maxBytes. Entries are by key but remember which data file, size
+// and checksum they were read from, so one that has gone stale is never served even if
+// an invalidation was missed.
+type objectCache struct {
+	mutex         sync.Mutex
+	maxBytes      int64
+	maxObjectSize int64
+	bytes         int64
+	lru           *list.List // of *cacheEntry, most recently read first
+	entries       map[string]*list.Element
+	hits, misses  int64
+}
+
+type cacheEntry struct {
+	key      string
+	path     string
+	checksum string
+	data     []byte
+}
+
+func newObjectCache(maxBytes, maxObjectSize int64) *objectCache {
+	return &objectCache{
+		maxBytes:      maxBytes,
+		maxObjectSize: min(maxObjectSize, maxBytes),
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// cacheable reports whether obj is small enough to be cached
+func (c *objectCache) cacheable(obj *models.StorageObject) bool {
+	return obj.Size <= c.maxObjectSize
+}
+
+// get returns the cached data of obj, or nil if it isn't cached as it is now
+func (c *objectCache) get(obj *models.StorageObject) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, exists := c.entries[obj.Key]
+	if exists {
+		entry := element.Value.(*cacheEntry)
+		if entry.path == obj.Replicas[0].FilePath && int64(len(entry.data)) == obj.Size &&
+			strings.EqualFold(entry.checksum, obj.Checksum) {
+			c.lru.MoveToFront(element)
+			c.hits++
+			return entry.data
+		}
+		c.removeElement(element)
+	}
+	c.misses++
+	return nil
+}
+
+// holds reports whether obj's data is cached as it is now, without counting a hit or miss
+func (c *objectCache) holds(obj *models.StorageObject) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, exists := c.entries[obj.Key]
+	if !exists {
+		return false
+	}
+	entry := element.Value.(*cacheEntry)
+	return entry.path == obj.Replicas[0].FilePath && int64(len(entry.data)) == obj.Size &&
+		strings.EqualFold(entry.checksum, obj.Checksum)
+}
+
+// add caches data as obj's, making room for it
+func (c *objectCache) add(obj *models.StorageObject, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if int64(len(data)) > c.maxObjectSize {
+		return
+	}
+	if element, exists := c.entries[obj.Key]; exists {
+		c.removeElement(element)
+	}
+	c.entries[obj.Key] = c.lru.PushFront(&cacheEntry{
+		key:      obj.Key,
+		path:     obj.Replicas[0].FilePath,
+		checksum: obj.Checksum,
+		data:     data,
+	})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove drops key's entry, if it has one
+func (c *objectCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, exists := c.entries[key]; exists {
+		c.removeElement(element)
+	}
+}
+
+func (c *objectCache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.data))
+}
+
+func (c *objectCache) stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Entries:       len(c.entries),
+		Bytes:         c.bytes,
+		MaxBytes:      c.maxBytes,
+		MaxObjectSize: c.maxObjectSize,
+	}
+}
+
+// SetCache keeps the data of objects up to maxObjectSize bytes in memory once read, up to
+// maxBytes in all, so reads of small, popular objects don't go to disk. A maxBytes of 0
+// turns the cache off. Changing the limits starts an empty cache.
+func (fs *FileStore) SetCache(maxBytes, maxObjectSize int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if current := fs.cache; current != nil && current.maxBytes == maxBytes &&
+		current.maxObjectSize == min(maxObjectSize, maxBytes) {
+		return
+	}
+	fs.cache = nil
+	if maxBytes > 0 && maxObjectSize > 0 {
+		fs.cache = newObjectCache(maxBytes, maxObjectSize)
+	}
+}
+
+// CacheStats reports the cache's hits and misses since it was set up, and what it holds
+func (fs *FileStore) CacheStats() CacheStats {
+	fs.mutex.RLock()
+	cache := fs.cache
+	fs.mutex.RUnlock()
+	if cache == nil {
+		return CacheStats{}
+	}
+	return cache.stats()
+}
+
+// CacheCheck returns store's Cached if it has a read cache switched on, for
+// ml.PrefetchOptions, and nil otherwise
+func CacheCheck(store Store) func(key string) bool {
+	cacher, ok := store.(Cacher)
+	if !ok || cacher.CacheStats().MaxBytes == 0 {
+		return nil
+	}
+	return cacher.Cached
+}
+
+// Cached reports whether key's current data is in the cache
+func (fs *FileStore) Cached(key string) bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	obj, exists := fs.objects[key]
+	return exists && fs.cache != nil && fs.cache.holds(obj)
+}
+
+// Preload reads key's data into the cache ahead of the reads expected for it, without
+// counting as one of them. It returns the bytes it added, none if the data was cached
+// already, the object is too large for the cache or the cache is off.
+func (fs *FileStore) Preload(key string) (int64, error) {
+	fs.mutex.RLock()
+	obj, exists := fs.objects[key]
+	if !exists || fs.expired(obj) {
+		fs.mutex.RUnlock()
+		return 0, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	cache := fs.cache
+	if cache == nil || !cache.cacheable(obj) || cache.holds(obj) || obj.Replicas[0].Status == replicaFailed {
+		fs.mutex.RUnlock()
+		return 0, nil
+	}
+	reader, err := fs.openObjectData(obj, 0, obj.Size)
+	fs.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var data bytes.Buffer
+	verifying, err := newVerifyingReader(teeReadCloser{Reader: io.TeeReader(reader, &data), src: reader}, obj.ChecksumAlgorithm,
+		func(checksum string, readErr error) error { return fs.checkIntegrity(obj, checksum, readErr) })
+	if err != nil {
+		reader.Close()
+		return 0, err
+	}
+	defer verifying.Close()
+	if _, err := io.Copy(io.Discard, verifying); err != nil {
+		return 0, err
+	}
+	cache.add(obj, data.Bytes())
+	return int64(data.Len()), nil
+}
+
+// uncache drops key's cached data after it has changed. The caller holds the lock.
+func (fs *FileStore) uncache(key string) {
+	if fs.cache != nil {
+		fs.cache.remove(key)
+	}
+}
+
+// cached returns a reader of obj's data from start for n bytes served from the cache, or
+// nil if it isn't cached. The caller holds the lock.
+func (fs *FileStore) cached(obj *models.StorageObject, start, n int64) io.ReadCloser {
+	if fs.cache == nil || !fs.cache.cacheable(obj) {
+		return nil
+	}
+	data := fs.cache.get(obj)
+	if data == nil {
+		return nil
+	}
+	return io.NopCloser(bytes.NewReader(data[start : start+n]))
+}
+
+// teeReadCloser is a TeeReader that closes its source
+type teeReadCloser struct {
+	io.Reader
+	src io.ReadCloser
+}
+
+func (t teeReadCloser) Close() error { return t.src.Close() }
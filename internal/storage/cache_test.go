@@ -0,0 +1,128 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+func TestFileStoreCacheCounters(t *testing.T) {
+	fs := openFileStore(t, storage.MetadataJSON)
+	fs.SetCache(1<<20, 1<<10)
+	storagetest.Put(t, fs, "small", "quarterly figures", storage.PutOptions{})
+	storagetest.Put(t, fs, "large", strings.Repeat("x", 2<<10), storage.PutOptions{})
+
+	// The first read misses and fills, the ones after it hit
+	for i := 0; i < 3; i++ {
+		if got, _ := storagetest.Read(t, fs, "small", storage.GetOptions{}); got != "quarterly figures" {
+			t.Fatalf("read %d: %q", i, got)
+		}
+	}
+	if stats := fs.CacheStats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != int64(len("quarterly figures")) {
+		t.Errorf("after three reads of one object: %+v, want 2 hits, 1 miss and its bytes held", stats)
+	}
+
+	// Objects over the size limit, and ranged reads, neither count nor fill
+	storagetest.Read(t, fs, "large", storage.GetOptions{})
+	storagetest.Read(t, fs, "small", storage.GetOptions{Ranged: true, Offset: 0, Length: 9})
+	if stats := fs.CacheStats(); stats.Hits != 3 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("after a large and a ranged read: %+v, want the ranged one a hit and nothing else", stats)
+	}
+
+	// Off, there's nothing to report; back on, the counters start over
+	fs.SetCache(0, 0)
+	if stats := fs.CacheStats(); stats != (storage.CacheStats{}) {
+		t.Errorf("with the cache off: %+v", stats)
+	}
+	fs.SetCache(1<<20, 1<<10)
+	storagetest.Read(t, fs, "small", storage.GetOptions{})
+	if stats := fs.CacheStats(); stats.Hits != 0 || stats.Misses != 1 {
+		t.Errorf("after turning it back on: %+v, want a fresh count", stats)
+	}
+}
+
+func TestFileStoreCacheInvalidation(t *testing.T) {
+	fs := openFileStore(t, storage.MetadataJSON)
+	fs.SetCache(1<<20, 1<<10)
+
+	storagetest.Put(t, fs, "report", "first draft", storage.PutOptions{})
+	storagetest.Read(t, fs, "report", storage.GetOptions{})
+	if !fs.Cached("report") {
+		t.Fatal("report not cached after a whole read")
+	}
+
+	// An overwrite drops the entry, so the next read goes to disk for the new data
+	storagetest.Put(t, fs, "report", "second draft", storage.PutOptions{})
+	if stats := fs.CacheStats(); fs.Cached("report") || stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("after an overwrite: cached %v, %+v, want the entry dropped", fs.Cached("report"), stats)
+	}
+	if got, _ := storagetest.Read(t, fs, "report", storage.GetOptions{}); got != "second draft" {
+		t.Errorf("read after the overwrite: %q", got)
+	}
+	if got, _ := storagetest.Read(t, fs, "report", storage.GetOptions{}); got != "second draft" {
+		t.Errorf("cached read after the overwrite: %q", got)
+	}
+	if stats := fs.CacheStats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("after reading the overwritten object twice: %+v, want 1 hit and 2 misses", stats)
+	}
+
+	// So does a delete, and the key isn't served from memory afterwards
+	if err := fs.Delete("report"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := fs.CacheStats(); fs.Cached("report") || stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("after a delete: cached %v, %+v, want the entry dropped", fs.Cached("report"), stats)
+	}
+	if _, _, err := fs.GetWithOptions("report", storage.GetOptions{}); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("read after the delete: %v, want not found", err)
+	}
+
+	// Put back under the same key, it's read fresh
+	storagetest.Put(t, fs, "report", "third draft", storage.PutOptions{})
+	if got, _ := storagetest.Read(t, fs, "report", storage.GetOptions{}); got != "third draft" {
+		t.Errorf("read after putting it back: %q", got)
+	}
+}
+
+func BenchmarkFileStoreGet(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		for _, cache := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%dKiB/cache=%v", size>>10, cache), func(b *testing.B) {
+				fs, err := storage.OpenFileStore(b.TempDir(), storage.MetadataJSON)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() { fs.Stop(context.Background()) })
+				if cache {
+					fs.SetCache(16<<20, 1<<20)
+				}
+				const keys = 64
+				for i := 0; i < keys; i++ {
+					data := strings.Repeat(string(rune('a'+i%26)), size)
+					if _, err := fs.PutWithOptions(fmt.Sprintf("object-%d", i), strings.NewReader(data), storage.PutOptions{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					reader, _, err := fs.GetWithOptions(fmt.Sprintf("object-%d", i%keys), storage.GetOptions{})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(io.Discard, reader); err != nil {
+						b.Fatal(err)
+					}
+					reader.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+)
+
+// ChecksumAlgorithms lists the supported digests
+var ChecksumAlgorithms = []string{ChecksumMD5, ChecksumSHA256, ChecksumCRC32C}
+
+// ErrUnsupportedChecksum is returned for a checksum algorithm the store doesn't know
+var ErrUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+
+// ErrChecksumMismatch is returned when written data doesn't hash to the checksum the writer expected
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewHasher returns a hash for the named algorithm
+func NewHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(castagnoli), nil
+	}
+	return nil, fmt.Errorf("%w %q, supported: %s", ErrUnsupportedChecksum, algorithm, strings.Join(ChecksumAlgorithms, ", "))
+}
+
+// ValidateChecksumAlgorithm checks that algorithm is one of ChecksumAlgorithms
+func ValidateChecksumAlgorithm(algorithm string) error {
+	_, err := NewHasher(algorithm)
+	return err
+}
+
+// Checksum hashes everything in r with the named algorithm, hex encoded
+func Checksum(algorithm string, r io.Reader) (string, error) {
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// FormatChecksum renders a digest with its algorithm, e.g. "sha256:<hex>"
+func FormatChecksum(algorithm, checksum string) string {
+	return algorithm + ":" + checksum
+}
+
+// ParseChecksum splits an "algorithm:hex" checksum. A bare hex value is taken to use
+// fallback, and is MD5 when fallback is empty, which is what older nodes sent.
+func ParseChecksum(value, fallback string) (string, string, error) {
+	algorithm, checksum, found := strings.Cut(strings.TrimSpace(value), ":")
+	if !found {
+		algorithm, checksum = fallback, value
+		if algorithm == "" {
+			algorithm = ChecksumMD5
+		}
+	}
+	algorithm = strings.ToLower(algorithm)
+	if err := ValidateChecksumAlgorithm(algorithm); err != nil {
+		return "", "", err
+	}
+	return algorithm, strings.ToLower(checksum), nil
+}
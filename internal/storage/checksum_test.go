@@ -0,0 +1,122 @@
+package storage_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+// digests are data's checksums by algorithm, worked out apart from the store
+func digests(data string) map[string]string {
+	md5Sum := md5.Sum([]byte(data))
+	sha256Sum := sha256.Sum256([]byte(data))
+	crc := crc32.Checksum([]byte(data), crc32.MakeTable(crc32.Castagnoli))
+	return map[string]string{
+		storage.ChecksumMD5:    hex.EncodeToString(md5Sum[:]),
+		storage.ChecksumSHA256: hex.EncodeToString(sha256Sum[:]),
+		storage.ChecksumCRC32C: fmt.Sprintf("%08x", crc),
+	}
+}
+
+// flipByte damages the first byte of the file at path
+func flipByte(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreChecksumAlgorithms(t *testing.T) {
+	const data = "quarterly figures, final"
+	want := digests(data)
+
+	for _, algorithm := range storage.ChecksumAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+
+			obj := storagetest.Put(t, fs, "report", data, storage.PutOptions{ChecksumAlgorithm: algorithm})
+			if obj.ChecksumAlgorithm != algorithm || obj.Checksum != want[algorithm] {
+				t.Errorf("recorded %s:%s, want %s:%s", obj.ChecksumAlgorithm, obj.Checksum, algorithm, want[algorithm])
+			}
+
+			// Checked against the digest the writer expected, in the same algorithm
+			_, err := fs.PutWithOptions("copy", strings.NewReader(data), storage.PutOptions{ChecksumAlgorithm: algorithm, ExpectedChecksum: want[algorithm]})
+			if err != nil {
+				t.Errorf("put with the right %s: %v", algorithm, err)
+			}
+			_, err = fs.PutWithOptions("damaged", strings.NewReader(data+"!"), storage.PutOptions{ChecksumAlgorithm: algorithm, ExpectedChecksum: want[algorithm]})
+			if !errors.Is(err, storage.ErrChecksumMismatch) {
+				t.Errorf("put not matching its %s: %v, want a checksum mismatch", algorithm, err)
+			}
+
+			// Kept over a restart, and what scrubbing and read verification check by
+			fs = reopenFileStore(t, fs, dir)
+			obj, err = fs.Stat("report")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.ChecksumAlgorithm != algorithm || obj.Checksum != want[algorithm] {
+				t.Errorf("after a restart %s:%s, want %s:%s", obj.ChecksumAlgorithm, obj.Checksum, algorithm, want[algorithm])
+			}
+			if err := fs.Verify("report"); err != nil {
+				t.Errorf("verifying the intact object: %v", err)
+			}
+
+			flipByte(t, obj.Replicas[0].FilePath)
+			if err := fs.Verify("report"); !errors.Is(err, storage.ErrCorrupt) {
+				t.Errorf("verifying the damaged object: %v, want corrupt", err)
+			}
+			fs.SetVerifyReads(true)
+			reader, _, err := fs.GetWithOptions("report", storage.GetOptions{})
+			if err == nil {
+				_, err = io.ReadAll(reader)
+				reader.Close()
+			}
+			if !errors.Is(err, storage.ErrCorrupt) {
+				t.Errorf("reading the damaged object: %v, want corrupt", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreDefaultChecksum(t *testing.T) {
+	fs := openFileStore(t, storage.MetadataJSON)
+
+	if obj := storagetest.Put(t, fs, "a", "data", storage.PutOptions{}); obj.ChecksumAlgorithm != storage.ChecksumSHA256 {
+		t.Errorf("default algorithm %s, want sha256", obj.ChecksumAlgorithm)
+	}
+	if err := fs.SetDefaultChecksum(storage.ChecksumCRC32C); err != nil {
+		t.Fatal(err)
+	}
+	if obj := storagetest.Put(t, fs, "b", "data", storage.PutOptions{}); obj.ChecksumAlgorithm != storage.ChecksumCRC32C || obj.Checksum != digests("data")[storage.ChecksumCRC32C] {
+		t.Errorf("recorded %s:%s, want the crc32c default", obj.ChecksumAlgorithm, obj.Checksum)
+	}
+	// Asking for one still wins over the default
+	if obj := storagetest.Put(t, fs, "c", "data", storage.PutOptions{ChecksumAlgorithm: storage.ChecksumMD5}); obj.ChecksumAlgorithm != storage.ChecksumMD5 {
+		t.Errorf("asked for md5, got %s", obj.ChecksumAlgorithm)
+	}
+
+	if err := fs.SetDefaultChecksum("crc7"); !errors.Is(err, storage.ErrUnsupportedChecksum) {
+		t.Errorf("default of crc7: %v, want unsupported", err)
+	}
+	_, err := fs.PutWithOptions("d", strings.NewReader("data"), storage.PutOptions{ChecksumAlgorithm: "crc7"})
+	if !errors.Is(err, storage.ErrUnsupportedChecksum) {
+		t.Errorf("put with crc7: %v, want unsupported", err)
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Storage tiers, see StorageObject.StorageTier
+const (
+	TierHot  = "hot"
+	TierWarm = "warm"
+	TierCold = "cold"
+)
+
+var ErrInvalidTier = errors.New("invalid storage tier")
+
+func ValidateTier(tier string) error {
+	switch tier {
+	case TierHot, TierWarm, TierCold:
+		return nil
+	}
+	return fmt.Errorf("%w: %q (want %s, %s or %s)", ErrInvalidTier, tier, TierHot, TierWarm, TierCold)
+}
+
+// putTier returns the tier a write asks for, hot unless it says otherwise
+func putTier(opts PutOptions) (string, error) {
+	if opts.StorageTier == "" {
+		return TierHot, nil
+	}
+	return opts.StorageTier, ValidateTier(opts.StorageTier)
+}
+
+// Cold objects are stored gzipped. Data that doesn't shrink to compressionRatio of its
+// size is stored raw instead, and marked identity so it isn't tried again.
+const (
+	encodingGzip      = "gzip"
+	encodingIdentity  = "identity"
+	compressionRatio  = 0.9
+	compressionSample = 64 * 1024
+	compressionActor  = "compression"
+)
+
+// compressFile writes a gzipped copy of the data file at src next to it, encrypted with
+// dstKey if that is set; srcKey is what src is encrypted with. If a sample of the data,
+// or the finished copy, shows it doesn't compress well, the copy is dropped and the
+// returned path is empty.
+func compressFile(src string, srcKey, dstKey []byte) (string, int64, error) {
+	// Try the start of the file first, so large incompressible files aren't read twice
+	reader, err := openStored(src, false, srcKey, 0, compressionSample)
+	if err != nil {
+		return "", 0, err
+	}
+	sample, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read data file: %v", err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(sample)
+	zw.Close()
+	if float64(buf.Len()) > compressionRatio*float64(len(sample)) {
+		return "", 0, nil
+	}
+
+	dst, size, stored, err := rewriteStored(src, false, srcKey, ".gz", true, dstKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to compress data file: %v", err)
+	}
+	if float64(stored) > compressionRatio*float64(size) {
+		os.Remove(dst)
+		return "", 0, nil
+	}
+	return dst, stored, nil
+}
+
+// decompressFile writes a plain copy of the gzipped data file at src next to it, see
+// compressFile for the keys
+func decompressFile(src string, srcKey, dstKey []byte) (string, int64, error) {
+	dst, _, stored, err := rewriteStored(src, true, srcKey, "", false, dstKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decompress data file: %v", err)
+	}
+	return dst, stored, nil
+}
+
+// SetTier moves an object to tier, compressing its data on the way into the cold tier and
+// decompressing it on the way out, and moving it into the tier's directory if it has one,
+// see SetTierDirs. A moved file is checked against the object's checksum before it is
+// used. The new data file is written without holding the lock, so reads carry on from the
+// old one until the switch; if the object changes in the meantime the move fails with
+// ErrPreconditionFailed.
+func (fs *FileStore) SetTier(key, tier, actor string) (*models.StorageObject, error) {
+	if err := ValidateTier(tier); err != nil {
+		return nil, err
+	}
+
+	fs.mutex.RLock()
+	obj, exists := fs.objects[key]
+	var srcKey, dstKey []byte
+	var keyID, wrapped string
+	err := fs.checkWritable()
+	if exists && err == nil {
+		if srcKey, err = fs.unwrapKey(obj); err == nil {
+			dstKey, keyID, wrapped, err = fs.newDataKey()
+		}
+	}
+	fs.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A put or delete meanwhile may take the old file away before it's rewritten or moved,
+	// which is the object changing rather than the move failing
+	changed := func(err error) error {
+		fs.mutex.RLock()
+		defer fs.mutex.RUnlock()
+		if !unchanged(fs.objects[key], obj) {
+			return fmt.Errorf("%w: %s changed while it was being moved to %s", ErrPreconditionFailed, key, tier)
+		}
+		return err
+	}
+
+	oldPath := obj.Replicas[0].FilePath
+	path, encoding, size := oldPath, obj.ContentEncoding, obj.StoredSize
+	switch {
+	case tier == TierCold && encoding == "" && fs.isBlob(path):
+		// Shared with other keys, which may not be cold
+		encoding = encodingIdentity
+	case tier == TierCold && encoding == "":
+		compressed, n, err := compressFile(path, srcKey, dstKey)
+		if err != nil {
+			return nil, changed(err)
+		}
+		encoding = encodingIdentity
+		if compressed != "" {
+			path, encoding, size = compressed, encodingGzip, n
+		}
+	case tier != TierCold && encoding == encodingGzip:
+		plain, n, err := decompressFile(path, srcKey, dstKey)
+		if err != nil {
+			return nil, changed(err)
+		}
+		path, encoding, size = plain, "", n
+	case tier != TierCold:
+		encoding = ""
+	}
+	rewritten := path != oldPath
+
+	// Shared blobs stay put, like they aren't rewritten
+	if !fs.isBlob(path) {
+		dataKey := srcKey
+		if rewritten {
+			dataKey = dstKey
+		}
+		moved, err := fs.moveToTier(obj, path, tier, encoding == encodingGzip, dataKey)
+		if rewritten && moved != path {
+			os.Remove(path)
+		}
+		if err != nil {
+			return nil, changed(err)
+		}
+		path = moved
+	}
+	if tier == obj.StorageTier && encoding == obj.ContentEncoding && path == oldPath {
+		return obj, nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	discard := func() {
+		if path != oldPath {
+			os.Remove(path)
+		}
+	}
+	current := fs.objects[key]
+	if !unchanged(current, obj) {
+		discard()
+		return nil, fmt.Errorf("%w: %s changed while it was being moved to %s", ErrPreconditionFailed, key, tier)
+	}
+	if err := fs.checkWritable(); err != nil {
+		discard()
+		return nil, err
+	}
+
+	updated := *current
+	updated.StorageTier = tier
+	updated.ContentEncoding = encoding
+	updated.StoredSize = size
+	updated.Replicas = append([]models.ReplicaInfo(nil), current.Replicas...)
+	updated.Replicas[0].FilePath = path
+	if rewritten {
+		updated.KeyID, updated.WrappedKey = keyID, wrapped
+	}
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+
+	if err := fs.saveObject(&updated); err != nil {
+		discard()
+		return nil, err
+	}
+	fs.objects[key] = &updated
+	fs.uncache(key)
+	fs.tally(current, &updated)
+	fs.record(journal.OpTier, &updated, actor, 0)
+	if path != oldPath {
+		// Never a shared blob, those aren't rewritten or moved
+		os.Remove(oldPath)
+	}
+	return &updated, nil
+}
+
+// CompressCold compresses cold objects whose data is still stored raw, such as those from
+// before compression existed, returning how many were compressed. Reads aren't blocked,
+// see SetTier; objects that change while it runs are left for next time.
+func (fs *FileStore) CompressCold(ctx context.Context) (int, error) {
+	fs.mutex.RLock()
+	var keys []string
+	for key, obj := range fs.objects {
+		if obj.StorageTier == TierCold && obj.ContentEncoding == "" {
+			keys = append(keys, key)
+		}
+	}
+	fs.mutex.RUnlock()
+
+	compressed := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return compressed, err
+		}
+		obj, err := fs.SetTier(key, TierCold, compressionActor)
+		if errors.Is(err, ErrObjectNotFound) || errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		if errors.Is(err, ErrReadOnly) {
+			return compressed, err
+		}
+		if err != nil {
+			log.Printf("Failed to compress %s: %v", key, err)
+			continue
+		}
+		if obj.ContentEncoding == encodingGzip {
+			compressed++
+		}
+	}
+	return compressed, nil
+}
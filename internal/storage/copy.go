@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrDestinationExists is returned when a copy or rename would replace an object without
+// being allowed to
+var ErrDestinationExists = errors.New("destination already exists")
+
+// CopyOptions carries the optional parts of a copy or rename
+type CopyOptions struct {
+	Overwrite bool   // replace the destination if it exists
+	Owner     string // owner of a new copy; ignored on overwrite and by Rename
+	Actor     string // who is making the change, for the journal
+}
+
+func newObjectID(key string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(key+time.Now().String())))
+}
+
+// Copy makes dstKey a new object holding srcKey's current data, without reading it. The
+// data file is hard linked, or copied outside the lock where the filesystem can't link;
+// shared blobs just gain a reference. The copy gets a new ID and fresh timestamps.
+func (fs *FileStore) Copy(srcKey, dstKey string, opts CopyOptions) (*models.StorageObject, error) {
+	obj, _, err := fs.copyObject(srcKey, dstKey, opts, false)
+	return obj, err
+}
+
+// copyObject is Copy, returning the source as it was copied too. keepStats carries over
+// the access stats and creation time, for Rename.
+func (fs *FileStore) copyObject(srcKey, dstKey string, opts CopyOptions, keepStats bool) (*models.StorageObject, *models.StorageObject, error) {
+	bucket, _ := SplitObjectName(dstKey)
+	objectID := newObjectID(dstKey)
+
+	fs.mutex.RLock()
+	src, err := fs.copySource(srcKey)
+	if err == nil {
+		err = fs.checkDestination(dstKey, opts)
+	}
+	var path string
+	if err == nil {
+		path = fs.tierDataPath(bucket, src.StorageTier, objectID)
+	}
+	fs.mutex.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srcPath := src.Replicas[0].FilePath
+	if fs.isBlob(srcPath) {
+		path = srcPath
+	} else {
+		// Not while the source is being appended to in place, which would grow the copy too
+		unlock := fs.appends.lock(srcKey)
+		err := linkData(srcPath, path)
+		unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	discard := func() {
+		if path != srcPath {
+			os.Remove(path)
+		}
+	}
+	if !unchanged(fs.objects[srcKey], src) {
+		discard()
+		return nil, nil, fmt.Errorf("%w: %s changed while it was being copied", ErrPreconditionFailed, srcKey)
+	}
+	if err := fs.checkDestination(dstKey, opts); err != nil {
+		discard()
+		return nil, nil, err
+	}
+	previous := fs.objects[dstKey]
+	owner := opts.Owner
+	if keepStats {
+		owner = src.Owner
+	}
+	if room := fs.quotaRoom(previous, owner); room >= 0 && src.Size > room {
+		discard()
+		return nil, nil, fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, src.Size, room)
+	}
+	if path == srcPath {
+		fs.refs[path]++
+	}
+
+	now := time.Now()
+	obj := *src
+	obj.ID = objectID
+	obj.Key, obj.Bucket = dstKey, bucket
+	obj.UpdatedAt = now
+	if !keepStats {
+		obj.CreatedAt, obj.LastAccess, obj.AccessCount = now, now, 0
+	}
+	obj.Metadata = maps.Clone(src.Metadata)
+	obj.VersionID = ""
+	obj.ExpiresAt = nil
+	obj.Version, obj.Owner = 1, owner
+	if previous != nil {
+		obj.Version, obj.Owner = previous.Version+1, previous.Owner
+	}
+	obj.Replicas = []models.ReplicaInfo{{NodeID: src.Replicas[0].NodeID, FilePath: path, Status: replicaActive}}
+
+	if err := fs.commitPut(&obj, previous, opts.Actor); err != nil {
+		return nil, nil, err
+	}
+	return &obj, src, nil
+}
+
+// Rename moves srcKey's current version to dstKey, keeping its data file, access stats
+// and creation time. Data only moves on disk when it changes bucket. With versioning on,
+// srcKey keeps its history: the object is copied and srcKey gets a delete marker.
+func (fs *FileStore) Rename(srcKey, dstKey string, opts CopyOptions) (*models.StorageObject, error) {
+	fs.mutex.RLock()
+	versioning := fs.versioning
+	fs.mutex.RUnlock()
+
+	if versioning && srcKey != dstKey {
+		obj, src, err := fs.copyObject(srcKey, dstKey, opts, true)
+		if err != nil {
+			return nil, err
+		}
+		err = fs.DeleteWithOptions(srcKey, DeleteOptions{IfVersion: &src.Version, Actor: opts.Actor})
+		if err != nil {
+			return nil, fmt.Errorf("copied %s to %s but failed to delete it: %w", srcKey, dstKey, err)
+		}
+		return obj, nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	src, err := fs.copySource(srcKey)
+	if err != nil {
+		return nil, err
+	}
+	if srcKey == dstKey {
+		return src, nil
+	}
+	if err := fs.checkDestination(dstKey, opts); err != nil {
+		return nil, err
+	}
+	previous := fs.objects[dstKey]
+
+	srcBucket, _ := SplitObjectName(srcKey)
+	bucket, _ := SplitObjectName(dstKey)
+	updated := *src
+	updated.ID = newObjectID(dstKey)
+	updated.Key, updated.Bucket = dstKey, bucket
+	updated.UpdatedAt = time.Now()
+	updated.Version = 1
+	if previous != nil {
+		updated.Version, updated.Owner = previous.Version+1, previous.Owner
+	}
+	// Other nodes only have copies under the old name
+	updated.Replicas = localReplicas(src)
+
+	// The bucket's directory goes when the bucket does, so data can't be left in the old
+	// one. Tier directories aren't per bucket.
+	oldPath := src.Replicas[0].FilePath
+	path := oldPath
+	if bucket != srcBucket && !fs.isBlob(oldPath) && !fs.inTierDir(oldPath) {
+		path = fs.dataPath(bucket, updated.ID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to move data file: %v", err)
+		}
+		if err := os.Rename(oldPath, path); err != nil {
+			return nil, fmt.Errorf("failed to move data file: %v", err)
+		}
+		updated.Replicas[0].FilePath = path
+	}
+	undo := func() {
+		if path != oldPath {
+			os.Rename(path, oldPath)
+		}
+	}
+
+	if err := fs.saveObject(&updated); err != nil {
+		undo()
+		return nil, err
+	}
+	if err := fs.removeObjectMeta(src); err != nil {
+		fs.removeObjectMeta(&updated)
+		if previous != nil {
+			fs.saveObject(previous) // updated took its record with the kv backend
+		}
+		undo()
+		return nil, err
+	}
+	delete(fs.objects, srcKey)
+	fs.objects[dstKey] = &updated
+	fs.uncache(srcKey)
+	fs.uncache(dstKey)
+	fs.tally(src, &updated)
+
+	sizeDelta := updated.Size
+	if previous != nil {
+		if err := fs.removeObjectMeta(previous); err != nil {
+			log.Printf("Failed to remove metadata of replaced object %s: %v", previous.ID, err)
+		}
+		for _, replica := range previous.Replicas {
+			fs.releaseData(replica.FilePath)
+		}
+		sizeDelta -= previous.Size
+		fs.tally(previous, nil)
+		fs.adjustUsage(previous.Owner, -1, -previous.Size)
+	}
+	fs.record(journal.OpDelete, src, opts.Actor, -src.Size)
+	fs.record(journal.OpPut, &updated, opts.Actor, sizeDelta)
+	fs.adjustUsage(src.Owner, -1, -src.Size)
+	fs.adjustUsage(updated.Owner, 1, updated.Size)
+	return &updated, nil
+}
+
+// copySource returns the object a copy or rename reads from. The caller holds the lock.
+func (fs *FileStore) copySource(key string) (*models.StorageObject, error) {
+	obj, exists := fs.objects[key]
+	if !exists || fs.expired(obj) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if obj.Replicas[0].Status == replicaFailed {
+		return nil, &CorruptionError{Key: key, Path: obj.Replicas[0].FilePath,
+			Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum)}
+	}
+	return obj, nil
+}
+
+// checkDestination makes sure a copy or rename may write to key. The caller holds the lock.
+func (fs *FileStore) checkDestination(key string, opts CopyOptions) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	bucket, _ := SplitObjectName(key)
+	if err := fs.checkBucket(bucket); err != nil {
+		return err
+	}
+	if _, exists := fs.objects[key]; exists && !opts.Overwrite {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, key)
+	}
+	return nil
+}
+
+// linkData gives the data file at src a second name at dst, copying it when the
+// filesystem can't link. Data files are never changed once written, so the two names can
+// share one file.
+func linkData(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if err := os.Link(src, dst); err == nil {
+		// A link shares the old file's times; a fresh one keeps GC off it until the copy
+		// is committed
+		now := time.Now()
+		os.Chtimes(dst, now, now)
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy data file: %v", err)
+	}
+	return nil
+}
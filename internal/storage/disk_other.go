@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package storage
+
+import "errors"
+
+// DiskSpace can't tell how big a filesystem is here
+func DiskSpace(path string) (total, free int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
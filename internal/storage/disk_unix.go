@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package storage
+
+import "syscall"
+
+// DiskSpace returns the size of the filesystem path is on and the bytes free on it
+func DiskSpace(path string) (total, free int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
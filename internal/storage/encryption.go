@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrKeyUnavailable is returned when data can't be encrypted or decrypted because the
+// master key it needs isn't configured
+var ErrKeyUnavailable = errors.New("encryption key unavailable")
+
+var ErrInvalidMasterKey = errors.New("invalid master key")
+
+// MasterKey wraps the data keys objects are encrypted with. Every wrapped key records the
+// ID of the master key that wrapped it, so older master keys keep working after a new one
+// takes over, until RotateKeys has rewrapped everything.
+type MasterKey struct {
+	ID  string
+	Key []byte // 32 bytes, AES-256
+}
+
+// ParseMasterKeys reads master keys written as id:base64-key, oldest first
+func ParseMasterKeys(specs []string) ([]MasterKey, error) {
+	keys := make([]MasterKey, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		id, encoded, ok := strings.Cut(spec, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%w: want id:base64-key", ErrInvalidMasterKey)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%w: %s is given twice", ErrInvalidMasterKey, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%w: %s must be 32 bytes, base64 encoded", ErrInvalidMasterKey, id)
+		}
+		seen[id] = true
+		keys = append(keys, MasterKey{ID: id, Key: key})
+	}
+	return keys, nil
+}
+
+// SetEncryption sets the master keys. New writes are encrypted with a data key wrapped by
+// the last one; the others are only used to unwrap existing keys. With no keys new writes
+// are stored in plaintext. Encrypted writes skip dedup, since every object has its own
+// data key and identical content no longer makes identical files.
+func (fs *FileStore) SetEncryption(keys []MasterKey) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.masterKeys = keys
+
+	// Objects can be encrypted with keys this node doesn't have, like replicas from a peer
+	// that it only stores; they just can't be read here
+	missing := make(map[string]int)
+	fs.eachObject(func(obj *models.StorageObject) {
+		if obj.KeyID != "" && fs.masterKey(obj.KeyID) == nil {
+			missing[obj.KeyID]++
+		}
+	})
+	for id, n := range missing {
+		log.Printf("%d objects are encrypted with master key %s, which isn't configured; they can't be read", n, id)
+	}
+}
+
+// RotateKeys rewraps every data key that isn't wrapped with the newest master key,
+// returning how many were rewrapped. The data files aren't touched, so it is quick, and
+// older master keys can be dropped once it has run.
+func (fs *FileStore) RotateKeys(actor string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return 0, err
+	}
+	if len(fs.masterKeys) == 0 {
+		return 0, fmt.Errorf("%w: no master key is configured", ErrKeyUnavailable)
+	}
+	active := fs.masterKeys[len(fs.masterKeys)-1]
+
+	rewrap := func(obj *models.StorageObject) (*models.StorageObject, error) {
+		key, err := fs.unwrapKey(obj)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := wrapKey(active, key)
+		if err != nil {
+			return nil, err
+		}
+		updated := *obj
+		updated.KeyID, updated.WrappedKey = active.ID, wrapped
+		return &updated, nil
+	}
+
+	rotated := 0
+	keys := make([]string, 0, len(fs.objects))
+	for key := range fs.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj := fs.objects[key]
+		if obj.KeyID == "" || obj.KeyID == active.ID {
+			continue
+		}
+		updated, err := rewrap(obj)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rewrap the data key of %s: %w", key, err)
+		}
+		if err := fs.saveObject(updated); err != nil {
+			return rotated, err
+		}
+		fs.objects[key] = updated
+		fs.record(journal.OpMetadata, updated, actor, 0)
+		rotated++
+	}
+
+	// Older versions are saved together, so they are all rewrapped or none are
+	versions := make(map[string][]*models.StorageObject)
+	changed := 0
+	for key, older := range fs.versions {
+		versions[key] = make([]*models.StorageObject, len(older))
+		for i, obj := range older {
+			versions[key][i] = obj
+			if obj.KeyID == "" || obj.KeyID == active.ID {
+				continue
+			}
+			updated, err := rewrap(obj)
+			if err != nil {
+				return rotated, fmt.Errorf("failed to rewrap the data key of a version of %s: %w", key, err)
+			}
+			versions[key][i] = updated
+			changed++
+		}
+	}
+	if changed > 0 {
+		previous := fs.versions
+		fs.versions = versions
+		if err := fs.saveVersions(); err != nil {
+			fs.versions = previous
+			return rotated, err
+		}
+	}
+	return rotated + changed, nil
+}
+
+// eachObject calls fn for every current object and every kept version
+func (fs *FileStore) eachObject(fn func(obj *models.StorageObject)) {
+	for _, obj := range fs.objects {
+		fn(obj)
+	}
+	for _, older := range fs.versions {
+		for _, obj := range older {
+			fn(obj)
+		}
+	}
+}
+
+func (fs *FileStore) masterKey(id string) *MasterKey {
+	for i := range fs.masterKeys {
+		if fs.masterKeys[i].ID == id {
+			return &fs.masterKeys[i]
+		}
+	}
+	return nil
+}
+
+// newDataKey makes a key for one data file, returning it with the ID of the master key that
+// wrapped it and the wrapped key. All three are empty when encryption is off. Every file
+// written gets a new key, never one used before, since chunk nonces repeat between files.
+func (fs *FileStore) newDataKey() ([]byte, string, string, error) {
+	if len(fs.masterKeys) == 0 {
+		return nil, "", "", nil
+	}
+	active := fs.masterKeys[len(fs.masterKeys)-1]
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrapped, err := wrapKey(active, key)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return key, active.ID, wrapped, nil
+}
+
+// unwrapKey returns the data key obj's file is encrypted with, or nil if it isn't
+func (fs *FileStore) unwrapKey(obj *models.StorageObject) ([]byte, error) {
+	if obj.KeyID == "" {
+		return nil, nil
+	}
+	master := fs.masterKey(obj.KeyID)
+	if master == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted with master key %s", ErrKeyUnavailable, obj.Key, obj.KeyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(obj.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %v", err)
+	}
+	aead, err := newGCM(master.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key: too short")
+	}
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(master.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s: %v", obj.Key, err)
+	}
+	return key, nil
+}
+
+func wrapKey(master MasterKey, key []byte) (string, error) {
+	aead, err := newGCM(master.Key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, []byte(master.ID))), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted files are a series of chunks, each encryptedChunk bytes of data sealed with
+// AES-GCM, so a file is never held in memory whole and ranges can seek to the chunk they
+// start in. A chunk's nonce is its index plus a flag marking the last chunk, which makes
+// reordered, dropped or truncated chunks fail to open.
+const (
+	encryptedChunk = 64 * 1024
+	gcmOverhead    = 16
+)
+
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	if last {
+		nonce[0] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	aead  cipher.AEAD
+	dst   io.Writer
+	buf   []byte
+	chunk uint64
+}
+
+func newEncryptWriter(dst io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{aead: aead, dst: dst, buf: make([]byte, 0, encryptedChunk)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, it may turn out to be the last
+		if len(e.buf) == encryptedChunk {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptedChunk], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk; it doesn't close dst
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.chunk, last), e.buf, nil)
+	if _, err := e.dst.Write(sealed); err != nil {
+		return err
+	}
+	e.chunk++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	chunk  uint64
+	plain  []byte
+	sealed []byte
+	done   bool
+}
+
+// newDecryptReader reads an encrypted file from src, which is positioned at the start of
+// chunk index
+func newDecryptReader(src io.Reader, key []byte, chunk uint64) (*decryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		aead:   aead,
+		src:    bufio.NewReader(src),
+		chunk:  chunk,
+		sealed: make([]byte, encryptedChunk+gcmOverhead),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		_, peekErr := d.src.Peek(1)
+		last = peekErr == io.EOF
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.chunk, last), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %v", d.chunk, err)
+	}
+	d.plain = plain
+	d.chunk++
+	d.done = last
+	return nil
+}
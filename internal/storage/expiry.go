@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// expiryActor is recorded in the journal for deletes made by the sweeper
+const expiryActor = "expiry"
+
+// Expired reports whether obj has an expiry time and it has passed at now
+func Expired(obj *models.StorageObject, now time.Time) bool {
+	return obj.ExpiresAt != nil && !now.Before(*obj.ExpiresAt)
+}
+
+// SetClock has expiry tell the time with now instead of the system clock, for tests
+func (fs *FileStore) SetClock(now func() time.Time) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.now = now
+}
+
+// expired reports whether obj has expired by the store's clock. The caller holds the lock.
+func (fs *FileStore) expired(obj *models.StorageObject) bool {
+	return Expired(obj, fs.now())
+}
+
+// ExpirySweeper deletes expired objects in the background. Stores already refuse to read
+// expired objects; the sweeper is what frees their space.
+type ExpirySweeper struct {
+	store Store
+	now   func() time.Time // see SetClock
+
+	tickerMutex sync.Mutex
+	ticker      *time.Ticker
+	interval    time.Duration
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func NewExpirySweeper(store Store, interval time.Duration) *ExpirySweeper {
+	return &ExpirySweeper{store: store, interval: interval, now: time.Now}
+}
+
+// SetClock has each sweep tell the time with now instead of the system clock, for tests.
+// Call it before Start.
+func (s *ExpirySweeper) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// Sweep deletes every object expired at now, returning how many. An object overwritten
+// since it was listed is left alone.
+func (s *ExpirySweeper) Sweep(now time.Time) int {
+	swept := 0
+	for key, obj := range s.store.List() {
+		if !Expired(obj, now) {
+			continue
+		}
+		version := obj.Version
+		err := s.store.DeleteWithOptions(key, DeleteOptions{IfVersion: &version, Actor: expiryActor})
+		if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to delete expired object %s: %v", key, err)
+			continue
+		}
+		swept++
+	}
+	return swept
+}
+
+func (s *ExpirySweeper) Start(ctx context.Context) error {
+	s.tickerMutex.Lock()
+	ticker := time.NewTicker(s.interval)
+	s.ticker = ticker
+	s.tickerMutex.Unlock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	s.stop, s.done = stop, done
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if n := s.Sweep(s.now()); n > 0 {
+					log.Printf("Deleted %d expired objects", n)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// SetInterval changes how often expired objects are looked for
+func (s *ExpirySweeper) SetInterval(interval time.Duration) {
+	s.tickerMutex.Lock()
+	defer s.tickerMutex.Unlock()
+
+	s.interval = interval
+	if s.ticker != nil {
+		s.ticker.Reset(interval)
+	}
+}
+
+// Stop ends the sweeps; once stopped, calling it again does nothing
+func (s *ExpirySweeper) Stop(ctx context.Context) error {
+	if s.stop == nil {
+		return nil
+	}
+	s.ticker.Stop()
+	close(s.stop)
+	s.stop = nil
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
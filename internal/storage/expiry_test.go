@@ -0,0 +1,122 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+// fakeClock only moves when it's told to
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestExpiredObjectsAreGoneBeforeTheSweep(t *testing.T) {
+	fs := openFileStore(t, storage.MetadataJSON)
+	clock := &fakeClock{now: time.Now()}
+	fs.SetClock(clock.Now)
+
+	expires := clock.Now().Add(time.Hour)
+	first := storagetest.Put(t, fs, "crash-dump", "core", storage.PutOptions{ExpiresAt: &expires})
+	clock.Advance(59 * time.Minute)
+	if data, _ := storagetest.Read(t, fs, "crash-dump", storage.GetOptions{}); data != "core" {
+		t.Errorf("a minute before it expires, crash-dump = %q", data)
+	}
+
+	clock.Advance(time.Minute)
+	if _, _, err := fs.Get("crash-dump"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Get of an expired object = %v, want ErrObjectNotFound", err)
+	}
+	if _, err := fs.Stat("crash-dump"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Stat of an expired object = %v, want ErrObjectNotFound", err)
+	}
+
+	// Written again, it's a new object rather than the expired one brought back
+	put := storagetest.Put(t, fs, "crash-dump", "another core", storage.PutOptions{})
+	if put.ID == first.ID || !put.CreatedAt.After(first.CreatedAt) {
+		t.Errorf("rewritten object has ID %s, created %s; want a new ID and creation time", put.ID, put.CreatedAt)
+	}
+	if data, _ := storagetest.Read(t, fs, "crash-dump", storage.GetOptions{}); data != "another core" {
+		t.Errorf("after writing it again, crash-dump = %q", data)
+	}
+}
+
+func TestExpirySweep(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	clock := &fakeClock{now: time.Now()}
+	fs.SetClock(clock.Now)
+
+	soon, later := clock.Now().Add(time.Minute), clock.Now().Add(time.Hour)
+	storagetest.Put(t, fs, "artifact", "build output", storage.PutOptions{ExpiresAt: &soon})
+	storagetest.Put(t, fs, "report", "kept a while", storage.PutOptions{ExpiresAt: &later})
+	storagetest.Put(t, fs, "forever", "never expires", storage.PutOptions{})
+
+	sweeper := storage.NewExpirySweeper(fs, time.Millisecond)
+	sweeper.SetClock(clock.Now)
+	if err := sweeper.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sweeper.Stop(context.Background()) })
+
+	// However often it runs, nothing has expired yet
+	time.Sleep(20 * time.Millisecond)
+	if n := len(fs.List()); n != 3 {
+		t.Fatalf("%d objects before any expired, want 3", n)
+	}
+
+	clock.Advance(time.Minute)
+	waitFor(t, "the sweeper to delete artifact", func() bool {
+		_, listed := fs.List()["artifact"]
+		return !listed
+	})
+	if files, _, metadataFiles := dataUsage(t, dir); files != 2 || metadataFiles != 2 {
+		t.Errorf("after the sweep: %d data and %d metadata files, want 2 of each", files, metadataFiles)
+	}
+
+	if err := sweeper.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	// Stopped, it leaves report alone even once it has expired
+	clock.Advance(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if _, listed := fs.List()["report"]; !listed {
+		t.Error("report was swept after the sweeper stopped")
+	}
+	if n := sweeper.Sweep(clock.Now()); n != 1 {
+		t.Errorf("Sweep deleted %d objects, want report", n)
+	}
+	if _, listed := fs.List()["forever"]; !listed {
+		t.Error("an object without an expiry was swept")
+	}
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
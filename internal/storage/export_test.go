@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SetAtomicWriter makes metadata writes go through wrap until the returned func is called
+func SetAtomicWriter(wrap func(io.Writer) io.Writer) (restore func()) {
+	previous := atomicWriter
+	atomicWriter = func(f *os.File) io.Writer { return wrap(f) }
+	return func() { atomicWriter = previous }
+}
+
+// SignS3Request signs req as an S3Store with these credentials would at now
+func SignS3Request(req *http.Request, accessKey, secretKey, region string, now time.Time, payloadHash string) {
+	c := &s3Client{region: region, accessKey: accessKey, secretKey: secretKey, now: func() time.Time { return now }}
+	c.sign(req, payloadHash)
+}
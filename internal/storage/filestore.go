@@ -2,40 +2,170 @@ package storage //it handles actual file operations, like saving, retrieving, an
 
 //backend for distributed storage system
 import (
-	"crypto/md5" //To generate a unique checksum of file content.
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync" //To ensure thread-safe access using mutexes.
 	"time"
 
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/internal/kv"
 	"github.com/9ifrashaikh/distributed-system/pkg/models"
 )
 
+// ErrObjectNotFound is returned when the key (or the requested version of it) doesn't exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned when a conditional write finds the object in a different state
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrIncompleteUpload is returned when fewer (or more) bytes arrive than the writer declared
+var ErrIncompleteUpload = errors.New("incomplete upload")
+
+// UnknownOwner labels objects written before ownership was recorded
+const UnknownOwner = "unknown"
+
+// PutOptions carries the optional parts of a write
+type PutOptions struct {
+	ContentType       string
+	ChecksumAlgorithm string // empty uses the store default
+	ExpectedChecksum  string // when set, data must hash to it (with ChecksumAlgorithm) or the write fails
+	Owner             string // ignored on overwrite, the original owner is kept
+	IfVersion         *int64 // current version must match; 0 means the key must not exist
+	// ExpectedSize is the declared length of data; when positive, any other byte count
+	// aborts the write
+	ExpectedSize int64
+	Actor        string     // who is making the change, for the journal
+	ExpiresAt    *time.Time // when set, the object stops being readable at this time
+	StorageTier  string     // empty means hot; cold data is stored compressed
+	IfMatch      []string   // current ETag must be one of these, see checkETags
+	IfNoneMatch  []string   // current ETag must be none of these; "*" means the key must not exist
+	// Metadata is user metadata stored with the object, replacing any it had, see
+	// ValidateMetadata
+	Metadata map[string]string
+	// ObjectID is the ID the object gets in place of a new one or the one it replaces had,
+	// for replicas that keep the ID they have on the node they came from
+	ObjectID string
+	// ReplicationFactor, when set, is how many other nodes the object is to be kept on
+	// instead of the cluster's factor
+	ReplicationFactor *int
+	// Stamp orders the write against ones of the same key made through other nodes. One
+	// older than the object it would replace fails with ErrStaleWrite.
+	Stamp *models.WriteStamp
+}
+
+type DeleteOptions struct {
+	IfVersion *int64
+	VersionID string // removes just this version instead of deleting the object
+	Actor     string
+}
+
+type GetOptions struct {
+	VersionID string // empty reads the current version
+	// When Ranged, only the window described by Offset and Length is read, see ResolveRange
+	Ranged bool
+	Offset int64
+	Length int64
+}
+
 type FileStore struct {
 	basePath     string
 	metadataPath string // json files
 	objects      map[string]*models.StorageObject
 	mutex        sync.RWMutex
+	journal      *journal.Journal // nil if the journal couldn't be opened
+	onUsage      UsageObserver
+
+	defaultChecksum string
+	quota           int64                 // bytes, 0 = unlimited
+	ownerQuotas     map[string]int64      // bytes by owner, see SetOwnerQuotas
+	usedBytes       int64                 // held by current objects
+	tierUsage       map[string]TierUsage  // of current objects, by tier, see Usage
+	ownerUsage      map[string]OwnerUsage // of current objects, by owner, see UsageByOwner
+	masterKeys      []MasterKey           // newest last; empty means new writes aren't encrypted
+
+	buckets       map[string]bool   // all but the default bucket
+	tierDirs      map[string]string // data directories of tiers that have their own
+	dedup         bool
+	refs          map[string]int // keys referencing each content-addressed blob
+	versioning    bool
+	versions      map[string][]*models.StorageObject // noncurrent versions per key, oldest first
+	lastVersionID int64
+
+	stopCompress context.CancelFunc
+	compressDone chan struct{}
+
+	verifyReads bool  // hash whole-object reads, see SetVerifyReads
+	corruptions int64 // atomic, see Corruptions
+	readOnly    bool  // see SetReadOnly
+
+	kv *kv.DB // nil when metadata is kept in JSON files
+
+	access     *accessLog // reads not yet counted in the metadata
+	stopAccess chan struct{}
+	accessDone chan struct{}
+
+	appends *appendLocks
+	cache   *objectCache     // nil when off, see SetCache
+	nodeID  string           // of this node, see SetNodeID
+	now     func() time.Time // what expiry is checked against, see SetClock
 }
 
+// UsageObserver is told how an owner's stored object count and bytes changed. It is called
+// with the store locked, so it must be quick and must not call back into the store.
+type UsageObserver func(owner string, objects, bytes int64)
+
+// NewFileStore opens the store at basePath with its metadata in JSON files, see
+// OpenFileStore
 func NewFileStore(basePath string) *FileStore {
+	fs := newFileStore(basePath)
+	fs.open()
+	return fs
+}
+
+func newFileStore(basePath string) *FileStore {
 	fs := &FileStore{
 		basePath:     basePath,
 		metadataPath: filepath.Join(basePath, "metadata"),
 		objects:      make(map[string]*models.StorageObject),
+		versions:     make(map[string][]*models.StorageObject),
+		refs:         make(map[string]int),
+		tierUsage:    make(map[string]TierUsage),
+		ownerUsage:   make(map[string]OwnerUsage),
+		buckets:      make(map[string]bool),
+		access:       newAccessLog(),
+		appends:      newAppendLocks(),
+		nodeID:       standaloneNodeID,
+		now:          time.Now,
+
+		defaultChecksum: ChecksumSHA256,
 	}
 
 	// Create directories
 	os.MkdirAll(basePath, 0755)
 	os.MkdirAll(fs.metadataPath, 0755)
+	return fs
+}
 
-	// Load existing metadata
+// open loads the catalog and opens the journal
+func (fs *FileStore) open() {
 	fs.loadMetadata()
 
-	return fs
+	j, err := journal.Open(filepath.Join(fs.basePath, "journal"))
+	if err != nil {
+		log.Printf("Mutation journal disabled: %v", err)
+	} else {
+		fs.journal = j
+	}
 }
 
 // This is how new file uploads are handled.
@@ -43,105 +173,626 @@ func NewFileStore(basePath string) *FileStore {
 // It generates a unique ID for each file, saves it to the filesystem, and updates metadata.
 // method for uploading files to the storage system
 func (fs *FileStore) Put(key string, data io.Reader, contentType string) (*models.StorageObject, error) {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
+	return fs.PutWithOptions(key, data, PutOptions{ContentType: contentType})
+}
 
-	// Generate object ID
-	objectID := fmt.Sprintf("%x", md5.Sum([]byte(key+time.Now().String())))
+// PutWithOptions is Put with ownership and preconditions. The body is written and hashed
+// to a temporary file without holding the lock, so a slow upload doesn't stall the rest
+// of the store; the lock is only taken to commit it. Preconditions, the bucket and the
+// quota are checked up front and again at commit, so of two Puts to one key the one that
+// commits last wins, unless its preconditions no longer hold.
+func (fs *FileStore) PutWithOptions(key string, data io.Reader, opts PutOptions) (*models.StorageObject, error) {
+	tier, err := putTier(opts)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := putMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkObjectID(opts.ObjectID); err != nil {
+		return nil, err
+	}
+	bucket, _ := SplitObjectName(key)
+	objectID := newObjectID(key)
 
-	// Create file path
-	filePath := filepath.Join(fs.basePath, objectID)
+	fs.mutex.RLock()
+	filePath := fs.tierDataPath(bucket, tier, fs.storedObjectID(objectID, fs.objects[key], opts))
+	algorithm := opts.ChecksumAlgorithm
+	if algorithm == "" {
+		algorithm = fs.defaultChecksum
+	}
+	err = fs.checkWritable()
+	if err == nil {
+		err = fs.checkBucket(bucket)
+	}
+	if err == nil {
+		err = checkPreconditions(key, fs.objects[key], opts)
+	}
+	room := fs.quotaRoom(fs.objects[key], opts.Owner)
+	dedup := fs.dedup
+	var dataKey, coldKey []byte
+	var keyID, wrappedKey, coldKeyID, coldWrapped string
+	if err == nil {
+		dataKey, keyID, wrappedKey, err = fs.newDataKey()
+	}
+	if err == nil && tier == TierCold && (dataKey != nil || !dedup) {
+		// The compressed copy is a new file, so it gets a new data key
+		coldKey, coldKeyID, coldWrapped, err = fs.newDataKey()
+	}
+	fs.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if room >= 0 && opts.ExpectedSize > room {
+		return nil, fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, opts.ExpectedSize, room)
+	}
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create file
-	file, err := os.Create(filePath)
+	// The data goes to a temporary file beside where it will live
+	file, err := createTemp(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file: %v", err)
 	}
+	tmp := file.Name()
 	defer file.Close()
 
-	// Calculate checksum while writing
-	hasher := md5.New()
-	writer := io.MultiWriter(file, hasher)
+	// Calculate checksum while writing; dedup always names blobs by SHA-256, whatever the
+	// object's own checksum is. Encrypted data is never shared, see SetEncryption.
+	stored, err := newStoredWriter(file, false, dataKey)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	writer := io.MultiWriter(stored, hasher)
+	var content hash.Hash
+	if dedup && dataKey == nil {
+		content = sha256.New()
+		writer = io.MultiWriter(stored, hasher, content)
+	}
 
+	// Without a declared size the quota is only known to be blown once the body gets
+	// there, so stop reading one byte past the room left
+	if room >= 0 {
+		data = io.LimitReader(data, room+1)
+	}
 	size, err := io.Copy(writer, data)
+	if err == nil {
+		err = stored.Close()
+	}
 	if err != nil {
-		os.Remove(filePath)
-		return nil, fmt.Errorf("failed to write data: %v", err)
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	if room >= 0 && size > room {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("%w: only %d bytes left", ErrQuotaExceeded, room)
+	}
+
+	// A short body means the client went away mid-upload, never keep it as a valid object
+	if opts.ExpectedSize > 0 && size != opts.ExpectedSize {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("%w: declared %d bytes, received %d", ErrIncompleteUpload, opts.ExpectedSize, size)
 	}
 
 	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if opts.ExpectedChecksum != "" && !strings.EqualFold(opts.ExpectedChecksum, checksum) {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch,
+			FormatChecksum(algorithm, opts.ExpectedChecksum), FormatChecksum(algorithm, checksum))
+	}
+
+	var encoding string
+	var onDisk int64
+	if dataKey != nil {
+		info, err := file.Stat()
+		if err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("failed to write data: %v", err)
+		}
+		onDisk = info.Size()
+	}
+	if content != nil {
+		if tier == TierCold {
+			encoding = encodingIdentity // shared blobs stay raw
+		}
+	} else if tier == TierCold {
+		compressed, n, err := compressFile(tmp, dataKey, coldKey)
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		encoding = encodingIdentity
+		if compressed != "" {
+			os.Remove(tmp)
+			tmp, encoding, onDisk = compressed, encodingGzip, n
+			keyID, wrappedKey = coldKeyID, coldWrapped
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Anything may have changed while the body was coming in
+	previous := fs.objects[key]
+	err = fs.checkWritable()
+	if err == nil {
+		err = fs.checkBucket(bucket)
+	}
+	if err == nil {
+		err = checkPreconditions(key, previous, opts)
+	}
+	if room := fs.quotaRoom(previous, opts.Owner); err == nil && room >= 0 && size > room {
+		err = fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, size, room)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if content != nil {
+		blob, err := fs.storeBlob(tmp, fmt.Sprintf("%x", content.Sum(nil)))
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		filePath = blob
+	} else {
+		// Named after the ID the object ends up with, which depends on what it replaces
+		suffix := ""
+		if encoding == encodingGzip {
+			suffix = ".gz"
+		}
+		filePath, err = fs.placeData(tmp, bucket, tier, fs.storedObjectID(objectID, previous, opts), suffix)
+		if err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("failed to write data: %v", err)
+		}
+	}
+
+	version := int64(1)
+	owner := opts.Owner
+	if previous != nil {
+		version = previous.Version + 1
+		owner = previous.Owner
+	}
 
 	// Create storage object
 	obj := &models.StorageObject{
-		ID:          objectID,
-		Key:         key,
-		Size:        size,
-		ContentType: contentType,
-		Checksum:    checksum,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		AccessCount: 0,
-		LastAccess:  time.Now(),
-		StorageTier: "hot",
+		ID:                objectID,
+		Key:               key,
+		Bucket:            bucket,
+		Size:              size,
+		ContentType:       opts.ContentType,
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm,
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+		AccessCount:       0,
+		LastAccess:        time.Now(),
+		StorageTier:       tier,
+		Version:           version,
+		Owner:             owner,
+		Metadata:          metadata,
+		ExpiresAt:         opts.ExpiresAt,
+		ContentEncoding:   encoding,
+		StoredSize:        onDisk,
+		KeyID:             keyID,
+		WrappedKey:        wrappedKey,
+		ReplicationFactor: opts.ReplicationFactor,
+		Stamp:             opts.Stamp,
 		Replicas: []models.ReplicaInfo{
 			{
-				NodeID:   "node-1", // Current node
+				NodeID:   fs.nodeID,
 				FilePath: filePath,
-				Status:   "active",
+				Status:   replicaActive,
 			},
 		},
 	}
 
-	fs.objects[key] = obj
-	fs.saveMetadata()
+	obj.ID = fs.storedObjectID(objectID, previous, opts)
+	fs.inherit(obj, previous)
 
+	if err := fs.commitPut(obj, previous, opts.Actor); err != nil {
+		return nil, err
+	}
 	return obj, nil
 }
 
+// storedObjectID is the ID a write replacing previous stores its object under: the one it
+// asks for, previous's, see inherit, or the fresh one it was given
+func (fs *FileStore) storedObjectID(fresh string, previous *models.StorageObject, opts PutOptions) string {
+	switch {
+	case opts.ObjectID != "":
+		return opts.ObjectID
+	case previous != nil && !fs.expired(previous):
+		return previous.ID
+	}
+	return fresh
+}
+
+// inherit gives obj, about to replace previous, previous's identity: its creation time,
+// access stats and conflict history, so an overwrite is the same object with new content.
+// Its ID is kept too, see storedObjectID. An expired object is gone already, so obj
+// starts afresh.
+func (fs *FileStore) inherit(obj, previous *models.StorageObject) {
+	if previous == nil || fs.expired(previous) {
+		return
+	}
+	obj.CreatedAt = previous.CreatedAt
+	obj.AccessCount, obj.LastAccess = previous.AccessCount, previous.LastAccess
+	obj.ConflictHistory = previous.ConflictHistory
+}
+
+// commitPut makes obj, whose data file is already written, the current version of its key
+// in place of previous, whose data goes unless it is kept as a version. If that can't be
+// saved obj's data file is released and nothing changes. The caller holds the lock.
+func (fs *FileStore) commitPut(obj, previous *models.StorageObject, actor string) error {
+	key, filePath := obj.Key, obj.Replicas[0].FilePath
+
+	archived := fs.versions[key]
+	if fs.versioning {
+		obj.VersionID = fs.nextVersionID()
+		if previous != nil {
+			fs.archive(previous)
+		}
+	}
+
+	sizeDelta := obj.Size
+	if previous != nil {
+		sizeDelta -= previous.Size
+	}
+
+	fs.objects[key] = obj
+	if err := fs.saveObject(obj); err != nil {
+		// Not durable, so it never happened
+		fs.restore(key, previous, archived)
+		fs.releaseData(filePath)
+		return err
+	}
+	if fs.versioning && previous != nil {
+		if err := fs.saveVersions(); err != nil {
+			fs.restore(key, previous, archived)
+			fs.removeObjectMeta(obj)
+			fs.saveObject(previous) // obj took its record with the kv backend
+			fs.releaseData(filePath)
+			return err
+		}
+	}
+	if previous != nil {
+		// Loading keeps the newest of two files for one key, so a leftover is harmless
+		if err := fs.removeObjectMeta(previous); err != nil {
+			log.Printf("Failed to remove metadata of replaced object %s: %v", previous.ID, err)
+		}
+		if !fs.versioning {
+			for _, replica := range previous.Replicas {
+				fs.releaseData(replica.FilePath)
+			}
+		}
+	}
+	fs.uncache(key)
+	fs.tally(previous, obj)
+	fs.record(journal.OpPut, obj, actor, sizeDelta)
+	if previous == nil {
+		fs.adjustUsage(obj.Owner, 1, sizeDelta)
+	} else {
+		fs.adjustUsage(obj.Owner, 0, sizeDelta)
+	}
+	return nil
+}
+
 //retreiving th edata from the storage system
 
 func (fs *FileStore) Get(key string) (io.ReadCloser, *models.StorageObject, error) {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
+	return fs.GetWithOptions(key, GetOptions{})
+}
 
-	obj, exists := fs.objects[key]
-	if !exists {
-		return nil, nil, fmt.Errorf("object not found: %s", key)
+// GetWithOptions reads the current version of the object, or the one opts asks for
+func (fs *FileStore) GetWithOptions(key string, opts GetOptions) (io.ReadCloser, *models.StorageObject, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	obj, err := fs.lookupVersion(key, opts.VersionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.expired(obj) {
+		return nil, nil, fmt.Errorf("%w: %s has expired", ErrObjectNotFound, key)
+	}
+	if obj.Replicas[0].Status == replicaFailed {
+		return nil, nil, &CorruptionError{Key: key, Path: obj.Replicas[0].FilePath,
+			Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum)}
 	}
 
-	// Update access statistics
-	obj.AccessCount++
-	obj.LastAccess = time.Now()
-	fs.saveMetadata()
+	var start, n int64
+	if opts.Ranged {
+		if start, n, err = ResolveRange(obj.Size, opts.Offset, opts.Length); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	// Open file
-	file, err := os.Open(obj.Replicas[0].FilePath)
+	if !opts.Ranged {
+		n = obj.Size
+	}
+	if reader := fs.cached(obj, start, n); reader != nil {
+		return reader, fs.access.record(obj), nil
+	}
+
+	reader, err := fs.openObjectData(obj, start, n)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+		return nil, nil, err
+	}
+	// A whole read of a small current object fills the cache, once its data checks out
+	cache := fs.cache
+	fill := cache != nil && cache.cacheable(obj) && opts.VersionID == "" && !opts.Ranged
+	if (fs.verifyReads || fill) && !opts.Ranged {
+		var data bytes.Buffer
+		if fill {
+			reader = teeReadCloser{Reader: io.TeeReader(reader, &data), src: reader}
+		}
+		verifying, err := newVerifyingReader(reader, obj.ChecksumAlgorithm, func(checksum string, readErr error) error {
+			if err := fs.checkIntegrity(obj, checksum, readErr); err != nil {
+				return err
+			}
+			if fill {
+				cache.add(obj, data.Bytes())
+			}
+			return nil
+		})
+		if err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+		reader = verifying
+	}
+
+	return reader, fs.access.record(obj), nil
+}
+
+// Stat returns a copy of key's metadata. Reads not flushed yet aren't counted in it, and
+// the data file isn't opened, so a missing or corrupt one isn't noticed.
+func (fs *FileStore) Stat(key string) (*models.StorageObject, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	obj, exists := fs.objects[key]
+	if !exists || fs.expired(obj) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	stat := *obj
+	return &stat, nil
+}
+
+// ErrInvalidRange is returned (inside a RangeError) when a requested window doesn't
+// overlap the object
+var ErrInvalidRange = errors.New("range not satisfiable")
+
+// RangeError reports an unsatisfiable range together with the object's size
+type RangeError struct {
+	Size int64
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%v: object is %d bytes", ErrInvalidRange, e.Size)
+}
+
+func (e *RangeError) Unwrap() error { return ErrInvalidRange }
+
+// ResolveRange turns a requested window into a start and length inside an object of
+// size bytes. A negative offset counts back from the end, a negative length reads to
+// the end, and a window running past the end is cut short.
+func ResolveRange(size, offset, length int64) (int64, int64, error) {
+	if offset < 0 {
+		offset += size
+		if offset < 0 {
+			offset = 0
+		}
+		length = -1
+	}
+	if offset >= size || length == 0 {
+		return 0, 0, &RangeError{Size: size}
 	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return offset, length, nil
+}
 
-	return file, obj, nil
+// GetRange is Get limited to a window of the object, see ResolveRange for how offset and
+// length are read
+func (fs *FileStore) GetRange(key string, offset, length int64) (io.ReadCloser, *models.StorageObject, error) {
+	return fs.GetWithOptions(key, GetOptions{Ranged: true, Offset: offset, Length: length})
 }
 
 // This method deletes a file from the storage system and removes its metadata.
 
 func (fs *FileStore) Delete(key string) error {
+	return fs.DeleteWithOptions(key, DeleteOptions{})
+}
+
+// DeleteWithOptions deletes the object, only if its current version matches opts.IfVersion when set
+func (fs *FileStore) DeleteWithOptions(key string, opts DeleteOptions) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
+	if opts.VersionID != "" {
+		return fs.deleteVersion(key, opts.VersionID, opts.Actor)
+	}
+
 	obj, exists := fs.objects[key]
 	if !exists {
-		return fmt.Errorf("object not found: %s", key)
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err := checkVersion(obj, opts.IfVersion); err != nil {
+		return err
+	}
+
+	if fs.versioning {
+		return fs.addDeleteMarker(obj, opts.Actor)
+	}
+	return fs.removeObject(obj, opts.Actor)
+}
+
+// DeleteBatch deletes every one of keys under a single lock, returning the error for each
+// key that wasn't deleted; keys that don't exist get ErrObjectNotFound. A failure only
+// affects its own key. With versioning on, every delete marker goes into one write of the
+// version history.
+func (fs *FileStore) DeleteBatch(keys []string, actor string) map[string]error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	failed := make(map[string]error)
+	if err := fs.checkWritable(); err != nil {
+		for _, key := range keys {
+			failed[key] = err
+		}
+		return failed
+	}
+	var objs []*models.StorageObject
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		obj, exists := fs.objects[key]
+		if !exists {
+			failed[key] = fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+			continue
+		}
+		objs = append(objs, obj)
+	}
+
+	if !fs.versioning {
+		for _, obj := range objs {
+			if err := fs.removeObject(obj, actor); err != nil {
+				failed[obj.Key] = err
+			}
+		}
+		return failed
+	}
+
+	history := make(map[string][]*models.StorageObject, len(objs))
+	for _, obj := range objs {
+		history[obj.Key] = fs.versions[obj.Key]
+		fs.appendDeleteMarker(obj)
+	}
+	if err := fs.saveVersions(); err != nil {
+		for _, obj := range objs {
+			fs.restore(obj.Key, obj, history[obj.Key])
+			failed[obj.Key] = err
+		}
+		return failed
 	}
+	restored := false
+	for _, obj := range objs {
+		if err := fs.removeObjectMeta(obj); err != nil {
+			fs.restore(obj.Key, obj, history[obj.Key])
+			failed[obj.Key] = err
+			restored = true
+			continue
+		}
+		delete(fs.objects, obj.Key)
+		fs.tally(obj, nil)
+		fs.record(journal.OpDelete, obj, actor, -obj.Size)
+		fs.adjustUsage(obj.Owner, -1, -obj.Size)
+	}
+	if restored {
+		// Take the markers of the keys that are still there back out
+		if err := fs.saveVersions(); err != nil {
+			log.Printf("Failed to save version history: %v", err)
+		}
+	}
+	return failed
+}
+
+// removeObject permanently deletes the current version of an object, data included
+func (fs *FileStore) removeObject(obj *models.StorageObject, actor string) error {
+	if err := fs.removeObjectMeta(obj); err != nil {
+		return err
+	}
+	delete(fs.objects, obj.Key)
+	fs.uncache(obj.Key)
+	fs.tally(obj, nil)
 
 	// Remove file
 	for _, replica := range obj.Replicas {
-		os.Remove(replica.FilePath)
+		fs.releaseData(replica.FilePath)
 	}
+	fs.record(journal.OpDelete, obj, actor, -obj.Size)
+	fs.adjustUsage(obj.Owner, -1, -obj.Size)
 
-	delete(fs.objects, key)
-	fs.saveMetadata()
+	return nil
+}
 
+// Start compresses any cold objects still stored raw in the background, and starts
+// flushing access stats
+func (fs *FileStore) Start(ctx context.Context) error {
+	stop, done := make(chan struct{}), make(chan struct{})
+	fs.stopAccess, fs.accessDone = stop, done
+	go func() {
+		defer close(done)
+		fs.flushAccessLoop(stop)
+	}()
+
+	compressCtx, cancel := context.WithCancel(context.Background())
+	fs.stopCompress = cancel
+	fs.compressDone = make(chan struct{})
+	go func() {
+		defer close(fs.compressDone)
+		n, err := fs.CompressCold(compressCtx)
+		if n > 0 {
+			log.Printf("Compressed %d cold objects", n)
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Compressing cold objects stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop writes out pending access stats and closes the journal and metadata database;
+// other metadata is written as each change is made. Writes must have stopped (the HTTP server is stopped first).
+func (fs *FileStore) Stop(ctx context.Context) error {
+	if fs.stopCompress != nil {
+		fs.stopCompress()
+		select {
+		case <-fs.compressDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fs.stopAccess != nil {
+		close(fs.stopAccess)
+		select {
+		case <-fs.accessDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	} else {
+		fs.flushAccess()
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.journal != nil {
+		if err := fs.journal.Close(); err != nil {
+			return fmt.Errorf("failed to close journal: %v", err)
+		}
+		fs.journal = nil
+	}
+	if fs.kv != nil {
+		if err := fs.kv.Close(); err != nil {
+			return fmt.Errorf("failed to close metadata database: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -158,17 +809,177 @@ func (fs *FileStore) List() map[string]*models.StorageObject {
 	return result
 }
 
+// ListWithOptions returns one page of objects in key order
+func (fs *FileStore) ListWithOptions(opts ListOptions) (*ListResult, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return ListPage(fs.objects, opts)
+}
+
+// SetOwner reassigns an object to a new owner
+func (fs *FileStore) SetOwner(key, owner, actor string) (*models.StorageObject, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	obj, exists := fs.objects[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+
+	updated := *obj
+	updated.Owner = owner
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+
+	if err := fs.saveObject(&updated); err != nil {
+		return nil, err
+	}
+	fs.objects[key] = &updated
+	fs.tally(obj, &updated)
+	fs.record(journal.OpMetadata, &updated, actor, 0)
+	fs.adjustUsage(obj.Owner, -1, -obj.Size)
+	fs.adjustUsage(owner, 1, obj.Size)
+
+	return &updated, nil
+}
+
+// BackfillOwner relabels every object under prefix that has no known owner, returning the count
+func (fs *FileStore) BackfillOwner(prefix, owner, actor string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	originals := make(map[string]*models.StorageObject)
+	for key, obj := range fs.objects {
+		if obj.Owner != UnknownOwner || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		updated := *obj
+		updated.Owner = owner
+		updated.Version++
+		if err := fs.saveObject(&updated); err != nil {
+			// Put back the ones already relabeled so the whole call has no effect
+			for key, original := range originals {
+				fs.objects[key] = original
+				fs.saveObject(original)
+			}
+			return 0, err
+		}
+		originals[key] = obj
+		fs.objects[key] = &updated
+	}
+
+	for key, obj := range originals {
+		fs.tally(obj, fs.objects[key])
+		fs.record(journal.OpMetadata, fs.objects[key], actor, 0)
+		fs.adjustUsage(obj.Owner, -1, -obj.Size)
+		fs.adjustUsage(owner, 1, obj.Size)
+	}
+	return len(originals), nil
+}
+
+// OwnerUsage is the number of objects and bytes stored by one owner
+type OwnerUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// UsageByOwner returns the objects and bytes each owner holds, kept up to date alongside
+// the usage of each tier rather than counted from the catalog
+func (fs *FileStore) UsageByOwner() map[string]OwnerUsage {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return maps.Clone(fs.ownerUsage)
+}
+
+// SetDefaultChecksum sets the algorithm used when a write doesn't ask for one
+func (fs *FileStore) SetDefaultChecksum(algorithm string) error {
+	if err := ValidateChecksumAlgorithm(algorithm); err != nil {
+		return err
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.defaultChecksum = algorithm
+	return nil
+}
+
+// SetUsageObserver registers fn to be told about every change in per-owner usage
+func (fs *FileStore) SetUsageObserver(fn UsageObserver) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.onUsage = fn
+}
+
+func (fs *FileStore) adjustUsage(owner string, objects, bytes int64) {
+	fs.usedBytes += bytes
+	if fs.onUsage != nil && (objects != 0 || bytes != 0) {
+		fs.onUsage(owner, objects, bytes)
+	}
+}
+
 // This method retrieves the metadata of a specific object by its key.
 
-func (fs *FileStore) saveMetadata() {
-	data, _ := json.MarshalIndent(fs.objects, "", "  ")
-	os.WriteFile(filepath.Join(fs.metadataPath, "objects.json"), data, 0644)
+func checkVersion(obj *models.StorageObject, expectedVersion *int64) error {
+	if expectedVersion == nil {
+		return nil
+	}
+	var current int64
+	if obj != nil {
+		current = obj.Version
+	}
+	if current != *expectedVersion {
+		return fmt.Errorf("%w: expected version %d, current version is %d", ErrPreconditionFailed, *expectedVersion, current)
+	}
+	return nil
 }
 
-func (fs *FileStore) loadMetadata() {
-	data, err := os.ReadFile(filepath.Join(fs.metadataPath, "objects.json"))
-	if err != nil {
-		return
+// checkPreconditions evaluates a write's conditions against the object it would replace,
+// nil if key doesn't exist. Stores call it under the lock the write is made under.
+func checkPreconditions(key string, previous *models.StorageObject, opts PutOptions) error {
+	if err := checkVersion(previous, opts.IfVersion); err != nil {
+		return err
+	}
+	if err := checkStamp(key, previous, opts.Stamp); err != nil {
+		return err
+	}
+	return checkETags(key, previous, opts.IfMatch, opts.IfNoneMatch)
+}
+
+// checkETags applies If-Match and If-None-Match: obj must match one of ifMatch, when any
+// are given, and none of ifNoneMatch. ETags are checksums, algorithm:hex, with a bare hex
+// digest taken to use obj's algorithm; "*" matches any object that exists.
+func checkETags(key string, obj *models.StorageObject, ifMatch, ifNoneMatch []string) error {
+	if len(ifMatch) > 0 && !matchesETag(obj, ifMatch) {
+		if obj == nil {
+			return fmt.Errorf("%w: %s doesn't exist", ErrPreconditionFailed, key)
+		}
+		return fmt.Errorf("%w: %s has ETag %s", ErrPreconditionFailed, key, FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum))
+	}
+	if matchesETag(obj, ifNoneMatch) {
+		return fmt.Errorf("%w: %s already exists with ETag %s", ErrPreconditionFailed, key, FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum))
+	}
+	return nil
+}
+
+func matchesETag(obj *models.StorageObject, etags []string) bool {
+	if obj == nil {
+		return false
+	}
+	for _, etag := range etags {
+		if etag == "*" {
+			return true
+		}
+		algorithm, checksum, err := ParseChecksum(etag, obj.ChecksumAlgorithm)
+		if err == nil && algorithm == obj.ChecksumAlgorithm && strings.EqualFold(checksum, obj.Checksum) {
+			return true
+		}
 	}
-	json.Unmarshal(data, &fs.objects)
+	return false
 }
@@ -0,0 +1,286 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+// openFileStore opens a FileStore in a directory of its own, stopped when the test ends
+func openFileStore(t *testing.T, metadataBackend string) *storage.FileStore {
+	t.Helper()
+	return openFileStoreIn(t, t.TempDir(), metadataBackend)
+}
+
+func openFileStoreIn(t *testing.T, dir, metadataBackend string) *storage.FileStore {
+	t.Helper()
+	fs, err := storage.OpenFileStore(dir, metadataBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Stop(context.Background()) })
+	return fs
+}
+
+// reopenFileStore stops fs and opens the JSON store in dir again, as after a restart
+func reopenFileStore(t *testing.T, fs *storage.FileStore, dir string) *storage.FileStore {
+	t.Helper()
+	if err := fs.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return openFileStoreIn(t, dir, storage.MetadataJSON)
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	for _, backend := range []string{storage.MetadataJSON, storage.MetadataKV} {
+		t.Run(backend, func(t *testing.T) {
+			storagetest.TestStore(t, func(t *testing.T) storage.Store {
+				return openFileStore(t, backend)
+			})
+		})
+	}
+}
+
+// killedWriter passes on the first n bytes, then fails as if the process died mid-write
+type killedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (k *killedWriter) Write(p []byte) (int, error) {
+	if len(p) > k.n {
+		written, _ := k.w.Write(p[:k.n])
+		k.n -= written
+		return written, errors.New("killed")
+	}
+	k.n -= len(p)
+	return k.w.Write(p)
+}
+
+func TestFileStoreKilledMetadataWrite(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	put := storagetest.Put(t, fs, "report", "first draft", storage.PutOptions{})
+
+	restore := storage.SetAtomicWriter(func(w io.Writer) io.Writer { return &killedWriter{w: w, n: 20} })
+	if _, err := fs.Put("report", strings.NewReader("second draft"), "text/plain"); err == nil {
+		t.Error("overwrite succeeded although its metadata write was killed")
+	}
+	if _, err := fs.Put("fresh", strings.NewReader("never committed"), "text/plain"); err == nil {
+		t.Error("Put succeeded although its metadata write was killed")
+	}
+	restore()
+	if data, _ := storagetest.Read(t, fs, "report", storage.GetOptions{}); data != "first draft" {
+		t.Errorf("before restarting, report = %q, want the first draft", data)
+	}
+
+	fs = reopenFileStore(t, fs, dir)
+	if data, obj := storagetest.Read(t, fs, "report", storage.GetOptions{}); data != "first draft" || obj.Checksum != put.Checksum {
+		t.Errorf("after the killed overwrite, report = %q with checksum %s; want the first draft, %s", data, obj.Checksum, put.Checksum)
+	}
+	if _, err := fs.Stat("fresh"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Stat of the killed Put = %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestFileStoreIgnoresPartialMetadataFiles(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	storagetest.Put(t, fs, "report", "first draft", storage.PutOptions{})
+
+	// What a process killed before the rename leaves behind: a truncated temporary file
+	partial := filepath.Join(dir, "metadata", "0123.json.tmp-42")
+	if err := os.WriteFile(partial, []byte(`{"key": "report", "id": "0123", "si`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reopenFileStore(t, fs, dir)
+	if data, _ := storagetest.Read(t, fs, "report", storage.GetOptions{}); data != "first draft" {
+		t.Errorf("report = %q, want the first draft", data)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("the partial write is still there: %v", err)
+	}
+}
+
+func TestFileStoreFallsBackToCatalogBackup(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	if err := os.MkdirAll(metadataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A legacy catalog cut off mid-write, with the previous one kept as a backup
+	if err := os.WriteFile(filepath.Join(metadataDir, "objects.json"), []byte(`{"report": {"id": "0123", "ke`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup := `{"report": {"id": "0123", "key": "report", "size": 11, "storage_tier": "hot"}}`
+	if err := os.WriteFile(filepath.Join(metadataDir, "objects.json.bak"), []byte(backup), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	obj, err := fs.Stat("report")
+	if err != nil {
+		t.Fatalf("Stat after falling back to the backup: %v", err)
+	}
+	if obj.ID != "0123" || obj.Size != 11 {
+		t.Errorf("report = ID %s, size %d; want the backup's 0123, 11", obj.ID, obj.Size)
+	}
+}
+
+// dataUsage returns the number of files and bytes under dir/data, and the number of
+// metadata files
+func dataUsage(t *testing.T, dir string) (files int, bytes int64, metadataFiles int) {
+	t.Helper()
+	err := filepath.WalkDir(filepath.Join(dir, "data"), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			metadataFiles++
+		}
+	}
+	return files, bytes, metadataFiles
+}
+
+func TestFileStoreOverwriteReleasesDisk(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	first := storagetest.Put(t, fs, "report", "draft 0", storage.PutOptions{Owner: "alice"})
+
+	var last string
+	for i := 1; i <= 20; i++ {
+		last = strings.Repeat(fmt.Sprintf("draft %d ", i), i%4+1)
+		obj := storagetest.Put(t, fs, "report", last, storage.PutOptions{Owner: "alice"})
+		if obj.ID != first.ID || !obj.CreatedAt.Equal(first.CreatedAt) {
+			t.Fatalf("overwrite %d has ID %s, created %s; want %s, %s", i, obj.ID, obj.CreatedAt, first.ID, first.CreatedAt)
+		}
+	}
+
+	files, bytes, metadataFiles := dataUsage(t, dir)
+	if files != 1 || bytes != int64(len(last)) || metadataFiles != 1 {
+		t.Errorf("after 20 overwrites: %d data files of %d bytes and %d metadata files; want 1 of %d and 1",
+			files, bytes, metadataFiles, len(last))
+	}
+	if usage := fs.Usage()[storage.TierHot]; usage.Objects != 1 || usage.Bytes != int64(len(last)) {
+		t.Errorf("hot tier usage = %+v, want 1 object of %d bytes", usage, len(last))
+	}
+	if usage := fs.UsageByOwner()["alice"]; usage.Objects != 1 || usage.Bytes != int64(len(last)) {
+		t.Errorf("alice's usage = %+v, want 1 object of %d bytes", usage, len(last))
+	}
+
+	if err := fs.Delete("report"); err != nil {
+		t.Fatal(err)
+	}
+	if files, bytes, metadataFiles := dataUsage(t, dir); files != 0 || bytes != 0 || metadataFiles != 0 {
+		t.Errorf("after deleting: %d data files of %d bytes and %d metadata files, want none", files, bytes, metadataFiles)
+	}
+}
+
+// stalledReader returns its first chunk, then blocks until release is closed and ends
+// with err
+type stalledReader struct {
+	chunk   []byte
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func newStalledReader(chunk string, err error) *stalledReader {
+	return &stalledReader{chunk: []byte(chunk), started: make(chan struct{}), release: make(chan struct{}), err: err}
+}
+
+func (s *stalledReader) Read(p []byte) (int, error) {
+	if s.chunk != nil {
+		n := copy(p, s.chunk)
+		s.chunk = nil
+		close(s.started)
+		return n, nil
+	}
+	<-s.release
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, io.EOF
+}
+
+func TestFileStoreSlowPutDoesNotBlockReads(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	storagetest.Put(t, fs, "other", "already here", storage.PutOptions{})
+
+	for _, failed := range []bool{false, true} {
+		key, uploadErr := "upload", error(nil)
+		if failed {
+			key, uploadErr = "failed-upload", errors.New("client went away")
+		}
+		slow := newStalledReader("the start of a long upload", uploadErr)
+		putDone := make(chan error, 1)
+		go func() {
+			_, err := fs.Put(key, slow, "text/plain")
+			putDone <- err
+		}()
+		<-slow.started
+
+		// With the upload stuck mid-body, the rest of the store carries on
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if data, _ := storagetest.Read(t, fs, "other", storage.GetOptions{}); data != "already here" {
+				t.Errorf("Get during the upload = %q, want the object", data)
+			}
+			if _, err := fs.Stat("other"); err != nil {
+				t.Errorf("Stat during the upload: %v", err)
+			}
+			storagetest.Put(t, fs, "another", "written meanwhile", storage.PutOptions{})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("reads and writes waited for the stalled upload")
+		}
+
+		close(slow.release)
+		err := <-putDone
+		if failed {
+			if err == nil {
+				t.Fatal("Put succeeded although its body failed")
+			}
+			if _, err := fs.Stat(key); !errors.Is(err, storage.ErrObjectNotFound) {
+				t.Errorf("Stat after the failed upload = %v, want ErrObjectNotFound", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	// The failed upload left nothing behind: the data of "other", "another" and "upload"
+	if files, _, _ := dataUsage(t, dir); files != 3 {
+		t.Errorf("%d data files, want 3", files)
+	}
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+)
+
+const (
+	quarantineDir = "quarantine"
+
+	// How many trailing journal records fsck compares against the catalog
+	fsckJournalTail = 1000
+)
+
+// FsckOptions selects how thorough the check is and whether to fix what it finds
+type FsckOptions struct {
+	Deep   bool // re-hash every blob, not just compare sizes
+	Repair bool
+}
+
+// FsckProblem is one inconsistency found by Fsck
+type FsckProblem struct {
+	Kind     string `json:"kind"` // metadata_corrupt, missing_blob, size_mismatch, checksum_mismatch, orphan_blob, journal_mismatch
+	Key      string `json:"key,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+	Action   string `json:"action,omitempty"`
+}
+
+type FsckReport struct {
+	Deep           bool          `json:"deep"`
+	Repair         bool          `json:"repair"`
+	StartedAt      time.Time     `json:"started_at"`
+	Duration       string        `json:"duration"`
+	ObjectsChecked int           `json:"objects_checked"`
+	BlobsScanned   int           `json:"blobs_scanned"`
+	Problems       []FsckProblem `json:"problems"`
+	Unrepaired     int           `json:"unrepaired"`
+}
+
+// Clean reports whether no unrepaired problems remain
+func (r *FsckReport) Clean() bool {
+	return r.Unrepaired == 0
+}
+
+func (r *FsckReport) add(p FsckProblem) {
+	r.Problems = append(r.Problems, p)
+	if !p.Repaired {
+		r.Unrepaired++
+	}
+}
+
+// Fsck verifies that the metadata catalog, the data files and the journal agree, and with
+// opts.Repair applies the fixes that can't lose data: dangling entries are dropped, orphan
+// blobs and unreadable metadata files are moved to quarantine, and entries missing from
+// the catalog are restored from the journal. Corrupted blobs are reported but never touched.
+func (fs *FileStore) Fsck(opts FsckOptions) *FsckReport {
+	report := &FsckReport{
+		Deep:      opts.Deep,
+		Repair:    opts.Repair,
+		StartedAt: time.Now(),
+		Problems:  make([]FsckProblem, 0),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+	}()
+
+	fs.checkMetadataFiles(report, opts)
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	changed := false
+	referenced := make(map[string]bool)
+
+	for key, obj := range fs.objects {
+		report.ObjectsChecked++
+		if len(obj.Replicas) == 0 {
+			continue
+		}
+		path := obj.Replicas[0].FilePath
+		referenced[filepath.Clean(path)] = true
+
+		info, err := os.Stat(path)
+		if err != nil {
+			problem := FsckProblem{Kind: "missing_blob", Key: key, Path: path, Detail: err.Error()}
+			if opts.Repair {
+				delete(fs.objects, key)
+				changed = true
+				problem.Repaired, problem.Action = true, "dropped metadata entry"
+			}
+			report.add(problem)
+			continue
+		}
+
+		if info.Size() != storedSize(obj) {
+			report.add(FsckProblem{Kind: "size_mismatch", Key: key, Path: path,
+				Detail: fmt.Sprintf("metadata says %d bytes, file has %d", storedSize(obj), info.Size())})
+			continue
+		}
+
+		if opts.Deep {
+			checksum, err := fs.dataChecksum(obj)
+			if err != nil {
+				report.add(FsckProblem{Kind: "checksum_mismatch", Key: key, Path: path, Detail: err.Error()})
+			} else if checksum != obj.Checksum {
+				report.add(FsckProblem{Kind: "checksum_mismatch", Key: key, Path: path,
+					Detail: fmt.Sprintf("expected %s, got %s", obj.Checksum, checksum)})
+			}
+		}
+	}
+
+	if fs.checkJournalTail(report, opts) {
+		changed = true
+	}
+	for path := range fs.referencedFiles() {
+		referenced[path] = true
+	}
+
+	fs.checkOrphans(report, opts, referenced)
+
+	if changed {
+		fs.countBlobRefs()
+		fs.countUsedBytes()
+		if err := fs.saveAll(); err != nil {
+			report.add(FsckProblem{Kind: "metadata_corrupt", Detail: "failed to save repairs: " + err.Error()})
+		}
+	}
+
+	return report
+}
+
+// checkMetadataFiles makes sure every per-object metadata file parses. Loading skipped the
+// bad ones; repair quarantines them, and the journal check below restores what it can.
+func (fs *FileStore) checkMetadataFiles(report *FsckReport, opts FsckOptions) {
+	fs.mutex.RLock()
+	dirs := fs.metadataDirs()
+	fs.mutex.RUnlock()
+
+	for _, dir := range dirs {
+		fs.checkMetadataDir(dir, report, opts)
+	}
+}
+
+func (fs *FileStore) checkMetadataDir(dir string, report *FsckReport, opts FsckOptions) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isObjectMetaFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if _, err := readObjectMeta(path); err == nil {
+			continue
+		}
+
+		problem := FsckProblem{Kind: "metadata_corrupt", Path: path, Detail: "unreadable metadata file"}
+		if opts.Repair {
+			if dest, err := fs.quarantine(path); err != nil {
+				problem.Detail += "; quarantine failed: " + err.Error()
+			} else {
+				problem.Repaired, problem.Action = true, "moved to "+dest
+			}
+		}
+		report.add(problem)
+	}
+}
+
+// checkJournalTail compares the latest journal record for each recently touched key against
+// the catalog. A catalog that is ahead of the journal is normal after a crash between the
+// two writes; a catalog that is behind or disagrees is a problem. Returns true if it changed
+// the catalog.
+func (fs *FileStore) checkJournalTail(report *FsckReport, opts FsckOptions) bool {
+	if fs.journal == nil {
+		return false
+	}
+
+	last := fs.journal.LastSeq()
+	since := uint64(0)
+	if last > fsckJournalTail {
+		since = last - fsckJournalTail
+	}
+	records, err := fs.journal.ReadSince(since, 0)
+	if err != nil {
+		report.add(FsckProblem{Kind: "journal_mismatch", Detail: "failed to read journal: " + err.Error()})
+		return false
+	}
+
+	latest := make(map[string]journal.Record)
+	for _, rec := range records {
+		latest[rec.Key] = rec
+	}
+
+	changed := false
+	for key, rec := range latest {
+		obj, exists := fs.objects[key]
+
+		switch {
+		case rec.Op == journal.OpDelete && exists && obj.ID == rec.ObjectID:
+			problem := FsckProblem{Kind: "journal_mismatch", Key: key, Detail: fmt.Sprintf("journal seq %d deleted the object but it is still in the catalog", rec.Seq)}
+			if opts.Repair {
+				delete(fs.objects, key)
+				changed = true
+				problem.Repaired, problem.Action = true, "dropped metadata entry"
+			}
+			report.add(problem)
+
+		case rec.Op != journal.OpDelete && rec.Object != nil && (!exists || obj.Version < rec.Object.Version):
+			// Without its data the journal entry can't be restored, and the missing blob
+			// has already been reported against the catalog entry
+			if len(rec.Object.Replicas) == 0 {
+				continue
+			}
+			restored := fs.relocated(rec.Object)
+			if restored == nil {
+				continue
+			}
+
+			problem := FsckProblem{Kind: "journal_mismatch", Key: key, Detail: fmt.Sprintf("catalog is behind journal seq %d", rec.Seq)}
+			if opts.Repair {
+				fs.objects[key] = restored
+				changed = true
+				problem.Repaired, problem.Action = true, "restored entry from journal"
+			}
+			report.add(problem)
+		}
+	}
+	return changed
+}
+
+// checkOrphans finds data files that no metadata entry points at
+func (fs *FileStore) checkOrphans(report *FsckReport, opts FsckOptions, referenced map[string]bool) {
+	for _, dir := range fs.dataDirs() {
+		fs.checkOrphansIn(dir, report, opts, referenced)
+	}
+}
+
+func (fs *FileStore) checkOrphansIn(dir string, report *FsckReport, opts FsckOptions, referenced map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || isStateFile(entry.Name()) {
+			continue
+		}
+		report.BlobsScanned++
+
+		path := filepath.Clean(filepath.Join(dir, entry.Name()))
+		if referenced[path] {
+			continue
+		}
+
+		problem := FsckProblem{Kind: "orphan_blob", Path: path, Detail: "no metadata entry references this file"}
+		if opts.Repair {
+			if dest, err := fs.quarantine(path); err != nil {
+				problem.Detail += "; quarantine failed: " + err.Error()
+			} else {
+				problem.Repaired, problem.Action = true, "moved to "+dest
+			}
+		}
+		report.add(problem)
+	}
+}
+
+func (fs *FileStore) quarantine(path string) (string, error) {
+	dir := filepath.Join(fs.basePath, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	log.Printf("Quarantined orphan blob %s", path)
+	return dest, nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// GCOptions controls a garbage collection run
+type GCOptions struct {
+	// Grace is how old an unreferenced file must be before it is removed. Writes create
+	// their data file before the metadata that points at it, so young files may still be
+	// about to be referenced.
+	Grace  time.Duration
+	DryRun bool // report what would be removed without removing it
+}
+
+// DanglingObject is a metadata entry whose data file is missing
+type DanglingObject struct {
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"` // set for a kept version
+	Path      string `json:"path"`
+}
+
+type GCReport struct {
+	DryRun         bool             `json:"dry_run"`
+	StartedAt      time.Time        `json:"started_at"`
+	Duration       string           `json:"duration"`
+	FilesScanned   int              `json:"files_scanned"`
+	FilesRemoved   int              `json:"files_removed"`
+	BytesReclaimed int64            `json:"bytes_reclaimed"`
+	Dangling       []DanglingObject `json:"dangling_metadata"`
+	Errors         []string         `json:"errors,omitempty"`
+}
+
+// Collector is implemented by stores that can clean up data files nothing refers to
+type Collector interface {
+	GC(opts GCOptions) *GCReport
+}
+
+// GC removes data files that no object or kept version refers to and that are older than
+// opts.Grace, and reports metadata entries whose data file is missing. Those are only
+// flagged: fsck with repair is what drops them.
+func (fs *FileStore) GC(opts GCOptions) *GCReport {
+	report := &GCReport{DryRun: opts.DryRun, StartedAt: time.Now(), Dangling: []DanglingObject{}}
+	cutoff := report.StartedAt.Add(-opts.Grace)
+
+	// Walking the tree can take a while, so it happens without the lock; whatever is
+	// written meanwhile is younger than the cutoff
+	fs.mutex.RLock()
+	dirs := fs.dataDirs()
+	fs.mutex.RUnlock()
+
+	var candidates []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || isStateFile(entry.Name()) {
+				continue
+			}
+			report.FilesScanned++
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			candidates = append(candidates, filepath.Clean(filepath.Join(dir, entry.Name())))
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	referenced := fs.referencedFiles()
+	for _, path := range candidates {
+		if referenced[path] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			log.Printf("GC removed unreferenced data file %s (%d bytes)", path, info.Size())
+		}
+		report.FilesRemoved++
+		report.BytesReclaimed += info.Size()
+	}
+
+	fs.eachObject(func(obj *models.StorageObject) {
+		if len(obj.Replicas) == 0 {
+			return
+		}
+		path := obj.Replicas[0].FilePath
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			dangling := DanglingObject{Key: obj.Key, Path: path}
+			if fs.objects[obj.Key] != obj {
+				dangling.VersionID = obj.VersionID
+			}
+			report.Dangling = append(report.Dangling, dangling)
+		}
+	})
+
+	report.Duration = time.Since(report.StartedAt).String()
+	return report
+}
+
+// GarbageCollector runs GC on a schedule
+type GarbageCollector struct {
+	store Store
+
+	mutex    sync.Mutex
+	grace    time.Duration
+	running  sync.Mutex // one run at a time, scheduled or not
+	ticker   *time.Ticker
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewGarbageCollector(store Store, interval, grace time.Duration) *GarbageCollector {
+	return &GarbageCollector{store: store, interval: interval, grace: grace}
+}
+
+// Collect runs GC now. It returns nil if the store can't collect garbage.
+func (g *GarbageCollector) Collect(dryRun bool) *GCReport {
+	collector, ok := g.store.(Collector)
+	if !ok {
+		return nil
+	}
+	g.mutex.Lock()
+	grace := g.grace
+	g.mutex.Unlock()
+
+	g.running.Lock()
+	defer g.running.Unlock()
+	return collector.GC(GCOptions{Grace: grace, DryRun: dryRun})
+}
+
+func (g *GarbageCollector) Start(ctx context.Context) error {
+	g.mutex.Lock()
+	g.ticker = time.NewTicker(g.interval)
+	g.mutex.Unlock()
+	gcCtx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.done = make(chan struct{})
+
+	go func() {
+		defer close(g.done)
+		for {
+			select {
+			case <-gcCtx.Done():
+				return
+			case <-g.ticker.C:
+				report := g.Collect(false)
+				if report != nil && (report.FilesRemoved > 0 || len(report.Dangling) > 0) {
+					log.Printf("GC removed %d files (%d bytes), found %d objects with missing data",
+						report.FilesRemoved, report.BytesReclaimed, len(report.Dangling))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// SetInterval changes how often GC runs
+func (g *GarbageCollector) SetInterval(interval time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.interval = interval
+	if g.ticker != nil {
+		g.ticker.Reset(interval)
+	}
+}
+
+// SetGrace changes how old an unreferenced file must be before GC removes it
+func (g *GarbageCollector) SetGrace(grace time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.grace = grace
+}
+
+func (g *GarbageCollector) Stop(ctx context.Context) error {
+	if g.cancel == nil {
+		return nil
+	}
+	g.ticker.Stop()
+	g.cancel()
+
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrCorrupt is returned (inside a CorruptionError) when stored data no longer matches its
+// checksum
+var ErrCorrupt = errors.New("data is corrupt")
+
+// Replica statuses, see ReplicaInfo.Status
+const (
+	replicaActive = "active"
+	replicaFailed = "failed"
+)
+
+// CorruptionError reports an object whose data doesn't hash to its checksum any more
+type CorruptionError struct {
+	Key      string
+	Path     string
+	Expected string // algorithm:hex
+	Actual   string // algorithm:hex, empty if the data couldn't be read back or wasn't rehashed
+	Err      error  // why the data couldn't be read back, if it couldn't
+}
+
+func (e *CorruptionError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("%v: %s can't be read back: %v", ErrCorrupt, e.Key, e.Err)
+	case e.Actual != "":
+		return fmt.Sprintf("%v: %s hashes to %s, expected %s", ErrCorrupt, e.Key, e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("%v: %s failed verification", ErrCorrupt, e.Key)
+}
+
+func (e *CorruptionError) Unwrap() error { return ErrCorrupt }
+
+// SetVerifyReads turns hashing of whole-object reads on or off. A read whose data doesn't
+// match fails at the end instead of returning its last byte, see verifyingReader.
+func (fs *FileStore) SetVerifyReads(enabled bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.verifyReads = enabled
+}
+
+// Corruptions is how many corrupt replicas have been found since the store was opened
+func (fs *FileStore) Corruptions() int64 {
+	return atomic.LoadInt64(&fs.corruptions)
+}
+
+// Verify rehashes key's data and compares it with the checksum recorded at write time,
+// returning a *CorruptionError if they differ. The replica is marked failed when they do,
+// and reads of it are refused; it is marked active again if it later verifies.
+func (fs *FileStore) Verify(key string) error {
+	fs.mutex.RLock()
+	obj, exists := fs.objects[key]
+	var dataKey []byte
+	var err error
+	if exists {
+		dataKey, err = fs.unwrapKey(obj)
+	}
+	fs.mutex.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	reader, err := openStored(obj.Replicas[0].FilePath, obj.ContentEncoding == encodingGzip, dataKey, 0, obj.Size)
+	if err != nil {
+		return err
+	}
+	checksum, err := Checksum(obj.ChecksumAlgorithm, reader)
+	reader.Close()
+	if err := fs.checkIntegrity(obj, checksum, err); err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.setReplicaStatus(obj, replicaActive)
+	return nil
+}
+
+// checkIntegrity compares the checksum obj's data was found to have, or the error reading
+// it failed with, against what was recorded. A mismatch is counted and logged and the
+// replica marked failed; Corruptions counts each replica once, when it turns bad.
+func (fs *FileStore) checkIntegrity(obj *models.StorageObject, checksum string, readErr error) error {
+	if readErr == nil && strings.EqualFold(checksum, obj.Checksum) {
+		return nil
+	}
+	corrupt := &CorruptionError{
+		Key:      obj.Key,
+		Path:     obj.Replicas[0].FilePath,
+		Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum),
+		Err:      readErr,
+	}
+	if readErr == nil {
+		corrupt.Actual = FormatChecksum(obj.ChecksumAlgorithm, checksum)
+	}
+	if obj.Replicas[0].Status != replicaFailed {
+		// Already counted when it was marked
+		atomic.AddInt64(&fs.corruptions, 1)
+		log.Printf("Corruption detected in %s: %v", corrupt.Path, corrupt)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.setReplicaStatus(obj, replicaFailed)
+	return corrupt
+}
+
+// setReplicaStatus records the health of obj's local replica, unless obj has been
+// replaced since it was read. The caller holds the lock.
+func (fs *FileStore) setReplicaStatus(obj *models.StorageObject, status string) {
+	if fs.objects[obj.Key] != obj || obj.Replicas[0].Status == status {
+		return
+	}
+	updated := *obj
+	updated.Replicas = append([]models.ReplicaInfo(nil), obj.Replicas...)
+	updated.Replicas[0].Status = status
+	if err := fs.saveObject(&updated); err != nil {
+		log.Printf("Failed to mark %s %s: %v", obj.Key, status, err)
+		return
+	}
+	fs.objects[obj.Key] = &updated
+}
+
+// verifyingReader hashes data as it is read and checks it once the end is reached. The
+// last byte is held back until then, so a reader of corrupt data never sees a complete
+// object, only an error.
+type verifyingReader struct {
+	src     io.ReadCloser
+	hasher  hash.Hash
+	check   func(checksum string, readErr error) error
+	scratch []byte
+	pending []byte // read from src and hashed, not returned yet
+	done    bool   // src is finished and checked out fine
+	err     error
+}
+
+func newVerifyingReader(src io.ReadCloser, algorithm string, check func(string, error) error) (*verifyingReader, error) {
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{src: src, hasher: hasher, check: check, scratch: make([]byte, 32*1024)}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	for len(v.pending) <= 1 && !v.done {
+		if v.err != nil {
+			return 0, v.err
+		}
+		n, err := v.src.Read(v.scratch)
+		v.hasher.Write(v.scratch[:n])
+		v.pending = append(v.pending, v.scratch[:n]...)
+		switch {
+		case err == io.EOF:
+			err = v.check(fmt.Sprintf("%x", v.hasher.Sum(nil)), nil)
+			v.done = err == nil
+		case err != nil:
+			err = v.check("", err)
+		}
+		if err != nil {
+			v.err, v.pending = err, nil
+			return 0, err
+		}
+	}
+
+	release := len(v.pending)
+	if !v.done {
+		release--
+	}
+	if release == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, v.pending[:release])
+	v.pending = v.pending[n:]
+	return n, nil
+}
+
+func (v *verifyingReader) Close() error { return v.src.Close() }
+
+// Verifier is implemented by stores that can check stored data against its checksum
+type Verifier interface {
+	Verify(key string) error
+	Corruptions() int64
+}
+
+// Scrubber verifies every object in the background, so corruption is found before anyone
+// reads it
+type Scrubber struct {
+	store Store
+
+	tickerMutex sync.Mutex
+	ticker      *time.Ticker
+	interval    time.Duration
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func NewScrubber(store Store, interval time.Duration) *Scrubber {
+	return &Scrubber{store: store, interval: interval}
+}
+
+// Scrub verifies every current object, returning how many were checked and how many were
+// corrupt. Stores that can't verify are left alone.
+func (s *Scrubber) Scrub(ctx context.Context) (checked, corrupt int) {
+	verifier, ok := s.store.(Verifier)
+	if !ok {
+		return 0, 0
+	}
+	for key := range s.store.List() {
+		if ctx.Err() != nil {
+			break
+		}
+		err := verifier.Verify(key)
+		if errors.Is(err, ErrObjectNotFound) || errors.Is(err, ErrKeyUnavailable) {
+			// Gone since it was listed, or encrypted with a key this node doesn't have
+			continue
+		}
+		checked++
+		if errors.Is(err, ErrCorrupt) {
+			corrupt++
+		} else if err != nil {
+			log.Printf("Failed to verify %s: %v", key, err)
+		}
+	}
+	return checked, corrupt
+}
+
+func (s *Scrubber) Start(ctx context.Context) error {
+	s.tickerMutex.Lock()
+	s.ticker = time.NewTicker(s.interval)
+	s.tickerMutex.Unlock()
+	scrubCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case <-scrubCtx.Done():
+				return
+			case <-s.ticker.C:
+				checked, corrupt := s.Scrub(scrubCtx)
+				if corrupt > 0 {
+					log.Printf("Scrub found %d corrupt objects out of %d", corrupt, checked)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// SetInterval changes how often every object is verified
+func (s *Scrubber) SetInterval(interval time.Duration) {
+	s.tickerMutex.Lock()
+	defer s.tickerMutex.Unlock()
+
+	s.interval = interval
+	if s.ticker != nil {
+		s.ticker.Reset(interval)
+	}
+}
+
+func (s *Scrubber) Stop(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.ticker.Stop()
+	s.cancel()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// record appends a committed mutation to the journal. Callers hold fs.mutex so records
+// land in the same order the mutations were applied.
+func (fs *FileStore) record(op string, obj *models.StorageObject, actor string, sizeDelta int64) {
+	if fs.journal == nil {
+		return
+	}
+
+	rec := journal.Record{
+		Op:        op,
+		Key:       obj.Key,
+		ObjectID:  obj.ID,
+		Checksum:  obj.Checksum,
+		Actor:     actor,
+		SizeDelta: sizeDelta,
+	}
+	if op != journal.OpDelete {
+		snapshot := *obj
+		rec.Object = &snapshot
+	}
+
+	if _, err := fs.journal.Append(rec); err != nil {
+		log.Printf("Failed to journal %s of %s: %v", op, obj.Key, err)
+	}
+}
+
+// Journal returns the store's mutation journal, or nil if it is disabled
+func (fs *FileStore) Journal() *journal.Journal {
+	return fs.journal
+}
+
+// RebuildFromJournal replaces the metadata catalog with one replayed from the journal,
+// keeping only entries whose data file still exists. It returns the number of objects
+// restored and the number dropped for missing data.
+func (fs *FileStore) RebuildFromJournal() (int, int, error) {
+	objects, _, err := journal.Replay(filepath.Join(fs.basePath, "journal"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to replay journal: %v", err)
+	}
+
+	dropped := 0
+	for key, obj := range objects {
+		if len(obj.Replicas) == 0 {
+			delete(objects, key)
+			dropped++
+			continue
+		}
+		// Entries from before sharding point at the flat layout
+		if found := fs.relocated(obj); found != nil {
+			objects[key] = found
+			continue
+		}
+		log.Printf("Journal entry %s has no data file, dropping", key)
+		delete(objects, key)
+		dropped++
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.objects = objects
+	fs.countBlobRefs()
+	fs.countUsedBytes()
+	if err := fs.saveAll(); err != nil {
+		return 0, 0, err
+	}
+
+	return len(objects), dropped, nil
+}
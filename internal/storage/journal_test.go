@@ -0,0 +1,116 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// catalogJSON renders a catalog for comparison; times survive the journal only as far as
+// JSON keeps them
+func catalogJSON(t *testing.T, objects map[string]*models.StorageObject) string {
+	t.Helper()
+	data, err := json.Marshal(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRebuildFromJournal(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	// Owned: objects without an owner are labelled unknown only when loaded, which would
+	// tell a restart apart from the rebuild
+	owned := storage.PutOptions{Owner: "sam", Actor: "sam"}
+	storagetest.Put(t, fs, "report", "first draft", owned)
+	storagetest.Put(t, fs, "report", "second draft", owned)
+	storagetest.Put(t, fs, "notes", "meeting notes", storage.PutOptions{Owner: "sam", Metadata: map[string]string{"author": "sam"}})
+	storagetest.Put(t, fs, "archive", "old logs", owned)
+	storagetest.Put(t, fs, "scratch", "thrown away", owned)
+	if _, err := fs.SetOwner("notes", "team-a", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SetTier("archive", "cold", "tierer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete("scratch"); err != nil {
+		t.Fatal(err)
+	}
+
+	// One record per mutation, each saying what it was
+	records, err := fs.Journal().ReadSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, rec := range records {
+		if rec.FormatVersion != journal.FormatVersion {
+			t.Errorf("record %d has format version %d", rec.Seq, rec.FormatVersion)
+		}
+		ops = append(ops, rec.Op)
+	}
+	want := []string{journal.OpPut, journal.OpPut, journal.OpPut, journal.OpPut, journal.OpPut, journal.OpMetadata, journal.OpTier, journal.OpDelete}
+	if len(ops) != len(want) {
+		t.Fatalf("journal holds %v, want %v", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("journal holds %v, want %v", ops, want)
+		}
+	}
+	before := catalogJSON(t, fs.List())
+
+	// Lose every metadata file
+	if err := fs.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "metadata")); err != nil {
+		t.Fatal(err)
+	}
+	fs = openFileStoreIn(t, dir, storage.MetadataJSON)
+	if n := len(fs.List()); n != 0 {
+		t.Fatalf("%d objects listed with the metadata gone", n)
+	}
+
+	restored, dropped, err := fs.RebuildFromJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 3 || dropped != 0 {
+		t.Errorf("restored %d and dropped %d, want 3 and none", restored, dropped)
+	}
+	if after := catalogJSON(t, fs.List()); after != before {
+		t.Errorf("rebuilt catalog\n\t%s\nwant\n\t%s", after, before)
+	}
+	// And it is written out, so it survives a restart
+	fs = reopenFileStore(t, fs, dir)
+	if after := catalogJSON(t, fs.List()); after != before {
+		t.Errorf("catalog after a restart\n\t%s\nwant\n\t%s", after, before)
+	}
+	if data, _ := storagetest.Read(t, fs, "archive", storage.GetOptions{}); data != "old logs" {
+		t.Errorf("archive = %q after the rebuild", data)
+	}
+
+	// Entries whose data is gone too are dropped rather than restored
+	obj, err := fs.Stat("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(obj.Replicas[0].FilePath); err != nil {
+		t.Fatal(err)
+	}
+	if restored, dropped, err := fs.RebuildFromJournal(); err != nil || restored != 2 || dropped != 1 {
+		t.Errorf("restored %d and dropped %d (%v), want 2 and report", restored, dropped, err)
+	}
+	if _, err := fs.Stat("report"); err == nil {
+		t.Error("report restored without its data")
+	}
+}
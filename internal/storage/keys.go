@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxKeyLength caps an object key, in bytes
+const MaxKeyLength = 1024
+
+var (
+	ErrInvalidKey      = errors.New("invalid object key")
+	ErrInvalidObjectID = errors.New("invalid object ID")
+)
+
+// ValidateKey accepts keys of up to MaxKeyLength bytes of printable UTF-8. Slashes, spaces
+// and percent signs are fine, but a key can't start with a slash or contain "..", so none
+// can be taken for a path outside where it belongs.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	case len(key) > MaxKeyLength:
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrInvalidKey, len(key), MaxKeyLength)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: key is not valid UTF-8", ErrInvalidKey)
+	case strings.HasPrefix(key, "/"):
+		return fmt.Errorf("%w: key can't start with a slash", ErrInvalidKey)
+	case strings.Contains(key, ".."):
+		return fmt.Errorf("%w: key can't contain \"..\"", ErrInvalidKey)
+	}
+	if i := strings.IndexFunc(key, unicode.IsControl); i >= 0 {
+		return fmt.Errorf("%w: control character at byte %d", ErrInvalidKey, i)
+	}
+	return nil
+}
+
+// checkObjectID accepts the ID a write asks for, see PutOptions.ObjectID. IDs name
+// metadata files, so only the 32 lowercase hex digits every store hands out will do.
+func checkObjectID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return fmt.Errorf("%w: %q", ErrInvalidObjectID, id)
+	}
+	return nil
+}
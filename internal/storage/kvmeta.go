@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/9ifrashaikh/distributed-system/internal/kv"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Metadata backends for FileStore. With MetadataKV the catalog lives in one embedded
+// database, metadata.db, instead of a JSON file per object: object records by key, an
+// index of keys by object ID, and the version history by key. Each change is written in a
+// single transaction, so a crash can't leave an object's record and its index entry out
+// of step.
+const (
+	MetadataJSON = "json"
+	MetadataKV   = "kv"
+
+	metadataDB = "metadata.db"
+
+	kvObjects  = "objects"
+	kvIDs      = "ids"
+	kvVersions = "versions"
+)
+
+// ErrWrongMetadataBackend is returned when a store is opened with a different metadata
+// backend than the one holding its catalog. Opening it anyway would show an empty or
+// stale catalog, and GC would then remove the data files it doesn't know about.
+var ErrWrongMetadataBackend = errors.New("catalog is kept by another metadata backend")
+
+// OpenFileStore opens the store at basePath with its metadata in the given backend
+func OpenFileStore(basePath, metadataBackend string) (*FileStore, error) {
+	fs := newFileStore(basePath)
+	dbPath := filepath.Join(basePath, metadataDB)
+	_, err := os.Stat(dbPath)
+	dbExists := err == nil
+
+	switch metadataBackend {
+	case MetadataJSON, "":
+		if dbExists {
+			return nil, fmt.Errorf("%w: %s holds the catalog, use the %s backend", ErrWrongMetadataBackend, dbPath, MetadataKV)
+		}
+	case MetadataKV:
+		if !dbExists && fs.hasJSONMetadata() {
+			return nil, fmt.Errorf("%w: the catalog is in JSON files, migrate it to %s first", ErrWrongMetadataBackend, MetadataKV)
+		}
+		db, err := kv.Open(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		fs.kv = db
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", metadataBackend)
+	}
+
+	fs.open()
+	return fs, nil
+}
+
+// hasJSONMetadata reports whether any JSON metadata is on disk
+func (fs *FileStore) hasJSONMetadata() bool {
+	fs.loadBuckets()
+	for _, dir := range fs.metadataDirs() {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MigrateMetadata imports the JSON catalog under basePath, the per-object files or a
+// legacy objects.json and the version history, into metadata.db in one transaction,
+// returning how many objects it holds. The JSON files are left where they are; the store
+// won't open with the JSON backend again.
+func MigrateMetadata(basePath string) (int, error) {
+	dbPath := filepath.Join(basePath, metadataDB)
+	if _, err := os.Stat(dbPath); err == nil {
+		return 0, fmt.Errorf("%s already exists", dbPath)
+	}
+
+	// Loading also converts objects.json to per-object files and finishes any pending
+	// layout migration
+	fs := NewFileStore(basePath)
+	defer fs.Stop(context.Background())
+
+	tmp := dbPath + ".migrating"
+	os.Remove(tmp) // from an earlier attempt
+	db, err := kv.Open(tmp)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Update(func(tx *kv.Tx) error {
+		for _, obj := range fs.objects {
+			if err := putObjectRecord(tx, obj); err != nil {
+				return err
+			}
+		}
+		return putVersionRecords(tx, fs.versions)
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dbPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to migrate metadata: %v", err)
+	}
+	return len(fs.objects), nil
+}
+
+func putObjectRecord(tx *kv.Tx, obj *models.StorageObject) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	if old := tx.Get(kvObjects, obj.Key); old != nil {
+		if id := recordID(old); id != obj.ID {
+			tx.Delete(kvIDs, id)
+		}
+	}
+	tx.Put(kvObjects, obj.Key, data)
+	return tx.Put(kvIDs, obj.ID, []byte(obj.Key))
+}
+
+// putVersionRecords makes the stored history match versions, rewriting only the keys
+// whose history changed
+func putVersionRecords(tx *kv.Tx, versions map[string][]*models.StorageObject) error {
+	var gone []string
+	tx.ForEach(kvVersions, func(key string, _ []byte) error {
+		if _, exists := versions[key]; !exists {
+			gone = append(gone, key)
+		}
+		return nil
+	})
+	for _, key := range gone {
+		tx.Delete(kvVersions, key)
+	}
+	for key, history := range versions {
+		data, err := json.Marshal(history)
+		if err != nil {
+			return fmt.Errorf("failed to encode version history: %v", err)
+		}
+		if !bytes.Equal(tx.Get(kvVersions, key), data) {
+			tx.Put(kvVersions, key, data)
+		}
+	}
+	return nil
+}
+
+// recordID is the object ID in a stored object record
+func recordID(data []byte) string {
+	var record struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(data, &record)
+	return record.ID
+}
+
+func (fs *FileStore) kvSaveObject(obj *models.StorageObject) error {
+	err := fs.kv.Update(func(tx *kv.Tx) error {
+		return putObjectRecord(tx, obj)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	return nil
+}
+
+// kvRemoveObject removes obj's record, unless its key has been given to another object
+// since
+func (fs *FileStore) kvRemoveObject(obj *models.StorageObject) error {
+	err := fs.kv.Update(func(tx *kv.Tx) error {
+		if string(tx.Get(kvIDs, obj.ID)) == obj.Key {
+			tx.Delete(kvIDs, obj.ID)
+		}
+		if record := tx.Get(kvObjects, obj.Key); record != nil && recordID(record) == obj.ID {
+			tx.Delete(kvObjects, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove metadata: %v", err)
+	}
+	return nil
+}
+
+func (fs *FileStore) kvSaveVersions() error {
+	err := fs.kv.Update(func(tx *kv.Tx) error {
+		return putVersionRecords(tx, fs.versions)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save version history: %v", err)
+	}
+	return nil
+}
+
+// kvSaveAll replaces every object record with the catalog, in one transaction
+func (fs *FileStore) kvSaveAll() error {
+	return fs.kv.Update(func(tx *kv.Tx) error {
+		var gone []string
+		tx.ForEach(kvObjects, func(key string, _ []byte) error {
+			if _, exists := fs.objects[key]; !exists {
+				gone = append(gone, key)
+			}
+			return nil
+		})
+		for _, key := range gone {
+			tx.Delete(kvObjects, key)
+		}
+		clearBucket(tx, kvIDs)
+		for _, obj := range fs.objects {
+			if err := putObjectRecord(tx, obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func clearBucket(tx *kv.Tx, bucket string) {
+	var keys []string
+	tx.ForEach(bucket, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	for _, key := range keys {
+		tx.Delete(bucket, key)
+	}
+}
+
+// kvLoad reads the catalog and version history. Unreadable records are skipped like
+// unreadable metadata files, and the ID index is rebuilt if it doesn't match the records.
+func (fs *FileStore) kvLoad() {
+	var ids map[string]string
+	fs.kv.View(func(tx *kv.Tx) error {
+		tx.ForEach(kvObjects, func(key string, data []byte) error {
+			var obj models.StorageObject
+			if err := json.Unmarshal(data, &obj); err != nil || obj.ID == "" {
+				log.Printf("Skipping unreadable metadata record %s", key)
+				return nil
+			}
+			obj.Key = key
+			fs.objects[key] = &obj
+			return nil
+		})
+		ids = make(map[string]string, tx.Len(kvIDs))
+		tx.ForEach(kvIDs, func(id string, key []byte) error {
+			ids[id] = string(key)
+			return nil
+		})
+		tx.ForEach(kvVersions, func(key string, data []byte) error {
+			var history []*models.StorageObject
+			if err := json.Unmarshal(data, &history); err != nil {
+				log.Printf("Skipping unreadable version history of %s", key)
+				return nil
+			}
+			fs.versions[key] = history
+			return nil
+		})
+		return nil
+	})
+
+	consistent := len(ids) == len(fs.objects)
+	for key, obj := range fs.objects {
+		consistent = consistent && ids[obj.ID] == key
+	}
+	if consistent {
+		return
+	}
+	log.Printf("Rebuilding the object ID index of %s", metadataDB)
+	err := fs.kv.Update(func(tx *kv.Tx) error {
+		clearBucket(tx, kvIDs)
+		for key, obj := range fs.objects {
+			tx.Put(kvIDs, obj.ID, []byte(key))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to rebuild the object ID index: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Data files are named after the ID of their object, followed by a random part since an
+// object keeps its ID over overwrites, and fan out two directory levels deep by the first
+// four hex characters of the ID, data/ab/cd/abcd1234....xyz, so no single directory ends
+// up holding every object. Blobs are fanned out the same way by their content hash under
+// blobs/.
+const (
+	dataDir    = "data"
+	blobPrefix = "sha256-"
+)
+
+// shardedPath is where the data file called name belongs under dir
+func shardedPath(dir, name string) string {
+	id := strings.TrimPrefix(name, blobPrefix)
+	if len(id) < 4 {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(dir, id[:2], id[2:4], name)
+}
+
+// dataPath is where a new data file for objectID in bucket goes. Its directory may not
+// exist yet.
+func (fs *FileStore) dataPath(bucket, objectID string) string {
+	return shardedPath(filepath.Join(fs.bucketPath(bucket), dataDir), objectID)
+}
+
+// tierDataPath is where a new data file for objectID in tier goes: under the tier's own
+// directory if it has one, see SetTierDirs, and where dataPath says otherwise. The caller
+// holds the lock.
+func (fs *FileStore) tierDataPath(bucket, tier, objectID string) string {
+	if dir := fs.tierDirs[tier]; dir != "" {
+		return shardedPath(filepath.Join(dir, dataDir), objectID)
+	}
+	return fs.dataPath(bucket, objectID)
+}
+
+// inTierDir reports whether path is under one of the tier directories. The caller holds
+// the lock.
+func (fs *FileStore) inTierDir(path string) bool {
+	path = filepath.Clean(path)
+	for _, dir := range fs.tierDirs {
+		if strings.HasPrefix(path, filepath.Join(dir, dataDir)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// placeData renames the finished data file at tmp into objectID's shard directory of tier,
+// under a name of its own starting with objectID, see createBeside, so it never takes the
+// place of the data of the version it replaces. suffix ends the name. The caller holds the
+// lock.
+func (fs *FileStore) placeData(tmp, bucket, tier, objectID, suffix string) (string, error) {
+	target := fs.tierDataPath(bucket, tier, objectID)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	file, err := createBeside(target, suffix)
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	if err := os.Rename(tmp, file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// createTemp creates a temporary file beside path, for data that is renamed there once
+// it is complete. Leftovers from a crash are unreferenced, so GC removes them.
+func createTemp(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return createBeside(path, ".tmp")
+}
+
+// shardedTwin returns where obj's data file moves to if it is still in the flat layout
+// data files were kept in before sharding, or "" if it isn't
+func (fs *FileStore) shardedTwin(obj *models.StorageObject) string {
+	if len(obj.Replicas) == 0 {
+		return ""
+	}
+	path := filepath.Clean(obj.Replicas[0].FilePath)
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	switch dir {
+	case filepath.Join(fs.basePath, blobDir):
+		return shardedPath(dir, name)
+	case filepath.Clean(fs.bucketPath(BucketOf(obj))):
+		return shardedPath(filepath.Join(dir, dataDir), name)
+	}
+	return ""
+}
+
+// relocated returns obj pointing at its data file, wherever the migration left it: obj
+// itself when the file is where it says, a copy pointing at the sharded twin when only
+// that exists, and nil when neither does. Used for metadata that may predate sharding,
+// like journal entries.
+func (fs *FileStore) relocated(obj *models.StorageObject) *models.StorageObject {
+	if len(obj.Replicas) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(obj.Replicas[0].FilePath); err == nil {
+		return obj
+	}
+	twin := fs.shardedTwin(obj)
+	if twin == "" {
+		return nil
+	}
+	if _, err := os.Stat(twin); err != nil {
+		return nil
+	}
+	updated := *obj
+	updated.Replicas = append([]models.ReplicaInfo(nil), obj.Replicas...)
+	updated.Replicas[0].FilePath = twin
+	return &updated
+}
+
+// migrateLayout moves data files still in the flat layout into their shard directories.
+// Each file is renamed before its metadata is updated, so an interrupted migration leaves
+// objects whose metadata points at a file that is already moved; the next run finds the
+// sharded twin and finishes them.
+func (fs *FileStore) migrateLayout() {
+	moved := 0
+	move := func(obj *models.StorageObject) *models.StorageObject {
+		twin := fs.shardedTwin(obj)
+		if twin == "" {
+			return nil
+		}
+		path := obj.Replicas[0].FilePath
+		if _, err := os.Stat(path); err == nil {
+			if err := os.MkdirAll(filepath.Dir(twin), 0755); err != nil {
+				log.Printf("Failed to move %s into the sharded layout: %v", path, err)
+				return nil
+			}
+			if err := os.Rename(path, twin); err != nil {
+				log.Printf("Failed to move %s into the sharded layout: %v", path, err)
+				return nil
+			}
+		}
+		// Missing data files, moved or not, are left for fsck to report
+		updated := fs.relocated(obj)
+		if updated == nil || updated == obj {
+			return nil
+		}
+		moved++
+		return updated
+	}
+
+	for key, obj := range fs.objects {
+		updated := move(obj)
+		if updated == nil {
+			continue
+		}
+		// Even if the metadata can't be saved the file has moved, so point at it
+		fs.objects[key] = updated
+		if err := fs.saveObject(updated); err != nil {
+			log.Printf("Failed to save metadata for %s after moving its data: %v", key, err)
+		}
+	}
+
+	changed := false
+	for _, versions := range fs.versions {
+		for i, obj := range versions {
+			if updated := move(obj); updated != nil {
+				versions[i] = updated
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := fs.saveVersions(); err != nil {
+			log.Printf("Failed to save version history after moving its data: %v", err)
+		}
+	}
+
+	if moved > 0 {
+		log.Printf("Moved %d data files into the sharded layout", moved)
+	}
+}
+
+// dataDirs lists every directory data files are kept in: the shard directories, those of
+// the tier directories, and the flat ones from before sharding where leftovers may still
+// be. The caller holds the lock.
+func (fs *FileStore) dataDirs() []string {
+	blobs := filepath.Join(fs.basePath, blobDir)
+	flat := []string{fs.basePath, blobs}
+	sharded := []string{filepath.Join(fs.basePath, dataDir), blobs}
+	for _, bucket := range fs.bucketNames() {
+		flat = append(flat, fs.bucketPath(bucket))
+		sharded = append(sharded, filepath.Join(fs.bucketPath(bucket), dataDir))
+	}
+	for _, dir := range fs.tierDirs {
+		sharded = append(sharded, filepath.Join(dir, dataDir))
+	}
+
+	// Tiers may share a directory, or use the store's own
+	var dirs []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if dir = filepath.Clean(dir); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range flat {
+		add(dir)
+	}
+	for _, root := range sharded {
+		for _, dir := range shardDirs(root) {
+			add(dir)
+		}
+	}
+	return dirs
+}
+
+// referencedFiles returns the data file of every current object and kept version. The
+// caller holds the lock.
+func (fs *FileStore) referencedFiles() map[string]bool {
+	referenced := make(map[string]bool, len(fs.objects))
+	fs.eachObject(func(obj *models.StorageObject) {
+		if len(obj.Replicas) > 0 {
+			referenced[filepath.Clean(obj.Replicas[0].FilePath)] = true
+		}
+	})
+	return referenced
+}
+
+// isStateFile reports whether a file found among data files is the store's own state
+// rather than object data: the node ID and the kv metadata database kept in the root
+func isStateFile(name string) bool {
+	return name == "node_id" || strings.HasPrefix(name, metadataDB)
+}
+
+// shardDirs lists the leaf directories of the sharded tree under root
+func shardDirs(root string) []string {
+	var dirs []string
+	first, _ := os.ReadDir(root)
+	for _, a := range first {
+		if !a.IsDir() {
+			continue
+		}
+		second, _ := os.ReadDir(filepath.Join(root, a.Name()))
+		for _, b := range second {
+			if b.IsDir() {
+				dirs = append(dirs, filepath.Join(root, a.Name(), b.Name()))
+			}
+		}
+	}
+	return dirs
+}
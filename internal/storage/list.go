@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrInvalidToken is returned for a continuation token no listing handed out
+var ErrInvalidToken = errors.New("invalid continuation token")
+
+// ListOptions selects one page of a listing in key order
+type ListOptions struct {
+	// Bucket, when set, lists just that bucket, by the keys within it: Prefix, the token
+	// and the page's order are then about those rather than store-wide names
+	Bucket string
+	Prefix string
+	Limit  int    // 0 means no limit
+	Token  string // NextToken from the previous page, empty for the first
+	// Filter, when set, leaves out the objects it turns down, before the page is cut. Stores
+	// call it under their lock, so it must not call back into them.
+	Filter func(*models.StorageObject) bool
+}
+
+type ListResult struct {
+	Objects     []*models.StorageObject
+	Keys        []string // of Objects, in the bucket when ListOptions.Bucket is set
+	IsTruncated bool
+	NextToken   string // set when IsTruncated
+}
+
+// ListPage returns the page of objects, keyed by store-wide name, that opts asks for.
+// Only the keys that make the page are kept in order while the rest are passed over, so a
+// page costs the same however many objects come after it. A token records the last key
+// handed out, so the next page starts in the right place even if that key has been
+// deleted in between.
+func ListPage(objects map[string]*models.StorageObject, opts ListOptions) (*ListResult, error) {
+	after := ""
+	if opts.Token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(opts.Token)
+		if err != nil || len(decoded) == 0 {
+			return nil, ErrInvalidToken
+		}
+		after = string(decoded)
+	}
+
+	// One more than the page, to tell whether anything follows it
+	page := &keyHeap{}
+	for name, obj := range objects {
+		key := name
+		if opts.Bucket != "" {
+			bucket, inBucket := SplitObjectName(name)
+			if bucket != opts.Bucket {
+				continue
+			}
+			key = inBucket
+		}
+		if !strings.HasPrefix(key, opts.Prefix) || (after != "" && key <= after) {
+			continue
+		}
+		if opts.Filter != nil && !opts.Filter(obj) {
+			continue
+		}
+		if opts.Limit > 0 && page.Len() > opts.Limit {
+			if key >= page.entries[0].key {
+				continue
+			}
+			heap.Pop(page)
+		}
+		heap.Push(page, listEntry{key: key, obj: obj})
+	}
+
+	entries := page.entries
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	result := &ListResult{}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		result.IsTruncated = true
+		result.NextToken = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].key))
+	}
+	result.Objects = make([]*models.StorageObject, 0, len(entries))
+	result.Keys = make([]string, 0, len(entries))
+	for _, entry := range entries {
+		result.Objects = append(result.Objects, entry.obj)
+		result.Keys = append(result.Keys, entry.key)
+	}
+	return result, nil
+}
+
+type listEntry struct {
+	key string
+	obj *models.StorageObject
+}
+
+// keyHeap keeps the greatest key on top, so the page being gathered drops it first
+type keyHeap struct {
+	entries []listEntry
+}
+
+func (h *keyHeap) Len() int           { return len(h.entries) }
+func (h *keyHeap) Less(i, j int) bool { return h.entries[i].key > h.entries[j].key }
+func (h *keyHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *keyHeap) Push(x any)         { h.entries = append(h.entries, x.(listEntry)) }
+func (h *keyHeap) Pop() any {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// MemStore is a Store kept entirely in memory, for tests and throwaway servers. It follows
+// FileStore's semantics (versions, access counts, checksums, ownership, errors) but has no
+// journal, version history or persistence.
+type MemStore struct {
+	mutex   sync.RWMutex
+	objects map[string]*models.StorageObject
+	data    map[string][]byte // by key
+	onUsage UsageObserver
+
+	defaultChecksum string
+	readOnly        bool
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		objects:         make(map[string]*models.StorageObject),
+		data:            make(map[string][]byte),
+		defaultChecksum: ChecksumSHA256,
+	}
+}
+
+func (ms *MemStore) Put(key string, data io.Reader, contentType string) (*models.StorageObject, error) {
+	return ms.PutWithOptions(key, data, PutOptions{ContentType: contentType})
+}
+
+func (ms *MemStore) PutWithOptions(key string, data io.Reader, opts PutOptions) (*models.StorageObject, error) {
+	tier, err := putTier(opts)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := putMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkObjectID(opts.ObjectID); err != nil {
+		return nil, err
+	}
+	algorithm := opts.ChecksumAlgorithm
+	if algorithm == "" {
+		algorithm = ms.defaultChecksum
+	}
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read before locking, like a slow client would be
+	var buf bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(&buf, hasher), data); err != nil {
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	size := int64(buf.Len())
+	if opts.ExpectedSize > 0 && size != opts.ExpectedSize {
+		return nil, fmt.Errorf("%w: declared %d bytes, received %d", ErrIncompleteUpload, opts.ExpectedSize, size)
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if opts.ExpectedChecksum != "" && !strings.EqualFold(opts.ExpectedChecksum, checksum) {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch,
+			FormatChecksum(algorithm, opts.ExpectedChecksum), FormatChecksum(algorithm, checksum))
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate object ID: %v", err)
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.readOnly {
+		return nil, ErrReadOnly
+	}
+	previous := ms.objects[key]
+	if err := checkPreconditions(key, previous, opts); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	obj := &models.StorageObject{
+		ID:                hex.EncodeToString(id),
+		Key:               key,
+		Size:              size,
+		ContentType:       opts.ContentType,
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		LastAccess:        now,
+		StorageTier:       tier,
+		Version:           1,
+		Owner:             opts.Owner,
+		Metadata:          metadata,
+		ExpiresAt:         opts.ExpiresAt,
+		ReplicationFactor: opts.ReplicationFactor,
+		Stamp:             opts.Stamp,
+	}
+
+	sizeDelta := size
+	if previous != nil {
+		obj.Version = previous.Version + 1
+		obj.Owner = previous.Owner
+		sizeDelta -= previous.Size
+	}
+	if opts.ObjectID != "" {
+		obj.ID = opts.ObjectID
+	}
+
+	ms.objects[key] = obj
+	ms.data[key] = buf.Bytes()
+	if previous == nil {
+		ms.adjustUsage(obj.Owner, 1, sizeDelta)
+	} else {
+		ms.adjustUsage(obj.Owner, 0, sizeDelta)
+	}
+	return obj, nil
+}
+
+func (ms *MemStore) Stat(key string) (*models.StorageObject, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	obj, exists := ms.objects[key]
+	if !exists || Expired(obj, time.Now()) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	stat := *obj
+	return &stat, nil
+}
+
+func (ms *MemStore) Get(key string) (io.ReadCloser, *models.StorageObject, error) {
+	return ms.GetWithOptions(key, GetOptions{})
+}
+
+func (ms *MemStore) GetWithOptions(key string, opts GetOptions) (io.ReadCloser, *models.StorageObject, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	obj, exists := ms.objects[key]
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if opts.VersionID != "" && opts.VersionID != versionIDOf(obj) {
+		return nil, nil, fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, opts.VersionID, key)
+	}
+	if Expired(obj, time.Now()) {
+		return nil, nil, fmt.Errorf("%w: %s has expired", ErrObjectNotFound, key)
+	}
+
+	data := ms.data[key]
+	if opts.Ranged {
+		start, n, err := ResolveRange(obj.Size, opts.Offset, opts.Length)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = data[start : start+n]
+	}
+
+	// Listings and other readers may still hold the stored object, so it's replaced, not changed
+	updated := *obj
+	updated.AccessCount++
+	updated.LastAccess = time.Now()
+	ms.objects[key] = &updated
+	read := updated
+
+	// Stored slices are never written to again, so readers can share them
+	return io.NopCloser(bytes.NewReader(data)), &read, nil
+}
+
+// ReadData reads key without counting an access
+func (ms *MemStore) ReadData(key string) (io.ReadCloser, *models.StorageObject, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	obj, exists := ms.objects[key]
+	if !exists || Expired(obj, time.Now()) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	stat := *obj
+	return io.NopCloser(bytes.NewReader(ms.data[key])), &stat, nil
+}
+
+func (ms *MemStore) Delete(key string) error {
+	return ms.DeleteWithOptions(key, DeleteOptions{})
+}
+
+func (ms *MemStore) DeleteWithOptions(key string, opts DeleteOptions) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.readOnly {
+		return ErrReadOnly
+	}
+	obj, exists := ms.objects[key]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if opts.VersionID != "" && opts.VersionID != versionIDOf(obj) {
+		return fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, opts.VersionID, key)
+	}
+	if err := checkVersion(obj, opts.IfVersion); err != nil {
+		return err
+	}
+
+	delete(ms.objects, key)
+	delete(ms.data, key)
+	ms.adjustUsage(obj.Owner, -1, -obj.Size)
+	return nil
+}
+
+func (ms *MemStore) List() map[string]*models.StorageObject {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	result := make(map[string]*models.StorageObject)
+	for k, v := range ms.objects {
+		result[k] = v
+	}
+	return result
+}
+
+// ListWithOptions returns one page of objects in key order
+func (ms *MemStore) ListWithOptions(opts ListOptions) (*ListResult, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ListPage(ms.objects, opts)
+}
+
+// ListVersions returns just the current version, MemStore keeps no history
+func (ms *MemStore) ListVersions(key string) ([]*models.StorageObject, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	obj, exists := ms.objects[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return []*models.StorageObject{obj}, nil
+}
+
+func (ms *MemStore) SetOwner(key, owner, actor string) (*models.StorageObject, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.readOnly {
+		return nil, ErrReadOnly
+	}
+	obj, exists := ms.objects[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+
+	updated := *obj
+	updated.Owner = owner
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+	ms.objects[key] = &updated
+
+	ms.adjustUsage(obj.Owner, -1, -obj.Size)
+	ms.adjustUsage(owner, 1, obj.Size)
+	return &updated, nil
+}
+
+func (ms *MemStore) BackfillOwner(prefix, owner, actor string) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.readOnly {
+		return 0, ErrReadOnly
+	}
+	relabeled := 0
+	for key, obj := range ms.objects {
+		if obj.Owner != UnknownOwner || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		updated := *obj
+		updated.Owner = owner
+		updated.Version++
+		ms.objects[key] = &updated
+
+		ms.adjustUsage(obj.Owner, -1, -obj.Size)
+		ms.adjustUsage(owner, 1, obj.Size)
+		relabeled++
+	}
+	return relabeled, nil
+}
+
+func (ms *MemStore) UsageByOwner() map[string]OwnerUsage {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	usage := make(map[string]OwnerUsage)
+	for _, obj := range ms.objects {
+		u := usage[obj.Owner]
+		u.Objects++
+		u.Bytes += obj.Size
+		usage[obj.Owner] = u
+	}
+	return usage
+}
+
+func (ms *MemStore) SetUsageObserver(fn UsageObserver) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.onUsage = fn
+}
+
+func (ms *MemStore) SetReadOnly(enabled bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.readOnly = enabled
+}
+
+func (ms *MemStore) ReadOnly() bool {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.readOnly
+}
+
+func (ms *MemStore) adjustUsage(owner string, objects, bytes int64) {
+	if ms.onUsage != nil && (objects != 0 || bytes != 0) {
+		ms.onUsage(owner, objects, bytes)
+	}
+}
+
+func (ms *MemStore) Journal() *journal.Journal { return nil }
@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+func TestMemStoreConformance(t *testing.T) {
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		return storage.NewMemStore()
+	})
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Each object's metadata lives in its own file, metadata/<objectID>.json, so a change only
+// rewrites the entry it touches. These names in the same directory are not object files.
+const (
+	legacyCatalogFile = "objects.json"
+	versionsFile      = "versions.json"
+)
+
+func (fs *FileStore) objectMetaPath(obj *models.StorageObject) string {
+	return filepath.Join(fs.bucketMetadataPath(BucketOf(obj)), obj.ID+".json")
+}
+
+// saveObject persists one object's metadata, replacing the file atomically
+func (fs *FileStore) saveObject(obj *models.StorageObject) error {
+	if fs.kv != nil {
+		return fs.kvSaveObject(obj)
+	}
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	if err := writeFileAtomic(fs.objectMetaPath(obj), data); err != nil {
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	return nil
+}
+
+// removeObjectMeta removes obj's metadata. Objects replaced by an overwrite or a promoted
+// version keep their ID, see inherit, so when the key's current object has obj's ID the
+// record is the current object's and stays.
+func (fs *FileStore) removeObjectMeta(obj *models.StorageObject) error {
+	if current := fs.objects[obj.Key]; current != nil && current != obj && current.ID == obj.ID {
+		return nil
+	}
+	if fs.kv != nil {
+		return fs.kvRemoveObject(obj)
+	}
+	if err := os.Remove(fs.objectMetaPath(obj)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove metadata: %v", err)
+	}
+	return nil
+}
+
+// saveAll rewrites the metadata of every object and drops files of objects no longer in
+// the catalog. Only for repairs that replace the catalog wholesale.
+func (fs *FileStore) saveAll() error {
+	if fs.kv != nil {
+		return fs.kvSaveAll()
+	}
+	keep := make(map[string]bool)
+	for _, obj := range fs.objects {
+		if err := fs.saveObject(obj); err != nil {
+			return err
+		}
+		keep[fs.objectMetaPath(obj)] = true
+	}
+
+	for _, dir := range fs.metadataDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata directory: %v", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if isObjectMetaFile(entry.Name()) && !keep[path] {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+func isObjectMetaFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && name != legacyCatalogFile && name != versionsFile
+}
+
+// loadMetadata rebuilds the catalog from the per-object files. Unreadable files are
+// skipped; if two files claim one key (a crash between writing an overwrite and removing
+// the old entry) the newer one wins.
+func (fs *FileStore) loadMetadata() {
+	fs.loadBuckets()
+	if fs.kv != nil {
+		fs.kvLoad()
+	} else {
+		fs.migrateCatalog()
+		for _, dir := range fs.metadataDirs() {
+			fs.loadMetadataDir(dir)
+		}
+		fs.loadVersions()
+	}
+
+	// Objects written before versioning, ownership and buckets existed
+	for _, obj := range fs.objects {
+		if obj.Version == 0 {
+			obj.Version = 1
+		}
+		if obj.Owner == "" {
+			obj.Owner = UnknownOwner
+		}
+		if obj.ChecksumAlgorithm == "" {
+			obj.ChecksumAlgorithm = ChecksumMD5
+		}
+		if obj.Bucket == "" {
+			obj.Bucket = DefaultBucket
+		}
+	}
+
+	fs.migrateLayout()
+	fs.countBlobRefs()
+	fs.countUsedBytes()
+}
+
+func (fs *FileStore) loadMetadataDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to read metadata directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if strings.Contains(name, ".tmp-") {
+			os.Remove(path) // an interrupted write
+			continue
+		}
+		if entry.IsDir() || !isObjectMetaFile(name) {
+			continue
+		}
+
+		obj, err := readObjectMeta(path)
+		if err != nil {
+			log.Printf("Skipping unreadable metadata file %s: %v", path, err)
+			continue
+		}
+
+		existing, exists := fs.objects[obj.Key]
+		if exists {
+			stale := obj
+			if obj.Version > existing.Version || (obj.Version == existing.Version && obj.UpdatedAt.After(existing.UpdatedAt)) {
+				stale = existing
+				fs.objects[obj.Key] = obj
+			}
+			log.Printf("Dropping stale metadata for %s (object %s)", obj.Key, stale.ID)
+			os.Remove(fs.objectMetaPath(stale))
+			continue
+		}
+		fs.objects[obj.Key] = obj
+	}
+}
+
+func readObjectMeta(path string) (*models.StorageObject, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obj models.StorageObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if obj.Key == "" || obj.ID == "" {
+		return nil, fmt.Errorf("missing key or object ID")
+	}
+	return &obj, nil
+}
+
+// migrateCatalog splits a legacy objects.json (or its backup, if the catalog itself is
+// unreadable) into per-object files. The old file is kept as objects.json.migrated.
+func (fs *FileStore) migrateCatalog() {
+	path := filepath.Join(fs.metadataPath, legacyCatalogFile)
+	objects, err := readCatalog(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Metadata catalog %s is unreadable: %v", path, err)
+	}
+	if err != nil {
+		backup, backupErr := readCatalog(path + ".bak")
+		switch {
+		case backupErr == nil:
+			log.Printf("Using metadata backup %s.bak (%d objects)", path, len(backup))
+			objects = backup
+		case !os.IsNotExist(err):
+			log.Printf("No usable metadata backup either: %v", backupErr)
+		}
+	}
+	if objects == nil {
+		return
+	}
+
+	for key, obj := range objects {
+		if obj.Key == "" {
+			obj.Key = key
+		}
+		if err := fs.saveObject(obj); err != nil {
+			// Leave objects.json in place so the next start tries again
+			log.Printf("Failed to migrate metadata catalog: %v", err)
+			return
+		}
+	}
+	if err := os.Rename(path, path+".migrated"); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to retire %s: %v", path, err)
+		return
+	}
+	os.Remove(path + ".bak")
+	log.Printf("Migrated %d objects from %s to per-object metadata files", len(objects), path)
+}
+
+func readCatalog(path string) (map[string]*models.StorageObject, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var objects map[string]*models.StorageObject
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, err
+	}
+	if objects == nil {
+		objects = make(map[string]*models.StorageObject)
+	}
+	return objects, nil
+}
+
+// atomicWriter is what writeFileAtomic writes the temporary file through. Tests swap it
+// for one that fails partway, as a crash mid-write would.
+var atomicWriter = func(f *os.File) io.Writer { return f }
+
+// writeFileAtomic replaces path with data so that readers see either the old or the new
+// contents in full
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := atomicWriter(tmp).Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrQuotaExceeded is returned when a write would take the store past its quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// SetQuota caps the bytes held by current objects; 0 means no limit. Lowering it below
+// what is already stored only turns away new writes, nothing gets deleted.
+func (fs *FileStore) SetQuota(bytes int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.quota = bytes
+}
+
+// SetOwnerQuotas caps the bytes each owner listed may hold in current objects, on top of
+// the store's quota; owners not listed, or given 0, have no limit of their own. As with
+// SetQuota, lowering one below what the owner already stores only turns away their writes.
+func (fs *FileStore) SetOwnerQuotas(quotas map[string]int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.ownerQuotas = maps.Clone(quotas)
+}
+
+// OwnerQuotas returns the limits set with SetOwnerQuotas
+func (fs *FileStore) OwnerQuotas() map[string]int64 {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return maps.Clone(fs.ownerQuotas)
+}
+
+// QuotaUsage returns the bytes held by current objects and the quota (0 if unlimited)
+func (fs *FileStore) QuotaUsage() (used, quota int64) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.usedBytes, fs.quota
+}
+
+// quotaRoom is how many bytes a write replacing previous, or creating a key for owner when
+// previous is nil, may store: the least room left under the store's quota and the quota
+// of the owner the object is charged to, or -1 without either. The caller holds the lock.
+func (fs *FileStore) quotaRoom(previous *models.StorageObject, owner string) int64 {
+	var released int64
+	if previous != nil {
+		owner, released = previous.Owner, previous.Size
+	}
+	room := int64(-1)
+	if fs.quota > 0 {
+		room = max(fs.quota-fs.usedBytes+released, 0)
+	}
+	if limit := fs.ownerQuotas[owner]; limit > 0 {
+		left := max(limit-fs.ownerUsage[owner].Bytes+released, 0)
+		if room < 0 || left < room {
+			room = left
+		}
+	}
+	return room
+}
+
+// countUsedBytes recomputes usedBytes and the usage of each tier and owner, for when the
+// catalog is loaded or replaced wholesale
+func (fs *FileStore) countUsedBytes() {
+	fs.usedBytes = 0
+	fs.tierUsage = make(map[string]TierUsage)
+	fs.ownerUsage = make(map[string]OwnerUsage)
+	for _, obj := range fs.objects {
+		fs.usedBytes += obj.Size
+		fs.tally(nil, obj)
+	}
+}
@@ -0,0 +1,71 @@
+package storage_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+func TestFileStoreOwnerQuota(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	fs.SetOwnerQuotas(map[string]int64{"alice": 10})
+	exceeded := func(what string, err error) {
+		t.Helper()
+		if !errors.Is(err, storage.ErrQuotaExceeded) {
+			t.Errorf("%s: %v, want the quota exceeded", what, err)
+		}
+	}
+
+	storagetest.Put(t, fs, "a", "123456", storage.PutOptions{Owner: "alice"})
+	_, err := fs.PutWithOptions("b", strings.NewReader("123456"), storage.PutOptions{Owner: "alice"})
+	exceeded("alice's second object", err)
+	_, err = fs.PutWithOptions("b", strings.NewReader("123456"), storage.PutOptions{Owner: "alice", ExpectedSize: 6})
+	exceeded("alice's second object, declared", err)
+	_, err = fs.Copy("a", "c", storage.CopyOptions{Owner: "alice"})
+	exceeded("a copy for alice", err)
+	_, err = fs.AppendWithOptions("a", strings.NewReader("12345"), storage.AppendOptions{})
+	exceeded("appending past alice's quota", err)
+
+	// Others aren't held to it, and what an overwrite replaces is given back
+	storagetest.Put(t, fs, "d", strings.Repeat("x", 20), storage.PutOptions{Owner: "bob"})
+	storagetest.Put(t, fs, "a", "1234567890", storage.PutOptions{Owner: "alice"})
+	// An overwrite is charged to the object's owner, not the writer
+	_, err = fs.PutWithOptions("a", strings.NewReader("12345678901"), storage.PutOptions{Owner: "bob"})
+	exceeded("growing alice's object past alice's quota", err)
+
+	// Handing an object to someone else, or deleting one, makes room
+	if _, err := fs.SetOwner("a", "bob", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Put(t, fs, "b", "123456", storage.PutOptions{Owner: "alice"})
+	if err := fs.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Put(t, fs, "b", "1234567890", storage.PutOptions{Owner: "alice"})
+
+	// The store's quota still applies when it's the tighter of the two
+	fs.SetQuota(32)
+	_, err = fs.PutWithOptions("e", strings.NewReader("123"), storage.PutOptions{Owner: "bob"})
+	exceeded("past the store's quota", err)
+
+	want := map[string]storage.OwnerUsage{"alice": {Objects: 1, Bytes: 10}, "bob": {Objects: 2, Bytes: 30}}
+	if got := fs.UsageByOwner(); got["alice"] != want["alice"] || got["bob"] != want["bob"] || len(got) != 2 {
+		t.Errorf("UsageByOwner() = %v, want %v", got, want)
+	}
+	if got := fs.OwnerQuotas(); len(got) != 1 || got["alice"] != 10 {
+		t.Errorf("OwnerQuotas() = %v, want alice's 10 bytes", got)
+	}
+
+	// Counted from the catalog after a restart, and enforced again once set
+	fs = reopenFileStore(t, fs, dir)
+	if got := fs.UsageByOwner(); got["alice"] != want["alice"] || got["bob"] != want["bob"] || len(got) != 2 {
+		t.Errorf("after a restart UsageByOwner() = %v, want %v", got, want)
+	}
+	fs.SetOwnerQuotas(map[string]int64{"alice": 10})
+	_, err = fs.PutWithOptions("f", strings.NewReader("1"), storage.PutOptions{Owner: "alice"})
+	exceeded("alice's object after a restart", err)
+}
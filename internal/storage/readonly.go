@@ -0,0 +1,31 @@
+package storage
+
+import "errors"
+
+// ErrReadOnly is returned by writes while the store is read-only, see SetReadOnly
+var ErrReadOnly = errors.New("store is read-only")
+
+// SetReadOnly turns read-only mode on or off. While it is on reads are served as usual but
+// every write fails with ErrReadOnly, including ones already under way that haven't
+// committed, and access stats are held back instead of being written out. Once it returns,
+// nothing more is committed until it is turned off again.
+func (fs *FileStore) SetReadOnly(enabled bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.readOnly = enabled
+}
+
+// ReadOnly reports whether the store is read-only
+func (fs *FileStore) ReadOnly() bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.readOnly
+}
+
+// checkWritable fails writes while the store is read-only. The caller holds the lock.
+func (fs *FileStore) checkWritable() error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// An object's copies on other nodes are recorded in its Replicas after the local one, by
+// node ID and without a file path. Writing new content drops them, the copies are of the
+// old content.
+
+// standaloneNodeID is the node a store's own copies are recorded on until it is told the
+// ID of the cluster node it belongs to
+const standaloneNodeID = "node-1"
+
+// SetNodeID has the store record its own copies as held by the node with id, the ones
+// already there included. Their metadata is only rewritten with it when the object next
+// changes; it is relabeled again at every start.
+func (fs *FileStore) SetNodeID(id string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.nodeID = id
+	for key, obj := range fs.objects {
+		fs.objects[key] = relabelLocal(obj, id)
+	}
+	for key, versions := range fs.versions {
+		for i, obj := range versions {
+			versions[i] = relabelLocal(obj, id)
+		}
+		fs.versions[key] = versions
+	}
+}
+
+// relabelLocal returns obj with its own copies recorded on nodeID, obj itself if they
+// already are. The copy leaves obj untouched for whoever still holds it.
+func relabelLocal(obj *models.StorageObject, nodeID string) *models.StorageObject {
+	for i, replica := range obj.Replicas {
+		if !isLocal(replica) || replica.NodeID == nodeID {
+			continue
+		}
+		updated := *obj
+		updated.Replicas = append([]models.ReplicaInfo(nil), obj.Replicas...)
+		for j := i; j < len(updated.Replicas); j++ {
+			if isLocal(updated.Replicas[j]) {
+				updated.Replicas[j].NodeID = nodeID
+			}
+		}
+		return &updated
+	}
+	return obj
+}
+
+// AddReplica records that nodeID, in zone, holds a verified copy of key, as the object
+// with objectID is at version. It fails with ErrPreconditionFailed if key has changed since.
+func (fs *FileStore) AddReplica(key, objectID string, version int64, nodeID, zone string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	current, exists := fs.objects[key]
+	if !exists || current.ID != objectID || current.Version != version {
+		return fmt.Errorf("%w: %s is no longer version %d of %s", ErrPreconditionFailed, key, version, objectID)
+	}
+	updated := *current
+	updated.Replicas = append([]models.ReplicaInfo(nil), current.Replicas...)
+	recorded := false
+	for i, replica := range updated.Replicas {
+		if isLocal(replica) || replica.NodeID != nodeID || replica.Status != replicaActive {
+			continue
+		}
+		if replica.Zone == zone {
+			return nil
+		}
+		// The node has moved since
+		updated.Replicas[i].Zone = zone
+		recorded = true
+	}
+	if !recorded {
+		updated.Replicas = append(updated.Replicas, models.ReplicaInfo{NodeID: nodeID, Status: replicaActive, Zone: zone})
+	}
+	if err := fs.saveObject(&updated); err != nil {
+		return err
+	}
+	fs.objects[key] = &updated
+	return nil
+}
+
+// RemoveReplica records that nodeID no longer holds a copy of key, as the object with
+// objectID is at version. It fails with ErrPreconditionFailed if key has changed since.
+func (fs *FileStore) RemoveReplica(key, objectID string, version int64, nodeID string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	current, exists := fs.objects[key]
+	if !exists || current.ID != objectID || current.Version != version {
+		return fmt.Errorf("%w: %s is no longer version %d of %s", ErrPreconditionFailed, key, version, objectID)
+	}
+	var kept []models.ReplicaInfo
+	for _, replica := range current.Replicas {
+		if isLocal(replica) || replica.NodeID != nodeID {
+			kept = append(kept, replica)
+		}
+	}
+	if len(kept) == len(current.Replicas) {
+		return nil
+	}
+	updated := *current
+	updated.Replicas = kept
+	if err := fs.saveObject(&updated); err != nil {
+		return err
+	}
+	fs.objects[key] = &updated
+	return nil
+}
+
+// ForgetNode drops nodeID from the copies recorded for every object, for when the node is
+// gone and whatever it held can't be counted on. It returns how many objects it was
+// dropped from.
+func (fs *FileStore) ForgetNode(nodeID string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return 0, err
+	}
+	forgotten := 0
+	for key, current := range fs.objects {
+		var kept []models.ReplicaInfo
+		for _, replica := range current.Replicas {
+			if isLocal(replica) || replica.NodeID != nodeID {
+				kept = append(kept, replica)
+			}
+		}
+		if len(kept) == len(current.Replicas) {
+			continue
+		}
+		updated := *current
+		updated.Replicas = kept
+		if err := fs.saveObject(&updated); err != nil {
+			return forgotten, err
+		}
+		fs.objects[key] = &updated
+		forgotten++
+	}
+	return forgotten, nil
+}
+
+// RestoreData rewrites the local data of key, which has to still be the object with
+// objectID at version, from a copy read elsewhere, for when its own file is lost or
+// corrupt. data has to be the whole object and match its checksum. Nothing else about the
+// object changes; it fails with ErrPreconditionFailed if the object does meanwhile.
+func (fs *FileStore) RestoreData(key, objectID string, version int64, data io.Reader) error {
+	fs.mutex.RLock()
+	obj, exists := fs.objects[key]
+	var dataKey []byte
+	var path string
+	err := fs.checkWritable()
+	if exists && err == nil {
+		dataKey, err = fs.unwrapKey(obj)
+		path = fs.tierDataPath(obj.Bucket, obj.StorageTier, obj.ID)
+	}
+	fs.mutex.RUnlock()
+	if !exists || obj.ID != objectID || obj.Version != version {
+		return fmt.Errorf("%w: %s is no longer version %d of %s", ErrPreconditionFailed, key, version, objectID)
+	}
+	if err != nil {
+		return err
+	}
+	hasher, err := NewHasher(obj.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	// Written uncompressed, whatever the lost file was; the tier keeps it that way
+	file, err := createTemp(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	tmp := file.Name()
+	defer file.Close()
+	stored, err := newStoredWriter(file, false, dataKey)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	size, err := io.Copy(io.MultiWriter(stored, hasher), data)
+	if err == nil {
+		err = stored.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if size != obj.Size || !strings.EqualFold(checksum, obj.Checksum) {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: expected %d bytes hashing to %s, got %d hashing to %s", ErrChecksumMismatch,
+			obj.Size, FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum), size, FormatChecksum(obj.ChecksumAlgorithm, checksum))
+	}
+	var onDisk int64
+	if dataKey != nil {
+		info, err := file.Stat()
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to write data: %v", err)
+		}
+		onDisk = info.Size()
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	current := fs.objects[key]
+	if !unchanged(current, obj) {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: %s changed while it was being restored", ErrPreconditionFailed, key)
+	}
+	if err := fs.checkWritable(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	path, err = fs.placeData(tmp, current.Bucket, current.StorageTier, current.ID, "")
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write data: %v", err)
+	}
+
+	updated := *current
+	updated.ContentEncoding = ""
+	if updated.StorageTier == TierCold {
+		updated.ContentEncoding = encodingIdentity
+	}
+	updated.StoredSize = onDisk
+	updated.Replicas = append([]models.ReplicaInfo(nil), current.Replicas...)
+	updated.Replicas[0].FilePath = path
+	updated.Replicas[0].Status = replicaActive
+	if err := fs.saveObject(&updated); err != nil {
+		os.Remove(path)
+		return err
+	}
+	fs.objects[key] = &updated
+	fs.uncache(key)
+	fs.tally(current, &updated)
+	// A blob shared with other keys just loses this reference
+	fs.releaseData(current.Replicas[0].FilePath)
+	return nil
+}
+
+// RemoteReplicas returns the other nodes obj is recorded as having been copied to
+func RemoteReplicas(obj *models.StorageObject) []string {
+	var nodes []string
+	for _, replica := range obj.Replicas {
+		if !isLocal(replica) && replica.Status == replicaActive {
+			nodes = append(nodes, replica.NodeID)
+		}
+	}
+	return nodes
+}
+
+// isLocal reports whether replica is a data file here rather than a copy elsewhere
+func isLocal(replica models.ReplicaInfo) bool {
+	return replica.FilePath != ""
+}
+
+// localReplicas returns obj's replicas without its copies on other nodes
+func localReplicas(obj *models.StorageObject) []models.ReplicaInfo {
+	var local []models.ReplicaInfo
+	for _, replica := range obj.Replicas {
+		if isLocal(replica) {
+			local = append(local, replica)
+		}
+	}
+	return local
+}
@@ -0,0 +1,675 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// S3Config says where an S3Store keeps its objects
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key" secret:"true"`
+}
+
+// Objects written through the API are stored under s3DataPrefix by object ID, with their
+// metadata as JSON under s3MetaPrefix by key. Anything else already in the bucket is
+// picked up as an object under its own key.
+const (
+	s3InternalPrefix = ".dss/"
+	s3DataPrefix     = s3InternalPrefix + "data/"
+	s3MetaPrefix     = s3InternalPrefix + "meta/"
+)
+
+// S3Store is a Store backed by an S3-compatible bucket. Metadata is cached in memory and
+// loaded from the bucket at startup; reads stream straight from S3. It keeps no journal
+// or version history. Access statistics are only written back on Stop.
+type S3Store struct {
+	client  *s3Client
+	objects map[string]*models.StorageObject
+	dirty   map[string]bool // keys with access statistics not yet written back
+	mutex   sync.RWMutex
+	onUsage UsageObserver
+
+	defaultChecksum string
+	readOnly        bool
+	nodeID          string // of this node, see SetNodeID
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	endpoint := cfg.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	u.Path = ""
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	accessKey, secretKey := cfg.AccessKey, cfg.SecretKey
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	s := &S3Store{
+		client: &s3Client{
+			endpoint:  u,
+			bucket:    cfg.Bucket,
+			region:    region,
+			accessKey: accessKey,
+			secretKey: secretKey,
+			// No overall timeout, downloads are streamed for as long as the reader wants
+			http: &http.Client{Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: 30 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			}},
+			now: time.Now,
+		},
+		objects:         make(map[string]*models.StorageObject),
+		dirty:           make(map[string]bool),
+		defaultChecksum: ChecksumSHA256,
+		nodeID:          standaloneNodeID,
+	}
+
+	if err := s.loadMetadata(); err != nil {
+		return nil, fmt.Errorf("failed to load bucket %s: %w", cfg.Bucket, err)
+	}
+	return s, nil
+}
+
+// loadMetadata lists the bucket once, reading every metadata object and importing keys
+// that have none
+func (s *S3Store) loadMetadata() error {
+	listings, err := s.client.listObjects("")
+	if err != nil {
+		return err
+	}
+
+	sizes := make(map[string]int64)
+	var metaKeys []string
+	for _, l := range listings {
+		sizes[l.Key] = l.Size
+		if strings.HasPrefix(l.Key, s3MetaPrefix) {
+			metaKeys = append(metaKeys, l.Key)
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, metaKey := range metaKeys {
+		obj, err := s.readObjectMeta(metaKey)
+		if err != nil {
+			log.Printf("Skipping unreadable metadata object %s: %v", metaKey, err)
+			continue
+		}
+		dataKey := s3DataKey(obj)
+		size, exists := sizes[dataKey]
+		if !exists || size != obj.Size {
+			// Data replaced or removed behind our back; an imported key is picked up again below
+			log.Printf("Ignoring stale metadata for %s", obj.Key)
+			continue
+		}
+		referenced[dataKey] = true
+		s.objects[obj.Key] = obj
+	}
+
+	for _, l := range listings {
+		if strings.HasPrefix(l.Key, s3InternalPrefix) || referenced[l.Key] {
+			continue
+		}
+		if _, exists := s.objects[l.Key]; exists {
+			continue
+		}
+		s.objects[l.Key] = importedObject(l, s.nodeID)
+	}
+
+	for _, obj := range s.objects {
+		if obj.Version == 0 {
+			obj.Version = 1
+		}
+		if obj.Owner == "" {
+			obj.Owner = UnknownOwner
+		}
+	}
+	return nil
+}
+
+func (s *S3Store) readObjectMeta(metaKey string) (*models.StorageObject, error) {
+	body, err := s.client.getObject(metaKey, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var obj models.StorageObject
+	if err := json.NewDecoder(body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj.Key == "" || obj.ID == "" || len(obj.Replicas) == 0 {
+		return nil, fmt.Errorf("missing key, object ID or data location")
+	}
+	return &obj, nil
+}
+
+// importedObject describes an object that was put in the bucket by something else. A
+// single-part upload's ETag is the MD5 of its content, so it doubles as the checksum;
+// multipart ETags aren't content hashes and are left out.
+func importedObject(l s3Listing, nodeID string) *models.StorageObject {
+	etag := strings.Trim(l.ETag, `"`)
+	checksum := ""
+	if len(etag) == 32 && !strings.Contains(etag, "-") {
+		checksum = strings.ToLower(etag)
+	}
+	id := md5.Sum([]byte(l.Key))
+	return &models.StorageObject{
+		ID:                hex.EncodeToString(id[:]),
+		Key:               l.Key,
+		Size:              l.Size,
+		ContentType:       "application/octet-stream",
+		Checksum:          checksum,
+		ChecksumAlgorithm: ChecksumMD5,
+		CreatedAt:         l.LastModified,
+		UpdatedAt:         l.LastModified,
+		LastAccess:        l.LastModified,
+		StorageTier:       "hot",
+		Version:           1,
+		Owner:             UnknownOwner,
+		Replicas:          []models.ReplicaInfo{{NodeID: nodeID, FilePath: l.Key, Status: "active"}},
+	}
+}
+
+// s3DataKey is where obj's bytes live in the bucket
+func s3DataKey(obj *models.StorageObject) string {
+	return obj.Replicas[0].FilePath
+}
+
+// saveObject writes obj's metadata object, replacing any earlier one
+func (s *S3Store) saveObject(obj *models.StorageObject) error {
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	digest := md5.Sum(data)
+	if err := s.client.putObject(s3MetaPrefix+obj.Key, bytes.NewReader(data), int64(len(data)),
+		hex.EncodeToString(sum[:]), digest[:], "application/json"); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return nil
+}
+
+func (s *S3Store) Put(key string, data io.Reader, contentType string) (*models.StorageObject, error) {
+	return s.PutWithOptions(key, data, PutOptions{ContentType: contentType})
+}
+
+// PutWithOptions uploads data under a fresh object ID and then points key's metadata at
+// it, so a failed upload leaves the previous object intact. The body is spooled to a
+// temporary file first because S3 needs its length and hashes up front.
+func (s *S3Store) PutWithOptions(key string, data io.Reader, opts PutOptions) (*models.StorageObject, error) {
+	if strings.HasPrefix(key, s3InternalPrefix) {
+		return nil, fmt.Errorf("keys under %s are reserved", s3InternalPrefix)
+	}
+	tier, err := putTier(opts)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := putMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkObjectID(opts.ObjectID); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	algorithm := opts.ChecksumAlgorithm
+	if algorithm == "" {
+		algorithm = s.defaultChecksum
+	}
+	readOnly := s.readOnly
+	s.mutex.RUnlock()
+	if readOnly {
+		return nil, ErrReadOnly
+	}
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := os.CreateTemp("", "dss-s3-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest, payload := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hasher, digest, payload), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	if opts.ExpectedSize > 0 && size != opts.ExpectedSize {
+		return nil, fmt.Errorf("%w: declared %d bytes, received %d", ErrIncompleteUpload, opts.ExpectedSize, size)
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if opts.ExpectedChecksum != "" && !strings.EqualFold(opts.ExpectedChecksum, checksum) {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch,
+			FormatChecksum(algorithm, opts.ExpectedChecksum), FormatChecksum(algorithm, checksum))
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind upload: %v", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate object ID: %v", err)
+	}
+	objectID := hex.EncodeToString(id)
+	dataKey := s3DataPrefix + objectID
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	previous := s.objects[key]
+	if err := checkPreconditions(key, previous, opts); err != nil {
+		return nil, err
+	}
+
+	if err := s.client.putObject(dataKey, spool, size, hexSum(payload), digest.Sum(nil), opts.ContentType); err != nil {
+		return nil, fmt.Errorf("failed to upload data: %w", err)
+	}
+
+	now := time.Now()
+	obj := &models.StorageObject{
+		ID:                objectID,
+		Key:               key,
+		Size:              size,
+		ContentType:       opts.ContentType,
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		LastAccess:        now,
+		StorageTier:       tier,
+		Version:           1,
+		Owner:             opts.Owner,
+		Metadata:          metadata,
+		ExpiresAt:         opts.ExpiresAt,
+		ReplicationFactor: opts.ReplicationFactor,
+		Stamp:             opts.Stamp,
+		Replicas:          []models.ReplicaInfo{{NodeID: s.nodeID, FilePath: dataKey, Status: "active"}},
+	}
+	sizeDelta := size
+	if previous != nil {
+		obj.Version = previous.Version + 1
+		obj.Owner = previous.Owner
+		sizeDelta -= previous.Size
+	}
+	if opts.ObjectID != "" {
+		obj.ID = opts.ObjectID
+	}
+
+	if err := s.saveObject(obj); err != nil {
+		s.client.deleteObject(dataKey)
+		return nil, err
+	}
+	s.objects[key] = obj
+	delete(s.dirty, key)
+
+	if previous != nil {
+		if err := s.client.deleteObject(s3DataKey(previous)); err != nil {
+			log.Printf("Failed to remove replaced data of %s: %v", key, err)
+		}
+		s.adjustUsage(obj.Owner, 0, sizeDelta)
+	} else {
+		s.adjustUsage(obj.Owner, 1, sizeDelta)
+	}
+	return obj, nil
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Stat returns a copy of key's metadata from the catalog, without asking S3
+func (s *S3Store) Stat(key string) (*models.StorageObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	obj, exists := s.objects[key]
+	if !exists || Expired(obj, time.Now()) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	stat := *obj
+	return &stat, nil
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, *models.StorageObject, error) {
+	return s.GetWithOptions(key, GetOptions{})
+}
+
+// GetWithOptions streams the object (or the requested range of it) directly from S3
+func (s *S3Store) GetWithOptions(key string, opts GetOptions) (io.ReadCloser, *models.StorageObject, error) {
+	s.mutex.Lock()
+	obj, exists := s.objects[key]
+	if !exists {
+		s.mutex.Unlock()
+		return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if opts.VersionID != "" && opts.VersionID != versionIDOf(obj) {
+		s.mutex.Unlock()
+		return nil, nil, fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, opts.VersionID, key)
+	}
+	if Expired(obj, time.Now()) {
+		s.mutex.Unlock()
+		return nil, nil, fmt.Errorf("%w: %s has expired", ErrObjectNotFound, key)
+	}
+
+	rangeHeader := ""
+	if opts.Ranged {
+		start, n, err := ResolveRange(obj.Size, opts.Offset, opts.Length)
+		if err != nil {
+			s.mutex.Unlock()
+			return nil, nil, err
+		}
+		if n == 0 {
+			stat := *obj
+			s.mutex.Unlock()
+			return io.NopCloser(strings.NewReader("")), &stat, nil
+		}
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", start, start+n-1)
+	}
+
+	// Listings and other readers may still hold the stored object, so it's replaced, not changed
+	updated := *obj
+	updated.AccessCount++
+	updated.LastAccess = time.Now()
+	s.objects[key] = &updated
+	s.dirty[key] = true
+	read := updated
+	obj = &read
+	dataKey := s3DataKey(obj)
+	s.mutex.Unlock()
+
+	if obj.Size == 0 {
+		// S3 rejects any range on an empty object
+		return io.NopCloser(strings.NewReader("")), obj, nil
+	}
+	body, err := s.client.getObject(dataKey, rangeHeader)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil, fmt.Errorf("%w: data of %s is missing from the bucket", ErrObjectNotFound, key)
+		}
+		return nil, nil, fmt.Errorf("failed to read object: %w", err)
+	}
+	return body, obj, nil
+}
+
+// ReadData streams key from S3 without counting an access
+func (s *S3Store) ReadData(key string) (io.ReadCloser, *models.StorageObject, error) {
+	obj, err := s.Stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if obj.Size == 0 {
+		return io.NopCloser(strings.NewReader("")), obj, nil
+	}
+	body, err := s.client.getObject(s3DataKey(obj), "")
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil, fmt.Errorf("%w: data of %s is missing from the bucket", ErrObjectNotFound, key)
+		}
+		return nil, nil, fmt.Errorf("failed to read object: %w", err)
+	}
+	return body, obj, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	return s.DeleteWithOptions(key, DeleteOptions{})
+}
+
+func (s *S3Store) DeleteWithOptions(key string, opts DeleteOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	obj, exists := s.objects[key]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if opts.VersionID != "" && opts.VersionID != versionIDOf(obj) {
+		return fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, opts.VersionID, key)
+	}
+	if err := checkVersion(obj, opts.IfVersion); err != nil {
+		return err
+	}
+
+	// Metadata first: leftover data is only wasted space, leftover metadata would bring
+	// the object back
+	if err := s.client.deleteObject(s3MetaPrefix + key); err != nil {
+		return fmt.Errorf("failed to remove metadata: %w", err)
+	}
+	if err := s.client.deleteObject(s3DataKey(obj)); err != nil {
+		if s3DataKey(obj) == key {
+			// An imported object with no metadata left would be imported again on restart
+			s.saveObject(obj)
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+		log.Printf("Failed to remove data of deleted object %s: %v", key, err)
+	}
+
+	delete(s.objects, key)
+	delete(s.dirty, key)
+	s.adjustUsage(obj.Owner, -1, -obj.Size)
+	return nil
+}
+
+func (s *S3Store) List() map[string]*models.StorageObject {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make(map[string]*models.StorageObject)
+	for k, v := range s.objects {
+		result[k] = v
+	}
+	return result
+}
+
+// ListWithOptions returns one page of objects in key order
+func (s *S3Store) ListWithOptions(opts ListOptions) (*ListResult, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return ListPage(s.objects, opts)
+}
+
+// ListVersions returns just the current version, S3Store keeps no history
+func (s *S3Store) ListVersions(key string) ([]*models.StorageObject, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	obj, exists := s.objects[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return []*models.StorageObject{obj}, nil
+}
+
+func (s *S3Store) SetOwner(key, owner, actor string) (*models.StorageObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	obj, exists := s.objects[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+
+	updated := *obj
+	updated.Owner = owner
+	updated.Version++
+	updated.UpdatedAt = time.Now()
+	if err := s.saveObject(&updated); err != nil {
+		return nil, err
+	}
+	s.objects[key] = &updated
+	delete(s.dirty, key)
+	s.adjustUsage(obj.Owner, -1, -obj.Size)
+	s.adjustUsage(owner, 1, obj.Size)
+	return &updated, nil
+}
+
+// BackfillOwner relabels unowned objects under prefix. Unlike FileStore it can't undo
+// earlier writes when one fails, so the objects relabeled before the failure keep their
+// new owner.
+func (s *S3Store) BackfillOwner(prefix, owner, actor string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	relabeled := 0
+	for key, obj := range s.objects {
+		if obj.Owner != UnknownOwner || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		updated := *obj
+		updated.Owner = owner
+		updated.Version++
+		if err := s.saveObject(&updated); err != nil {
+			return relabeled, err
+		}
+		s.objects[key] = &updated
+		delete(s.dirty, key)
+		s.adjustUsage(obj.Owner, -1, -obj.Size)
+		s.adjustUsage(owner, 1, obj.Size)
+		relabeled++
+	}
+	return relabeled, nil
+}
+
+func (s *S3Store) UsageByOwner() map[string]OwnerUsage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	usage := make(map[string]OwnerUsage)
+	for _, obj := range s.objects {
+		u := usage[obj.Owner]
+		u.Objects++
+		u.Bytes += obj.Size
+		usage[obj.Owner] = u
+	}
+	return usage
+}
+
+// SetDefaultChecksum sets the algorithm used when a write doesn't ask for one
+func (s *S3Store) SetDefaultChecksum(algorithm string) error {
+	if err := ValidateChecksumAlgorithm(algorithm); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultChecksum = algorithm
+	return nil
+}
+
+func (s *S3Store) SetUsageObserver(fn UsageObserver) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onUsage = fn
+}
+
+// SetNodeID has the store record the objects in the bucket as held by the node with id,
+// see FileStore.SetNodeID
+func (s *S3Store) SetNodeID(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodeID = id
+	for key, obj := range s.objects {
+		s.objects[key] = relabelLocal(obj, id)
+	}
+}
+
+func (s *S3Store) SetReadOnly(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readOnly = enabled
+}
+
+func (s *S3Store) ReadOnly() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.readOnly
+}
+
+func (s *S3Store) adjustUsage(owner string, objects, bytes int64) {
+	if s.onUsage != nil && (objects != 0 || bytes != 0) {
+		s.onUsage(owner, objects, bytes)
+	}
+}
+
+func (s *S3Store) Journal() *journal.Journal { return nil }
+
+func (s *S3Store) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop writes back access statistics gathered since startup
+func (s *S3Store) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failed := 0
+	for key := range s.dirty {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if obj, exists := s.objects[key]; exists {
+			if err := s.saveObject(obj); err != nil {
+				failed++
+				continue
+			}
+		}
+		delete(s.dirty, key)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to save access statistics of %d objects", failed)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrStaleWrite is returned when a write is stamped older than the object it would replace,
+// which has been written through another node since
+var ErrStaleWrite = errors.New("stale write")
+
+// maxConflictHistory is how many conflicts an object remembers
+const maxConflictHistory = 20
+
+// StampBefore reports whether a was written before b. Writes that came in through different
+// nodes with the same counter raced; the node with the higher ID wins.
+func StampBefore(a, b *models.WriteStamp) bool {
+	if a.Counter != b.Counter {
+		return a.Counter < b.Counter
+	}
+	return a.NodeID < b.NodeID
+}
+
+// checkStamp fails a write stamped older than previous. Unstamped writes and objects, from
+// before stamps or a standalone node, are never stale.
+func checkStamp(key string, previous *models.StorageObject, stamp *models.WriteStamp) error {
+	if stamp == nil || previous == nil || previous.Stamp == nil || !StampBefore(stamp, previous.Stamp) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is at %d@%s, newer than %d@%s", ErrStaleWrite, key,
+		previous.Stamp.Counter, previous.Stamp.NodeID, stamp.Counter, stamp.NodeID)
+}
+
+// RecordConflict adds record to the conflict history of key, which has to still be the
+// object with objectID. Like AddReplica it changes nothing else about the object.
+func (fs *FileStore) RecordConflict(key, objectID string, record models.ConflictRecord) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	current, exists := fs.objects[key]
+	if !exists || current.ID != objectID {
+		return fmt.Errorf("%w: %s is no longer %s", ErrPreconditionFailed, key, objectID)
+	}
+	if record.At.IsZero() {
+		record.At = time.Now()
+	}
+
+	updated := *current
+	history := append(append([]models.ConflictRecord(nil), current.ConflictHistory...), record)
+	if len(history) > maxConflictHistory {
+		history = history[len(history)-maxConflictHistory:]
+	}
+	updated.ConflictHistory = history
+	if err := fs.saveObject(&updated); err != nil {
+		return err
+	}
+	fs.objects[key] = &updated
+	return nil
+}
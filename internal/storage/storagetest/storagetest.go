@@ -0,0 +1,420 @@
+// Package storagetest checks that a storage.Store behaves the way the API relies on, so
+// every backend can be held to the same semantics.
+package storagetest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// TestStore runs the conformance suite, opening a fresh, empty store with open for each
+// check
+func TestStore(t *testing.T, open func(t *testing.T) storage.Store) {
+	checks := []struct {
+		name string
+		fn   func(t *testing.T, store storage.Store)
+	}{
+		{"PutGet", testPutGet},
+		{"NotFound", testNotFound},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"Range", testRange},
+		{"ReadData", testReadData},
+		{"ExpectedChecksum", testExpectedChecksum},
+		{"ExpectedSize", testExpectedSize},
+		{"IfVersion", testIfVersion},
+		{"IfMatch", testIfMatch},
+		{"ConcurrentPreconditions", testConcurrentPreconditions},
+		{"ReadsWhileListing", testReadsWhileListing},
+		{"Metadata", testMetadata},
+		{"ListPages", testListPages},
+		{"Owners", testOwners},
+		{"ReadOnly", testReadOnly},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			check.fn(t, open(t))
+		})
+	}
+}
+
+// Put writes data to key, failing the test if it can't
+func Put(t *testing.T, store storage.Store, key, data string, opts storage.PutOptions) *models.StorageObject {
+	t.Helper()
+	obj, err := store.PutWithOptions(key, strings.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+	return obj
+}
+
+// Read reads all of key, failing the test if it can't
+func Read(t *testing.T, store storage.Store, key string, opts storage.GetOptions) (string, *models.StorageObject) {
+	t.Helper()
+	reader, obj, err := store.GetWithOptions(key, opts)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data), obj
+}
+
+func testPutGet(t *testing.T, store storage.Store) {
+	obj := Put(t, store, "greeting", "hello, world", storage.PutOptions{ContentType: "text/plain"})
+	wantChecksum := fmt.Sprintf("%x", sha256.Sum256([]byte("hello, world")))
+	if obj.Size != 12 || obj.Checksum != wantChecksum || obj.ChecksumAlgorithm != storage.ChecksumSHA256 {
+		t.Errorf("Put returned size %d, checksum %s:%s; want 12, sha256:%s",
+			obj.Size, obj.ChecksumAlgorithm, obj.Checksum, wantChecksum)
+	}
+	if obj.ID == "" || obj.Version != 1 || obj.StorageTier != storage.TierHot {
+		t.Errorf("Put returned ID %q, version %d, tier %q; want an ID, 1, hot", obj.ID, obj.Version, obj.StorageTier)
+	}
+
+	data, got := Read(t, store, "greeting", storage.GetOptions{})
+	if data != "hello, world" {
+		t.Errorf("Get = %q, want %q", data, "hello, world")
+	}
+	if got.ID != obj.ID || got.ContentType != "text/plain" || got.Checksum != wantChecksum {
+		t.Errorf("Get returned ID %s, content type %q, checksum %s; want %s, text/plain, %s",
+			got.ID, got.ContentType, got.Checksum, obj.ID, wantChecksum)
+	}
+
+	stat, err := store.Stat("greeting")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if stat.ID != obj.ID || stat.Size != 12 {
+		t.Errorf("Stat returned ID %s, size %d; want %s, 12", stat.ID, stat.Size, obj.ID)
+	}
+}
+
+func testNotFound(t *testing.T, store storage.Store) {
+	if _, _, err := store.Get("missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Get of a missing key = %v, want ErrObjectNotFound", err)
+	}
+	if _, err := store.Stat("missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Stat of a missing key = %v, want ErrObjectNotFound", err)
+	}
+	if err := store.Delete("missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Delete of a missing key = %v, want ErrObjectNotFound", err)
+	}
+}
+
+func testOverwrite(t *testing.T, store storage.Store) {
+	first := Put(t, store, "doc", "first", storage.PutOptions{Owner: "alice"})
+	second := Put(t, store, "doc", "second, longer", storage.PutOptions{Owner: "bob"})
+	if second.Version != first.Version+1 {
+		t.Errorf("overwrite has version %d, want %d", second.Version, first.Version+1)
+	}
+	if second.Owner != "alice" {
+		t.Errorf("overwrite has owner %q, want the original owner alice", second.Owner)
+	}
+	if data, _ := Read(t, store, "doc", storage.GetOptions{}); data != "second, longer" {
+		t.Errorf("Get after the overwrite = %q, want the new data", data)
+	}
+	if n := len(store.List()); n != 1 {
+		t.Errorf("List has %d objects after an overwrite, want 1", n)
+	}
+}
+
+func testDelete(t *testing.T, store storage.Store) {
+	Put(t, store, "doomed", "data", storage.PutOptions{})
+	Put(t, store, "kept", "data", storage.PutOptions{})
+	if err := store.Delete("doomed"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get("doomed"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrObjectNotFound", err)
+	}
+	objects := store.List()
+	if _, exists := objects["doomed"]; exists || len(objects) != 1 {
+		t.Errorf("List after Delete has %d objects, want just kept", len(objects))
+	}
+}
+
+func testRange(t *testing.T, store storage.Store) {
+	Put(t, store, "digits", "0123456789", storage.PutOptions{})
+	data, _ := Read(t, store, "digits", storage.GetOptions{Ranged: true, Offset: 3, Length: 4})
+	if data != "3456" {
+		t.Errorf("bytes 3-6 = %q, want %q", data, "3456")
+	}
+	data, _ = Read(t, store, "digits", storage.GetOptions{Ranged: true, Offset: 7, Length: -1})
+	if data != "789" {
+		t.Errorf("bytes from 7 = %q, want %q", data, "789")
+	}
+	_, _, err := store.GetWithOptions("digits", storage.GetOptions{Ranged: true, Offset: 20, Length: 1})
+	if !errors.Is(err, storage.ErrInvalidRange) {
+		t.Errorf("range past the end = %v, want ErrInvalidRange", err)
+	}
+}
+
+// ReadData is for the store's own copies, which aren't accesses
+func testReadData(t *testing.T, store storage.Store) {
+	Put(t, store, "copied", "hello world", storage.PutOptions{})
+	for i := 0; i < 3; i++ {
+		reader, obj, err := store.ReadData("copied")
+		if err != nil {
+			t.Fatalf("ReadData: %v", err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "hello world" || obj.Size != 11 {
+			t.Fatalf("ReadData = %q, %d bytes (%v), want hello world", data, obj.Size, err)
+		}
+	}
+	if _, obj := Read(t, store, "copied", storage.GetOptions{}); obj.AccessCount != 1 {
+		t.Errorf("first Get after 3 ReadData counted as access %d, want 1", obj.AccessCount)
+	}
+	if _, _, err := store.ReadData("missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("ReadData of a missing key: %v, want ErrObjectNotFound", err)
+	}
+}
+
+func testExpectedChecksum(t *testing.T, store storage.Store) {
+	wrong := fmt.Sprintf("%x", sha256.Sum256([]byte("something else")))
+	_, err := store.PutWithOptions("checked", strings.NewReader("payload"), storage.PutOptions{ExpectedChecksum: wrong})
+	if !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Put with the wrong checksum = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := store.Stat("checked"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("object exists after a Put with the wrong checksum: %v", err)
+	}
+
+	right := fmt.Sprintf("%x", sha256.Sum256([]byte("payload")))
+	Put(t, store, "checked", "payload", storage.PutOptions{ExpectedChecksum: right})
+}
+
+func testExpectedSize(t *testing.T, store storage.Store) {
+	Put(t, store, "kept", "first", storage.PutOptions{})
+	for _, key := range []string{"short", "kept"} {
+		_, err := store.PutWithOptions(key, strings.NewReader("cut"), storage.PutOptions{ExpectedSize: 10})
+		if !errors.Is(err, storage.ErrIncompleteUpload) {
+			t.Errorf("Put of %s with 3 of 10 bytes = %v, want ErrIncompleteUpload", key, err)
+		}
+	}
+	if _, err := store.Stat("short"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("object exists after a short Put: %v", err)
+	}
+	if data, _ := Read(t, store, "kept", storage.GetOptions{}); data != "first" {
+		t.Errorf("kept = %q after a short overwrite, want it untouched", data)
+	}
+
+	// Without a declared size any length will do
+	Put(t, store, "short", "cut", storage.PutOptions{ExpectedSize: -1})
+}
+
+func testIfVersion(t *testing.T, store storage.Store) {
+	absent := int64(0)
+	Put(t, store, "once", "first", storage.PutOptions{IfVersion: &absent})
+	_, err := store.PutWithOptions("once", strings.NewReader("second"), storage.PutOptions{IfVersion: &absent})
+	if !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("Put of an existing key that must not exist = %v, want ErrPreconditionFailed", err)
+	}
+	current := int64(1)
+	Put(t, store, "once", "second", storage.PutOptions{IfVersion: &current})
+	if err := store.DeleteWithOptions("once", storage.DeleteOptions{IfVersion: &current}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("Delete at a stale version = %v, want ErrPreconditionFailed", err)
+	}
+}
+
+func testIfMatch(t *testing.T, store storage.Store) {
+	obj := Put(t, store, "tagged", "first", storage.PutOptions{})
+	etag := storage.FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum)
+	stale := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+	_, err := store.PutWithOptions("tagged", strings.NewReader("second"), storage.PutOptions{IfMatch: []string{stale}})
+	if !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("Put with a stale If-Match = %v, want ErrPreconditionFailed", err)
+	}
+	Put(t, store, "tagged", "second", storage.PutOptions{IfMatch: []string{etag}})
+	_, err = store.PutWithOptions("tagged", strings.NewReader("third"), storage.PutOptions{IfNoneMatch: []string{"*"}})
+	if !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("Put with If-None-Match: * over an existing object = %v, want ErrPreconditionFailed", err)
+	}
+}
+
+// contend has n writers put to key at once with opts, each writing something of its own
+// named after who, and returns what each wrote and the error it got
+func contend(store storage.Store, key, who string, n int, opts storage.PutOptions) ([]string, []error) {
+	data, errs := make([]string, n), make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range errs {
+		data[i] = fmt.Sprintf("%s writer %d", who, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, errs[i] = store.PutWithOptions(key, strings.NewReader(data[i]), opts)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return data, errs
+}
+
+// Writers racing with the same precondition: the check and the write are one step, so
+// exactly one of them gets in and the rest are refused
+func testConcurrentPreconditions(t *testing.T, store storage.Store) {
+	const writers = 16
+	for round := 0; round < 10; round++ {
+		key := fmt.Sprintf("contested-%d", round)
+		for _, conflict := range []string{"If-None-Match", "If-Match"} {
+			opts := storage.PutOptions{IfNoneMatch: []string{"*"}}
+			if conflict == "If-Match" {
+				_, current := Read(t, store, key, storage.GetOptions{})
+				opts = storage.PutOptions{IfMatch: []string{storage.FormatChecksum(current.ChecksumAlgorithm, current.Checksum)}}
+			}
+
+			data, errs := contend(store, key, conflict, writers, opts)
+			var winners []string
+			for i, err := range errs {
+				switch {
+				case err == nil:
+					winners = append(winners, data[i])
+				case !errors.Is(err, storage.ErrPreconditionFailed):
+					t.Errorf("%s writer %d: %v, want success or ErrPreconditionFailed", conflict, i, err)
+				}
+			}
+			if len(winners) != 1 {
+				t.Fatalf("%d of %d writers with the same %s succeeded, want 1", len(winners), writers, conflict)
+			}
+			if got, _ := Read(t, store, key, storage.GetOptions{}); got != winners[0] {
+				t.Errorf("after the %s race %s = %q, want the winner's %q", conflict, key, got, winners[0])
+			}
+		}
+	}
+}
+
+// Reads count themselves on the object without touching what listings and earlier reads
+// handed out, which callers go on to encode with no lock held
+func testReadsWhileListing(t *testing.T, store storage.Store) {
+	Put(t, store, "popular", "data", storage.PutOptions{})
+	listed := store.List()["popular"]
+	before := *listed
+
+	const readers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				reader, obj, err := store.GetWithOptions("popular", storage.GetOptions{})
+				if err != nil {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				reader.Close()
+				if _, err := json.Marshal(obj); err != nil {
+					t.Errorf("encoding a read object: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := json.Marshal(store.List()); err != nil {
+					t.Errorf("encoding a listing: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if listed.AccessCount != before.AccessCount || !listed.LastAccess.Equal(before.LastAccess) {
+		t.Errorf("reads changed an object listed before them: %d reads at %v, was %d at %v",
+			listed.AccessCount, listed.LastAccess, before.AccessCount, before.LastAccess)
+	}
+}
+
+func testMetadata(t *testing.T, store storage.Store) {
+	Put(t, store, "described", "data", storage.PutOptions{Metadata: map[string]string{"project": "apollo"}})
+	stat, err := store.Stat("described")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if stat.Metadata["project"] != "apollo" {
+		t.Errorf("metadata = %v, want project=apollo", stat.Metadata)
+	}
+}
+
+func testListPages(t *testing.T, store storage.Store) {
+	for _, key := range []string{"log-e", "log-a", "log-d", "image-x", "log-c", "log-b"} {
+		Put(t, store, key, key, storage.PutOptions{})
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("listing didn't end after %d pages", pages)
+		}
+		page, err := store.ListWithOptions(storage.ListOptions{Prefix: "log-", Limit: 2, Token: token})
+		if err != nil {
+			t.Fatalf("ListWithOptions: %v", err)
+		}
+		keys = append(keys, page.Keys...)
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextToken
+	}
+	if got, want := strings.Join(keys, ","), "log-a,log-b,log-c,log-d,log-e"; got != want {
+		t.Errorf("listed %s, want %s", got, want)
+	}
+
+	if _, err := store.ListWithOptions(storage.ListOptions{Token: "!"}); !errors.Is(err, storage.ErrInvalidToken) {
+		t.Errorf("listing with a bad token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func testOwners(t *testing.T, store storage.Store) {
+	Put(t, store, "a", "12345", storage.PutOptions{Owner: "alice"})
+	Put(t, store, "b", "123", storage.PutOptions{Owner: "alice"})
+	Put(t, store, "c", "1", storage.PutOptions{Owner: "bob"})
+	usage := store.UsageByOwner()
+	if alice := usage["alice"]; alice.Objects != 2 || alice.Bytes != 8 {
+		t.Errorf("alice's usage = %+v, want 2 objects, 8 bytes", alice)
+	}
+
+	if _, err := store.SetOwner("c", "alice", "test"); err != nil {
+		t.Fatalf("SetOwner: %v", err)
+	}
+	usage = store.UsageByOwner()
+	if alice, bob := usage["alice"], usage["bob"]; alice.Objects != 3 || bob.Objects != 0 {
+		t.Errorf("after SetOwner alice has %d objects and bob %d, want 3 and 0", alice.Objects, bob.Objects)
+	}
+}
+
+func testReadOnly(t *testing.T, store storage.Store) {
+	Put(t, store, "frozen", "data", storage.PutOptions{})
+	store.SetReadOnly(true)
+	if !store.ReadOnly() {
+		t.Error("ReadOnly() = false after SetReadOnly(true)")
+	}
+	if _, err := store.Put("new", strings.NewReader("data"), ""); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Put while read-only = %v, want ErrReadOnly", err)
+	}
+	if err := store.Delete("frozen"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Delete while read-only = %v, want ErrReadOnly", err)
+	}
+	if data, _ := Read(t, store, "frozen", storage.GetOptions{}); data != "data" {
+		t.Errorf("Get while read-only = %q, want the data", data)
+	}
+
+	store.SetReadOnly(false)
+	Put(t, store, "new", "data", storage.PutOptions{})
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"io"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// Store is what the API and the subsystems around it need from an object store.
+// FileStore keeps objects on local disk, S3Store in an S3 bucket and MemStore in memory.
+type Store interface {
+	Put(key string, data io.Reader, contentType string) (*models.StorageObject, error)
+	PutWithOptions(key string, data io.Reader, opts PutOptions) (*models.StorageObject, error)
+	Get(key string) (io.ReadCloser, *models.StorageObject, error)
+	GetWithOptions(key string, opts GetOptions) (io.ReadCloser, *models.StorageObject, error)
+	// Stat returns a copy of the current metadata of key without opening its data or
+	// counting an access
+	Stat(key string) (*models.StorageObject, error)
+	// ReadData opens the current version of key's data for the store's own use of it, such
+	// as copies sent to other nodes, without counting an access
+	ReadData(key string) (io.ReadCloser, *models.StorageObject, error)
+	Delete(key string) error
+	DeleteWithOptions(key string, opts DeleteOptions) error
+	List() map[string]*models.StorageObject
+	ListWithOptions(opts ListOptions) (*ListResult, error)
+	ListVersions(key string) ([]*models.StorageObject, error)
+
+	SetOwner(key, owner, actor string) (*models.StorageObject, error)
+	BackfillOwner(prefix, owner, actor string) (int, error)
+	UsageByOwner() map[string]OwnerUsage
+	SetUsageObserver(fn UsageObserver)
+
+	// SetReadOnly makes every write fail with ErrReadOnly until it is turned off again,
+	// while reads carry on
+	SetReadOnly(enabled bool)
+	ReadOnly() bool
+
+	// Journal returns the mutation journal, or nil if the store doesn't keep one
+	Journal() *journal.Journal
+}
+
+// Checker is implemented by stores that can verify (and repair) their own consistency
+type Checker interface {
+	Fsck(opts FsckOptions) *FsckReport
+}
+
+// Deduplicator is implemented by stores that can share content between keys
+type Deduplicator interface {
+	DedupStats() (blobs, references int)
+}
+
+// Bucketer is implemented by stores that keep objects in separate buckets. Stores without
+// it only have the default bucket.
+type Bucketer interface {
+	BucketExists(name string) bool
+	CreateBucket(name string) error
+	DeleteBucket(name string, force bool, actor string) (int, error)
+	ListBuckets() []BucketInfo
+}
+
+// ReplicaRecorder is implemented by stores that keep track of which other nodes hold
+// copies of their objects
+type ReplicaRecorder interface {
+	AddReplica(key, objectID string, version int64, nodeID, zone string) error
+	RemoveReplica(key, objectID string, version int64, nodeID string) error
+	ForgetNode(nodeID string) (int, error)
+}
+
+// NodeNamer is implemented by stores that record which node holds their own copy of each
+// object, see SetNodeID
+type NodeNamer interface {
+	SetNodeID(id string)
+}
+
+// ConflictRecorder is implemented by stores that keep a history of the write conflicts
+// found for each object
+type ConflictRecorder interface {
+	RecordConflict(key, objectID string, record models.ConflictRecord) error
+}
+
+// DataRestorer is implemented by stores whose lost or corrupt data can be rewritten from a
+// copy on another node
+type DataRestorer interface {
+	RestoreData(key, objectID string, version int64, data io.Reader) error
+}
+
+// Limiter is implemented by stores that can enforce a cap on the bytes they hold, in all
+// and by owner
+type Limiter interface {
+	SetQuota(bytes int64)
+	QuotaUsage() (used, quota int64)
+	SetOwnerQuotas(quotas map[string]int64)
+	OwnerQuotas() map[string]int64
+}
+
+// Cacher is implemented by stores that can keep small objects in memory for reads
+type Cacher interface {
+	SetCache(maxBytes, maxObjectSize int64)
+	CacheStats() CacheStats
+	Cached(key string) bool
+	Preload(key string) (int64, error)
+}
+
+// TierReporter is implemented by stores that keep track of how much each tier holds
+type TierReporter interface {
+	Usage() map[string]TierUsage
+	LargestObjects(n int) map[string][]*models.StorageObject
+}
+
+// Encrypter is implemented by stores that encrypt data at rest
+type Encrypter interface {
+	RotateKeys(actor string) (int, error)
+}
+
+// StoredCopier is implemented by stores that can hand out and take in data exactly as it
+// is stored, compressed and encrypted, so copies are made without decoding it
+type StoredCopier interface {
+	GetStored(key string) (io.ReadCloser, *models.StorageObject, error)
+	PutStored(key string, data io.Reader, form StoredForm, opts PutOptions) (*models.StorageObject, error)
+}
+
+// Copier is implemented by stores that can copy and rename objects without the data
+// passing through the caller
+type Copier interface {
+	Copy(srcKey, dstKey string, opts CopyOptions) (*models.StorageObject, error)
+	Rename(srcKey, dstKey string, opts CopyOptions) (*models.StorageObject, error)
+}
+
+// BatchDeleter is implemented by stores that can delete many objects at once more cheaply
+// than one at a time
+type BatchDeleter interface {
+	DeleteBatch(keys []string, actor string) map[string]error
+}
+
+// TierMigrator is implemented by stores that can move an object's data between tiers
+type TierMigrator interface {
+	SetTier(key, tier, actor string) (*models.StorageObject, error)
+}
+
+// TierReadReporter is implemented by stores that keep track of how long reads of each
+// tier's objects take
+type TierReadReporter interface {
+	TierReads() map[string]TierReads
+}
+
+// Appender is implemented by stores that can add data to the end of an object without it
+// being uploaded again
+type Appender interface {
+	AppendWithOptions(key string, data io.Reader, opts AppendOptions) (*models.StorageObject, error)
+}
+
+var (
+	_ Store            = (*FileStore)(nil)
+	_ Checker          = (*FileStore)(nil)
+	_ Deduplicator     = (*FileStore)(nil)
+	_ Bucketer         = (*FileStore)(nil)
+	_ Limiter          = (*FileStore)(nil)
+	_ Encrypter        = (*FileStore)(nil)
+	_ StoredCopier     = (*FileStore)(nil)
+	_ Verifier         = (*FileStore)(nil)
+	_ Collector        = (*FileStore)(nil)
+	_ Copier           = (*FileStore)(nil)
+	_ BatchDeleter     = (*FileStore)(nil)
+	_ TierMigrator     = (*FileStore)(nil)
+	_ Appender         = (*FileStore)(nil)
+	_ Cacher           = (*FileStore)(nil)
+	_ TierReporter     = (*FileStore)(nil)
+	_ ReplicaRecorder  = (*FileStore)(nil)
+	_ ConflictRecorder = (*FileStore)(nil)
+	_ DataRestorer     = (*FileStore)(nil)
+	_ NodeNamer        = (*FileStore)(nil)
+	_ NodeNamer        = (*S3Store)(nil)
+	_ Store            = (*TieredStore)(nil)
+	_ TierMigrator     = (*TieredStore)(nil)
+	_ TierReadReporter = (*TieredStore)(nil)
+	_ NodeNamer        = (*TieredStore)(nil)
+	_ Store            = (*MemStore)(nil)
+	_ Store            = (*S3Store)(nil)
+)
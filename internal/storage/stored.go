@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// A data file holds an object's bytes in their stored form: gzipped when ContentEncoding
+// is gzip, then encrypted when KeyID is set. Everything that reads or writes data files
+// other than as raw bytes goes through openStored and newStoredWriter.
+
+// storedSize is how many bytes obj's data file should have on disk
+func storedSize(obj *models.StorageObject) int64 {
+	if obj.ContentEncoding == encodingGzip || obj.KeyID != "" {
+		return obj.StoredSize
+	}
+	return obj.Size
+}
+
+// openObjectData reads n bytes (all of them if n is negative) of obj's original data,
+// starting at start. Reads stop at obj's size, past which an append may be under way. The
+// caller holds the lock.
+func (fs *FileStore) openObjectData(obj *models.StorageObject, start, n int64) (io.ReadCloser, error) {
+	key, err := fs.unwrapKey(obj)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n = max(obj.Size-start, 0)
+	}
+	return openStored(obj.Replicas[0].FilePath, obj.ContentEncoding == encodingGzip, key, start, n)
+}
+
+// dataChecksum hashes the original bytes of obj. The caller holds the lock.
+func (fs *FileStore) dataChecksum(obj *models.StorageObject) (string, error) {
+	reader, err := fs.openObjectData(obj, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return Checksum(obj.ChecksumAlgorithm, reader)
+}
+
+type storedReadCloser struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *storedReadCloser) Close() error { return s.file.Close() }
+
+// openStored reads n bytes (all of them if n is negative) of the original data in the data
+// file at path, starting at start; key is nil unless the file is encrypted. Gzip can't
+// seek, so in a compressed file the bytes before start are decoded and skipped.
+func openStored(path string, compressed bool, key []byte, start, n int64) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if !compressed && key == nil && start == 0 && n < 0 {
+		return file, nil
+	}
+	fail := func(err error) (io.ReadCloser, error) {
+		file.Close()
+		return nil, fmt.Errorf("failed to read data file: %v", err)
+	}
+
+	var reader io.Reader = file
+	skip := start
+	switch {
+	case key != nil:
+		var chunk int64
+		if !compressed {
+			chunk = start / encryptedChunk
+			if _, err := file.Seek(chunk*(encryptedChunk+gcmOverhead), io.SeekStart); err != nil {
+				return fail(err)
+			}
+			skip = start - chunk*encryptedChunk
+		}
+		if reader, err = newDecryptReader(file, key, uint64(chunk)); err != nil {
+			return fail(err)
+		}
+	case !compressed:
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return fail(err)
+		}
+		skip = 0
+	}
+	if compressed {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			return fail(err)
+		}
+		reader = zr
+	}
+	if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+		return fail(err)
+	}
+	if n >= 0 {
+		reader = io.LimitReader(reader, n)
+	}
+	return &storedReadCloser{Reader: reader, file: file}, nil
+}
+
+// storedWriter turns original bytes into their stored form. Close flushes it but leaves
+// the destination open.
+type storedWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func newStoredWriter(dst io.Writer, compressed bool, key []byte) (*storedWriter, error) {
+	w := &storedWriter{Writer: dst}
+	if key != nil {
+		enc, err := newEncryptWriter(dst, key)
+		if err != nil {
+			return nil, err
+		}
+		w.Writer = enc
+		w.closers = append(w.closers, enc)
+	}
+	if compressed {
+		zw := gzip.NewWriter(w.Writer)
+		w.Writer = zw
+		w.closers = append([]io.Closer{zw}, w.closers...)
+	}
+	return w, nil
+}
+
+func (w *storedWriter) Close() error {
+	for _, c := range w.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteStored copies the data file at src into a new file next to it, compressed or not
+// as asked and encrypted with dstKey if set. It returns the new path, the size of the
+// original data and the size of the new file.
+func rewriteStored(src string, srcCompressed bool, srcKey []byte, suffix string, compressed bool, dstKey []byte) (string, int64, int64, error) {
+	reader, err := openStored(src, srcCompressed, srcKey, 0, -1)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer reader.Close()
+
+	out, err := createBeside(src, suffix)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	dst := out.Name()
+	writer, err := newStoredWriter(out, compressed, dstKey)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return "", 0, 0, err
+	}
+	size, err := io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", 0, 0, err
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		os.Remove(dst)
+		return "", 0, 0, err
+	}
+	return dst, size, info.Size(), nil
+}
+
+// createBeside creates a new data file in the same directory as the one at src, named
+// after the same object ID. Names are unique so concurrent rewrites can't collide.
+func createBeside(src, suffix string) (*os.File, error) {
+	id, _, _ := strings.Cut(filepath.Base(src), ".")
+	file, err := os.CreateTemp(filepath.Dir(src), id+".*"+suffix)
+	if err != nil {
+		return nil, err
+	}
+	file.Chmod(0644)
+	return file, nil
+}
+
+// ReadData opens the original bytes of key's current version straight from its data file,
+// past the cache and without counting an access
+func (fs *FileStore) ReadData(key string) (io.ReadCloser, *models.StorageObject, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	obj, exists := fs.objects[key]
+	if !exists || fs.expired(obj) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if obj.Replicas[0].Status == replicaFailed {
+		return nil, nil, &CorruptionError{Key: key, Path: obj.Replicas[0].FilePath,
+			Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum)}
+	}
+	reader, err := fs.openObjectData(obj, 0, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat := *obj
+	return reader, &stat, nil
+}
+
+// GetStored opens key's data file exactly as it is stored, compressed and encrypted as the
+// returned object says, without counting an access. Replicas are made from this, so peers
+// holding them don't need the master key unless they serve reads.
+func (fs *FileStore) GetStored(key string) (io.ReadCloser, *models.StorageObject, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	obj, exists := fs.objects[key]
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	file, err := os.Open(obj.Replicas[0].FilePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	stored := *obj
+	return &storedReadCloser{Reader: io.LimitReader(file, storedSize(obj)), file: file}, &stored, nil
+}
+
+// EncryptionAlgorithm is how data files are encrypted: AES-256-GCM in chunks, with a data
+// key of each object's own, see newEncryptWriter
+const EncryptionAlgorithm = "aes-256-gcm"
+
+// ErrInvalidStoredForm is returned by PutStored for a stored form this store can't keep
+var ErrInvalidStoredForm = errors.New("invalid stored form")
+
+// StoredForm is how the bytes in a data file differ from the object's original ones, as
+// GetStored hands them out. KeyID names the master key that wraps WrappedKey, the data key
+// the file is encrypted with; StoredSize is the length of the file when it is compressed or
+// encrypted.
+type StoredForm struct {
+	ContentEncoding string
+	StoredSize      int64
+	KeyID           string
+	WrappedKey      string
+}
+
+// StoredFormOf is the form obj's data file is in
+func StoredFormOf(obj *models.StorageObject) StoredForm {
+	return StoredForm{ContentEncoding: obj.ContentEncoding, StoredSize: obj.StoredSize, KeyID: obj.KeyID, WrappedKey: obj.WrappedKey}
+}
+
+// PutStored makes data, already in the stored form given (as handed out by GetStored on a
+// peer), the current version of key. The object's size and checksum are opts.ExpectedSize
+// and opts.ExpectedChecksum, which are recorded as they are: only the length of data is
+// checked, since checking its checksum may need a master key this node doesn't have.
+// Otherwise opts work as they do for PutWithOptions. A compressed copy is kept cold.
+func (fs *FileStore) PutStored(key string, data io.Reader, form StoredForm, opts PutOptions) (*models.StorageObject, error) {
+	switch form.ContentEncoding {
+	case "", encodingIdentity:
+	case encodingGzip:
+		if opts.StorageTier == "" {
+			opts.StorageTier = TierCold
+		}
+	default:
+		return nil, fmt.Errorf("%w: content encoding %q", ErrInvalidStoredForm, form.ContentEncoding)
+	}
+	if (form.KeyID == "") != (form.WrappedKey == "") {
+		return nil, fmt.Errorf("%w: an encrypted copy needs both its key ID and wrapped key", ErrInvalidStoredForm)
+	}
+	tier, err := putTier(opts)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := putMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkObjectID(opts.ObjectID); err != nil {
+		return nil, err
+	}
+	if err := ValidateChecksumAlgorithm(opts.ChecksumAlgorithm); err != nil {
+		return nil, err
+	}
+	described := &models.StorageObject{Size: opts.ExpectedSize, ContentEncoding: form.ContentEncoding,
+		StoredSize: form.StoredSize, KeyID: form.KeyID}
+	expected := storedSize(described)
+
+	// Written without the lock like PutWithOptions, and checked again at commit
+	bucket, _ := SplitObjectName(key)
+	objectID := newObjectID(key)
+	fs.mutex.RLock()
+	filePath := fs.tierDataPath(bucket, tier, fs.storedObjectID(objectID, fs.objects[key], opts))
+	err = fs.checkWritable()
+	if err == nil {
+		err = fs.checkBucket(bucket)
+	}
+	if err == nil {
+		err = checkPreconditions(key, fs.objects[key], opts)
+	}
+	room := fs.quotaRoom(fs.objects[key], opts.Owner)
+	fs.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if room >= 0 && opts.ExpectedSize > room {
+		return nil, fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, opts.ExpectedSize, room)
+	}
+
+	file, err := createTemp(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	tmp := file.Name()
+	n, err := io.Copy(file, io.LimitReader(data, expected+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	if n != expected {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("%w: expected %d stored bytes, received %d", ErrIncompleteUpload, expected, n)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	previous := fs.objects[key]
+	err = fs.checkWritable()
+	if err == nil {
+		err = fs.checkBucket(bucket)
+	}
+	if err == nil {
+		err = checkPreconditions(key, previous, opts)
+	}
+	if room := fs.quotaRoom(previous, opts.Owner); err == nil && room >= 0 && opts.ExpectedSize > room {
+		err = fmt.Errorf("%w: %d bytes won't fit in the %d left", ErrQuotaExceeded, opts.ExpectedSize, room)
+	}
+	if err == nil {
+		suffix := ""
+		if form.ContentEncoding == encodingGzip {
+			suffix = ".gz"
+		}
+		filePath, err = fs.placeData(tmp, bucket, tier, fs.storedObjectID(objectID, previous, opts), suffix)
+		if err != nil {
+			err = fmt.Errorf("failed to write data: %v", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	stored := &models.StorageObject{
+		ID:                fs.storedObjectID(objectID, previous, opts),
+		Key:               key,
+		Bucket:            bucket,
+		Size:              opts.ExpectedSize,
+		ContentType:       opts.ContentType,
+		Checksum:          strings.ToLower(opts.ExpectedChecksum),
+		ChecksumAlgorithm: opts.ChecksumAlgorithm,
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+		LastAccess:        time.Now(),
+		Metadata:          metadata,
+		StorageTier:       tier,
+		Version:           1,
+		Owner:             opts.Owner,
+		ExpiresAt:         opts.ExpiresAt,
+		ContentEncoding:   form.ContentEncoding,
+		StoredSize:        form.StoredSize,
+		KeyID:             form.KeyID,
+		WrappedKey:        form.WrappedKey,
+		ReplicationFactor: opts.ReplicationFactor,
+		Stamp:             opts.Stamp,
+		Replicas:          []models.ReplicaInfo{{NodeID: fs.nodeID, FilePath: filePath, Status: replicaActive}},
+	}
+	if previous != nil {
+		stored.Version = previous.Version + 1
+		stored.Owner = previous.Owner
+	}
+	fs.inherit(stored, previous)
+	if err := fs.commitPut(stored, previous, opts.Actor); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// TieredStore keeps each tier's objects in a backend of its own, such as hot and warm on
+// local disk and cold in an S3 bucket. Each object lives in one backend at a time; which
+// one is kept in an index built from the backends' own catalogs when the store is opened,
+// so an object moved by MoveTier is read from wherever its data is now.
+type TieredStore struct {
+	tiers    map[string]Store // by tier
+	backends []Store          // each once, hot's first
+
+	mutex sync.RWMutex
+	index map[string]Store // which backend holds each key
+
+	keys  *appendLocks // serializes the writes to each key, across backends
+	reads map[string]*tierReads
+}
+
+// TierReads is how many reads of a tier's objects were started, and how long they took on
+// average to be served
+type TierReads struct {
+	Reads          int64   `json:"reads"`
+	AverageLatency float64 `json:"average_latency_ms"`
+}
+
+type tierReads struct {
+	reads   atomic.Int64
+	latency atomic.Int64 // nanoseconds, summed over the reads
+}
+
+// NewTieredStore routes every tier to the backend tiers gives it. Tiers may share a
+// backend. An object found in more than one, left behind by a move that stopped short of
+// deleting its old copy, is served from whichever has it newest.
+func NewTieredStore(tiers map[string]Store) (*TieredStore, error) {
+	t := &TieredStore{
+		tiers: make(map[string]Store),
+		index: make(map[string]Store),
+		keys:  newAppendLocks(),
+		reads: make(map[string]*tierReads),
+	}
+	for _, tier := range []string{TierHot, TierWarm, TierCold} {
+		backend := tiers[tier]
+		if backend == nil {
+			return nil, fmt.Errorf("no backend for the %s tier", tier)
+		}
+		t.tiers[tier] = backend
+		t.reads[tier] = &tierReads{}
+		if !t.has(backend) {
+			t.backends = append(t.backends, backend)
+		}
+	}
+	for tier := range tiers {
+		if err := ValidateTier(tier); err != nil {
+			return nil, err
+		}
+	}
+
+	newest := make(map[string]*models.StorageObject)
+	for _, backend := range t.backends {
+		for key, obj := range backend.List() {
+			if current, exists := newest[key]; exists && !obj.UpdatedAt.After(current.UpdatedAt) {
+				continue
+			}
+			newest[key] = obj
+			t.index[key] = backend
+		}
+	}
+	return t, nil
+}
+
+func (t *TieredStore) has(backend Store) bool {
+	for _, b := range t.backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// holder returns the backend key's object lives in, nil if none
+func (t *TieredStore) holder(key string) Store {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.index[key]
+}
+
+func (t *TieredStore) setHolder(key string, backend Store) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if backend == nil {
+		delete(t.index, key)
+	} else {
+		t.index[key] = backend
+	}
+}
+
+func (t *TieredStore) Put(key string, data io.Reader, contentType string) (*models.StorageObject, error) {
+	return t.PutWithOptions(key, data, PutOptions{ContentType: contentType})
+}
+
+// PutWithOptions writes to the backend of the tier asked for. Replacing an object held
+// by another backend checks the preconditions against it, and deletes it once the new one
+// is written.
+func (t *TieredStore) PutWithOptions(key string, data io.Reader, opts PutOptions) (*models.StorageObject, error) {
+	tier, err := putTier(opts)
+	if err != nil {
+		return nil, err
+	}
+	target := t.tiers[tier]
+
+	unlock := t.keys.lock(key)
+	defer unlock()
+
+	source := t.holder(key)
+	if source == nil || source == target {
+		obj, err := target.PutWithOptions(key, data, opts)
+		if err != nil {
+			return nil, err
+		}
+		t.setHolder(key, target)
+		return obj, nil
+	}
+
+	previous, err := source.Stat(key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return nil, err
+	}
+	if previous != nil {
+		if err := checkPreconditions(key, previous, opts); err != nil {
+			return nil, err
+		}
+		opts.Owner = previous.Owner
+	}
+	opts.IfVersion, opts.IfMatch, opts.IfNoneMatch = nil, nil, nil
+	obj, err := target.PutWithOptions(key, data, opts)
+	if err != nil {
+		return nil, err
+	}
+	t.setHolder(key, target)
+	t.dropCopy(source, key, opts.Actor)
+	return obj, nil
+}
+
+// dropCopy deletes key's old copy from backend after the object has moved elsewhere. One
+// that can't be deleted is only logged: the object is served from its new backend, and
+// the stale copy loses to it when the store is next opened.
+func (t *TieredStore) dropCopy(backend Store, key, actor string) {
+	err := backend.DeleteWithOptions(key, DeleteOptions{Actor: actor})
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		log.Printf("Failed to delete the old copy of %s after moving it: %v", key, err)
+	}
+}
+
+func (t *TieredStore) Get(key string) (io.ReadCloser, *models.StorageObject, error) {
+	return t.GetWithOptions(key, GetOptions{})
+}
+
+// GetWithOptions reads from the backend holding key, trying again where it has moved to
+// if it moved in between
+func (t *TieredStore) GetWithOptions(key string, opts GetOptions) (io.ReadCloser, *models.StorageObject, error) {
+	started := time.Now()
+	for attempt := 0; ; attempt++ {
+		backend := t.holder(key)
+		if backend == nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		reader, obj, err := backend.GetWithOptions(key, opts)
+		if errors.Is(err, ErrObjectNotFound) && attempt == 0 && t.holder(key) != backend {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if reads, ok := t.reads[obj.StorageTier]; ok {
+			reads.reads.Add(1)
+			reads.latency.Add(int64(time.Since(started)))
+		}
+		return reader, obj, nil
+	}
+}
+
+// TierReads reports the reads served from each tier since the store was opened
+func (t *TieredStore) TierReads() map[string]TierReads {
+	stats := make(map[string]TierReads, len(t.reads))
+	for tier, reads := range t.reads {
+		n := reads.reads.Load()
+		stats[tier] = TierReads{Reads: n}
+		if n > 0 {
+			stats[tier] = TierReads{Reads: n, AverageLatency: float64(reads.latency.Load()) / float64(n) / float64(time.Millisecond)}
+		}
+	}
+	return stats
+}
+
+func (t *TieredStore) Stat(key string) (*models.StorageObject, error) {
+	backend := t.holder(key)
+	if backend == nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return backend.Stat(key)
+}
+
+// ReadData reads key from whichever backend holds it, without counting a read of its tier
+func (t *TieredStore) ReadData(key string) (io.ReadCloser, *models.StorageObject, error) {
+	for attempt := 0; ; attempt++ {
+		backend := t.holder(key)
+		if backend == nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		reader, obj, err := backend.ReadData(key)
+		if errors.Is(err, ErrObjectNotFound) && attempt == 0 && t.holder(key) != backend {
+			continue
+		}
+		return reader, obj, err
+	}
+}
+
+func (t *TieredStore) Delete(key string) error {
+	return t.DeleteWithOptions(key, DeleteOptions{})
+}
+
+func (t *TieredStore) DeleteWithOptions(key string, opts DeleteOptions) error {
+	unlock := t.keys.lock(key)
+	defer unlock()
+
+	backend := t.holder(key)
+	if backend == nil {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err := backend.DeleteWithOptions(key, opts); err != nil {
+		return err
+	}
+	// Deleting one of its old versions leaves the object where it is
+	if _, err := backend.Stat(key); errors.Is(err, ErrObjectNotFound) {
+		t.setHolder(key, nil)
+	}
+	return nil
+}
+
+// List returns the objects of every backend, each from the one that holds it
+func (t *TieredStore) List() map[string]*models.StorageObject {
+	objects := make(map[string]*models.StorageObject)
+	for _, backend := range t.backends {
+		for key, obj := range backend.List() {
+			if holder := t.holder(key); holder != nil && holder != backend {
+				continue
+			}
+			objects[key] = obj
+		}
+	}
+	return objects
+}
+
+func (t *TieredStore) ListWithOptions(opts ListOptions) (*ListResult, error) {
+	return ListPage(t.List(), opts)
+}
+
+func (t *TieredStore) ListVersions(key string) ([]*models.StorageObject, error) {
+	backend := t.holder(key)
+	if backend == nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return backend.ListVersions(key)
+}
+
+func (t *TieredStore) SetOwner(key, owner, actor string) (*models.StorageObject, error) {
+	unlock := t.keys.lock(key)
+	defer unlock()
+
+	backend := t.holder(key)
+	if backend == nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return backend.SetOwner(key, owner, actor)
+}
+
+func (t *TieredStore) BackfillOwner(prefix, owner, actor string) (int, error) {
+	total := 0
+	for _, backend := range t.backends {
+		n, err := backend.BackfillOwner(prefix, owner, actor)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (t *TieredStore) UsageByOwner() map[string]OwnerUsage {
+	usage := make(map[string]OwnerUsage)
+	for _, backend := range t.backends {
+		for owner, u := range backend.UsageByOwner() {
+			total := usage[owner]
+			total.Objects += u.Objects
+			total.Bytes += u.Bytes
+			usage[owner] = total
+		}
+	}
+	return usage
+}
+
+func (t *TieredStore) SetUsageObserver(fn UsageObserver) {
+	for _, backend := range t.backends {
+		backend.SetUsageObserver(fn)
+	}
+}
+
+func (t *TieredStore) SetReadOnly(enabled bool) {
+	for _, backend := range t.backends {
+		backend.SetReadOnly(enabled)
+	}
+}
+
+func (t *TieredStore) ReadOnly() bool {
+	return t.backends[0].ReadOnly()
+}
+
+// Journal returns nil: each backend journals, if at all, only its own objects
+func (t *TieredStore) Journal() *journal.Journal {
+	return nil
+}
+
+// SetTier moves key to tier, see MoveTier
+func (t *TieredStore) SetTier(key, tier, actor string) (*models.StorageObject, error) {
+	return t.MoveTier(key, tier, actor)
+}
+
+// MoveTier moves key to tier. Between backends its data is copied to the new one, which
+// has to hash it to the checksum it had before the copy counts, and only then is the old
+// copy deleted; until that point the object is read from where it was, and a failed move
+// leaves it there. Within a backend that moves tiers itself, the move is left to it.
+func (t *TieredStore) MoveTier(key, tier, actor string) (*models.StorageObject, error) {
+	if err := ValidateTier(tier); err != nil {
+		return nil, err
+	}
+	target := t.tiers[tier]
+
+	unlock := t.keys.lock(key)
+	defer unlock()
+
+	source := t.holder(key)
+	if source == nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if migrator, ok := source.(TierMigrator); ok && source == target {
+		return migrator.SetTier(key, tier, actor)
+	}
+
+	reader, obj, err := source.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if source == target && obj.StorageTier == tier {
+		return obj, nil
+	}
+
+	opts := PutOptions{
+		ContentType:       obj.ContentType,
+		ChecksumAlgorithm: obj.ChecksumAlgorithm,
+		ExpectedChecksum:  obj.Checksum,
+		ExpectedSize:      obj.Size,
+		Owner:             obj.Owner,
+		Actor:             actor,
+		ExpiresAt:         obj.ExpiresAt,
+		StorageTier:       tier,
+		Metadata:          obj.Metadata,
+		ObjectID:          obj.ID,
+		ReplicationFactor: obj.ReplicationFactor,
+		Stamp:             obj.Stamp,
+	}
+	if source == target {
+		// Rewritten in place, so only if nothing was written to it in between
+		version := obj.Version
+		opts.IfVersion = &version
+	}
+	moved, err := target.PutWithOptions(key, reader, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move %s to the %s tier: %w", key, tier, err)
+	}
+	if !strings.EqualFold(moved.Checksum, obj.Checksum) {
+		// The backend took the data without checking it against the checksum
+		if source != target {
+			t.dropCopy(target, key, actor)
+		}
+		return nil, fmt.Errorf("%w: %s moved to the %s tier as %s, expected %s", ErrChecksumMismatch, key, tier,
+			FormatChecksum(moved.ChecksumAlgorithm, moved.Checksum), FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum))
+	}
+	if source != target {
+		t.setHolder(key, target)
+		t.dropCopy(source, key, actor)
+	}
+	return moved, nil
+}
+
+// SetDefaultChecksum sets the algorithm used when a write doesn't ask for one, in every
+// backend that has a default
+func (t *TieredStore) SetDefaultChecksum(algorithm string) error {
+	for _, backend := range t.backends {
+		if setter, ok := backend.(interface{ SetDefaultChecksum(string) error }); ok {
+			if err := setter.SetDefaultChecksum(algorithm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetNodeID passes id on to the backends that record it, see NodeNamer
+func (t *TieredStore) SetNodeID(id string) {
+	for _, backend := range t.backends {
+		if named, ok := backend.(NodeNamer); ok {
+			named.SetNodeID(id)
+		}
+	}
+}
+
+type component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Start starts the backends that have background work
+func (t *TieredStore) Start(ctx context.Context) error {
+	for _, backend := range t.backends {
+		if c, ok := backend.(component); ok {
+			if err := c.Start(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stop stops every backend, reporting the first that fails
+func (t *TieredStore) Stop(ctx context.Context) error {
+	var first error
+	for _, backend := range t.backends {
+		if c, ok := backend.(component); ok {
+			if err := c.Stop(ctx); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
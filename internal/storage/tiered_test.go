@@ -0,0 +1,172 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// brokenStore is a MemStore whose writes fail, or with corrupt set store other data than
+// they were given
+type brokenStore struct {
+	*storage.MemStore
+	corrupt bool
+}
+
+func (b *brokenStore) PutWithOptions(key string, data io.Reader, opts storage.PutOptions) (*models.StorageObject, error) {
+	if !b.corrupt {
+		return nil, errors.New("backend unavailable")
+	}
+	return b.MemStore.PutWithOptions(key, io.MultiReader(data, strings.NewReader("!")), opts)
+}
+
+func newTiered(t *testing.T, hot, cold storage.Store) *storage.TieredStore {
+	t.Helper()
+	tiered, err := storage.NewTieredStore(map[string]storage.Store{
+		storage.TierHot:  hot,
+		storage.TierWarm: hot,
+		storage.TierCold: cold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tiered
+}
+
+func readAll(t *testing.T, store storage.Store, key string) (string, *models.StorageObject) {
+	t.Helper()
+	reader, obj, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data), obj
+}
+
+func TestTieredStoreConformance(t *testing.T) {
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		_, server := newFakeS3(t)
+		return newTiered(t, openFileStore(t, storage.MetadataJSON), openS3Store(t, server))
+	})
+}
+
+// Between a FileStore and an S3Store, the data has to come out of one decoded and be
+// checked going into the other
+func TestTieredMoveTierFileToS3(t *testing.T) {
+	_, server := newFakeS3(t)
+	hot, cold := openFileStore(t, storage.MetadataJSON), openS3Store(t, server)
+	tiered := newTiered(t, hot, cold)
+
+	put := storagetest.Put(t, tiered, "archive", strings.Repeat("old records ", 1000), storage.PutOptions{StorageTier: storage.TierWarm})
+	moved, err := tiered.MoveTier("archive", storage.TierCold, "test")
+	if err != nil {
+		t.Fatalf("MoveTier: %v", err)
+	}
+	if moved.Checksum != put.Checksum {
+		t.Errorf("moved checksum %s, want %s", moved.Checksum, put.Checksum)
+	}
+	if _, err := hot.Stat("archive"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("FileStore still holds the object after the move: %v", err)
+	}
+	if data, obj := readAll(t, tiered, "archive"); data != strings.Repeat("old records ", 1000) || obj.StorageTier != storage.TierCold {
+		t.Errorf("Get after the move read %d bytes from %s, want the data from cold", len(data), obj.StorageTier)
+	}
+
+	// Reopened over the same backends, it still finds the object where it went
+	reopened := newTiered(t, hot, cold)
+	if _, obj := readAll(t, reopened, "archive"); obj.StorageTier != storage.TierCold {
+		t.Errorf("after reopening the object is read from %s, want cold", obj.StorageTier)
+	}
+}
+
+func TestTieredMoveTier(t *testing.T) {
+	hot, cold := storage.NewMemStore(), storage.NewMemStore()
+	tiered := newTiered(t, hot, cold)
+
+	put, err := tiered.Put("report", strings.NewReader("quarterly numbers"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := tiered.MoveTier("report", storage.TierCold, "test")
+	if err != nil {
+		t.Fatalf("MoveTier: %v", err)
+	}
+	if moved.StorageTier != storage.TierCold || moved.ID != put.ID || moved.Checksum != put.Checksum {
+		t.Errorf("moved object = tier %s, ID %s, checksum %s; want cold, %s, %s",
+			moved.StorageTier, moved.ID, moved.Checksum, put.ID, put.Checksum)
+	}
+	if _, err := hot.Stat("report"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("hot backend still holds the object after the move: %v", err)
+	}
+	if _, err := cold.Stat("report"); err != nil {
+		t.Errorf("cold backend doesn't hold the object after the move: %v", err)
+	}
+	if data, obj := readAll(t, tiered, "report"); data != "quarterly numbers" || obj.StorageTier != storage.TierCold {
+		t.Errorf("Get after the move = %q from %s, want the data from cold", data, obj.StorageTier)
+	}
+	if reads := tiered.TierReads()[storage.TierCold]; reads.Reads != 1 {
+		t.Errorf("cold reads = %d, want 1", reads.Reads)
+	}
+
+	// Written without a tier, it goes back to hot and leaves cold
+	if _, err := tiered.Put("report", strings.NewReader("revised numbers"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cold.Stat("report"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("cold backend still holds the object after it was overwritten: %v", err)
+	}
+	if data, obj := readAll(t, tiered, "report"); data != "revised numbers" || obj.StorageTier != storage.TierHot {
+		t.Errorf("Get after the overwrite = %q from %s, want the new data from hot", data, obj.StorageTier)
+	}
+	if n := len(tiered.List()); n != 1 {
+		t.Errorf("List has %d objects, want 1", n)
+	}
+}
+
+func TestTieredMoveTierFailure(t *testing.T) {
+	for _, corrupt := range []bool{false, true} {
+		name := map[bool]string{false: "write fails", true: "data corrupted"}[corrupt]
+		t.Run(name, func(t *testing.T) {
+			hot := storage.NewMemStore()
+			cold := &brokenStore{MemStore: storage.NewMemStore(), corrupt: corrupt}
+			tiered := newTiered(t, hot, cold)
+
+			if _, err := tiered.Put("report", strings.NewReader("quarterly numbers"), "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tiered.MoveTier("report", storage.TierCold, "test"); err == nil {
+				t.Fatal("MoveTier succeeded against a broken backend")
+			}
+			if data, obj := readAll(t, tiered, "report"); data != "quarterly numbers" || obj.StorageTier != storage.TierHot {
+				t.Errorf("Get after the failed move = %q from %s, want the original data from hot", data, obj.StorageTier)
+			}
+			if _, err := cold.Stat("report"); !errors.Is(err, storage.ErrObjectNotFound) {
+				t.Errorf("cold backend holds a copy after the failed move: %v", err)
+			}
+		})
+	}
+}
+
+func TestTieredPreconditionsAcrossBackends(t *testing.T) {
+	tiered := newTiered(t, storage.NewMemStore(), storage.NewMemStore())
+	if _, err := tiered.PutWithOptions("report", strings.NewReader("v1"), storage.PutOptions{StorageTier: storage.TierCold}); err != nil {
+		t.Fatal(err)
+	}
+	stale := int64(7)
+	_, err := tiered.PutWithOptions("report", strings.NewReader("v2"), storage.PutOptions{IfVersion: &stale})
+	if !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("overwrite with a stale If-Version = %v, want ErrPreconditionFailed", err)
+	}
+	if data, obj := readAll(t, tiered, "report"); data != "v1" || obj.StorageTier != storage.TierCold {
+		t.Errorf("Get after the refused overwrite = %q from %s, want v1 from cold", data, obj.StorageTier)
+	}
+}
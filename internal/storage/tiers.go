@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// SetTierDirs gives tiers directories of their own, which may be on different mounts, by
+// tier name. Tiers without one keep their data in the store's own directories. Data
+// already written stays where it is until the object moves tier, see SetTier.
+//
+// GC and fsck treat every file under dir/data as the store's, so a tier directory must not
+// be shared with anything else.
+func (fs *FileStore) SetTierDirs(dirs map[string]string) error {
+	tierDirs := make(map[string]string)
+	for tier, dir := range dirs {
+		if err := ValidateTier(tier); err != nil {
+			return err
+		}
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dir, dataDir), 0755); err != nil {
+			return fmt.Errorf("failed to create %s tier directory: %v", tier, err)
+		}
+		tierDirs[tier] = filepath.Clean(dir)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.tierDirs = tierDirs
+	return nil
+}
+
+// MigrateTier moves key's data to targetTier's directory, see SetTier
+func (fs *FileStore) MigrateTier(key, targetTier string) error {
+	_, err := fs.SetTier(key, targetTier, "")
+	return err
+}
+
+// moveToTier gives the data file at path, encrypted with key, a second name in tier's
+// directory and checks it still hashes to obj's checksum, returning the new path, or path
+// itself if the file is already where the tier keeps its data. The old name is left for
+// the caller to remove once the object points at the new one, so reads carry on from it
+// meanwhile.
+func (fs *FileStore) moveToTier(obj *models.StorageObject, path, tier string, compressed bool, key []byte) (string, error) {
+	fs.mutex.RLock()
+	target := fs.tierDataPath(BucketOf(obj), tier, filepath.Base(path))
+	fs.mutex.RUnlock()
+	if filepath.Clean(target) == filepath.Clean(path) {
+		return path, nil
+	}
+
+	if err := linkData(path, target); err != nil {
+		return "", fmt.Errorf("failed to move data file: %v", err)
+	}
+	reader, err := openStored(target, compressed, key, 0, obj.Size)
+	if err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	checksum, err := Checksum(obj.ChecksumAlgorithm, reader)
+	reader.Close()
+	if err != nil || !strings.EqualFold(checksum, obj.Checksum) {
+		os.Remove(target)
+		corrupt := &CorruptionError{
+			Key:      obj.Key,
+			Path:     target,
+			Expected: FormatChecksum(obj.ChecksumAlgorithm, obj.Checksum),
+			Err:      err,
+		}
+		if err == nil {
+			corrupt.Actual = FormatChecksum(obj.ChecksumAlgorithm, checksum)
+		}
+		return "", corrupt
+	}
+	return target, nil
+}
+
+// unchanged reports whether current is still the object obj was read as. Flushing access
+// stats replaces the metadata without a new version, so that doesn't count.
+func unchanged(current, obj *models.StorageObject) bool {
+	return current != nil && current.ID == obj.ID && current.Version == obj.Version
+}
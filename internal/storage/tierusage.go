@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// TierUsage is what one storage tier holds, counting current objects only
+type TierUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// StoredBytes is what the objects take up on disk, compressed and encrypted. Data
+	// shared between keys counts once for each of them.
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
+// Usage returns the objects and bytes in each tier. The counts are kept up to date as
+// objects are written, deleted, appended to and moved between tiers, so this doesn't go
+// through the catalog.
+func (fs *FileStore) Usage() map[string]TierUsage {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	usage := make(map[string]TierUsage, len(fs.tierUsage))
+	for tier, u := range fs.tierUsage {
+		usage[tier] = u
+	}
+	return usage
+}
+
+// LargestObjects returns copies of the n largest current objects of each tier, largest
+// first. Unlike Usage it goes through every object.
+func (fs *FileStore) LargestObjects(n int) map[string][]*models.StorageObject {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	largest := make(map[string][]*models.StorageObject)
+	if n <= 0 {
+		return largest
+	}
+	for _, obj := range fs.objects {
+		top := largest[obj.StorageTier]
+		if len(top) == n && top[n-1].Size >= obj.Size {
+			continue
+		}
+		// Kept sorted, so obj goes in before the first smaller one
+		i := sort.Search(len(top), func(i int) bool { return top[i].Size < obj.Size })
+		if len(top) < n {
+			top = append(top, nil)
+		}
+		copy(top[i+1:], top[i:])
+		top[i] = obj
+		largest[obj.StorageTier] = top
+	}
+	for tier, top := range largest {
+		for i, obj := range top {
+			copied := *obj
+			top[i] = &copied
+		}
+		largest[tier] = top
+	}
+	return largest
+}
+
+// tally takes removed out of its tier's and its owner's usage and adds added to its tier's
+// and owner's, for an object that was replaced, deleted, created or changed in place;
+// either may be nil. The caller holds the lock.
+func (fs *FileStore) tally(removed, added *models.StorageObject) {
+	if removed != nil {
+		o := fs.ownerUsage[removed.Owner]
+		o.Objects--
+		o.Bytes -= removed.Size
+		fs.ownerUsage[removed.Owner] = o
+		if o == (OwnerUsage{}) {
+			delete(fs.ownerUsage, removed.Owner)
+		}
+
+		u := fs.tierUsage[removed.StorageTier]
+		u.Objects--
+		u.Bytes -= removed.Size
+		u.StoredBytes -= storedSize(removed)
+		fs.tierUsage[removed.StorageTier] = u
+		if u == (TierUsage{}) {
+			delete(fs.tierUsage, removed.StorageTier)
+		}
+	}
+	if added != nil {
+		o := fs.ownerUsage[added.Owner]
+		o.Objects++
+		o.Bytes += added.Size
+		fs.ownerUsage[added.Owner] = o
+		u := fs.tierUsage[added.StorageTier]
+		u.Objects++
+		u.Bytes += added.Size
+		u.StoredBytes += storedSize(added)
+		fs.tierUsage[added.StorageTier] = u
+	}
+}
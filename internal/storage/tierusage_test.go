@@ -0,0 +1,145 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// countUsage works out each tier's usage from a listing, the way Usage avoids doing
+func countUsage(objects map[string]*models.StorageObject) map[string]storage.TierUsage {
+	usage := make(map[string]storage.TierUsage)
+	for _, obj := range objects {
+		u := usage[obj.StorageTier]
+		u.Objects++
+		u.Bytes += obj.Size
+		stored := obj.Size
+		if obj.ContentEncoding == "gzip" || obj.KeyID != "" {
+			stored = obj.StoredSize
+		}
+		u.StoredBytes += stored
+		usage[obj.StorageTier] = u
+	}
+	return usage
+}
+
+// countOwnerUsage works out each owner's usage from a listing, the way UsageByOwner avoids
+// doing
+func countOwnerUsage(objects map[string]*models.StorageObject) map[string]storage.OwnerUsage {
+	usage := make(map[string]storage.OwnerUsage)
+	for _, obj := range objects {
+		u := usage[obj.Owner]
+		u.Objects++
+		u.Bytes += obj.Size
+		usage[obj.Owner] = u
+	}
+	return usage
+}
+
+func TestFileStoreTierUsageUnderConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	tiers := []string{storage.TierHot, storage.TierWarm, storage.TierCold}
+	owners := []string{"alice", "bob", "carol"}
+
+	// Writers overwrite, delete, move and reassign a handful of keys between them, while readers
+	// keep asking for the totals
+	const writers, ops, keys = 8, 60, 12
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("object-%d", random.Intn(keys))
+				tier := tiers[random.Intn(len(tiers))]
+				owner := owners[random.Intn(len(owners))]
+				var err error
+				switch random.Intn(5) {
+				case 0, 1:
+					data := strings.Repeat(string(rune('a'+w)), 1+random.Intn(4096))
+					_, err = fs.PutWithOptions(key, strings.NewReader(data), storage.PutOptions{StorageTier: tier, Owner: owner})
+				case 2:
+					err = fs.Delete(key)
+				case 3:
+					_, err = fs.SetTier(key, tier, "test")
+				case 4:
+					_, err = fs.SetOwner(key, owner, "test")
+				}
+				if err != nil && !errors.Is(err, storage.ErrObjectNotFound) && !errors.Is(err, storage.ErrPreconditionFailed) {
+					t.Errorf("writer %d: %v", w, err)
+				}
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				fs.Usage()
+				fs.UsageByOwner()
+				fs.LargestObjects(3)
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	want := countUsage(fs.List())
+	if len(want) < 2 {
+		t.Fatalf("only %v left, want objects in more than one tier", want)
+	}
+	if got := fs.Usage(); !maps.Equal(got, want) {
+		t.Errorf("Usage() = %v, the objects listed add up to %v", got, want)
+	}
+	wantOwners := countOwnerUsage(fs.List())
+	if len(wantOwners) < 2 {
+		t.Fatalf("only %v left, want objects of more than one owner", wantOwners)
+	}
+	if got := fs.UsageByOwner(); !maps.Equal(got, wantOwners) {
+		t.Errorf("UsageByOwner() = %v, the objects listed add up to %v", got, wantOwners)
+	}
+
+	// The largest of each tier are the listing's, largest first
+	sizes := make(map[string][]int64)
+	for _, obj := range fs.List() {
+		sizes[obj.StorageTier] = append(sizes[obj.StorageTier], obj.Size)
+	}
+	for tier, largest := range fs.LargestObjects(3) {
+		all := sizes[tier]
+		sort.Slice(all, func(i, j int) bool { return all[i] > all[j] })
+		for i, obj := range largest {
+			if obj.Size != all[i] {
+				t.Errorf("%s: largest #%d is %d bytes, want %d", tier, i+1, obj.Size, all[i])
+			}
+		}
+		if len(largest) != min(3, len(all)) {
+			t.Errorf("%s: %d largest objects of %d, want %d", tier, len(largest), len(all), min(3, len(all)))
+		}
+	}
+
+	// Counted again from the catalog after a restart, the same
+	fs = reopenFileStore(t, fs, dir)
+	if got := fs.Usage(); !maps.Equal(got, want) {
+		t.Errorf("after a restart Usage() = %v, want %v", got, want)
+	}
+	if got := fs.UsageByOwner(); !maps.Equal(got, wantOwners) {
+		t.Errorf("after a restart UsageByOwner() = %v, want %v", got, wantOwners)
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// MaxMetadataSize caps the user metadata of one object, names and values together
+const MaxMetadataSize = 2 << 10
+
+var ErrInvalidMetadata = errors.New("invalid user metadata")
+
+// ValidateMetadata checks user metadata fits in MaxMetadataSize and that its names are
+// lowercase, as they come back from the X-Meta-* headers
+func ValidateMetadata(meta map[string]string) error {
+	total := 0
+	for name, value := range meta {
+		if name == "" || name != strings.ToLower(name) {
+			return fmt.Errorf("%w: name %q must be lowercase and not empty", ErrInvalidMetadata, name)
+		}
+		total += len(name) + len(value)
+	}
+	if total > MaxMetadataSize {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrInvalidMetadata, total, MaxMetadataSize)
+	}
+	return nil
+}
+
+// putMetadata returns the user metadata a write asks for, copied so the caller's map can't
+// change it afterwards, or nil if there is none
+func putMetadata(opts PutOptions) (map[string]string, error) {
+	if len(opts.Metadata) == 0 {
+		return nil, nil
+	}
+	if err := ValidateMetadata(opts.Metadata); err != nil {
+		return nil, err
+	}
+	return maps.Clone(opts.Metadata), nil
+}
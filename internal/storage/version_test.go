@@ -0,0 +1,125 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/internal/storage/storagetest"
+)
+
+func TestFileStoreVersionCountsMutations(t *testing.T) {
+	dir := t.TempDir()
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+
+	obj := storagetest.Put(t, fs, "report", "first draft", storage.PutOptions{Owner: "alice"})
+	if obj.Version != 1 {
+		t.Fatalf("new object at version %d, want 1", obj.Version)
+	}
+
+	// Each kind of change moves it on by one, the same bytes uploaded again included
+	for i, step := range []struct {
+		name   string
+		mutate func() error
+	}{
+		{"overwrite", func() error {
+			_, err := fs.Put("report", strings.NewReader("second draft"), "text/plain")
+			return err
+		}},
+		{"same bytes again", func() error {
+			_, err := fs.Put("report", strings.NewReader("second draft"), "text/plain")
+			return err
+		}},
+		{"append", func() error {
+			_, err := fs.Append("report", strings.NewReader(", revised"))
+			return err
+		}},
+		{"owner change", func() error {
+			_, err := fs.SetOwner("report", "bob", "admin")
+			return err
+		}},
+		{"tier move", func() error {
+			_, err := fs.SetTier("report", "cold", "autotier")
+			return err
+		}},
+	} {
+		if err := step.mutate(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		obj, err := fs.Stat("report")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(i + 2); obj.Version != want {
+			t.Errorf("after %s at version %d, want %d", step.name, obj.Version, want)
+		}
+	}
+
+	// Reads don't count
+	storagetest.Read(t, fs, "report", storage.GetOptions{})
+	if obj, _ := fs.Stat("report"); obj.Version != 6 {
+		t.Errorf("read moved the version to %d", obj.Version)
+	}
+
+	// The version survives a restart
+	fs = reopenFileStore(t, fs, dir)
+	if obj, err := fs.Stat("report"); err != nil {
+		t.Fatal(err)
+	} else if obj.Version != 6 {
+		t.Errorf("after a restart at version %d, want 6", obj.Version)
+	}
+}
+
+func TestFileStoreVersionPreconditions(t *testing.T) {
+	fs := openFileStore(t, storage.MetadataJSON)
+	version := func(v int64) *int64 { return &v }
+
+	// 0 means the key must not exist
+	storagetest.Put(t, fs, "report", "first draft", storage.PutOptions{IfVersion: version(0)})
+	if _, err := fs.PutWithOptions("report", strings.NewReader("again"), storage.PutOptions{IfVersion: version(0)}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("create-only put over an existing object: %v, want precondition failed", err)
+	}
+
+	// A stale version fails and changes nothing; the current one goes through
+	if _, err := fs.PutWithOptions("report", strings.NewReader("lost update"), storage.PutOptions{IfVersion: version(2)}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("put at version 2 over version 1: %v, want precondition failed", err)
+	}
+	storagetest.Put(t, fs, "report", "second draft", storage.PutOptions{IfVersion: version(1)})
+	if data, obj := storagetest.Read(t, fs, "report", storage.GetOptions{}); data != "second draft" || obj.Version != 2 {
+		t.Errorf("report = %q at version %d, want the second draft at 2", data, obj.Version)
+	}
+
+	if err := fs.DeleteWithOptions("report", storage.DeleteOptions{IfVersion: version(1)}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("delete at a stale version: %v, want precondition failed", err)
+	}
+	if err := fs.DeleteWithOptions("report", storage.DeleteOptions{IfVersion: version(2)}); err != nil {
+		t.Errorf("delete at the current version: %v", err)
+	}
+	if _, err := fs.Stat("report"); err == nil {
+		t.Error("report still there after deleting it")
+	}
+}
+
+func TestFileStoreObjectsBeforeVersioningAreVersionOne(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	if err := os.MkdirAll(metadataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"report": {"id": "0123", "key": "report", "size": 11, "storage_tier": "hot"}}`
+	if err := os.WriteFile(filepath.Join(metadataDir, "objects.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openFileStoreIn(t, dir, storage.MetadataJSON)
+	obj, err := fs.Stat("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Version != 1 {
+		t.Errorf("legacy object at version %d, want 1", obj.Version)
+	}
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/journal"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// NullVersionID names the version of an object written while versioning was off
+const NullVersionID = "null"
+
+// ErrDeleteMarker is returned when the version asked for is a delete marker, which has no data
+var ErrDeleteMarker = errors.New("version is a delete marker")
+
+// SetVersioning turns object versioning on or off. While on, overwrites and deletes keep
+// the previous data; turning it off keeps the versions already recorded.
+func (fs *FileStore) SetVersioning(enabled bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.versioning = enabled
+}
+
+// ListVersions returns every version of key, newest first. A delete marker first in the
+// list means the key currently reads as deleted.
+func (fs *FileStore) ListVersions(key string) ([]*models.StorageObject, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	current, exists := fs.objects[key]
+	older := fs.versions[key]
+	if !exists && len(older) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+
+	versions := make([]*models.StorageObject, 0, len(older)+1)
+	if exists {
+		versions = append(versions, current)
+	}
+	for i := len(older) - 1; i >= 0; i-- {
+		versions = append(versions, older[i])
+	}
+	return versions, nil
+}
+
+// nextVersionID returns a timestamp-based ID that sorts after every earlier one
+func (fs *FileStore) nextVersionID() string {
+	now := time.Now().UnixNano()
+	if now <= fs.lastVersionID {
+		now = fs.lastVersionID + 1
+	}
+	fs.lastVersionID = now
+	return fmt.Sprintf("%016x", now)
+}
+
+// lookupVersion finds one version of key; an empty versionID means the current one
+func (fs *FileStore) lookupVersion(key, versionID string) (*models.StorageObject, error) {
+	current, exists := fs.objects[key]
+	if versionID == "" {
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return current, nil
+	}
+
+	if exists && versionIDOf(current) == versionID {
+		return current, nil
+	}
+	for _, obj := range fs.versions[key] {
+		if obj.VersionID != versionID {
+			continue
+		}
+		if obj.DeleteMarker {
+			return nil, fmt.Errorf("%w: %s of %s", ErrDeleteMarker, versionID, key)
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, versionID, key)
+}
+
+func versionIDOf(obj *models.StorageObject) string {
+	if obj.VersionID == "" {
+		return NullVersionID
+	}
+	return obj.VersionID
+}
+
+// archive keeps obj, which is being replaced, as the newest noncurrent version
+func (fs *FileStore) archive(obj *models.StorageObject) {
+	archived := *obj
+	archived.VersionID = versionIDOf(obj)
+	fs.versions[obj.Key] = append(fs.versions[obj.Key], &archived)
+}
+
+// restore puts key's current object and version history back after a failed save
+func (fs *FileStore) restore(key string, current *models.StorageObject, versions []*models.StorageObject) {
+	if current != nil {
+		fs.objects[key] = current
+	} else {
+		delete(fs.objects, key)
+	}
+	if len(versions) > 0 {
+		fs.versions[key] = versions
+	} else {
+		delete(fs.versions, key)
+	}
+}
+
+// addDeleteMarker hides the current version behind a delete marker, keeping its data
+func (fs *FileStore) addDeleteMarker(obj *models.StorageObject, actor string) error {
+	versions := fs.versions[obj.Key]
+	fs.appendDeleteMarker(obj)
+
+	if err := fs.saveVersions(); err != nil {
+		fs.restore(obj.Key, obj, versions)
+		return err
+	}
+	if err := fs.removeObjectMeta(obj); err != nil {
+		fs.restore(obj.Key, obj, versions)
+		fs.saveVersions()
+		return err
+	}
+	delete(fs.objects, obj.Key)
+	fs.uncache(obj.Key)
+	fs.tally(obj, nil)
+	fs.record(journal.OpDelete, obj, actor, -obj.Size)
+	fs.adjustUsage(obj.Owner, -1, -obj.Size)
+	return nil
+}
+
+// appendDeleteMarker archives obj and puts a delete marker after it in memory only
+func (fs *FileStore) appendDeleteMarker(obj *models.StorageObject) {
+	now := time.Now()
+	fs.archive(obj)
+	fs.versions[obj.Key] = append(fs.versions[obj.Key], &models.StorageObject{
+		Key:          obj.Key,
+		Bucket:       obj.Bucket,
+		VersionID:    fs.nextVersionID(),
+		DeleteMarker: true,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Version:      obj.Version + 1,
+		Owner:        obj.Owner,
+	})
+}
+
+// deleteVersion permanently removes one version. If that leaves the key without a current
+// version and the newest remaining one has data, that one becomes current again.
+func (fs *FileStore) deleteVersion(key, versionID, actor string) error {
+	current, exists := fs.objects[key]
+	older := fs.versions[key]
+
+	var removed *models.StorageObject
+	if exists && versionIDOf(current) == versionID {
+		removed = current
+		delete(fs.objects, key)
+	} else {
+		index := -1
+		for i, obj := range older {
+			if obj.VersionID == versionID {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("%w: version %s of %s", ErrObjectNotFound, versionID, key)
+		}
+		removed = older[index]
+		remaining := make([]*models.StorageObject, 0, len(older)-1)
+		remaining = append(remaining, older[:index]...)
+		fs.versions[key] = append(remaining, older[index+1:]...)
+	}
+
+	promoted := fs.promote(key, removed.Version)
+	if len(fs.versions[key]) == 0 {
+		delete(fs.versions, key)
+	}
+	if err := fs.persistVersionChange(removed == current, current, promoted); err != nil {
+		fs.restore(key, current, older)
+		fs.saveVersions()
+		return err
+	}
+
+	for _, replica := range removed.Replicas {
+		fs.releaseData(replica.FilePath)
+	}
+	if removed == current {
+		fs.uncache(key)
+		fs.tally(current, nil)
+		fs.record(journal.OpDelete, current, actor, -current.Size)
+		fs.adjustUsage(current.Owner, -1, -current.Size)
+	}
+	if promoted != nil {
+		fs.tally(nil, promoted)
+		fs.record(journal.OpPut, promoted, actor, promoted.Size)
+		fs.adjustUsage(promoted.Owner, 1, promoted.Size)
+	}
+	return nil
+}
+
+// promote makes the newest noncurrent version of key current again, unless the key
+// already has a current version or the newest one is a delete marker. It returns the
+// promoted object, if any.
+func (fs *FileStore) promote(key string, after int64) *models.StorageObject {
+	older := fs.versions[key]
+	if _, exists := fs.objects[key]; exists || len(older) == 0 {
+		return nil
+	}
+	if older[len(older)-1].DeleteMarker {
+		return nil
+	}
+
+	promoted := *older[len(older)-1]
+	fs.versions[key] = older[:len(older)-1]
+	if promoted.Version <= after {
+		promoted.Version = after + 1
+	}
+	promoted.UpdatedAt = time.Now()
+	fs.objects[key] = &promoted
+	return &promoted
+}
+
+// persistVersionChange writes out deleteVersion's changes: the new history, the promoted
+// object's metadata and the removal of the deleted current object's metadata
+func (fs *FileStore) persistVersionChange(removedCurrent bool, current, promoted *models.StorageObject) error {
+	if err := fs.saveVersions(); err != nil {
+		return err
+	}
+	if promoted != nil {
+		if err := fs.saveObject(promoted); err != nil {
+			return err
+		}
+	}
+	if removedCurrent {
+		if err := fs.removeObjectMeta(current); err != nil {
+			if promoted != nil {
+				fs.removeObjectMeta(promoted)
+				fs.saveObject(current) // promoted took its record with the kv backend
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) saveVersions() error {
+	if fs.kv != nil {
+		return fs.kvSaveVersions()
+	}
+	path := filepath.Join(fs.metadataPath, versionsFile)
+	if len(fs.versions) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to save version history: %v", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(fs.versions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode version history: %v", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to save version history: %v", err)
+	}
+	return nil
+}
+
+func (fs *FileStore) loadVersions() {
+	data, err := os.ReadFile(filepath.Join(fs.metadataPath, versionsFile))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &fs.versions); err != nil {
+		log.Printf("Ignoring unreadable version history: %v", err)
+		fs.versions = make(map[string][]*models.StorageObject)
+	}
+}
@@ -0,0 +1,366 @@
+// Package upload implements resumable uploads: bytes are appended to a staging file across
+// any number of requests and the finished file is moved into the store in one write.
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	ErrBusy           = errors.New("upload is being written by another request")
+	ErrTooLarge       = errors.New("data exceeds the declared upload length")
+	ErrChecksum       = errors.New("checksum mismatch")
+)
+
+// Upload describes one resumable upload. Offset is derived from the staging file.
+type Upload struct {
+	ID                string    `json:"id"`
+	Key               string    `json:"key"`
+	Length            int64     `json:"length"`
+	Offset            int64     `json:"offset"`
+	ContentType       string    `json:"content_type"`
+	Owner             string    `json:"owner"`
+	Checksum          string    `json:"checksum,omitempty"` // expected digest of the whole object, if the client gave one
+	ChecksumAlgorithm string    `json:"checksum_algorithm,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type pending struct {
+	Upload
+	writer sync.Mutex // held by the request appending to it
+}
+
+type Manager struct {
+	dir   string
+	store storage.Store
+	ttl   time.Duration
+
+	mutex   sync.Mutex // guards uploads and each pending Upload
+	uploads map[string]*pending
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewManager reloads uploads left in dir by a previous run
+func NewManager(dir string, store storage.Store, ttl time.Duration) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	m := &Manager{
+		dir:     dir,
+		store:   store,
+		ttl:     ttl,
+		uploads: make(map[string]*pending),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload directory: %v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var u Upload
+		if err := json.Unmarshal(data, &u); err != nil {
+			log.Printf("Ignoring unreadable upload %s: %v", entry.Name(), err)
+			continue
+		}
+		if info, err := os.Stat(m.partPath(u.ID)); err == nil {
+			u.Offset = info.Size()
+		}
+		m.uploads[u.ID] = &pending{Upload: u}
+	}
+
+	return m, nil
+}
+
+func (m *Manager) partPath(id string) string { return filepath.Join(m.dir, id+".part") }
+func (m *Manager) infoPath(id string) string { return filepath.Join(m.dir, id+".json") }
+
+// Create registers a new upload of length bytes for key
+func (m *Manager) Create(key string, length int64, contentType, owner, checksum, algorithm string) (Upload, error) {
+	if algorithm != "" {
+		if err := storage.ValidateChecksumAlgorithm(algorithm); err != nil {
+			return Upload{}, err
+		}
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return Upload{}, fmt.Errorf("failed to generate upload ID: %v", err)
+	}
+
+	now := time.Now()
+	u := Upload{
+		ID:                hex.EncodeToString(buf),
+		Key:               key,
+		Length:            length,
+		ContentType:       contentType,
+		Owner:             owner,
+		Checksum:          strings.ToLower(checksum),
+		ChecksumAlgorithm: algorithm,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(m.ttl),
+	}
+
+	file, err := os.OpenFile(m.partPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to create upload: %v", err)
+	}
+	file.Close()
+
+	if err := m.saveInfo(u); err != nil {
+		os.Remove(m.partPath(u.ID))
+		return Upload{}, err
+	}
+
+	m.mutex.Lock()
+	m.uploads[u.ID] = &pending{Upload: u}
+	m.mutex.Unlock()
+	return u, nil
+}
+
+// Get returns a snapshot of the upload's state
+func (m *Manager) Get(id string) (Upload, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	u, exists := m.uploads[id]
+	if !exists {
+		return Upload{}, ErrNotFound
+	}
+	return u.Upload, nil
+}
+
+// Append writes data at offset, which must be the upload's current offset. Whatever
+// arrives before the body breaks off is kept, so the client can resume from the new
+// offset. When the upload becomes complete it is finalized into the store and the
+// stored object is returned.
+func (m *Manager) Append(id string, offset int64, data io.Reader, actor string) (Upload, *models.StorageObject, error) {
+	m.mutex.Lock()
+	u, exists := m.uploads[id]
+	m.mutex.Unlock()
+	if !exists {
+		return Upload{}, nil, ErrNotFound
+	}
+
+	if !u.writer.TryLock() {
+		return Upload{}, nil, ErrBusy
+	}
+	defer u.writer.Unlock()
+
+	// Only the writer changes Offset, so it's stable while we hold u.writer
+	m.mutex.Lock()
+	current, length := u.Offset, u.Length
+	m.mutex.Unlock()
+
+	if offset != current {
+		return m.snapshot(u), nil, fmt.Errorf("%w: upload is at %d, request starts at %d", ErrOffsetMismatch, current, offset)
+	}
+
+	file, err := os.OpenFile(m.partPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return m.snapshot(u), nil, fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(current, io.SeekStart); err != nil {
+		return m.snapshot(u), nil, fmt.Errorf("failed to seek upload: %v", err)
+	}
+
+	// Read one byte past the remaining length to detect oversized bodies
+	remaining := length - current
+	written, copyErr := io.Copy(file, io.LimitReader(data, remaining+1))
+	if written > remaining {
+		file.Truncate(current + remaining)
+		written = remaining
+		copyErr = ErrTooLarge
+	}
+	if err := file.Sync(); err != nil && copyErr == nil {
+		copyErr = fmt.Errorf("failed to sync upload: %v", err)
+	}
+
+	m.mutex.Lock()
+	u.Offset += written
+	u.ExpiresAt = time.Now().Add(m.ttl)
+	m.saveInfo(u.Upload)
+	snapshot := u.Upload
+	m.mutex.Unlock()
+
+	if copyErr != nil {
+		return snapshot, nil, copyErr
+	}
+	if snapshot.Offset < snapshot.Length {
+		return snapshot, nil, nil
+	}
+
+	obj, err := m.finalize(snapshot, actor)
+	return snapshot, obj, err
+}
+
+func (m *Manager) snapshot(u *pending) Upload {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return u.Upload
+}
+
+// finalize moves the completed upload into the store. On a checksum mismatch the upload
+// is discarded, since no resume can fix it.
+func (m *Manager) finalize(u Upload, actor string) (*models.StorageObject, error) {
+	if u.Checksum != "" {
+		file, err := os.Open(m.partPath(u.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open upload: %v", err)
+		}
+		actual, err := storage.Checksum(u.ChecksumAlgorithm, file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum upload: %v", err)
+		}
+		if actual != u.Checksum {
+			m.remove(u.ID)
+			return nil, fmt.Errorf("%w: expected %s %s, got %s", ErrChecksum, u.ChecksumAlgorithm, u.Checksum, actual)
+		}
+	}
+
+	file, err := os.Open(m.partPath(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %v", err)
+	}
+	obj, err := m.store.PutWithOptions(u.Key, file, storage.PutOptions{
+		ContentType:       u.ContentType,
+		ChecksumAlgorithm: u.ChecksumAlgorithm,
+		Owner:             u.Owner,
+		ExpectedSize:      u.Length,
+		Actor:             actor,
+	})
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store upload: %w", err)
+	}
+
+	m.remove(u.ID)
+	return obj, nil
+}
+
+// Terminate abandons an upload and frees its space
+func (m *Manager) Terminate(id string) error {
+	m.mutex.Lock()
+	u, exists := m.uploads[id]
+	m.mutex.Unlock()
+	if !exists {
+		return ErrNotFound
+	}
+	if !u.writer.TryLock() {
+		return ErrBusy
+	}
+	defer u.writer.Unlock()
+
+	m.remove(id)
+	return nil
+}
+
+func (m *Manager) remove(id string) {
+	m.mutex.Lock()
+	delete(m.uploads, id)
+	m.mutex.Unlock()
+
+	os.Remove(m.partPath(id))
+	os.Remove(m.infoPath(id))
+}
+
+func (m *Manager) saveInfo(u Upload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := m.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save upload: %v", err)
+	}
+	return os.Rename(tmp, m.infoPath(u.ID))
+}
+
+// Reap removes incomplete uploads that have passed their expiry, returning how many
+func (m *Manager) Reap(now time.Time) int {
+	m.mutex.Lock()
+	var expired []*pending
+	for _, u := range m.uploads {
+		if now.After(u.ExpiresAt) {
+			expired = append(expired, u)
+		}
+	}
+	m.mutex.Unlock()
+
+	reaped := 0
+	for _, u := range expired {
+		// An upload being written to is alive, whatever its expiry says
+		if !u.writer.TryLock() {
+			continue
+		}
+		m.remove(u.ID)
+		reaped++
+		u.writer.Unlock()
+	}
+	return reaped
+}
+
+func (m *Manager) Start(ctx context.Context) error {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				if n := m.Reap(now); n > 0 {
+					log.Printf("Reaped %d expired uploads", n)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) Stop(ctx context.Context) error {
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
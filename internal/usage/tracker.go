@@ -0,0 +1,386 @@
+// Package usage keeps per-principal storage and transfer totals and rolls them up daily
+// for chargeback reports.
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	// How often current totals are recomputed from the catalog to correct drift
+	DefaultReconcileInterval = 10 * time.Minute
+)
+
+// Totals is one principal's usage. Stored figures are current; transfer figures cover
+// the day so far (for a Rollup, the whole day).
+type Totals struct {
+	StoredBytes     int64 `json:"stored_bytes"`
+	Objects         int64 `json:"objects"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+}
+
+func (t Totals) empty() bool {
+	return t == Totals{}
+}
+
+// Rollup is a principal's usage for one UTC day, stored figures as of the end of the day
+type Rollup struct {
+	Date      string `json:"date"`
+	Principal string `json:"principal"`
+	Totals
+}
+
+// Summary is a principal's usage over a date range: current stored figures plus the
+// transfer within the range
+type Summary struct {
+	Principal string `json:"principal"`
+	Totals
+}
+
+type Tracker struct {
+	dir   string
+	store storage.Store
+
+	mutex   sync.Mutex
+	current map[string]*Totals
+	day     string // UTC day the transfer counters belong to
+	changes uint64 // bumped on every stored-usage change, lets Reconcile detect races
+
+	ReconcileInterval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// currentState is what survives a restart mid-day
+type currentState struct {
+	Day     string            `json:"day"`
+	Current map[string]Totals `json:"current"`
+}
+
+// NewTracker loads any saved state from dir, seeds stored totals from the store's catalog
+// and subscribes to the store's usage changes
+func NewTracker(dir string, store storage.Store) (*Tracker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create usage directory: %v", err)
+	}
+
+	t := &Tracker{
+		dir:               dir,
+		store:             store,
+		current:           make(map[string]*Totals),
+		day:               time.Now().UTC().Format(dateLayout),
+		ReconcileInterval: DefaultReconcileInterval,
+	}
+
+	if data, err := os.ReadFile(t.statePath()); err == nil {
+		var state currentState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Ignoring unreadable usage state: %v", err)
+		} else {
+			t.day = state.Day
+			for principal, totals := range state.Current {
+				totals := totals
+				t.current[principal] = &totals
+			}
+		}
+	}
+
+	store.SetUsageObserver(t.adjust)
+	t.Reconcile()
+	return t, nil
+}
+
+func (t *Tracker) statePath() string  { return filepath.Join(t.dir, "current.json") }
+func (t *Tracker) rollupPath() string { return filepath.Join(t.dir, "rollups.jsonl") }
+
+func (t *Tracker) totals(principal string) *Totals {
+	totals, exists := t.current[principal]
+	if !exists {
+		totals = &Totals{}
+		t.current[principal] = totals
+	}
+	return totals
+}
+
+// adjust is the store's usage observer
+func (t *Tracker) adjust(owner string, objects, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	totals := t.totals(owner)
+	totals.Objects += objects
+	totals.StoredBytes += bytes
+	t.changes++
+}
+
+func (t *Tracker) RecordUpload(principal string, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.totals(principal).BytesUploaded += bytes
+}
+
+func (t *Tracker) RecordDownload(principal string, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.totals(principal).BytesDownloaded += bytes
+}
+
+// Reconcile recomputes the stored figures from the catalog, returning how many principals
+// had drifted
+func (t *Tracker) Reconcile() int {
+	// The catalog is read without our lock (the store calls into us while holding its
+	// own), so retry if a write slipped in between
+	for attempt := 0; attempt < 3; attempt++ {
+		t.mutex.Lock()
+		before := t.changes
+		t.mutex.Unlock()
+
+		catalog := t.store.UsageByOwner()
+
+		t.mutex.Lock()
+		if t.changes != before {
+			t.mutex.Unlock()
+			continue
+		}
+
+		drifted := 0
+		for principal, totals := range t.current {
+			actual := catalog[principal]
+			if totals.StoredBytes != actual.Bytes || totals.Objects != actual.Objects {
+				drifted++
+				totals.StoredBytes, totals.Objects = actual.Bytes, actual.Objects
+			}
+		}
+		for principal, actual := range catalog {
+			if _, exists := t.current[principal]; !exists {
+				drifted++
+				t.current[principal] = &Totals{StoredBytes: actual.Bytes, Objects: actual.Objects}
+			}
+		}
+		for principal, totals := range t.current {
+			if totals.empty() {
+				delete(t.current, principal)
+			}
+		}
+		t.mutex.Unlock()
+		return drifted
+	}
+
+	log.Printf("Usage reconcile skipped, the store is too busy")
+	return 0
+}
+
+// Current returns the principal's current totals
+func (t *Tracker) Current(principal string) Totals {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if totals, exists := t.current[principal]; exists {
+		return *totals
+	}
+	return Totals{}
+}
+
+// Series returns the principal's daily rollups for from..to inclusive (YYYY-MM-DD)
+func (t *Tracker) Series(principal, from, to string) ([]Rollup, error) {
+	series := make([]Rollup, 0)
+	err := t.readRollups(func(r Rollup) {
+		if r.Principal == principal && r.Date >= from && r.Date <= to {
+			series = append(series, r)
+		}
+	})
+	return series, err
+}
+
+// Summarize totals every principal's transfer over from..to (including today so far when
+// the range covers it) alongside their current stored figures, largest consumers first
+func (t *Tracker) Summarize(from, to string) ([]Summary, error) {
+	byPrincipal := make(map[string]*Summary)
+	get := func(principal string) *Summary {
+		s, exists := byPrincipal[principal]
+		if !exists {
+			s = &Summary{Principal: principal}
+			byPrincipal[principal] = s
+		}
+		return s
+	}
+
+	err := t.readRollups(func(r Rollup) {
+		if r.Date >= from && r.Date <= to {
+			s := get(r.Principal)
+			s.BytesUploaded += r.BytesUploaded
+			s.BytesDownloaded += r.BytesDownloaded
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	includeToday := t.day >= from && t.day <= to
+	for principal, totals := range t.current {
+		s := get(principal)
+		s.StoredBytes, s.Objects = totals.StoredBytes, totals.Objects
+		if includeToday {
+			s.BytesUploaded += totals.BytesUploaded
+			s.BytesDownloaded += totals.BytesDownloaded
+		}
+	}
+	t.mutex.Unlock()
+
+	summaries := make([]Summary, 0, len(byPrincipal))
+	for _, s := range byPrincipal {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.StoredBytes != b.StoredBytes {
+			return a.StoredBytes > b.StoredBytes
+		}
+		if a.BytesUploaded+a.BytesDownloaded != b.BytesUploaded+b.BytesDownloaded {
+			return a.BytesUploaded+a.BytesDownloaded > b.BytesUploaded+b.BytesDownloaded
+		}
+		return a.Principal < b.Principal
+	})
+	return summaries, nil
+}
+
+func (t *Tracker) readRollups(fn func(Rollup)) error {
+	file, err := os.Open(t.rollupPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open rollups: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r Rollup
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue // a torn last line from a crash
+		}
+		fn(r)
+	}
+	return scanner.Err()
+}
+
+// rollover writes the finished day's rollups and starts new transfer counters once the
+// UTC date has changed
+func (t *Tracker) rollover(now time.Time) error {
+	today := now.UTC().Format(dateLayout)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.day == today {
+		return nil
+	}
+
+	file, err := os.OpenFile(t.rollupPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open rollups: %v", err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for principal, totals := range t.current {
+		if err := encoder.Encode(Rollup{Date: t.day, Principal: principal, Totals: *totals}); err != nil {
+			return fmt.Errorf("failed to write rollup: %v", err)
+		}
+		totals.BytesUploaded, totals.BytesDownloaded = 0, 0
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync rollups: %v", err)
+	}
+
+	log.Printf("Wrote usage rollup for %s (%d principals)", t.day, len(t.current))
+	t.day = today
+	return t.saveStateLocked()
+}
+
+func (t *Tracker) saveStateLocked() error {
+	state := currentState{Day: t.day, Current: make(map[string]Totals, len(t.current))}
+	for principal, totals := range t.current {
+		state.Current[principal] = *totals
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save usage state: %v", err)
+	}
+	return os.Rename(tmp, t.statePath())
+}
+
+func (t *Tracker) Start(ctx context.Context) error {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		lastReconcile := time.Now()
+
+		for {
+			select {
+			case <-t.stop:
+				return
+			case now := <-ticker.C:
+				if err := t.rollover(now); err != nil {
+					log.Printf("Usage rollup failed: %v", err)
+				}
+				if now.Sub(lastReconcile) >= t.ReconcileInterval {
+					if drifted := t.Reconcile(); drifted > 0 {
+						log.Printf("Usage reconcile corrected %d principals", drifted)
+					}
+					lastReconcile = now
+
+					t.mutex.Lock()
+					if err := t.saveStateLocked(); err != nil {
+						log.Printf("%v", err)
+					}
+					t.mutex.Unlock()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the background loop and saves today's counters so a restart doesn't lose them
+func (t *Tracker) Stop(ctx context.Context) error {
+	if t.stop != nil {
+		close(t.stop)
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.saveStateLocked()
+}
@@ -0,0 +1,346 @@
+// Package client is a Go client for the storage server's HTTP API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/pkg/models"
+)
+
+// ErrNotFound is returned when the server has no object under the requested key
+var ErrNotFound = errors.New("object not found")
+
+// APIError is a non-2xx response from the server
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// TransportError means the request never got a response (DNS, refused connection, timeout)
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("request failed: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+type Client struct {
+	BaseURL string
+	APIKey  string
+	HTTP    *http.Client
+	// Retries is how many more times a request is sent after a transport error or a 429,
+	// 502, 503 or 504, waiting RetryWait before the first retry and twice as long before
+	// each one after. Uploads are only retried when their body can be read again.
+	Retries   int
+	RetryWait time.Duration
+}
+
+func New(baseURL string, apiKey string, timeout time.Duration) *Client {
+	return &Client{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		APIKey:    apiKey,
+		HTTP:      &http.Client{Timeout: timeout},
+		Retries:   2,
+		RetryWait: 200 * time.Millisecond,
+	}
+}
+
+type PutOptions struct {
+	ContentType       string
+	Metadata          map[string]string // sent as X-Meta-* headers
+	Size              int64             // Content-Length, or -1 if unknown
+	ChecksumAlgorithm string            // md5, sha256 or crc32c; empty for the server default
+}
+
+// ByteRange is an inclusive byte range; End < 0 means "to the end of the object"
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r ByteRange) header() string {
+	if r.End < 0 {
+		return fmt.Sprintf("bytes=%d-", r.Start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+type GetOptions struct {
+	Range *ByteRange
+}
+
+// ObjectInfo is the object metadata carried in response headers
+type ObjectInfo struct {
+	Key               string
+	Size              int64
+	ContentType       string
+	ETag              string
+	Checksum          string
+	ChecksumAlgorithm string
+	ContentRange      string
+	Metadata          map[string]string
+}
+
+type Recommendation struct {
+	ObjectID         string  `json:"object_id"`
+	ObjectKey        string  `json:"object_key"`
+	CurrentTier      string  `json:"current_tier"`
+	RecommendedTier  string  `json:"recommended_tier"`
+	Confidence       float64 `json:"confidence"`
+	Reason           string  `json:"reason"`
+	EstimatedSavings float64 `json:"estimated_savings"`
+}
+
+func (c *Client) objectURL(key string) string {
+	return c.BaseURL + "/objects/" + url.PathEscape(key)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	for attempt := 0; attempt < c.Retries && retryable(req, resp, err); attempt++ {
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, &TransportError{Err: req.Context().Err()}
+		case <-time.After(c.RetryWait << attempt):
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = c.HTTP.Do(req)
+	}
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+// retryable reports whether req can be sent again after getting resp or err
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Put streams body to the server under key
+func (c *Client) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*models.StorageObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Size >= 0 {
+		req.ContentLength = opts.Size
+	}
+	// A file, say, can be sent again from where it started if the upload has to be retried
+	if seeker, ok := body.(io.ReadSeeker); ok && req.GetBody == nil {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			req.Body = io.NopCloser(seeker) // the transport closes it, the caller has to
+			req.GetBody = func() (io.ReadCloser, error) {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				return io.NopCloser(seeker), nil
+			}
+		}
+	}
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.ChecksumAlgorithm != "" {
+		req.Header.Set("X-Checksum-Algorithm", opts.ChecksumAlgorithm)
+	}
+	for name, value := range opts.Metadata {
+		req.Header.Set("X-Meta-"+name, value)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var obj models.StorageObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("invalid put response: %v", err)
+	}
+	return &obj, nil
+}
+
+// Get returns a streaming reader over the object's bytes; the caller must close it
+func (c *Client) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Range != nil {
+		req.Header.Set("Range", opts.Range.header())
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+// Head fetches an object's metadata without its body
+func (c *Client) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the objects whose keys start with prefix, sorted by key, fetching
+// as many pages as the listing takes
+func (c *Client) List(ctx context.Context, prefix string) ([]*models.StorageObject, error) {
+	var result []*models.StorageObject
+	token := ""
+	for {
+		query := url.Values{}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("token", token)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/objects?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Objects     map[string]*models.StorageObject `json:"objects"`
+			IsTruncated bool                             `json:"is_truncated"`
+			NextToken   string                           `json:"next_token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %v", err)
+		}
+
+		for _, obj := range page.Objects {
+			result = append(result, obj)
+		}
+		if !page.IsTruncated || page.NextToken == "" {
+			break
+		}
+		token = page.NextToken
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+func (c *Client) Recommendations(ctx context.Context) ([]Recommendation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/tiering/recommendations", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var recommendations []Recommendation
+	if err := json.NewDecoder(resp.Body).Decode(&recommendations); err != nil {
+		return nil, fmt.Errorf("invalid recommendations response: %v", err)
+	}
+	return recommendations, nil
+}
+
+func objectInfo(key string, resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:               key,
+		Size:              -1,
+		ContentType:       resp.Header.Get("Content-Type"),
+		ETag:              resp.Header.Get("ETag"),
+		Checksum:          resp.Header.Get("X-Checksum"),
+		ChecksumAlgorithm: resp.Header.Get("X-Checksum-Algorithm"),
+		ContentRange:      resp.Header.Get("Content-Range"),
+		Metadata:          make(map[string]string),
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, "X-Meta-") && len(values) > 0 {
+			info.Metadata[strings.ToLower(strings.TrimPrefix(name, "X-Meta-"))] = values[0]
+		}
+	}
+	return info
+}
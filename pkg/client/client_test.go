@@ -0,0 +1,260 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9ifrashaikh/distributed-system/internal/api"
+	"github.com/9ifrashaikh/distributed-system/internal/storage"
+)
+
+// newServer runs the real API over an in-memory store
+func newServer(t *testing.T) *Client {
+	t.Helper()
+	server := httptest.NewServer(api.NewAPIServer(storage.NewMemStore()))
+	t.Cleanup(server.Close)
+	return New(server.URL, "", 5*time.Second)
+}
+
+// flakyServer answers with each of statuses in turn, then with handler
+func flakyServer(t *testing.T, statuses []int, handler http.HandlerFunc) (*Client, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(statuses) {
+			io.Copy(io.Discard, r.Body)
+			http.Error(w, http.StatusText(statuses[n-1]), statuses[n-1])
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	c := New(server.URL, "secret", 5*time.Second)
+	c.RetryWait = time.Millisecond
+	return c, &calls
+}
+
+func readAll(t *testing.T, body io.ReadCloser) string {
+	t.Helper()
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPutGetHeadDelete(t *testing.T) {
+	c := newServer(t)
+	ctx := context.Background()
+
+	obj, err := c.Put(ctx, "notes", strings.NewReader("hello, world"), PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"project": "apollo"},
+		Size:        12,
+	})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if obj.Key != "notes" || obj.Size != 12 {
+		t.Errorf("Put returned key %q, size %d; want notes, 12", obj.Key, obj.Size)
+	}
+
+	body, info, err := c.Get(ctx, "notes", GetOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if data := readAll(t, body); data != "hello, world" {
+		t.Errorf("Get = %q, want %q", data, "hello, world")
+	}
+	if info.ContentType != "text/plain" || info.Checksum != obj.Checksum || info.Metadata["project"] != "apollo" {
+		t.Errorf("Get info = %+v, want text/plain, checksum %s, project=apollo", info, obj.Checksum)
+	}
+
+	body, info, err = c.Get(ctx, "notes", GetOptions{Range: &ByteRange{Start: 7, End: -1}})
+	if err != nil {
+		t.Fatalf("ranged Get: %v", err)
+	}
+	if data := readAll(t, body); data != "world" || info.ContentRange != "bytes 7-11/12" {
+		t.Errorf("ranged Get = %q with Content-Range %q, want world, bytes 7-11/12", data, info.ContentRange)
+	}
+
+	info, err = c.Head(ctx, "notes")
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	if info.Size != 12 {
+		t.Errorf("Head size = %d, want 12", info.Size)
+	}
+
+	if err := c.Delete(ctx, "notes"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := c.Get(ctx, "notes", GetOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+	}
+	if err := c.Delete(ctx, "notes"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestListFollowsPages(t *testing.T) {
+	c := newServer(t)
+	ctx := context.Background()
+	for _, key := range []string{"log-c", "log-a", "other", "log-b"} {
+		if _, err := c.Put(ctx, key, strings.NewReader(key), PutOptions{Size: -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server hands out two at a time, so the client has to follow the token
+	var pages atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages.Add(1)
+		query := r.URL.Query()
+		query.Set("limit", "2")
+		r.URL.RawQuery = query.Encode()
+		proxy, err := http.NewRequest(r.Method, c.BaseURL+r.URL.RequestURI(), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(proxy)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer server.Close()
+
+	objects, err := New(server.URL, "", 5*time.Second).List(ctx, "log-")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	if got := strings.Join(keys, ","); got != "log-a,log-b,log-c" {
+		t.Errorf("List = %s, want log-a,log-b,log-c", got)
+	}
+	if n := pages.Load(); n != 2 {
+		t.Errorf("List fetched %d pages, want 2", n)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			http.Error(w, "missing API key", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "no such object", http.StatusNotFound)
+	}))
+	ctx := context.Background()
+
+	_, _, err := New(server.URL, "", time.Second).Get(ctx, "anything", GetOptions{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "missing API key" {
+		t.Errorf("request without a key = %v, want an APIError 401 with the server's message", err)
+	}
+	if _, err := New(server.URL, "secret", time.Second).Head(ctx, "anything"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("404 = %v, want ErrNotFound", err)
+	}
+
+	server.Close()
+	c := New(server.URL, "secret", time.Second)
+	c.Retries = 0
+	var transportErr *TransportError
+	if _, err := c.Head(ctx, "anything"); !errors.As(err, &transportErr) {
+		t.Errorf("request to a closed server = %v, want a TransportError", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"key": %q, "size": %d}`, "k", len(data))
+	}
+
+	t.Run("recovers from unavailable", func(t *testing.T) {
+		c, calls := flakyServer(t, []int{http.StatusServiceUnavailable, http.StatusBadGateway}, ok)
+		obj, err := c.Put(ctx, "k", strings.NewReader("payload"), PutOptions{Size: 7})
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if obj.Size != 7 || calls.Load() != 3 {
+			t.Errorf("Put sent %d bytes the last time after %d calls, want 7 after 3", obj.Size, calls.Load())
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		c, calls := flakyServer(t, []int{503, 503, 503, 503}, ok)
+		_, err := c.Head(ctx, "k")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Head = %v, want the last 503", err)
+		}
+		if n := calls.Load(); n != 3 {
+			t.Errorf("Head was sent %d times, want 3", n)
+		}
+	})
+
+	t.Run("not on server errors", func(t *testing.T) {
+		c, calls := flakyServer(t, []int{http.StatusInternalServerError}, ok)
+		if err := c.Delete(ctx, "k"); err == nil {
+			t.Error("Delete succeeded after a 500")
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Delete was sent %d times, want 1", n)
+		}
+	})
+
+	t.Run("file sent again from where it started", func(t *testing.T) {
+		c, calls := flakyServer(t, []int{http.StatusServiceUnavailable}, ok)
+		path := filepath.Join(t.TempDir(), "upload")
+		if err := os.WriteFile(path, []byte("skip:payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.Seek(5, io.SeekStart)
+
+		obj, err := c.Put(ctx, "k", file, PutOptions{Size: 7})
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if obj.Size != 7 || calls.Load() != 2 {
+			t.Errorf("Put sent %d bytes the last time after %d calls, want 7 after 2", obj.Size, calls.Load())
+		}
+	})
+
+	t.Run("not with a body that can't be sent again", func(t *testing.T) {
+		c, calls := flakyServer(t, []int{http.StatusServiceUnavailable}, ok)
+		body := io.MultiReader(strings.NewReader("pay"), strings.NewReader("load"))
+		if _, err := c.Put(ctx, "k", body, PutOptions{Size: -1}); err == nil {
+			t.Error("Put succeeded after a 503 it couldn't retry")
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Put was sent %d times, want 1", n)
+		}
+	})
+}
@@ -5,25 +5,69 @@ import (
 )
 
 type StorageObject struct {
-	ID          string            `json:"id"`
-	Key         string            `json:"key"`
-	Size        int64             `json:"size"`
-	ContentType string            `json:"content_type"`
-	Checksum    string            `json:"checksum"` //for file integrating SHA256 SOMEWHAT
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
-	AccessCount int64             `json:"access_count"`
-	LastAccess  time.Time         `json:"last_access"`
-	Metadata    map[string]string `json:"metadata"`
-	StorageTier string            `json:"storage_tier"` // hot, warm, cold
-	Replicas    []ReplicaInfo     `json:"replicas"`
+	ID                string            `json:"id"`
+	Key               string            `json:"key"`    // unique across buckets, see storage.ObjectName
+	Bucket            string            `json:"bucket"` // empty for objects stored before buckets existed
+	Size              int64             `json:"size"`
+	ContentType       string            `json:"content_type"`
+	Checksum          string            `json:"checksum"`           // hex digest, see ChecksumAlgorithm
+	ChecksumAlgorithm string            `json:"checksum_algorithm"` // md5, sha256 or crc32c
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	AccessCount       int64             `json:"access_count"`
+	LastAccess        time.Time         `json:"last_access"`
+	Metadata          map[string]string `json:"metadata"`
+	StorageTier       string            `json:"storage_tier"`            // hot, warm, cold
+	Version           int64             `json:"version"`                 // bumped by the store on every mutation
+	VersionID         string            `json:"version_id,omitempty"`    // set when versioning is on
+	DeleteMarker      bool              `json:"delete_marker,omitempty"` // a version recording a delete
+	Owner             string            `json:"owner"`
+	ExpiresAt         *time.Time        `json:"expires_at,omitempty"` // reads fail and the object is deleted after this
+	Replicas          []ReplicaInfo     `json:"replicas"`
+	// ReplicationFactor is how many other nodes the object is kept on when its writer asked
+	// for other than the cluster's factor
+	ReplicationFactor *int `json:"replication_factor,omitempty"`
+	// Stamp orders this write against writes of the same key made through other nodes,
+	// ConflictHistory has the times two of them were found to race, oldest first
+	Stamp           *WriteStamp      `json:"stamp,omitempty"`
+	ConflictHistory []ConflictRecord `json:"conflict_history,omitempty"`
+
+	// How the data file is stored: gzip when compressed (cold objects are), identity when
+	// it was found not to compress, empty otherwise. When KeyID is set it is also
+	// encrypted, with a data key wrapped by that master key. Size and Checksum always
+	// describe the original bytes; StoredSize is what is on disk when compressed or
+	// encrypted.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	StoredSize      int64  `json:"stored_size,omitempty"`
+	KeyID           string `json:"key_id,omitempty"`
+	WrappedKey      string `json:"wrapped_key,omitempty"` // base64
+}
+
+// WriteStamp is a Lamport counter, with the ID of the node the write came in through
+// breaking ties
+type WriteStamp struct {
+	Counter int64  `json:"counter"`
+	NodeID  string `json:"node_id"`
+}
+
+// ConflictRecord is a write of an object that lost to another one made through a
+// different node
+type ConflictRecord struct {
+	At      time.Time   `json:"at"`
+	NodeID  string      `json:"node_id"` // the other node
+	Kept    *WriteStamp `json:"kept"`
+	Dropped *WriteStamp `json:"dropped"`
+	// Action is what happened to the loser: rejected_replica when another node sent it
+	// here, replaced when this node held it and took the winner from the other
+	Action string `json:"action"`
 }
 
 // STRUCTURE NO 2
 type ReplicaInfo struct {
 	NodeID   string `json:"node_id"`
 	FilePath string `json:"file_path"`
-	Status   string `json:"status"` // active, syncing, failed
+	Status   string `json:"status"`         // active, syncing, failed
+	Zone     string `json:"zone,omitempty"` // of a copy on another node, when it was made
 }
 
 type AccessPattern struct {
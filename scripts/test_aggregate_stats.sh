@@ -0,0 +1,91 @@
+#!/bin/bash
+
+# Starts four nodes and writes a few objects to each, then makes node C slow by freezing
+# it and kills node D outright, with no goodbye to the others, before either is noticed as
+# down. The aggregate stats from node A have to add up A and B, list C and D as failed
+# without failing themselves, come back within the per-node timeout, and be served from
+# the cache when asked again at once.
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+NODE_C="localhost:8083"
+NODE_D="localhost:8084"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill -CONT $PID_C 2>/dev/null
+    kill $PID_A $PID_B $PID_C $PID_D 2>/dev/null
+    wait 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+# Health checks far apart, so C and D are still taken as healthy when the stats are asked for
+export DSS_REPLICATION_FACTOR=0 DSS_CLUSTER_HEALTH_CHECK_INTERVAL=60s DSS_CLUSTER_STALE_AFTER=120s
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a -node-address "$NODE_A" > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b -node-address "$NODE_B" -peers "$NODE_A" > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+"$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-id node-c -node-address "$NODE_C" -peers "$NODE_A" > "$WORKDIR/c.log" 2>&1 &
+PID_C=$!
+"$WORKDIR/server" -port 8084 -storage "$WORKDIR/d" -node-id node-d -node-address "$NODE_D" -peers "$NODE_A" > "$WORKDIR/d.log" 2>&1 &
+PID_D=$!
+sleep 2
+
+FAILED=false
+aggregate() {
+    curl -s "http://$NODE_A/cluster/stats/aggregate"
+}
+field() {
+    python3 -c "import json,sys; d=json.load(sys.stdin); print($1)"
+}
+
+echo "1. Writing 3 objects to A, 2 to B and 1 each to C and D:"
+for I in 1 2 3; do curl -s -o /dev/null -X PUT "http://$NODE_A/objects/a-$I" -d "0123456789"; done
+for I in 1 2; do curl -s -o /dev/null -X PUT "http://$NODE_B/objects/b-$I" -d "0123456789"; done
+curl -s -o /dev/null -X PUT "http://$NODE_C/objects/c-1" -d "0123456789"
+curl -s -o /dev/null -X PUT "http://$NODE_D/objects/d-1" -d "0123456789"
+TOTAL=$(aggregate | field 'd["total_objects"], d["total_size"], d["nodes_responded"], "of", d["nodes_queried"]')
+echo "objects, bytes, nodes: $TOTAL"
+[ "$TOTAL" = "7 70 4 of 4" ] || FAILED=true
+echo
+
+echo "2. Waiting out the cache, then freezing C and killing D:"
+sleep 6
+kill -STOP $PID_C
+kill -9 $PID_D
+wait $PID_D 2>/dev/null
+START=$(date +%s%N)
+RESULT=$(aggregate)
+ELAPSED=$(( ($(date +%s%N) - START) / 1000000 ))
+echo "answered in ${ELAPSED}ms"
+[ "$ELAPSED" -lt 4000 ] || FAILED=true
+TOTAL=$(echo "$RESULT" | field 'd["total_objects"], d["total_size"], d["nodes_responded"], "of", d["nodes_queried"]')
+echo "objects, bytes, nodes: $TOTAL"
+[ "$TOTAL" = "5 50 2 of 4" ] || FAILED=true
+FAILURES=$(echo "$RESULT" | field '" ".join(d["nodes_failed"])')
+echo "failed: $FAILURES"
+[ "$FAILURES" = "node-c node-d" ] || FAILED=true
+echo "$RESULT" | field '"\n".join("  %s: %s" % (n, s.get("error", s["status"])) for n, s in sorted(d["nodes"].items()))'
+echo
+
+echo "3. Asking again at once:"
+START=$(date +%s%N)
+AGAIN=$(aggregate)
+ELAPSED=$(( ($(date +%s%N) - START) / 1000000 ))
+echo "answered in ${ELAPSED}ms"
+FIRST=$(echo "$RESULT" | field 'd["generated_at"]')
+SECOND=$(echo "$AGAIN" | field 'd["generated_at"]')
+echo "generated at: $FIRST, then $SECOND"
+[ "$FIRST" = "$SECOND" ] || FAILED=true
+[ "$ELAPSED" -lt 500 ] || FAILED=true
+echo
+
+if $FAILED; then
+    echo "FAIL"
+    exit 1
+fi
+echo "PASS: stats added up across the nodes that answered, the others flagged"
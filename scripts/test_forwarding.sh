@@ -0,0 +1,97 @@
+#!/bin/bash
+
+# Starts three nodes with forwarding on and no replication, so each key lives on its owner
+# only. Writes every key through node A, then checks reads through every node find it,
+# ranged and conditional requests through a node without the key reach its owner, and
+# ?local_only=true isn't forwarded. Finally compares the latency of reads served by the
+# owner with ones forwarded to it, the cost of one hop.
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+NODE_C="localhost:8083"
+WORKDIR=$(mktemp -d)
+KEYS=20
+
+cleanup() {
+    kill $PID_A $PID_B $PID_C 2>/dev/null
+    wait 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+export DSS_CLUSTER_FORWARDING=true DSS_REPLICATION_FACTOR=0 DSS_CLUSTER_HEARTBEAT_INTERVAL=1s
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a -node-address "$NODE_A" > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b -node-address "$NODE_B" -peers "$NODE_A" > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+"$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-id node-c -node-address "$NODE_C" -peers "$NODE_A" > "$WORKDIR/c.log" 2>&1 &
+PID_C=$!
+sleep 2
+
+FAILED=false
+
+echo "1. Writing $KEYS keys through A:"
+declare -A OWNER
+for I in $(seq 1 $KEYS); do
+    OWNER[key-$I]=$(curl -s -o /dev/null -D - -X PUT "http://$NODE_A/objects/key-$I" -d "value of key $I" \
+        | tr -d '\r' | awk -F': ' 'tolower($1) == "x-forwarded-to" { print $2 }')
+done
+echo "owners: $(printf '%s\n' "${OWNER[@]}" | sort | uniq -c | tr '\n' ' ')"
+echo
+
+echo "2. Reading every key through every node:"
+for NODE in "$NODE_A" "$NODE_B" "$NODE_C"; do
+    for I in $(seq 1 $KEYS); do
+        BODY=$(curl -s "http://$NODE/objects/key-$I")
+        if [ "$BODY" != "value of key $I" ]; then
+            echo "FAIL: key-$I through $NODE: $BODY"
+            FAILED=true
+        fi
+    done
+done
+echo
+
+# A key node B doesn't hold, for the rest of the checks
+for I in $(seq 1 $KEYS); do
+    if [ -n "${OWNER[key-$I]}" ] && [ "${OWNER[key-$I]}" != "node-b" ]; then
+        KEY=key-$I
+        break
+    fi
+done
+case "${OWNER[$KEY]}" in
+    node-a) OWNER_ADDRESS=$NODE_A ;;
+    node-c) OWNER_ADDRESS=$NODE_C ;;
+esac
+
+echo "3. Range and conditional headers through B for $KEY, owned by ${OWNER[$KEY]}:"
+RANGE=$(curl -s -H "Range: bytes=0-4" "http://$NODE_B/objects/$KEY")
+echo "Range bytes=0-4: $RANGE"
+[ "$RANGE" = "value" ] || FAILED=true
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "If-None-Match: *" "http://$NODE_B/objects/$KEY" -d "overwritten")
+echo "PUT with If-None-Match: *: $STATUS"
+[ "$STATUS" = "412" ] || FAILED=true
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "http://$NODE_B/objects/$KEY?local_only=true")
+echo "local_only: $STATUS"
+[ "$STATUS" = "404" ] || FAILED=true
+echo
+
+echo "4. Latency of 50 reads of $KEY, from its owner and forwarded through B:"
+latency() {
+    for I in $(seq 1 50); do
+        curl -s -o /dev/null -w "%{time_total}\n" "http://$1/objects/$KEY"
+    done | awk '{ sum += $1 } END { printf "%.2f", sum / NR * 1000 }'
+}
+DIRECT=$(latency "$OWNER_ADDRESS")
+FORWARDED=$(latency "$NODE_B")
+echo "direct: ${DIRECT}ms, forwarded: ${FORWARDED}ms, one hop adds $(awk "BEGIN { printf \"%.2f\", $FORWARDED - $DIRECT }")ms"
+curl -s "http://$NODE_B/stats" | python3 -c 'import json,sys; print("B forwarding stats:", json.load(sys.stdin)["forwarding"])'
+echo
+
+if $FAILED; then
+    echo "FAIL"
+    exit 1
+fi
+echo "PASS: requests reached the owners of their keys"
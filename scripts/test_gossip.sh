@@ -0,0 +1,65 @@
+#!/bin/bash
+
+# Starts three nodes that know nothing of each other, registers B and C with A only, then
+# checks gossip brings every node to the full membership within a few rounds. The nodes
+# share a cluster secret, so the gossip has to carry it.
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+NODE_C="localhost:8083"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill $PID_A $PID_B $PID_C 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+export DSS_CLUSTER_GOSSIP_INTERVAL=1s DSS_CLUSTER_GOSSIP_FANOUT=1 DSS_AUTH_CLUSTER_SECRET=gossip-test
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a -node-address "$NODE_A" > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b -node-address "$NODE_B" > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+"$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-id node-c -node-address "$NODE_C" > "$WORKDIR/c.log" 2>&1 &
+PID_C=$!
+sleep 1
+
+echo "1. Registering B and C with A, the seed:"
+for NODE in "node-b $NODE_B" "node-c $NODE_C"; do
+    set -- $NODE
+    curl -s -X POST "http://$NODE_A/cluster/register" -H "X-Cluster-Token: $DSS_AUTH_CLUSTER_SECRET" \
+         -d "{\"id\": \"$1\", \"address\": \"$2\", \"status\": \"healthy\"}"
+done
+echo
+
+members() {
+    curl -s "http://$1/cluster/status" | python3 -c 'import json,sys; print(" ".join(n["id"] for n in json.load(sys.stdin)["nodes"]))'
+}
+
+echo "2. Waiting for every node to know all three:"
+for ROUND in $(seq 1 10); do
+    sleep 1
+    CONVERGED=true
+    for NODE in "$NODE_A" "$NODE_B" "$NODE_C"; do
+        if [ "$(members "$NODE")" != "node-a node-b node-c" ]; then
+            CONVERGED=false
+        fi
+    done
+    if $CONVERGED; then
+        break
+    fi
+done
+for NODE in "$NODE_A" "$NODE_B" "$NODE_C"; do
+    echo "$NODE knows: $(members "$NODE")"
+done
+echo
+
+if $CONVERGED; then
+    echo "PASS: membership converged after $ROUND rounds"
+else
+    echo "FAIL: membership hadn't converged after $ROUND rounds"
+    exit 1
+fi
@@ -0,0 +1,87 @@
+#!/bin/bash
+
+# Starts two nodes plus a stand-in node that answers every replica with 500, then checks a
+# strict write that needs all of its copies fails and leaves a partial task behind
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+BROKEN="localhost:8083"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill $PID_A $PID_B $PID_BROKEN 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+# Healthy as far as the cluster can tell, but it never stores a copy
+python3 - > "$WORKDIR/broken.log" 2>&1 <<'EOF' &
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Broken(BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.end_headers()
+        self.wfile.write(b'{"status": "healthy", "nodes": {}}')
+
+    def do_POST(self):
+        self.do_GET()
+
+    def do_PUT(self):
+        self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        self.send_response(500)
+        self.end_headers()
+        self.wfile.write(b"disk on fire")
+
+HTTPServer(("localhost", 8083), Broken).serve_forever()
+EOF
+PID_BROKEN=$!
+
+export DSS_REPLICATION_MIN_SUCCESS=all DSS_REPLICATION_STRICT_WRITES=true \
+    DSS_REPLICATION_MAX_ATTEMPTS=2 DSS_REPLICATION_RETRY_DELAY=100ms
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a \
+    -node-address "$NODE_A" -replication-factor 2 > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+sleep 1
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b \
+    -node-address "$NODE_B" -peers "$NODE_A" -replication-factor 2 > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+curl -s -X POST "http://$NODE_A/cluster/register" \
+     -d "{\"id\": \"node-broken\", \"address\": \"$BROKEN\", \"status\": \"healthy\"}" > /dev/null
+sleep 2
+
+echo "1. Uploading to node A, which needs both copies:"
+STATUS=$(curl -s -o "$WORKDIR/put.out" -w "%{http_code}" -X PUT "http://$NODE_A/objects/strict.txt" \
+     --data-binary "Hello from node A")
+echo "$STATUS $(cat "$WORKDIR/put.out")"
+echo
+
+if [ "$STATUS" != "503" ]; then
+    echo "FAIL: strict write answered $STATUS"
+    exit 1
+fi
+echo "PASS: strict write failed"
+echo
+
+sleep 1
+ID=$(python3 -c 'import json,sys; print(json.load(open(sys.argv[1]))["task_id"])' "$WORKDIR/put.out")
+echo "2. Its replication task on node A:"
+TASK=$(curl -s "http://$NODE_A/replication/tasks/$ID")
+echo "$TASK"
+echo
+
+RESULT=$(python3 -c '
+import json, sys
+task = json.loads(sys.argv[1])
+targets = {t["node_id"]: t["status"] for t in task["targets"]}
+print(task["status"], targets.get("node-b"), targets.get("node-broken"))' "$TASK")
+if [ "$RESULT" = "partial completed failed" ]; then
+    echo "PASS: task is partial, node-b has a copy and node-broken doesn't"
+else
+    echo "FAIL: task status, node-b and node-broken were $RESULT"
+    exit 1
+fi
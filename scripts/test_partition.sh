@@ -0,0 +1,89 @@
+#!/bin/bash
+
+# Starts three nodes, then cuts node A off by freezing B and C so they stop answering. A
+# sees one of three nodes, fewer than the two it needs, so it has to turn writes away and
+# say it is degraded while still serving reads. Once B and C answer again A has to take
+# writes again, and both changes have to be in its event log.
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+NODE_C="localhost:8083"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill -CONT $PID_B $PID_C 2>/dev/null
+    kill $PID_A $PID_B $PID_C 2>/dev/null
+    wait 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+export DSS_CLUSTER_HEALTH_CHECK_INTERVAL=1s DSS_CLUSTER_HEALTH_CHECK_TIMEOUT=500ms \
+       DSS_CLUSTER_STALE_AFTER=3s DSS_CLUSTER_HEALTH_CHECK_FAILURES=2 \
+       DSS_CLUSTER_HEALTH_CHECK_SUCCESSES=1 DSS_CLUSTER_HEARTBEAT_INTERVAL=1s
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a -node-address "$NODE_A" > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b -node-address "$NODE_B" -peers "$NODE_A" > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+"$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-id node-c -node-address "$NODE_C" -peers "$NODE_A" > "$WORKDIR/c.log" 2>&1 &
+PID_C=$!
+sleep 2
+
+FAILED=false
+put() {
+    curl -s -o /dev/null -w "%{http_code}" -X PUT "http://$NODE_A/objects/$1" -d "$1"
+}
+health() {
+    curl -s "http://$NODE_A/health" | python3 -c 'import json,sys; h=json.load(sys.stdin); print(h["status"], "sees %d of %d" % (h["quorum"]["visible"], h["quorum"]["members"]))'
+}
+
+echo "1. Whole cluster up:"
+echo "health: $(health)"
+STATUS=$(put before)
+echo "PUT: $STATUS"
+[ "$STATUS" = "200" ] || [ "$STATUS" = "201" ] || FAILED=true
+echo
+
+echo "2. Freezing B and C:"
+kill -STOP $PID_B $PID_C
+for I in $(seq 1 15); do
+    sleep 1
+    if health | grep -q '^degraded'; then
+        break
+    fi
+done
+echo "health: $(health)"
+health | grep -q '^degraded' || FAILED=true
+STATUS=$(put during)
+echo "PUT: $STATUS (want 503)"
+[ "$STATUS" = "503" ] || FAILED=true
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "http://$NODE_A/objects/before")
+echo "GET: $STATUS (want 200)"
+[ "$STATUS" = "200" ] || FAILED=true
+echo
+
+echo "3. Thawing B and C:"
+kill -CONT $PID_B $PID_C
+for I in $(seq 1 15); do
+    sleep 1
+    if ! health | grep -q '^degraded'; then
+        break
+    fi
+done
+echo "health: $(health)"
+STATUS=$(put after)
+echo "PUT: $STATUS"
+[ "$STATUS" = "200" ] || [ "$STATUS" = "201" ] || FAILED=true
+EVENTS=$(curl -s "http://$NODE_A/cluster/events" | python3 -c 'import json,sys; d=json.load(sys.stdin); print(" ".join(e["type"] for e in (d["events"] if isinstance(d, dict) else d) if e["type"].startswith("quorum")))')
+echo "events: $EVENTS"
+[ "$EVENTS" = "quorum_lost quorum_regained" ] || FAILED=true
+echo
+
+if $FAILED; then
+    echo "FAIL"
+    exit 1
+fi
+echo "PASS: writes refused while cut off, taken again once the cluster was back"
@@ -0,0 +1,72 @@
+#!/bin/bash
+
+# Starts two nodes, writes an object to the first and checks it shows up on the second,
+# then checks the second refuses a copy damaged on the way
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill $PID_A $PID_B 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-id node-a \
+    -node-address "$NODE_A" -replication-factor 1 > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+sleep 1
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-id node-b \
+    -node-address "$NODE_B" -peers "$NODE_A" -replication-factor 1 > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+sleep 2
+
+echo "1. Cluster as node A sees it:"
+curl -s "http://$NODE_A/cluster/status"
+echo -e "\n"
+
+echo "2. Uploading to node A:"
+curl -s -X PUT "http://$NODE_A/objects/replicated.txt" \
+     -H "Content-Type: text/plain" \
+     --data-binary "Hello from node A"
+echo -e "\n"
+sleep 2
+
+echo "3. Replication tasks on node A:"
+curl -s "http://$NODE_A/replication/tasks"
+echo -e "\n"
+
+echo "4. Reading from node B:"
+BODY=$(curl -s "http://$NODE_B/objects/replicated.txt")
+echo "$BODY"
+echo
+
+if [ "$BODY" = "Hello from node A" ]; then
+    echo "PASS: object replicated to node B"
+else
+    echo "FAIL: object not found on node B"
+    exit 1
+fi
+echo
+
+echo "5. Sending node B a copy with a flipped byte, as node A would:"
+SENT="Hello from node A"
+CHECKSUM=$(printf '%s' "$SENT" | sha256sum | cut -d' ' -f1)
+STATUS=$(curl -s -o "$WORKDIR/corrupt.out" -w "%{http_code}" -X PUT "http://$NODE_B/internal/replicate/corrupt.txt" \
+     -H "X-Replication-Source: node-a" \
+     -H "X-Object-ID: 0123456789abcdef0123456789abcdef" \
+     -H "X-Checksum: sha256:$CHECKSUM" \
+     --data-binary "Hello from nodE A")
+echo "$STATUS $(cat "$WORKDIR/corrupt.out")"
+FOUND=$(curl -s -o /dev/null -w "%{http_code}" "http://$NODE_B/objects/corrupt.txt")
+
+if [ "$STATUS" = "422" ] && [ "$FOUND" = "404" ]; then
+    echo "PASS: corrupt copy refused and not stored"
+else
+    echo "FAIL: corrupt copy answered $STATUS, reading it back answered $FOUND"
+    exit 1
+fi
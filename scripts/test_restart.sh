@@ -0,0 +1,88 @@
+#!/bin/bash
+
+# Starts three nodes with no -node-id, so each generates an ID and keeps it in its storage
+# directory. Node C crashes and is started again: it has to come back under the same ID,
+# with every node still seeing three. Started with another -node-id it has to refuse to
+# run; with -force-node-id as well it is renamed, and the others have to take its old ID
+# as having left rather than keep it around as a fourth, unhealthy node.
+
+NODE_A="localhost:8081"
+NODE_B="localhost:8082"
+NODE_C="localhost:8083"
+WORKDIR=$(mktemp -d)
+
+cleanup() {
+    kill $PID_A $PID_B $PID_C 2>/dev/null
+    wait 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+echo "Building server..."
+go build -o "$WORKDIR/server" ./cmd/server || exit 1
+
+export DSS_CLUSTER_HEALTH_CHECK_INTERVAL=1s DSS_CLUSTER_HEARTBEAT_INTERVAL=1s
+"$WORKDIR/server" -port 8081 -storage "$WORKDIR/a" -node-address "$NODE_A" > "$WORKDIR/a.log" 2>&1 &
+PID_A=$!
+"$WORKDIR/server" -port 8082 -storage "$WORKDIR/b" -node-address "$NODE_B" -peers "$NODE_A" > "$WORKDIR/b.log" 2>&1 &
+PID_B=$!
+start_c() {
+    "$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-address "$NODE_C" -peers "$NODE_A" "$@" >> "$WORKDIR/c.log" 2>&1 &
+    PID_C=$!
+}
+start_c
+sleep 2
+
+FAILED=false
+# view NODE prints how many nodes NODE knows that haven't left
+view() {
+    curl -s "http://$1/cluster/status" | python3 -c 'import json,sys; print(len([n for n in json.load(sys.stdin)["nodes"] if n["status"] != "left"]), "nodes")'
+}
+check_views() {
+    for NODE in "$NODE_A" "$NODE_B" "$NODE_C"; do
+        VIEW=$(view "$NODE")
+        echo "$NODE sees $VIEW"
+        [ "$VIEW" = "$1" ] || FAILED=true
+    done
+}
+
+ID_C=$(cat "$WORKDIR/c/node_id")
+echo "1. Started, C is $ID_C:"
+check_views "3 nodes"
+echo
+
+echo "2. C crashes and starts again:"
+kill -9 $PID_C
+wait $PID_C 2>/dev/null
+start_c
+sleep 3
+echo "C is $(cat "$WORKDIR/c/node_id")"
+[ "$(cat "$WORKDIR/c/node_id")" = "$ID_C" ] || FAILED=true
+check_views "3 nodes"
+echo
+
+echo "3. C started again as another node ID:"
+kill $PID_C
+wait $PID_C 2>/dev/null
+"$WORKDIR/server" -port 8083 -storage "$WORKDIR/c" -node-id node-c -node-address "$NODE_C" -peers "$NODE_A" > "$WORKDIR/c-refused.log" 2>&1
+STATUS=$?
+echo "exit status $STATUS: $(grep -o 'Refusing to start.*' "$WORKDIR/c-refused.log")"
+[ "$STATUS" != "0" ] || FAILED=true
+echo
+
+echo "4. And with -force-node-id:"
+start_c -node-id node-c -force-node-id
+sleep 3
+echo "C is $(cat "$WORKDIR/c/node_id")"
+[ "$(cat "$WORKDIR/c/node_id")" = "node-c" ] || FAILED=true
+check_views "3 nodes"
+OLD=$(curl -s "http://$NODE_A/cluster/status" | python3 -c "import json,sys; print([n['status'] for n in json.load(sys.stdin)['nodes'] if n['id'] == '$ID_C'])")
+echo "A has $ID_C as $OLD"
+[ "$OLD" = "['left']" ] || FAILED=true
+echo
+
+if $FAILED; then
+    echo "FAIL"
+    exit 1
+fi
+echo "PASS: nodes kept their identity across restarts"